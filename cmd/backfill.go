@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const trackerBackfillPendingKey = "backfill-pending"
+
+// backfillQueue records the tables which were created by the consumer and still need their data backfilled.
+// The fork records the tables and the server polls for them so it can run a targeted import.
+type backfillQueue struct {
+	logger  logger.Logger
+	tracker *tracker.Tracker
+	lock    sync.Mutex
+	tables  []string
+}
+
+// add records a new table as pending a backfill.
+func (q *backfillQueue) add(table string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if util.SliceContains(q.tables, table) {
+		return
+	}
+	q.tables = append(q.tables, table)
+	sort.Strings(q.tables)
+	if err := q.tracker.SetKey(trackerBackfillPendingKey, util.JSONStringify(q.tables), 0); err != nil {
+		q.logger.Error("error saving pending backfill tables: %s", err)
+	}
+	q.logger.Info("table %s is pending a backfill", table)
+}
+
+// pending returns the tables which are pending a backfill.
+func (q *backfillQueue) pending() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]string{}, q.tables...)
+}
+
+// newBackfillQueue loads the pending tables from the tracker, removing any which have since been imported.
+func newBackfillQueue(logger logger.Logger, theTracker *tracker.Tracker, tableData []TableExportInfo) (*backfillQueue, error) {
+	q := &backfillQueue{logger: logger, tracker: theTracker}
+	found, val, err := theTracker.GetKey(trackerBackfillPendingKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading pending backfill tables from tracker: %w", err)
+	}
+	if !found {
+		return q, nil
+	}
+	var tables []string
+	if err := json.Unmarshal([]byte(val), &tables); err != nil {
+		return nil, fmt.Errorf("error decoding pending backfill tables: %w", err)
+	}
+	imported := tableNames(tableData)
+	for _, table := range tables {
+		if !util.SliceContains(imported, table) {
+			q.tables = append(q.tables, table)
+		}
+	}
+	if len(q.tables) == len(tables) {
+		return q, nil
+	}
+	if len(q.tables) == 0 {
+		err = theTracker.DeleteKey(trackerBackfillPendingKey)
+	} else {
+		err = theTracker.SetKey(trackerBackfillPendingKey, util.JSONStringify(q.tables), 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error saving pending backfill tables: %w", err)
+	}
+	return q, nil
+}
+
+// getPendingBackfill asks the fork for the tables which are pending a backfill.
+func getPendingBackfill(port int) ([]string, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/control/backfill", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending backfill tables: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get pending backfill tables: %d", resp.StatusCode)
+	}
+	var tables []string
+	if err := json.NewDecoder(resp.Body).Decode(&tables); err != nil {
+		return nil, fmt.Errorf("failed to decode pending backfill tables: %w", err)
+	}
+	return tables, nil
+}
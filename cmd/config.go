@@ -0,0 +1,432 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/consumer"
+	"github.com/shopmonkeyus/eds/internal/control"
+	"github.com/shopmonkeyus/eds/internal/errcode"
+	"github.com/shopmonkeyus/eds/internal/feature"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	cstr "github.com/shopmonkeyus/go-common/string"
+	"github.com/spf13/cobra"
+)
+
+// configSetting is a single line of the effective configuration summary.
+type configSetting struct {
+	name  string
+	value string
+}
+
+// configReport is the effective configuration of the server with any problems found validating it. It's built before
+// connecting to anything so a misconfigured install fails with all of its problems at once instead of deep in startup.
+type configReport struct {
+	settings []configSetting
+	errors   []string
+}
+
+func (r *configReport) set(name string, format string, args ...any) {
+	r.settings = append(r.settings, configSetting{name, fmt.Sprintf(format, args...)})
+}
+
+func (r *configReport) fail(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// print logs the summary and then the errors. Secrets must already be masked.
+func (r *configReport) print(logger logger.Logger) {
+	var width int
+	for _, setting := range r.settings {
+		width = max(width, len(setting.name))
+	}
+	var summary strings.Builder
+	summary.WriteString("effective configuration:")
+	for _, setting := range r.settings {
+		summary.WriteString(fmt.Sprintf("\n  %-*s  %s", width, setting.name, setting.value))
+	}
+	logger.Info("%s", summary.String())
+	for _, err := range r.errors {
+		logger.With(map[string]any{"code": errcode.InvalidConfig}).Error("invalid configuration: %s (%s)", err, errcode.InvalidConfig)
+	}
+}
+
+func orDefault(vals []string, def string) string {
+	if len(vals) == 0 {
+		return def
+	}
+	return strings.Join(vals, ", ")
+}
+
+// checkFeatures validates the feature flags.
+func (r *configReport) checkFeatures(features []string) {
+	flags, err := feature.Parse(features)
+	if err != nil {
+		r.fail("--feature %s", err)
+		return
+	}
+	var values []string
+	for name, on := range flags {
+		values = append(values, fmt.Sprintf("%s=%v", name, on))
+	}
+	sort.Strings(values)
+	r.set("features", "%s", orDefault(values, "none"))
+}
+
+// checkDriverURL validates the driver url without connecting to it.
+func (r *configReport) checkDriverURL(driverURL string) {
+	if driverURL == "" {
+		r.set("driver", "not configured, waiting for configuration from HQ")
+		return
+	}
+	masked, err := util.MaskURL(driverURL)
+	if err != nil {
+		r.set("driver", "%s", cstr.Mask(driverURL))
+		r.fail("--url is not a valid url: %s", err)
+		return
+	}
+	r.set("driver", "%s", masked)
+	metadata, err := internal.GetDriverMetadataForURL(driverURL)
+	if err != nil {
+		r.fail("--url is not a valid url: %s", err)
+		return
+	}
+	if metadata == nil {
+		r.fail("--url uses an unsupported driver: %s. Run %s for the supported drivers", strings.SplitN(driverURL, ":", 2)[0], getCommandExample("server", "help"))
+	}
+}
+
+// checkNatsServers validates the comma separated nats server urls.
+func (r *configReport) checkNatsServers(servers string) {
+	r.set("nats", "%s", servers)
+	for _, server := range strings.Split(servers, ",") {
+		u, err := url.Parse(strings.TrimSpace(server))
+		if err != nil {
+			r.fail("--server has an invalid url: %s", err)
+			continue
+		}
+		switch u.Scheme {
+		case "nats", "tls", "ws", "wss":
+		default:
+			r.fail("--server must be nats://, tls://, ws:// or wss:// urls, was: %s", server)
+		}
+	}
+}
+
+// checkAPI validates the api key and resolves the api url from it unless an alternative url was provided.
+func (r *configReport) checkAPI(cmd *cobra.Command, apiurl string, apikey string) {
+	if apikey == "" {
+		r.set("api key", "not set")
+		r.fail("API key not found. Make sure you run %s before continuing", getCommandExample("enroll", "[CODE]"))
+		return
+	}
+	r.set("api key", "%s", cstr.Mask(apikey))
+	if cmd.Flags().Changed("api-url") {
+		if u, err := url.Parse(apiurl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			r.fail("--api-url must be a http or https url, was: %s", apiurl)
+		}
+		r.set("api url", "%s (alternative)", apiurl)
+		return
+	}
+	url, err := util.GetAPIURLFromJWT(apikey)
+	if err != nil {
+		r.fail("invalid API key. %s", err)
+		return
+	}
+	r.set("api url", "%s", url)
+}
+
+// checkConsumer validates the flags which are passed through to the fork for the consumer.
+func (r *configReport) checkConsumer(cmd *cobra.Command) {
+	flushPolicy, _ := cmd.Flags().GetString("flushPolicy")
+	if _, err := consumer.NewFlushPolicy(flushPolicy); err != nil {
+		r.fail("--flushPolicy: %s", err)
+	}
+	r.set("flush policy", "%s", flushPolicy)
+
+	minPendingLatency, _ := cmd.Flags().GetDuration("minPendingLatency")
+	maxPendingLatency, _ := cmd.Flags().GetDuration("maxPendingLatency")
+	emptyBufferPause, _ := cmd.Flags().GetDuration("empty-buffer-pause")
+	ackWait, _ := cmd.Flags().GetDuration("ack-wait")
+	maxDeliver, _ := cmd.Flags().GetInt("max-deliver")
+	redeliveryBackoff, _ := cmd.Flags().GetDurationSlice("redelivery-backoff")
+	reconnectTimeout, _ := cmd.Flags().GetDuration("reconnect-timeout")
+	tuning := consumer.ConsumerConfig{
+		MinPendingLatency:    minPendingLatency,
+		MaxPendingLatency:    maxPendingLatency,
+		EmptyBufferPauseTime: emptyBufferPause,
+		AckWait:              ackWait,
+		MaxDeliver:           maxDeliver,
+		RedeliveryBackoff:    redeliveryBackoff,
+		ReconnectTimeout:     reconnectTimeout,
+	}
+	if err := tuning.ValidateTuning(); err != nil {
+		r.fail("%s", err)
+	}
+	r.set("pending latency", "%v - %v", minPendingLatency, maxPendingLatency)
+	r.set("empty buffer pause", "%v", emptyBufferPause)
+	if len(redeliveryBackoff) > 0 {
+		r.set("redelivery backoff", "%v", redeliveryBackoff)
+	} else {
+		r.set("ack wait", "%v", ackWait)
+	}
+	r.set("max deliver", "%d", maxDeliver)
+	ackAll, _ := cmd.Flags().GetBool("ack-all")
+	if ackAll {
+		r.set("ack policy", "all")
+	} else {
+		r.set("ack policy", "explicit")
+	}
+	r.set("reconnect timeout", "%v", reconnectTimeout)
+
+	maxAckPending, _ := cmd.Flags().GetInt("maxAckPending")
+	maxPendingBuffer, _ := cmd.Flags().GetInt("maxPendingBuffer")
+	if maxAckPending <= 0 {
+		r.fail("--maxAckPending must be greater than 0")
+	}
+	if maxPendingBuffer <= 0 {
+		r.fail("--maxPendingBuffer must be greater than 0")
+	}
+	r.set("max ack pending", "%d (buffer %d)", maxAckPending, maxPendingBuffer)
+
+	backpressureThreshold, _ := cmd.Flags().GetInt("backpressure-threshold")
+	backpressureFlushLatency, _ := cmd.Flags().GetDuration("backpressure-flush-latency")
+	if backpressureThreshold < consumer.BackpressureDisabled {
+		r.fail("--backpressure-threshold must be -1 (disabled), 0 (default) or greater")
+	}
+	if backpressureFlushLatency < 0 {
+		r.fail("--backpressure-flush-latency must not be negative")
+	}
+	if backpressureThreshold == 0 {
+		backpressureThreshold = maxAckPending / 2
+	}
+	if backpressureThreshold == consumer.BackpressureDisabled {
+		r.set("backpressure", "buffered disabled, flush latency %s", durationOrDisabled(backpressureFlushLatency))
+	} else {
+		r.set("backpressure", "%d buffered, flush latency %s", backpressureThreshold, durationOrDisabled(backpressureFlushLatency))
+	}
+
+	maxBufferedMB, _ := cmd.Flags().GetInt64("max-buffered-mb")
+	spill, _ := cmd.Flags().GetBool("spill")
+	if maxBufferedMB < 0 {
+		r.fail("--max-buffered-mb must not be negative")
+	}
+	if spill && maxBufferedMB == 0 {
+		r.fail("--spill requires --max-buffered-mb")
+	}
+	r.set("max buffered", "%s, spill %v", sizeOrUnlimited(maxBufferedMB, "MB"), spill)
+
+	pull := pullOptionsFromFlags(cmd)
+	if err := pull.Validate(); err != nil {
+		r.fail("%s", err)
+	}
+	r.set("pull", "%s", pull)
+
+	memory := memoryConfigFromFlags(cmd)
+	if err := memory.Validate(); err != nil {
+		r.fail("%s", err)
+	}
+	memoryLimit := fmt.Sprintf("%dMB", memory.LimitMB)
+	switch {
+	case memory.LimitMB == internal.MemoryLimitDisabled:
+		memoryLimit = "disabled"
+	case memory.LimitMB == 0 && os.Getenv("GOMEMLIMIT") != "":
+		memoryLimit = "GOMEMLIMIT " + os.Getenv("GOMEMLIMIT")
+	case memory.LimitMB == 0:
+		memoryLimit = fmt.Sprintf("%d%% of system memory", memory.LimitPercent)
+	}
+	gcPercent := strconv.Itoa(memory.GCPercent)
+	switch memory.GCPercent {
+	case 0:
+		gcPercent = "default"
+	case internal.GCDisabled:
+		gcPercent = "off"
+	}
+	r.set("memory", "limit %s, gc percent %s, ballast %dMB", memoryLimit, gcPercent, memory.BallastMB)
+
+	ordering, _ := cmd.Flags().GetString("ordering")
+	if err := consumer.ValidateOrderingMode(ordering); err != nil {
+		r.fail("--ordering: %s", err)
+	}
+	r.set("ordering", "%s", orDefault(strings.Fields(ordering), "none"))
+	if ordering != consumer.OrderingModeNone {
+		orderingMaxKeys, _ := cmd.Flags().GetInt("ordering-max-keys")
+		if orderingMaxKeys <= 0 {
+			r.fail("--ordering-max-keys must be greater than 0")
+		}
+		r.set("ordering max keys", "%d", orderingMaxKeys)
+	}
+
+	pipelines, _ := cmd.Flags().GetInt("pipelines")
+	pipelineShard, _ := cmd.Flags().GetString("pipeline-shard")
+	if pipelines < 1 {
+		r.fail("--pipelines must be at least 1")
+	}
+	if err := consumer.ValidatePipelineShard(pipelineShard); err != nil {
+		r.fail("--pipeline-shard: %s", err)
+	}
+	if pipelines > 1 {
+		r.set("pipelines", "%d sharded by %s", pipelines, pipelineShard)
+	} else {
+		r.set("pipelines", "1")
+	}
+	if ackAll, _ := cmd.Flags().GetBool("ack-all"); ackAll && pipelines > 1 {
+		r.fail("--ack-all can't be used with more than 1 pipeline")
+	}
+	journal, _ := cmd.Flags().GetBool("journal")
+	if journal && pipelines > 1 {
+		r.fail("--journal can't be used with more than 1 pipeline")
+	}
+	r.set("journal", "%v", journal)
+
+	quotas, _ := cmd.Flags().GetStringSlice("companyQuota")
+	if _, err := consumer.ParseCompanyQuotas(quotas); err != nil {
+		r.fail("--companyQuota: %s", err)
+	}
+	r.set("company quotas", "%s", orDefault(quotas, "none"))
+
+	isolateCompanies, _ := cmd.Flags().GetBool("isolate-companies")
+	r.set("isolate companies", "%v", isolateCompanies)
+
+	retryMaxAttempts, _ := cmd.Flags().GetInt("retry-max-attempts")
+	if retryMaxAttempts < 0 {
+		r.fail("--retry-max-attempts must not be negative")
+	}
+	if retryMaxAttempts == 0 {
+		r.set("retry queue", "disabled")
+	} else {
+		r.set("retry queue", "%d attempts", retryMaxAttempts)
+	}
+
+	flushGroupValues, _ := cmd.Flags().GetStringArray("flush-group")
+	if _, err := consumer.ParseFlushGroups(flushGroupValues); err != nil {
+		r.fail("--flush-group: %s", err)
+	}
+	if len(flushGroupValues) == 0 {
+		r.set("flush groups", "none")
+	} else {
+		r.set("flush groups", "%s", strings.Join(flushGroupValues, "; "))
+	}
+
+	fieldFilterValues, _ := cmd.Flags().GetStringArray("field-filter")
+	if _, err := consumer.ParseFieldFilters(fieldFilterValues); err != nil {
+		r.fail("--field-filter: %s", err)
+	}
+	if len(fieldFilterValues) == 0 {
+		r.set("field filters", "none")
+	} else {
+		r.set("field filters", "%s", strings.Join(fieldFilterValues, "; "))
+	}
+
+	labels, _ := cmd.Flags().GetStringSlice("metrics-labels")
+	if err := internal.SetMetricLabels(labels); err != nil {
+		r.fail("--metrics-labels: %s", err)
+	}
+	r.set("metrics labels", "%s", orDefault(labels, "none"))
+
+	maxEventSizeKB, _ := cmd.Flags().GetInt("max-event-size-kb")
+	if maxEventSizeKB < 0 {
+		r.fail("--max-event-size-kb must not be negative")
+	}
+	scratchQuotaMB, _ := cmd.Flags().GetInt64("scratch-quota-mb")
+	if scratchQuotaMB < 0 {
+		r.fail("--scratch-quota-mb must not be negative")
+	}
+	r.set("limits", "max event size %s, scratch quota %s", sizeOrUnlimited(int64(maxEventSizeKB), "KB"), sizeOrUnlimited(scratchQuotaMB, "MB"))
+}
+
+func durationOrDisabled(val time.Duration) string {
+	if val <= 0 {
+		return "disabled"
+	}
+	return val.String()
+}
+
+func sizeOrUnlimited(val int64, unit string) string {
+	if val <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d%s", val, unit)
+}
+
+// checkServerConfig validates the server flags and configuration without connecting to anything.
+func checkServerConfig(cmd *cobra.Command, apiurl string, apikey string, driverURL string, dataDir string, tables []string, features []string) *configReport {
+	var r configReport
+	r.set("data dir", "%s", dataDir)
+	r.checkAPI(cmd, apiurl, apikey)
+	r.checkDriverURL(driverURL)
+	server, _ := cmd.Flags().GetString("server")
+	r.checkNatsServers(server)
+	r.set("tables", "%s", orDefault(tables, "all"))
+	only, _ := cmd.Flags().GetStringSlice("only")
+	except, _ := cmd.Flags().GetStringSlice("except")
+	for _, table := range except {
+		if util.SliceContains(only, table) {
+			r.fail("--except table %s is also in --only", table)
+		}
+	}
+	if len(only) > 0 || len(except) > 0 {
+		r.set("table filter", "only %s, except %s", orDefault(only, "all"), orDefault(except, "none"))
+	}
+	locationIds, _ := cmd.Flags().GetStringSlice("locationIds")
+	r.set("locations", "%s", orDefault(locationIds, "all"))
+	r.checkFeatures(features)
+
+	port, _ := cmd.Flags().GetInt("port")
+	if oldHealthPort, _ := cmd.Flags().GetInt("health-port"); oldHealthPort > 0 {
+		port = oldHealthPort
+	}
+	if port <= 0 || port > 65535 {
+		r.fail("--port must be between 1 and 65535, was: %d", port)
+	}
+	r.set("port", "%d", port)
+
+	if dir, _ := cmd.Flags().GetString("schema-validator"); dir != "" {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			r.fail("--schema-validator must be an existing directory: %s", dir)
+		}
+		r.set("schema validator", "%s", dir)
+	}
+
+	renew, _ := cmd.Flags().GetDuration("renew-interval")
+	if renew <= 0 {
+		r.fail("--renew-interval must be greater than 0")
+	}
+	r.set("renew interval", "%v", renew)
+
+	r.checkConsumer(cmd)
+
+	maxEventsPerSecond, _ := cmd.Flags().GetStringSlice("max-events-per-second")
+	if rate, err := consumer.ParseMaxEventsPerSecond(maxEventsPerSecond, driverScheme(driverURL)); err != nil {
+		r.fail("--max-events-per-second: %s", err)
+	} else if rate > 0 {
+		r.set("max events per second", "%v", rate)
+	} else {
+		r.set("max events per second", "unlimited")
+	}
+
+	remoteControl, _ := cmd.Flags().GetStringSlice("remote-control")
+	if err := control.ValidateAllowlist(remoteControl); err != nil {
+		r.fail("--remote-control: %s", err)
+	} else if len(remoteControl) > 0 {
+		r.set("remote control", "%s", strings.Join(remoteControl, ", "))
+	} else {
+		r.set("remote control", "disabled")
+	}
+	return &r
+}
+
+// driverScheme returns the scheme of the driver for the url, resolving an alias, or an empty string if not supported.
+func driverScheme(driverURL string) string {
+	if metadata, err := internal.GetDriverMetadataForURL(driverURL); err == nil && metadata != nil {
+		return metadata.Scheme
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const defaultDrainTimeout = time.Minute
+
+// postDrain asks the fork to stop pulling and flush the pending events, waiting up to the timeout for them to be acked.
+func postDrain(port int, timeout time.Duration) error {
+	query := url.Values{"timeout": []string{timeout.String()}}
+	client := http.Client{Timeout: timeout + 5*time.Second} // the fork answers once the drain is done or the timeout passes
+	resp, err := client.Post(fmt.Sprintf("http://127.0.0.1:%d/control/drain?%s", port, query.Encode()), "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("failed to drain: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to drain: %d: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+	return nil
+}
+
+var drainCmd = &cobra.Command{
+	Use:   "drain",
+	Short: "Stop pulling new messages and flush the pending events of the running server",
+	Long:  "Stop pulling new messages and flush the pending events of the running server so they're acked, such as before a shutdown.\nPulling stays paused until the server is unpaused or restarted.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger(cmd).WithPrefix("[drain]")
+		port := mustFlagInt(cmd, "port", true)
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		if timeout <= 0 {
+			logger.Fatal("--timeout must be greater than 0")
+		}
+		started := time.Now()
+		if err := postDrain(port, timeout); err != nil {
+			logger.Fatal("%s", err)
+		}
+		logger.Info("drained in %v", time.Since(started).Round(time.Millisecond))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(drainCmd)
+	drainCmd.Flags().Int("port", getOSInt("PORT", 8080), "the port the server is listening on for health checks, metrics etc")
+	drainCmd.Flags().Duration("timeout", defaultDrainTimeout, "how long to wait for the pending events to be flushed")
+}
@@ -0,0 +1,6 @@
+//go:build use_databricks || !use_custom_driver
+// +build use_databricks !use_custom_driver
+
+package cmd
+
+import _ "github.com/shopmonkeyus/eds/internal/drivers/databricks"
@@ -1,5 +1,5 @@
-//go:build use_postgres || use_postgresql || !use_custom_driver
-// +build use_postgres use_postgresql !use_custom_driver
+//go:build use_postgres || use_postgresql || use_cockroach || !use_custom_driver
+// +build use_postgres use_postgresql use_cockroach !use_custom_driver
 
 package cmd
 
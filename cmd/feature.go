@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal/feature"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// featureFlagsHelp returns the help for the --feature flag with the feature flags this version understands.
+func featureFlagsHelp() string {
+	var flags []string
+	for _, name := range feature.Known() {
+		flags = append(flags, name+": "+feature.Description(name))
+	}
+	return "enable or disable a feature flag using name or name=bool (" + strings.Join(flags, ", ") + "). this is normally set by Shopmonkey"
+}
+
+// setFeatureFlags parses the feature flags and replaces the feature flags of the process.
+func setFeatureFlags(logger logger.Logger, values []string) error {
+	flags, err := feature.Parse(values)
+	if err != nil {
+		return err
+	}
+	for name := range flags {
+		if !feature.IsKnown(name) {
+			logger.Debug("ignoring unknown feature flag: %s", name)
+		}
+	}
+	feature.Set(flags)
+	if enabled := feature.EnabledFlags(); len(enabled) > 0 {
+		logger.Info("enabled features: %s", strings.Join(enabled, ", "))
+	} else {
+		logger.Debug("no features enabled")
+	}
+	return nil
+}
+
+// postFeatureFlags sends the feature flags to the fork so they're changed without a restart.
+func postFeatureFlags(port int, values []string) error {
+	if values == nil {
+		values = []string{}
+	}
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/control/features", port), "application/json", strings.NewReader(util.JSONStringify(values)))
+	if err != nil {
+		return fmt.Errorf("failed to change features: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to change features: %d", resp.StatusCode)
+	}
+	return nil
+}
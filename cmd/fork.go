@@ -2,21 +2,31 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shopmonkeyus/eds/internal"
 	"github.com/shopmonkeyus/eds/internal/consumer"
+	"github.com/shopmonkeyus/eds/internal/control"
+	"github.com/shopmonkeyus/eds/internal/errcode"
 	"github.com/shopmonkeyus/eds/internal/registry"
+	"github.com/shopmonkeyus/eds/internal/scratch"
 	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/eds/internal/usage"
 	"github.com/shopmonkeyus/eds/internal/util"
 	"github.com/shopmonkeyus/go-common/logger"
 	"github.com/shopmonkeyus/go-common/sys"
@@ -32,11 +42,64 @@ const (
 	exitCodeNatsDisconnected = 5
 )
 
+type companyPause struct {
+	companyID string
+	pause     bool
+}
+
+type tablesChange struct {
+	tables []string
+	result chan error
+}
+
+type schemaRefreshResult struct {
+	migrated []string
+	err      error
+}
+
+type schemaRefresh struct {
+	tables []string
+	result chan schemaRefreshResult
+}
+
+// forkConsumer is the consumer for all the companies or the consumers of each company when they're isolated.
+type forkConsumer interface {
+	Stop() error
+	Error() <-chan error
+	Disconnected() <-chan bool
+	Pause()
+	Unpause() error
+	PauseCompany(companyID string)
+	UnpauseCompany(companyID string)
+	PauseTable(table string)
+	UnpauseTable(table string)
+	SetTables(tables []string) error
+	RefreshSchema(tables []string) ([]string, error)
+	Drain(ctx context.Context) error
+	Replay(ctx context.Context, opts consumer.ReplayOptions) (consumer.ReplayResult, error)
+}
+
+type drainRequest struct {
+	timeout time.Duration
+	result  chan error
+}
+
+type replayResult struct {
+	result consumer.ReplayResult
+	err    error
+}
+
+type replayRequest struct {
+	opts   consumer.ReplayOptions
+	ctx    context.Context
+	result chan replayResult
+}
+
 func runHealthCheckServerFork(logger logger.Logger, port int) {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(internal.MetricsGatherer(), promhttp.HandlerOpts{})))
 	go func() {
 		defer util.RecoverPanic(logger)
 		if err := http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", port), nil); err != nil && err != http.ErrServerClosed {
@@ -54,8 +117,15 @@ var forkCmd = &cobra.Command{
 		serverStarted := time.Now()
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		logger := newLogger(cmd)
+		// the console log level can be changed while running, the log file always has every level
+		consoleLogger := newLevelLogger(newLoggerWithLevel(cmd, logger.LevelTrace), consoleLogLevel(cmd))
+		var logger logger.Logger = consoleLogger
 		companyIds, _ := cmd.Flags().GetStringSlice("companyIds")
+		locationIds, _ := cmd.Flags().GetStringSlice("locationIds")
+		tables, _ := cmd.Flags().GetStringSlice("tables")
+		onlyTables, _ := cmd.Flags().GetStringSlice("only")
+		exceptTables, _ := cmd.Flags().GetStringSlice("except")
+		features, _ := cmd.Flags().GetStringSlice("feature")
 		datadir := mustFlagString(cmd, "data-dir", true)
 		logDir := mustFlagString(cmd, "logs-dir", true)
 		sink, err := newLogFileSink(logDir)
@@ -67,6 +137,13 @@ var forkCmd = &cobra.Command{
 		logger.Trace("using log file sink: %s", logDir)
 		logger = newLoggerWithSink(logger, sink).WithPrefix("[fork]")
 
+		memory, err := internal.ApplyMemoryConfig(memoryConfigFromFlags(cmd))
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+		logger.Debug("memory settings: %s", memory)
+
 		defer util.RecoverPanic(logger)
 
 		natsurl := mustFlagString(cmd, "server", true)
@@ -77,14 +154,87 @@ var forkCmd = &cobra.Command{
 		maxPendingBuffer := mustFlagInt(cmd, "maxPendingBuffer", false)
 		minPendingLatency, _ := cmd.Flags().GetDuration("minPendingLatency")
 		maxPendingLatency, _ := cmd.Flags().GetDuration("maxPendingLatency")
+		emptyBufferPause, _ := cmd.Flags().GetDuration("empty-buffer-pause")
+		ackWait, _ := cmd.Flags().GetDuration("ack-wait")
+		maxDeliver, _ := cmd.Flags().GetInt("max-deliver")
+		redeliveryBackoff, _ := cmd.Flags().GetDurationSlice("redelivery-backoff")
+		ackAll, _ := cmd.Flags().GetBool("ack-all")
+		reconnectTimeout, _ := cmd.Flags().GetDuration("reconnect-timeout")
 		port := mustFlagInt(cmd, "port", false)
+		maxEventSizeKB, _ := cmd.Flags().GetInt("max-event-size-kb")
+		backpressureThreshold, _ := cmd.Flags().GetInt("backpressure-threshold")
+		backpressureFlushLatency, _ := cmd.Flags().GetDuration("backpressure-flush-latency")
+		maxBufferedMB, _ := cmd.Flags().GetInt64("max-buffered-mb")
+		pipelines, _ := cmd.Flags().GetInt("pipelines")
+		pipelineShard, _ := cmd.Flags().GetString("pipeline-shard")
+		retryMaxAttempts, _ := cmd.Flags().GetInt("retry-max-attempts")
+		pullOptions := pullOptionsFromFlags(cmd)
+		var retryDir string
+		if retryMaxAttempts > 0 {
+			retryDir = filepath.Join(datadir, "retry")
+		}
+		var journalDir string
+		if journal, _ := cmd.Flags().GetBool("journal"); journal {
+			journalDir = filepath.Join(datadir, "journal")
+		}
+		var spillDir string
+		if spill, _ := cmd.Flags().GetBool("spill"); spill {
+			spillDir = filepath.Join(datadir, "spill")
+		}
+
+		flushPolicy, err := consumer.NewFlushPolicy(mustFlagString(cmd, "flushPolicy", false))
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+
+		flushGroupValues, _ := cmd.Flags().GetStringArray("flush-group")
+		flushGroups, err := consumer.ParseFlushGroups(flushGroupValues)
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
 
-		// check to see if there's a schema validator and if so load it
-		validator, err := loadSchemaValidator(cmd)
+		fieldFilterValues, _ := cmd.Flags().GetStringArray("field-filter")
+		fieldFilters, err := consumer.ParseFieldFilters(fieldFilterValues)
 		if err != nil {
-			logger.Fatal("error loading validator: %s", err)
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+
+		companyQuotaValues, _ := cmd.Flags().GetStringSlice("companyQuota")
+		companyQuotas, err := consumer.ParseCompanyQuotas(companyQuotaValues)
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+
+		maxEventsPerSecondValues, _ := cmd.Flags().GetStringSlice("max-events-per-second")
+		maxEventsPerSecond, err := consumer.ParseMaxEventsPerSecond(maxEventsPerSecondValues, driverScheme(url))
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+
+		metricsLabels, _ := cmd.Flags().GetStringSlice("metrics-labels")
+		if err := internal.SetMetricLabels(metricsLabels); err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+
+		if err := setFeatureFlags(logger, features); err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
 		}
 
+		orderingMode := mustFlagString(cmd, "ordering", false)
+		if err := consumer.ValidateOrderingMode(orderingMode); err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+		orderingMaxKeys, _ := cmd.Flags().GetInt("ordering-max-keys")
+		isolateCompanies, _ := cmd.Flags().GetBool("isolate-companies")
+
 		tracker, err := tracker.NewTracker(tracker.TrackerConfig{
 			Logger:  logger,
 			Context: ctx,
@@ -96,6 +246,35 @@ var forkCmd = &cobra.Command{
 		}
 		defer tracker.Close()
 
+		// the consumer and the paused tables stay paused across restarts until they're unpaused
+		pausedAt, err := loadPausedAt(tracker)
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+		if pausedAt != nil {
+			logger.Warn("consumer is paused since %s", pausedAt.Format(time.RFC3339))
+		}
+		pausedTables, err := loadPausedTables(logger, tracker, ackAll)
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+		if len(pausedTables) > 0 {
+			logger.Warn("tables are paused: %s", strings.Join(pausedTables, ", "))
+		}
+
+		// check to see if there's a schema validator and if so load it and watch for changes
+		var validator internal.SchemaValidator
+		if schemaDir := mustFlagString(cmd, "schema-validator", false); schemaDir != "" {
+			reloadable, err := util.NewReloadableSchemaValidator(ctx, logger, schemaDir, util.WithSchemaValidatorTracker(tracker))
+			if err != nil {
+				logger.Fatal("error loading validator: %s", err)
+			}
+			defer reloadable.Close()
+			validator = reloadable
+		}
+
 		apiUrl := mustFlagString(cmd, "api-url", true)
 		schemaRegistry, err := registry.NewAPIRegistry(ctx, logger, apiUrl, Version, tracker)
 		if err != nil {
@@ -114,8 +293,35 @@ var forkCmd = &cobra.Command{
 			exportTableTimestamps[data.Table] = &data.Timestamp
 		}
 
+		scratchQuotaMB, _ := cmd.Flags().GetInt64("scratch-quota-mb")
+		encryptScratch, _ := cmd.Flags().GetBool("encrypt-scratch")
+		scratchSpace, err := scratch.NewManager(logger, filepath.Join(datadir, "scratch"), scratchQuotaMB*1024*1024, encryptScratch)
+		if err != nil {
+			logger.Error("error creating scratch space: %s", err)
+			os.Exit(exitCodeIncorrectUsage)
+		}
+
+		// the driver connects when it's started so wait for the destination to be reachable first instead of exiting
+		waitForDestination, _ := cmd.Flags().GetBool("wait-for-destination")
+		waitForDestinationTimeout, _ := cmd.Flags().GetDuration("wait-for-destination-timeout")
+		var destinationCheck func(ctx context.Context) error
+		if waitForDestination {
+			unstarted, err := internal.NewDriverForImport(ctx, logger, url, schemaRegistry, tracker, datadir)
+			if err != nil {
+				logger.Error("error creating driver: %s", err)
+				os.Exit(exitCodeIncorrectUsage)
+			}
+			destinationCheck = func(ctx context.Context) error {
+				return unstarted.Test(ctx, logger, url)
+			}
+			if err := consumer.WaitForDestination(ctx, logger, waitForDestinationTimeout, destinationCheck); err != nil {
+				logger.Error("error waiting for destination: %s", err)
+				os.Exit(1)
+			}
+		}
+
 		// note: don't use ctx here because we want the driver to continue running during shutdown so we can control the flush
-		driver, err := internal.NewDriver(context.Background(), logger, url, schemaRegistry, tracker, datadir)
+		driver, err := internal.NewDriver(context.Background(), logger, url, schemaRegistry, tracker, datadir, scratchSpace)
 		if err != nil {
 			logger.Error("error creating driver: %s", err)
 			os.Exit(exitCodeIncorrectUsage)
@@ -125,6 +331,29 @@ var forkCmd = &cobra.Command{
 
 		runHealthCheckServerFork(logger, port)
 
+		usageRecorder := usage.NewRecorder(tracker)
+		// the session is kept in the tracker so the consumer resumes it when the server restarts this process
+		sessions := consumer.NewSessionStore(logger, tracker)
+		http.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+			days := 1
+			if val := r.URL.Query().Get("days"); val != "" {
+				d, err := strconv.Atoi(val)
+				if err != nil || d <= 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				days = d
+			}
+			rollups, err := usageRecorder.Rollups(days)
+			if err != nil {
+				logger.Error("error getting usage: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(util.JSONStringify(rollups)))
+		})
+
 		// create a channel to listen for signals to control the process
 		restart := make(chan os.Signal, 1)
 		signal.Notify(restart, syscall.SIGHUP)
@@ -133,15 +362,141 @@ var forkCmd = &cobra.Command{
 		wg.Add(1)
 
 		restartFlag, _ := cmd.Flags().GetBool("restart")
+		fixStartPosition, _ := cmd.Flags().GetBool("fix-start-position")
+		preMigrate, _ := cmd.Flags().GetBool("pre-migrate")
+		repairSchemaDrift, _ := cmd.Flags().GetBool("repair-schema-drift")
 
 		// the ability to control the process from HTTP control channel
+		// passing a companyId will only pause that company and a table only that table instead of the entire consumer
 		pauseCh := make(chan bool)
+		companyPauseCh := make(chan companyPause)
+		tablePauseCh := make(chan tablePause)
 		http.HandleFunc("/control/pause", func(w http.ResponseWriter, r *http.Request) {
-			pauseCh <- true
+			if companyID := r.URL.Query().Get("companyId"); companyID != "" {
+				companyPauseCh <- companyPause{companyID, true}
+			} else if table := r.URL.Query().Get("table"); table != "" {
+				if ackAll {
+					http.Error(w, errAckAllTablePause.Error(), http.StatusConflict)
+					return
+				}
+				tablePauseCh <- tablePause{table, true}
+			} else {
+				pauseCh <- true
+			}
 			w.WriteHeader(http.StatusOK)
 		})
 		http.HandleFunc("/control/unpause", func(w http.ResponseWriter, r *http.Request) {
-			pauseCh <- false
+			if companyID := r.URL.Query().Get("companyId"); companyID != "" {
+				companyPauseCh <- companyPause{companyID, false}
+			} else if table := r.URL.Query().Get("table"); table != "" {
+				tablePauseCh <- tablePause{table, false}
+			} else {
+				pauseCh <- false
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		// the tables can be changed without restarting the consumer, an empty list allows all tables
+		tablesCh := make(chan tablesChange)
+		http.HandleFunc("/control/tables", func(w http.ResponseWriter, r *http.Request) {
+			var change tablesChange
+			if err := json.NewDecoder(r.Body).Decode(&change.tables); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			change.result = make(chan error, 1)
+			tablesCh <- change
+			if err := <-change.result; err != nil {
+				logger.Error("error changing tables: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		// the latest schema can be fetched and the tables migrated without restarting, an empty list migrates all tables
+		schemaRefreshCh := make(chan schemaRefresh)
+		http.HandleFunc("/control/schema/refresh", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req schemaRefresh
+			if err := json.NewDecoder(r.Body).Decode(&req.tables); err != nil && !errors.Is(err, io.EOF) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			req.result = make(chan schemaRefreshResult, 1)
+			schemaRefreshCh <- req
+			res := <-req.result
+			if res.err != nil {
+				logger.Error("error refreshing schema: %s", res.err)
+				http.Error(w, res.err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if res.migrated == nil {
+				res.migrated = []string{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(util.JSONStringify(res.migrated)))
+		})
+		// the pending events can be flushed and acked before a shutdown, pulling stays paused until unpaused
+		drainCh := make(chan drainRequest)
+		http.HandleFunc("/control/drain", func(w http.ResponseWriter, r *http.Request) {
+			req := drainRequest{timeout: defaultDrainTimeout, result: make(chan error, 1)}
+			if val := r.URL.Query().Get("timeout"); val != "" {
+				timeout, err := time.ParseDuration(val)
+				if err != nil || timeout <= 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				req.timeout = timeout
+			}
+			drainCh <- req
+			if err := <-req.result; err != nil {
+				logger.Error("error draining: %s", err)
+				status := http.StatusInternalServerError
+				if errors.Is(err, context.DeadlineExceeded) {
+					status = http.StatusGatewayTimeout
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		// the events of a time range can be processed again without moving the durable consumer
+		replayCh := make(chan replayRequest)
+		http.HandleFunc("/control/replay", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			opts, err := parseReplayQuery(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req := replayRequest{opts: opts, ctx: r.Context(), result: make(chan replayResult, 1)}
+			replayCh <- req
+			res := <-req.result
+			if res.err != nil {
+				logger.Error("error replaying: %s", res.err)
+				http.Error(w, res.err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(util.JSONStringify(res.result)))
+		})
+		// the feature flags can be changed without restarting since they are checked as they're used
+		http.HandleFunc("/control/features", func(w http.ResponseWriter, r *http.Request) {
+			var values []string
+			if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := setFeatureFlags(logger, values); err != nil {
+				logger.Error("error changing features: %s", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 		})
 		http.HandleFunc("/control/restart", func(w http.ResponseWriter, r *http.Request) {
@@ -163,6 +518,60 @@ var forkCmd = &cobra.Command{
 			w.Write([]byte(fn))
 		})
 
+		// the control plane can send signed commands over nats for the actions which are allowed
+		if remoteControl, _ := cmd.Flags().GetStringSlice("remote-control"); len(remoteControl) > 0 {
+			stopRemoteControl, err := startRemoteControl(remoteControlConfig{
+				logger:  logger,
+				natsurl: natsurl,
+				creds:   creds,
+				datadir: datadir,
+				allow:   remoteControl,
+				handler: control.Handler{
+					Pause: func(args map[string]string) error {
+						pauseArgs(args, true, pauseCh, companyPauseCh, tablePauseCh)
+						return nil
+					},
+					Unpause: func(args map[string]string) error {
+						pauseArgs(args, false, pauseCh, companyPauseCh, tablePauseCh)
+						return nil
+					},
+					Restart: func() error {
+						restart <- syscall.SIGHUP
+						return nil
+					},
+					RotateLogs:  sink.Rotate,
+					SetLogLevel: consoleLogger.SetLevel,
+				},
+			})
+			if err != nil {
+				logger.Error("error starting remote control: %s", err)
+				os.Exit(exitCodeIncorrectUsage)
+			}
+			defer stopRemoteControl()
+		}
+
+		// support can read back a destination table to verify its contents
+		http.HandleFunc("/control/snapshot", snapshotHandler(logger, driver))
+
+		// tables created by the consumer are recorded so the server can backfill them
+		var onNewTable func(table string)
+		if backfillNewTables, _ := cmd.Flags().GetBool("backfill-new-tables"); backfillNewTables {
+			backfill, err := newBackfillQueue(logger, tracker, tableData)
+			if err != nil {
+				logger.Error("%s", err)
+				os.Exit(exitCodeIncorrectUsage)
+			}
+			onNewTable = backfill.add
+			http.HandleFunc("/control/backfill", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(util.JSONStringify(backfill.pending())))
+			})
+		}
+
+		// heartbeats which can't be published to nats are picked up by the server and sent to the api
+		var heartbeats heartbeatFallback
+		http.Handle("/control/heartbeat", &heartbeats)
+
 		var exitCode int
 		go func() {
 			defer util.RecoverPanic(logger)
@@ -171,31 +580,82 @@ var forkCmd = &cobra.Command{
 				wg.Done()
 			}()
 			var completed bool
-			var paused bool
-			var localConsumer *consumer.Consumer
+			paused := pausedAt != nil // the consumer is created paused
+			var localConsumer forkConsumer
 			var err error
 			for !completed {
-				if !paused && localConsumer == nil {
-					localConsumer, err = consumer.NewConsumer(consumer.ConsumerConfig{
-						Context:               ctx,
-						Logger:                logger,
-						URL:                   natsurl,
-						Credentials:           creds,
-						Suffix:                consumerSuffix,
-						MaxAckPending:         maxAckPending,
-						MaxPendingBuffer:      maxPendingBuffer,
-						Driver:                driver,
-						ExportTableTimestamps: exportTableTimestamps,
-						DeliverAll:            restartFlag,
-						SchemaValidator:       validator,
-						CompanyIDs:            companyIds,
-						Registry:              schemaRegistry,
-						MinPendingLatency:     minPendingLatency,
-						MaxPendingLatency:     maxPendingLatency,
-					})
+				if localConsumer == nil {
+					config := consumer.ConsumerConfig{
+						Context:                     ctx,
+						Logger:                      logger,
+						URL:                         natsurl,
+						Credentials:                 creds,
+						Suffix:                      consumerSuffix,
+						MaxAckPending:               maxAckPending,
+						MaxPendingBuffer:            maxPendingBuffer,
+						Driver:                      driver,
+						DriverURL:                   url,
+						ExportTableTimestamps:       exportTableTimestamps,
+						DeliverAll:                  restartFlag,
+						FixStartPosition:            fixStartPosition,
+						SchemaValidator:             validator,
+						QuarantineDir:               filepath.Join(datadir, "quarantine"),
+						RetryDir:                    retryDir,
+						RetryMaxAttempts:            retryMaxAttempts,
+						JournalDir:                  journalDir,
+						CompanyIDs:                  companyIds,
+						LocationIDs:                 locationIds,
+						Tables:                      tables,
+						OnlyTables:                  onlyTables,
+						ExceptTables:                exceptTables,
+						Registry:                    schemaRegistry,
+						MinPendingLatency:           minPendingLatency,
+						MaxPendingLatency:           maxPendingLatency,
+						EmptyBufferPauseTime:        emptyBufferPause,
+						Version:                     Version,
+						AckWait:                     ackWait,
+						MaxDeliver:                  maxDeliver,
+						RedeliveryBackoff:           redeliveryBackoff,
+						AckAll:                      ackAll,
+						ReconnectTimeout:            reconnectTimeout,
+						FlushPolicy:                 flushPolicy,
+						OrderingMode:                orderingMode,
+						OrderingMaxKeys:             orderingMaxKeys,
+						CompanyQuotas:               companyQuotas,
+						MaxEventsPerSecond:          maxEventsPerSecond,
+						PausedTables:                pausedTables,
+						PausedAt:                    pausedAt,
+						FlushGroups:                 flushGroups,
+						FieldFilters:                fieldFilters,
+						Usage:                       usageRecorder,
+						Sessions:                    sessions,
+						OnNewTable:                  onNewTable,
+						PreMigrate:                  preMigrate,
+						RepairSchemaDrift:           repairSchemaDrift,
+						DestinationCheck:            destinationCheck,
+						DestinationMaxWait:          waitForDestinationTimeout,
+						HeartbeatFallback:           heartbeats.set,
+						MaxEventSize:                maxEventSizeKB * 1024,
+						BackpressureThreshold:       backpressureThreshold,
+						BackpressureMaxFlushLatency: backpressureFlushLatency,
+						MaxBufferedBytes:            maxBufferedMB * 1024 * 1024,
+						SpillDir:                    spillDir,
+						ParkDir:                     filepath.Join(datadir, "parked"),
+						Pull:                        pullOptions,
+						Pipelines:                   pipelines,
+						PipelineShard:               pipelineShard,
+						NewPipelineDriver: func() (consumer.Driver, error) {
+							return internal.NewDriverInstance(context.Background(), logger, url, schemaRegistry, tracker, datadir, scratchSpace)
+						},
+					}
+					if isolateCompanies {
+						localConsumer, err = consumer.NewCompanyConsumers(config)
+					} else {
+						localConsumer, err = consumer.NewConsumer(config)
+					}
 					if err != nil {
-						logger.Error("error creating consumer: %s", err)
-						os.Exit(1)
+						logger.With(errcode.Fields(err)).Error("error creating consumer: %s (%s)", err, errcode.Of(err))
+						os.Exit(errcode.ExitCode(err))
 					}
 					if localConsumer != nil {
 						go func() {
@@ -218,14 +678,15 @@ var forkCmd = &cobra.Command{
 					}
 				case err := <-localConsumer.Error():
 					if errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrDisconnected) {
-						logger.Warn("nats server / consumer needs reconnection: %s", err)
+						err = errcode.New(errcode.NatsDisconnected, err)
+						logger.With(errcode.Fields(err)).Warn("nats server / consumer needs reconnection: %s", err)
 					} else {
-						logger.Error("error from consumer: %s", err)
+						logger.With(errcode.Fields(err)).Error("error from consumer: %s (%s)", err, errcode.Of(err))
 					}
 					if err := localConsumer.Stop(); err != nil {
 						logger.Error("error stopping consumer: %s", err)
 					}
-					exitCode = 1
+					exitCode = errcode.ExitCode(err)
 					return
 				case sig := <-restart:
 					switch sig {
@@ -241,7 +702,88 @@ var forkCmd = &cobra.Command{
 						logger.Error("error stopping consumer: %s", err)
 					}
 					localConsumer = nil
+				case req := <-companyPauseCh:
+					if localConsumer == nil {
+						logger.Warn("cannot pause company %s, consumer is not running", req.companyID)
+					} else if req.pause {
+						localConsumer.PauseCompany(req.companyID)
+					} else {
+						localConsumer.UnpauseCompany(req.companyID)
+					}
+				case req := <-tablePauseCh:
+					var err error
+					if pausedTables, err = updatePausedTables(tracker, pausedTables, req, ackAll); err != nil {
+						if errors.Is(err, errAckAllTablePause) {
+							logger.Warn("can't pause table %s: %s", req.table, err)
+							continue
+						}
+						logger.Error("%s", err)
+					}
+					if localConsumer == nil {
+						continue // the consumer starts with the paused tables
+					}
+					if req.pause {
+						localConsumer.PauseTable(req.table)
+					} else {
+						localConsumer.UnpauseTable(req.table)
+					}
+				case change := <-tablesCh:
+					if localConsumer != nil {
+						if err := localConsumer.SetTables(change.tables); err != nil {
+							change.result <- err
+							continue
+						}
+					}
+					tables = change.tables
+					change.result <- nil
+				case req := <-schemaRefreshCh:
+					if localConsumer == nil {
+						req.result <- schemaRefreshResult{err: fmt.Errorf("cannot refresh schema, consumer is not running")}
+						continue
+					}
+					migrated, err := localConsumer.RefreshSchema(req.tables)
+					req.result <- schemaRefreshResult{migrated, err}
+				case req := <-drainCh:
+					if localConsumer == nil {
+						req.result <- fmt.Errorf("cannot drain, consumer is not running")
+						continue
+					}
+					drainCtx, cancelDrain := context.WithTimeout(ctx, req.timeout)
+					err := localConsumer.Drain(drainCtx)
+					cancelDrain()
+					paused = true // the drained consumer stays paused until unpaused
+					req.result <- err
+				case req := <-replayCh:
+					if localConsumer == nil {
+						req.result <- replayResult{err: fmt.Errorf("cannot replay, consumer is not running")}
+						continue
+					}
+					// the replay uses its own driver and runs alongside the consumer so it doesn't block the control loop
+					replayDriver, err := internal.NewDriverInstance(context.Background(), logger, url, schemaRegistry, tracker, datadir, scratchSpace)
+					if err != nil {
+						req.result <- replayResult{err: fmt.Errorf("error creating driver for the replay: %w", err)}
+						continue
+					}
+					req.opts.Driver = replayDriver
+					go func(c forkConsumer) {
+						defer replayDriver.Stop()
+						res, err := c.Replay(req.ctx, req.opts)
+						req.result <- replayResult{res, err}
+					}(localConsumer)
 				case pause := <-pauseCh:
+					// an explicit pause is saved so the consumer stays paused when it's restarted
+					if pause && pausedAt == nil {
+						now := time.Now()
+						pausedAt = &now
+						if err := savePausedAt(tracker, pausedAt); err != nil {
+							logger.Error("error saving pause state: %s", err)
+						}
+					} else if !pause && pausedAt != nil {
+						pausedAt = nil
+						if err := savePausedAt(tracker, nil); err != nil {
+							logger.Error("error saving pause state: %s", err)
+						}
+					}
 					if pause {
 						if !paused {
 							paused = true
@@ -291,17 +833,96 @@ func init() {
 	forkCmd.Flags().String("logs-dir", "", "the directory for storing logs")
 	forkCmd.Flags().String("creds", "", "the server credentials file provided by Shopmonkey")
 	forkCmd.Flags().String("url", "", "driver connection string")
+	forkCmd.Flags().StringSlice("tables", nil, "restrict to a specific table or multiple, if not set will use all")
+	forkCmd.Flags().StringSlice("feature", nil, featureFlagsHelp())
 	forkCmd.Flags().String("api-url", "", "url to shopmonkey api")
 	forkCmd.Flags().Int("maxAckPending", defaultMaxAckPending, "the number of max ack pending messages")
 	forkCmd.Flags().Int("maxPendingBuffer", defaultMaxPendingBuffer, "the maximum number of messages to pull from nats to buffer")
 	forkCmd.Flags().Duration("minPendingLatency", 0, "the minimum accumulation period before flushing (0 uses default)")
 	forkCmd.Flags().Duration("maxPendingLatency", 0, "the maximum accumulation period before flushing (0 uses default)")
+	forkCmd.Flags().String("flushPolicy", consumer.FlushPolicyBalanced, "the policy for deciding when to flush ("+strings.Join(consumer.FlushPolicyNames(), ", ")+")")
+	forkCmd.Flags().String("ordering", "", "how to handle events delivered out of order for the same record (detect, enforce)")
+	forkCmd.Flags().Int("ordering-max-keys", consumer.DefaultOrderingMaxKeys, "the number of the most recently changed records whose last version is remembered by --ordering")
 	forkCmd.Flags().Bool("restart", false, "restart the consumer from the beginning (only works on new consumers)")
+	forkCmd.Flags().Bool("fix-start-position", false, "recreate an existing consumer which started after the import so that it delivers from the import timestamp")
 
 	// NOTE: sync these with serverCmd
 	// these flags are passed through from the server
 	forkCmd.Flags().Int("port", 0, "the port to listen for health checks and metrics")
 	forkCmd.Flags().StringSlice("companyIds", nil, "restrict to a specific company ID or multiple")
+	forkCmd.Flags().StringSlice("locationIds", nil, "restrict to a specific location ID or multiple, events without a location are always received")
+	forkCmd.Flags().StringSlice("only", nil, "only receive these tables, the other tables are never delivered")
+	forkCmd.Flags().StringSlice("except", nil, "never receive these tables")
+	forkCmd.Flags().StringArray("field-filter", nil, "only deliver updates to a table which change one of the columns such as order=status,workflowStatusId, use * for every other table (can be repeated)")
+	forkCmd.Flags().StringArray("flush-group", nil, "a comma separated group of tables, parents first, whose events from the same transaction are committed in the same flush such as order,orderLineItem (can be repeated)")
+	forkCmd.Flags().Bool("isolate-companies", false, "run a consumer with its own driver for each company of the credentials so one company's backlog or failures don't stall the others")
+	forkCmd.Flags().StringSlice("companyQuota", nil, "limit the events per second for a company using companyId=rate, use * for all companies")
+	forkCmd.Flags().StringSlice("max-events-per-second", nil, "limit the events per second sent to the driver, use driver=rate to only limit a driver such as snowflake=500 (0 is unlimited)")
+	forkCmd.Flags().StringSlice("remote-control", nil, "allow the Shopmonkey control plane to send signed commands for these actions ("+strings.Join(control.Actions, ", ")+")")
 	forkCmd.Flags().String("consumer-suffix", "", "a suffix to use for the consumer group name")
+	forkCmd.Flags().Int64("scratch-quota-mb", 0, "the maximum size in megabytes of temporary files drivers can stage on disk (0 is unlimited)")
+	forkCmd.Flags().Bool("encrypt-scratch", false, "encrypt the files downloaded by imports and the temporary files drivers stage on disk with a key which is only kept in memory")
+	forkCmd.Flags().Int("max-event-size-kb", 0, "the maximum size in kilobytes of an event, larger events are quarantined (0 is unlimited)")
 	forkCmd.Flags().String("server", "", "the nats server url, could be multiple comma separated")
+	forkCmd.Flags().Bool("backfill-new-tables", false, "backfill the data for tables which are created when their first event arrives")
+	forkCmd.Flags().Bool("pre-migrate", false, "apply the migrations for all tables in the schema registry before consuming")
+	forkCmd.Flags().Bool("repair-schema-drift", false, "add back the columns which were removed from a destination table outside of eds instead of only reporting them")
+	forkCmd.Flags().Bool("wait-for-destination", false, "wait with a backoff for the destination to pass its connection test and the migrations to complete before consuming instead of exiting")
+	forkCmd.Flags().Duration("wait-for-destination-timeout", 0, "how long to wait for the destination before exiting (0 waits forever)")
+	forkCmd.Flags().Duration("reconnect-timeout", consumer.DefaultReconnectTimeout, "how long to try re-establishing the consumer after the connection to the nats server is lost before restarting (0 restarts immediately)")
+	forkCmd.Flags().Int("retry-max-attempts", consumer.DefaultRetryMaxAttempts, "the number of times events which failed with a transient error are retried from the retry queue before they're given up on (0 disables the retry queue)")
+	forkCmd.Flags().Int("backpressure-threshold", 0, "pause pulling messages when this many are waiting to be processed until they drain (0 uses half of max ack pending, -1 disables)")
+	forkCmd.Flags().Duration("backpressure-flush-latency", 0, "pause pulling messages when a flush takes longer than this until the destination catches up (0 disables)")
+	forkCmd.Flags().Int64("max-buffered-mb", 0, "pause pulling messages when the messages held in memory until they're acked reach this size in megabytes until the flushes release them (0 disables)")
+	forkCmd.Flags().Bool("spill", false, "write the messages which arrive once --max-buffered-mb is reached to the data directory instead of holding them in memory")
+	forkCmd.Flags().Int("pipelines", 1, "the number of pipelines with their own driver connection which the events are sharded into so a slow table doesn't hold up the others")
+	forkCmd.Flags().Bool("journal", false, "record the events handed to the driver in a journal in the data directory until they're acked so a crash can be checked for gaps or duplicates in the destination on the next start")
+	forkCmd.Flags().String("pipeline-shard", consumer.PipelineShardTable, "how events are sharded into the pipelines (table, key), key spreads a busy table across the pipelines but can't be used with migrations or flush groups")
+	addPullFlags(forkCmd)
+	addTuningFlags(forkCmd)
+	addMemoryFlags(forkCmd)
+	forkCmd.Flags().StringSlice("metrics-labels", nil, "add labels to every metric to identify the install ("+strings.Join(internal.MetricLabelNames(), ", ")+")")
+}
+
+// addPullFlags adds the flags which control how messages are pulled from the server.
+func addPullFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("pull-expiry", consumer.DefaultPullExpiry, "how long a request to pull messages from the server waits for them")
+	cmd.Flags().Int("pull-max-messages", consumer.DefaultPullMaxMessages, "the maximum number of messages to buffer for each pull, lower this on hosts with little memory")
+	cmd.Flags().Int("pull-max-bytes", 0, "the maximum size in bytes of the messages to buffer for each pull instead of a number of messages (0 uses --pull-max-messages)")
+	cmd.Flags().Duration("pull-heartbeat", 0, "the interval of the idle heartbeats from the server which restart a pull when missed, between 500ms and 30s (0 uses half of --pull-expiry up to 30s)")
+}
+
+// addTuningFlags adds the flags which trade off the throughput and the latency of the consumer.
+func addTuningFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("empty-buffer-pause", consumer.DefaultEmptyBufferPauseTime, "how long to wait without new messages before the transaction of a flush group is treated as complete and how often backpressure is checked while paused")
+	cmd.Flags().Duration("ack-wait", consumer.DefaultAckWait, "how long the server waits for a message to be acked before redelivering it, must be longer than 1m")
+	cmd.Flags().Int("max-deliver", consumer.DefaultMaxDeliver, "the maximum number of times the server delivers a message before it's dropped")
+	cmd.Flags().DurationSlice("redelivery-backoff", nil, "the delays before redelivering a message which failed by the number of deliveries such as 2m,5m,15m,1h, the last is used for the later deliveries and each must be longer than 1m (replaces --ack-wait)")
+	cmd.Flags().Bool("ack-all", false, "ack only the last message which is done after a flush instead of each message, which is faster with a high volume but tables can't be paused (recreates the consumer when changed)")
+}
+
+// addMemoryFlags adds the flags which control the memory limit and the garbage collection.
+func addMemoryFlags(cmd *cobra.Command) {
+	cmd.Flags().Int64("memory-limit-mb", 0, "the soft memory limit in megabytes which the garbage collection works harder to stay under (0 uses --memory-limit-percent of the system memory or GOMEMLIMIT, -1 disables)")
+	cmd.Flags().Int("memory-limit-percent", internal.DefaultMemoryLimitPercent, "the percent of the system memory to use as the memory limit when --memory-limit-mb is 0")
+	cmd.Flags().Int("gc-percent", 0, "the garbage collection target percentage like GOGC, higher collects less often (0 uses the default, -1 only collects at the memory limit)")
+	cmd.Flags().Int64("gc-ballast-mb", 0, "the size in megabytes of a ballast allocation which makes the garbage collection run less often with a small heap (0 disables)")
+}
+
+func memoryConfigFromFlags(cmd *cobra.Command) internal.MemoryConfig {
+	var config internal.MemoryConfig
+	config.LimitMB, _ = cmd.Flags().GetInt64("memory-limit-mb")
+	config.LimitPercent, _ = cmd.Flags().GetInt("memory-limit-percent")
+	config.GCPercent, _ = cmd.Flags().GetInt("gc-percent")
+	config.BallastMB, _ = cmd.Flags().GetInt64("gc-ballast-mb")
+	return config
+}
+
+func pullOptionsFromFlags(cmd *cobra.Command) consumer.PullOptions {
+	var opts consumer.PullOptions
+	opts.Expiry, _ = cmd.Flags().GetDuration("pull-expiry")
+	opts.MaxMessages, _ = cmd.Flags().GetInt("pull-max-messages")
+	opts.MaxBytes, _ = cmd.Flags().GetInt("pull-max-bytes")
+	opts.Heartbeat, _ = cmd.Flags().GetDuration("pull-heartbeat")
+	return opts
 }
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// failedHeartbeat is the last heartbeat which couldn't be published to nats.
+type failedHeartbeat struct {
+	Heartbeat json.RawMessage `json:"heartbeat"`
+	Error     string          `json:"error"`
+}
+
+// heartbeatFallback holds the last heartbeat which couldn't be published by the fork so the server, which has the
+// API key, can poll for it and send it to the API instead.
+type heartbeatFallback struct {
+	lock   sync.Mutex
+	failed *failedHeartbeat
+}
+
+// set records the failed heartbeat or clears it when hb is nil.
+func (f *heartbeatFallback) set(hb []byte, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if hb == nil {
+		f.failed = nil
+		return
+	}
+	f.failed = &failedHeartbeat{Heartbeat: hb, Error: err.Error()}
+}
+
+// take returns the failed heartbeat and clears it so it's only sent once.
+func (f *heartbeatFallback) take() *failedHeartbeat {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	failed := f.failed
+	f.failed = nil
+	return failed
+}
+
+// ServeHTTP responds with the failed heartbeat or no content if there isn't one.
+func (f *heartbeatFallback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	failed := f.take()
+	if failed == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failed)
+}
+
+// getFailedHeartbeat asks the fork for the last heartbeat which couldn't be published or nil if there isn't one.
+func getFailedHeartbeat(port int) (*failedHeartbeat, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/control/heartbeat", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get failed heartbeat: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("failed to get failed heartbeat: %d", resp.StatusCode)
+	}
+	var failed failedHeartbeat
+	if err := json.NewDecoder(resp.Body).Decode(&failed); err != nil {
+		return nil, fmt.Errorf("failed to decode failed heartbeat: %w", err)
+	}
+	return &failed, nil
+}
+
+// sendHeartbeat sends a heartbeat which couldn't be published to nats to the API.
+func sendHeartbeat(logger logger.Logger, apiURL string, apiKey string, sessionId string, failed *failedHeartbeat) error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v3/eds/internal/%s/heartbeat", apiURL, sessionId), bytes.NewBuffer([]byte(util.JSONStringify(failed))))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	setHTTPHeader(req, apiKey)
+	retry := util.NewHTTPRetry(req, util.WithLogger(logger), util.WithMaxAttempts(3))
+	resp, err := retry.Do()
+	if err != nil {
+		return fmt.Errorf("failed to send heartbeat: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return handleAPIError(resp, "heartbeat")
+	}
+	logger.Trace("heartbeat sent to api for session %s", sessionId)
+	return nil
+}
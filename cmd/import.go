@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,7 +20,9 @@ import (
 
 	"github.com/charmbracelet/huh"
 	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/importer"
 	"github.com/shopmonkeyus/eds/internal/registry"
+	"github.com/shopmonkeyus/eds/internal/scratch"
 	"github.com/shopmonkeyus/eds/internal/tracker"
 	"github.com/shopmonkeyus/eds/internal/util"
 	"github.com/shopmonkeyus/go-common/logger"
@@ -214,9 +217,15 @@ func pollUntilComplete(ctx context.Context, logger logger.Logger, apiURL string,
 	}
 }
 
-func downloadFile(log logger.Logger, dir string, parsedURL *url.URL) (int64, error) {
+// downloadFile saves the file to dir, encrypting it with key unless it's nil.
+func downloadFile(log logger.Logger, dir internal.ScratchDir, parsedURL *url.URL, key []byte) (int64, error) {
 	baseFileName := filepath.Base(parsedURL.Path)
-	resp, err := http.Get(parsedURL.String())
+	req, err := http.NewRequest("GET", parsedURL.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %s", err)
+	}
+	retry := util.NewHTTPRetry(req, util.WithLogger(log), util.WithMaxAttempts(maxDownloadAttempts))
+	resp, err := retry.Do()
 	if err != nil {
 		return 0, fmt.Errorf("error fetching data: %s", err)
 	}
@@ -226,14 +235,34 @@ func downloadFile(log logger.Logger, dir string, parsedURL *url.URL) (int64, err
 		log.Trace("error fetching data: %s, (url: %s)\n%s", resp.Status, parsedURL.String(), buf)
 		return 0, fmt.Errorf("error fetching data: %s", resp.Status)
 	}
-	filename := filepath.Join(dir, baseFileName)
-	file, err := os.Create(filename)
+	filename := baseFileName
+	if key != nil {
+		filename += util.EncryptedFileExtension
+	}
+	file, err := dir.Create(filename)
 	if err != nil {
 		return 0, fmt.Errorf("error creating file: %s", err)
 	}
-	defer file.Close()
-	bytes, err := io.Copy(file, resp.Body)
+	var w io.WriteCloser = file
+	if key != nil {
+		w, err = util.NewEncryptingWriter(file, key)
+		if err != nil {
+			file.Close()
+			return 0, fmt.Errorf("error creating file: %s", err)
+		}
+	}
+	bytes, err := io.Copy(w, resp.Body)
 	if err != nil {
+		file.Close()
+		return 0, fmt.Errorf("error writing file: %s", err)
+	}
+	if w != file {
+		if err := w.Close(); err != nil {
+			file.Close()
+			return 0, fmt.Errorf("error writing file: %s", err)
+		}
+	}
+	if err := file.Close(); err != nil {
 		return 0, fmt.Errorf("error writing file: %s", err)
 	}
 	log.Debug("downloaded file %s (%d bytes)", filename, bytes)
@@ -247,7 +276,10 @@ type TableExportInfo struct {
 
 const trackerTableExportKey = "table-export"
 
-func bulkDownloadData(log logger.Logger, data map[string]exportJobTableData, dir string) ([]TableExportInfo, error) {
+// maxDownloadAttempts is the number of times an export file download is attempted before failing the import.
+const maxDownloadAttempts = 5
+
+func bulkDownloadData(log logger.Logger, data map[string]exportJobTableData, dir internal.ScratchDir, key []byte) ([]TableExportInfo, error) {
 	var downloads []*url.URL
 	started := time.Now()
 	var tables []TableExportInfo
@@ -306,7 +338,7 @@ func bulkDownloadData(log logger.Logger, data map[string]exportJobTableData, dir
 			defer util.RecoverPanic(log)
 			defer downloadWG.Done()
 			for url := range downloadChan {
-				size, err := downloadFile(log, dir, url)
+				size, err := downloadFile(log, dir, url, key)
 				if err != nil {
 					errors <- fmt.Errorf("error downloading file: %s", err)
 					return
@@ -356,6 +388,148 @@ func tableNames(tableData []TableExportInfo) []string {
 	return tables
 }
 
+// mergeTableExportInfo returns the existing table export data with the tables from updated replaced or added.
+func mergeTableExportInfo(existing []TableExportInfo, updated []TableExportInfo) []TableExportInfo {
+	merged := make([]TableExportInfo, 0, len(existing)+len(updated))
+	for _, info := range existing {
+		if !util.SliceContains(tableNames(updated), info.Table) {
+			merged = append(merged, info)
+		}
+	}
+	return append(merged, updated...)
+}
+
+const (
+	exportShardTable    = "table"
+	exportShardLocation = "location"
+)
+
+// splitExportJob splits the export request into at most jobs requests, each with a share of the tables or the
+// locations, so a large tenant isn't exported by a single job which can time out.
+func splitExportJob(request exportJobCreateRequest, jobs int, shard string, tables []string) ([]exportJobCreateRequest, error) {
+	var values []string
+	switch shard {
+	case exportShardTable:
+		values = tables
+		if len(request.Tables) > 0 {
+			values = request.Tables
+		}
+	case exportShardLocation:
+		if len(request.LocationIDs) == 0 {
+			return nil, fmt.Errorf("splitting the export by location requires --locationIds")
+		}
+		values = request.LocationIDs
+	default:
+		return nil, fmt.Errorf("unknown export shard: %s", shard)
+	}
+	if jobs <= 1 || len(values) <= 1 {
+		return []exportJobCreateRequest{request}, nil
+	}
+	if jobs > len(values) {
+		jobs = len(values)
+	}
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.Strings(sorted)
+	shares := make([][]string, jobs)
+	for i, value := range sorted {
+		shares[i%jobs] = append(shares[i%jobs], value)
+	}
+	requests := make([]exportJobCreateRequest, jobs)
+	for i, share := range shares {
+		requests[i] = request
+		if shard == exportShardTable {
+			requests[i].Tables = share
+		} else {
+			requests[i].LocationIDs = share
+		}
+	}
+	return requests, nil
+}
+
+// mergeExportJobs merges the tables of the export jobs into one job. A table exported by more than one job, which
+// happens when splitting by location, has the files of all of them and the earliest cursor so no changes are skipped.
+func mergeExportJobs(jobs []exportJobResponse) (exportJobResponse, error) {
+	merged := exportJobResponse{Completed: true, Tables: make(map[string]exportJobTableData)}
+	for _, job := range jobs {
+		merged.Completed = merged.Completed && job.Completed
+		for table, data := range job.Tables {
+			existing, ok := merged.Tables[table]
+			if !ok {
+				merged.Tables[table] = data
+				continue
+			}
+			existing.URLs = append(existing.URLs, data.URLs...)
+			if data.Status != "Completed" {
+				existing.Status = data.Status
+				existing.Error = data.Error
+			}
+			if existing.Cursor == "" {
+				existing.Cursor = data.Cursor
+			} else if data.Cursor != "" {
+				a, err := strconv.ParseInt(existing.Cursor, 10, 64)
+				if err != nil {
+					return exportJobResponse{}, fmt.Errorf("error parsing cursor for table %s: %s. %w", table, existing.Cursor, err)
+				}
+				b, err := strconv.ParseInt(data.Cursor, 10, 64)
+				if err != nil {
+					return exportJobResponse{}, fmt.Errorf("error parsing cursor for table %s: %s. %w", table, data.Cursor, err)
+				}
+				if b < a {
+					existing.Cursor = data.Cursor
+				}
+			}
+			merged.Tables[table] = existing
+		}
+	}
+	return merged, nil
+}
+
+// pollExportJobs waits for all the export jobs to complete and merges them. Polling stops for all of them as soon
+// as one fails.
+func pollExportJobs(ctx context.Context, logger logger.Logger, apiURL string, apiKey string, jobIDs []string) (exportJobResponse, error) {
+	if len(jobIDs) == 1 {
+		return pollUntilComplete(ctx, logger, apiURL, apiKey, jobIDs[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make([]exportJobResponse, len(jobIDs))
+	errs := make(chan error, len(jobIDs))
+	var wg sync.WaitGroup
+	for i, jobID := range jobIDs {
+		wg.Add(1)
+		go func(i int, jobID string) {
+			defer util.RecoverPanic(logger)
+			defer wg.Done()
+			job, err := pollUntilComplete(ctx, logger, apiURL, apiKey, jobID)
+			if err != nil {
+				errs <- fmt.Errorf("job %s: %w", jobID, err)
+				cancel()
+				return
+			}
+			jobs[i] = job
+		}(i, jobID)
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return exportJobResponse{}, err
+	default:
+	}
+	if isCancelled(ctx) {
+		return exportJobResponse{}, nil
+	}
+	return mergeExportJobs(jobs)
+}
+
+// exportSessionID returns the id of the import session for the export jobs.
+func exportSessionID(jobIDs []string) string {
+	if len(jobIDs) == 1 {
+		return jobIDs[0]
+	}
+	return util.Hash(strings.Join(jobIDs, ","))
+}
+
 var importCmd = &cobra.Command{
 	Use:   "import",
 	Short: "Import data from your Shopmonkey instance to your system",
@@ -372,13 +546,27 @@ var importCmd = &cobra.Command{
 		apiKey := mustFlagString(cmd, "api-key", true)
 		jobID := mustFlagString(cmd, "job-id", false)
 		single, _ := cmd.Flags().GetBool("single")
+		maxBatchCount := mustFlagInt(cmd, "max-batch-count", false)
+		maxBatchBytes := mustFlagInt(cmd, "max-batch-bytes", false)
 		dir := mustFlagString(cmd, "dir", false)
 		schemaOnly := mustFlagBool(cmd, "schema-only", false)
 		validateOnly := mustFlagBool(cmd, "validate-only", false)
 		timeOffset := mustFlagString(cmd, "timeOffset", false)
 		noDelete := mustFlagBool(cmd, "no-delete", false)
+		encrypt := mustFlagBool(cmd, "encrypt", false)
+		encryptionKeyValue := mustFlagString(cmd, "encryption-key", false)
+		exportJobs := mustFlagInt(cmd, "export-jobs", false)
+		exportShard := mustFlagString(cmd, "export-shard", false)
+		scratchQuotaMB, _ := cmd.Flags().GetInt64("scratch-quota-mb")
 		var timeOffsetUnixMilli *int64
 
+		if exportJobs < 1 {
+			logger.Fatal("--export-jobs must be at least 1")
+		}
+		if exportShard != exportShardTable && exportShard != exportShardLocation {
+			logger.Fatal("--export-shard must be %s or %s", exportShardTable, exportShardLocation)
+		}
+
 		if timeOffset != "" {
 			tv, err := time.Parse(time.RFC3339, timeOffset)
 			if err != nil {
@@ -388,6 +576,25 @@ var importCmd = &cobra.Command{
 			timeOffsetUnixMilli = &t
 		}
 
+		// the downloaded files are encrypted with the key so they can only be read back by this process unless the key
+		// is provided, which is needed to restart from the files with --dir
+		var encryptionKey []byte
+		var temporaryKey bool
+		if encryptionKeyValue != "" {
+			key, err := util.ParseEncryptionKey(encryptionKeyValue)
+			if err != nil {
+				logger.Fatal("invalid --encryption-key: %s", err)
+			}
+			encryptionKey = key
+		} else if encrypt {
+			key, err := util.NewEncryptionKey()
+			if err != nil {
+				logger.Fatal("%s", err)
+			}
+			encryptionKey = key
+			temporaryKey = true
+		}
+
 		defer util.RecoverPanic(logger)
 
 		dataDir := getDataDir(cmd, logger)
@@ -427,6 +634,12 @@ var importCmd = &cobra.Command{
 
 		var err error
 
+		fileMappingValues, _ := cmd.Flags().GetStringSlice("file-mapping")
+		fileMappings, err := importer.ParseFileMappings(fileMappingValues)
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
 		theTracker, err := tracker.NewTracker(tracker.TrackerConfig{
 			Context: ctx,
 			Logger:  logger,
@@ -438,7 +651,7 @@ var importCmd = &cobra.Command{
 		defer theTracker.Close()
 
 		// check to see if there's a schema validator and if so load it
-		validator, err := loadSchemaValidator(cmd)
+		validator, err := loadSchemaValidator(cmd, theTracker)
 		if err != nil {
 			logger.Fatal("error loading validator: %s", err)
 		}
@@ -471,7 +684,7 @@ var importCmd = &cobra.Command{
 		}
 
 		// create a new importer for loading the data using the provider
-		importer, err := internal.NewImporter(ctx, logger, driverUrl, registry)
+		dataImporter, err := internal.NewImporter(ctx, logger, driverUrl, registry)
 		if err != nil {
 			logger.Fatal("error creating importer: %s", err)
 		}
@@ -479,7 +692,7 @@ var importCmd = &cobra.Command{
 		var skipDeleteConfirm bool
 
 		// check to see if the importer supports delete
-		if importerHelp, ok := importer.(internal.ImporterHelp); ok {
+		if importerHelp, ok := dataImporter.(internal.ImporterHelp); ok {
 			skipDeleteConfirm = !importerHelp.SupportsDelete()
 		}
 
@@ -527,16 +740,27 @@ var importCmd = &cobra.Command{
 
 		var success bool
 		var tableExportInfo []TableExportInfo
+		var downloads internal.ScratchDir // the scratch directory the export is downloaded to
 
 		defer func() {
 			defer util.RecoverPanic(logger)
 			logger.Trace("exit success: %v", success)
 			var filesRemoved bool
 			if success {
-				if !noCleanup {
-					os.RemoveAll(dir)
+				if !noCleanup && downloads != nil {
+					if err := downloads.Release(); err != nil {
+						logger.Error("%s", err)
+					}
 					filesRemoved = true
 				}
+				if len(only) > 0 {
+					// a targeted import only has the timestamps for its tables so keep the others
+					existing, err := loadTableExportInfo(theTracker)
+					if err != nil {
+						logger.Error("%s", err)
+					}
+					tableExportInfo = mergeTableExportInfo(existing, tableExportInfo)
+				}
 				if err := theTracker.SetKey(trackerTableExportKey, util.JSONStringify(tableExportInfo), 0); err != nil {
 					logger.Error("error saving table export data to tracker: %s", err)
 				}
@@ -545,6 +769,9 @@ var importCmd = &cobra.Command{
 			}
 			if !filesRemoved && dir != "" {
 				logger.Info("downloaded files saved to: %s", dir)
+				if temporaryKey {
+					logger.Warn("downloaded files are encrypted with a temporary key and can't be reused with --dir, use --encryption-key to provide a key which can")
+				}
 			}
 			if !success {
 				os.Exit(1)
@@ -554,22 +781,46 @@ var importCmd = &cobra.Command{
 
 		if dir == "" {
 			if !schemaOnly {
-				if jobID == "" {
-					logger.Info("Requesting Export...")
-					jobID, err = createExportJob(ctx, logger, apiURL, apiKey, exportJobCreateRequest{
+				var jobIDs []string
+				if jobID != "" {
+					jobIDs = strings.Split(jobID, ",")
+				} else {
+					var schemaTables []string
+					if exportShard == exportShardTable && exportJobs > 1 && len(only) == 0 {
+						schema, err := registry.GetLatestSchema()
+						if err != nil {
+							logger.Fatal("error getting latest schema: %s", err)
+						}
+						for table := range schema {
+							schemaTables = append(schemaTables, table)
+						}
+					}
+					requests, err := splitExportJob(exportJobCreateRequest{
 						Tables:      only,
 						CompanyIDs:  companyIds,
 						LocationIDs: locationIds,
 						TimeOffset:  timeOffsetUnixMilli,
-					})
+					}, exportJobs, exportShard, schemaTables)
 					if err != nil {
-						logger.Fatal("error creating export job: %s", err)
+						logger.Fatal("%s", err)
+					}
+					logger.Info("Requesting Export...")
+					for _, request := range requests {
+						id, err := createExportJob(ctx, logger, apiURL, apiKey, request)
+						if err != nil {
+							logger.Fatal("error creating export job: %s", err)
+						}
+						logger.Trace("created job: %s", id)
+						jobIDs = append(jobIDs, id)
+					}
+					if len(jobIDs) > 1 {
+						logger.Info("Created %d export jobs, use --job-id %s to resume them", len(jobIDs), strings.Join(jobIDs, ","))
 					}
-					logger.Trace("created job: %s", jobID)
 				}
+				jobID = exportSessionID(jobIDs)
 
 				logger.Info("Waiting for Export to Complete...")
-				job, err := pollUntilComplete(ctx, logger, apiURL, apiKey, jobID)
+				job, err := pollExportJobs(ctx, logger, apiURL, apiKey, jobIDs)
 				if err != nil && !isCancelled(ctx) {
 					logger.Fatal("error polling job: %s", err)
 				}
@@ -578,15 +829,20 @@ var importCmd = &cobra.Command{
 					return
 				}
 
-				// download the files
-				dir, err = os.MkdirTemp(dataDir, "import-"+jobID+"-*")
+				// download the files to scratch space, which removes the downloads of a previous import which were kept
+				scratchSpace, err := scratch.NewManager(logger, filepath.Join(dataDir, "imports"), scratchQuotaMB*1024*1024, false)
+				if err != nil {
+					logger.Fatal("error creating scratch space: %s", err)
+				}
+				downloads, err = scratchSpace.Allocate("import-" + jobID)
 				if err != nil {
-					logger.Fatal("error creating temp dir: %s", err)
+					logger.Fatal("%s", err)
 				}
+				dir = downloads.Path()
 				logger.Trace("temp dir created: %s", dir)
 
 				logger.Info("Downloading export data...")
-				tableData, err := bulkDownloadData(logger, job.Tables, dir)
+				tableData, err := bulkDownloadData(logger, job.Tables, downloads, encryptionKey)
 				if err != nil {
 					logger.Fatal("error downloading files: %s", err)
 				}
@@ -631,9 +887,9 @@ var importCmd = &cobra.Command{
 					logger.Fatal("unable to list files in directory: %s", err)
 				}
 				for _, file := range files {
-					table, _, ok := util.ParseCRDBExportFile(file)
-					if ok && !util.SliceContains(tables, table) {
-						tables = append(tables, table)
+					f, ok := importer.ParseFile(file, fileMappings)
+					if ok && !util.SliceContains(tables, f.Table) {
+						tables = append(tables, f.Table)
 					}
 				}
 			}
@@ -650,7 +906,7 @@ var importCmd = &cobra.Command{
 		}
 
 		logger.Info("Importing data to tables %s", strings.Join(tables, ", "))
-		if err := importer.Import(internal.ImporterConfig{
+		if err := dataImporter.Import(internal.ImporterConfig{
 			Context:         ctx,
 			URL:             driverUrl,
 			Logger:          logger,
@@ -661,9 +917,13 @@ var importCmd = &cobra.Command{
 			DryRun:          dryRun,
 			Tables:          tables,
 			Single:          single,
+			MaxBatchCount:   maxBatchCount,
+			MaxBatchBytes:   maxBatchBytes,
 			SchemaValidator: validator,
 			SchemaOnly:      schemaOnly,
 			NoDelete:        noDelete,
+			FileMappings:    fileMappings,
+			EncryptionKey:   encryptionKey,
 		}); err != nil {
 			logger.Error("error running import: %s", err)
 			return
@@ -704,7 +964,7 @@ func init() {
 	importCmd.Flags().String("api-key", os.Getenv("SM_APIKEY"), "shopmonkey api key")
 
 	// helpful flags
-	importCmd.Flags().String("job-id", "", "resume an existing job")
+	importCmd.Flags().String("job-id", "", "resume an existing job or a comma separated list of jobs created with --export-jobs")
 	importCmd.Flags().Bool("dry-run", false, "only simulate loading but don't actually make changes")
 	importCmd.Flags().Bool("no-confirm", false, "skip the confirmation prompt")
 	importCmd.Flags().Bool("no-cleanup", false, "skip removing the temp directory")
@@ -712,14 +972,22 @@ func init() {
 	importCmd.Flags().String("dir", "", "restart reading files from this existing import directory instead of downloading again")
 	importCmd.Flags().Bool("schema-only", false, "run the schema creation only, skipping the data import")
 	importCmd.Flags().Bool("validate-only", false, "run the validation only, skipping the data import")
+	importCmd.Flags().Bool("encrypt", false, "encrypt the downloaded files on disk with a temporary key and decrypt them while loading")
+	importCmd.Flags().String("encryption-key", os.Getenv("EDS_ENCRYPTION_KEY"), "encrypt the downloaded files on disk with this 32 byte hex or base64 key, which is also used to read an encrypted --dir")
+	importCmd.Flags().Int64("scratch-quota-mb", 0, "the maximum size in megabytes of the downloaded files (0 is unlimited)")
 	importCmd.Flags().String("timeOffset", "", "timestamp in RFC3339 format to export data with records updated after this time")
 
 	// tuning and testing flags
 	importCmd.Flags().Int("parallel", 4, "the number of parallel upload tasks (if supported by driver)")
 	importCmd.Flags().Bool("single", false, "run one insert at a time instead of batching")
+	importCmd.Flags().Int("max-batch-count", importer.DefaultMaxBatchCount, "the maximum number of records to hold in memory before writing a batch")
+	importCmd.Flags().Int("max-batch-bytes", importer.DefaultMaxBatchBytes, "the maximum number of bytes of records to hold in memory before writing a batch")
 	importCmd.Flags().StringSlice("only", nil, "only import these tables")
+	importCmd.Flags().StringSlice("file-mapping", nil, "map the files in --dir with a name matching a glob pattern to a table using pattern=table, otherwise the table is the filename without its extension")
 	importCmd.Flags().StringSlice("companyIds", nil, "only import these company ids")
 	importCmd.Flags().StringSlice("locationIds", nil, "only import these location ids")
+	importCmd.Flags().Int("export-jobs", 1, "split the export into this many jobs which run concurrently, for tenants too large to export with one job")
+	importCmd.Flags().String("export-shard", exportShardTable, "how to split the export with --export-jobs, either by table or by location which requires --locationIds")
 
 	// internal flags
 	importCmd.Flags().String("api-url", "https://api.shopmonkey.cloud", "url to shopmonkey api")
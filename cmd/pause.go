@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	trackerPausedKey       = "paused"
+	trackerPausedTablesKey = "paused-tables"
+)
+
+// errAckAllTablePause is returned when pausing a table with the ack all policy since acking a later message would ack
+// the events of the table which were held back.
+var errAckAllTablePause = errors.New("tables can't be paused with the ack all policy")
+
+type tablePause struct {
+	table string
+	pause bool
+}
+
+// loadPausedTables returns the tables which were paused before the fork was restarted. Tables can't be paused with
+// the ack all policy so tables which were paused before it was turned on are unpaused instead of failing to start.
+func loadPausedTables(logger logger.Logger, theTracker *tracker.Tracker, ackAll bool) ([]string, error) {
+	found, val, err := theTracker.GetKey(trackerPausedTablesKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading paused tables from tracker: %w", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	var tables []string
+	if err := json.Unmarshal([]byte(val), &tables); err != nil {
+		return nil, fmt.Errorf("error decoding paused tables: %w", err)
+	}
+	if ackAll && len(tables) > 0 {
+		logger.Warn("unpausing tables since %s: %s", errAckAllTablePause, strings.Join(tables, ", "))
+		if err := savePausedTables(theTracker, nil); err != nil {
+			logger.Error("error saving paused tables: %s", err)
+		}
+		return nil, nil
+	}
+	return tables, nil
+}
+
+// updatePausedTables pauses or unpauses the table of the request and saves the paused tables. A pause is rejected
+// with the ack all policy before anything is saved.
+func updatePausedTables(theTracker *tracker.Tracker, tables []string, req tablePause, ackAll bool) ([]string, error) {
+	if req.pause {
+		if ackAll {
+			return tables, errAckAllTablePause
+		}
+		if !util.SliceContains(tables, req.table) {
+			tables = append(tables, req.table)
+			slices.Sort(tables)
+		}
+	} else {
+		tables = slices.DeleteFunc(tables, func(table string) bool { return table == req.table })
+	}
+	if err := savePausedTables(theTracker, tables); err != nil {
+		return tables, fmt.Errorf("error saving paused tables: %w", err)
+	}
+	return tables, nil
+}
+
+// savePausedTables records the paused tables so they stay paused when the fork is restarted.
+func savePausedTables(theTracker *tracker.Tracker, tables []string) error {
+	if len(tables) == 0 {
+		return theTracker.DeleteKey(trackerPausedTablesKey)
+	}
+	return theTracker.SetKey(trackerPausedTablesKey, util.JSONStringify(tables), 0)
+}
+
+// loadPausedAt returns when the consumer was paused before the fork was restarted or nil if it wasn't paused.
+func loadPausedAt(theTracker *tracker.Tracker) (*time.Time, error) {
+	found, val, err := theTracker.GetKey(trackerPausedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading pause state from tracker: %w", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	pausedAt, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding pause state: %w", err)
+	}
+	return &pausedAt, nil
+}
+
+// savePausedAt records when the consumer was paused so it stays paused when the fork is restarted, nil clears it.
+func savePausedAt(theTracker *tracker.Tracker, pausedAt *time.Time) error {
+	if pausedAt == nil {
+		return theTracker.DeleteKey(trackerPausedKey)
+	}
+	return theTracker.SetKey(trackerPausedKey, pausedAt.Format(time.RFC3339), 0)
+}
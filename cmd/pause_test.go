@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTracker(t *testing.T, dir string) *tracker.Tracker {
+	theTracker, err := tracker.NewTracker(tracker.TrackerConfig{
+		Logger:  logger.NewTestLogger(),
+		Context: context.Background(),
+		Dir:     dir,
+	})
+	assert.NoError(t, err)
+	return theTracker
+}
+
+func TestPauseTableWithAckAll(t *testing.T) {
+	dir := t.TempDir()
+	theTracker := newTestTracker(t, dir)
+
+	// a pause is rejected before it's saved so a restart doesn't find the table paused
+	tables, err := updatePausedTables(theTracker, nil, tablePause{"order", true}, true)
+	assert.ErrorIs(t, err, errAckAllTablePause)
+	assert.Empty(t, tables)
+	tables, err = loadPausedTables(logger.NewTestLogger(), theTracker, true)
+	assert.NoError(t, err)
+	assert.Empty(t, tables)
+
+	// a table which was paused before the ack all policy was turned on is unpaused on restart
+	tables, err = updatePausedTables(theTracker, nil, tablePause{"order", true}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"order"}, tables)
+	assert.NoError(t, theTracker.Close())
+	theTracker = newTestTracker(t, dir)
+	tables, err = loadPausedTables(logger.NewTestLogger(), theTracker, true)
+	assert.NoError(t, err)
+	assert.Empty(t, tables)
+	found, _, err := theTracker.GetKey(trackerPausedTablesKey)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.NoError(t, theTracker.Close())
+}
+
+func TestPauseTableRestart(t *testing.T) {
+	dir := t.TempDir()
+	theTracker := newTestTracker(t, dir)
+	tables, err := updatePausedTables(theTracker, nil, tablePause{"order", true}, false)
+	assert.NoError(t, err)
+	tables, err = updatePausedTables(theTracker, tables, tablePause{"customer", true}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, theTracker.Close())
+
+	theTracker = newTestTracker(t, dir)
+	tables, err = loadPausedTables(logger.NewTestLogger(), theTracker, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"customer", "order"}, tables)
+	tables, err = updatePausedTables(theTracker, tables, tablePause{"order", false}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"customer"}, tables)
+	assert.NoError(t, theTracker.Close())
+}
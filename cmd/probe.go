@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/probe"
+	"github.com/spf13/cobra"
+)
+
+var probeCmd = &cobra.Command{
+	Use:   "probe <host>[:port]",
+	Short: "Detect the destination at a host and suggest the driver url to use for it",
+	Long: "Detect the destination at a host and suggest the driver url to use for it.\n" +
+		"The host is probed with the handshake of each supported protocol on its default ports, or only on the port if one is provided.\n" +
+		"Nothing is written to the destination and the credentials are only used to build the suggested url and for http basic authentication.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger(cmd).WithPrefix("[probe]")
+		host, port, err := probe.ParseHost(args[0])
+		if err != nil {
+			logger.Fatal("invalid host: %s", err)
+		}
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		creds := probe.Credentials{
+			Username: mustFlagString(cmd, "user", false),
+			Password: mustFlagString(cmd, "password", false),
+			Database: mustFlagString(cmd, "database", false),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout+time.Second)
+		defer cancel()
+
+		var found int
+		for _, result := range probe.Probe(ctx, host, port, creds, timeout) {
+			if _, err := internal.GetDriverMetadataForURL(result.URL); err != nil {
+				logger.Debug("skipping %s on port %d since the driver isn't included in this build", result.Driver, result.Port)
+				continue
+			}
+			found++
+			detail := result.Protocol
+			if result.Detail != "" {
+				detail += ", " + result.Detail
+			}
+			if result.Port > 0 {
+				detail = fmt.Sprintf("port %d, %s", result.Port, detail)
+			}
+			logger.Info("detected %s (%s): %s", result.Driver, detail, result.URL)
+		}
+		if found == 0 {
+			logger.Error("no supported destination was detected at %s", args[0])
+			os.Exit(1)
+		}
+		logger.Info("pass the url to --url after replacing any placeholders, run the server help command with the driver name for its options")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+	probeCmd.Flags().String("user", "", "the username to add to the suggested url")
+	probeCmd.Flags().String("password", "", "the password to add to the suggested url")
+	probeCmd.Flags().String("database", "", "the database, keyspace or topic to add to the suggested url")
+	probeCmd.Flags().Duration("timeout", probe.DefaultTimeout, "how long to wait for each handshake")
+}
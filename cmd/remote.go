@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/shopmonkeyus/eds/internal/consumer"
+	"github.com/shopmonkeyus/eds/internal/control"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const remoteControlAuditFile = "control-audit.log"
+
+var logLevels = map[string]logger.LogLevel{
+	"trace": logger.LevelTrace,
+	"debug": logger.LevelDebug,
+	"info":  logger.LevelInfo,
+	"warn":  logger.LevelWarn,
+	"error": logger.LevelError,
+}
+
+// levelLogger only logs the messages at or above a level which can be changed while running, the loggers created from it share the level.
+type levelLogger struct {
+	log   logger.Logger
+	level *atomic.Int32
+}
+
+var _ logger.Logger = (*levelLogger)(nil)
+
+func newLevelLogger(log logger.Logger, level logger.LogLevel) *levelLogger {
+	l := &levelLogger{log: log, level: &atomic.Int32{}}
+	l.level.Store(int32(level))
+	return l
+}
+
+// SetLevel changes the level using its name such as debug.
+func (l *levelLogger) SetLevel(name string) error {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("invalid log level: %q, must be one of: trace, debug, info, warn, error", name)
+	}
+	l.level.Store(int32(level))
+	return nil
+}
+
+func (l *levelLogger) enabled(level logger.LogLevel) bool {
+	return int32(level) >= l.level.Load()
+}
+
+func (l *levelLogger) With(metadata map[string]interface{}) logger.Logger {
+	return &levelLogger{log: l.log.With(metadata), level: l.level}
+}
+
+func (l *levelLogger) WithPrefix(prefix string) logger.Logger {
+	return &levelLogger{log: l.log.WithPrefix(prefix), level: l.level}
+}
+
+func (l *levelLogger) Trace(msg string, args ...interface{}) {
+	if l.enabled(logger.LevelTrace) {
+		l.log.Trace(msg, args...)
+	}
+}
+
+func (l *levelLogger) Debug(msg string, args ...interface{}) {
+	if l.enabled(logger.LevelDebug) {
+		l.log.Debug(msg, args...)
+	}
+}
+
+func (l *levelLogger) Info(msg string, args ...interface{}) {
+	if l.enabled(logger.LevelInfo) {
+		l.log.Info(msg, args...)
+	}
+}
+
+func (l *levelLogger) Warn(msg string, args ...interface{}) {
+	if l.enabled(logger.LevelWarn) {
+		l.log.Warn(msg, args...)
+	}
+}
+
+func (l *levelLogger) Error(msg string, args ...interface{}) {
+	if l.enabled(logger.LevelError) {
+		l.log.Error(msg, args...)
+	}
+}
+
+func (l *levelLogger) Fatal(msg string, args ...interface{}) {
+	l.log.Fatal(msg, args...)
+}
+
+// pauseArgs sends a remote pause or unpause to the same channels as the HTTP control endpoints.
+func pauseArgs(args map[string]string, pause bool, pauseCh chan<- bool, companyPauseCh chan<- companyPause, tablePauseCh chan<- tablePause) {
+	if companyID := args["companyId"]; companyID != "" {
+		companyPauseCh <- companyPause{companyID, pause}
+	} else if table := args["table"]; table != "" {
+		tablePauseCh <- tablePause{table, pause}
+	} else {
+		pauseCh <- pause
+	}
+}
+
+type remoteControlConfig struct {
+	logger  logger.Logger
+	natsurl string
+	creds   string
+	datadir string
+	allow   []string
+	handler control.Handler
+}
+
+// startRemoteControl connects to nats and runs the signed commands which the control plane publishes for the session.
+func startRemoteControl(config remoteControlConfig) (func(), error) {
+	nc, info, err := consumer.NewNatsConnection(config.logger, config.natsurl, config.creds)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := control.New(control.Config{
+		Logger:    config.logger,
+		Conn:      nc,
+		SessionID: info.SessionID,
+		PublicKey: ShopmonkeyPublicPGPKey,
+		Allow:     config.allow,
+		AuditFile: filepath.Join(config.datadir, remoteControlAuditFile),
+		Handler:   config.handler,
+	})
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if err := rc.Start(); err != nil {
+		rc.Stop()
+		nc.Close()
+		return nil, err
+	}
+	return func() {
+		if err := rc.Stop(); err != nil {
+			config.logger.Error("error stopping remote control: %s", err)
+		}
+		nc.Close()
+	}, nil
+}
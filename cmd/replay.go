@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal/consumer"
+	"github.com/spf13/cobra"
+)
+
+// parseReplayQuery returns the replay options of a replay request. The end of the range defaults to now.
+func parseReplayQuery(query url.Values) (consumer.ReplayOptions, error) {
+	var opts consumer.ReplayOptions
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		return opts, fmt.Errorf("invalid from: %q, must be a RFC3339 time", query.Get("from"))
+	}
+	opts.From = from
+	opts.To = time.Now()
+	if val := query.Get("to"); val != "" {
+		to, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return opts, fmt.Errorf("invalid to: %q, must be a RFC3339 time", val)
+		}
+		opts.To = to
+	}
+	if !opts.To.After(opts.From) {
+		return opts, fmt.Errorf("to must be after from")
+	}
+	opts.Tables = query["table"]
+	return opts, nil
+}
+
+// postReplay asks the fork to replay the events of the time range and waits for it to finish.
+func postReplay(port int, query url.Values) (consumer.ReplayResult, error) {
+	var result consumer.ReplayResult
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/control/replay?%s", port, query.Encode()), "application/json", nil)
+	if err != nil {
+		return result, fmt.Errorf("failed to replay: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return result, fmt.Errorf("failed to replay: %d: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("failed to decode replay result: %w", err)
+	}
+	return result, nil
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Process the events of a time range again through the driver of the running server",
+	Long:  "Process the events which were published in a time range again through the driver of the running server, such as after the data in the destination was corrupted.\nThe events are read with a temporary consumer so the position of the server's consumer isn't changed.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger(cmd).WithPrefix("[replay]")
+		port := mustFlagInt(cmd, "port", true)
+		from := mustFlagString(cmd, "from", true)
+		to := mustFlagString(cmd, "to", false)
+		tables, _ := cmd.Flags().GetStringSlice("table")
+		query := url.Values{"from": {from}, "table": tables}
+		if to != "" {
+			query.Set("to", to)
+		}
+		// validate before asking the server so a typo doesn't need a round trip
+		if _, err := parseReplayQuery(query); err != nil {
+			logger.Fatal("%s", err)
+		}
+		started := time.Now()
+		result, err := postReplay(port, query)
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+		logger.Info("replayed %d events (%d skipped) in %v", result.Events, result.Skipped, time.Since(started).Round(time.Millisecond))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+	replayCmd.Flags().Int("port", getOSInt("PORT", 8080), "the port the server is listening on for health checks, metrics etc")
+	replayCmd.Flags().String("from", "", "the time to replay the events from such as 2024-01-02T15:04:05Z")
+	replayCmd.Flags().String("to", "", "the time to replay the events until, defaults to now")
+	replayCmd.Flags().StringSlice("table", nil, "only replay the events of this table or multiple")
+}
@@ -157,24 +157,28 @@ func newLogFileSink(dir string) (*logFileSink, error) {
 
 type CloseFunc func()
 
+// consoleLogLevel returns the level of the console logger for the --silent and --verbose flags.
+func consoleLogLevel(cmd *cobra.Command) logger.LogLevel {
+	if silent, _ := cmd.Flags().GetBool("silent"); silent {
+		return logger.LevelError
+	}
+	if verbose, _ := cmd.Flags().GetBool("verbose"); verbose {
+		return logger.LevelTrace
+	}
+	return logger.LevelInfo
+}
+
 func newLogger(cmd *cobra.Command) logger.Logger {
+	return newLoggerWithLevel(cmd, consoleLogLevel(cmd))
+}
+
+func newLoggerWithLevel(cmd *cobra.Command, level logger.LogLevel) logger.Logger {
 	ts, _ := cmd.Flags().GetBool("timestamp")
 	if !ts {
 		glog.SetFlags(0)
 	}
 	glog.SetOutput(os.Stdout)
-	silent, _ := cmd.Flags().GetBool("silent")
-	var log logger.Logger
-	if silent {
-		log = logger.NewConsoleLogger(logger.LevelError)
-	} else {
-		verbose, _ := cmd.Flags().GetBool("verbose")
-		if verbose {
-			log = logger.NewConsoleLogger(logger.LevelTrace)
-		} else {
-			log = logger.NewConsoleLogger(logger.LevelInfo)
-		}
-	}
+	var log logger.Logger = logger.NewConsoleLogger(level)
 	if cmd.Flags().Changed("log-label") {
 		label, _ := cmd.Flags().GetString("log-label")
 		if label != "" {
@@ -242,12 +246,12 @@ func loadTableExportInfo(theTracker *tracker.Tracker) ([]TableExportInfo, error)
 	return tableData, nil
 }
 
-func loadSchemaValidator(cmd *cobra.Command) (internal.SchemaValidator, error) {
+func loadSchemaValidator(cmd *cobra.Command, theTracker *tracker.Tracker) (internal.SchemaValidator, error) {
 	schemaDir := mustFlagString(cmd, "schema-validator", false)
 	if schemaDir == "" {
 		return nil, nil
 	}
-	return util.NewSchemaValidator(schemaDir)
+	return util.NewSchemaValidator(schemaDir, util.WithSchemaValidatorTracker(theTracker))
 }
 
 // rootCmd represents the base command when called without any subcommands
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/spf13/cobra"
+)
+
+// postSchemaRefresh asks the fork to fetch the latest schema and migrate the tables, an empty list migrates all the
+// tables. It returns the tables which were migrated.
+func postSchemaRefresh(port int, tables []string) ([]string, error) {
+	if tables == nil {
+		tables = []string{}
+	}
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/control/schema/refresh", port), "application/json", strings.NewReader(util.JSONStringify(tables)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh schema: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to refresh schema: %d: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+	var migrated []string
+	if err := json.NewDecoder(resp.Body).Decode(&migrated); err != nil {
+		return nil, fmt.Errorf("failed to decode refresh schema response: %w", err)
+	}
+	return migrated, nil
+}
+
+var refreshSchemaCmd = &cobra.Command{
+	Use:   "refresh-schema [table...]",
+	Short: "Fetch the latest schema and migrate the tables of the running server without restarting it",
+	Long:  "Fetch the latest schema and migrate the tables of the running server without restarting it.\nIf no tables are provided, all the tables the server receives are migrated.",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger(cmd).WithPrefix("[refresh-schema]")
+		port := mustFlagInt(cmd, "port", true)
+		migrated, err := postSchemaRefresh(port, args)
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+		if len(migrated) == 0 {
+			logger.Info("schema refreshed, no tables needed to be migrated")
+			return
+		}
+		logger.Info("schema refreshed, migrated tables: %s", strings.Join(migrated, ", "))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(refreshSchemaCmd)
+	refreshSchemaCmd.Flags().Int("port", getOSInt("PORT", 8080), "the port the server is listening on for health checks, metrics etc")
+}
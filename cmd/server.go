@@ -23,6 +23,9 @@ import (
 	"github.com/shopmonkeyus/eds/internal"
 	"github.com/shopmonkeyus/eds/internal/api"
 	"github.com/shopmonkeyus/eds/internal/consumer"
+	"github.com/shopmonkeyus/eds/internal/control"
+	"github.com/shopmonkeyus/eds/internal/errcode"
+	"github.com/shopmonkeyus/eds/internal/feature"
 	"github.com/shopmonkeyus/eds/internal/notification"
 	"github.com/shopmonkeyus/eds/internal/upgrade"
 	"github.com/shopmonkeyus/eds/internal/util"
@@ -126,9 +129,7 @@ func sendStart(logger logger.Logger, apiURL string, apiKey string, driverUrl str
 	return &sessionResp.Data, nil
 }
 
-func sendEnd(logger logger.Logger, apiURL string, apiKey string, sessionId string, errored bool) (*api.SessionEndURLs, error) {
-	var body api.SessionEnd
-	body.Errored = errored
+func sendEnd(logger logger.Logger, apiURL string, apiKey string, sessionId string, body api.SessionEnd) (*api.SessionEndURLs, error) {
 	req, err := http.NewRequest("POST", apiURL+"/v3/eds/internal/"+sessionId, bytes.NewBuffer([]byte(util.JSONStringify(body))))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
@@ -218,9 +219,18 @@ func getRemainingLog(logsDir string) (string, error) {
 	return last, nil
 }
 
-func sendEndAndUpload(logger logger.Logger, apiurl string, apikey string, sessionId string, errored bool, logfile string, stderrFile string) (string, error) {
+// sessionEnd returns the end of the session for the exit code of the server.
+func sessionEnd(exitCode int) api.SessionEnd {
+	end := api.SessionEnd{Errored: exitCode != 0 && exitCode != exitCodeRestart}
+	if def, ok := errcode.ForExitCode(exitCode); ok && end.Errored {
+		end.ErrorCode = string(def.Code)
+	}
+	return end
+}
+
+func sendEndAndUpload(logger logger.Logger, apiurl string, apikey string, sessionId string, end api.SessionEnd, logfile string, stderrFile string) (string, error) {
 	logger.Info("uploading logs for session: %s", sessionId)
-	urls, err := sendEnd(logger, apiurl, apikey, sessionId, errored)
+	urls, err := sendEnd(logger, apiurl, apikey, sessionId, end)
 	if err != nil {
 		return "", fmt.Errorf("failed to send session end: %w", err)
 	}
@@ -237,7 +247,7 @@ func sendEndAndUpload(logger logger.Logger, apiurl string, apikey string, sessio
 		}
 	}
 	logger.Trace("logs uploaded successfully for session: %s", sessionId)
-	if errored {
+	if end.Errored {
 		logger.Info("error log files saved to %s for session: %s", logfile, sessionId)
 	}
 	return logFileStoragePath, nil
@@ -269,20 +279,79 @@ func getLogUploadURL(logger logger.Logger, apiURL string, apiKey string, session
 	return s.Data.URL, nil
 }
 
+// getSchemaValidator returns the remote schema validator files for the session or nil if there isn't one configured.
+func getSchemaValidator(logger logger.Logger, apiURL string, apiKey string, sessionId string) (*api.SchemaValidatorBundle, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v3/eds/internal/%s/validator", apiURL, sessionId), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	setHTTPHeader(req, apiKey)
+	retry := util.NewHTTPRetry(req, util.WithLogger(logger))
+	resp, err := retry.Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema validator: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, handleAPIError(resp, "schema validator")
+	}
+	var s api.SchemaValidatorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if !s.Success {
+		return nil, fmt.Errorf("failed to get schema validator: %s", s.Message)
+	}
+	if len(s.Data.Files) == 0 {
+		return nil, nil
+	}
+	return &s.Data, nil
+}
+
+// syncRemoteSchemaValidator will fetch the remote schema validator and write it into dir.
+// It returns true if a remote schema validator is configured and true if the files changed.
+func syncRemoteSchemaValidator(logger logger.Logger, apiURL string, apiKey string, sessionId string, dir string) (bool, bool, error) {
+	bundle, err := getSchemaValidator(logger, apiURL, apiKey, sessionId)
+	if err != nil {
+		return false, false, err
+	}
+	if bundle == nil {
+		if util.Exists(dir) {
+			logger.Info("remote schema validator removed")
+			return false, true, os.RemoveAll(dir)
+		}
+		return false, false, nil
+	}
+	changed, err := util.SyncSchemaValidatorFiles(dir, bundle.Files)
+	if err != nil {
+		return true, false, err
+	}
+	if changed {
+		logger.Info("remote schema validator updated")
+	}
+	return true, changed, nil
+}
+
 var serverIgnoreFlags = map[string]bool{
-	"--api-url":        true,
-	"--api-key":        true,
-	"--eds-id":         true,
-	"--silent":         true,
-	"--port":           true,
-	"--health-port":    true,
-	"--renew-interval": true,
-	"--wrapper":        true,
-	"--parent":         true,
-	"--url":            true,
-	"--server":         true,
-	"--keep-logs":      true,
-	"--no-restart":     true,
+	"--api-url":                  true,
+	"--api-key":                  true,
+	"--eds-id":                   true,
+	"--silent":                   true,
+	"--port":                     true,
+	"--health-port":              true,
+	"--renew-interval":           true,
+	"--schema-validator-refresh": true,
+	"--wrapper":                  true,
+	"--parent":                   true,
+	"--url":                      true,
+	"--server":                   true,
+	"--keep-logs":                true,
+	"--no-restart":               true,
+	"--tables":                   true,
+	"--feature":                  true,
 }
 
 func collectCommandArgs() []string {
@@ -480,16 +549,25 @@ var serverCmd = &cobra.Command{
 		driverURL := viper.GetString("url")
 		server := mustFlagString(cmd, "server", false)
 		apikey := viper.GetString("token")
-		if apikey == "" {
-			logger.Fatal("API key not found. Make sure you run %s before continuing.", getCommandExample("enroll", "[CODE]"))
-		}
 		keepLogs := viper.GetBool("keep_logs")
+		tables := viper.GetStringSlice("tables")
+		features := viper.GetStringSlice("features")
 		verbose := mustFlagBool(cmd, "verbose", false)
 		noRestart := mustFlagBool(cmd, "no-restart", false)
 
 		// run the wrapper to handle the rest of the code from inside the wrapper
 		wrapper := mustFlagBool(cmd, "wrapper", false)
 		if !wrapper {
+			// validate everything before connecting anywhere so a misconfigured install fails fast with all of its problems
+			report := checkServerConfig(cmd, apiurl, apikey, driverURL, dataDir, tables, features)
+			report.print(logger)
+			if len(report.errors) > 0 {
+				os.Exit(exitCodeIncorrectUsage)
+			}
+			if mustFlagBool(cmd, "check-config", false) {
+				logger.Info("configuration is valid")
+				return
+			}
 			runWrapperLoop(logger)
 			return
 		}
@@ -754,11 +832,20 @@ var serverCmd = &cobra.Command{
 			}
 		}
 
-		runImport := func(ctx context.Context, url string, schemaOnly bool, validateOnly bool) (bool, bool, *string, *string) {
+		runImport := func(ctx context.Context, url string, schemaOnly bool, validateOnly bool, only ...string) (bool, bool, *string, *string) {
 			importargs := []string{"--url", url, "--api-key", apikey, "--no-confirm", "--data-dir", dataDir}
 			if schemaOnly {
 				importargs = append(importargs, "--schema-only")
 			}
+			if len(only) > 0 {
+				importargs = append(importargs, "--only", strings.Join(only, ","))
+			}
+			if encryptScratch, _ := cmd.Flags().GetBool("encrypt-scratch"); encryptScratch {
+				importargs = append(importargs, "--encrypt")
+			}
+			if scratchQuotaMB, _ := cmd.Flags().GetInt64("scratch-quota-mb"); scratchQuotaMB > 0 {
+				importargs = append(importargs, "--scratch-quota-mb", fmt.Sprint(scratchQuotaMB))
+			}
 			if validateOnly {
 				importargs = append(importargs, "--validate-only", "--silent")
 			} else {
@@ -861,8 +948,13 @@ var serverCmd = &cobra.Command{
 			}
 		}
 
+		// imports pause and restart the fork so only run one at a time
+		var importLock sync.Mutex
+
 		importaction := func(req *notification.ImportRequest) *notification.ImportResponse {
 			logger.Trace("received import action")
+			importLock.Lock()
+			defer importLock.Unlock()
 			pause() // pause the consumer, if any, from processing any data while we are importing
 			success, _, msg, uploadLogPath := runImport(ctx, driverURL, !req.Backfill, false)
 			if !configured {
@@ -874,6 +966,117 @@ var serverCmd = &cobra.Command{
 			return &notification.ImportResponse{SessionID: sessionId, Success: success, Message: msg, LogPath: uploadLogPath}
 		}
 
+		// the fork records the tables the consumer created when their first event arrived, run a targeted import
+		// for those so they have the data from before. tables which fail aren't retried until the server restarts.
+		backfillNewTables, _ := cmd.Flags().GetBool("backfill-new-tables")
+		backfillFailed := make(map[string]bool)
+
+		backfill := func() {
+			if !configured {
+				return
+			}
+			pending, err := getPendingBackfill(port)
+			if err != nil {
+				logger.Error("%s", err)
+				return
+			}
+			var tables []string
+			for _, table := range pending {
+				if !backfillFailed[table] {
+					tables = append(tables, table)
+				}
+			}
+			if len(tables) == 0 {
+				return
+			}
+			importLock.Lock()
+			defer importLock.Unlock()
+			logger.Info("backfilling new tables: %s", strings.Join(tables, ", "))
+			pause()
+			_, imported, msg, _ := runImport(ctx, driverURL, false, false, tables...)
+			if !imported {
+				for _, table := range tables {
+					backfillFailed[table] = true
+				}
+				if msg != nil {
+					logger.Error("backfill failed for tables: %s. %s", strings.Join(tables, ", "), *msg)
+				} else {
+					logger.Error("backfill failed for tables: %s", strings.Join(tables, ", "))
+				}
+			}
+			restart() // restart the fork to pick up the new timestamps
+		}
+
+		// send heartbeats which the fork couldn't publish to nats to the api so the control plane still sees we're alive
+		sendFailedHeartbeat := func() {
+			if !configured || sessionId == "" {
+				return
+			}
+			failed, err := getFailedHeartbeat(port)
+			if err != nil {
+				logger.Trace("%s", err)
+				return
+			}
+			if failed == nil {
+				return
+			}
+			if err := sendHeartbeat(logger, apiurl, apikey, sessionId, failed); err != nil {
+				logger.Error("%s", err)
+			}
+		}
+
+		// the control plane sends the tables the server should receive, save them so they are used
+		// on the next start and change them in the running fork without a restart
+		changeTables := func(newTables []string) error {
+			logger.Info("tables changed: %s", strings.Join(newTables, ", "))
+			tables = newTables
+			viper.Set("tables", newTables)
+			if err := viper.WriteConfig(); err != nil {
+				logger.Error("failed to write config: %s", err)
+			}
+			if !configured {
+				return nil
+			}
+			resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/control/tables", port), "application/json", strings.NewReader(util.JSONStringify(newTables)))
+			if err != nil {
+				return fmt.Errorf("failed to change tables: %w", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to change tables: %d", resp.StatusCode)
+			}
+			return nil
+		}
+
+		// the control plane sends the feature flags for the install, save them so they are used on the next start
+		// and change them in the running fork without a restart
+		changeFeatures := func(newFeatures []string) error {
+			if _, err := feature.Parse(newFeatures); err != nil {
+				return err
+			}
+			logger.Info("features changed: %s", strings.Join(newFeatures, ", "))
+			features = newFeatures
+			viper.Set("features", newFeatures)
+			if err := viper.WriteConfig(); err != nil {
+				logger.Error("failed to write config: %s", err)
+			}
+			if !configured {
+				return nil
+			}
+			return postFeatureFlags(port, newFeatures)
+		}
+
+		// the control plane can ask for the latest schema to be fetched and the tables migrated, such as after a model release
+		refreshSchema := func(tables []string) error {
+			if !configured {
+				return fmt.Errorf("server is not configured")
+			}
+			if _, err := postSchemaRefresh(port, tables); err != nil {
+				return err
+			}
+			return nil
+		}
+
 		driverconfig := func() *notification.DriverConfigResponse {
 			config := internal.GetDriverConfigurations()
 			return &notification.DriverConfigResponse{
@@ -897,6 +1100,32 @@ var serverCmd = &cobra.Command{
 			}
 		}
 
+		// the fork watches the schema validator directory and reloads on change, but must be restarted when
+		// a remote schema validator is added or removed since that changes the flags we pass to it
+		localSchemaValidator := mustFlagString(cmd, "schema-validator", false)
+		schemaValidatorRefresh, _ := cmd.Flags().GetDuration("schema-validator-refresh")
+		remoteSchemaValidatorDir := filepath.Join(dataDir, "schema-validator")
+		var remoteSchemaValidator bool
+		var schemaValidatorLock sync.Mutex
+
+		refreshSchemaValidator := func() bool {
+			if localSchemaValidator != "" || schemaValidatorRefresh <= 0 || sessionId == "" {
+				return false
+			}
+			schemaValidatorLock.Lock()
+			defer schemaValidatorLock.Unlock()
+			found, _, err := syncRemoteSchemaValidator(logger, apiurl, apikey, sessionId, remoteSchemaValidatorDir)
+			if err != nil {
+				logger.Error("failed to sync remote schema validator: %s", err)
+				return false
+			}
+			if found != remoteSchemaValidator {
+				remoteSchemaValidator = found
+				return true
+			}
+			return false
+		}
+
 		natsurl := mustFlagString(cmd, "server", true)
 		if strings.Contains(apiurl, "localhost") {
 			natsurl = "nats://localhost:4222"
@@ -904,16 +1133,19 @@ var serverCmd = &cobra.Command{
 
 		// create a notification consumer that will listen for notification actions and handle them here
 		notificationConsumer := notification.New(logger, natsurl, notification.NotificationHandler{
-			Restart:      restart,
-			Shutdown:     shutdown,
-			Pause:        pause,
-			Unpause:      unpause,
-			Upgrade:      upgrade,
-			SendLogs:     sendLogs,
-			Configure:    configure,
-			Import:       importaction,
-			DriverConfig: driverconfig,
-			Validate:     validate,
+			Restart:       restart,
+			Shutdown:      shutdown,
+			Pause:         pause,
+			Unpause:       unpause,
+			Upgrade:       upgrade,
+			SendLogs:      sendLogs,
+			Configure:     configure,
+			Import:        importaction,
+			DriverConfig:  driverconfig,
+			Validate:      validate,
+			Tables:        changeTables,
+			RefreshSchema: refreshSchema,
+			Features:      changeFeatures,
 		})
 
 		// setup tickers
@@ -923,15 +1155,39 @@ var serverCmd = &cobra.Command{
 		logSenderTicker := time.NewTicker(time.Hour)
 		defer renewTicker.Stop()
 		defer logSenderTicker.Stop()
+		var schemaValidatorTicker <-chan time.Time
+		if localSchemaValidator == "" && schemaValidatorRefresh > 0 {
+			ticker := time.NewTicker(schemaValidatorRefresh)
+			defer ticker.Stop()
+			schemaValidatorTicker = ticker.C
+		} else if localSchemaValidator != "" {
+			logger.Debug("using local schema validator: %s, remote schema validator disabled", localSchemaValidator)
+		}
+		var backfillTicker <-chan time.Time
+		if backfillNewTables {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			backfillTicker = ticker.C
+		}
+		heartbeatTicker := time.NewTicker(time.Minute)
+		defer heartbeatTicker.Stop()
 		go func() {
 			defer util.RecoverPanic(logger)
 			for {
 				select {
+				case <-heartbeatTicker.C:
+					sendFailedHeartbeat()
+				case <-backfillTicker:
+					backfill()
 				case <-logSenderTicker.C:
 					// ask the notification consumer to send the logs so it can report the success/failure
 					notificationConsumer.CallSendLogs()
 				case <-renewTicker.C:
 					restart()
+				case <-schemaValidatorTicker:
+					if refreshSchemaValidator() {
+						restart()
+					}
 				}
 			}
 		}()
@@ -992,6 +1248,18 @@ var serverCmd = &cobra.Command{
 				"--url", driverURL,
 				"--server", natsurl,
 			)
+			if len(tables) > 0 {
+				args = append(args, "--tables", strings.Join(tables, ","))
+			}
+			if len(features) > 0 {
+				args = append(args, "--feature", strings.Join(features, ","))
+			}
+			refreshSchemaValidator()
+			schemaValidatorLock.Lock()
+			if remoteSchemaValidator {
+				args = append(args, "--schema-validator", remoteSchemaValidatorDir)
+			}
+			schemaValidatorLock.Unlock()
 			result, err := command.Fork(command.ForkArgs{
 				Log:              logger,
 				Command:          "fork",
@@ -1020,7 +1288,7 @@ var serverCmd = &cobra.Command{
 						logger.Error("failed to get remaining log: %s", err)
 					}
 					logsLock.Lock()
-					logPath, err := sendEndAndUpload(logger, apiurl, apikey, session.SessionId, ec != 0 && ec != exitCodeRestart, logFile, filepath.Join(sessionDir, "server_stderr.txt"))
+					logPath, err := sendEndAndUpload(logger, apiurl, apikey, session.SessionId, sessionEnd(ec), logFile, filepath.Join(sessionDir, "server_stderr.txt"))
 					logsLock.Unlock()
 					if err != nil {
 						logger.Error("failed to send end and upload logs: %s", err)
@@ -1051,7 +1319,11 @@ var serverCmd = &cobra.Command{
 					logger.Info("server shut down as part of restart (code = %d)", ec)
 				} else {
 					failures++
-					logger.Error("server exited with code %d", ec)
+					if def, ok := errcode.ForExitCode(ec); ok {
+						logger.With(map[string]any{"code": def.Code}).Error("server exited with code %d (%s: %s, %s)", ec, def.Code, def.Summary, def.Remediation)
+					} else {
+						logger.Error("server exited with code %d", ec)
+					}
 				}
 			}
 			notificationConsumer.Stop()
@@ -1140,9 +1412,30 @@ func init() {
 	serverCmd.Flags().String("eds-id", "", "the EDS server ID")
 	viper.BindPFlag("server_id", serverCmd.Flags().Lookup("eds-id"))
 	serverCmd.Flags().StringSlice("companyIds", nil, "restrict to a specific company ID or multiple, if not set will use all")
+	serverCmd.Flags().StringSlice("locationIds", nil, "restrict to a specific location ID or multiple, if not set will use all. events without a location are always received")
+	serverCmd.Flags().StringSlice("only", nil, "only receive these tables, the other tables are never delivered")
+	serverCmd.Flags().StringSlice("except", nil, "never receive these tables")
 	serverCmd.Flags().MarkHidden("companyIds") // not intended for production use
+	serverCmd.Flags().StringSlice("tables", nil, "restrict to a specific table or multiple, if not set will use all. this is normally set by Shopmonkey")
+	viper.BindPFlag("tables", serverCmd.Flags().Lookup("tables"))
+	serverCmd.Flags().StringSlice("feature", nil, featureFlagsHelp())
+	viper.BindPFlag("features", serverCmd.Flags().Lookup("feature"))
+	serverCmd.Flags().StringArray("field-filter", nil, "only deliver updates to a table which change one of the columns such as order=status,workflowStatusId, use * for every other table (can be repeated)")
+	serverCmd.Flags().StringArray("flush-group", nil, "a comma separated group of tables, parents first, whose events from the same transaction are committed in the same flush such as order,orderLineItem (can be repeated)")
+	serverCmd.Flags().Bool("isolate-companies", false, "run a consumer with its own driver for each company of the credentials so one company's backlog or failures don't stall the others")
+	serverCmd.Flags().StringSlice("companyQuota", nil, "limit the events per second for a company using companyId=rate, use * for all companies")
+	serverCmd.Flags().StringSlice("max-events-per-second", nil, "limit the events per second sent to the driver, use driver=rate to only limit a driver such as snowflake=500 (0 is unlimited)")
+	serverCmd.Flags().StringSlice("remote-control", nil, "allow the Shopmonkey control plane to send signed commands for these actions ("+strings.Join(control.Actions, ", ")+")")
 	serverCmd.Flags().Bool("keep-logs", false, "keep logs after the server exits instead of deleting them")
 	viper.BindPFlag("keep_logs", serverCmd.Flags().Lookup("keep-logs"))
+	serverCmd.Flags().Bool("check-config", false, "validate the configuration, print the effective configuration and exit")
+	serverCmd.Flags().Bool("backfill-new-tables", false, "backfill the data for tables which are created when their first event arrives")
+	serverCmd.Flags().Bool("pre-migrate", false, "apply the migrations for all tables in the schema registry before consuming")
+	serverCmd.Flags().Bool("repair-schema-drift", false, "add back the columns which were removed from a destination table outside of eds instead of only reporting them")
+	serverCmd.Flags().Bool("wait-for-destination", false, "wait with a backoff for the destination to pass its connection test and the migrations to complete before consuming instead of exiting")
+	serverCmd.Flags().Duration("wait-for-destination-timeout", 0, "how long to wait for the destination before exiting (0 waits forever)")
+	serverCmd.Flags().Duration("reconnect-timeout", consumer.DefaultReconnectTimeout, "how long to try re-establishing the consumer after the connection to the nats server is lost before restarting (0 restarts immediately)")
+	serverCmd.Flags().StringSlice("metrics-labels", nil, "add labels to every metric to identify the install ("+strings.Join(internal.MetricLabelNames(), ", ")+")")
 
 	// deprecated but left for backwards compatibility
 	serverCmd.Flags().Int("health-port", 0, "the port to listen for health checks")
@@ -1155,16 +1448,35 @@ func init() {
 	serverCmd.Flags().MarkHidden("server")
 	serverCmd.Flags().String("consumer-suffix", "", "suffix which is appended to the nats consumer group name")
 	serverCmd.Flags().MarkHidden("consumer-suffix")
+	serverCmd.Flags().Int64("scratch-quota-mb", 0, "the maximum size in megabytes of temporary files drivers can stage on disk (0 is unlimited)")
+	serverCmd.Flags().Bool("encrypt-scratch", false, "encrypt the files downloaded by imports and the temporary files drivers stage on disk with a key which is only kept in memory")
+	serverCmd.Flags().Int("max-event-size-kb", 0, "the maximum size in kilobytes of an event, larger events are quarantined (0 is unlimited)")
+	serverCmd.Flags().Int("retry-max-attempts", consumer.DefaultRetryMaxAttempts, "the number of times events which failed with a transient error are retried from the retry queue before they're given up on (0 disables the retry queue)")
+	serverCmd.Flags().Int("backpressure-threshold", 0, "pause pulling messages when this many are waiting to be processed until they drain (0 uses half of max ack pending, -1 disables)")
+	serverCmd.Flags().Duration("backpressure-flush-latency", 0, "pause pulling messages when a flush takes longer than this until the destination catches up (0 disables)")
+	serverCmd.Flags().Int64("max-buffered-mb", 0, "pause pulling messages when the messages held in memory until they're acked reach this size in megabytes until the flushes release them (0 disables)")
+	serverCmd.Flags().Bool("spill", false, "write the messages which arrive once --max-buffered-mb is reached to the data directory instead of holding them in memory")
+	serverCmd.Flags().Int("pipelines", 1, "the number of pipelines with their own driver connection which the events are sharded into so a slow table doesn't hold up the others")
+	serverCmd.Flags().Bool("journal", false, "record the events handed to the driver in a journal in the data directory until they're acked so a crash can be checked for gaps or duplicates in the destination on the next start")
+	serverCmd.Flags().String("pipeline-shard", consumer.PipelineShardTable, "how events are sharded into the pipelines (table, key), key spreads a busy table across the pipelines but can't be used with migrations or flush groups")
+	addPullFlags(serverCmd)
+	addTuningFlags(serverCmd)
+	addMemoryFlags(serverCmd)
 	serverCmd.Flags().Int("maxAckPending", defaultMaxAckPending, "the number of max ack pending messages")
 	serverCmd.Flags().MarkHidden("maxAckPending")
 	serverCmd.Flags().Int("maxPendingBuffer", defaultMaxPendingBuffer, "the maximum number of messages to pull from nats to buffer")
 	serverCmd.Flags().MarkHidden("maxPendingBuffer")
 	serverCmd.Flags().Duration("minPendingLatency", consumer.DefaultMinPendingLatency, "the minimum accumulation period before flushing (0 uses default)")
-	serverCmd.Flags().MarkHidden("minPendingLatency")
 	serverCmd.Flags().Duration("maxPendingLatency", consumer.DefaultMaxPendingLatency, "the maximum accumulation period before flushing (0 uses default)")
-	serverCmd.Flags().MarkHidden("maxPendingLatency")
+	serverCmd.Flags().String("flushPolicy", consumer.FlushPolicyBalanced, "the policy for deciding when to flush ("+strings.Join(consumer.FlushPolicyNames(), ", ")+")")
+	serverCmd.Flags().MarkHidden("flushPolicy")
+	serverCmd.Flags().String("ordering", "", "how to handle events delivered out of order for the same record (detect, enforce)")
+	serverCmd.Flags().Int("ordering-max-keys", consumer.DefaultOrderingMaxKeys, "the number of the most recently changed records whose last version is remembered by --ordering")
 	serverCmd.Flags().Bool("restart", false, "restart the consumer from the beginning (only works on new consumers)")
 	serverCmd.Flags().MarkHidden("restart")
+	serverCmd.Flags().Bool("fix-start-position", false, "recreate an existing consumer which started after the import so that it delivers from the import timestamp")
+	serverCmd.Flags().Duration("schema-validator-refresh", time.Minute*5, "the interval to check for remote schema validator changes (0 disables)")
+	serverCmd.Flags().MarkHidden("schema-validator-refresh")
 	serverCmd.Flags().Duration("renew-interval", time.Hour*24, "the interval to renew the session")
 	serverCmd.Flags().MarkHidden("renew-interval")
 	serverCmd.Flags().Bool("wrapper", false, "running in wrapper mode")
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/spf13/cobra"
+)
+
+const defaultSnapshotLimit = 1_000
+
+// snapshotResponse sets the headers of the response on the first write so that an error which happens before any
+// rows are written can still be returned with its status.
+type snapshotResponse struct {
+	w       http.ResponseWriter
+	table   string
+	started bool
+}
+
+func (s *snapshotResponse) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "text/csv")
+		s.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.table+".csv"))
+		s.w.WriteHeader(http.StatusOK)
+	}
+	return s.w.Write(p)
+}
+
+// snapshotHandler streams the rows of a destination table as CSV for drivers which support it.
+func snapshotHandler(logger logger.Logger, driver internal.Driver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshotter, ok := driver.(internal.DriverSnapshot)
+		if !ok {
+			http.Error(w, "the driver doesn't support snapshots", http.StatusNotImplemented)
+			return
+		}
+		table := r.URL.Query().Get("table")
+		if table == "" {
+			http.Error(w, "table is required", http.StatusBadRequest)
+			return
+		}
+		limit := defaultSnapshotLimit
+		if val := r.URL.Query().Get("limit"); val != "" {
+			l, err := strconv.Atoi(val)
+			if err != nil || l < 0 {
+				http.Error(w, "invalid limit: "+val, http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+		resp := &snapshotResponse{w: w, table: table}
+		if err := snapshotter.Snapshot(r.Context(), logger, table, limit, resp); err != nil {
+			if errors.Is(err, internal.ErrTableNotFound) {
+				http.Error(w, "table not found: "+table, http.StatusNotFound)
+				return
+			}
+			logger.Error("error writing snapshot of table %s: %s", table, err)
+			if !resp.started {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	}
+}
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot <table>",
+	Short: "Write the rows of a destination table of the running server as CSV",
+	Long:  "Write the rows of a destination table of the running server as CSV to verify the contents of the destination.\nOnly the drivers for SQL databases support snapshots.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger(cmd).WithPrefix("[snapshot]")
+		port := mustFlagInt(cmd, "port", true)
+		limit := mustFlagInt(cmd, "limit", false)
+		output := mustFlagString(cmd, "output", false)
+		query := url.Values{"table": {args[0]}, "limit": {strconv.Itoa(limit)}}
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/control/snapshot?%s", port, query.Encode()))
+		if err != nil {
+			logger.Fatal("failed to get snapshot: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			buf, _ := io.ReadAll(resp.Body)
+			logger.Fatal("failed to get snapshot: %d: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
+		}
+		out := os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			if err != nil {
+				logger.Fatal("failed to create %s: %s", output, err)
+			}
+			defer f.Close()
+			out = f
+		}
+		if _, err := io.Copy(out, resp.Body); err != nil {
+			logger.Fatal("failed to write snapshot: %s", err)
+		}
+		if output != "" {
+			logger.Info("wrote snapshot of table %s to %s", args[0], output)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.Flags().Int("port", getOSInt("PORT", 8080), "the port the server is listening on for health checks, metrics etc")
+	snapshotCmd.Flags().Int("limit", defaultSnapshotLimit, "the maximum number of rows to write (0 writes all of them)")
+	snapshotCmd.Flags().StringP("output", "o", "", "the file to write the CSV to instead of stdout")
+}
@@ -31,7 +31,8 @@ type SessionStartResponse struct {
 }
 
 type SessionEnd struct {
-	Errored bool `json:"errored"`
+	Errored   bool   `json:"errored"`
+	ErrorCode string `json:"errorCode,omitempty"` // the error code of the exit code of the server when known
 }
 
 type SessionEndURLs struct {
@@ -45,6 +46,16 @@ type SessionEndResponse struct {
 	Data    SessionEndURLs `json:"data"`
 }
 
+type SchemaValidatorBundle struct {
+	Files map[string]string `json:"files"` // relative filename to file contents, must include a config.json
+}
+
+type SchemaValidatorResponse struct {
+	Success bool                  `json:"success"`
+	Message string                `json:"message"`
+	Data    SchemaValidatorBundle `json:"data"`
+}
+
 type EnrollTokenData struct {
 	Token    string `json:"token" toml:"token"`
 	ServerID string `json:"serverId" toml:"server_id"`
@@ -0,0 +1,113 @@
+package consumer
+
+import (
+	"math"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ackFloor tracks the messages of a consumer with the ack all policy, where acking a message acks every message before
+// it in the stream. Only the highest message which is done and below the first message which is still outstanding is
+// acked, so a message which was nacked isn't acked by a later one before it's redelivered.
+type ackFloor struct {
+	lock        sync.Mutex
+	outstanding map[uint64]bool          // the stream sequences of the messages delivered but not done
+	done        map[uint64]jetstream.Msg // the messages which are done but not acked yet by stream sequence
+}
+
+func newAckFloor() *ackFloor {
+	return &ackFloor{
+		outstanding: make(map[uint64]bool),
+		done:        make(map[uint64]jetstream.Msg),
+	}
+}
+
+// deliver records a message which was delivered, or nacked and will be redelivered.
+func (a *ackFloor) deliver(seq uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.outstanding[seq] = true
+	delete(a.done, seq)
+}
+
+// complete records a message which was processed or skipped so it can be acked.
+func (a *ackFloor) complete(seq uint64, msg jetstream.Msg) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.outstanding, seq)
+	a.done[seq] = msg
+}
+
+// drop forgets a message which the server won't redeliver.
+func (a *ackFloor) drop(seq uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.outstanding, seq)
+}
+
+// next returns the message to ack and the number of messages which it acks, or nil if there's nothing to ack.
+func (a *ackFloor) next() (jetstream.Msg, int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	lowest := uint64(math.MaxUint64)
+	for seq := range a.outstanding {
+		lowest = min(lowest, seq)
+	}
+	var highest uint64
+	var msg jetstream.Msg
+	for seq, m := range a.done {
+		if seq < lowest && seq > highest {
+			highest, msg = seq, m
+		}
+	}
+	if msg == nil {
+		return nil, 0
+	}
+	var count int
+	for seq := range a.done {
+		if seq <= highest {
+			delete(a.done, seq)
+			count++
+		}
+	}
+	return msg, count
+}
+
+// ackAll marks the messages as done and acks the highest contiguous one with the ack all policy.
+func (c *Consumer) ackAll(msgs []jetstream.Msg) error {
+	for _, m := range msgs {
+		md, err := m.Metadata()
+		if err != nil {
+			return err
+		}
+		c.acks.complete(md.Sequence.Stream, m)
+	}
+	msg, count := c.acks.next()
+	if msg == nil {
+		return nil
+	}
+	c.logger.Trace("acking %d msgs up to %s", count, msg.Reply())
+	return msg.Ack()
+}
+
+// nacked records a message which was nacked with the ack all policy so it holds back the acks until it's redelivered,
+// unless it was delivered for the last time.
+func (c *Consumer) nacked(msg jetstream.Msg) {
+	if c.acks == nil {
+		return
+	}
+	md, err := msg.Metadata()
+	if err != nil {
+		return
+	}
+	maxDeliver := c.maxDeliver
+	if maxDeliver == 0 {
+		maxDeliver = DefaultMaxDeliver
+	}
+	if md.NumDelivered >= uint64(maxDeliver) {
+		c.acks.drop(md.Sequence.Stream)
+		return
+	}
+	c.acks.deliver(md.Sequence.Stream)
+}
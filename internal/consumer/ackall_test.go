@@ -0,0 +1,197 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type ackMsg struct {
+	jetstream.Msg
+}
+
+func TestAckFloor(t *testing.T) {
+	a := newAckFloor()
+	msgs := make([]jetstream.Msg, 6)
+	for i := range msgs {
+		msgs[i] = &ackMsg{}
+	}
+	msg, count := a.next()
+	assert.Nil(t, msg)
+	assert.Equal(t, 0, count)
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		a.deliver(seq)
+	}
+	a.complete(1, msgs[1])
+	a.complete(2, msgs[2])
+	a.complete(4, msgs[4])
+	msg, count = a.next()
+	assert.Same(t, msgs[2], msg, "3 is outstanding")
+	assert.Equal(t, 2, count)
+
+	// 3 was nacked and 4 is redelivered so both hold back 5
+	a.deliver(3)
+	a.deliver(4)
+	a.complete(5, msgs[5])
+	msg, _ = a.next()
+	assert.Nil(t, msg)
+
+	a.complete(3, msgs[3])
+	a.drop(4) // delivered for the last time
+	msg, count = a.next()
+	assert.Same(t, msgs[5], msg)
+	assert.Equal(t, 2, count)
+	msg, _ = a.next()
+	assert.Nil(t, msg)
+}
+
+func TestAckAll(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		var lock sync.Mutex
+		var processed []string
+		newConsumer := func(ackAll bool) *Consumer {
+			consumer, err := NewConsumer(ConsumerConfig{
+				Context: context.Background(),
+				Logger:  logger.NewTestLogger(),
+				Driver: &mockDriver{
+					process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+						lock.Lock()
+						defer lock.Unlock()
+						processed = append(processed, event.ID)
+						return false, nil
+					},
+				},
+				URL:               natsurl,
+				AckAll:            ackAll,
+				MinPendingLatency: 10 * time.Millisecond,
+				MaxPendingLatency: 50 * time.Millisecond,
+			})
+			assert.NoError(t, err)
+			return consumer
+		}
+		publish := func(ids ...int) {
+			for _, id := range ids {
+				evt := internal.DBChangeEvent{ID: fmt.Sprint(id), Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+				_, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+				assert.NoError(t, err)
+			}
+		}
+		waitForAckFloor := func(consumer *Consumer, seq uint64) {
+			assert.Eventually(t, func() bool {
+				info, err := consumer.jsconn.Info(context.Background())
+				return err == nil && info.AckFloor.Stream == seq && info.NumAckPending == 0
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+
+		consumer := newConsumer(false)
+		publish(1, 2)
+		waitForAckFloor(consumer, 2)
+		assert.NoError(t, consumer.Stop())
+
+		// the consumer is recreated with the ack all policy after the last acked message
+		consumer = newConsumer(true)
+		defer consumer.Stop()
+		assert.Equal(t, jetstream.AckAllPolicy, consumer.jsconn.CachedInfo().Config.AckPolicy)
+		publish(3, 4, 5)
+		waitForAckFloor(consumer, 5)
+		lock.Lock()
+		assert.Equal(t, []string{"1", "2", "3", "4", "5"}, processed)
+		lock.Unlock()
+	})
+}
+
+func TestAckAllWithPipelines(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		_, err := NewConsumer(ConsumerConfig{
+			Context:   context.Background(),
+			Logger:    logger.NewTestLogger(),
+			Driver:    &mockDriver{},
+			URL:       natsurl,
+			AckAll:    true,
+			Pipelines: 2,
+			NewPipelineDriver: func() (Driver, error) {
+				return &mockDriver{}, nil
+			},
+		})
+		assert.ErrorContains(t, err, "the ack all policy can't be used with 2 pipelines")
+	})
+}
+
+func TestAckAllWithPausedTables(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		_, err := NewConsumer(ConsumerConfig{
+			Context:      context.Background(),
+			Logger:       logger.NewTestLogger(),
+			Driver:       &mockDriver{},
+			URL:          natsurl,
+			AckAll:       true,
+			PausedTables: []string{"order"},
+		})
+		assert.ErrorContains(t, err, "the ack all policy can't be used while tables are paused: order")
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  &mockDriver{},
+			URL:     natsurl,
+			AckAll:  true,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		// the events of a paused table would be acked by a later message before they're redelivered
+		consumer.PauseTable("order")
+		assert.Empty(t, consumer.PausedTables())
+	})
+}
+
+func TestAckAllPausedCompanyWithoutPark(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		var lock sync.Mutex
+		var processed []string
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					lock.Lock()
+					defer lock.Unlock()
+					processed = append(processed, event.ID)
+					return false, nil
+				},
+			},
+			URL:               natsurl,
+			AckAll:            true,
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		consumer.PauseCompany("CID")
+
+		// the event can't be nacked to be redelivered later without being acked by the next one so it's processed
+		companyID := "CID"
+		for _, id := range []string{"1", "2"} {
+			evt := internal.DBChangeEvent{ID: id, Table: "order", Operation: "INSERT", CompanyID: &companyID, Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+		assert.Eventually(t, func() bool {
+			info, err := consumer.jsconn.Info(context.Background())
+			return err == nil && info.AckFloor.Stream == 2 && info.NumAckPending == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, []string{"1", "2"}, processed)
+		lock.Unlock()
+	})
+}
@@ -0,0 +1,60 @@
+package consumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// validateRedeliveryBackoff returns an error if the backoff can't be used by the server or would redeliver messages
+// which are still pending.
+func validateRedeliveryBackoff(backoff []time.Duration, maxDeliver int) error {
+	if maxDeliver == 0 {
+		maxDeliver = DefaultMaxDeliver
+	}
+	if len(backoff) > maxDeliver {
+		return fmt.Errorf("redelivery backoff has %d delays which is more than the max deliver of %d", len(backoff), maxDeliver)
+	}
+	for _, delay := range backoff {
+		// the server uses the delay as the ack wait of the delivery so it must allow pending messages to be extended
+		if delay <= inProgressInterval {
+			return fmt.Errorf("redelivery backoff delay (%v) must be longer than %v", delay, inProgressInterval)
+		}
+	}
+	return nil
+}
+
+// redeliveryDelay returns the delay of the backoff for a message which was delivered the number of times.
+func redeliveryDelay(backoff []time.Duration, numDelivered uint64) time.Duration {
+	if len(backoff) == 0 {
+		return 0
+	}
+	if numDelivered == 0 {
+		numDelivered = 1
+	}
+	return backoff[min(int(numDelivered), len(backoff))-1]
+}
+
+// canDelay returns true if a message can be redelivered later without reaching the max deliver, in which case the
+// server would drop it.
+func (c *Consumer) canDelay(numDelivered uint64) bool {
+	maxDeliver := c.maxDeliver
+	if maxDeliver == 0 {
+		maxDeliver = DefaultMaxDeliver
+	}
+	return numDelivered < uint64(maxDeliver-maxDeliverSafetyMargin)
+}
+
+// nak tells the server to redeliver the message, after the delay of the backoff when there's one so a failing driver
+// isn't retried right away.
+func (c *Consumer) nak(m jetstream.Msg) error {
+	if len(c.redeliveryBackoff) == 0 {
+		return m.Nak()
+	}
+	md, err := m.Metadata()
+	if err != nil {
+		return m.Nak()
+	}
+	return m.NakWithDelay(redeliveryDelay(c.redeliveryBackoff, md.NumDelivered))
+}
@@ -0,0 +1,97 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRedeliveryBackoff(t *testing.T) {
+	assert.NoError(t, validateRedeliveryBackoff(nil, 0))
+	assert.NoError(t, validateRedeliveryBackoff([]time.Duration{2 * time.Minute, time.Hour}, 2))
+	assert.ErrorContains(t, validateRedeliveryBackoff([]time.Duration{2 * time.Minute, time.Hour}, 1), "more than the max deliver of 1")
+	assert.ErrorContains(t, validateRedeliveryBackoff([]time.Duration{time.Minute}, 0), "must be longer than 1m0s")
+	assert.ErrorContains(t, ConsumerConfig{MaxDeliver: -1}.ValidateTuning(), "max deliver must not be negative")
+	assert.ErrorContains(t, ConsumerConfig{RedeliveryBackoff: []time.Duration{time.Second}}.ValidateTuning(), "redelivery backoff delay")
+}
+
+func TestRedeliveryDelay(t *testing.T) {
+	backoff := []time.Duration{2 * time.Minute, 5 * time.Minute, time.Hour}
+	assert.Equal(t, time.Duration(0), redeliveryDelay(nil, 3))
+	assert.Equal(t, 2*time.Minute, redeliveryDelay(backoff, 0))
+	assert.Equal(t, 2*time.Minute, redeliveryDelay(backoff, 1))
+	assert.Equal(t, 5*time.Minute, redeliveryDelay(backoff, 2))
+	assert.Equal(t, time.Hour, redeliveryDelay(backoff, 3))
+	assert.Equal(t, time.Hour, redeliveryDelay(backoff, 10))
+}
+
+func TestCanDelay(t *testing.T) {
+	var c Consumer
+	assert.True(t, c.canDelay(DefaultMaxDeliver-2))
+	assert.False(t, c.canDelay(DefaultMaxDeliver-1))
+	c.maxDeliver = 3
+	assert.True(t, c.canDelay(1))
+	assert.False(t, c.canDelay(2))
+}
+
+func TestRedeliveryBackoff(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		var lock sync.Mutex
+		var processed int
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					lock.Lock()
+					defer lock.Unlock()
+					processed++
+					return false, nil
+				},
+				flush: func(logger logger.Logger) error {
+					return errors.New("destination is down")
+				},
+			},
+			URL:               natsurl,
+			MaxDeliver:        5,
+			RedeliveryBackoff: []time.Duration{2 * time.Minute, 5 * time.Minute},
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		config := consumer.jsconn.CachedInfo().Config
+		assert.Equal(t, 5, config.MaxDeliver)
+		assert.Equal(t, []time.Duration{2 * time.Minute, 5 * time.Minute}, config.BackOff)
+
+		evt := internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+		assert.NoError(t, err)
+		select {
+		case err := <-consumer.Error():
+			assert.ErrorContains(t, err, "destination is down")
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timed out waiting for the flush to fail")
+		}
+
+		// the failed message waits for the first delay of the backoff instead of being redelivered right away
+		time.Sleep(500 * time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, 1, processed)
+		lock.Unlock()
+		info, err := consumer.jsconn.Info(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, info.NumAckPending)
+		assert.Equal(t, 0, info.NumRedelivered)
+	})
+}
@@ -0,0 +1,133 @@
+package consumer
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	BackpressureReasonBuffer  = "buffer"  // the messages waiting to be processed reached the threshold
+	BackpressureReasonLatency = "latency" // a flush took longer than the max flush latency
+	BackpressureReasonRate    = "rate"    // the rate limit was used up or more messages are waiting than can be processed in a second at it
+	BackpressureReasonBytes   = "bytes"   // the messages held in memory reached the max buffered size
+
+	BackpressureDisabled = -1 // the threshold which disables pausing on the number of buffered messages
+)
+
+// backpressure decides when to stop pulling messages because the driver can't keep up. Without it the consumer keeps
+// pulling until MaxAckPending messages are in-flight and the ones waiting the longest are redelivered when their ack
+// wait expires, which adds more work for a driver which is already behind.
+type backpressure struct {
+	highWater       int           // pause when this many messages are waiting to be processed
+	lowWater        int           // resume when the messages waiting to be processed drop to this many
+	maxFlushLatency time.Duration // pause when a flush takes longer than this, 0 disables
+	rateHighWater   int           // pause when this many messages are waiting to be processed at the rate limit, 0 disables
+	limiter         *rate.Limiter // pause when the rate limit is used up, nil disables
+	limit           *bufferLimit  // pause when the messages held in memory reach the limit, nil disables
+	active          bool
+	reason          string
+	since           time.Time
+}
+
+// newBackpressure returns the backpressure for the threshold and max flush latency or nil if both are disabled.
+// A threshold of 0 uses half of max ack pending.
+func newBackpressure(threshold int, maxFlushLatency time.Duration, maxAckPending int) *backpressure {
+	if threshold == 0 {
+		threshold = maxAckPending / 2
+	}
+	if threshold < 0 {
+		threshold = 0
+	}
+	if threshold == 0 && maxFlushLatency <= 0 {
+		return nil
+	}
+	return &backpressure{
+		highWater:       threshold,
+		lowWater:        threshold / 4,
+		maxFlushLatency: maxFlushLatency,
+	}
+}
+
+// limitRate pauses pulling when the limiter is used up or more messages are waiting than can be sent to the driver in a
+// second at its rate, so the surplus stays in the stream instead of in memory. It returns the backpressure, which is
+// created if it was disabled.
+func (b *backpressure) limitRate(limiter *rate.Limiter) *backpressure {
+	if limiter == nil {
+		return b
+	}
+	if b == nil {
+		b = &backpressure{}
+	}
+	b.rateHighWater = limiter.Burst()
+	b.limiter = limiter
+	return b
+}
+
+// limitBytes pauses pulling when the messages held in memory reach the limit until the flushes release them. It returns
+// the backpressure, which is created if it was disabled.
+func (b *backpressure) limitBytes(limit *bufferLimit) *backpressure {
+	if limit == nil {
+		return b
+	}
+	if b == nil {
+		b = &backpressure{}
+	}
+	b.limit = limit
+	return b
+}
+
+// shouldPause returns true and the reason if pulling should be paused.
+func (b *backpressure) shouldPause(buffered int, lastFlush time.Duration) (bool, string) {
+	if b.active {
+		return false, ""
+	}
+	if b.highWater > 0 && buffered >= b.highWater {
+		return true, BackpressureReasonBuffer
+	}
+	if b.limiter != nil && (buffered >= b.rateHighWater || b.limiter.Tokens() < 1) {
+		return true, BackpressureReasonRate
+	}
+	if b.limit.full() {
+		return true, BackpressureReasonBytes
+	}
+	if b.maxFlushLatency > 0 && lastFlush > b.maxFlushLatency {
+		return true, BackpressureReasonLatency
+	}
+	return false, ""
+}
+
+// shouldResume returns true if pulling should resume. The buffer must drain to the low water mark, the messages held in
+// memory must drop to a quarter of the limit and a slow destination must have had a flush within the max flush latency,
+// unless there is nothing left to flush.
+func (b *backpressure) shouldResume(buffered int, pending int, lastFlush time.Duration) bool {
+	lowWater := b.lowWater
+	if b.reason == BackpressureReasonRate {
+		lowWater = b.rateHighWater / 4
+	}
+	if !b.active || buffered > lowWater {
+		return false
+	}
+	if b.reason == BackpressureReasonRate && b.limiter.Tokens() < float64(b.rateHighWater)/4 {
+		return false // wait for a quarter of a second of events so pulling isn't resumed for every event
+	}
+	if b.limit != nil && b.limit.size() > b.limit.maxBytes/4 {
+		return false
+	}
+	if b.maxFlushLatency > 0 && lastFlush > b.maxFlushLatency && buffered+pending > 0 {
+		return false
+	}
+	return true
+}
+
+func (b *backpressure) pause(reason string) {
+	b.active = true
+	b.reason = reason
+	b.since = time.Now()
+}
+
+func (b *backpressure) resume() time.Duration {
+	b.active = false
+	b.reason = ""
+	return time.Since(b.since)
+}
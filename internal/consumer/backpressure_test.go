@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBackpressure(t *testing.T) {
+	bp := newBackpressure(0, 0, 1000)
+	assert.NotNil(t, bp)
+	assert.Equal(t, 500, bp.highWater)
+	assert.Equal(t, 125, bp.lowWater)
+
+	assert.Nil(t, newBackpressure(BackpressureDisabled, 0, 1000))
+
+	bp = newBackpressure(BackpressureDisabled, time.Second, 1000)
+	assert.NotNil(t, bp)
+	assert.Equal(t, 0, bp.highWater)
+	assert.Equal(t, time.Second, bp.maxFlushLatency)
+}
+
+func TestBackpressureBuffer(t *testing.T) {
+	bp := newBackpressure(100, 0, 1000)
+	pause, _ := bp.shouldPause(99, time.Hour)
+	assert.False(t, pause)
+	pause, reason := bp.shouldPause(100, 0)
+	assert.True(t, pause)
+	assert.Equal(t, BackpressureReasonBuffer, reason)
+	bp.pause(reason)
+
+	pause, _ = bp.shouldPause(200, 0)
+	assert.False(t, pause, "already paused")
+	assert.False(t, bp.shouldResume(26, 0, 0))
+	assert.True(t, bp.shouldResume(25, 500, 0))
+	bp.resume()
+	assert.False(t, bp.active)
+	assert.False(t, bp.shouldResume(0, 0, 0), "not paused")
+}
+
+func TestBackpressureLatency(t *testing.T) {
+	bp := newBackpressure(BackpressureDisabled, time.Second, 1000)
+	pause, _ := bp.shouldPause(5000, time.Second)
+	assert.False(t, pause)
+	pause, reason := bp.shouldPause(0, 2*time.Second)
+	assert.True(t, pause)
+	assert.Equal(t, BackpressureReasonLatency, reason)
+	bp.pause(reason)
+
+	assert.False(t, bp.shouldResume(0, 10, 2*time.Second), "still slow with pending work")
+	assert.True(t, bp.shouldResume(0, 0, 2*time.Second), "nothing left to flush")
+	assert.True(t, bp.shouldResume(0, 10, 500*time.Millisecond))
+}
+
+func TestBackpressureRate(t *testing.T) {
+	assert.Nil(t, newBackpressure(BackpressureDisabled, 0, 1000).limitRate(nil))
+	limiter := newRateLimiter(40)
+	bp := newBackpressure(BackpressureDisabled, 0, 1000).limitRate(limiter)
+	assert.NotNil(t, bp)
+	pause, _ := bp.shouldPause(39, 0)
+	assert.False(t, pause)
+	pause, reason := bp.shouldPause(40, 0)
+	assert.True(t, pause)
+	assert.Equal(t, BackpressureReasonRate, reason)
+	bp.pause(reason)
+
+	assert.False(t, bp.shouldResume(11, 0, 0))
+	assert.True(t, bp.shouldResume(10, 0, 0))
+	bp.resume()
+
+	// using up the rate limit pauses until a quarter of a second of events is available again
+	assert.True(t, limiter.AllowN(time.Now(), 40))
+	pause, reason = bp.shouldPause(0, 0)
+	assert.True(t, pause)
+	assert.Equal(t, BackpressureReasonRate, reason)
+	bp.pause(reason)
+	assert.False(t, bp.shouldResume(0, 0, 0))
+	assert.Eventually(t, func() bool { return bp.shouldResume(0, 0, 0) }, time.Second, 10*time.Millisecond)
+}
+
+func TestBackpressureBytes(t *testing.T) {
+	assert.Nil(t, newBackpressure(BackpressureDisabled, 0, 1000).limitBytes(nil))
+	limit := &bufferLimit{maxBytes: 100}
+	bp := newBackpressure(BackpressureDisabled, 0, 1000).limitBytes(limit)
+	assert.NotNil(t, bp)
+	limit.add(99)
+	pause, _ := bp.shouldPause(0, 0)
+	assert.False(t, pause)
+	limit.add(1)
+	pause, reason := bp.shouldPause(0, 0)
+	assert.True(t, pause)
+	assert.Equal(t, BackpressureReasonBytes, reason)
+	bp.pause(reason)
+
+	limit.add(-74)
+	assert.False(t, bp.shouldResume(0, 10, 0), "still holding more than a quarter of the limit")
+	limit.add(-1)
+	assert.True(t, bp.shouldResume(0, 10, 0))
+}
@@ -6,29 +6,43 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/errcode"
+	"github.com/shopmonkeyus/eds/internal/feature"
+	"github.com/shopmonkeyus/eds/internal/usage"
 	"github.com/shopmonkeyus/eds/internal/util"
 	"github.com/shopmonkeyus/go-common/logger"
 	cnats "github.com/shopmonkeyus/go-common/nats"
 	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/time/rate"
 )
 
 const (
-	defaultEmptyBufferPauseTime = time.Millisecond * 10 // time to wait when the buffer is empty to prevent CPU spinning
+	DefaultEmptyBufferPauseTime = time.Millisecond * 10 // time without new messages before the stream is treated as idle
+	DefaultAckWait              = time.Minute * 5       // how long the server waits for a message to be acked before redelivering it
+	DefaultMaxDeliver           = 20                    // maximum number of times a message will be delivered by the server
 	DefaultMinPendingLatency    = time.Second * 2       // minimum accumulation period before flushing
 	DefaultMaxPendingLatency    = time.Second * 30      // maximum accumulation period before flushing
+	inProgressInterval          = time.Minute           // how often pending messages held open past the flush latency have their ack wait extended
 	traceLogNatsProcessDetail   = true                  // turn on trace logging for nats processing
+	heartbeatFlushTimeout       = time.Second * 10      // time to wait for the server to receive a heartbeat
+	maxHeartbeatFailures        = 3                     // consecutive heartbeat failures before using the fallback
 )
 
 var ErrConsumerAlreadyRunning = errors.New("consumer already running")
 
+// ErrConsumerMissedHistory is returned when an existing consumer would skip data which was changed after the last import.
+var ErrConsumerMissedHistory = errors.New("consumer start position is after the import timestamp")
+
 // Driver is a local interface which slims down the driver to only the methods we need to make it easier to test.
 type Driver interface {
 	Flush(logger logger.Logger) error
@@ -54,6 +68,21 @@ type ConsumerConfig struct {
 	// CompanyIDs is the list of company IDs to listen for. If empty, all companies will be listened to.
 	CompanyIDs []string
 
+	// LocationIDs is the list of location IDs to listen for. If empty, all locations will be listened to. The events
+	// without a location, such as for the company's customers, are always received.
+	LocationIDs []string
+
+	// Tables is the list of tables to listen for. If empty, all tables will be listened to.
+	Tables []string
+
+	// OnlyTables restricts the tables set by Tables to these tables. If empty, the tables aren't restricted further.
+	OnlyTables []string
+
+	// ExceptTables are the tables which are never received. When only tables are excluded the filter is compiled from
+	// the tables in the Registry, which is updated when the schema is refreshed, and tables which aren't known are
+	// skipped after they are delivered.
+	ExceptTables []string
+
 	// Suffix for the consumer name
 	Suffix string
 
@@ -72,25 +101,179 @@ type ConsumerConfig struct {
 	// DeliverAll will configure the consumer to read from the beginning of the stream, this only works if the consumer is new
 	DeliverAll bool
 
+	// FixStartPosition will recreate an existing consumer which started after the import timestamp so that it delivers from the import timestamp.
+	FixStartPosition bool
+
 	// SchemaValidator is the schema validator to use for the importer or nil if not needed.
 	SchemaValidator internal.SchemaValidator
 
+	// CompanyQuotas is a map of company ID to the maximum number of events per second. The key * applies to all other companies.
+	CompanyQuotas map[string]float64
+
+	// MaxEventsPerSecond is the maximum number of events per second sent to the driver, the messages over the rate are left
+	// in the stream instead of being pulled. Defaults to 0 which is unlimited.
+	MaxEventsPerSecond float64
+
+	// PausedTables are the tables which start paused, such as the tables which were paused before a restart.
+	PausedTables []string
+
+	// PausedAt is when the consumer was paused before a restart or nil. When set the consumer starts paused and doesn't
+	// pull messages until Unpause is called.
+	PausedAt *time.Time
+
+	// Usage records the events and bytes delivered for usage reporting or nil if not needed.
+	Usage *usage.Recorder
+
+	// QuarantineDir is the directory to save events which fail a validation rule with the quarantine action.
+	QuarantineDir string
+
+	// MaxEventSize is the maximum size in bytes of an event payload. Larger events are quarantined without being decoded. Defaults to 0 which is unlimited.
+	MaxEventSize int
+
 	// HeartbeatInterval is the interval to send heartbeats. Defaults to 1 minute.
 	HeartbeatInterval time.Duration
 
+	// LagInterval is the interval to refresh the lag and stream position metrics of the consumer. Defaults to 15 seconds.
+	LagInterval time.Duration
+
 	// MinPendingLatency is the minimum accumulation period before flushing.
 	MinPendingLatency time.Duration
 
 	// MaxPendingLatency is the maximum accumulation period before flushing.
 	MaxPendingLatency time.Duration
 
-	// EmptyBufferPauseTime is the time to wait when the buffer is empty to prevent CPU spinning.
+	// EmptyBufferPauseTime is how long the consumer waits without new messages before the transaction of a flush group
+	// is treated as complete, and how often backpressure is checked while pulling is paused. Defaults to
+	// DefaultEmptyBufferPauseTime.
 	EmptyBufferPauseTime time.Duration
 
+	// AckWait is how long the server waits for a message to be acked before redelivering it. It must be longer than the
+	// interval the ack wait of pending messages is extended at. Defaults to DefaultAckWait.
+	AckWait time.Duration
+
+	// MaxDeliver is the maximum number of times the server delivers a message before it's dropped. Defaults to
+	// DefaultMaxDeliver.
+	MaxDeliver int
+
+	// RedeliveryBackoff are the delays before a message which failed is redelivered by the number of times it was
+	// delivered, the last delay is used for the later deliveries. It replaces the ack wait and each delay must be longer
+	// than the interval the ack wait of pending messages is extended at. Defaults to redelivering immediately.
+	RedeliveryBackoff []time.Duration
+
+	// AckAll uses the ack all policy for the consumer and acks the highest message below the first one which isn't done
+	// after a flush instead of acking each message. An existing consumer is recreated from its ack floor when the policy
+	// changes. It can't be used with more than 1 pipeline. Defaults to false.
+	AckAll bool
+
+	// FlushPolicy decides when pending messages are flushed. Defaults to the balanced policy.
+	FlushPolicy FlushPolicy
+
 	// Registry returns the schema registry to use.
 	Registry internal.SchemaRegistry
 
-	sessionIDCallback func(id string) // only used in testing
+	// OrderingMode controls how events delivered out of order for the same key are handled. Defaults to no checks.
+	OrderingMode string
+
+	// OrderingMaxKeys is the number of the most recently changed records the last version is remembered for by the
+	// OrderingMode. An older version of a record which was forgotten isn't detected. Defaults to DefaultOrderingMaxKeys.
+	OrderingMaxKeys int
+
+	// OnNewTable is called after a table the destination didn't have yet was created from the registry schema or nil if not needed.
+	OnNewTable func(table string)
+
+	// PreMigrate will apply the migrations for all the tables in the registry before consuming when the driver supports migrations.
+	PreMigrate bool
+
+	// RepairSchemaDrift adds back the columns which are missing from a destination table, such as a column which was
+	// dropped by hand, when the drift is detected after the pre-migration or a failed flush. Otherwise it's only reported.
+	RepairSchemaDrift bool
+
+	// DestinationCheck is called before the consumer starts pulling messages and is retried with an exponential backoff,
+	// along with the pre-migration, until it passes. Defaults to nil which starts pulling without checking.
+	DestinationCheck func(ctx context.Context) error
+
+	// DestinationMaxWait is how long to retry the DestinationCheck before giving up. Defaults to 0 which retries until
+	// the consumer is stopped.
+	DestinationMaxWait time.Duration
+
+	// RetryDir is the directory to save the events which failed with a retryable error so they are retried with a backoff
+	// after the consumer restarts. Defaults to empty which relies on the redelivery of the messages instead.
+	RetryDir string
+
+	// JournalDir is the directory of the journal where the events handed to the driver are recorded until they're acked,
+	// so the events which were being processed when the server crashed can be checked against the destination when it
+	// starts again. Defaults to empty which disables the journal.
+	JournalDir string
+
+	// RetryMaxAttempts is the number of times the events in the retry queue are retried before they're given up on and
+	// kept in the retry directory for inspection. Defaults to DefaultRetryMaxAttempts.
+	RetryMaxAttempts int
+
+	// FlushGroups are groups of tables, parents first, whose events from the same transaction are delivered to the driver
+	// together in the group's table order and committed in the same flush.
+	FlushGroups [][]string
+
+	// FieldFilters are the columns of a table, or * for every other table, which an update must change to be delivered
+	// to the driver. Other updates are acked and skipped. Inserts and deletes are always delivered.
+	FieldFilters map[string][]string
+
+	// BackpressureThreshold is the number of messages waiting to be processed at which pulling is paused until they drain.
+	// Defaults to half of MaxAckPending, use BackpressureDisabled to only pause on the flush latency.
+	BackpressureThreshold int
+
+	// BackpressureMaxFlushLatency pauses pulling when a flush takes longer than this until the destination catches up.
+	// Defaults to 0 which doesn't pause on the flush latency.
+	BackpressureMaxFlushLatency time.Duration
+
+	// MaxBufferedBytes is the size in bytes of the messages held in memory from when they're pulled until they're acked
+	// at which pulling is paused until the flushes release them. Defaults to 0 which only limits the number of messages.
+	MaxBufferedBytes int64
+
+	// SpillDir is the directory where the messages which arrive once MaxBufferedBytes is reached are written instead of
+	// being held in memory. Defaults to empty which keeps them in memory.
+	SpillDir string
+
+	// ParkDir is the directory where the events of a company which is over its quota or paused are parked in order and
+	// their messages acked, until the company can be processed again. Defaults to empty which nacks the messages with a
+	// delay so they're redelivered later instead.
+	ParkDir string
+
+	// HeartbeatFallback is called with the JSON encoded heartbeat and the error when publishing heartbeats has failed
+	// several times in a row and with nil once publishing succeeds again, or nil if not needed.
+	HeartbeatFallback func(hb []byte, err error)
+
+	// Pull controls how messages are pulled from the server. The zero value uses the defaults.
+	Pull PullOptions
+
+	// Pipelines is the number of pipelines the events are sharded into, each with its own driver instance, pending buffer
+	// and flush cycle, so a slow table doesn't hold up the others. Defaults to 0 which processes every event in one pipeline.
+	Pipelines int
+
+	// PipelineShard is how the events are sharded into the pipelines, by table or by primary key. Events for the same
+	// record are always processed in order by the same pipeline. Defaults to PipelineShardTable.
+	PipelineShard string
+
+	// NewPipelineDriver creates the driver for each pipeline and each company consumer after the first. It's required when
+	// there is more than one pipeline or when the companies are isolated.
+	NewPipelineDriver func() (Driver, error)
+
+	// Version is the version of eds which is added to the lineage of the events when the lineage feature is enabled.
+	Version string
+
+	// ReconnectTimeout is how long to try re-establishing the consumer after the connection to the server was lost before
+	// giving up with an error. Pulling resumes from the last acked message without restarting the process. Defaults to 0
+	// which stops the consumer and signals Disconnected as soon as the connection is lost.
+	ReconnectTimeout time.Duration
+
+	// DriverURL is the url of the driver, the heartbeats report the name of the driver and the url with the credentials masked.
+	DriverURL string
+
+	// Sessions persists the session so the same session is used across restarts or nil to use the session of the credentials.
+	Sessions *SessionStore
+
+	sessionIDCallback  func(id string) // only used in testing
+	startSequence      uint64          // the stream sequence a new jetstream consumer starts at, such as when it takes over for another consumer
+	heartbeatsDisabled bool            // the heartbeats are sent by another consumer of the same session
 }
 
 type Consumer struct {
@@ -100,10 +283,16 @@ type Consumer struct {
 	driver               Driver
 	conn                 *nats.Conn
 	jsconn               jetstream.Consumer
+	js                   jetstream.JetStream
+	companyIDs           []string
+	filter               tableFilter
+	locationIDs          []string
+	tablesLock           sync.RWMutex
 	logger               logger.Logger
 	subscriber           jetstream.ConsumeContext
 	buffer               chan jetstream.Msg
 	pending              []jetstream.Msg
+	pendingIDs           map[string]bool // the ids of the pending events when the dedupe feature is enabled
 	started              *time.Time
 	pendingStarted       *time.Time
 	pauseStarted         *time.Time
@@ -113,17 +302,77 @@ type Consumer struct {
 	stopping             bool
 	subError             chan error
 	sessionID            string
+	credentialSessionID  string // the session of the credentials which the heartbeats are published for
+	incarnation          int
 	tableTimestamps      map[string]*time.Time
 	validator            internal.SchemaValidator
+	quarantineDir        string
+	maxEventSize         int
+	tenants              *tenantController
+	pausedTables         *pausedTables
+	limiter              *rate.Limiter // limits the events sent to the driver or nil if unlimited
+	rateLimitStarted     time.Time     // when the bufferer started waiting for the rate limit
+	usage                *usage.Recorder
 	heartbeatInterval    time.Duration
+	heartbeatFailures    int
+	heartbeatFallback    func(hb []byte, err error)
+	heartbeatsDisabled   bool
+	lagInterval          time.Duration
+	lastEventTimestamp   atomic.Int64 // the timestamp in milliseconds of the last event received, read when reporting the lag
+	lag                  atomic.Int64 // nanoseconds behind the head of the stream when the lag was last reported
+	driverName           string
+	destination          string
+	heartbeatEvents      float64   // the total events when the last heartbeat was sent
+	heartbeatSent        time.Time // when the last heartbeat was sent
 	minPendingLatency    time.Duration
 	maxPendingLatency    time.Duration
 	emptyBufferPauseTime time.Duration
+	name                 string // the name of the durable consumer
+	version              string
+	batchID              string // the id of the pending events which is added to their lineage
+	flushPolicy          FlushPolicy
+	lastProgress         time.Time
+	ordering             *orderingTracker
+	resequence           *resequencer
 	offset               int64
 	supportsMigration    bool
 	registry             internal.SchemaRegistry
+	onNewTable           func(table string)
+	preMigrate           bool
+	repairSchemaDrift    bool
+	destinationCheck     func(ctx context.Context) error
+	destinationMaxWait   time.Duration
+	refreshes            chan schemaRefresh
+	drains               chan chan error // the drain requests which are answered once the pending events are flushed
+	backpressure         *backpressure
+	pull                 PullOptions
+	groups               *flushGrouper
+	fields               fieldFilter
+	batcher              internal.DriverBatchProcessor
+	batch                []internal.DBChangeEvent
+	retries              *retryQueue
+	lastFlushDuration    atomic.Int64 // nanoseconds since it's read from the consumer when the pipelines flush
+	subscriberLock       sync.Mutex
 	sequence             uint64
 	disconnected         chan bool
+	reconnects           chan struct{} // signals the bufferer to re-establish the consumer after the connection was lost
+	reconnectTimeout     time.Duration
+	maxDeliver           int
+	acks                 *ackFloor // the messages to ack with the ack all policy or nil to ack each message
+	hooks                []internal.ProcessorHook
+	hookEvents           []internal.DBChangeEvent // the events sent to the driver since the last flush for the post-flush hooks
+	journal              *journal
+	limit                *bufferLimit // the size of the messages held in memory, shared with the pipelines, or nil
+	redeliveryBackoff    []time.Duration
+	connectedURL         string
+	lastError            *heartbeatError
+	errorLock            sync.Mutex
+	parent               *Consumer // the consumer which dispatches the events to this pipeline
+	index                int       // the index of the pipeline
+	parked               *companyPark
+	parkReleased         time.Time   // when the parked events were last checked
+	pipelines            []*Consumer // the pipelines the events are sharded into or nil to process them on the bufferer
+	router               *pipelineRouter
 }
 
 // Disconnected returns a channel that will be closed when the consumer is disconnected from the NATS server.
@@ -131,6 +380,102 @@ func (c *Consumer) Disconnected() <-chan bool {
 	return c.disconnected
 }
 
+// noLocationToken is the location token in the subject of an event without a location.
+const noLocationToken = "NONE"
+
+// filterSubjects returns the subjects for the companies, tables and locations, all tables are included when tables is
+// empty and all locations when locationIDs is empty. The events without a location are always included.
+func filterSubjects(companyIDs []string, tables []string, locationIDs []string) []string {
+	if len(tables) == 0 {
+		tables = []string{"*"}
+	}
+	locations := []string{"*"}
+	if len(locationIDs) > 0 {
+		locations = append([]string{noLocationToken}, locationIDs...)
+	}
+	var subjects []string
+	for _, companyID := range companyIDs {
+		for _, table := range tables {
+			for _, location := range locations {
+				subjects = append(subjects, "dbchange."+table+".*."+companyID+"."+location+".PUBLIC.>")
+			}
+		}
+	}
+	return subjects
+}
+
+// isLocationAllowed returns true if the event doesn't have a location or its location is allowed.
+func (c *Consumer) isLocationAllowed(evt *internal.DBChangeEvent) bool {
+	return len(c.locationIDs) == 0 || evt.LocationID == nil || *evt.LocationID == "" || util.SliceContains(c.locationIDs, *evt.LocationID)
+}
+
+func (c *Consumer) isTableAllowed(table string) bool {
+	if c.parent != nil {
+		return c.parent.isTableAllowed(table)
+	}
+	c.tablesLock.RLock()
+	defer c.tablesLock.RUnlock()
+	return c.filter.allowed(table)
+}
+
+// knownTables returns the tables in the schema registry which are used to compile a filter which only excludes tables.
+func (c *Consumer) knownTables(filter tableFilter) []string {
+	if !filter.exceptOnly() || c.registry == nil {
+		return nil
+	}
+	latest, err := c.registry.GetLatestSchema()
+	if err != nil {
+		c.logger.Warn("error getting the tables from the schema registry, excluded tables are skipped instead of filtered: %s", err)
+		return nil
+	}
+	tables := make([]string, 0, len(latest))
+	for table := range latest {
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// updateFilter updates the filter subjects of the jetstream consumer for the table filter.
+func (c *Consumer) updateFilter(filter tableFilter) error {
+	include, err := filter.include(c.knownTables(filter))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, time.Minute)
+	defer cancel()
+	info, err := c.jsconn.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting consumer info: %w", err)
+	}
+	config := info.Config
+	config.FilterSubject = ""
+	config.FilterSubjects = filterSubjects(c.companyIDs, include, c.locationIDs)
+	if _, err := c.js.UpdateConsumer(ctx, "dbchange", config); err != nil {
+		return fmt.Errorf("error updating jetstream consumer: %w", err)
+	}
+	c.tablesLock.Lock()
+	c.filter = filter
+	c.tablesLock.Unlock()
+	return nil
+}
+
+// SetTables changes the tables the consumer receives without restarting it. If empty, all tables will be received.
+func (c *Consumer) SetTables(tables []string) error {
+	c.tablesLock.RLock()
+	filter := c.filter
+	c.tablesLock.RUnlock()
+	filter.tables = tables
+	if err := c.updateFilter(filter); err != nil {
+		return err
+	}
+	if len(tables) > 0 {
+		c.logger.Info("restricting to tables: %s", strings.Join(tables, ", "))
+	} else {
+		c.logger.Info("receiving all tables")
+	}
+	return nil
+}
+
 func (c *Consumer) isStopping() bool {
 	c.lock.Lock()
 	val := c.stopping
@@ -148,9 +493,11 @@ func (c *Consumer) Stop() error {
 		c.stopping = true
 		c.lock.Unlock()
 		c.flush(c.logger)
+		c.flushPipelines()
 		c.cancel()
 		c.logger.Debug("waiting on bufferer")
 		c.waitGroup.Wait()
+		c.stopPipelines()
 		c.logger.Debug("stopped bufferer")
 
 		// once we get here, the bufferer should be done and its safe to start shutting down
@@ -170,6 +517,10 @@ func (c *Consumer) Stop() error {
 		close(c.buffer)
 		c.subscriber = nil
 		c.conn = nil
+		if c.journal != nil {
+			c.journal.close()
+		}
+		c.limit.close()
 	})
 	c.logger.Debug("stopped consumer")
 	return nil
@@ -178,16 +529,59 @@ func (c *Consumer) Stop() error {
 func (c *Consumer) nackEverything() {
 	c.logger.Debug("nack everything")
 	for _, m := range c.pending {
-		if err := m.Nak(); err != nil {
+		if err := c.nak(m); err != nil {
 			c.logger.Error("error nacking msg %s: %s", m.Headers().Get(nats.MsgIdHdr), err)
 		}
+		c.nacked(m)
 	}
+	c.limit.release(c.pending...)
 	c.pending = nil
+	c.pendingIDs = nil
 	c.pendingStarted = nil
+	c.batchID = ""
+	c.batch = nil
+	c.hookEvents = nil
+	if c.groups != nil {
+		c.groups.Reset()
+	}
+	if c.resequence != nil {
+		c.resequence.Reset()
+	}
+	if c.usage != nil {
+		c.usage.Discard()
+	}
+	if c.journal != nil {
+		if err := c.journal.reset(); err != nil {
+			c.logger.Error("error resetting journal: %s", err)
+		}
+	}
+}
+
+// recordError keeps the code of the error to send with the heartbeats.
+func (c *Consumer) recordError(err error) {
+	if c.parent != nil {
+		c.parent.recordError(err)
+		return
+	}
+	c.errorLock.Lock()
+	c.lastError = &heartbeatError{Code: errcode.Of(err), Time: time.Now()}
+	c.errorLock.Unlock()
+}
+
+// destinationError adds the code to an error from the driver.
+func destinationError(err error) error {
+	if internal.IsRetryableError(err) {
+		return errcode.New(errcode.DestinationUnavailable, err)
+	}
+	return errcode.New(errcode.DestinationWrite, err)
 }
 
 func (c *Consumer) handleError(err error) {
-	c.logger.Error("error: %s", err)
+	c.logger.With(errcode.Fields(err)).Error("error: %s (%s)", err, errcode.Of(err))
+	c.recordError(err)
+	if c.retries != nil && len(c.pending) > 0 && internal.IsRetryableError(err) {
+		c.queueForRetry(err)
+	}
 	c.nackEverything()
 	c.subError <- err
 }
@@ -200,71 +594,269 @@ func (c *Consumer) flush(logger logger.Logger) bool {
 	started := time.Now()
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if err := c.driver.Flush(logger); err != nil {
+	if c.resequence != nil && c.resequence.Len() > 0 {
+		if err := c.releaseResequenced(logger); err != nil {
+			if errors.Is(err, internal.ErrDriverStopped) {
+				c.nackEverything()
+				return true
+			}
+			c.handleError(err)
+			return true
+		}
+	}
+	var err error
+	if c.journal != nil {
+		// the events must be in the journal before the destination can have them
+		err = c.journal.sync()
+	}
+	if err == nil {
+		err = c.processBatch(logger)
+	}
+	if err == nil {
+		err = c.driver.Flush(logger)
+	}
+	if err != nil {
 		if errors.Is(err, internal.ErrDriverStopped) {
 			c.nackEverything()
 			return true
 		}
+		if c.supportsMigration && !internal.IsRetryableError(err) {
+			// a column removed from the destination by hand fails every flush so check if that's the cause
+			c.checkSchemaDrift(logger, c.pendingTables())
+		}
+		c.handleError(destinationError(err))
+		return true
+	}
+	if err := c.postFlush(logger); err != nil {
 		c.handleError(err)
 		return true
 	}
 	var count float64
-	for _, m := range c.pending {
-		if err := m.Ack(); err != nil {
-			internal.PendingEvents.Dec()
-			logger.Error("error acking msg %s: %s", m.Headers().Get(nats.MsgIdHdr), err)
+	if c.acks != nil {
+		count = float64(len(c.pending))
+		internal.PendingEvents.Sub(count)
+		if err := c.ackAll(c.pending); err != nil {
+			logger.Error("error acking %d msgs: %s", len(c.pending), err)
 			c.nackEverything()
 			return true
 		}
-		internal.PendingEvents.Dec()
-		count++
+	} else {
+		for _, m := range c.pending {
+			if err := m.Ack(); err != nil {
+				internal.PendingEvents.Dec()
+				logger.Error("error acking msg %s: %s", m.Headers().Get(nats.MsgIdHdr), err)
+				c.nackEverything()
+				return true
+			}
+			internal.PendingEvents.Dec()
+			count++
+			if c.journal != nil {
+				if md, err := m.Metadata(); err == nil {
+					if err := c.journal.ack(md.Sequence.Stream); err != nil {
+						logger.Error("error writing journal: %s", err)
+					}
+				}
+			}
+		}
 	}
 	if c.pendingStarted != nil {
 		processingDuration := time.Since(*c.pendingStarted)
 		internal.ProcessingDuration.Observe(processingDuration.Seconds())
 	}
-	internal.FlushDuration.Observe(time.Since(started).Seconds())
+	if c.usage != nil {
+		if err := c.usage.Commit(); err != nil {
+			logger.Error("error saving usage: %s", err)
+		}
+	}
+	if c.journal != nil {
+		if err := c.journal.reset(); err != nil {
+			logger.Error("error resetting journal: %s", err)
+		}
+	}
+	duration := time.Since(started)
+	c.lastFlushDuration.Store(int64(duration))
+	internal.FlushDuration.Observe(duration.Seconds())
 	internal.FlushCount.Observe(count)
+	c.limit.release(c.pending...)
 	c.pending = nil
+	c.pendingIDs = nil
 	c.pendingStarted = nil
+	c.batchID = ""
 	return c.stopping
 }
 
-func (c *Consumer) shouldSkip(logger logger.Logger, evt *internal.DBChangeEvent) bool {
+// releaseResequenced sends the staged events of the batch to the driver in the order of their versions for each record.
+// An event which is older than a version of the record which was already flushed can't be resequenced so it's dropped.
+// The driver is flushed along the way if it asks to be, and the events are acked with the rest of the batch.
+func (c *Consumer) releaseResequenced(logger logger.Logger) error {
+	for _, event := range c.resequence.Release() {
+		if c.ordering.ShouldDrop(&event.evt) {
+			event.log.Warn("dropping out of order event: %s (version: %s)", event.evt.String(), event.evt.MVCCTimestamp)
+			internal.SkippedEvents.WithLabelValues(event.evt.Table, internal.SkipReasonOutOfOrder).Inc()
+			continue
+		}
+		flush, err := c.processEvent(event)
+		if err != nil {
+			return err
+		}
+		if !flush {
+			continue
+		}
+		if c.journal != nil {
+			if err := c.journal.sync(); err != nil {
+				return err
+			}
+		}
+		if err := c.processBatch(logger); err != nil {
+			return destinationError(err)
+		}
+		if err := c.driver.Flush(logger); err != nil {
+			return destinationError(err)
+		}
+	}
+	return nil
+}
+
+// processBatch sends the events of the batch to a driver which processes them all at once.
+func (c *Consumer) processBatch(logger logger.Logger) error {
+	if c.batcher == nil || len(c.batch) == 0 {
+		return nil
+	}
+	batch := c.batch
+	c.batch = nil
+	return c.batcher.ProcessBatch(logger, batch)
+}
+
+// shouldSkip returns true and the reason if the event shouldn't be sent to the driver.
+func (c *Consumer) shouldSkip(logger logger.Logger, evt *internal.DBChangeEvent) (bool, string) {
+	if !c.isTableAllowed(evt.Table) {
+		// messages delivered before the tables changed can still be for a table which is no longer allowed
+		logger.Trace("skipping %s, table is not allowed for event: %s", evt.Table, util.JSONStringify(evt))
+		return true, internal.SkipReasonTableNotAllowed
+	}
+	if !c.isLocationAllowed(evt) {
+		logger.Trace("skipping %s, location %s is not allowed", evt.Table, *evt.LocationID)
+		return true, internal.SkipReasonLocationNotAllowed
+	}
+	if !c.fields.Allow(evt) {
+		logger.Trace("skipping %s, none of the subscribed fields changed: %v", evt.Table, evt.Diff)
+		return true, internal.SkipReasonUnchangedFields
+	}
 	if c.tableTimestamps != nil {
 		eventTimestamp := time.UnixMilli(evt.Timestamp)
 		// check if we have a timestamp for this table and only process if its newer
 		if tableTimestamp := c.tableTimestamps[evt.Table]; tableTimestamp != nil {
 			if eventTimestamp.Before(*tableTimestamp) {
-				return true
+				return true, internal.SkipReasonExportTimestamp
 			}
 		}
 	}
 	if c.validator != nil {
 		found, valid, path, err := c.validator.Validate(*evt)
+		var rerr *internal.ValidationRuleError
+		if errors.As(err, &rerr) {
+			internal.ValidationFailures.WithLabelValues(rerr.Table, rerr.Rule, string(rerr.Action)).Inc()
+			switch rerr.Action {
+			case internal.ValidationActionAlert:
+				logger.Warn("%s for event: %s", rerr, evt)
+				err = nil
+			case internal.ValidationActionQuarantine:
+				if err := c.quarantine(evt, rerr); err != nil {
+					logger.Error("error quarantining event: %s for event: %s", err, util.JSONStringify(evt))
+				} else {
+					logger.Debug("quarantined %s, %s", evt.Table, rerr)
+				}
+				return true, internal.SkipReasonQuarantined
+			}
+		}
 		if err != nil {
+			if rerr != nil {
+				logger.Debug("skipping %s, %s", evt.Table, rerr)
+				return true, internal.SkipReasonValidationRule
+			}
 			if errors.Is(err, util.ErrSchemaValidation) {
 				// note we join these errors since they are separated by definition in errors.Join and we want to log them together
 				logger.Debug("skipping %s, schema did not validate (%s) for event: %s", evt.Table, strings.TrimSpace(strings.Join(strings.Split(err.Error(), "\n"), " ")), util.JSONStringify(evt))
-				return true
+				return true, internal.SkipReasonSchemaValidation
 			}
 			logger.Error("error validating schema: %s for event: %s", err, util.JSONStringify(evt))
-			return true
+			return true, internal.SkipReasonValidationError
 		}
 		if !found {
 			logger.Trace("skipping %s, no schema found for event: %s", evt.Table, util.JSONStringify(evt))
-			return true
+			return true, internal.SkipReasonSchemaNotFound
 		}
 		if !valid {
 			logger.Trace("skipping %s, schema did not validate for event: %s", evt.Table, util.JSONStringify(evt))
-			return true
+			return true, internal.SkipReasonSchemaValidation
 		}
 		if path != "" {
 			evt.SchemaValidatedPath = &path
 			logger.Trace("schema validated %s", path)
 		}
 	}
-	return false
+	return false, ""
+}
+
+// skip will ack the message and remove it from pending without sending it to the driver
+func (c *Consumer) skip(logger logger.Logger, msg jetstream.Msg) {
+	c.removePending(msg)
+	if c.acks != nil {
+		// the message is acked with the next flush, or now if nothing else is waiting for one
+		if len(c.pending) > 0 {
+			if md, err := msg.Metadata(); err == nil {
+				c.acks.complete(md.Sequence.Stream, msg)
+			}
+		} else if err := c.ackAll([]jetstream.Msg{msg}); err != nil {
+			logger.Error("error acking skipped msg: %s", err)
+		}
+		return
+	}
+	if err := msg.Ack(); err != nil {
+		// not much we can do here, just log it
+		logger.Error("error acking skipped msg: %s", err)
+	}
+}
+
+// removePending removes the message from pending once it has been acked or nacked outside of a flush
+func (c *Consumer) removePending(msg jetstream.Msg) {
+	for i, m := range c.pending {
+		if m == msg {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			c.limit.release(msg)
+			break
+		}
+	}
+	internal.PendingEvents.Dec()
+}
+
+// throttle will nak the message with a delay so it's redelivered later and remove it from pending
+func (c *Consumer) throttle(logger logger.Logger, msg jetstream.Msg, companyID string, reason string) {
+	logger.Trace("throttling company %s (%s)", companyID, reason)
+	if err := msg.NakWithDelay(throttleDelay(reason)); err != nil {
+		logger.Error("error nacking throttled msg: %s", err)
+	}
+	c.nacked(msg)
+	c.removePending(msg)
+	internal.CompanyThrottled.WithLabelValues(companyID, reason).Inc()
+}
+
+// PauseCompany will stop processing events for a specific company. Events for the company will be parked, or
+// redelivered later without a park directory.
+func (c *Consumer) PauseCompany(companyID string) {
+	c.logger.Info("pausing company: %s", companyID)
+	c.tenants.Pause(companyID)
+}
+
+// UnpauseCompany will resume processing events for a specific company.
+func (c *Consumer) UnpauseCompany(companyID string) {
+	c.logger.Info("unpausing company: %s", companyID)
+	c.tenants.Unpause(companyID)
+}
+
+// PausedCompanies returns the list of companies which are paused.
+func (c *Consumer) PausedCompanies() []string {
+	return c.tenants.Paused()
 }
 
 func (c *Consumer) Error() <-chan error {
@@ -274,29 +866,45 @@ func (c *Consumer) Error() <-chan error {
 func (c *Consumer) handlePossibleMigration(ctx context.Context, logger logger.Logger, event *internal.DBChangeEvent) (bool, error) {
 	found, version, err := c.registry.GetTableVersion(event.Table)
 	if err != nil {
-		return false, fmt.Errorf("error getting current table version for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+		return false, errcode.Errorf(errcode.SchemaRegistry, "error getting current table version for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
 	}
 	if !found || version != event.ModelVersion {
 		logger.Trace("%s found: %v, version: %v, model version: %v", event.Table, found, version, event.ModelVersion)
 		newschema, err := c.registry.GetSchema(event.Table, event.ModelVersion)
 		if err != nil {
-			return false, fmt.Errorf("error getting new schema for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+			return false, errcode.Errorf(errcode.SchemaRegistry, "error getting new schema for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
 		}
 		migration := c.driver.(internal.DriverMigration)
 		if !found {
 			logger.Debug("need to migrate new table: %s, model version: %s", event.Table, event.ModelVersion)
 			if err := migration.MigrateNewTable(ctx, logger, newschema); err != nil {
-				return false, fmt.Errorf("error migrating new table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+				return false, errcode.Errorf(errcode.MigrationFailed, "error migrating new table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
 			}
 			logger.Info("migrated new table: %s, model version: %s", event.Table, event.ModelVersion)
 			if err := c.registry.SetTableVersion(event.Table, event.ModelVersion); err != nil {
-				return false, fmt.Errorf("error setting table version for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+				return false, errcode.Errorf(errcode.SchemaRegistry, "error setting table version for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+			}
+			if c.onNewTable != nil {
+				c.onNewTable(event.Table)
 			}
 			return true, nil
 		}
 		oldschema, err := c.registry.GetSchema(event.Table, version)
 		if err != nil {
-			return false, fmt.Errorf("error getting current schema for table: %s, model version: %s: %w", event.Table, version, err)
+			return false, errcode.Errorf(errcode.SchemaRegistry, "error getting current schema for table: %s, model version: %s: %w", event.Table, version, err)
+		}
+		latest, err := c.registry.GetLatestSchema()
+		if err != nil {
+			return false, errcode.Errorf(errcode.SchemaRegistry, "error getting latest schema: %w", err)
+		}
+		// events from a backlog can have an older model version than the table so bring them up to the table's version
+		if isOlderVersion(latest, event.Table, event.ModelVersion, newschema, version, oldschema) {
+			logger.Debug("translating event for table: %s from model version: %s to %s", event.Table, event.ModelVersion, version)
+			if err := translateEvent(event, newschema, oldschema, version); err != nil {
+				return false, err
+			}
+			internal.TranslatedEvents.WithLabelValues(event.Table).Inc()
+			return false, nil
 		}
 		// figure out which columns are new
 		var columns []string
@@ -309,7 +917,7 @@ func (c *Consumer) handlePossibleMigration(ctx context.Context, logger logger.Lo
 		if len(columns) > 0 {
 			logger.Debug("need to migrate table: %s, columns: %s, model version: %s", event.Table, strings.Join(columns, ","), event.ModelVersion)
 			if err := migration.MigrateNewColumns(ctx, logger, newschema, columns); err != nil {
-				return false, fmt.Errorf("error migrating new columns for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+				return false, errcode.Errorf(errcode.MigrationFailed, "error migrating new columns for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
 			}
 			for _, col := range columns {
 				if !util.SliceContains(event.Diff, col) {
@@ -323,34 +931,242 @@ func (c *Consumer) handlePossibleMigration(ctx context.Context, logger logger.Lo
 		}
 		// we want to bring the table up to the new version in all cases
 		if err := c.registry.SetTableVersion(event.Table, event.ModelVersion); err != nil {
-			return false, fmt.Errorf("error setting table version for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+			return false, errcode.Errorf(errcode.SchemaRegistry, "error setting table version for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
 		}
 	}
 	return false, nil
 }
 
+// migrateTables applies the migrations for the latest schema of the tables and returns the tables which were migrated.
+func (c *Consumer) migrateTables(latest internal.SchemaMap, tables []string) ([]string, error) {
+	var migratedTables []string
+	for _, table := range tables {
+		schema := latest[table]
+		if schema == nil {
+			continue
+		}
+		event := internal.DBChangeEvent{Table: table, ModelVersion: schema.ModelVersion}
+		migrated, err := c.handlePossibleMigration(c.ctx, c.logger, &event)
+		if err != nil {
+			return migratedTables, err
+		}
+		if migrated {
+			// the version isn't set after new columns are migrated so set it here, otherwise the first event would migrate again
+			if err := c.registry.SetTableVersion(table, schema.ModelVersion); err != nil {
+				return migratedTables, errcode.Errorf(errcode.SchemaRegistry, "error setting table version for table: %s, model version: %s: %w", table, schema.ModelVersion, err)
+			}
+			migratedTables = append(migratedTables, table)
+		}
+	}
+	return migratedTables, nil
+}
+
+// premigrate applies the migrations for the latest schema of each table before consuming so the first event for a table
+// which changed while the consumer was stopped doesn't have to wait on the DDL.
+func (c *Consumer) premigrate() error {
+	latest, err := c.registry.GetLatestSchema()
+	if err != nil {
+		return fmt.Errorf("error getting latest schema: %w", err)
+	}
+	tables := make([]string, 0, len(latest))
+	for table := range latest {
+		if c.isTableAllowed(table) {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	started := time.Now()
+	migrated, err := c.migrateTables(latest, tables)
+	if err != nil {
+		return err
+	}
+	c.logger.Info("pre-migrated %d of %d tables in %v", len(migrated), len(tables), time.Since(started))
+	c.checkSchemaDrift(c.logger, tables)
+	return nil
+}
+
+type schemaRefreshResult struct {
+	migrated []string
+	err      error
+}
+
+type schemaRefresh struct {
+	tables []string
+	result chan schemaRefreshResult
+}
+
+// RefreshSchema fetches the latest schema from the registry again and applies the migrations for the tables without
+// restarting the consumer. If tables is empty, all the tables the consumer receives are migrated. It returns the tables
+// which were migrated.
+func (c *Consumer) RefreshSchema(tables []string) ([]string, error) {
+	if !c.supportsMigration || c.registry == nil {
+		return nil, fmt.Errorf("driver doesn't support migrations")
+	}
+	var latest internal.SchemaMap
+	var err error
+	if refresher, ok := c.registry.(internal.SchemaRegistryRefresher); ok {
+		latest, err = refresher.RefreshLatestSchema()
+	} else {
+		latest, err = c.registry.GetLatestSchema()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing latest schema: %w", err)
+	}
+	c.tablesLock.RLock()
+	filter := c.filter
+	c.tablesLock.RUnlock()
+	if filter.exceptOnly() {
+		// the tables which are new in the schema aren't delivered until they're added to the filter subjects
+		if err := c.updateFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+	if len(tables) == 0 {
+		for table := range latest {
+			if c.isTableAllowed(table) {
+				tables = append(tables, table)
+			}
+		}
+	} else {
+		for _, table := range tables {
+			if latest[table] == nil {
+				return nil, fmt.Errorf("table not found in latest schema: %s", table)
+			}
+		}
+	}
+	sort.Strings(tables)
+	if c.pipelines != nil {
+		return c.refreshPipelines(tables)
+	}
+	return c.requestRefresh(tables)
+}
+
+// requestRefresh asks the bufferer to apply the migrations for the tables and waits for the tables which were migrated.
+func (c *Consumer) requestRefresh(tables []string) ([]string, error) {
+	// the migrations run on the bufferer so they don't run while the driver is processing or flushing events
+	req := schemaRefresh{tables: tables, result: make(chan schemaRefreshResult, 1)}
+	select {
+	case c.refreshes <- req:
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+	select {
+	case res := <-req.result:
+		return res.migrated, res.err
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+}
+
+// refreshSchema flushes the pending events and then applies the migrations for the refresh request. It returns true if
+// the bufferer should stop.
+func (c *Consumer) refreshSchema(req schemaRefresh) bool {
+	if c.groups != nil && c.groups.Len() > 0 && c.releaseGroup() {
+		req.result <- schemaRefreshResult{err: fmt.Errorf("error processing flush group events before migrating")}
+		return true
+	}
+	if len(c.pending) > 0 {
+		if c.flush(c.logger) {
+			req.result <- schemaRefreshResult{err: fmt.Errorf("error flushing pending events before migrating")}
+			return true
+		}
+	}
+	latest, err := c.registry.GetLatestSchema()
+	if err != nil {
+		req.result <- schemaRefreshResult{err: fmt.Errorf("error getting latest schema: %w", err)}
+		return false
+	}
+	started := time.Now()
+	migrated, err := c.migrateTables(latest, req.tables)
+	if err == nil {
+		c.logger.Info("schema refresh migrated %d of %d tables in %v", len(migrated), len(req.tables), time.Since(started))
+	}
+	req.result <- schemaRefreshResult{migrated, err}
+	return false
+}
+
+func (c *Consumer) flushState(maxBatchSize int, numPending uint64) FlushState {
+	state := FlushState{
+		Pending:           len(c.pending),
+		MaxBatchSize:      maxBatchSize,
+		MaxAckPending:     c.max,
+		NumPending:        numPending,
+		MinPendingLatency: c.minPendingLatency,
+		MaxPendingLatency: c.maxPendingLatency,
+	}
+	if c.pendingStarted != nil {
+		state.Elapsed = time.Since(*c.pendingStarted)
+	}
+	return state
+}
+
 func (c *Consumer) bufferer() {
 	c.logger.Trace("starting bufferer")
 	c.waitGroup.Add(1)
+	wake := time.NewTimer(time.Hour)
 	defer func() {
+		wake.Stop()
 		c.waitGroup.Done()
 		c.logger.Trace("stopped bufferer")
 	}()
 	for {
+		if c.releaseParked() {
+			return
+		}
+		// wait for the next message or until there is something to do while idle instead of polling
+		if d := c.nextWake(); d >= 0 {
+			wake.Reset(d)
+		} else {
+			wake.Stop()
+		}
+		buffer := c.buffer
+		if c.rateLimited() {
+			buffer = nil // the messages wait in the buffer until the wake timer while pulling is paused
+		}
 		select {
 		case <-c.ctx.Done():
 			c.nackEverything()
 			return
-		case msg := <-c.buffer:
+		case req := <-c.refreshes:
+			if c.refreshSchema(req) {
+				return
+			}
+		case result := <-c.drains:
+			if c.flushDrained(result) {
+				return
+			}
+		case <-c.reconnects:
+			if err := c.reconnect(); err != nil {
+				c.handleError(err)
+				return
+			}
+		case msg := <-buffer:
 			if msg == nil {
 				return
 			}
+			if c.limiter != nil && c.parent == nil {
+				c.limiter.Allow() // the message is only taken once the limiter lets it through
+			}
+			if err := c.checkBackpressure(); err != nil {
+				internal.PendingEvents.Dec()
+				c.handleError(err)
+				return
+			}
 			m, err := msg.Metadata()
 			if err != nil {
 				internal.PendingEvents.Dec()
 				c.handleError(err)
 				return
 			}
+			if c.acks != nil {
+				c.acks.deliver(m.Sequence.Stream)
+			}
+			if c.pipelines != nil {
+				if c.dispatch(msg, m) {
+					return
+				}
+				continue
+			}
 			log := c.logger.With(map[string]any{
 				"msgId":   msg.Headers().Get(nats.MsgIdHdr),
 				"subject": msg.Subject(),
@@ -360,149 +1176,399 @@ func (c *Consumer) bufferer() {
 			log.Trace("msg received - deliveries=%d,pending=%d", m.NumDelivered, len(c.pending))
 			c.pending = append(c.pending, msg)
 
-			// check the expected sequence number
-			if m.Sequence.Consumer != c.sequence+1 {
+			// check the expected sequence number, the consumer checks it before dispatching to a pipeline
+			if c.parent == nil && m.Sequence.Consumer != c.sequence+1 {
 				internal.PendingEvents.Dec()
-				c.handleError(fmt.Errorf("out of order sequence: %d, expected: %d", m.Sequence.Consumer, c.sequence+1))
+				c.handleError(errcode.Errorf(errcode.SequenceGap, "out of order sequence: %d, expected: %d", m.Sequence.Consumer, c.sequence+1))
 				return
 			}
 			c.sequence = m.Sequence.Consumer
-			buf := msg.Data()
 			md, _ := msg.Metadata()
+			buf, err := util.DecodeNatsData(msg.Headers(), msg.Data())
+			if err != nil {
+				internal.PendingEvents.Dec()
+				log.Error("error decoding %s payload (seq:%d): %s", msg.Headers().Get("content-encoding"), md.Sequence.Consumer, err)
+				c.handleError(errcode.New(errcode.InvalidEvent, err))
+				return
+			}
+			if c.maxEventSize > 0 && len(buf) > c.maxEventSize {
+				table := tableFromSubject(msg.Subject())
+				if err := c.quarantineOversized(table, m.Sequence.Stream, buf); err != nil {
+					log.Error("error quarantining oversized event of %d bytes: %s", len(buf), err)
+				} else {
+					log.Warn("quarantined %s event of %d bytes which exceeds the max event size of %d bytes", table, len(buf), c.maxEventSize)
+				}
+				internal.SkippedEvents.WithLabelValues(table, internal.SkipReasonOversized).Inc()
+				c.skip(log, msg)
+				continue
+			}
 			var evt internal.DBChangeEvent
 			if err := json.Unmarshal(buf, &evt); err != nil {
 				internal.PendingEvents.Dec()
 				log.Error("error unmarshalling: %s (seq:%d): %s", string(buf), md.Sequence.Consumer, err)
-				c.handleError(err)
+				c.handleError(errcode.New(errcode.InvalidEvent, err))
 				return
 			}
-			if c.shouldSkip(log, &evt) {
-				log.Debug("skipping event")
-				if err := msg.Ack(); err != nil {
-					// not much we can do here, just log it
-					log.Error("error acking skipped msg: %s", err)
+			companyID := unknownCompanyID
+			if evt.CompanyID != nil {
+				companyID = *evt.CompanyID
+			}
+			if reason, throttled := c.throttled(companyID); throttled {
+				if c.parked != nil {
+					err := c.park(log, msg, buf, companyID, reason)
+					if err == nil {
+						continue
+					}
+					log.Error("error parking event of company %s: %s", companyID, err)
+				}
+				if c.acks != nil {
+					// acking a later message would ack a nacked one before it's redelivered
+					log.Warn("company %s is %s but processing event since it can't be redelivered later with the ack all policy", companyID, reason)
+				} else if c.canDelay(m.NumDelivered) {
+					// don't let a throttled message get dropped by the server, process it on the last delivery
+					c.throttle(log, msg, companyID, reason)
+					continue
+				} else {
+					log.Warn("company %s is %s but processing event to prevent it from exceeding max deliveries", companyID, reason)
+				}
+			}
+			if c.pausedTables.IsPaused(evt.Table) {
+				if c.canDelay(m.NumDelivered) {
+					c.throttleTable(log, msg, evt.Table)
+					continue
+				}
+				log.Warn("table %s is paused but processing event to prevent it from exceeding max deliveries", evt.Table)
+			}
+			internal.CompanyEvents.WithLabelValues(companyID).Inc()
+			if evt.Timestamp > 0 {
+				internal.CompanyLag.WithLabelValues(companyID).Set(time.Since(time.UnixMilli(evt.Timestamp)).Seconds())
+				c.lastEventTimestamp.Store(evt.Timestamp)
+			}
+			if skip, reason := c.shouldSkip(log, &evt); skip {
+				log.Debug("skipping event (%s)", reason)
+				internal.SkippedEvents.WithLabelValues(evt.Table, reason).Inc()
+				c.skip(log, msg)
+				continue
+			}
+			if c.ordering != nil && c.resequence == nil {
+				c.ordering.Check(&evt) // only detecting so the event is still delivered
+			}
+			if feature.Enabled(feature.Dedupe) && evt.ID != "" {
+				if c.pendingIDs[evt.ID] {
+					log.Debug("skipping duplicate event: %s", evt.String())
+					internal.SkippedEvents.WithLabelValues(evt.Table, internal.SkipReasonDuplicate).Inc()
+					c.skip(log, msg)
+					continue
 				}
-				// remove from pending
-				for i, m := range c.pending {
-					if m == msg {
-						c.pending = append(c.pending[:i], c.pending[i+1:]...)
-						break
-					}
+				if c.pendingIDs == nil {
+					c.pendingIDs = make(map[string]bool)
 				}
-				internal.PendingEvents.Dec()
-				continue
+				c.pendingIDs[evt.ID] = true
 			}
 			evt.NatsMsg = msg // in case the driver wants to get specific information from it for logging, etc
 
-			var forceFlushAfterMigration bool
-
-			// check to see if we need to perform a migration
-			if c.supportsMigration {
-				migrated, err := c.handlePossibleMigration(c.ctx, log, &evt)
-				if err != nil {
-					c.handleError(err)
+			event := groupedEvent{log: log, evt: evt, companyID: companyID, size: len(buf), numPending: md.NumPending, sequence: md.Sequence.Stream}
+			if c.resequence != nil {
+				// the events are sent to the driver when the batch is flushed so the events of a record can be resequenced
+				c.resequence.Stage(event)
+				if c.checkFlush(log, false, md.NumPending) {
 					return
 				}
-				forceFlushAfterMigration = migrated
+				continue
 			}
-
-			// check to see if the schema matches the incoming object
-			if evt.Operation != "DELETE" && c.registry != nil {
-				schema, err := c.registry.GetSchema(evt.Table, evt.ModelVersion)
-				if err != nil {
-					c.handleError(fmt.Errorf("error getting schema for table: %s, model version: %s: %w", evt.Table, evt.ModelVersion, err))
-					return
-				}
-				object, err := evt.GetObject()
-				if err != nil {
-					c.handleError(fmt.Errorf("error getting object for table: %s, model version: %s: %w", evt.Table, evt.ModelVersion, err))
-					return
+			if c.groups != nil {
+				if c.groups.Continues(&evt) {
+					c.groups.Stage(event)
+					// don't hold more than a batch, a transaction this large is split across flushes
+					if c.groups.Len() >= c.maxBatchSize() && c.releaseGroup() {
+						return
+					}
+					continue
 				}
-				diff := util.JSONDiff(object, schema.Columns())
-				if len(diff) > 0 {
-					if err := evt.OmitProperties(diff...); err != nil {
-						c.handleError(fmt.Errorf("error omitting extra properties: %s properties for table: %s, model version: %s: %w", diff, evt.Table, evt.ModelVersion, err))
+				if c.groups.Len() > 0 {
+					// hold back this message so a flush of the released events doesn't ack it before it's processed
+					c.pending = c.pending[:len(c.pending)-1]
+					stop := c.releaseGroup()
+					c.pending = append(c.pending, msg)
+					if stop {
+						c.nackEverything()
 						return
 					}
 				}
+				if c.groups.Groupable(&evt) {
+					c.groups.Stage(event)
+					continue
+				}
 			}
-
-			flush, err := c.driver.Process(log, evt)
+			flush, err := c.processEvent(event)
 			if err != nil {
-				internal.PendingEvents.Dec()
 				c.handleError(err)
 				return
 			}
-			maxsize := c.driver.MaxBatchSize()
-			if maxsize <= 0 {
-				maxsize = c.max
-			}
-			if traceLogNatsProcessDetail {
-				log.Trace("process returned. flush=%v,pending=%d,max=%d", flush, len(c.pending), maxsize)
-			}
-			if flush || len(c.pending) >= maxsize || forceFlushAfterMigration {
-				if traceLogNatsProcessDetail {
-					log.Trace("flush 1 called. flush=%v,pending=%d,max=%d", flush, len(c.pending), maxsize)
-				}
-				if c.flush(log) {
-					return
-				}
-				continue
-			}
-			if c.pendingStarted == nil {
-				ts := time.Now()
-				c.pendingStarted = &ts
-			}
-			if md.NumPending > uint64(c.max) && time.Since(*c.pendingStarted) < c.maxPendingLatency*2 {
-				continue // if we have a large number, just keep going to try and catchup
+			if c.checkFlush(log, flush, md.NumPending) {
+				return
 			}
-			if len(c.pending) >= c.max || time.Since(*c.pendingStarted) >= c.maxPendingLatency {
-				if traceLogNatsProcessDetail {
-					log.Trace("flush 2 called. flush=%v,pending=%d,max=%d,started=%v", flush, len(c.pending), maxsize, time.Since(*c.pendingStarted))
-				}
-				if c.flush(log) {
-					return
-				}
-				continue
+		case <-wake.C:
+			if c.idle() {
+				return
 			}
-		default:
-			count := len(c.pending)
-			if count > 0 && count < c.max && c.pendingStarted != nil && time.Since(*c.pendingStarted) >= c.minPendingLatency {
-				if traceLogNatsProcessDetail {
-					c.logger.Trace("flush 3 called. count=%d,max=%d,started=%v", count, c.max, time.Since(*c.pendingStarted))
-				}
-				if c.flush(c.logger) {
-					return
-				}
-				continue
+		}
+	}
+}
+
+// idle is called when the bufferer wakes up without a message to flush the pending messages once the flush policy
+// allows it, release a flush group whose transaction isn't continuing, extend the pending messages and resume from
+// backpressure. It returns true if the bufferer should stop.
+func (c *Consumer) idle() bool {
+	if len(c.buffer) > 0 && !c.rateLimited() {
+		return false // the stream isn't idle, the messages are handled first
+	}
+	if err := c.checkBackpressure(); err != nil {
+		c.handleError(err)
+		return true
+	}
+	if c.groups != nil && c.groups.Len() > 0 {
+		// the stream is idle so the rest of the transaction isn't coming
+		return c.releaseGroup()
+	}
+	count := len(c.pending)
+	// the pending messages are flushed right away once the max buffered size is reached to release them
+	if count > 0 && c.pendingStarted != nil && (c.limit.full() || c.flushPolicy.ShouldFlushIdle(c.flushState(c.maxBatchSize(), 0))) {
+		if traceLogNatsProcessDetail {
+			c.logger.Trace("flush 3 called. count=%d,max=%d,started=%v,policy=%s", count, c.max, time.Since(*c.pendingStarted), c.flushPolicy.Name())
+		}
+		return c.flush(c.logger)
+	}
+	if count > 0 {
+		c.extendPending()
+	}
+	return false
+}
+
+// nextWake returns how long the bufferer waits for a message before it wakes up to check if there is something to do
+// while idle, or a negative duration if there is nothing to do until a message arrives. While the rate limit is used up
+// it wakes up once the limiter lets the next message through at the latest.
+func (c *Consumer) nextWake() time.Duration {
+	wait := c.nextIdleWake()
+	if c.rateLimited() {
+		if delay := c.rateLimitDelay(); wait < 0 || delay < wait {
+			wait = delay
+		}
+	}
+	return wait
+}
+
+func (c *Consumer) nextIdleWake() time.Duration {
+	if c.backpressure != nil && c.backpressure.active {
+		return c.emptyBufferPauseTime // the resume conditions change as the destination catches up
+	}
+	if c.groups != nil && c.groups.Len() > 0 {
+		return c.emptyBufferPauseTime // the rest of the transaction can still be on its way
+	}
+	release := time.Duration(-1)
+	if c.parked.waiting(c.index) {
+		release = max(0, parkReleaseInterval-time.Since(c.parkReleased))
+	}
+	if len(c.pending) == 0 || c.pendingStarted == nil {
+		return release
+	}
+	wait := c.flushPolicy.IdleFlushDelay(c.flushState(c.maxBatchSize(), 0))
+	extend := max(inProgressInterval-time.Since(*c.pendingStarted), inProgressInterval-time.Since(c.lastProgress))
+	if release >= 0 {
+		wait = min(wait, release)
+	}
+	return max(0, min(wait, extend))
+}
+
+func (c *Consumer) maxBatchSize() int {
+	maxsize := c.driver.MaxBatchSize()
+	if maxsize <= 0 {
+		maxsize = c.max
+	}
+	return maxsize
+}
+
+// processEvent migrates the table if needed and sends the event to the driver. It returns true if the driver or the
+// migration requires a flush.
+func (c *Consumer) processEvent(event groupedEvent) (bool, error) {
+	log, evt := event.log, event.evt
+	var forceFlushAfterMigration bool
+
+	// check to see if we need to perform a migration
+	if c.supportsMigration {
+		migrated, err := c.handlePossibleMigration(c.ctx, log, &evt)
+		if err != nil {
+			return false, err
+		}
+		forceFlushAfterMigration = migrated
+	}
+
+	// check to see if the schema matches the incoming object
+	if evt.Operation != "DELETE" && c.registry != nil {
+		schema, err := c.registry.GetSchema(evt.Table, evt.ModelVersion)
+		if err != nil {
+			return false, errcode.Errorf(errcode.SchemaRegistry, "error getting schema for table: %s, model version: %s: %w", evt.Table, evt.ModelVersion, err)
+		}
+		object, err := evt.GetObject()
+		if err != nil {
+			return false, fmt.Errorf("error getting object for table: %s, model version: %s: %w", evt.Table, evt.ModelVersion, err)
+		}
+		diff := util.JSONDiff(object, schema.Columns())
+		if len(diff) > 0 {
+			if err := evt.OmitProperties(diff...); err != nil {
+				return false, fmt.Errorf("error omitting extra properties: %s properties for table: %s, model version: %s: %w", diff, evt.Table, evt.ModelVersion, err)
 			}
-			if count > 0 {
-				continue
+		}
+	}
+
+	if feature.Enabled(feature.Lineage) {
+		evt.Lineage = c.lineage(&evt)
+	}
+
+	skip, err := c.preProcess(log, &evt)
+	if err != nil {
+		return false, err
+	}
+	if skip {
+		return forceFlushAfterMigration, nil
+	}
+
+	var flush bool
+	if c.batcher != nil {
+		// the driver gets all the events of the batch at once when flushing
+		if c.journal != nil && event.sequence > 0 {
+			if err := c.journal.add(event.sequence, &evt); err != nil {
+				return false, err
 			}
-			select {
-			case <-c.ctx.Done():
-				c.logger.Debug("context done")
-				c.nackEverything()
-				return
-			default:
-				time.Sleep(c.emptyBufferPauseTime)
+		}
+		c.batch = append(c.batch, evt)
+	} else {
+		var err error
+		if c.journal != nil && event.sequence > 0 {
+			if err := c.journal.add(event.sequence, &evt); err != nil {
+				return false, err
 			}
 		}
+		flush, err = c.driver.Process(log, evt)
+		if err != nil {
+			internal.PendingEvents.Dec()
+			return false, destinationError(err)
+		}
+	}
+	if c.hasPostFlushHooks() {
+		c.hookEvents = append(c.hookEvents, evt)
+	}
+	if c.usage != nil {
+		c.usage.Add(event.companyID, evt.Table, event.size)
+	}
+	return flush || forceFlushAfterMigration, nil
+}
+
+// checkFlush flushes the pending events if the driver requested it, the batch is full or the flush policy decides to.
+// It returns true if the bufferer should stop.
+func (c *Consumer) checkFlush(log logger.Logger, flush bool, numPending uint64) bool {
+	maxsize := c.maxBatchSize()
+	if traceLogNatsProcessDetail {
+		log.Trace("process returned. flush=%v,pending=%d,max=%d", flush, len(c.pending), maxsize)
+	}
+	if flush || len(c.pending) >= maxsize {
+		if traceLogNatsProcessDetail {
+			log.Trace("flush 1 called. flush=%v,pending=%d,max=%d", flush, len(c.pending), maxsize)
+		}
+		return c.flush(log)
+	}
+	if c.pendingStarted == nil {
+		ts := time.Now()
+		c.pendingStarted = &ts
+	}
+	if c.flushPolicy.ShouldFlush(c.flushState(maxsize, numPending)) {
+		if traceLogNatsProcessDetail {
+			log.Trace("flush 2 called. flush=%v,pending=%d,max=%d,started=%v,policy=%s", flush, len(c.pending), maxsize, time.Since(*c.pendingStarted), c.flushPolicy.Name())
+		}
+		return c.flush(log)
+	}
+	c.extendPending()
+	return false
+}
+
+// releaseGroup sends the staged events of a flush group transaction to the driver, parents first, and only checks for
+// a flush after all of them were processed so they are committed together. It returns true if the bufferer should stop.
+func (c *Consumer) releaseGroup() bool {
+	events := c.groups.Release()
+	var flush bool
+	for _, event := range events {
+		f, err := c.processEvent(event)
+		if err != nil {
+			c.handleError(err)
+			return true
+		}
+		flush = flush || f
+	}
+	last := events[len(events)-1]
+	last.log.Trace("released %d events of flush group transaction %s", len(events), last.evt.MVCCTimestamp)
+	return c.checkFlush(last.log, flush, last.numPending)
+}
+
+// lineage returns the lineage of the event so it can be traced back to its message downstream. The events which are
+// flushed together share a batch id.
+func (c *Consumer) lineage(evt *internal.DBChangeEvent) *internal.Lineage {
+	if c.batchID == "" {
+		c.batchID = uuid.NewString()
+	}
+	name := c.name
+	if c.parent != nil {
+		name = c.parent.name
+	}
+	return &internal.Lineage{
+		StreamSequence: evt.GetStreamSequence(),
+		Consumer:       name,
+		Version:        c.version,
+		BatchID:        c.batchID,
+	}
+}
+
+// extendPending tells the server the pending messages are still being worked on so that messages held
+// longer than the ack wait (such as for an aggregation window) are not redelivered.
+func (c *Consumer) extendPending() {
+	if c.pendingStarted == nil || time.Since(*c.pendingStarted) < inProgressInterval || time.Since(c.lastProgress) < inProgressInterval {
+		return
+	}
+	for _, m := range c.pending {
+		if err := m.InProgress(); err != nil {
+			c.logger.Warn("error extending ack wait for msg %s: %s", m.Headers().Get(nats.MsgIdHdr), err)
+		}
 	}
+	c.lastProgress = time.Now()
 }
 
 func (c *Consumer) process(msg jetstream.Msg) {
 	internal.PendingEvents.Inc()
 	internal.TotalEvents.Inc()
-	c.buffer <- msg
+	c.buffer <- c.limit.hold(c.logger, msg)
 }
 
 type heartbeat struct {
-	SessionId string               `json:"sessionId" msgpack:"sessionId"`
-	Offset    int64                `json:"offset" msgpack:"offset"`
-	Uptime    time.Duration        `json:"uptime" msgpack:"uptime"`
-	Stats     internal.SystemStats `json:"stats" msgpack:"stats"`
-	Paused    *time.Time           `json:"paused,omitempty" msgpack:"paused,omitempty"`
+	SessionId       string                          `json:"sessionId" msgpack:"sessionId"`
+	Incarnation     int                             `json:"incarnation,omitempty" msgpack:"incarnation,omitempty"` // the number of times the session was resumed by a new process
+	Offset          int64                           `json:"offset" msgpack:"offset"`
+	Uptime          time.Duration                   `json:"uptime" msgpack:"uptime"`
+	Stats           internal.SystemStats            `json:"stats" msgpack:"stats"`
+	Paused          *time.Time                      `json:"paused,omitempty" msgpack:"paused,omitempty"`
+	PausedTables    []string                        `json:"pausedTables,omitempty" msgpack:"pausedTables,omitempty"`
+	Usage           []usage.Rollup                  `json:"usage,omitempty" msgpack:"usage,omitempty"`
+	Features        []string                        `json:"features,omitempty" msgpack:"features,omitempty"`
+	Error           *heartbeatError                 `json:"error,omitempty" msgpack:"error,omitempty"`             // the last error of the consumer
+	Driver          string                          `json:"driver,omitempty" msgpack:"driver,omitempty"`           // the name of the driver
+	Destination     string                          `json:"destination,omitempty" msgpack:"destination,omitempty"` // the url of the driver with the credentials masked
+	Lag             float64                         `json:"lag" msgpack:"lag"`                                     // the seconds the consumer is behind the head of the stream
+	EventsPerSecond float64                         `json:"eventsPerSecond" msgpack:"eventsPerSecond"`             // the rate of events received since the last heartbeat
+	LastFlush       float64                         `json:"lastFlush" msgpack:"lastFlush"`                         // the seconds the last flush took
+	Validator       *internal.SchemaValidatorStatus `json:"validator,omitempty" msgpack:"validator,omitempty"`     // the status of the schema validator if there is one
+}
+
+type heartbeatError struct {
+	Code errcode.Code `json:"code" msgpack:"code"`
+	Time time.Time    `json:"time" msgpack:"time"`
 }
 
 func (c *Consumer) heartbeat() error {
@@ -511,14 +1577,31 @@ func (c *Consumer) heartbeat() error {
 		return fmt.Errorf("error getting system stats: %w", err)
 	}
 
-	subject := fmt.Sprintf("eds.client.%s.heartbeat", c.sessionID)
+	// the credentials only allow publishing for their own session
+	subject := fmt.Sprintf("eds.client.%s.heartbeat", c.credentialSessionID)
 
 	hb := heartbeat{
-		SessionId: c.sessionID,
-		Stats:     *stats,
-		Uptime:    time.Duration(time.Since(*c.started).Seconds()),
-		Paused:    c.pauseStarted,
-		Offset:    c.offset,
+		SessionId:    c.sessionID,
+		Incarnation:  c.incarnation,
+		Stats:        *stats,
+		Uptime:       time.Duration(time.Since(*c.started).Seconds()),
+		Paused:       c.pauseStarted,
+		PausedTables: c.pausedTables.List(),
+		Offset:       c.offset,
+		Features:     feature.EnabledFlags(),
+	}
+	c.errorLock.Lock()
+	hb.Error = c.lastError
+	c.errorLock.Unlock()
+	c.heartbeatState(&hb)
+
+	if c.usage != nil {
+		rollups, err := c.usage.Rollups(1)
+		if err != nil {
+			c.logger.Error("error getting usage for heartbeat: %s", err)
+		} else {
+			hb.Usage = rollups
+		}
 	}
 
 	c.offset++
@@ -534,13 +1617,37 @@ func (c *Consumer) heartbeat() error {
 	msg.Header.Set(nats.MsgIdHdr, msgId)
 	msg.Header.Set("content-encoding", "msgpack")
 	msg.Data = buffer.Bytes()
-	if err := c.conn.PublishMsg(msg); err != nil {
+	err = c.conn.PublishMsg(msg)
+	if err == nil {
+		// publish only buffers the message so flush to make sure the server received it
+		err = c.conn.FlushTimeout(heartbeatFlushTimeout)
+	}
+	if err != nil {
+		c.heartbeatFailed(&hb, err)
 		return err
 	}
+	if c.heartbeatFailures >= maxHeartbeatFailures && c.heartbeatFallback != nil {
+		c.logger.Info("heartbeat publish recovered after %d failures", c.heartbeatFailures)
+		c.heartbeatFallback(nil, nil)
+	}
+	c.heartbeatFailures = 0
 	c.logger.Trace("heartbeat sent %s with: %v", msgId, util.JSONStringify(hb))
 	return nil
 }
 
+// heartbeatFailed hands the heartbeat to the fallback once publishing has failed several times in a row so the
+// control plane can still see the server is alive and surface the problem.
+func (c *Consumer) heartbeatFailed(hb *heartbeat, err error) {
+	c.heartbeatFailures++
+	if c.heartbeatFailures < maxHeartbeatFailures || c.heartbeatFallback == nil {
+		return
+	}
+	if c.heartbeatFailures == maxHeartbeatFailures {
+		c.logger.Warn("heartbeat publish failed %d times in a row, using fallback: %s", c.heartbeatFailures, err)
+	}
+	c.heartbeatFallback([]byte(util.JSONStringify(hb)), err)
+}
+
 // sendHeartbeats sends a heartbeat every minute
 func (c *Consumer) sendHeartbeats() {
 
@@ -574,7 +1681,7 @@ type CredentialInfo struct {
 	SessionID  string
 }
 
-func NewNatsConnection(logger logger.Logger, url string, creds string) (*nats.Conn, *CredentialInfo, error) {
+func NewNatsConnection(logger logger.Logger, url string, creds string, opts ...nats.Option) (*nats.Conn, *CredentialInfo, error) {
 	var natsCredentials nats.Option
 	var info *CredentialInfo
 
@@ -594,7 +1701,7 @@ func NewNatsConnection(logger logger.Logger, url string, creds string) (*nats.Co
 	}
 
 	// Nats connection to main NATS server
-	nc, err := cnats.NewNats(logger, "eds-"+info.ServerID, url, natsCredentials)
+	nc, err := cnats.NewNats(logger, "eds-"+info.ServerID, url, natsCredentials, opts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error creating nats connection: %w", err)
 	}
@@ -604,32 +1711,88 @@ func NewNatsConnection(logger logger.Logger, url string, creds string) (*nats.Co
 
 func (c *Consumer) Pause() {
 	c.logger.Debug("pausing")
-	c.subscriber.Drain()
-	c.subscriber = nil
+	c.subscriberLock.Lock()
+	defer c.subscriberLock.Unlock()
+	if c.subscriber != nil {
+		c.subscriber.Drain()
+		c.subscriber = nil
+	}
 	t := time.Now()
 	c.pauseStarted = &t
 	c.logger.Debug("paused")
 }
 
 func (c *Consumer) Unpause() error {
+	c.subscriberLock.Lock()
+	defer c.subscriberLock.Unlock()
 	if c.subscriber != nil {
 		return fmt.Errorf("consumer already started")
 	}
-	// start consuming messages
-	sub, err := c.jsconn.Consume(
-		c.process,
-		jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
-			c.logger.Warn("consumer error: %s", err)
-		}),
-		jetstream.PullExpiry(time.Minute),
-		jetstream.PullMaxMessages(4_096),
-	)
+
+	if c.destinationCheck != nil {
+		if err := WaitForDestination(c.ctx, c.logger, c.destinationMaxWait, c.checkDestination); err != nil {
+			return fmt.Errorf("error waiting for destination: %w", err)
+		}
+	} else if c.preMigrate && c.supportsMigration && c.registry != nil {
+		if err := c.premigrate(); err != nil {
+			return fmt.Errorf("error pre-migrating tables: %w", err)
+		}
+	}
+	c.pauseStarted = nil
+	if c.backpressure != nil && c.backpressure.active {
+		c.logger.Debug("unpaused but pulling will resume once the backpressure clears")
+		return nil
+	}
+	return c.subscribe()
+}
+
+// subscribe starts pulling messages. The caller must hold the subscriber lock.
+func (c *Consumer) subscribe() error {
+	opts := append(c.pull.consumeOpts(), jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		c.logger.Warn("consumer error: %s", err)
+	}))
+	sub, err := c.jsconn.Consume(c.process, opts...)
 	if err != nil {
 		c.conn.Close()
 		return fmt.Errorf("error starting jetstream consumer: %w", err)
 	}
 	c.subscriber = sub
-	c.pauseStarted = nil
+	return nil
+}
+
+// checkBackpressure stops pulling messages when the driver can't keep up and starts pulling again once it has caught up.
+// Pulling isn't started again if the consumer was paused in the meantime.
+func (c *Consumer) checkBackpressure() error {
+	if c.backpressure == nil {
+		return nil
+	}
+	buffered := c.buffered()
+	lastFlush := c.flushLatency()
+	if pause, reason := c.backpressure.shouldPause(buffered, lastFlush); pause {
+		c.subscriberLock.Lock()
+		defer c.subscriberLock.Unlock()
+		if c.subscriber != nil {
+			c.subscriber.Drain()
+			c.subscriber = nil
+		}
+		c.backpressure.pause(reason)
+		internal.Backpressure.Set(1)
+		internal.BackpressurePauses.WithLabelValues(reason).Inc()
+		c.logger.Warn("pausing pulling messages because of backpressure (%s), buffered: %d, pending: %d, bytes: %d, last flush: %v", reason, buffered, len(c.pending), c.limit.size(), lastFlush)
+		return nil
+	}
+	if c.backpressure.shouldResume(buffered, len(c.pending), lastFlush) {
+		c.subscriberLock.Lock()
+		defer c.subscriberLock.Unlock()
+		reason := c.backpressure.reason
+		duration := c.backpressure.resume()
+		internal.Backpressure.Set(0)
+		c.resetFlushLatency() // only a flush after resuming can pause again for latency
+		c.logger.Info("backpressure (%s) cleared after %v", reason, duration)
+		if c.pauseStarted == nil && c.subscriber == nil {
+			return c.subscribe()
+		}
+	}
 	return nil
 }
 
@@ -638,23 +1801,108 @@ func (c *Consumer) start() error {
 		return fmt.Errorf("consumer already started")
 	}
 
-	if err := c.Unpause(); err != nil {
+	if c.retries != nil {
+		if err := c.replayRetries(); err != nil {
+			return err
+		}
+	}
+
+	if c.pauseStarted != nil {
+		c.logger.Info("starting paused since %s", c.pauseStarted.Format(time.RFC3339))
+	} else if err := c.Unpause(); err != nil {
 		return err
 	}
 
 	// start the background processor
 	go c.bufferer()
+	c.startPipelines()
 
 	// start the heartbeat
-	go c.sendHeartbeats()
+	if !c.heartbeatsDisabled {
+		go c.sendHeartbeats()
+	}
+	go c.reportLag()
 
 	c.logger.Debug("started")
 	return nil
 }
 
+// checkStartPosition returns an error if the existing consumer would not deliver the changes made after the import timestamp.
+// A consumer which was created with deliver new (or a later start time) after the import will have silently skipped them.
+func checkStartPosition(info *jetstream.ConsumerInfo, startAt *time.Time) error {
+	if info == nil || startAt == nil {
+		return nil
+	}
+	switch info.Config.DeliverPolicy {
+	case jetstream.DeliverNewPolicy, jetstream.DeliverLastPolicy, jetstream.DeliverLastPerSubjectPolicy:
+		if info.Created.After(*startAt) {
+			return fmt.Errorf("%w: consumer was created at %s with deliver policy %s but the import timestamp is %s", ErrConsumerMissedHistory, info.Created.Format(time.RFC3339), info.Config.DeliverPolicy, startAt.Format(time.RFC3339))
+		}
+	case jetstream.DeliverByStartTimePolicy:
+		if info.Config.OptStartTime != nil && info.Config.OptStartTime.After(*startAt) {
+			return fmt.Errorf("%w: consumer starts at %s but the import timestamp is %s", ErrConsumerMissedHistory, info.Config.OptStartTime.Format(time.RFC3339), startAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// ValidateTuning returns an error if the flush latencies, the empty buffer pause, the ack wait or the reconnect timeout
+// can't be used together.
+// Zero values use their defaults.
+func (config ConsumerConfig) ValidateTuning() error {
+	if config.MinPendingLatency < 0 || config.MaxPendingLatency < 0 {
+		return fmt.Errorf("pending latencies must not be negative")
+	}
+	minPendingLatency, maxPendingLatency := config.MinPendingLatency, config.MaxPendingLatency
+	if minPendingLatency == 0 {
+		minPendingLatency = DefaultMinPendingLatency
+	}
+	if maxPendingLatency == 0 {
+		maxPendingLatency = DefaultMaxPendingLatency
+	}
+	if minPendingLatency > maxPendingLatency {
+		return fmt.Errorf("min pending latency (%v) must not be greater than max pending latency (%v)", minPendingLatency, maxPendingLatency)
+	}
+	if config.EmptyBufferPauseTime < 0 {
+		return fmt.Errorf("empty buffer pause must not be negative")
+	}
+	if config.AckWait < 0 {
+		return fmt.Errorf("ack wait must not be negative")
+	}
+	if config.ReconnectTimeout < 0 {
+		return fmt.Errorf("reconnect timeout must not be negative")
+	}
+	if config.MaxDeliver < 0 {
+		return fmt.Errorf("max deliver must not be negative")
+	}
+	if err := validateRedeliveryBackoff(config.RedeliveryBackoff, config.MaxDeliver); err != nil {
+		return err
+	}
+	// pending messages are only extended once they've been held for the in progress interval so a shorter ack wait
+	// would redeliver them before then
+	if config.AckWait > 0 && config.AckWait <= inProgressInterval {
+		return fmt.Errorf("ack wait (%v) must be longer than %v", config.AckWait, inProgressInterval)
+	}
+	return nil
+}
+
 // CreateConsumer creates a new nats consumer, but does not start it.
 func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
-	nc, info, err := NewNatsConnection(config.Logger, config.URL, config.Credentials)
+	if err := config.ValidateTuning(); err != nil {
+		return nil, err
+	}
+	if err := config.Pull.Validate(); err != nil {
+		return nil, err
+	}
+	// the events of a paused table are nacked to be redelivered later, which acking a later message would ack instead
+	if config.AckAll && len(config.PausedTables) > 0 {
+		return nil, fmt.Errorf("the ack all policy can't be used while tables are paused: %s", strings.Join(config.PausedTables, ", "))
+	}
+	var natsOpts []nats.Option
+	if config.ReconnectTimeout > 0 {
+		natsOpts = append(natsOpts, nats.MaxReconnects(-1)) // the reconnect timeout decides when to give up
+	}
+	nc, info, err := NewNatsConnection(config.Logger, config.URL, config.Credentials, natsOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -669,6 +1917,12 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 	if config.MaxAckPending <= 0 {
 		config.MaxAckPending = 25_000
 	}
+	if config.AckWait == 0 {
+		config.AckWait = DefaultAckWait
+	}
+	if config.MaxDeliver == 0 {
+		config.MaxDeliver = DefaultMaxDeliver
+	}
 
 	var startAt *time.Time
 	var consumer Consumer
@@ -679,20 +1933,68 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 	consumer.ctx = ctx
 	consumer.cancel = cancel
 	consumer.conn = nc
+	// fail releases what was created so far when the consumer can't be created
+	fail := func(err error) (*Consumer, error) {
+		consumer.stopPipelineDrivers()
+		nc.Close()
+		cancel()
+		return nil, err
+	}
 	consumer.driver = config.Driver
 	consumer.buffer = make(chan jetstream.Msg, config.MaxAckPending)
 	consumer.pending = make([]jetstream.Msg, 0)
-	consumer.subError = make(chan error, 10)
+	consumer.subError = make(chan error, 10+config.Pipelines) // each pipeline can send an error before stopping
+	consumer.refreshes = make(chan schemaRefresh)
+	consumer.drains = make(chan chan error)
 	consumer.sessionID = info.SessionID
+	consumer.credentialSessionID = info.SessionID
+	if config.Sessions != nil {
+		session, err := config.Sessions.Resume(info)
+		if err != nil {
+			return fail(err)
+		}
+		consumer.sessionID = session.ID
+		consumer.incarnation = session.Incarnation
+	}
 	consumer.validator = config.SchemaValidator
+	consumer.quarantineDir = config.QuarantineDir
+	consumer.maxEventSize = config.MaxEventSize
+	consumer.tenants = newTenantController(config.CompanyQuotas)
+	consumer.pausedTables = newPausedTables(config.PausedTables)
+	consumer.pauseStarted = config.PausedAt
+	consumer.usage = config.Usage
 	consumer.registry = config.Registry
+	consumer.onNewTable = config.OnNewTable
+	consumer.preMigrate = config.PreMigrate
+	consumer.repairSchemaDrift = config.RepairSchemaDrift
+	consumer.destinationCheck = config.DestinationCheck
+	consumer.destinationMaxWait = config.DestinationMaxWait
+	consumer.groups = newFlushGrouper(config.FlushGroups)
+	consumer.fields = config.FieldFilters
+	consumer.locationIDs = config.LocationIDs
+	if config.RetryMaxAttempts == 0 {
+		config.RetryMaxAttempts = DefaultRetryMaxAttempts
+	}
+	if consumer.retries, err = newRetryQueue(config.RetryDir, config.RetryMaxAttempts); err != nil {
+		return fail(err)
+	}
+	consumer.limiter = newRateLimiter(config.MaxEventsPerSecond)
+	consumer.backpressure = newBackpressure(config.BackpressureThreshold, config.BackpressureMaxFlushLatency, config.MaxAckPending).limitRate(consumer.limiter)
+	consumer.pull = config.Pull
 	if _, ok := config.Driver.(internal.DriverMigration); ok {
 		consumer.supportsMigration = true
 	}
 	consumer.heartbeatInterval = config.HeartbeatInterval
+	consumer.heartbeatFallback = config.HeartbeatFallback
+	consumer.heartbeatsDisabled = config.heartbeatsDisabled
 	if consumer.heartbeatInterval == 0 {
 		consumer.heartbeatInterval = time.Minute
 	}
+	consumer.driverName, consumer.destination = describeDestination(config.DriverURL)
+	consumer.lagInterval = config.LagInterval
+	if consumer.lagInterval == 0 {
+		consumer.lagInterval = defaultLagInterval
+	}
 	consumer.minPendingLatency = config.MinPendingLatency
 	if consumer.minPendingLatency == 0 {
 		consumer.minPendingLatency = DefaultMinPendingLatency
@@ -701,9 +2003,36 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 	if consumer.maxPendingLatency == 0 {
 		consumer.maxPendingLatency = DefaultMaxPendingLatency
 	}
+	consumer.version = config.Version
 	consumer.emptyBufferPauseTime = config.EmptyBufferPauseTime
 	if consumer.emptyBufferPauseTime == 0 {
-		consumer.emptyBufferPauseTime = defaultEmptyBufferPauseTime
+		consumer.emptyBufferPauseTime = DefaultEmptyBufferPauseTime
+	}
+	consumer.flushPolicy = config.FlushPolicy
+	if consumer.flushPolicy == nil {
+		consumer.flushPolicy, _ = NewFlushPolicy("")
+	}
+	if agg, ok := config.Driver.(internal.DriverAggregation); ok && agg.AggregationWindow() > 0 {
+		// the driver only writes once per window so the window replaces the latency based policies
+		consumer.flushPolicy = &windowFlushPolicy{agg.AggregationWindow()}
+	}
+	consumer.logger.Debug("using flush policy: %s", consumer.flushPolicy.Name())
+	consumer.hooks = internal.ProcessorHooks()
+	if batcher, ok := config.Driver.(internal.DriverBatchProcessor); ok {
+		consumer.batcher = batcher
+		consumer.logger.Debug("driver processes events in batches")
+	}
+	if err := ValidateOrderingMode(config.OrderingMode); err != nil {
+		return fail(err)
+	}
+	if config.OrderingMode != OrderingModeNone {
+		consumer.ordering = newOrderingTracker(config.OrderingMode, config.OrderingMaxKeys)
+		consumer.resequence = newResequencer(config.OrderingMode)
+		if consumer.resequence != nil && consumer.groups != nil {
+			// the events of a transaction are already held back and released together parents first
+			return fail(fmt.Errorf("the %s ordering mode can't be used with flush groups", config.OrderingMode))
+		}
+		consumer.logger.Debug("using ordering mode: %s for up to %d records", config.OrderingMode, consumer.ordering.maxKeys)
 	}
 
 	if config.ExportTableTimestamps != nil {
@@ -716,17 +2045,24 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 		}
 	}
 
+	if config.Pipelines > 1 {
+		if err := consumer.createPipelines(config); err != nil {
+			return fail(err)
+		}
+	}
+
 	// set company ID overrides
 	if len(config.CompanyIDs) > 0 {
 		var newCompanyIDs []string
 		for _, companyID := range config.CompanyIDs {
-			if !util.SliceContains(info.CompanyIDs, companyID) {
-				return nil, fmt.Errorf("provided company ID %s not in credentials", companyID)
+			// the credentials of a local server allow every company
+			if !util.SliceContains(info.CompanyIDs, companyID) && !util.SliceContains(info.CompanyIDs, "*") {
+				return fail(fmt.Errorf("provided company ID %s not in credentials", companyID))
 			}
 			newCompanyIDs = append(newCompanyIDs, companyID)
 		}
 		if len(newCompanyIDs) == 0 {
-			return nil, fmt.Errorf("no valid company IDs provided")
+			return fail(fmt.Errorf("no valid company IDs provided"))
 		}
 		info.CompanyIDs = newCompanyIDs
 		consumer.logger.Debug("using override company IDs: %v", newCompanyIDs)
@@ -754,34 +2090,47 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 		),
 	)
 	if err != nil {
-		nc.Close()
-		return nil, fmt.Errorf("error creating jetstream connection: %w", err)
+		return fail(fmt.Errorf("error creating jetstream connection: %w", err))
 	}
 
-	consumer.logger.Info("using info from credentials, server: %s companies: %s, session: %s", info.ServerID, info.CompanyIDs, info.SessionID)
+	consumer.logger.Info("using info from credentials, server: %s companies: %s, session: %s", info.ServerID, info.CompanyIDs, consumer.sessionID)
+	internal.SetMetricsInfo(consumer.sessionID, info.ServerID, info.CompanyIDs)
 
 	var suffix string
 	if config.Suffix != "" {
 		suffix = "-" + config.Suffix
 	}
 	name := fmt.Sprintf("eds-%s%s", info.ServerID, suffix)
-	var subjects []string
-	for _, companyID := range info.CompanyIDs {
-		subject := "dbchange.*.*." + companyID + ".*.PUBLIC.>"
-		subjects = append(subjects, subject)
+	consumer.name = name
+	consumer.companyIDs = info.CompanyIDs
+	consumer.filter = tableFilter{tables: config.Tables, only: config.OnlyTables, except: config.ExceptTables}
+	include, err := consumer.filter.include(consumer.knownTables(consumer.filter))
+	if err != nil {
+		return fail(err)
+	}
+	subjects := filterSubjects(info.CompanyIDs, include, config.LocationIDs)
+	if len(config.Tables) > 0 {
+		consumer.logger.Info("restricting to tables: %s", strings.Join(config.Tables, ", "))
+	}
+	if len(config.OnlyTables) > 0 || len(config.ExceptTables) > 0 {
+		consumer.logger.Info("filtering tables, only: %s, except: %s", strings.Join(config.OnlyTables, ", "), strings.Join(config.ExceptTables, ", "))
 	}
 
 	jsConfig := jetstream.ConsumerConfig{
 		Durable:           name,
 		MaxAckPending:     config.MaxAckPending,
-		MaxDeliver:        20,
-		AckWait:           time.Minute * 5,
+		MaxDeliver:        config.MaxDeliver,
+		AckWait:           config.AckWait,
+		BackOff:           config.RedeliveryBackoff,
 		MaxRequestBatch:   config.MaxPendingBuffer,
 		FilterSubjects:    subjects,
 		AckPolicy:         jetstream.AckExplicitPolicy,
 		InactiveThreshold: time.Hour * 24 * 3, // expire if unused 3 days from first creating
 		MaxWaiting:        1,                  // only 1 consumer allowed
 	}
+	if config.AckAll {
+		jsConfig.AckPolicy = jetstream.AckAllPolicy
+	}
 
 	// create a context with a longer deadline for creating the consumer
 	configConsumerCtx, cancelConfig := context.WithDeadline(config.Context, time.Now().Add(time.Minute*10))
@@ -791,14 +2140,16 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 	c, err := js.Consumer(configConsumerCtx, "dbchange", jsConfig.Durable)
 	if err != nil {
 		if !errors.Is(err, jetstream.ErrConsumerNotFound) {
-			nc.Close()
-			return nil, fmt.Errorf("error getting jetstream consumer: %w", err)
+			return fail(fmt.Errorf("error getting jetstream consumer: %w", err))
 		}
 		// consumer not found, create it
 
 		// only set the deliver policy if we are creating a new consumer, it will error if we try to update it
 		if config.DeliverAll {
 			jsConfig.DeliverPolicy = jetstream.DeliverAllPolicy
+		} else if config.startSequence > 0 {
+			jsConfig.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+			jsConfig.OptStartSeq = config.startSequence
 		} else if startAt != nil {
 			jsConfig.DeliverPolicy = jetstream.DeliverByStartTimePolicy
 			jsConfig.OptStartTime = startAt
@@ -809,50 +2160,140 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 
 		c, err = js.CreateConsumer(configConsumerCtx, "dbchange", jsConfig)
 		if err != nil {
-			nc.Close()
-			return nil, fmt.Errorf("error creating jetstream consumer: %w", err)
+			return fail(fmt.Errorf("error creating jetstream consumer: %w", err))
 		}
 	} else {
 		preUpdateInfo, err := c.Info(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("error getting consumer info: %w", err)
+			return fail(fmt.Errorf("error getting consumer info: %w", err))
 		}
 
-		jsConfig.DeliverPolicy = preUpdateInfo.Config.DeliverPolicy
-		jsConfig.OptStartTime = preUpdateInfo.Config.OptStartTime
-		jsConfig.MaxWaiting = preUpdateInfo.Config.MaxWaiting
-		consumer.logger.Debug("consumer found, setting delivery policy to %v and start time to %v", jsConfig.DeliverPolicy, jsConfig.OptStartTime)
-
-		// consumer found, update it
-		// TODO: we should check if the consumer is already in the correct state and skip this
-		c, err = js.UpdateConsumer(configConsumerCtx, "dbchange", jsConfig)
-		if err != nil {
-			nc.Close()
-			return nil, fmt.Errorf("error updating jetstream consumer: %w", err)
+		if err := checkStartPosition(preUpdateInfo, startAt); err != nil {
+			if !config.FixStartPosition {
+				return fail(fmt.Errorf("%w. to fix, restart with --fix-start-position to recreate the consumer %s from %s or run a new import", err, name, startAt.Format(time.RFC3339)))
+			}
+			if preUpdateInfo.NumWaiting > 0 {
+				return fail(ErrConsumerAlreadyRunning)
+			}
+			consumer.logger.Warn("%s, recreating consumer to start at %v", err, startAt)
+			if err := js.DeleteConsumer(configConsumerCtx, "dbchange", name); err != nil {
+				return fail(fmt.Errorf("error deleting jetstream consumer: %w", err))
+			}
+			jsConfig.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+			jsConfig.OptStartTime = startAt
+			c, err = js.CreateConsumer(configConsumerCtx, "dbchange", jsConfig)
+			if err != nil {
+				return fail(fmt.Errorf("error creating jetstream consumer: %w", err))
+			}
+		} else if preUpdateInfo.Config.AckPolicy != jsConfig.AckPolicy {
+			// the ack policy of a consumer can't be updated so it's recreated after the last acked message
+			if preUpdateInfo.NumWaiting > 0 {
+				return fail(ErrConsumerAlreadyRunning)
+			}
+			jsConfig.DeliverPolicy = preUpdateInfo.Config.DeliverPolicy
+			jsConfig.OptStartTime = preUpdateInfo.Config.OptStartTime
+			jsConfig.OptStartSeq = preUpdateInfo.Config.OptStartSeq
+			if preUpdateInfo.AckFloor.Stream > 0 {
+				jsConfig.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+				jsConfig.OptStartTime = nil
+				jsConfig.OptStartSeq = preUpdateInfo.AckFloor.Stream + 1
+			}
+			consumer.logger.Warn("changing the ack policy from %s to %s, recreating consumer %s to start after the last acked message (%d)", preUpdateInfo.Config.AckPolicy, jsConfig.AckPolicy, name, preUpdateInfo.AckFloor.Stream)
+			if err := js.DeleteConsumer(configConsumerCtx, "dbchange", name); err != nil {
+				return fail(fmt.Errorf("error deleting jetstream consumer: %w", err))
+			}
+			c, err = js.CreateConsumer(configConsumerCtx, "dbchange", jsConfig)
+			if err != nil {
+				return fail(fmt.Errorf("error creating jetstream consumer: %w", err))
+			}
+		} else {
+			jsConfig.DeliverPolicy = preUpdateInfo.Config.DeliverPolicy
+			jsConfig.OptStartTime = preUpdateInfo.Config.OptStartTime
+			jsConfig.OptStartSeq = preUpdateInfo.Config.OptStartSeq
+			jsConfig.MaxWaiting = preUpdateInfo.Config.MaxWaiting
+			consumer.logger.Debug("consumer found, setting delivery policy to %v and start time to %v", jsConfig.DeliverPolicy, jsConfig.OptStartTime)
+
+			// consumer found, update it
+			// TODO: we should check if the consumer is already in the correct state and skip this
+			c, err = js.UpdateConsumer(configConsumerCtx, "dbchange", jsConfig)
+			if err != nil {
+				return fail(fmt.Errorf("error updating jetstream consumer: %w", err))
+			}
 		}
 	}
 	cancelConfig()
 
 	ci, err := c.Info(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error getting consumer info: %w", err)
+		return fail(fmt.Errorf("error getting consumer info: %w", err))
 	}
 
 	if ci.NumWaiting > 0 {
-		return nil, ErrConsumerAlreadyRunning
+		return fail(ErrConsumerAlreadyRunning)
 	}
 
 	consumer.logger.Debug("number of waiting consumers: %d, number of messages pending: %d, consumer ack floor: %d, consumer seq: %d", ci.NumWaiting, ci.NumPending, ci.AckFloor.Consumer, ci.Delivered.Consumer)
 
 	consumer.sequence = ci.Delivered.Consumer
 	consumer.jsconn = c
+	consumer.js = js
 	consumer.disconnected = make(chan bool, 1)
+	consumer.reconnects = make(chan struct{}, 1)
+	consumer.reconnectTimeout = config.ReconnectTimeout
+	consumer.maxDeliver = config.MaxDeliver
+	consumer.redeliveryBackoff = config.RedeliveryBackoff
+	if config.AckAll {
+		consumer.acks = newAckFloor()
+	}
+
+	if config.JournalDir != "" {
+		if config.Pipelines > 1 {
+			return fail(fmt.Errorf("the journal can't be used with %d pipelines", config.Pipelines))
+		}
+		j, entries, err := openJournal(config.JournalDir, name)
+		if err != nil {
+			return fail(err)
+		}
+		consumer.reconcileJournal(entries, ci.AckFloor.Stream)
+		if err := j.reset(); err != nil {
+			j.close()
+			return fail(err)
+		}
+		consumer.journal = j
+	}
+
+	limit, err := newBufferLimit(config.MaxBufferedBytes, config.SpillDir, name, nc)
+	if err != nil {
+		if consumer.journal != nil {
+			consumer.journal.close()
+		}
+		return fail(err)
+	}
+	consumer.limit = limit
+	consumer.backpressure = consumer.backpressure.limitBytes(limit)
+
+	var route func(msg *parkedMessage) int
+	if consumer.router != nil {
+		route = func(msg *parkedMessage) int { return consumer.router.routeEvent(msg.Subject, msg.Data) }
+	}
+	parked, err := newCompanyPark(config.ParkDir, name, route)
+	if err != nil {
+		if consumer.journal != nil {
+			consumer.journal.close()
+		}
+		limit.close()
+		return fail(err)
+	}
+	consumer.parked = parked
+	for _, p := range consumer.pipelines {
+		p.parked = parked
+	}
 
-	connectedURL := nc.ConnectedUrlRedacted()
+	consumer.connectedURL = nc.ConnectedUrlRedacted()
 
 	nc.SetClosedHandler(func(nc *nats.Conn) {
 		if !consumer.isStopping() {
-			consumer.logger.Info("nats closed: %s", connectedURL)
+			consumer.logger.Info("nats closed: %s", consumer.connectedURL)
 			select {
 			case consumer.disconnected <- true:
 			default:
@@ -862,25 +2303,14 @@ func CreateConsumer(config ConsumerConfig) (*Consumer, error) {
 	})
 
 	nc.SetReconnectHandler(func(nc *nats.Conn) {
-		consumer.logger.Info("nats reconnect: %s", connectedURL)
+		consumer.logger.Info("nats reconnect: %s", nc.ConnectedUrlRedacted())
 	})
 
 	nc.SetDisconnectErrHandler(func(nc *nats.Conn, err error) {
-		if !consumer.isStopping() {
-			if err != nil {
-				consumer.logger.Error("nats disconnected: %s %s", connectedURL, err)
-			} else {
-				consumer.logger.Error("nats disconnected: %s", connectedURL)
-			}
-			select {
-			case consumer.disconnected <- true:
-			default:
-			}
-			consumer.Stop()
-		}
+		consumer.handleDisconnect(err)
 	})
 
-	consumer.logger.Info("nats connected: %s", connectedURL)
+	consumer.logger.Info("nats connected: %s", consumer.connectedURL)
 
 	return &consumer, nil
 }
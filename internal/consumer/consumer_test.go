@@ -2,9 +2,13 @@ package consumer
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -13,7 +17,10 @@ import (
 	natsserver "github.com/nats-io/nats-server/v2/test"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/errcode"
+	"github.com/shopmonkeyus/eds/internal/feature"
 	"github.com/shopmonkeyus/eds/internal/util"
 	"github.com/shopmonkeyus/go-common/logger"
 	"github.com/stretchr/testify/assert"
@@ -136,6 +143,155 @@ func TestSingleMessage(t *testing.T) {
 	})
 }
 
+func TestEncodedMessages(t *testing.T) {
+	sendEvent := internal.DBChangeEvent{
+		ID:        "1",
+		Table:     "order",
+		Operation: "INSERT",
+		Key:       []string{"CID", "o1"},
+		After:     json.RawMessage(`{"id":"o1","number":1}`),
+	}
+	gzipped := func(buf []byte) []byte {
+		var out bytes.Buffer
+		w := gzip.NewWriter(&out)
+		w.Write(buf)
+		w.Close()
+		return out.Bytes()
+	}
+	msgpacked := func(buf []byte) []byte {
+		var o any
+		assert.NoError(t, json.Unmarshal(buf, &o))
+		out, err := msgpack.Marshal(o)
+		assert.NoError(t, err)
+		return out
+	}
+	tests := []struct {
+		name     string
+		encoding string
+		encode   func(buf []byte) []byte
+	}{
+		{"json", "", func(buf []byte) []byte { return buf }},
+		{"gzip", "gzip/json", gzipped},
+		{"msgpack", "msgpack", msgpacked},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+				events := make(chan internal.DBChangeEvent, 1)
+				consumer, err := NewConsumer(ConsumerConfig{
+					Context: context.Background(),
+					Logger:  logger.NewTestLogger(),
+					Driver: &mockDriver{
+						process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+							events <- event
+							return false, nil
+						},
+					},
+					URL: natsurl,
+				})
+				assert.NoError(t, err)
+				defer consumer.Stop()
+
+				sendEvent.Timestamp = time.Now().UnixMilli()
+				msg := nats.NewMsg("dbchange.order.INSERT.CID.LID.PUBLIC.1")
+				msg.Data = test.encode([]byte(util.JSONStringify(sendEvent)))
+				if test.encoding != "" {
+					msg.Header.Set("content-encoding", test.encoding)
+				}
+				_, err = js.PublishMsg(context.Background(), msg)
+				assert.NoError(t, err)
+
+				select {
+				case event := <-events:
+					assert.Equal(t, sendEvent.ID, event.ID)
+					assert.Equal(t, sendEvent.Key, event.Key)
+					assert.Equal(t, sendEvent.Timestamp, event.Timestamp)
+					assert.JSONEq(t, string(sendEvent.After), string(event.After))
+				case <-time.After(5 * time.Second):
+					assert.Fail(t, "timed out waiting for the event")
+				}
+			})
+		})
+	}
+}
+
+func TestInvalidEncodedMessage(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  &mockDriver{},
+			URL:     natsurl,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		msg := nats.NewMsg("dbchange.order.INSERT.CID.LID.PUBLIC.1")
+		msg.Data = []byte(`{"id":"1"}`)
+		msg.Header.Set("content-encoding", "gzip/json")
+		_, err = js.PublishMsg(context.Background(), msg)
+		assert.NoError(t, err)
+
+		select {
+		case err := <-consumer.Error():
+			assert.Equal(t, errcode.InvalidEvent, errcode.Of(err))
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timed out waiting for the error")
+		}
+	})
+}
+
+func TestTables(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var tables []string
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				tables = append(tables, event.Table)
+				return false, nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  mockDriver,
+			URL:     natsurl,
+			Tables:  []string{"order"},
+		})
+		assert.NoError(t, err)
+
+		publish := func(table string) {
+			var sendEvent internal.DBChangeEvent
+			sendEvent.Table = table
+			sendEvent.Operation = "INSERT"
+			sendEvent.Timestamp = time.Now().UnixMilli()
+			sendEvent.MVCCTimestamp = fmt.Sprintf("%v", time.Now().UnixNano())
+			_, err := js.Publish(context.Background(), "dbchange."+table+".INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+
+		publish("customer")
+		publish("order")
+		time.Sleep(time.Millisecond * 100)
+		assert.Equal(t, []string{"order"}, tables)
+
+		assert.NoError(t, consumer.SetTables([]string{"customer"}))
+		publish("order")
+		publish("customer")
+		time.Sleep(time.Millisecond * 100)
+		assert.Equal(t, []string{"order", "customer"}, tables)
+
+		assert.NoError(t, consumer.Stop())
+	})
+}
+
+func TestFilterSubjects(t *testing.T) {
+	assert.Equal(t, []string{"dbchange.*.*.1.*.PUBLIC.>", "dbchange.*.*.2.*.PUBLIC.>"}, filterSubjects([]string{"1", "2"}, nil, nil))
+	assert.Equal(t, []string{"dbchange.order.*.1.*.PUBLIC.>", "dbchange.customer.*.1.*.PUBLIC.>"}, filterSubjects([]string{"1"}, []string{"order", "customer"}, nil))
+	assert.Equal(t, []string{"dbchange.order.*.1.NONE.PUBLIC.>", "dbchange.order.*.1.L1.PUBLIC.>"}, filterSubjects([]string{"1"}, []string{"order"}, []string{"L1"}))
+}
+
 func TestSingleMessageWithFlush(t *testing.T) {
 	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
 
@@ -419,6 +575,30 @@ func TestHeartbeats(t *testing.T) {
 	})
 }
 
+func TestHeartbeatFallback(t *testing.T) {
+	var fallbacks [][]byte
+	var fallbackErr error
+	c := &Consumer{
+		logger: logger.NewTestLogger(),
+		heartbeatFallback: func(hb []byte, err error) {
+			fallbacks = append(fallbacks, hb)
+			fallbackErr = err
+		},
+	}
+	hb := &heartbeat{SessionId: "1234"}
+	for i := 0; i < maxHeartbeatFailures-1; i++ {
+		c.heartbeatFailed(hb, nats.ErrTimeout)
+	}
+	assert.Empty(t, fallbacks)
+	c.heartbeatFailed(hb, nats.ErrTimeout)
+	c.heartbeatFailed(hb, nats.ErrTimeout)
+	assert.Len(t, fallbacks, 2)
+	assert.ErrorIs(t, fallbackErr, nats.ErrTimeout)
+	var payload heartbeat
+	assert.NoError(t, json.Unmarshal(fallbacks[0], &payload))
+	assert.Equal(t, "1234", payload.SessionId)
+}
+
 func TestMultipleMessagesWithMultipleBatches(t *testing.T) {
 	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
 
@@ -524,6 +704,78 @@ func TestMultipleMessagesWithIdleDelayFlush(t *testing.T) {
 	})
 }
 
+func TestFlushSchedulerLatencies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   time.Duration // the latency the pending message should be flushed at
+	}{
+		{"min pending latency", FlushPolicyBalanced, time.Millisecond * 200},
+		{"max pending latency", FlushPolicyCost, time.Millisecond * 600},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+				var lock sync.Mutex
+				var received, flushed time.Time
+
+				mockDriver := &mockDriver{
+					maxBatchSize: -1,
+					process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+						lock.Lock()
+						received = time.Now()
+						lock.Unlock()
+						return false, nil
+					},
+					flush: func(logger logger.Logger) error {
+						lock.Lock()
+						flushed = time.Now()
+						lock.Unlock()
+						return nil
+					},
+				}
+
+				policy, err := NewFlushPolicy(test.policy)
+				assert.NoError(t, err)
+				consumer, err := NewConsumer(ConsumerConfig{
+					Context:           context.Background(),
+					Logger:            logger.NewTestLogger(),
+					Driver:            mockDriver,
+					URL:               natsurl,
+					MinPendingLatency: time.Millisecond * 200,
+					MaxPendingLatency: time.Millisecond * 600,
+					FlushPolicy:       policy,
+				})
+				assert.NoError(t, err)
+
+				var sendEvent internal.DBChangeEvent
+				sendEvent.Table = "order"
+				sendEvent.Operation = "INSERT"
+				sendEvent.Key = []string{"1"}
+				sendEvent.Timestamp = time.Now().UnixMilli()
+				_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+				assert.NoError(t, err)
+
+				assert.Eventually(t, func() bool {
+					lock.Lock()
+					defer lock.Unlock()
+					return !flushed.IsZero()
+				}, time.Second*2, time.Millisecond*10)
+
+				lock.Lock()
+				latency := flushed.Sub(received)
+				lock.Unlock()
+				assert.GreaterOrEqual(t, latency, test.want)
+				assert.Less(t, latency, test.want+time.Millisecond*150)
+
+				assert.NoError(t, consumer.Stop())
+				// nothing is pending after the flush so the bufferer waits for the next message
+				assert.Less(t, consumer.nextWake(), time.Duration(0))
+			})
+		})
+	}
+}
+
 func TestPause(t *testing.T) {
 	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
 		var testEvent *internal.DBChangeEvent
@@ -581,6 +833,7 @@ func TestPause(t *testing.T) {
 }
 
 func TestTableSkipOldEvents(t *testing.T) {
+	internal.MetricsReset()
 	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
 		var testEvent *internal.DBChangeEvent
 		var flushed bool
@@ -622,6 +875,7 @@ func TestTableSkipOldEvents(t *testing.T) {
 
 		assert.Nil(t, testEvent)
 		assert.False(t, flushed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.SkippedEvents.WithLabelValues("order", internal.SkipReasonExportTimestamp)))
 
 		time.Sleep(time.Millisecond * 100)
 		sendEvent.Timestamp = time.Now().UnixMilli()
@@ -804,6 +1058,7 @@ func TestTableSchemaMigrationNewTable(t *testing.T) {
 	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
 		var testEvent *internal.DBChangeEvent
 		var migrateTable *internal.Schema
+		var newTables []string
 
 		mockDriver := &mockDriverWithMigration{
 			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
@@ -831,6 +1086,9 @@ func TestTableSchemaMigrationNewTable(t *testing.T) {
 			Driver:   mockDriver,
 			URL:      natsurl,
 			Registry: mockRegistry,
+			OnNewTable: func(table string) {
+				newTables = append(newTables, table)
+			},
 		})
 
 		assert.NoError(t, err)
@@ -849,11 +1107,155 @@ func TestTableSchemaMigrationNewTable(t *testing.T) {
 
 		assert.NotNil(t, testEvent)
 		assert.NotNil(t, migrateTable)
+		assert.Equal(t, []string{"order"}, newTables)
 
 		assert.NoError(t, consumer.Stop())
 	})
 }
 
+func TestPremigrate(t *testing.T) {
+	versions := map[string]string{"customer": "1", "order": "1"}
+	latest := internal.SchemaMap{
+		"customer": {Table: "customer", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}},
+		"order":    {Table: "order", ModelVersion: "2", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "total": {Type: "number"}}},
+		"invoice":  {Table: "invoice", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}},
+		"vehicle":  {Table: "vehicle", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}},
+	}
+	var newTables []string
+	var columns []string
+	driver := &mockDriverWithMigration{
+		migrateTable: func(ctx context.Context, logger logger.Logger, schema *internal.Schema) error {
+			newTables = append(newTables, schema.Table)
+			return nil
+		},
+		migrateColumns: func(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns_ []string) error {
+			columns = append(columns, columns_...)
+			return nil
+		},
+	}
+	registry := &mockRegistry{
+		latestSchema: latest,
+		getSchema: func(table string, version string) (*internal.Schema, error) {
+			if table == "order" && version == "1" {
+				return &internal.Schema{Table: "order", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}}, nil
+			}
+			return latest[table], nil
+		},
+		getTableVersion: func(table string) (bool, string, error) {
+			version, ok := versions[table]
+			return ok, version, nil
+		},
+		setTableVersion: func(table string, version string) error {
+			versions[table] = version
+			return nil
+		},
+	}
+	c := &Consumer{
+		ctx:               context.Background(),
+		logger:            logger.NewTestLogger(),
+		driver:            driver,
+		registry:          registry,
+		supportsMigration: true,
+		filter:            tableFilter{tables: []string{"customer", "order", "invoice"}},
+	}
+	assert.NoError(t, c.premigrate())
+	assert.Equal(t, []string{"invoice"}, newTables)
+	assert.Equal(t, []string{"total"}, columns)
+	assert.Equal(t, map[string]string{"customer": "1", "order": "2", "invoice": "1"}, versions)
+
+	// nothing to do the second time
+	newTables = nil
+	columns = nil
+	assert.NoError(t, c.premigrate())
+	assert.Empty(t, newTables)
+	assert.Empty(t, columns)
+}
+
+type mockRefreshRegistry struct {
+	mockRegistry
+	refreshed internal.SchemaMap
+}
+
+func (r *mockRefreshRegistry) RefreshLatestSchema() (internal.SchemaMap, error) {
+	r.latestSchema = r.refreshed
+	return r.latestSchema, nil
+}
+
+func TestRefreshSchema(t *testing.T) {
+	versions := map[string]string{"customer": "1", "order": "1"}
+	schemas := map[string]*internal.Schema{
+		"customer-1": {Table: "customer", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}},
+		"customer-2": {Table: "customer", ModelVersion: "2", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "email": {Type: "string"}}},
+		"order-1":    {Table: "order", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}},
+		"order-2":    {Table: "order", ModelVersion: "2", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "total": {Type: "number"}}},
+	}
+	var columns []string
+	driver := &mockDriverWithMigration{
+		migrateColumns: func(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns_ []string) error {
+			columns = append(columns, columns_...)
+			return nil
+		},
+	}
+	registry := &mockRefreshRegistry{
+		mockRegistry: mockRegistry{
+			latestSchema: internal.SchemaMap{"customer": schemas["customer-1"], "order": schemas["order-1"]},
+			getSchema: func(table string, version string) (*internal.Schema, error) {
+				return schemas[table+"-"+version], nil
+			},
+			getTableVersion: func(table string) (bool, string, error) {
+				version, ok := versions[table]
+				return ok, version, nil
+			},
+			setTableVersion: func(table string, version string) error {
+				versions[table] = version
+				return nil
+			},
+		},
+		refreshed: internal.SchemaMap{"customer": schemas["customer-2"], "order": schemas["order-2"]},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Consumer{
+		ctx:               ctx,
+		logger:            logger.NewTestLogger(),
+		driver:            driver,
+		registry:          registry,
+		supportsMigration: true,
+		refreshes:         make(chan schemaRefresh),
+	}
+	// the refresh requests are handled by the bufferer
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case req := <-c.refreshes:
+				c.refreshSchema(req)
+			}
+		}
+	}()
+
+	migrated, err := c.RefreshSchema([]string{"order"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"order"}, migrated)
+	assert.Equal(t, []string{"total"}, columns)
+	assert.Equal(t, map[string]string{"customer": "1", "order": "2"}, versions)
+
+	columns = nil
+	migrated, err = c.RefreshSchema(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"customer"}, migrated)
+	assert.Equal(t, []string{"email"}, columns)
+	assert.Equal(t, map[string]string{"customer": "2", "order": "2"}, versions)
+
+	_, err = c.RefreshSchema([]string{"invoice"})
+	assert.ErrorContains(t, err, "table not found in latest schema: invoice")
+
+	c.supportsMigration = false
+	_, err = c.RefreshSchema(nil)
+	assert.ErrorContains(t, err, "driver doesn't support migrations")
+}
+
 func TestTableSchemaMigrationNewColumns(t *testing.T) {
 	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
 		var testEvent *internal.DBChangeEvent
@@ -1016,6 +1418,79 @@ func TestTableSchemaMigrationNoNewColumns(t *testing.T) {
 	})
 }
 
+func TestTableSchemaMigrationOlderVersion(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var testEvent *internal.DBChangeEvent
+		var migrated, versionChanged bool
+
+		mockDriver := &mockDriverWithMigration{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				testEvent = &event
+				return false, nil
+			},
+			migrateTable: func(ctx context.Context, logger logger.Logger, schema *internal.Schema) error {
+				migrated = true
+				return nil
+			},
+			migrateColumns: func(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns_ []string) error {
+				migrated = true
+				return nil
+			},
+		}
+
+		v1, v2 := versionSchemas()
+
+		mockRegistry := &mockRegistry{
+			latestSchema: internal.SchemaMap{"order": v2},
+			getSchema: func(table string, version string) (*internal.Schema, error) {
+				if version == "1" {
+					return v1, nil
+				}
+				return v2, nil
+			},
+			getTableVersion: func(table string) (bool, string, error) {
+				return true, "2", nil
+			},
+			setTableVersion: func(table string, version string) error {
+				versionChanged = true
+				return nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:  context.Background(),
+			Logger:   logger.NewTestLogger(),
+			Driver:   mockDriver,
+			URL:      natsurl,
+			Registry: mockRegistry,
+		})
+
+		assert.NoError(t, err)
+
+		var sendEvent internal.DBChangeEvent
+		sendEvent.Table = "order"
+		sendEvent.Operation = "INSERT"
+		sendEvent.Timestamp = time.Now().UnixMilli()
+		sendEvent.MVCCTimestamp = fmt.Sprintf("%v", time.Now().UnixNano())
+		sendEvent.ModelVersion = "1"
+		sendEvent.After = json.RawMessage(`{"id":"123","name":"foo","legacy":"bar"}`)
+
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+		assert.NoError(t, err)
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NotNil(t, testEvent)
+		assert.Equal(t, "2", testEvent.ModelVersion)
+		assert.NotContains(t, string(testEvent.After), "legacy")
+		assert.NotContains(t, string(testEvent.After), "total", "the new column is left to the destination")
+		assert.False(t, migrated)
+		assert.False(t, versionChanged)
+
+		assert.NoError(t, consumer.Stop())
+	})
+}
+
 func TestTableSchemaMismatch(t *testing.T) {
 	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
 
@@ -1112,3 +1587,611 @@ func TestDisconnectedHandler(t *testing.T) {
 		assert.True(t, closed)
 	})
 }
+
+func TestOrderingEnforceResequencesOlderVersions(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		internal.MetricsReset()
+		var lock sync.Mutex
+		var testEvents []internal.DBChangeEvent
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				testEvents = append(testEvents, event)
+				return false, nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:           context.Background(),
+			Logger:            logger.NewTestLogger(),
+			Driver:            mockDriver,
+			URL:               natsurl,
+			OrderingMode:      OrderingModeEnforce,
+			MinPendingLatency: 100 * time.Millisecond,
+			MaxPendingLatency: time.Second,
+		})
+
+		assert.NoError(t, err)
+
+		tv := time.Now()
+
+		var sendEvent internal.DBChangeEvent
+		sendEvent.Table = "order"
+		sendEvent.Operation = "UPDATE"
+		sendEvent.Key = []string{"1"}
+		sendEvent.Timestamp = tv.UnixMilli()
+		sendEvent.MVCCTimestamp = fmt.Sprintf("%v.0000000001", tv.UnixNano())
+
+		_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+		assert.NoError(t, err)
+
+		// older version of the same record delivered after the newer one in the same batch is resequenced
+		sendEvent.MVCCTimestamp = fmt.Sprintf("%v.0000000000", tv.UnixNano())
+		_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+		assert.NoError(t, err)
+
+		// different record with an older version is fine
+		sendEvent.Key = []string{"2"}
+		_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.2", []byte(util.JSONStringify(sendEvent)))
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(testEvents) == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, "1", testEvents[0].GetPrimaryKey())
+		assert.Equal(t, fmt.Sprintf("%v.0000000000", tv.UnixNano()), testEvents[0].MVCCTimestamp)
+		assert.Equal(t, "1", testEvents[1].GetPrimaryKey())
+		assert.Equal(t, fmt.Sprintf("%v.0000000001", tv.UnixNano()), testEvents[1].MVCCTimestamp)
+		assert.Equal(t, "2", testEvents[2].GetPrimaryKey())
+		lock.Unlock()
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.OrderingViolations.WithLabelValues("order")))
+
+		// an older version delivered after the newer one was flushed can't be resequenced so it's dropped
+		sendEvent.Key = []string{"1"}
+		_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(internal.SkippedEvents.WithLabelValues("order", internal.SkipReasonOutOfOrder)) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.NoError(t, consumer.Stop())
+		lock.Lock()
+		assert.Len(t, testEvents, 3)
+		lock.Unlock()
+	})
+}
+
+func TestDedupeFeature(t *testing.T) {
+	feature.Set(map[string]bool{feature.Dedupe: true})
+	defer feature.Set(nil)
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var testEvents []internal.DBChangeEvent
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				testEvents = append(testEvents, event)
+				return false, nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  mockDriver,
+			URL:     natsurl,
+		})
+
+		assert.NoError(t, err)
+
+		var sendEvent internal.DBChangeEvent
+		sendEvent.ID = "1"
+		sendEvent.Table = "order"
+		sendEvent.Operation = "UPDATE"
+		sendEvent.Key = []string{"1"}
+		sendEvent.Timestamp = time.Now().UnixMilli()
+
+		// the same event published twice with different message ids so jetstream doesn't dedupe it
+		_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)), jetstream.WithMsgID("a"))
+		assert.NoError(t, err)
+		_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)), jetstream.WithMsgID("b"))
+		assert.NoError(t, err)
+
+		sendEvent.ID = "2"
+		_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)), jetstream.WithMsgID("c"))
+		assert.NoError(t, err)
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NoError(t, consumer.Stop())
+		assert.Len(t, testEvents, 2)
+		assert.Equal(t, "1", testEvents[0].ID)
+		assert.Equal(t, "2", testEvents[1].ID)
+	})
+}
+
+func TestLineageFeature(t *testing.T) {
+	feature.Set(map[string]bool{feature.Lineage: true})
+	defer feature.Set(nil)
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var testEvents []internal.DBChangeEvent
+
+		mockDriver := &mockDriver{
+			maxBatchSize: 2,
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				testEvents = append(testEvents, event)
+				return false, nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  mockDriver,
+			URL:     natsurl,
+			Version: "1.2.3",
+		})
+		assert.NoError(t, err)
+
+		for i := 1; i <= 3; i++ {
+			var sendEvent internal.DBChangeEvent
+			sendEvent.ID = fmt.Sprintf("%d", i)
+			sendEvent.Table = "order"
+			sendEvent.Operation = "UPDATE"
+			sendEvent.Key = []string{sendEvent.ID}
+			sendEvent.Timestamp = time.Now().UnixMilli()
+			_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC."+sendEvent.ID, []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NoError(t, consumer.Stop())
+		assert.Len(t, testEvents, 3)
+		for i, event := range testEvents {
+			assert.NotNil(t, event.Lineage)
+			assert.Equal(t, uint64(i+1), event.Lineage.StreamSequence)
+			assert.True(t, strings.HasPrefix(event.Lineage.Consumer, "eds-"))
+			assert.Equal(t, "1.2.3", event.Lineage.Version)
+			assert.Equal(t, fmt.Sprintf("%d", i+1), event.Lineage.Headers()["eds-stream-sequence"])
+		}
+		// the first two events are flushed together
+		assert.Equal(t, testEvents[0].Lineage.BatchID, testEvents[1].Lineage.BatchID)
+		assert.NotEqual(t, testEvents[1].Lineage.BatchID, testEvents[2].Lineage.BatchID)
+	})
+}
+
+func TestFlushGroups(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var batch []string
+		var batches [][]string
+
+		mockDriver := &mockDriver{
+			maxBatchSize: 4,
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				batch = append(batch, event.ID)
+				return false, nil
+			},
+			flush: func(logger logger.Logger) error {
+				batches = append(batches, batch)
+				batch = nil
+				return nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:     context.Background(),
+			Logger:      logger.NewTestLogger(),
+			Driver:      mockDriver,
+			URL:         natsurl,
+			FlushGroups: [][]string{{"order", "orderLineItem"}},
+		})
+
+		assert.NoError(t, err)
+
+		publish := func(id string, table string, txn string) {
+			var sendEvent internal.DBChangeEvent
+			sendEvent.ID = id
+			sendEvent.Table = table
+			sendEvent.Operation = "INSERT"
+			sendEvent.Key = []string{id}
+			sendEvent.Timestamp = time.Now().UnixMilli()
+			sendEvent.MVCCTimestamp = txn
+			_, err := js.Publish(context.Background(), "dbchange."+table+".INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+
+		// the line items of the transaction arrive before and after their order
+		publish("customer1", "customer", "1")
+		publish("item1", "orderLineItem", "2")
+		publish("order1", "order", "2")
+		publish("item2", "orderLineItem", "2")
+		publish("customer2", "customer", "3")
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NoError(t, consumer.Stop())
+		assert.Equal(t, [][]string{{"customer1", "order1", "item1", "item2"}, {"customer2"}}, batches)
+	})
+}
+
+type mockBatchDriver struct {
+	mockDriver
+	processBatch func(logger logger.Logger, events []internal.DBChangeEvent) error
+}
+
+func (m *mockBatchDriver) ProcessBatch(logger logger.Logger, events []internal.DBChangeEvent) error {
+	return m.processBatch(logger, events)
+}
+
+func TestProcessBatch(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var processed int
+		var batches [][]string
+		var flushes int
+
+		mockDriver := &mockBatchDriver{
+			mockDriver: mockDriver{
+				maxBatchSize: 2,
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					processed++
+					return false, nil
+				},
+				flush: func(logger logger.Logger) error {
+					flushes++
+					return nil
+				},
+			},
+			processBatch: func(logger logger.Logger, events []internal.DBChangeEvent) error {
+				var ids []string
+				for _, event := range events {
+					ids = append(ids, event.ID)
+				}
+				batches = append(batches, ids)
+				return nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  mockDriver,
+			URL:     natsurl,
+		})
+
+		assert.NoError(t, err)
+
+		for _, id := range []string{"1", "2", "3"} {
+			var sendEvent internal.DBChangeEvent
+			sendEvent.ID = id
+			sendEvent.Table = "order"
+			sendEvent.Operation = "UPDATE"
+			sendEvent.Key = []string{id}
+			sendEvent.Timestamp = time.Now().UnixMilli()
+			_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NoError(t, consumer.Stop())
+		assert.Equal(t, 0, processed)
+		assert.Equal(t, [][]string{{"1", "2"}, {"3"}}, batches)
+		assert.GreaterOrEqual(t, flushes, 2)
+	})
+}
+
+func TestRetryQueueReplay(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		dir := t.TempDir()
+		failingDriver := &mockDriver{
+			flush: func(logger logger.Logger) error {
+				return internal.NewRetryableError(fmt.Errorf("connection lost"))
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:  context.Background(),
+			Logger:   logger.NewTestLogger(),
+			Driver:   failingDriver,
+			URL:      natsurl,
+			RetryDir: dir,
+		})
+		assert.NoError(t, err)
+
+		for _, id := range []string{"1", "2"} {
+			var sendEvent internal.DBChangeEvent
+			sendEvent.ID = id
+			sendEvent.Table = "order"
+			sendEvent.Operation = "UPDATE"
+			sendEvent.Key = []string{id}
+			sendEvent.Timestamp = time.Now().UnixMilli()
+			_, err = js.Publish(context.Background(), "dbchange.order.UPDATE.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+
+		select {
+		case err := <-consumer.Error():
+			assert.ErrorContains(t, err, "connection lost")
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timed out waiting for the flush error")
+		}
+		assert.NoError(t, consumer.Stop())
+
+		queue, err := newRetryQueue(dir, DefaultRetryMaxAttempts)
+		assert.NoError(t, err)
+		entries, err := queue.list()
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		var queued int
+		for _, entry := range entries {
+			queued += len(entry.Messages)
+			// don't wait for the backoff
+			entry.NextAttempt = time.Now()
+			assert.NoError(t, queue.save(entry))
+		}
+		assert.Greater(t, queued, 0)
+
+		var replayed []string
+		var flushed bool
+		workingDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				if !flushed {
+					replayed = append(replayed, event.ID)
+				}
+				return false, nil
+			},
+			flush: func(logger logger.Logger) error {
+				flushed = true
+				return nil
+			},
+		}
+		consumer, err = NewConsumer(ConsumerConfig{
+			Context:  context.Background(),
+			Logger:   logger.NewTestLogger(),
+			Driver:   workingDriver,
+			URL:      natsurl,
+			RetryDir: dir,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, consumer.Stop())
+		assert.Len(t, replayed, queued)
+		assert.Equal(t, "1", replayed[0])
+		entries, err = queue.list()
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestMaxEventSize(t *testing.T) {
+	internal.MetricsReset()
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var testEvents []internal.DBChangeEvent
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				testEvents = append(testEvents, event)
+				return false, nil
+			},
+		}
+
+		dir := t.TempDir()
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:       context.Background(),
+			Logger:        logger.NewTestLogger(),
+			Driver:        mockDriver,
+			URL:           natsurl,
+			QuarantineDir: dir,
+			MaxEventSize:  1024,
+		})
+
+		assert.NoError(t, err)
+
+		var sendEvent internal.DBChangeEvent
+		sendEvent.ID = "small"
+		sendEvent.Table = "order"
+		sendEvent.Operation = "INSERT"
+		sendEvent.Timestamp = time.Now().UnixMilli()
+		sendEvent.MVCCTimestamp = fmt.Sprintf("%v", time.Now().UnixNano())
+		sendEvent.After = json.RawMessage(`{"id":"small"}`)
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+		assert.NoError(t, err)
+
+		sendEvent.ID = "large"
+		sendEvent.After = json.RawMessage(`{"id":"large","note":"` + strings.Repeat("x", 2048) + `"}`)
+		ack, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.2", []byte(util.JSONStringify(sendEvent)))
+		assert.NoError(t, err)
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NoError(t, consumer.Stop())
+		assert.Len(t, testEvents, 1)
+		assert.Equal(t, "small", testEvents[0].ID)
+		assert.True(t, util.Exists(filepath.Join(dir, "order", fmt.Sprintf("%d_oversized.json", ack.Sequence))))
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.SkippedEvents.WithLabelValues("order", internal.SkipReasonOversized)))
+	})
+}
+
+func TestValidationRuleActions(t *testing.T) {
+	internal.MetricsReset()
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var testEvents []internal.DBChangeEvent
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				testEvents = append(testEvents, event)
+				return false, nil
+			},
+		}
+
+		validator := &mockValidator{
+			validator: func(event internal.DBChangeEvent) (bool, bool, string, error) {
+				switch event.ID {
+				case "quarantine":
+					return true, false, "", errors.Join(util.ErrSchemaValidation, &internal.ValidationRuleError{Table: event.Table, Rule: "range", Action: internal.ValidationActionQuarantine, Message: "out of range"})
+				case "alert":
+					return true, true, "", &internal.ValidationRuleError{Table: event.Table, Rule: "reference", Action: internal.ValidationActionAlert, Message: "unknown"}
+				case "skip":
+					return true, false, "", errors.Join(util.ErrSchemaValidation, &internal.ValidationRuleError{Table: event.Table, Rule: "required", Action: internal.ValidationActionSkip, Message: "missing"})
+				}
+				return true, true, "", nil
+			},
+		}
+
+		dir := t.TempDir()
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:         context.Background(),
+			Logger:          logger.NewTestLogger(),
+			Driver:          mockDriver,
+			URL:             natsurl,
+			SchemaValidator: validator,
+			QuarantineDir:   dir,
+		})
+
+		assert.NoError(t, err)
+
+		var sendEvent internal.DBChangeEvent
+		sendEvent.Table = "order"
+		sendEvent.Operation = "INSERT"
+		sendEvent.Timestamp = time.Now().UnixMilli()
+		sendEvent.MVCCTimestamp = fmt.Sprintf("%v", time.Now().UnixNano())
+
+		for _, id := range []string{"quarantine", "alert", "skip"} {
+			sendEvent.ID = id
+			_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC."+id, []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NoError(t, consumer.Stop())
+		assert.Len(t, testEvents, 1)
+		assert.Equal(t, "alert", testEvents[0].ID)
+		assert.True(t, util.Exists(filepath.Join(dir, "order", sendEvent.MVCCTimestamp+"_quarantine.json")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.SkippedEvents.WithLabelValues("order", internal.SkipReasonQuarantined)))
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.SkippedEvents.WithLabelValues("order", internal.SkipReasonValidationRule)))
+	})
+}
+
+func TestPauseCompany(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var testEvents []internal.DBChangeEvent
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				testEvents = append(testEvents, event)
+				return false, nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  mockDriver,
+			URL:     natsurl,
+		})
+
+		assert.NoError(t, err)
+
+		consumer.PauseCompany("A")
+		assert.Equal(t, []string{"A"}, consumer.PausedCompanies())
+
+		var sendEvent internal.DBChangeEvent
+		sendEvent.Table = "order"
+		sendEvent.Operation = "INSERT"
+		sendEvent.Timestamp = time.Now().UnixMilli()
+		sendEvent.MVCCTimestamp = fmt.Sprintf("%v", time.Now().UnixNano())
+
+		for _, companyID := range []string{"A", "B"} {
+			cid := companyID
+			sendEvent.CompanyID = &cid
+			_, err = js.Publish(context.Background(), "dbchange.order.INSERT."+companyID+".LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.NoError(t, consumer.Stop())
+		assert.Len(t, testEvents, 1)
+		assert.Equal(t, "B", *testEvents[0].CompanyID)
+	})
+}
+
+func TestStartPositionAfterImport(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  &mockDriver{},
+			URL:     natsurl,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, consumer.Stop())
+
+		// an import which finished before the consumer was created with deliver new
+		importedAt := time.Now().Add(-time.Hour)
+		timestamps := map[string]*time.Time{"order": &importedAt}
+
+		_, err = NewConsumer(ConsumerConfig{
+			Context:               context.Background(),
+			Logger:                logger.NewTestLogger(),
+			Driver:                &mockDriver{},
+			URL:                   natsurl,
+			ExportTableTimestamps: timestamps,
+		})
+		assert.ErrorIs(t, err, ErrConsumerMissedHistory)
+		assert.Contains(t, err.Error(), "--fix-start-position")
+
+		consumer, err = NewConsumer(ConsumerConfig{
+			Context:               context.Background(),
+			Logger:                logger.NewTestLogger(),
+			Driver:                &mockDriver{},
+			URL:                   natsurl,
+			ExportTableTimestamps: timestamps,
+			FixStartPosition:      true,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, consumer.Stop())
+
+		stream, err := js.Stream(context.Background(), "dbchange")
+		assert.NoError(t, err)
+		names := stream.ConsumerNames(context.Background())
+		name := <-names.Name()
+		c, err := js.Consumer(context.Background(), "dbchange", name)
+		assert.NoError(t, err)
+		info, err := c.Info(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, jetstream.DeliverByStartTimePolicy, info.Config.DeliverPolicy)
+		assert.True(t, info.Config.OptStartTime.Equal(importedAt))
+
+		// once fixed the consumer can be started again without the flag
+		consumer, err = NewConsumer(ConsumerConfig{
+			Context:               context.Background(),
+			Logger:                logger.NewTestLogger(),
+			Driver:                &mockDriver{},
+			URL:                   natsurl,
+			ExportTableTimestamps: timestamps,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, consumer.Stop())
+	})
+}
+
+func TestErrorCodes(t *testing.T) {
+	assert.Equal(t, errcode.DestinationUnavailable, errcode.Of(destinationError(internal.NewRetryableError(errors.New("timeout")))))
+	assert.Equal(t, errcode.DestinationWrite, errcode.Of(destinationError(errors.New("permission denied"))))
+	assert.NoError(t, destinationError(nil))
+
+	var c Consumer
+	c.recordError(errcode.Errorf(errcode.SequenceGap, "out of order sequence: 3, expected: 2"))
+	assert.Equal(t, errcode.SequenceGap, c.lastError.Code)
+	pipeline := Consumer{parent: &c}
+	pipeline.recordError(errors.New("boom"))
+	assert.Equal(t, errcode.Unknown, c.lastError.Code)
+}
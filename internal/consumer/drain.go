@@ -0,0 +1,94 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errStillBuffered is returned to a drain request while messages are waiting to be processed.
+var errStillBuffered = errors.New("messages are still buffered")
+
+// Drain stops pulling new messages, processes the messages which were already pulled and flushes all the pending
+// events through the driver so they're acked, unlike Stop which nacks them. It returns once nothing is pending or with
+// an error when the context is done first. The consumer stays paused afterwards until Unpause is called.
+func (c *Consumer) Drain(ctx context.Context) error {
+	started := time.Now()
+	c.logger.Info("draining")
+	c.subscriberLock.Lock()
+	sub := c.subscriber
+	if sub != nil {
+		sub.Drain()
+		c.subscriber = nil
+	}
+	if c.pauseStarted == nil {
+		c.pauseStarted = &started
+	}
+	c.subscriberLock.Unlock()
+	if sub != nil {
+		// the messages which were already pulled are still handed to the consumer until the subscription is closed
+		select {
+		case <-sub.Closed():
+		case <-ctx.Done():
+			return fmt.Errorf("error draining: %w", ctx.Err())
+		}
+	}
+	if err := c.drainPending(ctx); err != nil {
+		return err
+	}
+	// the pipelines are drained after the consumer so they have every message it dispatched
+	for i, p := range c.pipelines {
+		if err := p.drainPending(ctx); err != nil {
+			return fmt.Errorf("pipeline %d: %w", i, err)
+		}
+	}
+	// the acks are published asynchronously so make sure the server has them before returning
+	if err := c.conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("error flushing acks: %w", err)
+	}
+	c.logger.Info("drained in %v", time.Since(started))
+	return nil
+}
+
+// drainPending asks the bufferer to flush the pending events until none of the messages are still buffered.
+func (c *Consumer) drainPending(ctx context.Context) error {
+	for {
+		result := make(chan error, 1)
+		select {
+		case c.drains <- result:
+		case <-ctx.Done():
+			return fmt.Errorf("error draining: %w", ctx.Err())
+		case <-c.ctx.Done():
+			return fmt.Errorf("error draining: consumer stopped")
+		}
+		err := <-result
+		if !errors.Is(err, errStillBuffered) {
+			return err
+		}
+		select {
+		case <-time.After(c.emptyBufferPauseTime):
+		case <-ctx.Done():
+			return fmt.Errorf("error draining with %d messages still buffered: %w", len(c.buffer), ctx.Err())
+		}
+	}
+}
+
+// flushDrained flushes the pending events for a drain request once the buffered messages have been processed. It
+// returns true if the bufferer should stop.
+func (c *Consumer) flushDrained(result chan error) bool {
+	if len(c.buffer) > 0 {
+		result <- errStillBuffered
+		return false
+	}
+	if c.groups != nil && c.groups.Len() > 0 && c.releaseGroup() {
+		result <- fmt.Errorf("error processing flush group events while draining")
+		return true
+	}
+	if len(c.pending) > 0 && c.flush(c.logger) {
+		result <- fmt.Errorf("error flushing pending events while draining")
+		return true
+	}
+	result <- nil
+	return false
+}
@@ -0,0 +1,86 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		var processed, flushed atomic.Int32
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					processed.Add(1)
+					return false, nil
+				},
+				flush: func(logger logger.Logger) error {
+					flushed.Add(1)
+					return nil
+				},
+			},
+			URL:               natsurl,
+			MinPendingLatency: time.Hour, // only the drain flushes
+			MaxPendingLatency: time.Hour,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		for i := 0; i < 5; i++ {
+			evt := internal.DBChangeEvent{ID: fmt.Sprint(i), Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+		assert.Eventually(t, func() bool { return processed.Load() == 5 }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int32(0), flushed.Load())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, consumer.Drain(ctx))
+		assert.Equal(t, int32(1), flushed.Load())
+
+		assert.Eventually(t, func() bool {
+			info, err := consumer.jsconn.Info(context.Background())
+			return err == nil && info.NumAckPending == 0 && info.AckFloor.Consumer == 5
+		}, time.Second, 10*time.Millisecond)
+
+		// pulling stays paused after the drain
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(internal.DBChangeEvent{ID: "5", Table: "order", Operation: "INSERT"})))
+		assert.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, int32(5), processed.Load())
+
+		assert.NoError(t, consumer.Unpause())
+		assert.Eventually(t, func() bool { return processed.Load() == 6 }, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestDrainDeadline(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  &mockDriver{},
+			URL:     natsurl,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.ErrorIs(t, consumer.Drain(ctx), context.Canceled)
+	})
+}
@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// checkSchemaDrift compares the destination tables with the schemas the migrator applied and reports the columns which
+// are missing, such as a column which was dropped or renamed by hand. The missing columns are added back when repairing
+// is enabled. It returns the tables which were repaired.
+func (c *Consumer) checkSchemaDrift(logger logger.Logger, tables []string) []string {
+	drift, ok := c.driver.(internal.DriverSchemaDrift)
+	if !ok || c.registry == nil || len(tables) == 0 {
+		return nil
+	}
+	var schemas []*internal.Schema
+	for _, table := range tables {
+		found, version, err := c.registry.GetTableVersion(table)
+		if err != nil || !found {
+			continue
+		}
+		schema, err := c.registry.GetSchema(table, version)
+		if err != nil {
+			logger.Warn("error getting schema to check drift for table: %s, model version: %s: %s", table, version, err)
+			continue
+		}
+		schemas = append(schemas, schema)
+	}
+	if len(schemas) == 0 {
+		return nil
+	}
+	missing, err := drift.MissingColumns(c.ctx, logger, schemas)
+	if err != nil {
+		logger.Warn("error checking schema drift: %s", err)
+		return nil
+	}
+	var repaired []string
+	for _, schema := range schemas {
+		columns := missing[schema.Table]
+		internal.SchemaDriftColumns.WithLabelValues(schema.Table).Set(float64(len(columns)))
+		if len(columns) == 0 {
+			continue
+		}
+		sort.Strings(columns)
+		if !c.repairSchemaDrift {
+			logger.Error("table: %s is missing columns: %s in the destination which were removed outside of eds, use --repair-schema-drift to add them back", schema.Table, strings.Join(columns, ","))
+			continue
+		}
+		logger.Warn("table: %s is missing columns: %s in the destination which were removed outside of eds, adding them back", schema.Table, strings.Join(columns, ","))
+		if err := c.driver.(internal.DriverMigration).MigrateNewColumns(c.ctx, logger, schema, columns); err != nil {
+			logger.Error("error repairing columns: %s for table: %s: %s", strings.Join(columns, ","), schema.Table, err)
+			continue
+		}
+		internal.SchemaDriftColumns.WithLabelValues(schema.Table).Set(0)
+		logger.Info("repaired table: %s, columns: %s", schema.Table, strings.Join(columns, ","))
+		repaired = append(repaired, schema.Table)
+	}
+	return repaired
+}
+
+// pendingTables returns the tables of the pending messages.
+func (c *Consumer) pendingTables() []string {
+	seen := make(map[string]bool)
+	var tables []string
+	for _, m := range c.pending {
+		if table := tableFromSubject(m.Subject()); table != "" && !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockDriverWithDrift struct {
+	mockDriverWithMigration
+	missing map[string][]string
+}
+
+func (m *mockDriverWithDrift) MissingColumns(ctx context.Context, logger logger.Logger, schemas []*internal.Schema) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, schema := range schemas {
+		if columns, ok := m.missing[schema.Table]; ok {
+			res[schema.Table] = columns
+		}
+	}
+	return res, nil
+}
+
+func TestCheckSchemaDrift(t *testing.T) {
+	schemas := map[string]*internal.Schema{
+		"order":    {Table: "order", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "status": {Type: "string"}, "total": {Type: "number"}}},
+		"customer": {Table: "customer", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}},
+	}
+	repaired := make(map[string][]string)
+	driver := &mockDriverWithDrift{
+		missing: map[string][]string{"order": {"total", "status"}},
+		mockDriverWithMigration: mockDriverWithMigration{
+			migrateColumns: func(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns []string) error {
+				repaired[schema.Table] = columns
+				return nil
+			},
+		},
+	}
+	registry := &mockRegistry{
+		getSchema: func(table string, version string) (*internal.Schema, error) {
+			return schemas[table], nil
+		},
+		getTableVersion: func(table string) (bool, string, error) {
+			_, ok := schemas[table]
+			return ok, "1", nil
+		},
+	}
+	c := &Consumer{
+		ctx:               context.Background(),
+		logger:            logger.NewTestLogger(),
+		driver:            driver,
+		registry:          registry,
+		supportsMigration: true,
+	}
+
+	// the drift is only reported by default
+	assert.Empty(t, c.checkSchemaDrift(c.logger, []string{"customer", "order", "vehicle"}))
+	assert.Empty(t, repaired)
+
+	c.repairSchemaDrift = true
+	assert.Equal(t, []string{"order"}, c.checkSchemaDrift(c.logger, []string{"customer", "order", "vehicle"}))
+	assert.Equal(t, map[string][]string{"order": {"status", "total"}}, repaired)
+
+	// drivers which can't detect drift are skipped
+	c.driver = &driver.mockDriverWithMigration
+	assert.Empty(t, c.checkSchemaDrift(c.logger, []string{"order"}))
+}
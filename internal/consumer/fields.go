@@ -0,0 +1,64 @@
+package consumer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const fieldFilterFormat = "table=column[,column...]" // the format of a field filter flag value
+
+// ParseFieldFilters parses a list of field filters where each filter is a table and a comma separated list of columns
+// such as order=status,workflowStatusId. The table * applies to every table without its own filter.
+func ParseFieldFilters(values []string) (map[string][]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	filters := make(map[string][]string)
+	for _, value := range values {
+		table, list, ok := strings.Cut(value, "=")
+		table = strings.TrimSpace(table)
+		if !ok || table == "" {
+			return nil, fmt.Errorf("invalid field filter: %s (expected %s)", value, fieldFilterFormat)
+		}
+		if _, ok := filters[table]; ok {
+			return nil, fmt.Errorf("invalid field filter: %s (table %s already has a field filter)", value, table)
+		}
+		var columns []string
+		for _, column := range strings.Split(list, ",") {
+			if column = strings.TrimSpace(column); column != "" {
+				columns = append(columns, column)
+			}
+		}
+		if len(columns) == 0 {
+			return nil, fmt.Errorf("invalid field filter: %s (expected %s)", value, fieldFilterFormat)
+		}
+		filters[table] = columns
+	}
+	return filters, nil
+}
+
+// fieldFilter skips the updates which don't change any of the columns a table is subscribed to.
+type fieldFilter map[string][]string
+
+// Allow returns true if the event should be delivered to the driver. Inserts and deletes are always delivered and so
+// are updates without a diff since what changed isn't known.
+func (f fieldFilter) Allow(evt *internal.DBChangeEvent) bool {
+	if len(f) == 0 || evt.Operation != "UPDATE" || len(evt.Diff) == 0 {
+		return true
+	}
+	columns, ok := f[evt.Table]
+	if !ok {
+		if columns, ok = f["*"]; !ok {
+			return true
+		}
+	}
+	for _, name := range evt.Diff {
+		if util.SliceContains(columns, name) {
+			return true
+		}
+	}
+	return false
+}
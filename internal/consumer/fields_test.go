@@ -0,0 +1,41 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFieldFilters(t *testing.T) {
+	filters, err := ParseFieldFilters(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, filters)
+
+	filters, err = ParseFieldFilters([]string{"order=status, workflowStatusId", "*=deleted"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"order": {"status", "workflowStatusId"}, "*": {"deleted"}}, filters)
+
+	_, err = ParseFieldFilters([]string{"order"})
+	assert.EqualError(t, err, "invalid field filter: order (expected table=column[,column...])")
+	_, err = ParseFieldFilters([]string{"order="})
+	assert.Error(t, err)
+	_, err = ParseFieldFilters([]string{"order=status", "order=paid"})
+	assert.EqualError(t, err, "invalid field filter: order=paid (table order already has a field filter)")
+}
+
+func TestFieldFilterAllow(t *testing.T) {
+	f := fieldFilter{"order": {"status"}, "*": {"deleted"}}
+	assert.True(t, f.Allow(&internal.DBChangeEvent{Table: "order", Operation: "UPDATE", Diff: []string{"updatedDate", "status"}}))
+	assert.False(t, f.Allow(&internal.DBChangeEvent{Table: "order", Operation: "UPDATE", Diff: []string{"updatedDate"}}))
+	assert.False(t, f.Allow(&internal.DBChangeEvent{Table: "order", Operation: "UPDATE", Diff: []string{"deleted"}}), "the table filter replaces the * filter")
+	assert.True(t, f.Allow(&internal.DBChangeEvent{Table: "order", Operation: "INSERT"}))
+	assert.True(t, f.Allow(&internal.DBChangeEvent{Table: "order", Operation: "DELETE"}))
+	assert.True(t, f.Allow(&internal.DBChangeEvent{Table: "order", Operation: "UPDATE"}), "updates without a diff are delivered")
+	assert.True(t, f.Allow(&internal.DBChangeEvent{Table: "customer", Operation: "UPDATE", Diff: []string{"deleted"}}))
+	assert.False(t, f.Allow(&internal.DBChangeEvent{Table: "customer", Operation: "UPDATE", Diff: []string{"firstName"}}))
+
+	var none fieldFilter
+	assert.True(t, none.Allow(&internal.DBChangeEvent{Table: "order", Operation: "UPDATE", Diff: []string{"updatedDate"}}))
+	assert.True(t, fieldFilter{"order": {"status"}}.Allow(&internal.DBChangeEvent{Table: "customer", Operation: "UPDATE", Diff: []string{"firstName"}}))
+}
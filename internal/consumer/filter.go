@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+// tableFilter decides which tables the consumer receives. The tables are compiled into the filter subjects of the
+// jetstream consumer so the other tables are never delivered.
+type tableFilter struct {
+	tables []string // the tables set by Shopmonkey, empty for all
+	only   []string // the tables set by the operator, empty for all
+	except []string // the tables which are never received
+}
+
+// allowed returns true if the table should be received.
+func (f tableFilter) allowed(table string) bool {
+	if len(f.tables) > 0 && !util.SliceContains(f.tables, table) {
+		return false
+	}
+	if len(f.only) > 0 && !util.SliceContains(f.only, table) {
+		return false
+	}
+	return !util.SliceContains(f.except, table)
+}
+
+// include returns the tables to receive or nil to receive every table. Since a filter subject can't exclude a table,
+// excluding tables from every table uses the known tables, or receives every table and skips them when none are known.
+func (f tableFilter) include(known []string) ([]string, error) {
+	candidates := f.tables
+	if len(candidates) == 0 {
+		candidates = f.only
+	}
+	if len(candidates) == 0 {
+		if len(f.except) == 0 || len(known) == 0 {
+			return nil, nil
+		}
+		candidates = known
+	}
+	var tables []string
+	for _, table := range candidates {
+		if f.allowed(table) && !util.SliceContains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables are left to receive after applying the table filters")
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// exceptOnly returns true if the tables to receive depend on the known tables.
+func (f tableFilter) exceptOnly() bool {
+	return len(f.tables) == 0 && len(f.only) == 0 && len(f.except) > 0
+}
@@ -0,0 +1,143 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableFilter(t *testing.T) {
+	known := []string{"order", "customer", "payment", "vehicle"}
+
+	include, err := tableFilter{}.include(known)
+	assert.NoError(t, err)
+	assert.Nil(t, include)
+
+	include, err = tableFilter{only: []string{"order", "customer"}, except: []string{"customer"}}.include(known)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"order"}, include)
+
+	include, err = tableFilter{except: []string{"payment"}}.include(known)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"customer", "order", "vehicle"}, include)
+
+	// without the known tables the excluded tables are skipped instead
+	include, err = tableFilter{except: []string{"payment"}}.include(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, include)
+
+	filter := tableFilter{tables: []string{"order", "payment"}, only: []string{"order", "customer"}}
+	include, err = filter.include(known)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"order"}, include)
+	assert.True(t, filter.allowed("order"))
+	assert.False(t, filter.allowed("customer"))
+	assert.False(t, filter.allowed("payment"))
+
+	_, err = tableFilter{only: []string{"order"}, except: []string{"order"}}.include(known)
+	assert.ErrorContains(t, err, "no tables are left")
+}
+
+func TestExceptTables(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var tables []string
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				tables = append(tables, event.Table)
+				return false, nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  mockDriver,
+			URL:     natsurl,
+			Registry: &mockRegistry{
+				latestSchema: internal.SchemaMap{"order": &internal.Schema{}, "customer": &internal.Schema{}, "payment": &internal.Schema{}},
+				getSchema: func(table string, version string) (*internal.Schema, error) {
+					return &internal.Schema{}, nil
+				},
+			},
+			ExceptTables: []string{"payment"},
+		})
+		assert.NoError(t, err)
+
+		info, err := consumer.jsconn.Info(context.Background())
+		assert.NoError(t, err)
+		for _, subject := range info.Config.FilterSubjects {
+			assert.NotContains(t, subject, "payment")
+		}
+
+		for _, table := range []string{"payment", "order", "customer"} {
+			var sendEvent internal.DBChangeEvent
+			sendEvent.Table = table
+			sendEvent.Operation = "INSERT"
+			sendEvent.Timestamp = time.Now().UnixMilli()
+			sendEvent.MVCCTimestamp = fmt.Sprintf("%v", time.Now().UnixNano())
+			_, err := js.Publish(context.Background(), "dbchange."+table+".INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+		time.Sleep(time.Millisecond * 100)
+		assert.Equal(t, []string{"order", "customer"}, tables)
+
+		assert.NoError(t, consumer.Stop())
+	})
+}
+
+func TestLocationIDs(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var locations []string
+
+		mockDriver := &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				location := noLocationToken
+				if event.LocationID != nil {
+					location = *event.LocationID
+				}
+				locations = append(locations, location)
+				return false, nil
+			},
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:     context.Background(),
+			Logger:      logger.NewTestLogger(),
+			Driver:      mockDriver,
+			URL:         natsurl,
+			LocationIDs: []string{"L1"},
+		})
+		assert.NoError(t, err)
+
+		for _, location := range []string{"L1", "L2", noLocationToken} {
+			var sendEvent internal.DBChangeEvent
+			sendEvent.Table = "order"
+			sendEvent.Operation = "INSERT"
+			sendEvent.Timestamp = time.Now().UnixMilli()
+			if location != noLocationToken {
+				sendEvent.LocationID = &location
+			}
+			_, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID."+location+".PUBLIC.1", []byte(util.JSONStringify(sendEvent)))
+			assert.NoError(t, err)
+		}
+		time.Sleep(time.Millisecond * 100)
+		assert.Equal(t, []string{"L1", noLocationToken}, locations)
+
+		// an event delivered with a subject which doesn't match its location is still skipped
+		l2 := "L2"
+		assert.False(t, consumer.isLocationAllowed(&internal.DBChangeEvent{LocationID: &l2}))
+		assert.True(t, consumer.isLocationAllowed(&internal.DBChangeEvent{}))
+
+		assert.NoError(t, consumer.Stop())
+	})
+}
@@ -0,0 +1,203 @@
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FlushPolicyBalanced = "balanced" // default policy, flushes on size or latency but will defer to catch up when behind
+	FlushPolicyLatency  = "latency"  // flushes as soon as the minimum latency is reached to minimize end-to-end delay
+	FlushPolicyCost     = "cost"     // accumulates the largest batches possible to minimize the number of flushes
+	FlushPolicyCatchup  = "catchup"  // keeps accumulating while the server reports a backlog to maximize throughput
+)
+
+// FlushState is the state of the pending buffer used by a FlushPolicy to make a flush decision.
+type FlushState struct {
+	// Pending is the number of messages currently pending a flush.
+	Pending int
+
+	// MaxBatchSize is the maximum number of messages the driver wants in a single batch.
+	MaxBatchSize int
+
+	// MaxAckPending is the maximum number of messages that can be in-flight at once.
+	MaxAckPending int
+
+	// NumPending is the number of messages remaining on the server for this consumer.
+	NumPending uint64
+
+	// Elapsed is the time since the first pending message was received.
+	Elapsed time.Duration
+
+	// MinPendingLatency is the configured minimum accumulation period before flushing.
+	MinPendingLatency time.Duration
+
+	// MaxPendingLatency is the configured maximum accumulation period before flushing.
+	MaxPendingLatency time.Duration
+}
+
+// Full returns true once the pending messages fill a batch, which is the driver's max batch size when it has one
+// smaller than the max ack pending.
+func (s FlushState) Full() bool {
+	size := s.MaxAckPending
+	if s.MaxBatchSize > 0 && s.MaxBatchSize < size {
+		size = s.MaxBatchSize
+	}
+	return s.Pending >= size
+}
+
+// FlushPolicy decides when the consumer should flush pending messages to the driver.
+// A flush is always forced when the driver requests it or the batch reaches the driver's max batch size.
+type FlushPolicy interface {
+	// Name returns the name of the policy.
+	Name() string
+
+	// ShouldFlush is called after each message is processed by the driver.
+	ShouldFlush(state FlushState) bool
+
+	// ShouldFlushIdle is called when there are no new messages waiting to be processed.
+	ShouldFlushIdle(state FlushState) bool
+
+	// IdleFlushDelay returns how long until ShouldFlushIdle could return true for the state, the consumer waits this
+	// long for new messages before checking again.
+	IdleFlushDelay(state FlushState) time.Duration
+}
+
+type balancedFlushPolicy struct{}
+
+var _ FlushPolicy = (*balancedFlushPolicy)(nil)
+
+func (p *balancedFlushPolicy) Name() string {
+	return FlushPolicyBalanced
+}
+
+func (p *balancedFlushPolicy) ShouldFlush(state FlushState) bool {
+	if state.NumPending > uint64(state.MaxAckPending) && state.Elapsed < state.MaxPendingLatency*2 {
+		return false // if we have a large number, just keep going to try and catchup
+	}
+	return state.Full() || state.Elapsed >= state.MaxPendingLatency
+}
+
+func (p *balancedFlushPolicy) ShouldFlushIdle(state FlushState) bool {
+	return state.Pending > 0 && !state.Full() && state.Elapsed >= state.MinPendingLatency
+}
+
+func (p *balancedFlushPolicy) IdleFlushDelay(state FlushState) time.Duration {
+	return state.MinPendingLatency - state.Elapsed
+}
+
+type latencyFlushPolicy struct{}
+
+var _ FlushPolicy = (*latencyFlushPolicy)(nil)
+
+func (p *latencyFlushPolicy) Name() string {
+	return FlushPolicyLatency
+}
+
+func (p *latencyFlushPolicy) ShouldFlush(state FlushState) bool {
+	return state.Full() || state.Elapsed >= state.MinPendingLatency
+}
+
+func (p *latencyFlushPolicy) ShouldFlushIdle(state FlushState) bool {
+	return state.Pending > 0 && state.Elapsed >= state.MinPendingLatency
+}
+
+func (p *latencyFlushPolicy) IdleFlushDelay(state FlushState) time.Duration {
+	return state.MinPendingLatency - state.Elapsed
+}
+
+type costFlushPolicy struct{}
+
+var _ FlushPolicy = (*costFlushPolicy)(nil)
+
+func (p *costFlushPolicy) Name() string {
+	return FlushPolicyCost
+}
+
+func (p *costFlushPolicy) ShouldFlush(state FlushState) bool {
+	return state.Full() || state.Elapsed >= state.MaxPendingLatency
+}
+
+func (p *costFlushPolicy) ShouldFlushIdle(state FlushState) bool {
+	return state.Pending > 0 && state.Elapsed >= state.MaxPendingLatency
+}
+
+func (p *costFlushPolicy) IdleFlushDelay(state FlushState) time.Duration {
+	return state.MaxPendingLatency - state.Elapsed
+}
+
+type catchupFlushPolicy struct{}
+
+var _ FlushPolicy = (*catchupFlushPolicy)(nil)
+
+func (p *catchupFlushPolicy) Name() string {
+	return FlushPolicyCatchup
+}
+
+func (p *catchupFlushPolicy) ShouldFlush(state FlushState) bool {
+	if state.NumPending > 0 && state.Elapsed < state.MaxPendingLatency*2 {
+		return state.Full()
+	}
+	return state.Full() || state.Elapsed >= state.MaxPendingLatency
+}
+
+func (p *catchupFlushPolicy) ShouldFlushIdle(state FlushState) bool {
+	return state.Pending > 0 && state.Elapsed >= state.MinPendingLatency
+}
+
+func (p *catchupFlushPolicy) IdleFlushDelay(state FlushState) time.Duration {
+	return state.MinPendingLatency - state.Elapsed
+}
+
+// windowFlushPolicy holds the pending messages open for the driver's aggregation window.
+type windowFlushPolicy struct {
+	window time.Duration
+}
+
+var _ FlushPolicy = (*windowFlushPolicy)(nil)
+
+func (p *windowFlushPolicy) Name() string {
+	return "window(" + p.window.String() + ")"
+}
+
+func (p *windowFlushPolicy) ShouldFlush(state FlushState) bool {
+	return state.Full() || state.Elapsed >= p.window
+}
+
+func (p *windowFlushPolicy) ShouldFlushIdle(state FlushState) bool {
+	return state.Pending > 0 && state.Elapsed >= p.window
+}
+
+func (p *windowFlushPolicy) IdleFlushDelay(state FlushState) time.Duration {
+	return p.window - state.Elapsed
+}
+
+var flushPolicies = map[string]FlushPolicy{
+	FlushPolicyBalanced: &balancedFlushPolicy{},
+	FlushPolicyLatency:  &latencyFlushPolicy{},
+	FlushPolicyCost:     &costFlushPolicy{},
+	FlushPolicyCatchup:  &catchupFlushPolicy{},
+}
+
+// FlushPolicyNames returns the names of the built-in flush policies.
+func FlushPolicyNames() []string {
+	var names []string
+	for name := range flushPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFlushPolicy returns the built-in flush policy for name. An empty name returns the default policy.
+func NewFlushPolicy(name string) (FlushPolicy, error) {
+	if name == "" {
+		return flushPolicies[FlushPolicyBalanced], nil
+	}
+	if policy, ok := flushPolicies[strings.ToLower(name)]; ok {
+		return policy, nil
+	}
+	return nil, fmt.Errorf("unknown flush policy: %s (must be one of: %s)", name, strings.Join(FlushPolicyNames(), ", "))
+}
@@ -0,0 +1,142 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFlushPolicy(t *testing.T) {
+	policy, err := NewFlushPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, FlushPolicyBalanced, policy.Name())
+
+	for _, name := range FlushPolicyNames() {
+		policy, err := NewFlushPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, policy.Name())
+	}
+
+	policy, err = NewFlushPolicy("COST")
+	assert.NoError(t, err)
+	assert.Equal(t, FlushPolicyCost, policy.Name())
+
+	_, err = NewFlushPolicy("foo")
+	assert.ErrorContains(t, err, "unknown flush policy: foo")
+}
+
+func TestFlushPolicies(t *testing.T) {
+	state := FlushState{
+		Pending:           10,
+		MaxAckPending:     100,
+		MinPendingLatency: time.Second * 2,
+		MaxPendingLatency: time.Second * 30,
+	}
+
+	balanced, _ := NewFlushPolicy(FlushPolicyBalanced)
+	latency, _ := NewFlushPolicy(FlushPolicyLatency)
+	cost, _ := NewFlushPolicy(FlushPolicyCost)
+	catchup, _ := NewFlushPolicy(FlushPolicyCatchup)
+
+	// under the min latency nobody should flush
+	state.Elapsed = time.Second
+	for _, policy := range []FlushPolicy{balanced, latency, cost, catchup} {
+		assert.False(t, policy.ShouldFlush(state), policy.Name())
+		assert.False(t, policy.ShouldFlushIdle(state), policy.Name())
+	}
+
+	// past the min latency
+	state.Elapsed = time.Second * 3
+	assert.False(t, balanced.ShouldFlush(state))
+	assert.True(t, balanced.ShouldFlushIdle(state))
+	assert.True(t, latency.ShouldFlush(state))
+	assert.True(t, latency.ShouldFlushIdle(state))
+	assert.False(t, cost.ShouldFlush(state))
+	assert.False(t, cost.ShouldFlushIdle(state))
+	assert.False(t, catchup.ShouldFlush(state))
+	assert.True(t, catchup.ShouldFlushIdle(state))
+
+	// past the max latency
+	state.Elapsed = time.Second * 31
+	for _, policy := range []FlushPolicy{balanced, latency, cost, catchup} {
+		assert.True(t, policy.ShouldFlush(state), policy.Name())
+		assert.True(t, policy.ShouldFlushIdle(state), policy.Name())
+	}
+
+	// behind on the server
+	state.NumPending = 50
+	assert.True(t, balanced.ShouldFlush(state))
+	assert.False(t, catchup.ShouldFlush(state))
+	state.NumPending = 500
+	assert.False(t, balanced.ShouldFlush(state))
+	assert.False(t, catchup.ShouldFlush(state))
+	state.Elapsed = time.Second * 61
+	assert.True(t, balanced.ShouldFlush(state))
+	assert.True(t, catchup.ShouldFlush(state))
+
+	// full batch
+	state.Elapsed = time.Second
+	state.Pending = 100
+	assert.False(t, balanced.ShouldFlush(state)) // balanced keeps going when far behind
+	assert.True(t, latency.ShouldFlush(state))
+	assert.True(t, cost.ShouldFlush(state))
+	assert.True(t, catchup.ShouldFlush(state))
+	state.NumPending = 0
+	assert.True(t, balanced.ShouldFlush(state))
+
+	// a batch is full at the driver's max batch size when it's smaller than the max ack pending
+	state.Pending = 20
+	assert.False(t, cost.ShouldFlush(state))
+	state.MaxBatchSize = 20
+	for _, policy := range []FlushPolicy{balanced, latency, cost, catchup} {
+		assert.True(t, policy.ShouldFlush(state), policy.Name())
+	}
+	assert.False(t, balanced.ShouldFlushIdle(state))
+	state.MaxBatchSize = 500
+	assert.False(t, cost.ShouldFlush(state))
+}
+
+func TestIdleFlushDelay(t *testing.T) {
+	state := FlushState{Pending: 10, MaxAckPending: 100, MinPendingLatency: time.Second * 2, MaxPendingLatency: time.Second * 30, Elapsed: time.Second}
+	for _, name := range FlushPolicyNames() {
+		policy, _ := NewFlushPolicy(name)
+		delay := policy.IdleFlushDelay(state)
+		idle := state
+		idle.Elapsed += delay
+		assert.True(t, policy.ShouldFlushIdle(idle), name)
+		if delay > 0 {
+			idle.Elapsed -= time.Millisecond
+			assert.False(t, policy.ShouldFlushIdle(idle), name)
+		}
+	}
+	cost, _ := NewFlushPolicy(FlushPolicyCost)
+	assert.Equal(t, time.Second*29, cost.IdleFlushDelay(state))
+	window := &windowFlushPolicy{window: time.Minute}
+	assert.Equal(t, time.Second*59, window.IdleFlushDelay(state))
+}
+
+func TestWindowFlushPolicy(t *testing.T) {
+	policy := &windowFlushPolicy{window: time.Minute * 5}
+	state := FlushState{Pending: 10, MaxAckPending: 100, MinPendingLatency: time.Second * 2, MaxPendingLatency: time.Second * 30}
+	state.Elapsed = time.Minute
+	assert.False(t, policy.ShouldFlush(state))
+	assert.False(t, policy.ShouldFlushIdle(state))
+	state.Elapsed = time.Minute * 5
+	assert.True(t, policy.ShouldFlush(state))
+	assert.True(t, policy.ShouldFlushIdle(state))
+
+	// the server won't deliver more than max ack pending so the window has to be cut short
+	state.Elapsed = time.Minute
+	state.Pending = 100
+	assert.True(t, policy.ShouldFlush(state))
+}
+
+func TestValidateTuning(t *testing.T) {
+	assert.NoError(t, ConsumerConfig{}.ValidateTuning())
+	assert.NoError(t, ConsumerConfig{MinPendingLatency: time.Second, MaxPendingLatency: 5 * time.Second, EmptyBufferPauseTime: time.Millisecond, AckWait: 2 * time.Minute}.ValidateTuning())
+	assert.ErrorContains(t, ConsumerConfig{MinPendingLatency: -time.Second}.ValidateTuning(), "must not be negative")
+	assert.ErrorContains(t, ConsumerConfig{MinPendingLatency: time.Minute}.ValidateTuning(), "must not be greater than max pending latency")
+	assert.ErrorContains(t, ConsumerConfig{EmptyBufferPauseTime: -time.Millisecond}.ValidateTuning(), "empty buffer pause")
+	assert.ErrorContains(t, ConsumerConfig{AckWait: 30 * time.Second}.ValidateTuning(), "must be longer than 1m0s")
+}
@@ -0,0 +1,124 @@
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const flushGroupFormat = "table,table[,table...]" // the format of a flush group flag value
+
+// ParseFlushGroups parses a list of flush groups where each group is a comma separated list of tables such as
+// order,orderLineItem. The tables are listed parents first which is the order their events are delivered to the driver.
+func ParseFlushGroups(values []string) ([][]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	seen := make(map[string]bool)
+	var groups [][]string
+	for _, value := range values {
+		var tables []string
+		for _, table := range strings.Split(value, ",") {
+			table = strings.TrimSpace(table)
+			if table == "" {
+				continue
+			}
+			if seen[table] {
+				return nil, fmt.Errorf("invalid flush group: %s (table %s is already in a flush group)", value, table)
+			}
+			seen[table] = true
+			tables = append(tables, table)
+		}
+		if len(tables) < 2 {
+			return nil, fmt.Errorf("invalid flush group: %s (expected %s)", value, flushGroupFormat)
+		}
+		groups = append(groups, tables)
+	}
+	return groups, nil
+}
+
+// groupedEvent is an event which is held until the rest of its transaction has arrived.
+type groupedEvent struct {
+	log        logger.Logger
+	evt        internal.DBChangeEvent
+	companyID  string
+	size       int
+	numPending uint64
+	sequence   uint64 // the stream sequence of the message, 0 when it's replayed from the retry queue
+}
+
+type groupTable struct {
+	group int // the index of the group the table belongs to
+	rank  int // the position of the table in the group, parents first
+}
+
+// flushGrouper holds the events of the tables in a flush group which were changed in the same transaction so they are
+// delivered to the driver together, parents first, and committed in the same flush. Events of a transaction share
+// the same mvcc timestamp.
+type flushGrouper struct {
+	tables map[string]groupTable
+	staged []groupedEvent
+	group  int
+	txn    string
+}
+
+func newFlushGrouper(groups [][]string) *flushGrouper {
+	if len(groups) == 0 {
+		return nil
+	}
+	tables := make(map[string]groupTable)
+	for i, group := range groups {
+		for rank, table := range group {
+			tables[table] = groupTable{group: i, rank: rank}
+		}
+	}
+	return &flushGrouper{tables: tables}
+}
+
+// Groupable returns true if the event belongs to a flush group and can be matched to its transaction.
+func (g *flushGrouper) Groupable(evt *internal.DBChangeEvent) bool {
+	_, ok := g.tables[evt.Table]
+	return ok && evt.MVCCTimestamp != ""
+}
+
+// Continues returns true if the event is part of the transaction of the staged events.
+func (g *flushGrouper) Continues(evt *internal.DBChangeEvent) bool {
+	if len(g.staged) == 0 || !g.Groupable(evt) {
+		return false
+	}
+	return g.tables[evt.Table].group == g.group && evt.MVCCTimestamp == g.txn
+}
+
+// Stage holds the event until the transaction is released.
+func (g *flushGrouper) Stage(event groupedEvent) {
+	if len(g.staged) == 0 {
+		g.group = g.tables[event.evt.Table].group
+		g.txn = event.evt.MVCCTimestamp
+	}
+	g.staged = append(g.staged, event)
+}
+
+// Len returns the number of staged events.
+func (g *flushGrouper) Len() int {
+	return len(g.staged)
+}
+
+// Release returns the staged events ordered by their table in the group, keeping the order of the events for the same
+// table, and clears the staged events.
+func (g *flushGrouper) Release() []groupedEvent {
+	events := g.staged
+	sort.SliceStable(events, func(i, j int) bool {
+		return g.tables[events[i].evt.Table].rank < g.tables[events[j].evt.Table].rank
+	})
+	g.Reset()
+	return events
+}
+
+// Reset drops the staged events.
+func (g *flushGrouper) Reset() {
+	g.staged = nil
+	g.txn = ""
+}
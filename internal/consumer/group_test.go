@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFlushGroups(t *testing.T) {
+	groups, err := ParseFlushGroups(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, groups)
+
+	groups, err = ParseFlushGroups([]string{"order, orderLineItem", "customer,vehicle,"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"order", "orderLineItem"}, {"customer", "vehicle"}}, groups)
+
+	_, err = ParseFlushGroups([]string{"order"})
+	assert.ErrorContains(t, err, "invalid flush group: order")
+	_, err = ParseFlushGroups([]string{"order,orderLineItem", "orderLineItem,inventoryPart"})
+	assert.ErrorContains(t, err, "table orderLineItem is already in a flush group")
+}
+
+func TestFlushGrouper(t *testing.T) {
+	assert.Nil(t, newFlushGrouper(nil))
+	g := newFlushGrouper([][]string{{"order", "orderLineItem"}, {"customer", "vehicle"}})
+
+	event := func(table, id, txn string) groupedEvent {
+		return groupedEvent{evt: internal.DBChangeEvent{Table: table, ID: id, MVCCTimestamp: txn}}
+	}
+
+	assert.False(t, g.Groupable(&internal.DBChangeEvent{Table: "inspection", MVCCTimestamp: "1"}))
+	assert.False(t, g.Groupable(&internal.DBChangeEvent{Table: "order"}))
+
+	first := event("orderLineItem", "1", "1")
+	assert.True(t, g.Groupable(&first.evt))
+	assert.False(t, g.Continues(&first.evt))
+	g.Stage(first)
+	for _, e := range []groupedEvent{event("order", "2", "1"), event("orderLineItem", "3", "1")} {
+		assert.True(t, g.Continues(&e.evt))
+		g.Stage(e)
+	}
+	assert.False(t, g.Continues(&internal.DBChangeEvent{Table: "order", MVCCTimestamp: "2"}), "different transaction")
+	assert.False(t, g.Continues(&internal.DBChangeEvent{Table: "customer", MVCCTimestamp: "1"}), "different group")
+	assert.Equal(t, 3, g.Len())
+
+	var ids []string
+	for _, e := range g.Release() {
+		ids = append(ids, e.evt.ID)
+	}
+	assert.Equal(t, []string{"2", "1", "3"}, ids)
+	assert.Equal(t, 0, g.Len())
+	assert.False(t, g.Continues(&internal.DBChangeEvent{Table: "order", MVCCTimestamp: "1"}))
+}
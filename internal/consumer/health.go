@@ -0,0 +1,62 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	destinationBaseDelay = time.Second
+	destinationMaxDelay  = time.Minute
+)
+
+// WaitForDestination calls check until it passes, waiting with an exponential backoff between the attempts, so a
+// destination which is temporarily down delays the start instead of failing it. It returns the last error if the check
+// hasn't passed within maxWait or the context is cancelled. A maxWait of 0 waits until the context is cancelled.
+func WaitForDestination(ctx context.Context, logger logger.Logger, maxWait time.Duration, check func(ctx context.Context) error) error {
+	return waitForDestination(ctx, logger, maxWait, destinationBaseDelay, check)
+}
+
+func waitForDestination(ctx context.Context, logger logger.Logger, maxWait time.Duration, baseDelay time.Duration, check func(ctx context.Context) error) error {
+	started := time.Now()
+	delay := baseDelay
+	for attempt := 1; ; attempt++ {
+		err := check(ctx)
+		if err == nil {
+			if attempt > 1 {
+				logger.Info("destination is ready after %d attempts in %v", attempt, time.Since(started))
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if maxWait > 0 && time.Since(started)+delay > maxWait {
+			return fmt.Errorf("destination not ready after %d attempts in %v: %w", attempt, time.Since(started).Round(time.Millisecond), err)
+		}
+		logger.Warn("destination is not ready (attempt: %d), retrying in %v: %s", attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, destinationMaxDelay)
+	}
+}
+
+// checkDestination is the check for WaitForDestination which runs the destination check and then the pre-migration so
+// a failed migration is retried the same way.
+func (c *Consumer) checkDestination(ctx context.Context) error {
+	if err := c.destinationCheck(ctx); err != nil {
+		return err
+	}
+	if c.preMigrate && c.supportsMigration && c.registry != nil {
+		if err := c.premigrate(); err != nil {
+			return fmt.Errorf("error pre-migrating tables: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForDestination(t *testing.T) {
+	var attempts int
+	err := waitForDestination(context.Background(), logger.NewTestLogger(), 0, time.Millisecond, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("warehouse is down")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = waitForDestination(context.Background(), logger.NewTestLogger(), 20*time.Millisecond, time.Millisecond, func(ctx context.Context) error {
+		attempts++
+		return fmt.Errorf("warehouse is down")
+	})
+	assert.ErrorContains(t, err, "destination not ready after")
+	assert.ErrorContains(t, err, "warehouse is down")
+	assert.Greater(t, attempts, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = waitForDestination(ctx, logger.NewTestLogger(), 0, time.Hour, func(ctx context.Context) error {
+		return fmt.Errorf("warehouse is down")
+	})
+	assert.ErrorContains(t, err, "warehouse is down")
+}
@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// preProcess runs the pre-process hooks on the event and returns true if one of them skipped it.
+func (c *Consumer) preProcess(log logger.Logger, evt *internal.DBChangeEvent) (bool, error) {
+	for _, hook := range c.hooks {
+		if hook.PreProcess == nil {
+			continue
+		}
+		skip, err := hook.PreProcess(log, evt)
+		if err != nil {
+			return false, fmt.Errorf("error running pre-process hook %s: %w", hook.Name, err)
+		}
+		if skip {
+			log.Debug("skipping event (hook %s)", hook.Name)
+			internal.SkippedEvents.WithLabelValues(evt.Table, internal.SkipReasonHook).Inc()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hasPostFlushHooks returns true if the events sent to the driver must be kept for the post-flush hooks.
+func (c *Consumer) hasPostFlushHooks() bool {
+	for _, hook := range c.hooks {
+		if hook.PostFlush != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// postFlush runs the post-flush hooks with the events which were flushed.
+func (c *Consumer) postFlush(logger logger.Logger) error {
+	events := c.hookEvents
+	c.hookEvents = nil
+	if len(events) == 0 {
+		return nil
+	}
+	for _, hook := range c.hooks {
+		if hook.PostFlush == nil {
+			continue
+		}
+		if err := hook.PostFlush(logger, events); err != nil {
+			return fmt.Errorf("error running post-flush hook %s: %w", hook.Name, err)
+		}
+	}
+	return nil
+}
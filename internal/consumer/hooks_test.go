@@ -0,0 +1,121 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessorHooks(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		t.Cleanup(internal.ResetProcessorHooks)
+		var lock sync.Mutex
+		var processed, flushed []string
+		var driverFlushed bool
+		userID := "enriched"
+		internal.RegisterProcessorHook(internal.ProcessorHook{
+			Name: "enrich",
+			PreProcess: func(logger logger.Logger, event *internal.DBChangeEvent) (bool, error) {
+				event.UserID = &userID
+				return event.Table == "customer", nil
+			},
+		})
+		internal.RegisterProcessorHook(internal.ProcessorHook{
+			Name: "audit",
+			PostFlush: func(logger logger.Logger, events []internal.DBChangeEvent) error {
+				lock.Lock()
+				defer lock.Unlock()
+				assert.True(t, driverFlushed, "called after the driver flushed")
+				for _, event := range events {
+					flushed = append(flushed, event.ID)
+				}
+				return nil
+			},
+		})
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					lock.Lock()
+					defer lock.Unlock()
+					assert.Equal(t, &userID, event.UserID)
+					processed = append(processed, event.ID)
+					return false, nil
+				},
+				flush: func(logger logger.Logger) error {
+					lock.Lock()
+					defer lock.Unlock()
+					driverFlushed = true
+					return nil
+				},
+			},
+			URL:               natsurl,
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		for _, evt := range []internal.DBChangeEvent{
+			{ID: "1", Table: "order", Operation: "INSERT"},
+			{ID: "2", Table: "customer", Operation: "INSERT"},
+			{ID: "3", Table: "order", Operation: "UPDATE"},
+		} {
+			evt.Timestamp = time.Now().UnixMilli()
+			_, err = js.Publish(context.Background(), "dbchange."+evt.Table+"."+evt.Operation+".CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(flushed) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, []string{"1", "3"}, processed)
+		assert.Equal(t, []string{"1", "3"}, flushed)
+		lock.Unlock()
+	})
+}
+
+func TestProcessorHookError(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		t.Cleanup(internal.ResetProcessorHooks)
+		internal.RegisterProcessorHook(internal.ProcessorHook{
+			Name: "notify",
+			PostFlush: func(logger logger.Logger, events []internal.DBChangeEvent) error {
+				return errors.New("webhook is down")
+			},
+		})
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:           context.Background(),
+			Logger:            logger.NewTestLogger(),
+			Driver:            &mockDriver{},
+			URL:               natsurl,
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		evt := internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+		assert.NoError(t, err)
+		select {
+		case err := <-consumer.Error():
+			assert.ErrorContains(t, err, "error running post-flush hook notify: webhook is down")
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timed out waiting for the hook to fail")
+		}
+	})
+}
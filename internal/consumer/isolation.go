@@ -0,0 +1,389 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// CompanyConsumers runs a consumer for each company, each with its own jetstream consumer, driver and pending buffer,
+// so the backlog or a failing schema of one company doesn't stall the others. A consumer which fails is restarted with
+// a backoff while the consumers of the other companies keep running.
+type CompanyConsumers struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	config       ConsumerConfig
+	logger       logger.Logger
+	companies    []string
+	drivers      map[string]Driver
+	consumers    map[string]*Consumer
+	paused       bool
+	pausedIDs    map[string]bool // the companies which were paused by PauseCompany
+	pausedTables *pausedTables   // the tables which are paused for every company, restored when a consumer is restarted
+	lock         sync.Mutex
+	waitGroup    sync.WaitGroup
+	subError     chan error
+	disconnected chan bool
+	restartDelay func(attempt int) time.Duration
+	serverID     string
+}
+
+// companyConsumerSuffix returns the suffix of the jetstream consumer of the company.
+func companyConsumerSuffix(suffix string, companyID string) string {
+	if suffix == "" {
+		return companyID
+	}
+	return suffix + "-" + companyID
+}
+
+// NewCompanyConsumers creates and starts a consumer for each company of the credentials, or of the CompanyIDs when set.
+// The first consumer uses the Driver and the others a driver from NewPipelineDriver. When a consumer for all the
+// companies was used before, the consumers of the companies start after its last acked message.
+func NewCompanyConsumers(config ConsumerConfig) (*CompanyConsumers, error) {
+	if config.NewPipelineDriver == nil {
+		return nil, fmt.Errorf("a driver for each company is required to isolate the companies")
+	}
+	nc, info, err := NewNatsConnection(config.Logger, config.URL, config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	companies := info.CompanyIDs
+	if len(config.CompanyIDs) > 0 {
+		companies = config.CompanyIDs
+	}
+	if util.SliceContains(companies, "*") {
+		nc.Close()
+		return nil, fmt.Errorf("the companies must be listed to isolate them, the credentials allow every company")
+	}
+	companies = slices.Compact(slices.Sorted(slices.Values(companies)))
+
+	// the consumer for all the companies is left to expire, the new consumers continue where it stopped
+	var suffix string
+	if config.Suffix != "" {
+		suffix = "-" + config.Suffix
+	}
+	var startSequence uint64
+	if js, err := jetstream.New(nc); err == nil {
+		ctx, cancel := context.WithTimeout(config.Context, time.Minute)
+		if c, err := js.Consumer(ctx, "dbchange", fmt.Sprintf("eds-%s%s", info.ServerID, suffix)); err == nil {
+			startSequence = c.CachedInfo().AckFloor.Stream + 1
+		} else if !errors.Is(err, jetstream.ErrConsumerNotFound) {
+			config.Logger.Warn("error getting the consumer for all the companies: %s", err)
+		}
+		cancel()
+	}
+	nc.Close()
+
+	ctx, cancel := context.WithCancel(config.Context)
+	g := &CompanyConsumers{
+		ctx:          ctx,
+		cancel:       cancel,
+		config:       config,
+		logger:       config.Logger.WithPrefix("[companies]"),
+		companies:    companies,
+		drivers:      make(map[string]Driver),
+		consumers:    make(map[string]*Consumer),
+		pausedIDs:    make(map[string]bool),
+		pausedTables: newPausedTables(config.PausedTables),
+		paused:       config.PausedAt != nil,
+		subError:     make(chan error, 1),
+		disconnected: make(chan bool, 1),
+		restartDelay: reconnectBackoff,
+		serverID:     info.ServerID,
+	}
+	for i, companyID := range companies {
+		driver := config.Driver
+		if i > 0 {
+			if driver, err = config.NewPipelineDriver(); err != nil {
+				g.Stop()
+				return nil, fmt.Errorf("error creating driver for company %s: %w", companyID, err)
+			}
+		}
+		g.drivers[companyID] = driver
+		c, err := g.start(companyID, startSequence)
+		if err != nil {
+			g.Stop()
+			return nil, fmt.Errorf("error starting consumer for company %s: %w", companyID, err)
+		}
+		g.consumers[companyID] = c
+	}
+	g.setMetricsInfo()
+	for _, companyID := range companies {
+		g.waitGroup.Add(1)
+		go g.supervise(companyID)
+	}
+	g.logger.Info("started a consumer for each of the companies: %s", strings.Join(companies, ", "))
+	return g, nil
+}
+
+// setMetricsInfo sets the metrics info to all the companies since each consumer sets it to its own company.
+func (g *CompanyConsumers) setMetricsInfo() {
+	internal.SetMetricsInfo(g.consumers[g.companies[0]].sessionID, g.serverID, g.companies)
+}
+
+// start creates and starts the consumer of the company.
+func (g *CompanyConsumers) start(companyID string, startSequence uint64) (*Consumer, error) {
+	config := g.config
+	config.Context = g.ctx
+	config.Logger = g.config.Logger.WithPrefix("[" + companyID + "]")
+	config.CompanyIDs = []string{companyID}
+	config.Suffix = companyConsumerSuffix(g.config.Suffix, companyID)
+	config.Driver = g.drivers[companyID]
+	if config.RetryDir != "" {
+		config.RetryDir = filepath.Join(config.RetryDir, companyID) // each consumer replays only its own events
+	}
+	config.PausedTables = g.pausedTables.List()
+	config.startSequence = startSequence
+	config.heartbeatsDisabled = companyID != g.companies[0] // the heartbeats are for the session and not the company
+	return NewConsumer(config)
+}
+
+// supervise restarts the consumer of the company with a backoff when it fails until the consumers are stopped.
+func (g *CompanyConsumers) supervise(companyID string) {
+	defer g.waitGroup.Done()
+	for {
+		g.lock.Lock()
+		c := g.consumers[companyID]
+		g.lock.Unlock()
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-c.Disconnected():
+			// the connection is lost for every company so let the process restart
+			select {
+			case g.disconnected <- true:
+			default:
+			}
+			return
+		case err := <-c.Error():
+			internal.CompanyErrors.WithLabelValues(companyID).Inc()
+			g.logger.Error("consumer for company %s failed, restarting it: %s", companyID, err)
+			c.Stop()
+		}
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-g.ctx.Done():
+				return
+			case <-time.After(g.restartDelay(attempt)):
+			}
+			// the driver may still hold the events of the failed flush, which are redelivered, so use a new one
+			if err := g.replaceDriver(companyID); err != nil {
+				internal.CompanyErrors.WithLabelValues(companyID).Inc()
+				g.logger.Error("error creating driver for company %s (attempt %d): %s", companyID, attempt, err)
+				continue
+			}
+			restarted, err := g.start(companyID, 0)
+			if err != nil {
+				internal.CompanyErrors.WithLabelValues(companyID).Inc()
+				g.logger.Error("error restarting consumer for company %s (attempt %d): %s", companyID, attempt, err)
+				continue
+			}
+			g.lock.Lock()
+			if g.paused || g.pausedIDs[companyID] {
+				restarted.Pause()
+			}
+			g.consumers[companyID] = restarted
+			g.setMetricsInfo()
+			g.lock.Unlock()
+			g.logger.Info("restarted consumer for company %s", companyID)
+			break
+		}
+	}
+}
+
+// Stop stops the consumer of each company and the drivers created for them.
+func (g *CompanyConsumers) Stop() error {
+	g.cancel()
+	g.waitGroup.Wait()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, c := range g.consumers {
+		c.Stop()
+	}
+	g.consumers = make(map[string]*Consumer)
+	for companyID := range g.drivers {
+		g.stopDriver(companyID)
+	}
+	return nil
+}
+
+// stopDriver stops the driver of the company unless it's the Driver which the caller stops.
+func (g *CompanyConsumers) stopDriver(companyID string) {
+	driver := g.drivers[companyID]
+	delete(g.drivers, companyID)
+	if companyID == g.companies[0] && driver == g.config.Driver {
+		return
+	}
+	if d, ok := driver.(interface{ Stop() error }); ok {
+		if err := d.Stop(); err != nil {
+			g.logger.Error("error stopping driver for company %s: %s", companyID, err)
+		}
+	}
+}
+
+// replaceDriver stops the driver of the company and creates a new one.
+func (g *CompanyConsumers) replaceDriver(companyID string) error {
+	driver, err := g.config.NewPipelineDriver()
+	if err != nil {
+		return err
+	}
+	g.lock.Lock()
+	g.stopDriver(companyID)
+	g.drivers[companyID] = driver
+	g.lock.Unlock()
+	return nil
+}
+
+// Error returns a channel which never receives since the errors of a company only restart the consumer of the company.
+func (g *CompanyConsumers) Error() <-chan error {
+	return g.subError
+}
+
+// Disconnected returns a channel which receives when the connection to the NATS server is lost.
+func (g *CompanyConsumers) Disconnected() <-chan bool {
+	return g.disconnected
+}
+
+// each calls fn for the consumer of each company in order and returns the first error.
+func (g *CompanyConsumers) each(fn func(companyID string, c *Consumer) error) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, companyID := range g.companies {
+		if c := g.consumers[companyID]; c != nil {
+			if err := fn(companyID, c); err != nil {
+				return fmt.Errorf("company %s: %w", companyID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Pause stops pulling messages for every company.
+func (g *CompanyConsumers) Pause() {
+	g.each(func(companyID string, c *Consumer) error {
+		c.Pause()
+		return nil
+	})
+	g.lock.Lock()
+	g.paused = true
+	g.lock.Unlock()
+}
+
+// Unpause starts pulling messages again for every company which wasn't paused by PauseCompany.
+func (g *CompanyConsumers) Unpause() error {
+	g.lock.Lock()
+	g.paused = false
+	g.lock.Unlock()
+	return g.each(func(companyID string, c *Consumer) error {
+		if g.pausedIDs[companyID] {
+			return nil
+		}
+		return c.Unpause()
+	})
+}
+
+// PauseCompany stops pulling messages for the company.
+func (g *CompanyConsumers) PauseCompany(companyID string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.pausedIDs[companyID] {
+		return
+	}
+	g.pausedIDs[companyID] = true
+	if c := g.consumers[companyID]; c != nil && !g.paused {
+		c.Pause()
+	}
+}
+
+// UnpauseCompany starts pulling messages again for the company unless every company is paused.
+func (g *CompanyConsumers) UnpauseCompany(companyID string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.pausedIDs[companyID] {
+		return
+	}
+	delete(g.pausedIDs, companyID)
+	if c := g.consumers[companyID]; c != nil && !g.paused {
+		if err := c.Unpause(); err != nil {
+			g.logger.Error("error unpausing company %s: %s", companyID, err)
+		}
+	}
+}
+
+// PauseTable stops processing the events of the table for every company.
+func (g *CompanyConsumers) PauseTable(table string) {
+	g.pausedTables.Pause(table)
+	g.each(func(companyID string, c *Consumer) error {
+		c.PauseTable(table)
+		return nil
+	})
+}
+
+// UnpauseTable resumes processing the events of the table for every company.
+func (g *CompanyConsumers) UnpauseTable(table string) {
+	g.pausedTables.Unpause(table)
+	g.each(func(companyID string, c *Consumer) error {
+		c.UnpauseTable(table)
+		return nil
+	})
+}
+
+// SetTables changes the tables the consumer of each company receives.
+func (g *CompanyConsumers) SetTables(tables []string) error {
+	return g.each(func(companyID string, c *Consumer) error {
+		return c.SetTables(tables)
+	})
+}
+
+// RefreshSchema applies the migrations for the tables with the driver of each company and returns the tables which
+// were migrated by any of them.
+func (g *CompanyConsumers) RefreshSchema(tables []string) ([]string, error) {
+	var migrated []string
+	err := g.each(func(companyID string, c *Consumer) error {
+		res, err := c.RefreshSchema(tables)
+		migrated = append(migrated, res...)
+		return err
+	})
+	slices.Sort(migrated)
+	return slices.Compact(migrated), err
+}
+
+// Drain flushes the pending events of each company, see Consumer.Drain.
+func (g *CompanyConsumers) Drain(ctx context.Context) error {
+	return g.each(func(companyID string, c *Consumer) error {
+		return c.Drain(ctx)
+	})
+}
+
+// Replay replays the events of each company in turn through the driver of the options, see Consumer.Replay. The lock
+// isn't held while replaying so a failed consumer can still be restarted.
+func (g *CompanyConsumers) Replay(ctx context.Context, opts ReplayOptions) (ReplayResult, error) {
+	g.lock.Lock()
+	consumers := make([]*Consumer, 0, len(g.companies))
+	for _, companyID := range g.companies {
+		if c := g.consumers[companyID]; c != nil {
+			consumers = append(consumers, c)
+		}
+	}
+	g.lock.Unlock()
+	var result ReplayResult
+	for _, c := range consumers {
+		res, err := c.Replay(ctx, opts)
+		result.Events += res.Events
+		result.Skipped += res.Skipped
+		if err != nil {
+			return result, fmt.Errorf("company %s: %w", c.companyIDs[0], err)
+		}
+	}
+	return result, nil
+}
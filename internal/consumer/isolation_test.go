@@ -0,0 +1,126 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompanyConsumerSuffix(t *testing.T) {
+	assert.Equal(t, "c1", companyConsumerSuffix("", "c1"))
+	assert.Equal(t, "test-c1", companyConsumerSuffix("test", "c1"))
+}
+
+// processedEvents records the ids of the events processed by the drivers of each company.
+type processedEvents struct {
+	lock   sync.Mutex
+	events map[string][]string
+}
+
+func (p *processedEvents) driver(fail *bool) Driver {
+	return &mockDriver{
+		process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			p.events[*event.CompanyID] = append(p.events[*event.CompanyID], event.ID)
+			return false, nil
+		},
+		flush: func(logger logger.Logger) error {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			if fail != nil && *fail {
+				*fail = false
+				return errors.New("flush failed")
+			}
+			return nil
+		},
+	}
+}
+
+func (p *processedEvents) get(companyID string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string{}, p.events[companyID]...)
+}
+
+func TestCompanyConsumers(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		internal.MetricsReset()
+		// the test stream only allows one consumer
+		assert.NoError(t, js.DeleteStream(context.Background(), "dbchange"))
+		_, err := js.CreateStream(context.Background(), jetstream.StreamConfig{
+			Name:     "dbchange",
+			Subjects: []string{"dbchange.>"},
+			Storage:  jetstream.MemoryStorage,
+		})
+		assert.NoError(t, err)
+		publish := func(companyID string, id string) {
+			t.Helper()
+			evt := internal.DBChangeEvent{ID: id, CompanyID: &companyID, Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), fmt.Sprintf("dbchange.order.INSERT.%s.LID.PUBLIC.1", companyID), []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+
+		processed := &processedEvents{events: make(map[string][]string)}
+		config := ConsumerConfig{
+			Context:           context.Background(),
+			Logger:            logger.NewTestLogger(),
+			URL:               natsurl,
+			CompanyIDs:        []string{"c2", "c1"},
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		}
+
+		// a consumer for all the companies which the company consumers take over from
+		config.Driver = processed.driver(nil)
+		all, err := NewConsumer(config)
+		assert.NoError(t, err)
+		publish("c1", "1")
+		assert.Eventually(t, func() bool { return len(processed.get("c1")) == 1 }, 5*time.Second, 10*time.Millisecond)
+		assert.NoError(t, all.Stop())
+		publish("c1", "2")
+
+		fail := true
+		config.Driver = processed.driver(&fail) // the first company is c1
+		config.NewPipelineDriver = func() (Driver, error) { return processed.driver(nil), nil }
+		consumers, err := NewCompanyConsumers(config)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer consumers.Stop()
+		consumers.restartDelay = func(attempt int) time.Duration { return 10 * time.Millisecond }
+		assert.Equal(t, []string{"c1", "c2"}, consumers.companies)
+		assert.Equal(t, "eds-dev-c1", consumers.consumers["c1"].name)
+
+		// the event after the last ack of the consumer for all the companies is delivered, the failed flush redelivers it
+		publish("c2", "3")
+		assert.Eventually(t, func() bool { return len(processed.get("c2")) == 1 }, 5*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			events := processed.get("c1")
+			return len(events) == 3 && events[1] == "2" && events[2] == "2"
+		}, 10*time.Second, 10*time.Millisecond)
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.CompanyErrors.WithLabelValues("c1")))
+		assert.Equal(t, float64(0), testutil.ToFloat64(internal.CompanyErrors.WithLabelValues("c2")))
+
+		// pausing a company only stops pulling for it
+		consumers.PauseCompany("c2")
+		publish("c2", "4")
+		publish("c1", "5")
+		assert.Eventually(t, func() bool { return len(processed.get("c1")) == 4 }, 5*time.Second, 10*time.Millisecond)
+		assert.Len(t, processed.get("c2"), 1)
+		consumers.UnpauseCompany("c2")
+		assert.Eventually(t, func() bool { return len(processed.get("c2")) == 2 }, 5*time.Second, 10*time.Millisecond)
+	})
+}
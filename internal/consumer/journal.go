@@ -0,0 +1,227 @@
+package consumer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	journalExt               = ".journal"
+	journalLookupTimeout     = time.Minute   // how long the destination is checked for the events in the journal
+	journalResultApplied     = "applied"     // the event was acked and is in the destination
+	journalResultRedelivered = "redelivered" // the event wasn't acked and isn't in the destination, it is processed when redelivered
+	journalResultDuplicate   = "duplicate"   // the event wasn't acked but is in the destination, it is processed again when redelivered
+	journalResultGap         = "gap"         // the event was acked but isn't in the destination
+	journalResultUnknown     = "unknown"     // the driver can't check the destination
+)
+
+// journalEntry is an event which was handed to the driver but not acked yet, or the ack of one of them.
+type journalEntry struct {
+	Sequence     uint64   `json:"seq,omitempty"`
+	ID           string   `json:"id,omitempty"`
+	Table        string   `json:"table,omitempty"`
+	Operation    string   `json:"op,omitempty"`
+	Key          []string `json:"key,omitempty"`
+	ModelVersion string   `json:"modelVersion,omitempty"`
+	CompanyID    *string  `json:"companyId,omitempty"`
+	Timestamp    int64    `json:"timestamp,omitempty"`
+	UpdatedDate  string   `json:"updatedDate,omitempty"` // the version of the row after an update
+	Acked        uint64   `json:"acked,omitempty"`       // the sequence of an event which was acked
+
+	acked bool // the event was acked individually, which the ack floor doesn't show when an earlier event wasn't
+}
+
+func (e journalEntry) event() internal.DBChangeEvent {
+	evt := internal.DBChangeEvent{
+		ID:           e.ID,
+		Table:        e.Table,
+		Operation:    e.Operation,
+		Key:          e.Key,
+		ModelVersion: e.ModelVersion,
+		CompanyID:    e.CompanyID,
+		Timestamp:    e.Timestamp,
+	}
+	if e.UpdatedDate != "" {
+		evt.After = json.RawMessage(util.JSONStringify(map[string]string{"updatedDate": e.UpdatedDate}))
+	}
+	return evt
+}
+
+// journal is a write-ahead log of the events handed to the driver since the last flush. It is synced to disk before
+// the driver flushes and emptied once the events are acked, so entries left in it mean the process crashed in between.
+type journal struct {
+	file   *os.File
+	writer *bufio.Writer
+	empty  bool
+}
+
+// openJournal opens the journal of the consumer and returns the entries which were left in it, it must be reset before
+// events are added.
+func openJournal(dir string, name string) (*journal, []journalEntry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("error creating journal directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name+journalExt), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening journal: %w", err)
+	}
+	var entries []journalEntry
+	acked := make(map[uint64]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break // the last entry can be partially written when the process crashed
+		}
+		if entry.Acked > 0 {
+			acked[entry.Acked] = true
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	for i := range entries {
+		entries[i].acked = acked[entries[i].Sequence]
+	}
+	// the entries are kept until they're reconciled and the journal is reset
+	return &journal{file: file, writer: bufio.NewWriter(file)}, entries, nil
+}
+
+// add records an event before it's handed to the driver.
+func (j *journal) add(sequence uint64, evt *internal.DBChangeEvent) error {
+	entry := journalEntry{
+		Sequence:     sequence,
+		ID:           evt.ID,
+		Table:        evt.Table,
+		Operation:    evt.Operation,
+		Key:          evt.Key,
+		ModelVersion: evt.ModelVersion,
+		CompanyID:    evt.CompanyID,
+		Timestamp:    evt.Timestamp,
+	}
+	if evt.Operation == "UPDATE" {
+		// the row is in the destination before an update is applied so its version is checked
+		if object, err := evt.GetObject(); err == nil {
+			entry.UpdatedDate, _ = object["updatedDate"].(string)
+		}
+	}
+	return j.write(entry)
+}
+
+// ack records an event which was acked so it isn't mistaken for one which will be redelivered when it's above the ack
+// floor after a crash. It's written to the file right away since the journal is reset once the events are acked.
+func (j *journal) ack(sequence uint64) error {
+	if err := j.write(journalEntry{Acked: sequence}); err != nil {
+		return err
+	}
+	if err := j.writer.Flush(); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	return nil
+}
+
+func (j *journal) write(entry journalEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding journal entry: %w", err)
+	}
+	buf = append(buf, '\n')
+	if _, err := j.writer.Write(buf); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	j.empty = false
+	return nil
+}
+
+// sync writes the entries to disk so they survive a crash while the driver flushes.
+func (j *journal) sync() error {
+	if j.empty {
+		return nil
+	}
+	if err := j.writer.Flush(); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing journal: %w", err)
+	}
+	return nil
+}
+
+// reset empties the journal once the events were acked, or nacked so they are redelivered.
+func (j *journal) reset() error {
+	j.writer.Reset(j.file)
+	if j.empty {
+		return nil
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating journal: %w", err)
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error truncating journal: %w", err)
+	}
+	j.empty = true
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// reconcileJournal checks the destination for the events which were left in the journal after a crash. The events
+// after the ack floor which weren't acked individually are redelivered so one which is already in the destination is a
+// potential duplicate, and one which was acked but isn't in the destination is a potential gap. It returns the number
+// of events by result. The events replayed from the retry queue or the park were acked before so they aren't journaled.
+func (c *Consumer) reconcileJournal(entries []journalEntry, ackFloor uint64) map[string]int {
+	results := make(map[string]int)
+	if len(entries) == 0 {
+		return results
+	}
+	c.logger.Warn("found %d events in the journal which weren't acked before the server stopped, checking the destination", len(entries))
+	lookup, _ := c.driver.(internal.DriverLookup)
+	ctx, cancel := context.WithTimeout(c.ctx, journalLookupTimeout)
+	defer cancel()
+	for _, entry := range entries {
+		acked := entry.Sequence <= ackFloor || entry.acked
+		result := journalResultUnknown
+		if lookup != nil {
+			found, err := lookup.Lookup(ctx, c.logger, entry.event())
+			if errors.Is(err, internal.ErrTableNotFound) {
+				found, err = entry.Operation == "DELETE", nil
+			}
+			if err != nil {
+				c.logger.Error("error checking the destination for event %s of %s (seq:%d): %s", entry.ID, entry.Table, entry.Sequence, err)
+			} else {
+				switch {
+				case acked && found:
+					result = journalResultApplied
+				case acked:
+					result = journalResultGap
+					c.logger.Error("event %s of %s (seq:%d) was acked but isn't in the destination", entry.ID, entry.Table, entry.Sequence)
+				case found:
+					result = journalResultDuplicate
+					c.logger.Warn("event %s of %s (seq:%d) is in the destination and will be processed again when it's redelivered", entry.ID, entry.Table, entry.Sequence)
+				default:
+					result = journalResultRedelivered
+				}
+			}
+		}
+		results[result]++
+		internal.JournalEvents.WithLabelValues(result).Inc()
+	}
+	c.logger.Info("checked the journal: %d applied, %d redelivered, %d potential duplicates, %d potential gaps, %d unknown", results[journalResultApplied], results[journalResultRedelivered], results[journalResultDuplicate], results[journalResultGap], results[journalResultUnknown])
+	return results
+}
@@ -0,0 +1,167 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	j, entries, err := openJournal(dir, "eds-test")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.NoError(t, j.reset())
+	companyID := "CID"
+	assert.NoError(t, j.add(1, &internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT", Key: []string{"CID", "o1"}, CompanyID: &companyID}))
+	assert.NoError(t, j.add(2, &internal.DBChangeEvent{ID: "2", Table: "order", Operation: "DELETE", Key: []string{"CID", "o2"}}))
+	assert.NoError(t, j.add(3, &internal.DBChangeEvent{ID: "3", Table: "order", Operation: "UPDATE", Key: []string{"CID", "o3"}, After: []byte(`{"id":"o3","updatedDate":"2024-10-02T12:00:00Z"}`)}))
+	assert.NoError(t, j.ack(2))
+	assert.NoError(t, j.sync())
+	assert.NoError(t, j.close())
+
+	// a crash while writing leaves a partial entry at the end
+	f, err := os.OpenFile(filepath.Join(dir, "eds-test"+journalExt), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"seq":4,"id":"4","ta`)
+	assert.NoError(t, err)
+	f.Close()
+
+	j, entries, err = openJournal(dir, "eds-test")
+	assert.NoError(t, err)
+	assert.Equal(t, []journalEntry{
+		{Sequence: 1, ID: "1", Table: "order", Operation: "INSERT", Key: []string{"CID", "o1"}, CompanyID: &companyID},
+		{Sequence: 2, ID: "2", Table: "order", Operation: "DELETE", Key: []string{"CID", "o2"}, acked: true},
+		{Sequence: 3, ID: "3", Table: "order", Operation: "UPDATE", Key: []string{"CID", "o3"}, UpdatedDate: "2024-10-02T12:00:00Z"},
+	}, entries)
+	evt := entries[0].event()
+	assert.Equal(t, "o1", evt.GetPrimaryKey())
+	evt = entries[2].event()
+	object, err := evt.GetObject()
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-10-02T12:00:00Z", object["updatedDate"], "the version of an update is looked up")
+	assert.NoError(t, j.reset())
+	assert.NoError(t, j.close())
+	buf, err := os.ReadFile(filepath.Join(dir, "eds-test"+journalExt))
+	assert.NoError(t, err)
+	assert.Empty(t, buf)
+}
+
+type lookupDriver struct {
+	mockDriver
+	found map[string]bool
+}
+
+func (d *lookupDriver) Lookup(ctx context.Context, logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	if event.ID == "error" {
+		return false, errors.New("lookup failed")
+	}
+	if event.Table == "missing" {
+		return false, internal.ErrTableNotFound
+	}
+	return d.found[event.ID], nil
+}
+
+func TestReconcileJournal(t *testing.T) {
+	internal.MetricsReset()
+	c := &Consumer{
+		ctx:    context.Background(),
+		logger: logger.NewTestLogger(),
+		driver: &lookupDriver{found: map[string]bool{"1": true, "3": true}},
+	}
+	entries := []journalEntry{
+		{Sequence: 1, ID: "1", Table: "order"},              // acked and found
+		{Sequence: 2, ID: "2", Table: "order"},              // acked and not found
+		{Sequence: 3, ID: "3", Table: "order"},              // not acked and found
+		{Sequence: 4, ID: "4", Table: "order"},              // not acked and not found
+		{Sequence: 7, ID: "7", Table: "order", acked: true}, // acked above the ack floor and not found
+		{Sequence: 5, ID: "error", Table: "order"},
+		{Sequence: 6, ID: "6", Table: "missing", Operation: "DELETE"},
+	}
+	results := c.reconcileJournal(entries, 2)
+	assert.Equal(t, map[string]int{
+		journalResultApplied:     1,
+		journalResultGap:         2,
+		journalResultDuplicate:   2,
+		journalResultRedelivered: 1,
+		journalResultUnknown:     1,
+	}, results)
+	assert.Equal(t, float64(2), testutil.ToFloat64(internal.JournalEvents.WithLabelValues(journalResultGap)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(internal.JournalEvents.WithLabelValues(journalResultDuplicate)))
+
+	// the destination can't be checked without a lookup
+	c.driver = &mockDriver{}
+	assert.Equal(t, map[string]int{journalResultUnknown: 2}, c.reconcileJournal(entries[:2], 2))
+}
+
+func TestJournalConsumer(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		internal.MetricsReset()
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "eds-dev"+journalExt)
+		// the journal left by a crash is reconciled when the consumer starts
+		assert.NoError(t, os.WriteFile(filename, []byte(`{"seq":100,"id":"old","table":"order","op":"INSERT"}`+"\n"), 0600))
+
+		var lock sync.Mutex
+		var journaled []string
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &lookupDriver{
+				mockDriver: mockDriver{
+					flush: func(logger logger.Logger) error {
+						// the events are in the journal before the destination has them
+						buf, err := os.ReadFile(filename)
+						if err != nil {
+							return err
+						}
+						lock.Lock()
+						defer lock.Unlock()
+						journaled = append(journaled, strings.TrimSpace(string(buf)))
+						return nil
+					},
+				},
+			},
+			URL:               natsurl,
+			JournalDir:        dir,
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.JournalEvents.WithLabelValues(journalResultRedelivered)))
+
+		evt := internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT", Key: []string{"CID", "o1"}, Timestamp: time.Now().UnixMilli()}
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(journaled) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Contains(t, journaled[0], `"id":"1"`)
+		assert.NotContains(t, journaled[0], `"old"`)
+		lock.Unlock()
+
+		// the journal is emptied once the events are acked
+		assert.Eventually(t, func() bool {
+			buf, err := os.ReadFile(filename)
+			return err == nil && len(buf) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,51 @@
+package consumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+const defaultLagInterval = 15 * time.Second
+
+// reportLag refreshes the lag and stream position metrics every lag interval until the consumer is stopped.
+func (c *Consumer) reportLag() {
+	ticker := time.NewTicker(c.lagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.updateLag(); err != nil {
+				c.logger.Debug("error getting consumer info for the lag metrics: %s", err)
+			}
+		}
+	}
+}
+
+// updateLag sets the lag and stream position metrics from the info of the jetstream consumer. The time behind the head
+// of the stream is the age of the last event received while messages are still waiting to be delivered.
+func (c *Consumer) updateLag() error {
+	c.subscriberLock.Lock()
+	jsconn := c.jsconn
+	c.subscriberLock.Unlock()
+	ctx, cancel := context.WithTimeout(c.ctx, c.lagInterval)
+	defer cancel()
+	info, err := jsconn.Info(ctx)
+	if err != nil {
+		return err
+	}
+	internal.ConsumerPending.WithLabelValues(c.name).Set(float64(info.NumPending))
+	internal.ConsumerDeliveredSequence.WithLabelValues(c.name).Set(float64(info.Delivered.Stream))
+	internal.ConsumerAckFloorSequence.WithLabelValues(c.name).Set(float64(info.AckFloor.Stream))
+	internal.ConsumerRedelivered.WithLabelValues(c.name).Set(float64(info.NumRedelivered))
+	var lag time.Duration
+	if ts := c.lastEventTimestamp.Load(); info.NumPending > 0 && ts > 0 {
+		lag = max(time.Since(time.UnixMilli(ts)), 0)
+	}
+	internal.ConsumerLag.WithLabelValues(c.name).Set(lag.Seconds())
+	c.lag.Store(int64(lag))
+	return nil
+}
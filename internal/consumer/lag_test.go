@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateLag(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		internal.MetricsReset()
+		var processed atomic.Int32
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					processed.Add(1)
+					return false, nil
+				},
+			},
+			URL:               natsurl,
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+			LagInterval:       time.Hour, // only the test refreshes the metrics
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		publish := func(id string) {
+			t.Helper()
+			evt := internal.DBChangeEvent{ID: id, Table: "order", Operation: "INSERT", Timestamp: time.Now().Add(-time.Hour).UnixMilli()}
+			_, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+		metric := func(gauge *prometheus.GaugeVec) float64 {
+			return testutil.ToFloat64(gauge.WithLabelValues(consumer.name))
+		}
+
+		for i := 0; i < 2; i++ {
+			publish(fmt.Sprint(i))
+		}
+		assert.Eventually(t, func() bool {
+			return processed.Load() == 2 && consumer.updateLag() == nil && metric(internal.ConsumerAckFloorSequence) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, float64(0), metric(internal.ConsumerPending))
+		assert.Equal(t, float64(2), metric(internal.ConsumerDeliveredSequence))
+		assert.Equal(t, float64(0), metric(internal.ConsumerRedelivered))
+		assert.Equal(t, float64(0), metric(internal.ConsumerLag), "caught up")
+
+		// the messages which aren't delivered while paused put the consumer behind the last event received
+		consumer.Pause()
+		publish("2")
+		assert.NoError(t, consumer.updateLag())
+		assert.Equal(t, float64(1), metric(internal.ConsumerPending))
+		assert.Equal(t, float64(2), metric(internal.ConsumerDeliveredSequence))
+		assert.GreaterOrEqual(t, metric(internal.ConsumerLag), time.Hour.Seconds())
+	})
+}
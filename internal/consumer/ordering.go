@@ -0,0 +1,180 @@
+package consumer
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	OrderingModeNone    = ""        // no ordering checks are performed
+	OrderingModeDetect  = "detect"  // out of order events are reported as metrics but still delivered to the driver
+	OrderingModeEnforce = "enforce" // out of order events are reported as metrics and resequenced within the batch, or dropped if a newer version was already flushed
+
+	DefaultOrderingMaxKeys = 100_000 // maximum number of keys to remember versions for
+)
+
+// ValidateOrderingMode returns an error if the ordering mode is not valid.
+func ValidateOrderingMode(mode string) error {
+	switch mode {
+	case OrderingModeNone, OrderingModeDetect, OrderingModeEnforce:
+		return nil
+	}
+	return fmt.Errorf("unknown ordering mode: %s (must be one of: %s, %s)", mode, OrderingModeDetect, OrderingModeEnforce)
+}
+
+// keyRouter routes events to a fixed number of workers so that all events for the same ordering key are always handled by the same worker.
+type keyRouter struct {
+	workers int
+}
+
+func newKeyRouter(workers int) *keyRouter {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &keyRouter{workers: workers}
+}
+
+// Route returns the worker index for the event.
+func (r *keyRouter) Route(evt *internal.DBChangeEvent) int {
+	if r.workers == 1 {
+		return 0
+	}
+	return util.Modulo(evt.OrderingKey(), r.workers)
+}
+
+type orderingEntry struct {
+	key     string
+	version internal.EventVersion
+}
+
+// orderingTracker remembers the last version seen for each key to detect events which are delivered out of order.
+// only the most recently used keys are remembered to bound memory.
+type orderingTracker struct {
+	mode    string
+	maxKeys int
+	entries map[string]*list.Element
+	lru     *list.List
+	lock    sync.Mutex
+}
+
+func newOrderingTracker(mode string, maxKeys int) *orderingTracker {
+	if maxKeys <= 0 {
+		maxKeys = DefaultOrderingMaxKeys
+	}
+	return &orderingTracker{
+		mode:    mode,
+		maxKeys: maxKeys,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Check records the version of the event and returns true if the event is older than a previously seen version for the same key.
+// A redelivery of the same version is not considered out of order.
+func (t *orderingTracker) Check(evt *internal.DBChangeEvent) bool {
+	version := evt.GetVersion()
+	if version.IsZero() {
+		return false
+	}
+	key := evt.OrderingKey()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if el, ok := t.entries[key]; ok {
+		entry := el.Value.(*orderingEntry)
+		t.lru.MoveToFront(el)
+		if version.Compare(entry.version) < 0 {
+			internal.OrderingViolations.WithLabelValues(evt.Table).Inc()
+			return true
+		}
+		entry.version = version
+		return false
+	}
+	t.entries[key] = t.lru.PushFront(&orderingEntry{key: key, version: version})
+	if t.lru.Len() > t.maxKeys {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.entries, oldest.Value.(*orderingEntry).key)
+	}
+	return false
+}
+
+// ShouldDrop returns true if the event is out of order and should not be delivered to the driver.
+func (t *orderingTracker) ShouldDrop(evt *internal.DBChangeEvent) bool {
+	return t.Check(evt) && t.mode == OrderingModeEnforce
+}
+
+// resequencer holds the events of a batch when enforcing the ordering so the events for the same ordering key are
+// sent to the driver in the order of their versions instead of the order they were delivered in. The events of
+// different keys keep their places in the batch.
+type resequencer struct {
+	staged []groupedEvent
+}
+
+func newResequencer(mode string) *resequencer {
+	if mode != OrderingModeEnforce {
+		return nil
+	}
+	return &resequencer{}
+}
+
+// Stage holds the event until the batch is released.
+func (r *resequencer) Stage(event groupedEvent) {
+	r.staged = append(r.staged, event)
+}
+
+// Len returns the number of staged events.
+func (r *resequencer) Len() int {
+	return len(r.staged)
+}
+
+// Release returns the staged events with the events of each key sorted by their version, counting the events which
+// were delivered after a newer version of the same key as ordering violations, and clears the staged events.
+func (r *resequencer) Release() []groupedEvent {
+	events := r.staged
+	r.Reset()
+	positions := make(map[string][]int)
+	var keys []string
+	for i := range events {
+		if events[i].evt.GetVersion().IsZero() {
+			continue // an event without a version stays where it was delivered
+		}
+		key := events[i].evt.OrderingKey()
+		if _, ok := positions[key]; !ok {
+			keys = append(keys, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+	for _, key := range keys {
+		indexes := positions[key]
+		if len(indexes) < 2 {
+			continue
+		}
+		sorted := make([]groupedEvent, len(indexes))
+		latest := events[indexes[0]].evt.GetVersion()
+		for i, index := range indexes {
+			sorted[i] = events[index]
+			if version := sorted[i].evt.GetVersion(); version.Compare(latest) < 0 {
+				internal.OrderingViolations.WithLabelValues(sorted[i].evt.Table).Inc()
+			} else {
+				latest = version
+			}
+		}
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].evt.GetVersion().Compare(sorted[j].evt.GetVersion()) < 0
+		})
+		for i, index := range indexes {
+			events[index] = sorted[i]
+		}
+	}
+	return events
+}
+
+// Reset drops the staged events.
+func (r *resequencer) Reset() {
+	r.staged = nil
+}
@@ -0,0 +1,98 @@
+package consumer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventVersion(t *testing.T) {
+	evt := internal.DBChangeEvent{MVCCTimestamp: "1727812345678901234.0000000002"}
+	assert.Equal(t, internal.EventVersion{Wall: 1727812345678901234, Logical: 2}, evt.GetVersion())
+	evt = internal.DBChangeEvent{MVCCTimestamp: "1727812345678901234"}
+	assert.Equal(t, internal.EventVersion{Wall: 1727812345678901234}, evt.GetVersion())
+	evt = internal.DBChangeEvent{Timestamp: 1727812345678}
+	assert.Equal(t, internal.EventVersion{Wall: 1727812345678000000}, evt.GetVersion())
+	assert.True(t, (&internal.DBChangeEvent{}).GetVersion().IsZero())
+
+	a := internal.EventVersion{Wall: 1, Logical: 1}
+	b := internal.EventVersion{Wall: 1, Logical: 2}
+	c := internal.EventVersion{Wall: 2}
+	assert.Equal(t, -1, a.Compare(b))
+	assert.Equal(t, 1, b.Compare(a))
+	assert.Equal(t, -1, b.Compare(c))
+	assert.Equal(t, 0, c.Compare(c))
+}
+
+func TestOrderingKey(t *testing.T) {
+	assert.Equal(t, "order:o1", (&internal.DBChangeEvent{Table: "order", Key: []string{"CID", "o1"}}).OrderingKey())
+	assert.Equal(t, "order:o2", (&internal.DBChangeEvent{Table: "order", After: []byte(`{"id":"o2"}`)}).OrderingKey())
+}
+
+func TestKeyRouter(t *testing.T) {
+	router := newKeyRouter(8)
+	for i := 0; i < 100; i++ {
+		evt := &internal.DBChangeEvent{Table: "order", Key: []string{fmt.Sprintf("%d", i)}}
+		worker := router.Route(evt)
+		assert.True(t, worker >= 0 && worker < 8)
+		assert.Equal(t, worker, router.Route(&internal.DBChangeEvent{Table: "order", Key: []string{fmt.Sprintf("%d", i)}}))
+	}
+	assert.Equal(t, 0, newKeyRouter(0).Route(&internal.DBChangeEvent{Table: "order", Key: []string{"1"}}))
+}
+
+func TestOrderingTracker(t *testing.T) {
+	internal.MetricsReset()
+	tracker := newOrderingTracker(OrderingModeEnforce, 2)
+	newer := &internal.DBChangeEvent{Table: "order", Key: []string{"1"}, MVCCTimestamp: "2.0"}
+	older := &internal.DBChangeEvent{Table: "order", Key: []string{"1"}, MVCCTimestamp: "1.0"}
+	assert.False(t, tracker.ShouldDrop(newer))
+	assert.False(t, tracker.ShouldDrop(newer), "redelivery of same version should be allowed")
+	assert.True(t, tracker.ShouldDrop(older))
+	assert.Equal(t, float64(1), testutil.ToFloat64(internal.OrderingViolations.WithLabelValues("order")))
+
+	// a different key is not affected
+	assert.False(t, tracker.ShouldDrop(&internal.DBChangeEvent{Table: "customer", Key: []string{"1"}, MVCCTimestamp: "1.0"}))
+
+	// evict the oldest key once we exceed the max
+	assert.False(t, tracker.ShouldDrop(&internal.DBChangeEvent{Table: "vehicle", Key: []string{"1"}, MVCCTimestamp: "1.0"}))
+	assert.False(t, tracker.ShouldDrop(older))
+
+	detect := newOrderingTracker(OrderingModeDetect, 0)
+	assert.Equal(t, DefaultOrderingMaxKeys, detect.maxKeys)
+	assert.False(t, detect.ShouldDrop(newer))
+	assert.False(t, detect.ShouldDrop(older))
+	assert.Equal(t, float64(2), testutil.ToFloat64(internal.OrderingViolations.WithLabelValues("order")))
+}
+
+func TestResequencer(t *testing.T) {
+	internal.MetricsReset()
+	assert.Nil(t, newResequencer(OrderingModeDetect))
+	r := newResequencer(OrderingModeEnforce)
+	stage := func(table string, key string, version string) {
+		r.Stage(groupedEvent{evt: internal.DBChangeEvent{Table: table, Key: []string{key}, MVCCTimestamp: version}})
+	}
+	stage("order", "1", "3.0")
+	stage("order", "2", "2.0")
+	stage("order", "1", "1.0")
+	stage("order", "3", "")
+	stage("order", "1", "2.0")
+	assert.Equal(t, 5, r.Len())
+
+	var released []string
+	for _, event := range r.Release() {
+		released = append(released, event.evt.GetPrimaryKey()+"@"+event.evt.MVCCTimestamp)
+	}
+	assert.Equal(t, []string{"1@1.0", "2@2.0", "1@2.0", "3@", "1@3.0"}, released)
+	assert.Equal(t, float64(2), testutil.ToFloat64(internal.OrderingViolations.WithLabelValues("order")))
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestValidateOrderingMode(t *testing.T) {
+	assert.NoError(t, ValidateOrderingMode(""))
+	assert.NoError(t, ValidateOrderingMode(OrderingModeDetect))
+	assert.NoError(t, ValidateOrderingMode(OrderingModeEnforce))
+	assert.Error(t, ValidateOrderingMode("foo"))
+}
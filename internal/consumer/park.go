@@ -0,0 +1,287 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	parkExt              = ".json"
+	parkReleaseInterval  = time.Second // how often the parked events are checked for companies which can be processed again
+	throttleReasonParked = "parked"    // the company has parked events which are processed first
+)
+
+// parkedMessage is the event of a message which was parked.
+type parkedMessage struct {
+	CompanyID string `json:"companyId"`
+	retryMessage
+
+	path     string
+	pipeline int
+}
+
+type parkKey struct {
+	companyID string
+	pipeline  int
+}
+
+// companyPark holds the events of the companies which are over their quota or paused on disk so their messages are
+// acked right away. A message which is nacked to be redelivered later uses up one of its deliveries, counts against the
+// max ack pending until it's acked, and can be redelivered after a newer event for the same record. The events of a
+// company are parked in the order they were delivered and while a company has parked events its new events are parked
+// behind them, so they're replayed in order once the company can be processed again. The park is shared with the
+// pipelines and the events are parked by the pipeline they're routed to, so each pipeline replays its own.
+type companyPark struct {
+	dir    string
+	lock   sync.Mutex
+	queues map[parkKey][]*parkedMessage
+	seqs   map[uint64]bool // the stream sequences which are parked so a redelivery isn't parked twice
+	count  int
+}
+
+// newCompanyPark returns the park for the consumer in dir or nil if dir is empty. The events parked before a restart
+// were already acked so they're loaded in the order they were parked, and route returns their pipeline.
+func newCompanyPark(dir string, name string, route func(msg *parkedMessage) int) (*companyPark, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	p := &companyPark{
+		dir:    filepath.Join(dir, name),
+		queues: make(map[parkKey][]*parkedMessage),
+		seqs:   make(map[uint64]bool),
+	}
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating park directory: %w", err)
+	}
+	files, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading park directory: %w", err)
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), parkExt) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn := filepath.Join(p.dir, name)
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading parked event: %w", err)
+		}
+		var msg parkedMessage
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return nil, fmt.Errorf("error decoding parked event %s: %w", name, err)
+		}
+		msg.path = fn
+		if route != nil {
+			msg.pipeline = route(&msg)
+		}
+		p.push(&msg)
+	}
+	return p, nil
+}
+
+func (p *companyPark) push(msg *parkedMessage) {
+	key := parkKey{msg.CompanyID, msg.pipeline}
+	p.queues[key] = append(p.queues[key], msg)
+	p.seqs[msg.Sequence] = true
+	p.count++
+	internal.ParkedEvents.Inc()
+}
+
+// add saves the event of the company which was routed to the pipeline at the end of the company's parked events.
+func (p *companyPark) add(pipeline int, companyID string, msg retryMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if msg.Sequence > 0 && p.seqs[msg.Sequence] {
+		return nil // a redelivery of a message which was parked but not acked
+	}
+	parked := &parkedMessage{CompanyID: companyID, retryMessage: msg, pipeline: pipeline}
+	parked.path = filepath.Join(p.dir, fmt.Sprintf("%020d-%d%s", time.Now().UnixNano(), msg.Sequence, parkExt))
+	// write to a temp file and rename so a partially written event is never read
+	tmp := parked.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(util.JSONStringify(parked)), 0600); err != nil {
+		return fmt.Errorf("error writing parked event: %w", err)
+	}
+	if err := os.Rename(tmp, parked.path); err != nil {
+		return fmt.Errorf("error renaming parked event: %w", err)
+	}
+	p.push(parked)
+	return nil
+}
+
+// has returns true if the company has parked events for the pipeline.
+func (p *companyPark) has(companyID string, pipeline int) bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.queues[parkKey{companyID, pipeline}]) > 0
+}
+
+// waiting returns true if there are parked events for the pipeline.
+func (p *companyPark) waiting(pipeline int) bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key := range p.queues {
+		if key.pipeline == pipeline {
+			return true
+		}
+	}
+	return false
+}
+
+// companies returns the companies with parked events for the pipeline sorted by id.
+func (p *companyPark) companies(pipeline int) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var res []string
+	for key := range p.queues {
+		if key.pipeline == pipeline {
+			res = append(res, key.companyID)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// peek returns up to n of the oldest parked events of the company for the pipeline without removing them.
+func (p *companyPark) peek(companyID string, pipeline int, n int) []*parkedMessage {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	queue := p.queues[parkKey{companyID, pipeline}]
+	return append(make([]*parkedMessage, 0, min(n, len(queue))), queue[:min(n, len(queue))]...)
+}
+
+// remove deletes the oldest n parked events of the company for the pipeline once they were replayed.
+func (p *companyPark) remove(companyID string, pipeline int, n int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := parkKey{companyID, pipeline}
+	queue := p.queues[key]
+	n = min(n, len(queue))
+	for _, msg := range queue[:n] {
+		if err := os.Remove(msg.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing parked event: %w", err)
+		}
+		delete(p.seqs, msg.Sequence)
+		p.count--
+		internal.ParkedEvents.Dec()
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(p.queues, key)
+	} else {
+		p.queues[key] = queue
+	}
+	return nil
+}
+
+// len returns the number of parked events.
+func (p *companyPark) len() int {
+	if p == nil {
+		return 0
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.count
+}
+
+// throttled returns the reason and true if the events of the company are held back, either because it's over its quota
+// or paused, or because it has parked events which must be processed first.
+func (c *Consumer) throttled(companyID string) (string, bool) {
+	if c.parked.has(companyID, c.index) {
+		return throttleReasonParked, true
+	}
+	ok, reason := c.tenants.Allow(companyID)
+	return reason, !ok
+}
+
+// park saves the event of a company which is throttled and acks its message so it's replayed once the company can be
+// processed again.
+func (c *Consumer) park(logger logger.Logger, msg jetstream.Msg, buf []byte, companyID string, reason string) error {
+	parked := retryMessage{Subject: msg.Subject(), MsgID: msg.Headers().Get(nats.MsgIdHdr), Data: buf}
+	if md, err := msg.Metadata(); err == nil {
+		parked.Sequence = md.Sequence.Stream
+	}
+	if err := c.parked.add(c.index, companyID, parked); err != nil {
+		return err
+	}
+	logger.Trace("parked event of company %s (%s)", companyID, reason)
+	c.skip(logger, msg)
+	internal.CompanyThrottled.WithLabelValues(companyID, reason).Inc()
+	return nil
+}
+
+// releaseParked replays the parked events of the companies which can be processed again, as many as their quota allows
+// up to a batch at a time, and removes them once they're flushed. The pending events are flushed first since the
+// parked events are flushed on their own. It returns true if the bufferer should stop.
+func (c *Consumer) releaseParked() bool {
+	if c.parked == nil || time.Since(c.parkReleased) < parkReleaseInterval || !c.parked.waiting(c.index) {
+		return false
+	}
+	c.parkReleased = time.Now()
+	if (c.backpressure != nil && c.backpressure.active) || (c.groups != nil && c.groups.Len() > 0) {
+		return false // a transaction which is being staged isn't processed yet so it can't be flushed
+	}
+	for _, companyID := range c.parked.companies(c.index) {
+		parked := c.parked.peek(companyID, c.index, c.maxBatchSize())
+		var n int
+		for n < len(parked) {
+			if ok, _ := c.tenants.Allow(companyID); !ok {
+				break
+			}
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if len(c.pending) > 0 && c.flush(c.logger) {
+			return true
+		}
+		entry := &retryEntry{}
+		for _, msg := range parked[:n] {
+			var evt internal.DBChangeEvent
+			if err := json.Unmarshal(msg.Data, &evt); err == nil {
+				log := c.logger.With(map[string]any{"msgId": msg.MsgID, "subject": msg.Subject, "sid": msg.Sequence})
+				if skip, reason := c.shouldSkip(log, &evt); skip {
+					log.Debug("skipping parked event (%s)", reason)
+					internal.SkippedEvents.WithLabelValues(evt.Table, reason).Inc()
+					continue
+				}
+			}
+			entry.Messages = append(entry.Messages, msg.retryMessage)
+		}
+		if len(entry.Messages) > 0 {
+			if err := c.replay(entry); err != nil {
+				c.handleError(err)
+				return true
+			}
+			internal.CompanyEvents.WithLabelValues(companyID).Add(float64(len(entry.Messages)))
+		}
+		if err := c.parked.remove(companyID, c.index, n); err != nil {
+			// the events are replayed again after a restart which the drivers tolerate as a duplicate
+			c.logger.Error("%s", err)
+		}
+		c.logger.Debug("released %d parked events of company %s", n, companyID)
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompanyPark(t *testing.T) {
+	internal.MetricsReset()
+	park, err := newCompanyPark("", "eds-test", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, park)
+	assert.False(t, park.has("A", 0))
+
+	dir := t.TempDir()
+	park, err = newCompanyPark(dir, "eds-test", nil)
+	assert.NoError(t, err)
+	for i, companyID := range []string{"A", "B", "A", "A"} {
+		assert.NoError(t, park.add(0, companyID, retryMessage{Subject: "dbchange.order.INSERT." + companyID, Sequence: uint64(i + 1), Data: []byte("{}")}))
+	}
+	assert.NoError(t, park.add(0, "A", retryMessage{Sequence: 1, Data: []byte("{}")}), "a redelivery isn't parked twice")
+	assert.Equal(t, 4, park.len())
+	assert.Equal(t, float64(4), testutil.ToFloat64(internal.ParkedEvents))
+	assert.True(t, park.has("A", 0))
+	assert.False(t, park.has("A", 1))
+	assert.True(t, park.waiting(0))
+	assert.False(t, park.waiting(1))
+	assert.Equal(t, []string{"A", "B"}, park.companies(0))
+
+	parked := park.peek("A", 0, 2)
+	assert.Len(t, parked, 2)
+	assert.Equal(t, uint64(1), parked[0].Sequence)
+	assert.Equal(t, uint64(3), parked[1].Sequence)
+	assert.NoError(t, park.remove("A", 0, 2))
+	assert.Equal(t, 2, park.len())
+
+	// the parked events are loaded in order after a restart and routed again
+	internal.MetricsReset()
+	park, err = newCompanyPark(dir, "eds-test", func(msg *parkedMessage) int { return 1 })
+	assert.NoError(t, err)
+	assert.Equal(t, 2, park.len())
+	assert.Equal(t, float64(2), testutil.ToFloat64(internal.ParkedEvents))
+	assert.False(t, park.waiting(0))
+	parked = park.peek("A", 1, 10)
+	assert.Len(t, parked, 1)
+	assert.Equal(t, uint64(4), parked[0].Sequence)
+	assert.Equal(t, "dbchange.order.INSERT.A", parked[0].Subject)
+	assert.NoError(t, park.remove("A", 1, 1))
+	assert.NoError(t, park.remove("B", 1, 1))
+	files, err := os.ReadDir(filepath.Join(dir, "eds-test"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestParkPausedCompany(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		internal.MetricsReset()
+		var lock sync.Mutex
+		var processed []string
+		dir := t.TempDir()
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					lock.Lock()
+					defer lock.Unlock()
+					processed = append(processed, event.ID)
+					return false, nil
+				},
+			},
+			URL:               natsurl,
+			ParkDir:           dir,
+			MaxDeliver:        2,
+			MinPendingLatency: time.Millisecond,
+			MaxPendingLatency: 10 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		consumer.PauseCompany("A")
+
+		for i, companyID := range []string{"A", "B", "A", "A"} {
+			cid := companyID
+			evt := internal.DBChangeEvent{ID: fmt.Sprintf("%s%d", companyID, i), Table: "order", Operation: "UPDATE", CompanyID: &cid, Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), "dbchange.order.UPDATE."+companyID+".LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+
+		// the events of the paused company are acked so they don't use up their deliveries or hold back the others
+		assert.Eventually(t, func() bool {
+			info, err := consumer.jsconn.Info(context.Background())
+			return err == nil && info.AckFloor.Stream == 4 && info.NumAckPending == 0 && info.NumRedelivered == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, []string{"B1"}, processed)
+		lock.Unlock()
+		assert.Equal(t, 3, consumer.parked.len())
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.CompanyThrottled.WithLabelValues("A", throttleReasonPaused)))
+		assert.Equal(t, float64(2), testutil.ToFloat64(internal.CompanyThrottled.WithLabelValues("A", throttleReasonParked)), "parked behind the first")
+
+		// waiting longer than the redeliveries would have taken doesn't process them
+		time.Sleep(2 * parkReleaseInterval)
+		lock.Lock()
+		assert.Equal(t, []string{"B1"}, processed)
+		lock.Unlock()
+
+		consumer.UnpauseCompany("A")
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(processed) == 4
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, []string{"B1", "A0", "A2", "A3"}, processed)
+		lock.Unlock()
+		assert.Equal(t, 0, consumer.parked.len())
+		assert.Equal(t, float64(0), testutil.ToFloat64(internal.ParkedEvents))
+		files, err := os.ReadDir(filepath.Join(dir, consumer.Name()))
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
+}
@@ -0,0 +1,294 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/errcode"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	PipelineShardTable = "table" // events are sharded by table so each table is written by a single pipeline
+	PipelineShardKey   = "key"   // events are sharded by the primary key so the events of a busy table are spread across the pipelines
+)
+
+// ValidatePipelineShard returns an error if the pipeline sharding is not valid.
+func ValidatePipelineShard(shard string) error {
+	switch shard {
+	case "", PipelineShardTable, PipelineShardKey:
+		return nil
+	}
+	return fmt.Errorf("unknown pipeline shard: %s (must be one of: %s, %s)", shard, PipelineShardTable, PipelineShardKey)
+}
+
+// keyFromSubject returns the primary key of the subject which is everything after the schema.
+func keyFromSubject(subject string) string {
+	parts := strings.SplitN(subject, ".", 7)
+	if len(parts) < 7 {
+		return subject
+	}
+	return parts[6]
+}
+
+// pipelineRouter picks the pipeline of a message so that all the messages for the same table, or for the same ordering
+// key when sharding by key, are handled by the same pipeline in the order they were delivered.
+type pipelineRouter struct {
+	pipelines int
+	shard     string
+	groups    map[string]string // the first table of the flush group of each table in a flush group
+	keys      *keyRouter
+}
+
+func newPipelineRouter(pipelines int, shard string, groups [][]string) *pipelineRouter {
+	r := &pipelineRouter{pipelines: pipelines, shard: shard, groups: make(map[string]string), keys: newKeyRouter(pipelines)}
+	for _, group := range groups {
+		for _, table := range group {
+			r.groups[table] = group[0]
+		}
+	}
+	return r
+}
+
+// RouteTable returns the pipeline of the table when sharding by table. The tables of a flush group share a pipeline
+// so their transactions are still committed together.
+func (r *pipelineRouter) RouteTable(table string) int {
+	if first, ok := r.groups[table]; ok {
+		table = first
+	}
+	return util.Modulo(table, r.pipelines)
+}
+
+// RouteMsg returns the pipeline of the message. When sharding by key the event is decoded so it's routed by its ordering
+// key, which the subject may not match, and the subject is used if it can't be decoded so the pipeline reports it.
+func (r *pipelineRouter) RouteMsg(msg jetstream.Msg) int {
+	if r.shard == PipelineShardKey {
+		if buf, err := util.DecodeNatsData(msg.Headers(), msg.Data()); err == nil {
+			return r.routeEvent(msg.Subject(), buf)
+		}
+	}
+	return r.Route(msg.Subject())
+}
+
+// routeEvent returns the pipeline of the decoded event of a message, such as a parked event.
+func (r *pipelineRouter) routeEvent(subject string, buf []byte) int {
+	if r.shard == PipelineShardKey {
+		var evt internal.DBChangeEvent
+		if err := json.Unmarshal(buf, &evt); err == nil {
+			return r.keys.Route(&evt)
+		}
+	}
+	return r.Route(subject)
+}
+
+// Route returns the pipeline of the message subject.
+func (r *pipelineRouter) Route(subject string) int {
+	table := tableFromSubject(subject)
+	if r.shard == PipelineShardKey {
+		return util.Modulo(table+":"+keyFromSubject(subject), r.pipelines)
+	}
+	return r.RouteTable(table)
+}
+
+// createPipelines creates the pipelines which the events are sharded into. Each pipeline has its own instance of the
+// driver, pending buffer and flush cycle while the checks which aren't per table, such as the tenants and the
+// ordering, are shared with the consumer.
+func (c *Consumer) createPipelines(config ConsumerConfig) error {
+	shard := config.PipelineShard
+	if shard == "" {
+		shard = PipelineShardTable
+	}
+	if err := ValidatePipelineShard(shard); err != nil {
+		return err
+	}
+	if config.NewPipelineDriver == nil {
+		return fmt.Errorf("a pipeline driver is required to use %d pipelines", config.Pipelines)
+	}
+	// acking a message acks the messages before it which could still be processed by another pipeline
+	if config.AckAll {
+		return fmt.Errorf("the ack all policy can't be used with %d pipelines", config.Pipelines)
+	}
+	if shard == PipelineShardKey {
+		// the events for a table are processed by every pipeline so they could migrate the same table at once
+		if c.supportsMigration {
+			return fmt.Errorf("the %s pipeline shard can't be used with a driver which supports migrations", shard)
+		}
+		// a transaction can't be committed together when its events are in different pipelines
+		if len(config.FlushGroups) > 0 {
+			return fmt.Errorf("the %s pipeline shard can't be used with flush groups", shard)
+		}
+	}
+	c.router = newPipelineRouter(config.Pipelines, shard, config.FlushGroups)
+	for i := 0; i < config.Pipelines; i++ {
+		driver, err := config.NewPipelineDriver()
+		if err != nil {
+			c.stopPipelineDrivers()
+			return fmt.Errorf("error creating driver for pipeline %d: %w", i, err)
+		}
+		if p, ok := driver.(internal.DriverSessionHandler); ok {
+			p.SetSessionID(c.sessionID)
+		}
+		p := &Consumer{
+			ctx:                  c.ctx,
+			parent:               c,
+			index:                i,
+			max:                  c.max,
+			driver:               driver,
+			logger:               c.logger.WithPrefix(fmt.Sprintf("[pipeline-%d]", i)),
+			buffer:               make(chan jetstream.Msg, c.max),
+			pending:              make([]jetstream.Msg, 0),
+			subError:             c.subError,
+			refreshes:            make(chan schemaRefresh),
+			drains:               make(chan chan error),
+			tableTimestamps:      c.tableTimestamps,
+			validator:            c.validator,
+			quarantineDir:        c.quarantineDir,
+			maxEventSize:         c.maxEventSize,
+			tenants:              c.tenants,
+			maxDeliver:           c.maxDeliver,
+			redeliveryBackoff:    c.redeliveryBackoff,
+			pausedTables:         c.pausedTables,
+			usage:                c.usage.Clone(),
+			minPendingLatency:    c.minPendingLatency,
+			maxPendingLatency:    c.maxPendingLatency,
+			emptyBufferPauseTime: c.emptyBufferPauseTime,
+			version:              c.version,
+			flushPolicy:          c.flushPolicy,
+			ordering:             c.ordering,
+			supportsMigration:    c.supportsMigration,
+			registry:             c.registry,
+			onNewTable:           c.onNewTable,
+			repairSchemaDrift:    c.repairSchemaDrift,
+			groups:               newFlushGrouper(config.FlushGroups),
+			fields:               c.fields,
+			locationIDs:          c.locationIDs,
+			retries:              c.retries,
+			hooks:                c.hooks,
+			limit:                c.limit,
+		}
+		if batcher, ok := driver.(internal.DriverBatchProcessor); ok {
+			p.batcher = batcher
+		}
+		if c.resequence != nil {
+			p.resequence = &resequencer{}
+		}
+		c.pipelines = append(c.pipelines, p)
+	}
+	c.logger.Info("sharding events by %s into %d pipelines", shard, config.Pipelines)
+	return nil
+}
+
+// startPipelines starts the bufferer of each pipeline.
+func (c *Consumer) startPipelines() {
+	for _, p := range c.pipelines {
+		go p.bufferer()
+	}
+}
+
+// dispatch checks the sequence of the message and hands it to the pipeline it's routed to. It returns true if the
+// bufferer should stop.
+func (c *Consumer) dispatch(msg jetstream.Msg, md *jetstream.MsgMetadata) bool {
+	if md.Sequence.Consumer != c.sequence+1 {
+		internal.PendingEvents.Dec()
+		c.pending = append(c.pending, msg)
+		c.handleError(errcode.Errorf(errcode.SequenceGap, "out of order sequence: %d, expected: %d", md.Sequence.Consumer, c.sequence+1))
+		return true
+	}
+	c.sequence = md.Sequence.Consumer
+	p := c.pipelines[c.router.RouteMsg(msg)]
+	select {
+	case p.buffer <- msg:
+		return false
+	case <-c.ctx.Done():
+		if err := msg.Nak(); err != nil {
+			c.logger.Error("error nacking msg %s: %s", msg.Headers().Get(nats.MsgIdHdr), err)
+		}
+		c.limit.release(msg)
+		internal.PendingEvents.Dec()
+		return true
+	}
+}
+
+// refreshPipelines applies the migrations for the tables on the pipelines which write to them so a table isn't
+// migrated while its pipeline is processing events.
+func (c *Consumer) refreshPipelines(tables []string) ([]string, error) {
+	byPipeline := make(map[int][]string)
+	for _, table := range tables {
+		i := c.router.RouteTable(table)
+		byPipeline[i] = append(byPipeline[i], table)
+	}
+	var migrated []string
+	for i, tables := range byPipeline {
+		res, err := c.pipelines[i].requestRefresh(tables)
+		migrated = append(migrated, res...)
+		if err != nil {
+			sort.Strings(migrated)
+			return migrated, err
+		}
+	}
+	sort.Strings(migrated)
+	return migrated, nil
+}
+
+// buffered returns the number of messages waiting to be processed by the consumer and its pipelines.
+func (c *Consumer) buffered() int {
+	count := len(c.buffer)
+	for _, p := range c.pipelines {
+		count += len(p.buffer)
+	}
+	return count
+}
+
+// flushLatency returns how long the last flush took, the slowest of the last flushes of the pipelines when sharded.
+func (c *Consumer) flushLatency() time.Duration {
+	latency := time.Duration(c.lastFlushDuration.Load())
+	for _, p := range c.pipelines {
+		if l := time.Duration(p.lastFlushDuration.Load()); l > latency {
+			latency = l
+		}
+	}
+	return latency
+}
+
+// resetFlushLatency forgets the last flush latency of the consumer and its pipelines.
+func (c *Consumer) resetFlushLatency() {
+	c.lastFlushDuration.Store(0)
+	for _, p := range c.pipelines {
+		p.lastFlushDuration.Store(0)
+	}
+}
+
+// flushPipelines flushes the pending events of each pipeline before stopping.
+func (c *Consumer) flushPipelines() {
+	for _, p := range c.pipelines {
+		p.lock.Lock()
+		p.stopping = true
+		p.lock.Unlock()
+		p.flush(p.logger)
+	}
+}
+
+// stopPipelines waits for the bufferer of each pipeline to stop once the context is cancelled and then stops their drivers.
+func (c *Consumer) stopPipelines() {
+	for _, p := range c.pipelines {
+		p.waitGroup.Wait()
+		p.nackEverything()
+	}
+	c.stopPipelineDrivers()
+}
+
+func (c *Consumer) stopPipelineDrivers() {
+	for i, p := range c.pipelines {
+		if d, ok := p.driver.(interface{ Stop() error }); ok {
+			if err := d.Stop(); err != nil {
+				c.logger.Error("error stopping driver for pipeline %d: %s", i, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineRouter(t *testing.T) {
+	r := newPipelineRouter(4, PipelineShardTable, [][]string{{"order", "orderLineItem"}})
+	assert.Equal(t, r.Route("dbchange.order.INSERT.CID.LID.PUBLIC.1"), r.Route("dbchange.order.UPDATE.CID.LID.PUBLIC.2"))
+	assert.Equal(t, r.Route("dbchange.order.INSERT.CID.LID.PUBLIC.1"), r.Route("dbchange.orderLineItem.INSERT.CID.LID.PUBLIC.3"))
+	assert.Equal(t, r.RouteTable("order"), r.RouteTable("orderLineItem"))
+
+	r = newPipelineRouter(4, PipelineShardKey, nil)
+	assert.Equal(t, r.Route("dbchange.order.INSERT.CID.LID.PUBLIC.1"), r.Route("dbchange.order.UPDATE.CID2.LID.PUBLIC.1"))
+	routes := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		routes[r.Route(fmt.Sprintf("dbchange.order.INSERT.CID.LID.PUBLIC.%d", i))] = true
+	}
+	assert.Len(t, routes, 4)
+
+	assert.Equal(t, "1", keyFromSubject("dbchange.order.INSERT.CID.LID.PUBLIC.1"))
+	assert.Equal(t, "1.2", keyFromSubject("dbchange.order.INSERT.CID.LID.PUBLIC.1.2"))
+	assert.NoError(t, ValidatePipelineShard(PipelineShardKey))
+	assert.ErrorContains(t, ValidatePipelineShard("company"), "unknown pipeline shard")
+}
+
+func TestPipelines(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var lock sync.Mutex
+		processed := make(map[string][]string) // the keys of the events processed by each driver for a table
+		drivers := make(map[string]int)        // the driver which processed each table
+		var flushed int
+		var count int
+
+		newDriver := func() (Driver, error) {
+			lock.Lock()
+			id := count
+			count++
+			lock.Unlock()
+			return &mockDriver{
+				maxBatchSize: 1,
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					lock.Lock()
+					defer lock.Unlock()
+					if driver, ok := drivers[event.Table]; ok && driver != id {
+						return false, fmt.Errorf("table %s processed by driver %d and %d", event.Table, driver, id)
+					}
+					drivers[event.Table] = id
+					processed[event.Table] = append(processed[event.Table], event.Key[0])
+					return false, nil
+				},
+				flush: func(logger logger.Logger) error {
+					lock.Lock()
+					flushed++
+					lock.Unlock()
+					return nil
+				},
+			}, nil
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:           context.Background(),
+			Logger:            logger.NewTestLogger(),
+			Driver:            &mockDriver{},
+			URL:               natsurl,
+			Pipelines:         3,
+			NewPipelineDriver: newDriver,
+		})
+		assert.NoError(t, err)
+		assert.Len(t, consumer.pipelines, 3)
+
+		tables := []string{"order", "customer", "vehicle", "labor", "part"}
+		for i := 0; i < 10; i++ {
+			for _, table := range tables {
+				var evt internal.DBChangeEvent
+				evt.Table = table
+				evt.Operation = "INSERT"
+				evt.Key = []string{fmt.Sprintf("%d", i)}
+				evt.Timestamp = time.Now().UnixMilli()
+				_, err = js.Publish(context.Background(), fmt.Sprintf("dbchange.%s.INSERT.CID.LID.PUBLIC.%d", table, i), []byte(util.JSONStringify(evt)))
+				assert.NoError(t, err)
+			}
+		}
+
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return flushed == 50
+		}, 5*time.Second, 10*time.Millisecond)
+
+		lock.Lock()
+		for _, table := range tables {
+			assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, processed[table], table)
+		}
+		lock.Unlock()
+
+		assert.NoError(t, consumer.Stop())
+		select {
+		case err := <-consumer.Error():
+			assert.NoError(t, err)
+		default:
+		}
+	})
+}
+
+func TestPipelinesOrderingKey(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var lock sync.Mutex
+		processed := make(map[string][]int) // the versions of the events processed for each ordering key
+		drivers := make(map[string]int)     // the driver which processed each ordering key
+		inflight := make(map[string]bool)
+		var count, total int
+
+		newDriver := func() (Driver, error) {
+			lock.Lock()
+			id := count
+			count++
+			lock.Unlock()
+			return &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					key := event.OrderingKey()
+					lock.Lock()
+					if inflight[key] {
+						lock.Unlock()
+						return false, fmt.Errorf("%s processed concurrently", key)
+					}
+					if driver, ok := drivers[key]; ok && driver != id {
+						lock.Unlock()
+						return false, fmt.Errorf("%s processed by driver %d and %d", key, driver, id)
+					}
+					inflight[key] = true
+					drivers[key] = id
+					lock.Unlock()
+					time.Sleep(time.Millisecond)
+					lock.Lock()
+					defer lock.Unlock()
+					inflight[key] = false
+					var version int
+					fmt.Sscanf(event.MVCCTimestamp, "%d", &version)
+					processed[key] = append(processed[key], version)
+					total++
+					return false, nil
+				},
+			}, nil
+		}
+
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:           context.Background(),
+			Logger:            logger.NewTestLogger(),
+			Driver:            &mockDriver{},
+			URL:               natsurl,
+			Pipelines:         4,
+			PipelineShard:     PipelineShardKey,
+			NewPipelineDriver: newDriver,
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		// the key of the subject doesn't match the event so it can't be used to route it
+		for i := 0; i < 100; i++ {
+			evt := internal.DBChangeEvent{
+				Table:         "order",
+				Operation:     "UPDATE",
+				Key:           []string{"CID", fmt.Sprintf("o%d", i%5)},
+				Timestamp:     time.Now().UnixMilli(),
+				MVCCTimestamp: fmt.Sprintf("%d", i),
+			}
+			_, err = js.Publish(context.Background(), fmt.Sprintf("dbchange.order.UPDATE.CID.LID.PUBLIC.%d", i), []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return total == 100
+		}, 5*time.Second, 10*time.Millisecond)
+
+		lock.Lock()
+		assert.Len(t, processed, 5)
+		for key, versions := range processed {
+			assert.Len(t, versions, 20, key)
+			assert.IsIncreasing(t, versions, key)
+		}
+		lock.Unlock()
+		select {
+		case err := <-consumer.Error():
+			assert.NoError(t, err)
+		default:
+		}
+	})
+}
+
+func TestPipelinesKeyShardWithMigrations(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		_, err := NewConsumer(ConsumerConfig{
+			Context:       context.Background(),
+			Logger:        logger.NewTestLogger(),
+			Driver:        &mockDriverWithMigration{},
+			URL:           natsurl,
+			Pipelines:     2,
+			PipelineShard: PipelineShardKey,
+			NewPipelineDriver: func() (Driver, error) {
+				return &mockDriverWithMigration{}, nil
+			},
+		})
+		assert.ErrorContains(t, err, "can't be used with a driver which supports migrations")
+	})
+}
+
+type mockStoppableDriver struct {
+	mockDriver
+	stopped *atomic.Int32
+}
+
+func (m *mockStoppableDriver) Stop() error {
+	m.stopped.Add(1)
+	return nil
+}
+
+func TestPipelinesStoppedOnError(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, _ *server.Server) {
+		var stopped atomic.Int32
+		_, err := NewConsumer(ConsumerConfig{
+			Context:    context.Background(),
+			Logger:     logger.NewTestLogger(),
+			Driver:     &mockDriver{},
+			URL:        natsurl,
+			Pipelines:  2,
+			JournalDir: t.TempDir(),
+			NewPipelineDriver: func() (Driver, error) {
+				return &mockStoppableDriver{stopped: &stopped}, nil
+			},
+		})
+		assert.ErrorContains(t, err, "the journal can't be used with 2 pipelines")
+		assert.Equal(t, int32(2), stopped.Load(), "the pipeline drivers are stopped when the consumer can't be created")
+	})
+}
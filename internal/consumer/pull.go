@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	DefaultPullExpiry      = time.Minute // how long a pull request waits for messages
+	DefaultPullMaxMessages = 4_096       // the maximum number of messages buffered by the client for a pull
+
+	minPullExpiry    = time.Second
+	minPullHeartbeat = 500 * time.Millisecond
+	maxPullHeartbeat = 30 * time.Second
+)
+
+// PullOptions control how messages are pulled from the server. Smaller pulls use less memory on hosts which don't
+// have much while larger pulls help a destination which can keep up with a lot of messages.
+type PullOptions struct {
+	// Expiry is how long a pull request waits for messages. Defaults to DefaultPullExpiry.
+	Expiry time.Duration
+
+	// MaxMessages is the maximum number of messages buffered by the client. Defaults to DefaultPullMaxMessages and is
+	// ignored when MaxBytes is set.
+	MaxMessages int
+
+	// MaxBytes is the maximum size in bytes of the messages buffered by the client instead of a number of messages.
+	// Defaults to 0 which uses MaxMessages.
+	MaxBytes int
+
+	// Heartbeat is the interval of the idle heartbeats sent by the server for a pull which restart the pull when they
+	// are missed. Defaults to 0 which uses half of the expiry, up to 30 seconds.
+	Heartbeat time.Duration
+}
+
+// Validate returns an error if the options can't be used for a pull.
+func (o PullOptions) Validate() error {
+	expiry := o.Expiry
+	if expiry == 0 {
+		expiry = DefaultPullExpiry
+	}
+	if expiry < minPullExpiry {
+		return fmt.Errorf("pull expiry must be at least %v", minPullExpiry)
+	}
+	if o.MaxMessages < 0 {
+		return fmt.Errorf("pull max messages must not be negative")
+	}
+	if o.MaxBytes < 0 {
+		return fmt.Errorf("pull max bytes must not be negative")
+	}
+	if o.Heartbeat != 0 {
+		if o.Heartbeat < minPullHeartbeat || o.Heartbeat > maxPullHeartbeat {
+			return fmt.Errorf("pull heartbeat must be between %v and %v", minPullHeartbeat, maxPullHeartbeat)
+		}
+		if o.Heartbeat > expiry/2 {
+			return fmt.Errorf("pull heartbeat (%v) must not be more than half of the pull expiry (%v)", o.Heartbeat, expiry)
+		}
+	}
+	return nil
+}
+
+// String returns a summary of the options with the defaults applied.
+func (o PullOptions) String() string {
+	o = o.withDefaults()
+	heartbeat := "default"
+	if o.Heartbeat > 0 {
+		heartbeat = o.Heartbeat.String()
+	}
+	if o.MaxBytes > 0 {
+		return fmt.Sprintf("expiry %v, max bytes %d, heartbeat %s", o.Expiry, o.MaxBytes, heartbeat)
+	}
+	return fmt.Sprintf("expiry %v, max messages %d, heartbeat %s", o.Expiry, o.MaxMessages, heartbeat)
+}
+
+func (o PullOptions) withDefaults() PullOptions {
+	if o.Expiry == 0 {
+		o.Expiry = DefaultPullExpiry
+	}
+	if o.MaxMessages == 0 {
+		o.MaxMessages = DefaultPullMaxMessages
+	}
+	return o
+}
+
+// consumeOpts returns the options for pulling messages. Only one of the max messages and max bytes can be set.
+func (o PullOptions) consumeOpts() []jetstream.PullConsumeOpt {
+	o = o.withDefaults()
+	opts := []jetstream.PullConsumeOpt{jetstream.PullExpiry(o.Expiry)}
+	if o.MaxBytes > 0 {
+		opts = append(opts, jetstream.PullMaxBytes(o.MaxBytes))
+	} else {
+		opts = append(opts, jetstream.PullMaxMessages(o.MaxMessages))
+	}
+	if o.Heartbeat > 0 {
+		opts = append(opts, jetstream.PullHeartbeat(o.Heartbeat))
+	}
+	return opts
+}
@@ -0,0 +1,25 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullOptionsValidate(t *testing.T) {
+	assert.NoError(t, PullOptions{}.Validate())
+	assert.NoError(t, PullOptions{Expiry: 10 * time.Second, MaxBytes: 1024 * 1024, Heartbeat: 5 * time.Second}.Validate())
+	assert.ErrorContains(t, PullOptions{Expiry: 100 * time.Millisecond}.Validate(), "pull expiry must be at least")
+	assert.ErrorContains(t, PullOptions{MaxMessages: -1}.Validate(), "pull max messages")
+	assert.ErrorContains(t, PullOptions{MaxBytes: -1}.Validate(), "pull max bytes")
+	assert.ErrorContains(t, PullOptions{Heartbeat: time.Minute}.Validate(), "must be between")
+	assert.ErrorContains(t, PullOptions{Expiry: 10 * time.Second, Heartbeat: 6 * time.Second}.Validate(), "half of the pull expiry")
+}
+
+func TestPullOptionsConsumeOpts(t *testing.T) {
+	assert.Len(t, PullOptions{}.consumeOpts(), 2)
+	assert.Len(t, PullOptions{MaxBytes: 1024, Heartbeat: time.Second}.consumeOpts(), 3)
+	assert.Equal(t, "expiry 1m0s, max messages 4096, heartbeat default", PullOptions{}.String())
+	assert.Equal(t, "expiry 10s, max bytes 1024, heartbeat 1s", PullOptions{Expiry: 10 * time.Second, MaxMessages: 10, MaxBytes: 1024, Heartbeat: time.Second}.String())
+}
@@ -0,0 +1,84 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+type quarantineRecord struct {
+	Rule        string                  `json:"rule"`
+	Message     string                  `json:"message"`
+	Quarantined time.Time               `json:"quarantined"`
+	Event       *internal.DBChangeEvent `json:"event,omitempty"`
+	Data        json.RawMessage         `json:"data,omitempty"`
+}
+
+// quarantine saves the event which failed a validation rule into the quarantine directory so it can be inspected and replayed later.
+func (c *Consumer) quarantine(evt *internal.DBChangeEvent, rerr *internal.ValidationRuleError) error {
+	if c.quarantineDir == "" {
+		return fmt.Errorf("no quarantine directory configured")
+	}
+	dir := filepath.Join(c.quarantineDir, evt.Table)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating quarantine directory: %w", err)
+	}
+	record := quarantineRecord{
+		Rule:        rerr.Rule,
+		Message:     rerr.Message,
+		Quarantined: time.Now(),
+		Event:       evt,
+	}
+	fn := filepath.Join(dir, fmt.Sprintf("%s_%s.json", evt.MVCCTimestamp, evt.ID))
+	if err := os.WriteFile(fn, []byte(util.JSONStringify(record)), 0600); err != nil {
+		return fmt.Errorf("error writing quarantine file: %w", err)
+	}
+	return nil
+}
+
+// quarantineOversized saves the raw payload of an event which is larger than the max event size into the quarantine
+// directory without decoding it, since decoding is what uses the memory.
+func (c *Consumer) quarantineOversized(table string, seq uint64, buf []byte) error {
+	if c.quarantineDir == "" {
+		return fmt.Errorf("no quarantine directory configured")
+	}
+	dir := filepath.Join(c.quarantineDir, table)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating quarantine directory: %w", err)
+	}
+	data := json.RawMessage(buf)
+	if !json.Valid(buf) {
+		data, _ = json.Marshal(string(buf)) // save it as a string so the record is still valid json
+	}
+	record := quarantineRecord{
+		Rule:        "max-event-size",
+		Message:     fmt.Sprintf("event size of %d bytes exceeds the maximum of %d bytes", len(buf), c.maxEventSize),
+		Quarantined: time.Now(),
+		Data:        data,
+	}
+	fn := filepath.Join(dir, fmt.Sprintf("%d_oversized.json", seq))
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating quarantine file: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(record); err != nil {
+		return fmt.Errorf("error writing quarantine file: %w", err)
+	}
+	return nil
+}
+
+// tableFromSubject returns the table from a dbchange subject such as dbchange.order.INSERT.cid.lid.PUBLIC.1
+func tableFromSubject(subject string) string {
+	parts := strings.Split(subject, ".")
+	if len(parts) < 2 || parts[1] == "" {
+		return "unknown"
+	}
+	return parts[1]
+}
@@ -0,0 +1,79 @@
+package consumer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"golang.org/x/time/rate"
+)
+
+const maxEventsPerSecondFormat = "rate or driver=rate" // the format of a max events per second flag value
+
+// ParseMaxEventsPerSecond parses a list of rates in the format rate or driver=rate where rate is the maximum number of
+// events per second sent to the driver and driver is the scheme of a driver such as snowflake, and returns the rate for
+// the scheme. A rate for the driver overrides a rate without a driver. Returns 0 when unlimited.
+func ParseMaxEventsPerSecond(values []string, scheme string) (float64, error) {
+	var res, override float64
+	for _, value := range values {
+		driver, limit, ok := strings.Cut(value, "=")
+		if !ok {
+			driver, limit = "", value
+		} else if driver == "" {
+			return 0, fmt.Errorf("invalid max events per second: %s (expected %s)", value, maxEventsPerSecondFormat)
+		}
+		val, err := strconv.ParseFloat(limit, 64)
+		if err != nil || val < 0 {
+			return 0, fmt.Errorf("invalid max events per second: %s (expected %s)", value, maxEventsPerSecondFormat)
+		}
+		switch driver {
+		case "":
+			res = val
+		case scheme:
+			override = val
+		}
+	}
+	if override > 0 {
+		return override, nil
+	}
+	return res, nil
+}
+
+// newRateLimiter returns the limiter for the events sent to the driver or nil if unlimited. The burst allows a second
+// of events so the events which were pulled together aren't spread out.
+func newRateLimiter(eventsPerSecond float64) *rate.Limiter {
+	if eventsPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(eventsPerSecond), max(int(eventsPerSecond), 1))
+}
+
+// rateLimited returns true while the rate limit is used up so the bufferer stops taking messages until the limiter lets
+// the next one through, without blocking the rest of its work. The time spent waiting is recorded once it's over.
+func (c *Consumer) rateLimited() bool {
+	if c.limiter == nil || c.parent != nil {
+		return false // the rate is for every pipeline so it's limited before the events are dispatched to them
+	}
+	if c.limiter.Tokens() >= 1 {
+		if !c.rateLimitStarted.IsZero() {
+			internal.RateLimitWait.Add(time.Since(c.rateLimitStarted).Seconds())
+			c.rateLimitStarted = time.Time{}
+		}
+		return false
+	}
+	if c.rateLimitStarted.IsZero() {
+		c.rateLimitStarted = time.Now()
+	}
+	return true
+}
+
+// rateLimitDelay returns how long until the limiter lets the next message through.
+func (c *Consumer) rateLimitDelay() time.Duration {
+	tokens := c.limiter.Tokens()
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / float64(c.limiter.Limit()) * float64(time.Second))
+}
@@ -0,0 +1,116 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMaxEventsPerSecond(t *testing.T) {
+	rate, err := ParseMaxEventsPerSecond(nil, "snowflake")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), rate)
+
+	rate, err = ParseMaxEventsPerSecond([]string{"1000", "snowflake=200.5"}, "snowflake")
+	assert.NoError(t, err)
+	assert.Equal(t, 200.5, rate)
+
+	rate, err = ParseMaxEventsPerSecond([]string{"snowflake=200", "1000"}, "postgres")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1000), rate)
+
+	rate, err = ParseMaxEventsPerSecond([]string{"snowflake=200"}, "postgres")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), rate)
+
+	for _, value := range []string{"fast", "-1", "=100", "snowflake=", "snowflake=fast"} {
+		_, err := ParseMaxEventsPerSecond([]string{value}, "snowflake")
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		internal.MetricsReset()
+		var processed atomic.Int32
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					processed.Add(1)
+					return false, nil
+				},
+			},
+			URL:                natsurl,
+			MaxEventsPerSecond: 20,
+			MinPendingLatency:  10 * time.Millisecond,
+			MaxPendingLatency:  50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		// a second of events is sent right away and the rest at the rate while pulling is paused
+		started := time.Now()
+		for i := 0; i < 30; i++ {
+			evt := internal.DBChangeEvent{ID: fmt.Sprint(i), Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+			_, err := js.PublishAsync("dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+		<-js.PublishAsyncComplete()
+		assert.Eventually(t, func() bool { return processed.Load() == 30 }, 5*time.Second, 10*time.Millisecond)
+		assert.GreaterOrEqual(t, time.Since(started), 400*time.Millisecond)
+		assert.Greater(t, testutil.ToFloat64(internal.RateLimitWait), float64(0))
+		assert.GreaterOrEqual(t, testutil.ToFloat64(internal.BackpressurePauses.WithLabelValues(BackpressureReasonRate)), float64(1))
+	})
+}
+
+func TestRateLimitDoesNotBlockFlush(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		internal.MetricsReset()
+		var processed, flushed atomic.Int32
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					processed.Add(1)
+					return false, nil
+				},
+				flush: func(logger logger.Logger) error {
+					flushed.Add(1)
+					return nil
+				},
+			},
+			URL:                natsurl,
+			MaxEventsPerSecond: 1,
+			MinPendingLatency:  10 * time.Millisecond,
+			MaxPendingLatency:  50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		for i := 0; i < 3; i++ {
+			evt := internal.DBChangeEvent{ID: fmt.Sprint(i), Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+
+		// the first event is flushed while the next one waits for the rate limit
+		assert.Eventually(t, func() bool { return flushed.Load() == 1 }, 500*time.Millisecond, 10*time.Millisecond)
+		assert.Equal(t, int32(1), processed.Load())
+		assert.Eventually(t, func() bool { return processed.Load() == 3 && flushed.Load() == 3 }, 5*time.Second, 10*time.Millisecond)
+		assert.Greater(t, testutil.ToFloat64(internal.RateLimitWait), float64(1))
+	})
+}
@@ -0,0 +1,170 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/errcode"
+)
+
+const (
+	DefaultReconnectTimeout = time.Minute * 5 // how long the command line tries to re-establish the consumer by default
+
+	reconnectMinWait = time.Second
+	reconnectMaxWait = time.Second * 30
+)
+
+// The results counted by NatsReconnects.
+const (
+	reconnectResultReconnected = "reconnected"
+	reconnectResultFailed      = "failed"
+)
+
+// reconnectBackoff returns how long to wait before the next attempt to re-establish the consumer.
+func reconnectBackoff(attempt int) time.Duration {
+	wait := reconnectMinWait
+	for i := 1; i < attempt && wait < reconnectMaxWait; i++ {
+		wait *= 2
+	}
+	return min(wait, reconnectMaxWait)
+}
+
+// handleDisconnect is called when the connection to the server is lost. The nats connection reconnects by itself, the
+// bufferer then re-establishes the jetstream consumer. Without a reconnect timeout the consumer is stopped instead so
+// the process is restarted.
+func (c *Consumer) handleDisconnect(err error) {
+	if c.isStopping() {
+		return
+	}
+	if err != nil {
+		c.logger.Error("nats disconnected: %s %s", c.connectedURL, err)
+	} else {
+		c.logger.Error("nats disconnected: %s", c.connectedURL)
+	}
+	internal.NatsDisconnects.Inc()
+	if c.reconnectTimeout > 0 {
+		select {
+		case c.reconnects <- struct{}{}:
+		default:
+		}
+		return
+	}
+	select {
+	case c.disconnected <- true:
+	default:
+	}
+	c.Stop()
+}
+
+// reconnect stops pulling until the consumer is re-established after the connection was lost and then resumes pulling
+// from the last acked message. The pending messages are kept and acked by the next flush, the messages which were
+// buffered but not processed are nacked so they're redelivered in order. It returns an error if the consumer couldn't
+// be re-established within the reconnect timeout or nil if the consumer was stopped in the meantime.
+func (c *Consumer) reconnect() error {
+	started := time.Now()
+	c.logger.Warn("re-establishing the consumer for up to %v", c.reconnectTimeout)
+	c.subscriberLock.Lock()
+	if c.subscriber != nil {
+		c.subscriber.Stop()
+		c.subscriber = nil
+	}
+	c.subscriberLock.Unlock()
+	c.nackBuffered()
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.reconnectTimeout)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		err := c.resubscribe(ctx)
+		if err == nil {
+			internal.NatsReconnects.WithLabelValues(reconnectResultReconnected).Inc()
+			c.logger.Info("consumer re-established after %v and %d attempt(s), resuming from sequence %d", time.Since(started), attempt, c.sequence)
+			return nil
+		}
+		wait := reconnectBackoff(attempt)
+		c.logger.Warn("error re-establishing the consumer (attempt %d), retrying in %v: %s", attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			if c.ctx.Err() != nil {
+				return nil
+			}
+			internal.NatsReconnects.WithLabelValues(reconnectResultFailed).Inc()
+			return errcode.New(errcode.NatsDisconnected, fmt.Errorf("error re-establishing the consumer within %v: %w", c.reconnectTimeout, err))
+		case <-time.After(wait):
+		}
+	}
+}
+
+// nackBuffered nacks the messages which were delivered before the connection was lost but not processed yet, including
+// the ones handed to the pipelines, the server redelivers them after the consumer is re-established.
+func (c *Consumer) nackBuffered() {
+	c.nackBuffer()
+	for _, p := range c.pipelines {
+		p.nackBuffer()
+	}
+}
+
+func (c *Consumer) nackBuffer() {
+	for {
+		select {
+		case msg := <-c.buffer:
+			if msg == nil {
+				return
+			}
+			internal.PendingEvents.Dec()
+			if err := msg.Nak(); err != nil {
+				c.logger.Debug("error nacking buffered msg %s: %s", msg.Headers().Get(nats.MsgIdHdr), err)
+			}
+			c.nacked(msg)
+			c.limit.release(msg)
+		default:
+			return
+		}
+	}
+}
+
+// resubscribe looks up the jetstream consumer again, creating it if the server lost it, and starts pulling unless the
+// consumer is paused. A lost consumer is created to start after the last acked message it was seen with, rather than
+// with its original deliver policy which would skip or replay the messages since, so the messages acked since then are
+// redelivered which the drivers tolerate as duplicates.
+func (c *Consumer) resubscribe(ctx context.Context) error {
+	if !c.conn.IsConnected() {
+		return nats.ErrDisconnected
+	}
+	config := c.jsconn.CachedInfo().Config
+	jsconn, err := c.js.Consumer(ctx, "dbchange", config.Durable)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		if floor := c.jsconn.CachedInfo().AckFloor.Stream; floor > 0 {
+			config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+			config.OptStartTime = nil
+			config.OptStartSeq = floor + 1
+			c.logger.Warn("consumer %s not found after reconnecting, creating it to start after the last acked message (%d)", config.Durable, floor)
+		} else {
+			c.logger.Warn("consumer %s not found after reconnecting, creating it", config.Durable)
+		}
+		jsconn, err = c.js.CreateOrUpdateConsumer(ctx, "dbchange", config)
+		if c.acks != nil {
+			c.acks = newAckFloor() // the messages which were outstanding on the lost consumer aren't redelivered
+		}
+	}
+	if err != nil {
+		return err
+	}
+	info, err := jsconn.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting consumer info: %w", err)
+	}
+	c.subscriberLock.Lock()
+	defer c.subscriberLock.Unlock()
+	c.jsconn = jsconn
+	// the messages after the last ack which were in-flight are redelivered with new sequences
+	c.sequence = info.Delivered.Consumer
+	if c.pauseStarted != nil || (c.backpressure != nil && c.backpressure.active) {
+		return nil
+	}
+	return c.subscribe()
+}
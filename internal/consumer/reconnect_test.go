@@ -0,0 +1,212 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, reconnectBackoff(1))
+	assert.Equal(t, 2*time.Second, reconnectBackoff(2))
+	assert.Equal(t, 16*time.Second, reconnectBackoff(5))
+	assert.Equal(t, reconnectMaxWait, reconnectBackoff(6))
+	assert.Equal(t, reconnectMaxWait, reconnectBackoff(100))
+}
+
+func TestReconnect(t *testing.T) {
+	port, err := util.GetFreePort()
+	assert.NoError(t, err)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir() // the stream and the consumer are kept across the restart
+	srv := natsserver.RunServer(&opts)
+	defer func() { srv.Shutdown() }()
+	natsurl := fmt.Sprintf("nats://localhost:%d", port)
+
+	publish := func(id string) {
+		t.Helper()
+		nc, err := nats.Connect(natsurl)
+		assert.NoError(t, err)
+		defer nc.Close()
+		js, err := jetstream.New(nc)
+		assert.NoError(t, err)
+		_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+			Name:     "dbchange",
+			Subjects: []string{"dbchange.>"},
+			Storage:  jetstream.FileStorage,
+		})
+		assert.NoError(t, err)
+		if id == "" {
+			return
+		}
+		evt := internal.DBChangeEvent{ID: id, Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+		assert.NoError(t, err)
+	}
+	publish("") // only create the stream since a new consumer delivers the new messages
+
+	var lock sync.Mutex
+	var received []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Context: context.Background(),
+		Logger:  logger.NewTestLogger(),
+		Driver: &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				lock.Lock()
+				received = append(received, event.ID)
+				lock.Unlock()
+				return false, nil
+			},
+			flush: func(logger logger.Logger) error { return nil },
+		},
+		URL:              natsurl,
+		ReconnectTimeout: time.Minute,
+	})
+	assert.NoError(t, err)
+	defer consumer.Stop()
+
+	publish("1")
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	srv.Shutdown()
+	srv.WaitForShutdown()
+	srv = natsserver.RunServer(&opts)
+	publish("2")
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 2
+	}, 20*time.Second, 50*time.Millisecond)
+
+	select {
+	case <-consumer.Disconnected():
+		t.Fatal("consumer should have reconnected instead of disconnecting")
+	case err := <-consumer.Error():
+		t.Fatalf("unexpected consumer error: %s", err)
+	default:
+	}
+	assert.Equal(t, []string{"1", "2"}, received)
+}
+
+func TestReconnectTimeout(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context:          context.Background(),
+			Logger:           logger.NewTestLogger(),
+			Driver:           &mockDriver{},
+			URL:              natsurl,
+			ReconnectTimeout: time.Second,
+		})
+		assert.NoError(t, err)
+
+		srv.Shutdown()
+
+		select {
+		case err := <-consumer.Error():
+			assert.ErrorContains(t, err, "error re-establishing the consumer within 1s")
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the reconnect to give up")
+		}
+		assert.NoError(t, consumer.Stop())
+	})
+}
+
+func TestReconnectLostConsumer(t *testing.T) {
+	port, err := util.GetFreePort()
+	assert.NoError(t, err)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&opts)
+	defer func() { srv.Shutdown() }()
+	natsurl := fmt.Sprintf("nats://localhost:%d", port)
+
+	publish := func(id string) {
+		t.Helper()
+		nc, err := nats.Connect(natsurl)
+		assert.NoError(t, err)
+		defer nc.Close()
+		js, err := jetstream.New(nc)
+		assert.NoError(t, err)
+		_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+			Name:     "dbchange",
+			Subjects: []string{"dbchange.>"},
+			Storage:  jetstream.FileStorage,
+		})
+		assert.NoError(t, err)
+		if id == "" {
+			return
+		}
+		evt := internal.DBChangeEvent{ID: id, Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+		_, err = js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+		assert.NoError(t, err)
+	}
+	publish("")
+
+	var lock sync.Mutex
+	var received []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Context: context.Background(),
+		Logger:  logger.NewTestLogger(),
+		Driver: &mockDriver{
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				lock.Lock()
+				received = append(received, event.ID)
+				lock.Unlock()
+				return false, nil
+			},
+		},
+		URL:              natsurl,
+		ReconnectTimeout: time.Minute,
+	})
+	assert.NoError(t, err)
+	defer consumer.Stop()
+
+	publish("1")
+	publish("2")
+	assert.Eventually(t, func() bool {
+		return consumer.updateLag() == nil && consumer.jsconn.CachedInfo().AckFloor.Stream == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the server loses the consumer but keeps the stream
+	srv.Shutdown()
+	srv.WaitForShutdown()
+	dirs, err := filepath.Glob(filepath.Join(opts.StoreDir, "jetstream", "*", "streams", "dbchange", "obs", consumer.Name()))
+	assert.NoError(t, err)
+	assert.Len(t, dirs, 1)
+	assert.NoError(t, os.RemoveAll(dirs[0]))
+	srv = natsserver.RunServer(&opts)
+	publish("3")
+
+	// the new consumer starts after the last acked message instead of only delivering the new messages
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 3
+	}, 20*time.Second, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, []string{"1", "2", "3"}, received)
+	lock.Unlock()
+}
@@ -0,0 +1,139 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+// replayFetchWait is how long a fetch waits for messages before the replay is treated as caught up with the stream.
+const replayFetchWait = 2 * time.Second
+
+// ReplayOptions are the options for replaying the events of a time range.
+type ReplayOptions struct {
+	// From is the time of the first message to replay.
+	From time.Time
+
+	// To is the time after which messages are no longer replayed.
+	To time.Time
+
+	// Tables restricts the replay to these tables, defaults to the tables the consumer receives.
+	Tables []string
+
+	// Driver processes the replayed events, it should be a different instance than the driver of the consumer.
+	Driver Driver
+}
+
+// ReplayResult is the result of a replay.
+type ReplayResult struct {
+	Events  int `json:"events"`  // the number of events processed by the driver
+	Skipped int `json:"skipped"` // the number of events in the range which the consumer doesn't receive
+}
+
+// Replay processes the events which were published in the time range again through the driver of the options using an
+// ephemeral consumer, so the durable consumer and its position are left alone. It returns once every message in the
+// range was processed and flushed, or when the stream has no more messages.
+func (c *Consumer) Replay(ctx context.Context, opts ReplayOptions) (ReplayResult, error) {
+	var result ReplayResult
+	if opts.Driver == nil {
+		return result, fmt.Errorf("a driver is required to replay")
+	}
+	if !opts.To.After(opts.From) {
+		return result, fmt.Errorf("the end of the replay must be after the start")
+	}
+	started := time.Now()
+	config := jetstream.OrderedConsumerConfig{
+		DeliverPolicy: jetstream.DeliverByStartTimePolicy,
+		OptStartTime:  &opts.From,
+	}
+	if len(opts.Tables) > 0 {
+		config.FilterSubjects = filterSubjects(c.companyIDs, opts.Tables, c.locationIDs)
+	} else {
+		c.subscriberLock.Lock()
+		config.FilterSubjects = c.jsconn.CachedInfo().Config.FilterSubjects
+		c.subscriberLock.Unlock()
+	}
+	jsconn, err := c.js.OrderedConsumer(ctx, "dbchange", config)
+	if err != nil {
+		return result, fmt.Errorf("error creating replay consumer: %w", err)
+	}
+	c.logger.Info("replaying events from %s to %s", opts.From.Format(time.RFC3339), opts.To.Format(time.RFC3339))
+
+	maxBatchSize := opts.Driver.MaxBatchSize()
+	var pending int
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		if err := opts.Driver.Flush(c.logger); err != nil {
+			return fmt.Errorf("error flushing replayed events: %w", err)
+		}
+		result.Events += pending
+		pending = 0
+		return nil
+	}
+	for {
+		batch, err := jsconn.Fetch(max(maxBatchSize, 1), jetstream.FetchMaxWait(replayFetchWait))
+		if err != nil {
+			return result, fmt.Errorf("error fetching replayed events: %w", err)
+		}
+		var received int
+		done := false
+		for msg := range batch.Messages() {
+			received++
+			md, err := msg.Metadata()
+			if err != nil {
+				return result, err
+			}
+			if md.Timestamp.After(opts.To) {
+				done = true
+				break
+			}
+			buf, err := util.DecodeNatsData(msg.Headers(), msg.Data())
+			if err != nil {
+				return result, fmt.Errorf("error decoding replayed event at sequence %d: %w", md.Sequence.Stream, err)
+			}
+			var evt internal.DBChangeEvent
+			if err := json.Unmarshal(buf, &evt); err != nil {
+				return result, fmt.Errorf("error decoding replayed event at sequence %d: %w", md.Sequence.Stream, err)
+			}
+			if !c.isTableAllowed(evt.Table) || !c.isLocationAllowed(&evt) {
+				result.Skipped++
+				continue
+			}
+			flushNow, err := opts.Driver.Process(c.logger, evt)
+			if err != nil {
+				return result, fmt.Errorf("error processing replayed event at sequence %d: %w", md.Sequence.Stream, err)
+			}
+			pending++
+			if flushNow || (maxBatchSize > 0 && pending >= maxBatchSize) {
+				if err := flush(); err != nil {
+					return result, err
+				}
+			}
+			if md.NumPending == 0 {
+				done = true // caught up with the stream
+			}
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, jetstream.ErrNoMessages) {
+			return result, fmt.Errorf("error fetching replayed events: %w", err)
+		}
+		if done || received == 0 {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return result, fmt.Errorf("error replaying: %w", err)
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+	c.logger.Info("replayed %d events (%d skipped) in %v", result.Events, result.Skipped, time.Since(started))
+	return result, nil
+}
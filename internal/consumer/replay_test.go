@@ -0,0 +1,92 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplay(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		// the test stream only allows one consumer
+		assert.NoError(t, js.DeleteStream(context.Background(), "dbchange"))
+		_, err := js.CreateStream(context.Background(), jetstream.StreamConfig{
+			Name:     "dbchange",
+			Subjects: []string{"dbchange.>"},
+			Storage:  jetstream.MemoryStorage,
+		})
+		assert.NoError(t, err)
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver:  &mockDriver{},
+			URL:     natsurl,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer consumer.Stop()
+		publish := func(table string, id string) {
+			t.Helper()
+			evt := internal.DBChangeEvent{ID: id, Table: table, Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), fmt.Sprintf("dbchange.%s.INSERT.CID.LID.PUBLIC.1", table), []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+
+		publish("order", "0")
+		time.Sleep(10 * time.Millisecond)
+		from := time.Now()
+		publish("order", "1")
+		publish("customer", "2")
+		publish("order", "3")
+		publish("order", "4")
+		to := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		publish("order", "5")
+
+		var lock sync.Mutex
+		var processed []string
+		var flushes int
+		driver := &mockDriver{
+			maxBatchSize: 2,
+			process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				processed = append(processed, event.ID)
+				return false, nil
+			},
+			flush: func(logger logger.Logger) error {
+				lock.Lock()
+				defer lock.Unlock()
+				flushes++
+				return nil
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		result, err := consumer.Replay(ctx, ReplayOptions{From: from, To: to, Driver: driver})
+		assert.NoError(t, err)
+		assert.Equal(t, ReplayResult{Events: 4}, result)
+		assert.Equal(t, []string{"1", "2", "3", "4"}, processed)
+		assert.Equal(t, 2, flushes)
+
+		processed = nil
+		result, err = consumer.Replay(ctx, ReplayOptions{From: from, To: to, Tables: []string{"order"}, Driver: driver})
+		assert.NoError(t, err)
+		assert.Equal(t, ReplayResult{Events: 3}, result)
+		assert.Equal(t, []string{"1", "3", "4"}, processed)
+
+		_, err = consumer.Replay(ctx, ReplayOptions{From: to, To: from, Driver: driver})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,250 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	DefaultRetryMaxAttempts = 10 // the number of times a batch is retried before it's given up on
+
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = 5 * time.Minute
+	retryExt       = ".json"
+	retryFailedExt = ".failed" // the extension of a batch which was given up on, kept for inspection
+)
+
+// retryMessage is a message of a batch in the retry queue.
+type retryMessage struct {
+	Subject  string `json:"subject"`
+	MsgID    string `json:"msgId,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	Data     []byte `json:"data"`
+}
+
+// retryEntry is a batch of messages which failed with a retryable error.
+type retryEntry struct {
+	Attempts    int            `json:"attempts"`
+	NextAttempt time.Time      `json:"nextAttempt"`
+	Error       string         `json:"error"`
+	Messages    []retryMessage `json:"messages"`
+
+	path string
+}
+
+// retryDelay returns the delay before the next attempt which doubles after each attempt up to the max delay.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 0; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// retryQueue persists the batches which failed with a retryable error so they are replayed with a backoff after the
+// consumer restarts instead of depending on the redelivery of the messages.
+type retryQueue struct {
+	dir         string
+	maxAttempts int
+}
+
+func newRetryQueue(dir string, maxAttempts int) (*retryQueue, error) {
+	if dir == "" || maxAttempts <= 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating retry directory: %w", err)
+	}
+	return &retryQueue{dir: dir, maxAttempts: maxAttempts}, nil
+}
+
+// save writes the entry, replacing the file if it was saved before.
+func (q *retryQueue) save(entry *retryEntry) error {
+	if entry.path == "" {
+		entry.path = filepath.Join(q.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), retryExt))
+	}
+	// write to a temp file and rename so a partially written entry is never read
+	tmp := entry.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(util.JSONStringify(entry)), 0600); err != nil {
+		return fmt.Errorf("error writing retry entry: %w", err)
+	}
+	if err := os.Rename(tmp, entry.path); err != nil {
+		return fmt.Errorf("error renaming retry entry: %w", err)
+	}
+	return nil
+}
+
+// add saves the messages as a new entry which is first retried after the base delay.
+func (q *retryQueue) add(msgs []retryMessage, cause error) error {
+	return q.save(&retryEntry{
+		NextAttempt: time.Now().Add(retryBaseDelay),
+		Error:       cause.Error(),
+		Messages:    msgs,
+	})
+}
+
+// list returns the entries in the order they were added.
+func (q *retryQueue) list() ([]*retryEntry, error) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading retry directory: %w", err)
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), retryExt) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	entries := make([]*retryEntry, 0, len(names))
+	for _, name := range names {
+		fn := filepath.Join(q.dir, name)
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading retry entry: %w", err)
+		}
+		var entry retryEntry
+		if err := json.Unmarshal(buf, &entry); err != nil {
+			return nil, fmt.Errorf("error decoding retry entry %s: %w", name, err)
+		}
+		entry.path = fn
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+func (q *retryQueue) remove(entry *retryEntry) error {
+	return os.Remove(entry.path)
+}
+
+// fail gives up on the entry and keeps it for inspection.
+func (q *retryQueue) fail(entry *retryEntry) error {
+	if err := q.save(entry); err != nil {
+		return err
+	}
+	return os.Rename(entry.path, strings.TrimSuffix(entry.path, retryExt)+retryFailedExt)
+}
+
+// queueForRetry saves the pending messages to the retry queue and acks them so the batch is retried with a backoff
+// after the consumer restarts. The messages are left pending to be nacked if they couldn't be saved.
+func (c *Consumer) queueForRetry(cause error) {
+	msgs := make([]retryMessage, 0, len(c.pending))
+	for _, m := range c.pending {
+		msg := retryMessage{Subject: m.Subject(), MsgID: m.Headers().Get(nats.MsgIdHdr), Data: m.Data()}
+		if data, err := util.DecodeNatsData(m.Headers(), m.Data()); err == nil {
+			msg.Data = data // saved as JSON since the headers aren't
+		}
+		if md, err := m.Metadata(); err == nil {
+			msg.Sequence = md.Sequence.Stream
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := c.retries.add(msgs, cause); err != nil {
+		c.logger.Error("error saving %d events for retry: %s", len(msgs), err)
+		return
+	}
+	if c.acks != nil {
+		if err := c.ackAll(c.pending); err != nil {
+			c.logger.Warn("error acking %d msgs queued for retry: %s", len(c.pending), err)
+		}
+		internal.PendingEvents.Sub(float64(len(c.pending)))
+	} else {
+		for _, m := range c.pending {
+			if err := m.Ack(); err != nil {
+				// the message will be redelivered as well as retried which the drivers tolerate as a duplicate
+				c.logger.Warn("error acking msg %s queued for retry: %s", m.Headers().Get(nats.MsgIdHdr), err)
+			}
+			internal.PendingEvents.Dec()
+		}
+	}
+	internal.RetryEvents.WithLabelValues("queued").Add(float64(len(msgs)))
+	c.logger.Warn("saved %d events for retry after error: %s", len(msgs), cause)
+	c.limit.release(c.pending...)
+	c.pending = nil
+}
+
+// replay sends the messages of the entry to the driver and flushes them.
+func (c *Consumer) replay(entry *retryEntry) error {
+	for _, msg := range entry.Messages {
+		var evt internal.DBChangeEvent
+		if err := json.Unmarshal(msg.Data, &evt); err != nil {
+			return fmt.Errorf("error decoding event of msg %s: %w", msg.MsgID, err)
+		}
+		companyID := unknownCompanyID
+		if evt.CompanyID != nil {
+			companyID = *evt.CompanyID
+		}
+		log := c.logger.With(map[string]any{"msgId": msg.MsgID, "subject": msg.Subject, "sid": msg.Sequence})
+		if _, err := c.processEvent(groupedEvent{log: log, evt: evt, companyID: companyID, size: len(msg.Data)}); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.processBatch(c.logger)
+	if err == nil {
+		err = c.driver.Flush(c.logger)
+	}
+	if c.usage != nil {
+		if err != nil {
+			c.usage.Discard()
+		} else if uerr := c.usage.Commit(); uerr != nil {
+			c.logger.Error("error saving usage: %s", uerr)
+		}
+	}
+	return destinationError(err)
+}
+
+// replayRetries replays the entries in the retry queue in order before consuming so they are delivered before any
+// newer events. It waits until an entry is due and returns an error if an entry failed again and will be retried later.
+func (c *Consumer) replayRetries() error {
+	entries, err := c.retries.list()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if wait := time.Until(entry.NextAttempt); wait > 0 {
+			c.logger.Info("waiting %v to retry %d events which failed with: %s", wait.Round(time.Second), len(entry.Messages), entry.Error)
+			select {
+			case <-time.After(wait):
+			case <-c.ctx.Done():
+				return c.ctx.Err()
+			}
+		}
+		started := time.Now()
+		err := c.replay(entry)
+		if err == nil {
+			if err := c.retries.remove(entry); err != nil {
+				return fmt.Errorf("error removing retry entry: %w", err)
+			}
+			internal.RetryEvents.WithLabelValues("replayed").Add(float64(len(entry.Messages)))
+			c.logger.Info("retried %d events after %d attempts in %v", len(entry.Messages), entry.Attempts+1, time.Since(started))
+			continue
+		}
+		entry.Attempts++
+		entry.Error = err.Error()
+		if !internal.IsRetryableError(err) || entry.Attempts >= c.retries.maxAttempts {
+			if ferr := c.retries.fail(entry); ferr != nil {
+				return fmt.Errorf("error saving failed retry entry: %w", ferr)
+			}
+			internal.RetryEvents.WithLabelValues("failed").Add(float64(len(entry.Messages)))
+			c.logger.Error("giving up on %d events after %d attempts, saved to %s: %s", len(entry.Messages), entry.Attempts, c.retries.dir, err)
+			continue
+		}
+		entry.NextAttempt = time.Now().Add(retryDelay(entry.Attempts))
+		if serr := c.retries.save(entry); serr != nil {
+			return fmt.Errorf("error saving retry entry: %w", serr)
+		}
+		return fmt.Errorf("error retrying %d events (attempt %d of %d): %w", len(entry.Messages), entry.Attempts, c.retries.maxAttempts, err)
+	}
+	return nil
+}
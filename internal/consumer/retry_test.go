@@ -0,0 +1,53 @@
+package consumer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, retryBaseDelay, retryDelay(0))
+	assert.Equal(t, 2*retryBaseDelay, retryDelay(1))
+	assert.Equal(t, 4*retryBaseDelay, retryDelay(2))
+	assert.Equal(t, retryMaxDelay, retryDelay(100))
+}
+
+func TestRetryQueue(t *testing.T) {
+	q, err := newRetryQueue("", DefaultRetryMaxAttempts)
+	assert.NoError(t, err)
+	assert.Nil(t, q)
+
+	dir := t.TempDir()
+	q, err = newRetryQueue(dir, 3)
+	assert.NoError(t, err)
+	assert.NoError(t, q.add([]retryMessage{{Subject: "dbchange.order.INSERT", MsgID: "1", Data: []byte(`{"id":"1"}`)}}, fmt.Errorf("first")))
+	assert.NoError(t, q.add([]retryMessage{{Subject: "dbchange.order.INSERT", MsgID: "2", Data: []byte(`{"id":"2"}`)}}, fmt.Errorf("second")))
+
+	entries, err := q.list()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "first", entries[0].Error)
+	assert.Equal(t, `{"id":"1"}`, string(entries[0].Messages[0].Data))
+	assert.WithinDuration(t, time.Now().Add(retryBaseDelay), entries[0].NextAttempt, time.Second)
+
+	entries[0].Attempts = 1
+	assert.NoError(t, q.save(entries[0]))
+	assert.NoError(t, q.fail(entries[1]))
+	entries, err = q.list()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 1, entries[0].Attempts)
+	failed, err := filepath.Glob(filepath.Join(dir, "*"+retryFailedExt))
+	assert.NoError(t, err)
+	assert.Len(t, failed, 1)
+
+	assert.NoError(t, q.remove(entries[0]))
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
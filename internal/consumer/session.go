@@ -0,0 +1,72 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const trackerSessionKey = "consumer-session"
+
+// Session is the logical session of the install. It's kept across restarts of the process so the heartbeats and the
+// drivers see one session instead of a new one each time the server restarts the consumer.
+type Session struct {
+	ID          string    `json:"id"`
+	ServerID    string    `json:"serverId"`
+	Incarnation int       `json:"incarnation"` // the number of times the session was resumed by a new process
+	Started     time.Time `json:"started"`
+}
+
+// SessionStore persists the session in the tracker.
+type SessionStore struct {
+	logger  logger.Logger
+	tracker *tracker.Tracker
+	lock    sync.Mutex
+	session *Session
+}
+
+// NewSessionStore returns a store which persists the session in the tracker.
+func NewSessionStore(logger logger.Logger, tracker *tracker.Tracker) *SessionStore {
+	return &SessionStore{logger: logger, tracker: tracker}
+}
+
+// Resume returns the session for the credentials. The first call in the process resumes the session persisted for the
+// server with the next incarnation or starts a new one with the session id of the credentials. Later calls, such as when
+// the consumer is recreated after a pause, return the same session.
+func (s *SessionStore) Resume(info *CredentialInfo) (*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.session != nil && s.session.ServerID == info.ServerID {
+		return s.session, nil
+	}
+	found, val, err := s.tracker.GetKey(trackerSessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading session from tracker: %w", err)
+	}
+	var session Session
+	if found {
+		if err := json.Unmarshal([]byte(val), &session); err != nil {
+			s.logger.Warn("ignoring invalid session in tracker: %s", err)
+			found = false
+		} else if session.ServerID != info.ServerID {
+			s.logger.Info("starting a new session since the persisted session %s is for server: %s", session.ID, session.ServerID)
+			found = false
+		}
+	}
+	if found {
+		session.Incarnation++
+		s.logger.Info("resuming session: %s (incarnation: %d)", session.ID, session.Incarnation)
+	} else {
+		session = Session{ID: info.SessionID, ServerID: info.ServerID, Started: time.Now()}
+	}
+	if err := s.tracker.SetKey(trackerSessionKey, util.JSONStringify(session), 0); err != nil {
+		return nil, fmt.Errorf("error saving session to tracker: %w", err)
+	}
+	s.session = &session
+	return s.session, nil
+}
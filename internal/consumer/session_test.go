@@ -0,0 +1,53 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStoreResume(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *tracker.Tracker {
+		tr, err := tracker.NewTracker(tracker.TrackerConfig{
+			Logger:  logger.NewTestLogger(),
+			Context: context.Background(),
+			Dir:     dir,
+		})
+		assert.NoError(t, err)
+		return tr
+	}
+
+	tr := open()
+	store := NewSessionStore(logger.NewTestLogger(), tr)
+	session, err := store.Resume(&CredentialInfo{ServerID: "server1", SessionID: "session1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "session1", session.ID)
+	assert.Equal(t, 0, session.Incarnation)
+
+	// recreating the consumer in the same process keeps the incarnation
+	session, err = store.Resume(&CredentialInfo{ServerID: "server1", SessionID: "session1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "session1", session.ID)
+	assert.Equal(t, 0, session.Incarnation)
+	assert.NoError(t, tr.Close())
+
+	// a restart resumes the session even though the credentials have a new session
+	tr = open()
+	session, err = NewSessionStore(logger.NewTestLogger(), tr).Resume(&CredentialInfo{ServerID: "server1", SessionID: "session2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "session1", session.ID)
+	assert.Equal(t, 1, session.Incarnation)
+	assert.NoError(t, tr.Close())
+
+	// a different server starts a new session
+	tr = open()
+	defer tr.Close()
+	session, err = NewSessionStore(logger.NewTestLogger(), tr).Resume(&CredentialInfo{ServerID: "server2", SessionID: "session3"})
+	assert.NoError(t, err)
+	assert.Equal(t, "session3", session.ID)
+	assert.Equal(t, 0, session.Incarnation)
+}
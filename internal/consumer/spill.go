@@ -0,0 +1,233 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// The bodies of the acks which the server understands, see the jetstream package.
+var (
+	spilledAck      = []byte("+ACK")
+	spilledNak      = []byte("-NAK")
+	spilledProgress = []byte("+WPI")
+	spilledTerm     = []byte("+TERM")
+)
+
+// bufferLimit caps the size of the messages held in memory from when they're pulled until they're acked, which is
+// shared by the consumer and its pipelines. Pulling is paused by the backpressure once the limit is reached, and the
+// messages of a pull which was already on its way are spilled to disk when there's a spill directory instead of being
+// held in memory.
+type bufferLimit struct {
+	maxBytes int64
+	bytes    atomic.Int64
+	dir      string // the directory the messages are spilled to or empty to keep them in memory
+	nc       *nats.Conn
+}
+
+// newBufferLimit returns the limit or nil if maxBytes is 0. The messages are spilled to a directory for the consumer
+// in dir which is emptied first, the messages spilled before a restart weren't acked so they are redelivered.
+func newBufferLimit(maxBytes int64, dir string, name string, nc *nats.Conn) (*bufferLimit, error) {
+	if maxBytes <= 0 {
+		return nil, nil
+	}
+	b := &bufferLimit{maxBytes: maxBytes, nc: nc}
+	if dir != "" {
+		b.dir = filepath.Join(dir, name)
+		if err := os.RemoveAll(b.dir); err != nil {
+			return nil, fmt.Errorf("error removing spill directory: %w", err)
+		}
+		if err := os.MkdirAll(b.dir, 0700); err != nil {
+			return nil, fmt.Errorf("error creating spill directory: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// full returns true if the messages held in memory reached the limit.
+func (b *bufferLimit) full() bool {
+	return b != nil && b.bytes.Load() >= b.maxBytes
+}
+
+// size returns the bytes held in memory.
+func (b *bufferLimit) size() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.bytes.Load()
+}
+
+func (b *bufferLimit) add(n int64) {
+	b.bytes.Add(n)
+	internal.BufferedBytes.Add(float64(n))
+}
+
+// hold returns the message to buffer, which is spilled to disk if the limit is reached.
+func (b *bufferLimit) hold(logger logger.Logger, msg jetstream.Msg) jetstream.Msg {
+	if b == nil {
+		return msg
+	}
+	if b.dir != "" && b.full() {
+		spilled, err := b.spill(msg)
+		if err == nil {
+			internal.SpilledEvents.Inc()
+			return spilled
+		}
+		logger.Warn("error spilling msg %s to disk, keeping it in memory: %s", msg.Headers().Get(nats.MsgIdHdr), err)
+	}
+	b.add(int64(len(msg.Data())))
+	return msg
+}
+
+// release is called with the messages which are no longer held once they're acked or nacked. The data of the spilled
+// messages is removed from disk, with the ack all policy they can be done without being acked themselves.
+func (b *bufferLimit) release(msgs ...jetstream.Msg) {
+	if b == nil {
+		return
+	}
+	var size int64
+	for _, m := range msgs {
+		if spilled, ok := m.(*spilledMsg); ok {
+			os.Remove(spilled.path)
+		} else {
+			size += int64(len(m.Data()))
+		}
+	}
+	if size > 0 {
+		b.add(-size)
+	}
+}
+
+// close removes the messages which are still spilled, they weren't acked so they are redelivered.
+func (b *bufferLimit) close() {
+	if b == nil {
+		return
+	}
+	b.add(-b.bytes.Load())
+	if b.dir != "" {
+		os.RemoveAll(b.dir)
+	}
+}
+
+func (b *bufferLimit) spill(msg jetstream.Msg) (*spilledMsg, error) {
+	md, err := msg.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	// a message redelivered while a previous delivery is still held gets its own file
+	path := filepath.Join(b.dir, fmt.Sprintf("%d-%d.msg", md.Sequence.Stream, md.NumDelivered))
+	if err := os.WriteFile(path, msg.Data(), 0600); err != nil {
+		return nil, err
+	}
+	return &spilledMsg{
+		nc:       b.nc,
+		subject:  msg.Subject(),
+		reply:    msg.Reply(),
+		headers:  msg.Headers(),
+		metadata: md,
+		path:     path,
+	}, nil
+}
+
+// spilledMsg is a message whose data was written to disk. It only keeps what's needed to ack the message so the data of
+// the original message can be garbage collected, and the data is read from disk each time it's needed.
+type spilledMsg struct {
+	nc       *nats.Conn
+	subject  string
+	reply    string
+	headers  nats.Header
+	metadata *jetstream.MsgMetadata
+	path     string
+	lock     sync.Mutex
+	acked    bool
+}
+
+var _ jetstream.Msg = (*spilledMsg)(nil)
+
+func (m *spilledMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return m.metadata, nil
+}
+
+// Data returns the data read from disk or nil if it can't be read, which fails to decode like any invalid event.
+func (m *spilledMsg) Data() []byte {
+	buf, err := os.ReadFile(m.path)
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+func (m *spilledMsg) Headers() nats.Header {
+	return m.headers
+}
+
+func (m *spilledMsg) Subject() string {
+	return m.subject
+}
+
+func (m *spilledMsg) Reply() string {
+	return m.reply
+}
+
+func (m *spilledMsg) Ack() error {
+	return m.ackReply(context.Background(), spilledAck, false)
+}
+
+func (m *spilledMsg) DoubleAck(ctx context.Context) error {
+	return m.ackReply(ctx, spilledAck, true)
+}
+
+func (m *spilledMsg) Nak() error {
+	return m.ackReply(context.Background(), spilledNak, false)
+}
+
+func (m *spilledMsg) NakWithDelay(delay time.Duration) error {
+	if delay <= 0 {
+		return m.Nak()
+	}
+	return m.ackReply(context.Background(), []byte(fmt.Sprintf("%s {\"delay\": %d}", spilledNak, delay.Nanoseconds())), false)
+}
+
+func (m *spilledMsg) InProgress() error {
+	return m.nc.Publish(m.reply, spilledProgress)
+}
+
+func (m *spilledMsg) Term() error {
+	return m.ackReply(context.Background(), spilledTerm, false)
+}
+
+func (m *spilledMsg) TermWithReason(reason string) error {
+	if reason == "" {
+		return m.Term()
+	}
+	return m.ackReply(context.Background(), []byte(fmt.Sprintf("%s %s", spilledTerm, reason)), false)
+}
+
+// ackReply sends the ack to the server unless the message was already acked.
+func (m *spilledMsg) ackReply(ctx context.Context, body []byte, sync bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.acked {
+		return jetstream.ErrMsgAlreadyAckd
+	}
+	var err error
+	if sync {
+		_, err = m.nc.RequestWithContext(ctx, m.reply, body)
+	} else {
+		err = m.nc.Publish(m.reply, body)
+	}
+	if err != nil {
+		return err
+	}
+	m.acked = true
+	return nil
+}
@@ -0,0 +1,137 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type dataMsg struct {
+	jetstream.Msg
+	data []byte
+	seq  uint64
+}
+
+func (m *dataMsg) Data() []byte {
+	return m.data
+}
+
+func (m *dataMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return &jetstream.MsgMetadata{Sequence: jetstream.SequencePair{Stream: m.seq}, NumDelivered: 1}, nil
+}
+
+func (m *dataMsg) Subject() string {
+	return "dbchange.order.INSERT.CID.LID.PUBLIC.1"
+}
+
+func (m *dataMsg) Reply() string {
+	return fmt.Sprintf("$JS.ACK.dbchange.eds-test.1.%d.%d.0.0", m.seq, m.seq)
+}
+
+func (m *dataMsg) Headers() nats.Header {
+	return nats.Header{}
+}
+
+func TestBufferLimit(t *testing.T) {
+	internal.MetricsReset()
+	limit, err := newBufferLimit(0, t.TempDir(), "eds-test", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, limit)
+	msg := &dataMsg{data: []byte("12345"), seq: 1}
+	assert.Same(t, msg, limit.hold(logger.NewTestLogger(), msg), "no limit")
+
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "eds-test"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "eds-test", "1-1.msg"), []byte("old"), 0600))
+	limit, err = newBufferLimit(10, dir, "eds-test", nil)
+	assert.NoError(t, err)
+	files, _ := os.ReadDir(filepath.Join(dir, "eds-test"))
+	assert.Empty(t, files, "spilled before a restart")
+
+	msgs := []*dataMsg{{data: []byte("123456"), seq: 1}, {data: []byte("123456"), seq: 2}, {data: []byte("123456"), seq: 3}}
+	held := make([]jetstream.Msg, len(msgs))
+	for i, m := range msgs {
+		held[i] = limit.hold(logger.NewTestLogger(), m)
+	}
+	assert.Same(t, msgs[0], held[0])
+	assert.Same(t, msgs[1], held[1], "kept in memory until the limit is reached")
+	spilled, ok := held[2].(*spilledMsg)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("123456"), spilled.Data())
+	assert.Equal(t, msgs[2].Reply(), spilled.Reply())
+	md, err := spilled.Metadata()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), md.Sequence.Stream)
+	assert.Equal(t, int64(12), limit.size())
+	assert.True(t, limit.full())
+	assert.Equal(t, float64(1), testutil.ToFloat64(internal.SpilledEvents))
+	assert.Equal(t, float64(12), testutil.ToFloat64(internal.BufferedBytes))
+
+	limit.release(held...)
+	assert.Equal(t, int64(0), limit.size())
+	assert.False(t, limit.full())
+	assert.Nil(t, spilled.Data(), "removed once released")
+	limit.close()
+	assert.NoDirExists(t, filepath.Join(dir, "eds-test"))
+}
+
+func TestSpillConsumer(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		internal.MetricsReset()
+		dir := t.TempDir()
+		var lock sync.Mutex
+		var processed []string
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					lock.Lock()
+					defer lock.Unlock()
+					processed = append(processed, event.ID)
+					return false, nil
+				},
+			},
+			URL:               natsurl,
+			MaxBufferedBytes:  1,
+			SpillDir:          dir,
+			MinPendingLatency: time.Hour, // only flushed to release the messages
+			MaxPendingLatency: time.Hour,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		var expected []string
+		for i := 0; i < 20; i++ {
+			evt := internal.DBChangeEvent{ID: fmt.Sprint(i), Table: "order", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), "dbchange.order.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+			expected = append(expected, evt.ID)
+		}
+		assert.Eventually(t, func() bool {
+			info, err := consumer.jsconn.Info(context.Background())
+			return err == nil && info.AckFloor.Stream == 20 && info.NumAckPending == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Equal(t, expected, processed)
+		lock.Unlock()
+		assert.Greater(t, testutil.ToFloat64(internal.SpilledEvents), float64(0))
+		assert.Greater(t, testutil.ToFloat64(internal.BackpressurePauses.WithLabelValues(BackpressureReasonBytes)), float64(0))
+		assert.Equal(t, float64(0), testutil.ToFloat64(internal.BufferedBytes))
+		files, err := os.ReadDir(filepath.Join(dir, consumer.Name()))
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
+}
@@ -0,0 +1,48 @@
+package consumer
+
+import (
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+// describeDestination returns the name of the driver and the url with the credentials masked for the heartbeats.
+func describeDestination(driverURL string) (string, string) {
+	if driverURL == "" {
+		return "", ""
+	}
+	var name string
+	if metadata, err := internal.GetDriverMetadataForURL(driverURL); err == nil && metadata != nil {
+		name = metadata.Name
+	}
+	destination, err := util.MaskURL(driverURL)
+	if err != nil {
+		destination = "" // don't risk sending a url which couldn't be parsed to be masked
+	}
+	return name, destination
+}
+
+// heartbeatState adds the state of the driver and the consumer to the heartbeat so the control plane can show the health
+// of the server. The events per second are the events received since the previous heartbeat.
+func (c *Consumer) heartbeatState(hb *heartbeat) {
+	hb.Driver = c.driverName
+	hb.Destination = c.destination
+	hb.Lag = time.Duration(c.lag.Load()).Seconds()
+	hb.LastFlush = c.flushLatency().Seconds()
+	now := time.Now()
+	total := hb.Stats.Metrics.TotalEvents
+	if !c.heartbeatSent.IsZero() && total >= c.heartbeatEvents {
+		if elapsed := now.Sub(c.heartbeatSent).Seconds(); elapsed > 0 {
+			hb.EventsPerSecond = (total - c.heartbeatEvents) / elapsed
+		}
+	}
+	c.heartbeatEvents = total
+	c.heartbeatSent = now
+	if v, ok := c.validator.(internal.SchemaValidatorWithStatus); ok {
+		status := v.Status()
+		hb.Validator = &status
+	} else if c.validator != nil {
+		hb.Validator = &internal.SchemaValidatorStatus{}
+	}
+}
@@ -0,0 +1,104 @@
+package consumer
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const defaultPausedTableDelay = time.Minute // delay before redelivery for a table which is paused
+
+// pausedTables are the tables whose events are redelivered later instead of being processed, so a misbehaving table
+// can be held back while the other tables keep flowing.
+type pausedTables struct {
+	tables map[string]bool
+	lock   sync.Mutex
+}
+
+func newPausedTables(tables []string) *pausedTables {
+	p := &pausedTables{tables: make(map[string]bool)}
+	for _, table := range tables {
+		p.tables[table] = true
+	}
+	return p
+}
+
+// Pause stops processing the events of the table and returns false if it was already paused.
+func (p *pausedTables) Pause(table string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.tables[table] {
+		return false
+	}
+	p.tables[table] = true
+	return true
+}
+
+// Unpause resumes processing the events of the table and returns false if it wasn't paused.
+func (p *pausedTables) Unpause(table string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.tables[table] {
+		return false
+	}
+	delete(p.tables, table)
+	return true
+}
+
+// IsPaused returns true if the table is paused.
+func (p *pausedTables) IsPaused(table string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.tables[table]
+}
+
+// List returns the paused tables sorted by name.
+func (p *pausedTables) List() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	res := make([]string, 0, len(p.tables))
+	for table := range p.tables {
+		res = append(res, table)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// throttleTable will nak the message of a paused table with a delay so it's redelivered later and remove it from pending.
+func (c *Consumer) throttleTable(logger logger.Logger, msg jetstream.Msg, table string) {
+	logger.Trace("throttling paused table %s", table)
+	if err := msg.NakWithDelay(defaultPausedTableDelay); err != nil {
+		logger.Error("error nacking msg of paused table: %s", err)
+	}
+	c.nacked(msg)
+	c.removePending(msg)
+	internal.PausedTableEvents.WithLabelValues(table).Inc()
+}
+
+// PauseTable will stop processing the events of a table while the other tables continue. Events for the table will be
+// redelivered later, so a table can't be paused with the ack all policy since acking a later message would ack them.
+func (c *Consumer) PauseTable(table string) {
+	if c.acks != nil {
+		c.logger.Warn("can't pause table %s with the ack all policy", table)
+		return
+	}
+	if c.pausedTables.Pause(table) {
+		c.logger.Info("pausing table: %s", table)
+	}
+}
+
+// UnpauseTable will resume processing the events of a table.
+func (c *Consumer) UnpauseTable(table string) {
+	if c.pausedTables.Unpause(table) {
+		c.logger.Info("unpausing table: %s", table)
+	}
+}
+
+// PausedTables returns the list of tables which are paused.
+func (c *Consumer) PausedTables() []string {
+	return c.pausedTables.List()
+}
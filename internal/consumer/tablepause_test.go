@@ -0,0 +1,142 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestPausedTables(t *testing.T) {
+	p := newPausedTables([]string{"order"})
+	assert.True(t, p.IsPaused("order"))
+	assert.False(t, p.IsPaused("customer"))
+	assert.True(t, p.Pause("customer"))
+	assert.False(t, p.Pause("customer"))
+	assert.Equal(t, []string{"customer", "order"}, p.List())
+	assert.True(t, p.Unpause("order"))
+	assert.False(t, p.Unpause("order"))
+	assert.Equal(t, []string{"customer"}, p.List())
+}
+
+func TestPauseTable(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		internal.MetricsReset()
+		var lock sync.Mutex
+		var processed []string
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					lock.Lock()
+					defer lock.Unlock()
+					processed = append(processed, event.Table)
+					return false, nil
+				},
+			},
+			URL:               natsurl,
+			PausedTables:      []string{"order"},
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+		publish := func(table string) {
+			t.Helper()
+			evt := internal.DBChangeEvent{ID: table, Table: table, Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+			_, err := js.Publish(context.Background(), "dbchange."+table+".INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+			assert.NoError(t, err)
+		}
+		get := func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]string{}, processed...)
+		}
+
+		// the events of the paused table are redelivered later while the other tables continue
+		publish("order")
+		publish("customer")
+		assert.Eventually(t, func() bool { return len(get()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"customer"}, get())
+		assert.Equal(t, float64(1), testutil.ToFloat64(internal.PausedTableEvents.WithLabelValues("order")))
+		assert.Equal(t, []string{"order"}, consumer.PausedTables())
+
+		consumer.UnpauseTable("order")
+		consumer.PauseTable("customer")
+		publish("order")
+		publish("customer")
+		assert.Eventually(t, func() bool { return len(get()) == 2 }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"customer", "order"}, get())
+		assert.Equal(t, []string{"customer"}, consumer.PausedTables())
+	})
+}
+
+func TestStartPaused(t *testing.T) {
+	runNatsTestServer(func(natsurl string, nc *nats.Conn, js jetstream.JetStream, srv *server.Server) {
+		var processed atomic.Int32
+		heartbeats := make(chan *nats.Msg, 1)
+		pausedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+		consumer, err := NewConsumer(ConsumerConfig{
+			Context: context.Background(),
+			Logger:  logger.NewTestLogger(),
+			Driver: &mockDriver{
+				process: func(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+					processed.Add(1)
+					return false, nil
+				},
+			},
+			URL:               natsurl,
+			PausedAt:          &pausedAt,
+			PausedTables:      []string{"order"},
+			MinPendingLatency: 10 * time.Millisecond,
+			MaxPendingLatency: 50 * time.Millisecond,
+			sessionIDCallback: func(id string) {
+				nc.Subscribe("eds.client."+id+".heartbeat", func(msg *nats.Msg) {
+					select {
+					case heartbeats <- msg:
+					default:
+					}
+				})
+			},
+		})
+		assert.NoError(t, err)
+		defer consumer.Stop()
+
+		// the pause state which was restored is reported in the heartbeat
+		select {
+		case msg := <-heartbeats:
+			dec := msgpack.NewDecoder(bytes.NewReader(msg.Data))
+			dec.SetCustomStructTag("json")
+			var payload heartbeat
+			assert.NoError(t, dec.Decode(&payload))
+			if assert.NotNil(t, payload.Paused) {
+				assert.True(t, pausedAt.Equal(*payload.Paused))
+			}
+			assert.Equal(t, []string{"order"}, payload.PausedTables)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "no heartbeat")
+		}
+
+		evt := internal.DBChangeEvent{ID: "1", Table: "customer", Operation: "INSERT", Timestamp: time.Now().UnixMilli()}
+		_, err = js.Publish(context.Background(), "dbchange.customer.INSERT.CID.LID.PUBLIC.1", []byte(util.JSONStringify(evt)))
+		assert.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, int32(0), processed.Load())
+
+		assert.NoError(t, consumer.Unpause())
+		assert.Eventually(t, func() bool { return processed.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,126 @@
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultThrottleDelay      = time.Second      // delay before redelivery for a company which is over quota
+	defaultPausedCompanyDelay = time.Minute      // delay before redelivery for a company which is paused
+	allCompaniesQuotaKey      = "*"              // quota key which applies to any company without a specific quota
+	throttleReasonQuota       = "quota"          // the company exceeded its rate quota
+	throttleReasonPaused      = "paused"         // the company is paused
+	unknownCompanyID          = "unknown"        // label used when the event has no company
+	maxDeliverSafetyMargin    = 1                // number of deliveries to leave before max deliver so throttled messages aren't dropped
+	companyQuotaFormat        = "companyId=rate" // the format of a company quota flag value
+)
+
+// ParseCompanyQuotas parses a list of company quotas in the format companyId=rate where rate is the maximum number of events
+// per second. A companyId of * applies to all companies without a specific quota.
+func ParseCompanyQuotas(values []string) (map[string]float64, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	quotas := make(map[string]float64)
+	for _, value := range values {
+		companyID, limit, ok := strings.Cut(value, "=")
+		if !ok || companyID == "" {
+			return nil, fmt.Errorf("invalid company quota: %s (expected %s)", value, companyQuotaFormat)
+		}
+		val, err := strconv.ParseFloat(limit, 64)
+		if err != nil || val <= 0 {
+			return nil, fmt.Errorf("invalid company quota rate: %s for company: %s", limit, companyID)
+		}
+		quotas[companyID] = val
+	}
+	return quotas, nil
+}
+
+// tenantController enforces per-company rate quotas and pause controls when a consumer serves multiple companies.
+type tenantController struct {
+	quotas   map[string]float64
+	limiters map[string]*rate.Limiter
+	paused   map[string]bool
+	lock     sync.Mutex
+}
+
+func newTenantController(quotas map[string]float64) *tenantController {
+	return &tenantController{
+		quotas:   quotas,
+		limiters: make(map[string]*rate.Limiter),
+		paused:   make(map[string]bool),
+	}
+}
+
+func (t *tenantController) limiter(companyID string) *rate.Limiter {
+	if l, ok := t.limiters[companyID]; ok {
+		return l
+	}
+	limit, ok := t.quotas[companyID]
+	if !ok {
+		limit, ok = t.quotas[allCompaniesQuotaKey]
+	}
+	var l *rate.Limiter
+	if ok {
+		burst := int(limit)
+		if burst < 1 {
+			burst = 1
+		}
+		l = rate.NewLimiter(rate.Limit(limit), burst)
+	}
+	t.limiters[companyID] = l
+	return l
+}
+
+// Allow returns true if the company event can be processed or false and the reason if it should be throttled.
+func (t *tenantController) Allow(companyID string) (bool, string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.paused[companyID] {
+		return false, throttleReasonPaused
+	}
+	if l := t.limiter(companyID); l != nil && !l.Allow() {
+		return false, throttleReasonQuota
+	}
+	return true, ""
+}
+
+// Pause will stop processing events for the company.
+func (t *tenantController) Pause(companyID string) {
+	t.lock.Lock()
+	t.paused[companyID] = true
+	t.lock.Unlock()
+}
+
+// Unpause will resume processing events for the company.
+func (t *tenantController) Unpause(companyID string) {
+	t.lock.Lock()
+	delete(t.paused, companyID)
+	t.lock.Unlock()
+}
+
+// Paused returns the list of paused companies.
+func (t *tenantController) Paused() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var res []string
+	for companyID := range t.paused {
+		res = append(res, companyID)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func throttleDelay(reason string) time.Duration {
+	if reason == throttleReasonPaused {
+		return defaultPausedCompanyDelay
+	}
+	return defaultThrottleDelay
+}
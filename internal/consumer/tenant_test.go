@@ -0,0 +1,61 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCompanyQuotas(t *testing.T) {
+	quotas, err := ParseCompanyQuotas(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, quotas)
+
+	quotas, err = ParseCompanyQuotas([]string{"123=10", "*=2.5"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"123": 10, "*": 2.5}, quotas)
+
+	_, err = ParseCompanyQuotas([]string{"123"})
+	assert.ErrorContains(t, err, "invalid company quota: 123")
+	_, err = ParseCompanyQuotas([]string{"123=abc"})
+	assert.ErrorContains(t, err, "invalid company quota rate: abc")
+	_, err = ParseCompanyQuotas([]string{"123=0"})
+	assert.ErrorContains(t, err, "invalid company quota rate: 0")
+}
+
+func TestTenantController(t *testing.T) {
+	tenants := newTenantController(map[string]float64{"A": 2, "*": 1})
+
+	// A has a burst of 2
+	ok, _ := tenants.Allow("A")
+	assert.True(t, ok)
+	ok, _ = tenants.Allow("A")
+	assert.True(t, ok)
+	ok, reason := tenants.Allow("A")
+	assert.False(t, ok)
+	assert.Equal(t, throttleReasonQuota, reason)
+
+	// B uses the default quota and isn't affected by A
+	ok, _ = tenants.Allow("B")
+	assert.True(t, ok)
+	ok, _ = tenants.Allow("B")
+	assert.False(t, ok)
+
+	tenants.Pause("C")
+	tenants.Pause("D")
+	assert.Equal(t, []string{"C", "D"}, tenants.Paused())
+	ok, reason = tenants.Allow("C")
+	assert.False(t, ok)
+	assert.Equal(t, throttleReasonPaused, reason)
+	tenants.Unpause("C")
+	ok, _ = tenants.Allow("C")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"D"}, tenants.Paused())
+
+	// no quotas means no limits
+	unlimited := newTenantController(nil)
+	for i := 0; i < 100; i++ {
+		ok, _ := unlimited.Allow("A")
+		assert.True(t, ok)
+	}
+}
@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// isOlderVersion returns true if the event's model version is older than the version the table was migrated to, in which case
+// the event should be translated to the table's version instead of migrating the table back to the older version.
+// The latest schema from the registry decides when it has either version, otherwise the event is considered older when its
+// schema has none of the table's columns missing from the table and the table has columns which the event doesn't.
+func isOlderVersion(latest internal.SchemaMap, table string, eventVersion string, eventSchema *internal.Schema, tableVersion string, tableSchema *internal.Schema) bool {
+	if schema, ok := latest[table]; ok && schema != nil {
+		switch schema.ModelVersion {
+		case tableVersion:
+			return true
+		case eventVersion:
+			return false
+		}
+	}
+	for name := range eventSchema.Properties {
+		if _, ok := tableSchema.Properties[name]; !ok {
+			return false
+		}
+	}
+	for name := range tableSchema.Properties {
+		if _, ok := eventSchema.Properties[name]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// translateObject drops the columns of the object which aren't in the schema. The columns which the schema has but the
+// object doesn't are left out rather than guessing their values.
+func translateObject(buf json.RawMessage, to *internal.Schema) (json.RawMessage, error) {
+	if len(buf) == 0 || string(buf) == "null" {
+		return buf, nil
+	}
+	object := make(map[string]any)
+	if err := json.Unmarshal(buf, &object); err != nil {
+		return nil, err
+	}
+	for name := range object {
+		if _, ok := to.Properties[name]; !ok {
+			delete(object, name)
+		}
+	}
+	return json.Marshal(object)
+}
+
+// translateEvent converts the event from one model version to another by dropping the columns which were removed. The columns
+// which were added are left out of the event and aren't included in the diff so updates don't overwrite their values.
+func translateEvent(event *internal.DBChangeEvent, from *internal.Schema, to *internal.Schema, version string) error {
+	var err error
+	if event.Before, err = translateObject(event.Before, to); err != nil {
+		return fmt.Errorf("error translating before for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+	}
+	if event.After, err = translateObject(event.After, to); err != nil {
+		return fmt.Errorf("error translating after for table: %s, model version: %s: %w", event.Table, event.ModelVersion, err)
+	}
+	var diff []string
+	for _, name := range event.Diff {
+		if _, ok := to.Properties[name]; ok {
+			diff = append(diff, name)
+		}
+	}
+	event.Diff = diff
+	event.ModelVersion = version
+	return nil
+}
@@ -0,0 +1,77 @@
+package consumer
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func versionSchemas() (*internal.Schema, *internal.Schema) {
+	v1 := &internal.Schema{
+		Table:        "order",
+		ModelVersion: "1",
+		PrimaryKeys:  []string{"id"},
+		Properties: map[string]internal.SchemaProperty{
+			"id":     {Type: "string"},
+			"name":   {Type: "string", Nullable: true},
+			"legacy": {Type: "string", Nullable: true},
+		},
+	}
+	v2 := &internal.Schema{
+		Table:        "order",
+		ModelVersion: "2",
+		PrimaryKeys:  []string{"id"},
+		Properties: map[string]internal.SchemaProperty{
+			"id":        {Type: "string"},
+			"name":      {Type: "string", Nullable: true},
+			"total":     {Type: "number"},
+			"paid":      {Type: "boolean"},
+			"tags":      {Type: "array", Nullable: true},
+			"note":      {Type: "string", Nullable: true},
+			"createdAt": {Type: "string", Format: "date-time"},
+		},
+	}
+	return v1, v2
+}
+
+func TestIsOlderVersion(t *testing.T) {
+	v1, v2 := versionSchemas()
+	latest := internal.SchemaMap{"order": v2}
+	assert.True(t, isOlderVersion(latest, "order", "1", v1, "2", v2))
+	assert.False(t, isOlderVersion(latest, "order", "2", v2, "1", v1))
+
+	// without the latest schema the columns decide
+	subset := &internal.Schema{Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}}}
+	assert.True(t, isOlderVersion(nil, "order", "0", subset, "2", v2))
+	assert.False(t, isOlderVersion(nil, "order", "2", v2, "0", subset))
+	assert.False(t, isOlderVersion(nil, "order", "1", v1, "2", v2)) // legacy is new to the table so it must be migrated
+	assert.False(t, isOlderVersion(nil, "order", "3", v2, "2", v2))
+}
+
+func TestTranslateEvent(t *testing.T) {
+	v1, v2 := versionSchemas()
+	event := &internal.DBChangeEvent{
+		Table:        "order",
+		Operation:    "UPDATE",
+		ModelVersion: "1",
+		Before:       json.RawMessage(`{"id":"1","name":"a","legacy":"x"}`),
+		After:        json.RawMessage(`{"id":"1","name":"b","legacy":"y"}`),
+		Diff:         []string{"name", "legacy"},
+	}
+	assert.NoError(t, translateEvent(event, v1, v2, "2"))
+	assert.Equal(t, "2", event.ModelVersion)
+	assert.Equal(t, []string{"name"}, event.Diff)
+	var after map[string]any
+	assert.NoError(t, json.Unmarshal(event.After, &after))
+	// the columns added since aren't given made up values
+	assert.Equal(t, map[string]any{"id": "1", "name": "b"}, after)
+	assert.Contains(t, string(event.Before), `"name":"a"`)
+	assert.NotContains(t, string(event.Before), "legacy")
+
+	deleted := &internal.DBChangeEvent{Table: "order", Operation: "DELETE", ModelVersion: "1", Before: json.RawMessage(`{"id":"1","legacy":"x"}`)}
+	assert.NoError(t, translateEvent(deleted, v1, v2, "2"))
+	assert.Nil(t, deleted.After)
+	assert.NotContains(t, string(deleted.Before), "legacy")
+}
@@ -0,0 +1,311 @@
+package control
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"github.com/nats-io/nats.go"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	ActionPause       = "pause"
+	ActionUnpause     = "unpause"
+	ActionRestart     = "restart"
+	ActionRotateLogs  = "rotate-logs"
+	ActionSetLogLevel = "set-loglevel"
+
+	// SignatureHeader is the header of the base64 encoded detached PGP signature of the command.
+	SignatureHeader = "Eds-Signature"
+
+	// DefaultMaxAge is how old a command can be before it's rejected, which also limits how long the ids are remembered.
+	DefaultMaxAge = 5 * time.Minute
+)
+
+// Actions are the actions which can be allowed to be controlled remotely.
+var Actions = []string{ActionPause, ActionUnpause, ActionRestart, ActionRotateLogs, ActionSetLogLevel}
+
+// ValidateAllowlist returns an error if one of the values isn't an action which can be controlled remotely.
+func ValidateAllowlist(values []string) error {
+	for _, val := range values {
+		if !slices.Contains(Actions, val) {
+			return fmt.Errorf("invalid remote control action: %q, must be one of: %s", val, strings.Join(Actions, ", "))
+		}
+	}
+	return nil
+}
+
+// Subject returns the subject the commands for a session are published to.
+func Subject(sessionID string) string {
+	return fmt.Sprintf("eds.client.%s.control", sessionID)
+}
+
+// Command is a command sent by the control plane.
+type Command struct {
+	ID        string            `json:"id"`
+	SessionID string            `json:"sessionId"`
+	Action    string            `json:"action"`
+	Args      map[string]string `json:"args,omitempty"`
+	Timestamp int64             `json:"timestamp"` // unix milliseconds, commands older than the max age are rejected
+}
+
+// Response is the reply to a command.
+type Response struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// AuditEntry is a line of the audit log.
+type AuditEntry struct {
+	Time    time.Time         `json:"time"`
+	ID      string            `json:"id,omitempty"`
+	Action  string            `json:"action,omitempty"`
+	Args    map[string]string `json:"args,omitempty"`
+	Status  string            `json:"status"` // executed, failed or rejected
+	Message string            `json:"message,omitempty"`
+}
+
+// Handler runs the commands.
+type Handler struct {
+	// Pause action is called to pause the consumer, or only a table or company when the args have a table or companyId.
+	Pause func(args map[string]string) error
+
+	// Unpause action is called to unpause the consumer, or only a table or company when the args have a table or companyId.
+	Unpause func(args map[string]string) error
+
+	// Restart action is called to restart the process.
+	Restart func() error
+
+	// RotateLogs action is called to rotate the log file, it returns the name of the rotated file.
+	RotateLogs func() (string, error)
+
+	// SetLogLevel action is called to change the console log level.
+	SetLogLevel func(level string) error
+}
+
+// Config is the configuration for the remote control.
+type Config struct {
+	Logger    logger.Logger
+	Conn      *nats.Conn
+	SessionID string
+
+	// PublicKey is the armored PGP key which the commands must be signed with.
+	PublicKey string
+
+	// Allow are the actions which can be run, the others are rejected.
+	Allow []string
+
+	// AuditFile is the file every received command is appended to.
+	AuditFile string
+
+	// MaxAge defaults to DefaultMaxAge.
+	MaxAge time.Duration
+
+	Handler Handler
+}
+
+// RemoteControl runs the signed commands published for the session.
+type RemoteControl struct {
+	logger   logger.Logger
+	config   Config
+	verifier crypto.PGPVerify
+	sub      *nats.Subscription
+	audit    *os.File
+	lock     sync.Mutex
+	seen     map[string]time.Time
+	now      func() time.Time
+}
+
+// New will create a new RemoteControl.
+func New(config Config) (*RemoteControl, error) {
+	if err := ValidateAllowlist(config.Allow); err != nil {
+		return nil, err
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = DefaultMaxAge
+	}
+	publicKey, err := crypto.NewKeyFromArmored(config.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %w", err)
+	}
+	verifier, err := crypto.PGP().Verify().VerificationKey(publicKey).New()
+	if err != nil {
+		return nil, fmt.Errorf("error creating PGP verifier: %w", err)
+	}
+	audit, err := os.OpenFile(config.AuditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+	return &RemoteControl{
+		logger:   config.Logger.WithPrefix("[control]"),
+		config:   config,
+		verifier: verifier,
+		audit:    audit,
+		seen:     make(map[string]time.Time),
+		now:      time.Now,
+	}, nil
+}
+
+// Start will subscribe to the commands of the session.
+func (r *RemoteControl) Start() error {
+	subject := Subject(r.config.SessionID)
+	sub, err := r.config.Conn.Subscribe(subject, r.callback)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+	r.sub = sub
+	r.logger.Debug("listening for remote commands on %s, allowed: %s", subject, strings.Join(r.config.Allow, ", "))
+	return nil
+}
+
+// Stop will stop receiving commands and close the audit log.
+func (r *RemoteControl) Stop() error {
+	if r.sub != nil {
+		if err := r.sub.Unsubscribe(); err != nil {
+			r.logger.Warn("error unsubscribing: %s", err)
+		}
+		r.sub = nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.audit.Close()
+}
+
+func (r *RemoteControl) callback(m *nats.Msg) {
+	var command Command
+	message, err := r.run(m, &command)
+	status := "executed"
+	if err != nil {
+		message = err.Error()
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			status = "rejected"
+			r.logger.Warn("rejected remote command %s (%s): %s", command.Action, command.ID, err)
+		} else {
+			status = "failed"
+			r.logger.Error("remote command %s (%s) failed: %s", command.Action, command.ID, err)
+		}
+	} else {
+		r.logger.Info("executed remote command %s (%s)", command.Action, command.ID)
+	}
+	r.record(AuditEntry{
+		Time:    r.now().UTC(),
+		ID:      command.ID,
+		Action:  command.Action,
+		Args:    command.Args,
+		Status:  status,
+		Message: message,
+	})
+	if m.Reply != "" {
+		if err := m.Respond([]byte(util.JSONStringify(Response{ID: command.ID, Success: status == "executed", Message: message}))); err != nil {
+			r.logger.Error("error responding to remote command: %s", err)
+		}
+	}
+}
+
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return e.reason
+}
+
+func reject(format string, args ...any) error {
+	return &rejectedError{fmt.Sprintf(format, args...)}
+}
+
+// run verifies the command and runs it, a rejectedError is returned when the command wasn't run.
+func (r *RemoteControl) run(m *nats.Msg, command *Command) (string, error) {
+	signature := m.Header.Get(SignatureHeader)
+	if signature == "" {
+		return "", reject("missing signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", reject("invalid signature encoding: %s", err)
+	}
+	result, err := r.verifier.VerifyDetached(m.Data, sig, crypto.Bytes)
+	if err != nil {
+		return "", reject("invalid signature: %s", err)
+	}
+	if err := result.SignatureError(); err != nil {
+		return "", reject("invalid signature: %s", err)
+	}
+	if err := json.Unmarshal(m.Data, command); err != nil {
+		return "", reject("invalid command: %s", err)
+	}
+	if command.ID == "" {
+		return "", reject("missing id")
+	}
+	if command.SessionID != r.config.SessionID {
+		return "", reject("command is for session %s", command.SessionID)
+	}
+	if !slices.Contains(r.config.Allow, command.Action) {
+		return "", reject("action %s is not allowed", command.Action)
+	}
+	if err := r.checkReplay(command); err != nil {
+		return "", err
+	}
+	return r.dispatch(command)
+}
+
+// checkReplay rejects commands which are too old, from too far in the future or which were already received.
+func (r *RemoteControl) checkReplay(command *Command) error {
+	now := r.now()
+	sent := time.UnixMilli(command.Timestamp)
+	if age := now.Sub(sent); age > r.config.MaxAge || age < -r.config.MaxAge {
+		return reject("command was sent at %s which is outside of %v", sent.UTC().Format(time.RFC3339), r.config.MaxAge)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id, received := range r.seen {
+		if now.Sub(received) > 2*r.config.MaxAge {
+			delete(r.seen, id)
+		}
+	}
+	if _, ok := r.seen[command.ID]; ok {
+		return reject("command %s was already received", command.ID)
+	}
+	r.seen[command.ID] = now
+	return nil
+}
+
+func (r *RemoteControl) dispatch(command *Command) (string, error) {
+	handler := r.config.Handler
+	switch command.Action {
+	case ActionPause:
+		return "", handler.Pause(command.Args)
+	case ActionUnpause:
+		return "", handler.Unpause(command.Args)
+	case ActionRestart:
+		return "", handler.Restart()
+	case ActionRotateLogs:
+		return handler.RotateLogs()
+	case ActionSetLogLevel:
+		level := command.Args["level"]
+		if level == "" {
+			return "", fmt.Errorf("missing level")
+		}
+		return "", handler.SetLogLevel(level)
+	}
+	return "", reject("unknown action: %s", command.Action)
+}
+
+func (r *RemoteControl) record(entry AuditEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.audit.WriteString(util.JSONStringify(entry) + "\n"); err != nil {
+		r.logger.Error("error writing audit log: %s", err)
+	}
+}
@@ -0,0 +1,145 @@
+package control
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAllowlist(t *testing.T) {
+	assert.NoError(t, ValidateAllowlist(nil))
+	assert.NoError(t, ValidateAllowlist([]string{"pause", "set-loglevel"}))
+	assert.EqualError(t, ValidateAllowlist([]string{"pause", "shutdown"}), `invalid remote control action: "shutdown", must be one of: pause, unpause, restart, rotate-logs, set-loglevel`)
+}
+
+func runNatsTestServer(t *testing.T) *nats.Conn {
+	port, err := util.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+	srv := natsserver.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+	nc, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestRemoteControl(t *testing.T) {
+	nc := runNatsTestServer(t)
+	pgp := crypto.PGP()
+	key, err := pgp.KeyGeneration().AddUserId("test", "test@example.com").New().GenerateKey()
+	assert.NoError(t, err)
+	publicKey, err := key.GetArmoredPublicKey()
+	assert.NoError(t, err)
+	signer, err := pgp.Sign().SigningKey(key).Detached().New()
+	assert.NoError(t, err)
+	otherKey, err := pgp.KeyGeneration().AddUserId("other", "other@example.com").New().GenerateKey()
+	assert.NoError(t, err)
+	otherSigner, err := pgp.Sign().SigningKey(otherKey).Detached().New()
+	assert.NoError(t, err)
+
+	var paused []map[string]string
+	var levels []string
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	rc, err := New(Config{
+		Logger:    logger.NewTestLogger(),
+		Conn:      nc,
+		SessionID: "s1",
+		PublicKey: publicKey,
+		Allow:     []string{ActionPause, ActionSetLogLevel},
+		AuditFile: auditFile,
+		Handler: Handler{
+			Pause: func(args map[string]string) error {
+				paused = append(paused, args)
+				return nil
+			},
+			SetLogLevel: func(level string) error {
+				if level != "debug" {
+					return fmt.Errorf("invalid level: %s", level)
+				}
+				levels = append(levels, level)
+				return nil
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Start())
+	defer rc.Stop()
+
+	send := func(signer crypto.PGPSign, command Command) Response {
+		t.Helper()
+		buf := []byte(util.JSONStringify(command))
+		msg := nats.NewMsg(Subject("s1"))
+		msg.Data = buf
+		if signer != nil {
+			sig, err := signer.Sign(buf, crypto.Bytes)
+			assert.NoError(t, err)
+			msg.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sig))
+		}
+		reply, err := nc.RequestMsg(msg, 5*time.Second)
+		assert.NoError(t, err)
+		var resp Response
+		assert.NoError(t, json.Unmarshal(reply.Data, &resp))
+		return resp
+	}
+	now := time.Now().UnixMilli()
+
+	resp := send(signer, Command{ID: "1", SessionID: "s1", Action: ActionPause, Args: map[string]string{"table": "order"}, Timestamp: now})
+	assert.True(t, resp.Success, resp.Message)
+	assert.Equal(t, []map[string]string{{"table": "order"}}, paused)
+
+	// the same command can't be run twice
+	resp = send(signer, Command{ID: "1", SessionID: "s1", Action: ActionPause, Timestamp: now})
+	assert.False(t, resp.Success)
+	assert.Equal(t, "command 1 was already received", resp.Message)
+
+	resp = send(nil, Command{ID: "2", SessionID: "s1", Action: ActionPause, Timestamp: now})
+	assert.Equal(t, "missing signature", resp.Message)
+	resp = send(otherSigner, Command{ID: "3", SessionID: "s1", Action: ActionPause, Timestamp: now})
+	assert.False(t, resp.Success)
+	assert.Contains(t, resp.Message, "invalid signature")
+	resp = send(signer, Command{ID: "4", SessionID: "s2", Action: ActionPause, Timestamp: now})
+	assert.Equal(t, "command is for session s2", resp.Message)
+	resp = send(signer, Command{ID: "5", SessionID: "s1", Action: ActionRestart, Timestamp: now})
+	assert.Equal(t, "action restart is not allowed", resp.Message)
+	resp = send(signer, Command{ID: "6", SessionID: "s1", Action: ActionPause, Timestamp: time.Now().Add(-time.Hour).UnixMilli()})
+	assert.False(t, resp.Success)
+	assert.Contains(t, resp.Message, "outside of 5m0s")
+	assert.Len(t, paused, 1)
+
+	resp = send(signer, Command{ID: "7", SessionID: "s1", Action: ActionSetLogLevel, Args: map[string]string{"level": "loud"}, Timestamp: now})
+	assert.Equal(t, "invalid level: loud", resp.Message)
+	resp = send(signer, Command{ID: "8", SessionID: "s1", Action: ActionSetLogLevel, Args: map[string]string{"level": "debug"}, Timestamp: now})
+	assert.True(t, resp.Success, resp.Message)
+	assert.Equal(t, []string{"debug"}, levels)
+
+	assert.NoError(t, rc.Stop())
+	buf, err := os.ReadFile(auditFile)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	var statuses []string
+	for _, line := range lines {
+		var entry AuditEntry
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		statuses = append(statuses, entry.ID+":"+entry.Status)
+	}
+	assert.Equal(t, []string{"1:executed", "1:rejected", ":rejected", ":rejected", // unverified commands aren't decoded
+		"4:rejected", "5:rejected", "6:rejected", "7:failed", "8:executed"}, statuses)
+}
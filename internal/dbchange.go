@@ -2,6 +2,8 @@ package internal
 
 import (
 	"encoding/json"
+	"strconv"
+	"strings"
 
 	"github.com/nats-io/nats.go/jetstream"
 )
@@ -23,6 +25,7 @@ type DBChangeEvent struct {
 	MVCCTimestamp string          `json:"mvccTimestamp"`
 
 	Imported bool          `json:"imported,omitempty"` // NOTE: this is not on the real dbchange but added during import
+	Lineage  *Lineage      `json:"lineage,omitempty"`  // NOTE: this is not on the real dbchange but added by the consumer with the lineage feature
 	NatsMsg  jetstream.Msg `json:"-"`                  // could be nil
 
 	object map[string]any
@@ -30,10 +33,37 @@ type DBChangeEvent struct {
 	SchemaValidatedPath *string `json:"-"` // set by the schema validator if valid and the path is returned as non-empty and not nil
 }
 
+// Lineage traces a delivered event back to the nats message it came from.
+type Lineage struct {
+	StreamSequence uint64 `json:"streamSequence,omitempty"` // the sequence of the message in the dbchange stream
+	Consumer       string `json:"consumer"`                 // the name of the consumer which delivered the message
+	Version        string `json:"version"`                  // the version of eds which delivered the message
+	BatchID        string `json:"batchId"`                  // the id shared by the events which were flushed together
+}
+
+// Headers returns the lineage as message headers for the drivers which send messages.
+func (l *Lineage) Headers() map[string]string {
+	headers := map[string]string{
+		"eds-consumer": l.Consumer,
+		"eds-version":  l.Version,
+		"eds-batch-id": l.BatchID,
+	}
+	if l.StreamSequence > 0 {
+		headers["eds-stream-sequence"] = strconv.FormatUint(l.StreamSequence, 10)
+	}
+	return headers
+}
+
 func (c *DBChangeEvent) String() string {
 	return "DBChangeEvent[op=" + c.Operation + ",table=" + c.Table + ",id=" + c.ID + ",pk=" + c.GetPrimaryKey() + "]"
 }
 
+// OrderingKey returns the key shared by the changes of the same record. The consumer processes the events with the same
+// ordering key one at a time in the order they were delivered, even when they're spread across several pipelines.
+func (c *DBChangeEvent) OrderingKey() string {
+	return c.Table + ":" + c.GetPrimaryKey()
+}
+
 func (c *DBChangeEvent) GetPrimaryKey() string {
 	if len(c.Key) >= 1 {
 		return c.Key[len(c.Key)-1]
@@ -47,6 +77,60 @@ func (c *DBChangeEvent) GetPrimaryKey() string {
 	return ""
 }
 
+// EventVersion is the hybrid logical clock version of a change event which can be used to order changes for the same key.
+type EventVersion struct {
+	Wall    int64
+	Logical int64
+}
+
+// Compare returns -1 if v is older than o, 1 if v is newer than o and 0 if they are the same version.
+func (v EventVersion) Compare(o EventVersion) int {
+	switch {
+	case v.Wall < o.Wall:
+		return -1
+	case v.Wall > o.Wall:
+		return 1
+	case v.Logical < o.Logical:
+		return -1
+	case v.Logical > o.Logical:
+		return 1
+	}
+	return 0
+}
+
+// IsZero returns true if the version is not set.
+func (v EventVersion) IsZero() bool {
+	return v.Wall == 0 && v.Logical == 0
+}
+
+// GetVersion returns the version of the event using the mvcc timestamp and falling back to the event timestamp if not available.
+func (c *DBChangeEvent) GetVersion() EventVersion {
+	if c.MVCCTimestamp != "" {
+		wall, logical, _ := strings.Cut(c.MVCCTimestamp, ".")
+		if w, err := strconv.ParseInt(wall, 10, 64); err == nil {
+			var v EventVersion
+			v.Wall = w
+			if logical != "" {
+				v.Logical, _ = strconv.ParseInt(logical, 10, 64)
+			}
+			return v
+		}
+	}
+	return EventVersion{Wall: c.Timestamp * 1_000_000} // timestamp is in milliseconds and the mvcc wall time is in nanoseconds
+}
+
+// GetStreamSequence returns the sequence of the event in the nats stream or 0 if not available such as during an import.
+func (c *DBChangeEvent) GetStreamSequence() uint64 {
+	if c.NatsMsg == nil {
+		return 0
+	}
+	md, err := c.NatsMsg.Metadata()
+	if err != nil {
+		return 0
+	}
+	return md.Sequence.Stream
+}
+
 // OmitProperties removes the specified properties from the object
 func (c *DBChangeEvent) OmitProperties(props ...string) error {
 	object, err := c.GetObject()
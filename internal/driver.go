@@ -2,9 +2,16 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/charmbracelet/x/ansi"
 	"github.com/shopmonkeyus/eds/internal/tracker"
@@ -14,6 +21,53 @@ import (
 // ErrDriverStopped is returned when the driver has been stopped and a process or flush is called.
 var ErrDriverStopped = fmt.Errorf("driver stopped")
 
+// ErrRetryable is wrapped by drivers to mark an error as transient so the failed events are retried later.
+var ErrRetryable = errors.New("retryable")
+
+// NewRetryableError marks the error as transient so the failed events are retried later.
+func NewRetryableError(err error) error {
+	return fmt.Errorf("%w: %w", ErrRetryable, err)
+}
+
+// IsRetryableError returns true if the error is transient such as an error marked with NewRetryableError, a timeout or a
+// connection which was refused or reset.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrRetryable) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// ErrScratchQuotaExceeded is returned when writing to scratch space would exceed the configured quota.
+var ErrScratchQuotaExceeded = errors.New("scratch space quota exceeded")
+
+// ScratchSpace manages the temporary files for drivers which need to stage data on disk before loading it.
+type ScratchSpace interface {
+	// Allocate returns a new empty directory for staging files. The prefix is used to identify the directory.
+	Allocate(prefix string) (ScratchDir, error)
+}
+
+// ScratchDir is a directory in scratch space. It must be released when it's no longer needed, even if the batch fails.
+type ScratchDir interface {
+	// Path returns the absolute path to the directory.
+	Path() string
+
+	// Create a new file in the directory. Writes return ErrScratchQuotaExceeded if the quota would be exceeded. When the
+	// scratch space is encrypted the data is written in chunks so the error may only be returned by a later Write or Close.
+	Create(name string) (io.WriteCloser, error)
+
+	// Open a file in the directory for reading. Files must be read with Open instead of from Path since they may be
+	// encrypted on disk.
+	Open(name string) (io.ReadCloser, error)
+
+	// Release removes the directory and all of its files.
+	Release() error
+}
+
 // DriverConfig is the configuration for a driver.
 type DriverConfig struct {
 
@@ -34,6 +88,9 @@ type DriverConfig struct {
 
 	// DataDir is the directory where the driver can store data.
 	DataDir string
+
+	// Scratch is the shared scratch space for staging temporary files. Drivers should use this instead of creating temp files directly.
+	Scratch ScratchSpace
 }
 
 // DriverSessionHandler is for drivers that want to receive the session id
@@ -41,6 +98,38 @@ type DriverSessionHandler interface {
 	SetSessionID(sessionID string)
 }
 
+// DriverAggregation is for drivers that collapse events into time windows before writing.
+type DriverAggregation interface {
+	// AggregationWindow returns how long events should be accumulated before Flush is called or 0 if aggregation is disabled.
+	AggregationWindow() time.Duration
+}
+
+// DriverBatchProcessor is for drivers that build set-based operations from all the events of a batch. When implemented,
+// the consumer calls ProcessBatch with the events of the batch right before Flush instead of calling Process for each event.
+type DriverBatchProcessor interface {
+	// ProcessBatch processes the events of a batch in the order they were received. If an error is returned, the consumer will NAK all the events of the batch.
+	ProcessBatch(logger logger.Logger, events []DBChangeEvent) error
+}
+
+// ErrTableNotFound is returned when a table doesn't exist in the destination.
+var ErrTableNotFound = errors.New("table not found")
+
+// DriverSnapshot is for drivers which can read back the rows of a destination table, such as for support to verify
+// what the destination contains.
+type DriverSnapshot interface {
+	// Snapshot writes up to limit rows of the table to w as CSV with a header row of the column names, or all the rows if
+	// the limit is 0. ErrTableNotFound is returned if the table doesn't exist.
+	Snapshot(ctx context.Context, logger logger.Logger, table string, limit int, w io.Writer) error
+}
+
+// DriverLookup is for drivers which can check if the change of an event is in the destination, such as to reconcile the
+// events which were being processed when the server crashed.
+type DriverLookup interface {
+	// Lookup returns true if the change of the event is in the destination, such as the row of an insert exists, the
+	// row of an update exists with a version at least as new as the event's or the row of a delete doesn't.
+	Lookup(ctx context.Context, logger logger.Logger, event DBChangeEvent) (bool, error)
+}
+
 // DriverLifecycle is the interface that must be implemented by all driver implementations.
 type DriverLifecycle interface {
 
@@ -139,6 +228,7 @@ func driverSupportsMigration(driver Driver) bool {
 
 var driverRegistry = map[string]Driver{}
 var driverAliasRegistry = map[string]string{}
+var driverPrototypes = map[string]Driver{} // unstarted copies of the registered drivers to create new instances from
 
 // GetDriverMetadata returns the metadata for all the registered drivers.
 func GetDriverMetadata() []DriverMetadata {
@@ -221,6 +311,7 @@ func GetDriverMetadataForURL(urlString string) (*DriverMetadata, error) {
 // Register registers a driver for a given protocol.
 func RegisterDriver(protocol string, driver Driver) {
 	driverRegistry[protocol] = driver
+	driverPrototypes[protocol] = copyDriver(driver)
 	if p, ok := driver.(DriverAlias); ok {
 		for _, alias := range p.Aliases() {
 			driverAliasRegistry[alias] = protocol
@@ -228,21 +319,44 @@ func RegisterDriver(protocol string, driver Driver) {
 	}
 }
 
+// copyDriver returns a shallow copy of the driver.
+func copyDriver(driver Driver) Driver {
+	val := reflect.ValueOf(driver)
+	if val.Kind() != reflect.Pointer || val.Elem().Kind() != reflect.Struct {
+		return driver
+	}
+	instance := reflect.New(val.Elem().Type())
+	instance.Elem().Set(val.Elem())
+	return instance.Interface().(Driver)
+}
+
 // NewDriver creates a new driver for the given URL.
-func NewDriver(ctx context.Context, logger logger.Logger, urlString string, registry SchemaRegistry, tracker *tracker.Tracker, datadir string) (Driver, error) {
+func NewDriver(ctx context.Context, logger logger.Logger, urlString string, registry SchemaRegistry, tracker *tracker.Tracker, datadir string, scratch ScratchSpace) (Driver, error) {
+	return newDriver(ctx, logger, urlString, registry, tracker, datadir, scratch, false)
+}
+
+// NewDriverInstance creates a new driver for the given URL which is a separate instance from the one returned by
+// NewDriver, with its own connection, so several instances of the driver can process events at the same time.
+func NewDriverInstance(ctx context.Context, logger logger.Logger, urlString string, registry SchemaRegistry, tracker *tracker.Tracker, datadir string, scratch ScratchSpace) (Driver, error) {
+	return newDriver(ctx, logger, urlString, registry, tracker, datadir, scratch, true)
+}
+
+func newDriver(ctx context.Context, logger logger.Logger, urlString string, registry SchemaRegistry, tracker *tracker.Tracker, datadir string, scratch ScratchSpace, instance bool) (Driver, error) {
 	u, err := url.Parse(urlString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URL: %w", err)
 	}
-	driver := driverRegistry[u.Scheme]
+	protocol := u.Scheme
+	if driverRegistry[protocol] == nil {
+		protocol = driverAliasRegistry[u.Scheme]
+	}
+	driver := driverRegistry[protocol]
 	if driver == nil {
-		protocol := driverAliasRegistry[u.Scheme]
-		if protocol != "" {
-			driver = driverRegistry[protocol]
-		}
-		if driver == nil {
-			return nil, fmt.Errorf("no driver registered for protocol %s", u.Scheme)
-		}
+		return nil, fmt.Errorf("no driver registered for protocol %s", u.Scheme)
+	}
+	if instance {
+		// the registered driver may already be started so copy the unstarted one
+		driver = copyDriver(driverPrototypes[protocol])
 	}
 
 	// start the driver if it implements the DriverLifecycle interface
@@ -254,6 +368,7 @@ func NewDriver(ctx context.Context, logger logger.Logger, urlString string, regi
 			SchemaRegistry: registry,
 			Tracker:        tracker,
 			DataDir:        datadir,
+			Scratch:        scratch,
 		}); err != nil {
 			return nil, err
 		}
@@ -342,6 +457,17 @@ func OptionalNumberField(name, description string, defval *int) DriverField {
 	}
 }
 
+func OptionalBooleanField(name, description string, defval bool) DriverField {
+	defstr := strconv.FormatBool(defval)
+	return DriverField{
+		Name:        name,
+		Type:        DriverTypeBoolean,
+		Description: description,
+		Required:    false,
+		Default:     &defstr,
+	}
+}
+
 func StringPointer(val string) *string {
 	if val == "" {
 		return nil
@@ -409,6 +535,18 @@ func GetOptionalIntValue(name string, def int, values map[string]any) int {
 	return def
 }
 
+func GetOptionalBoolValue(name string, def bool, values map[string]any) bool {
+	if val, ok := values[name].(bool); ok {
+		return val
+	}
+	if val, ok := values[name].(string); ok {
+		if boolVal, err := strconv.ParseBool(val); err == nil {
+			return boolVal
+		}
+	}
+	return def
+}
+
 func URLFromDatabaseConfiguration(schema string, defport int, values map[string]any) string {
 	hostname := GetRequiredStringValue("Hostname", values)
 	username := GetOptionalStringValue("Username", "", values)
@@ -432,6 +570,32 @@ func URLFromDatabaseConfiguration(schema string, defport int, values map[string]
 	return unescapedUrl
 }
 
+// ReadReplicaField is the configuration field for the hostname of a read replica.
+func ReadReplicaField() DriverField {
+	return OptionalStringField("Read Hostname", "The hostname or ip address of a read replica to use for queries instead of the primary", nil)
+}
+
+// AppendReadURLFromDatabaseConfiguration adds the readURL query parameter to the url when a read replica hostname is configured.
+// The read replica uses the same port and database as the primary and inherits its credentials.
+func AppendReadURLFromDatabaseConfiguration(urlstr string, schema string, defport int, values map[string]any) string {
+	hostname := GetOptionalStringValue("Read Hostname", "", values)
+	if hostname == "" {
+		return urlstr
+	}
+	readValues := make(map[string]any, len(values))
+	for k, v := range values {
+		readValues[k] = v
+	}
+	readValues["Hostname"] = hostname
+	delete(readValues, "Username")
+	delete(readValues, "Password")
+	sep := "?"
+	if strings.Contains(urlstr, "?") {
+		sep = "&"
+	}
+	return urlstr + sep + "readURL=" + url.QueryEscape(URLFromDatabaseConfiguration(schema, defport, readValues))
+}
+
 func NewDatabaseConfiguration(defport int) []DriverField {
 	fields := []DriverField{
 		RequiredStringField("Database", "The database name to use", nil),
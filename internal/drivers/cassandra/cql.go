@@ -0,0 +1,185 @@
+package cassandra
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// quoteIdentifier quotes the name so that it keeps its case, otherwise CQL folds it to lower case.
+func quoteIdentifier(val string) string {
+	return util.ANSIIdentifiers.Quote(val)
+}
+
+func quoteIdentifiers(vals []string) []string {
+	return util.ANSIIdentifiers.QuoteAll(vals)
+}
+
+func tableName(keyspace string, table string) string {
+	return quoteIdentifier(keyspace) + "." + quoteIdentifier(table)
+}
+
+// cqlType returns the column type. Objects and arrays are stored as JSON text since their shape isn't fixed.
+func cqlType(prop internal.SchemaProperty) string {
+	switch prop.Type {
+	case "integer":
+		return "bigint"
+	case "number":
+		return "double"
+	case "boolean":
+		return "boolean"
+	case "string":
+		if prop.Format == "date-time" {
+			return "timestamp"
+		}
+	}
+	return "text"
+}
+
+// keyColumns returns the columns of the primary key. They are all part of the partition key so each row is its own
+// partition.
+func keyColumns(schema *internal.Schema) []string {
+	if len(schema.PrimaryKeys) > 0 {
+		return schema.PrimaryKeys
+	}
+	return []string{"id"}
+}
+
+// createKeyspaceCQL returns the statement to create the keyspace. The NetworkTopologyStrategy is used when the
+// datacenter is set, otherwise the SimpleStrategy.
+func createKeyspaceCQL(keyspace string, datacenter string, replication int) string {
+	if datacenter != "" {
+		return fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'NetworkTopologyStrategy', '%s': %d}", quoteIdentifier(keyspace), strings.ReplaceAll(datacenter, "'", "''"), replication)
+	}
+	return fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': %d}", quoteIdentifier(keyspace), replication)
+}
+
+// dropCQL returns the statement to drop the table if it exists.
+func dropCQL(keyspace string, s *internal.Schema) string {
+	return "DROP TABLE IF EXISTS " + tableName(keyspace, s.Table)
+}
+
+// createCQL returns the statement to create the table if it doesn't exist.
+func createCQL(keyspace string, s *internal.Schema) string {
+	var cql strings.Builder
+	cql.WriteString("CREATE TABLE IF NOT EXISTS ")
+	cql.WriteString(tableName(keyspace, s.Table))
+	cql.WriteString(" (\n")
+	for _, name := range s.Columns() {
+		cql.WriteString("\t")
+		cql.WriteString(quoteIdentifier(name))
+		cql.WriteString(" ")
+		cql.WriteString(cqlType(s.Properties[name]))
+		cql.WriteString(",\n")
+	}
+	cql.WriteString("\tPRIMARY KEY ((")
+	cql.WriteString(strings.Join(quoteIdentifiers(keyColumns(s)), ", "))
+	cql.WriteString("))\n)")
+	return cql.String()
+}
+
+// addNewColumnsCQL returns the statements to add the columns which don't exist yet.
+func addNewColumnsCQL(logger logger.Logger, keyspace string, columns []string, s *internal.Schema, db internal.DatabaseSchema) []string {
+	var res []string
+	for _, column := range columns {
+		if ok, _ := db.GetType(s.Table, column); ok {
+			logger.Warn("skipping migration for column: %s for table: %s since it already exists", column, s.Table)
+			continue
+		}
+		res = append(res, fmt.Sprintf("ALTER TABLE %s ADD %s %s", tableName(keyspace, s.Table), quoteIdentifier(column), cqlType(s.Properties[column])))
+	}
+	return res
+}
+
+// upsertCQL returns the INSERT statement for all the columns of the table. An INSERT replaces the existing row with
+// the same primary key so it's used for updates too.
+func upsertCQL(keyspace string, s *internal.Schema) string {
+	columns := s.Columns()
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", tableName(keyspace, s.Table), strings.Join(quoteIdentifiers(columns), ","), strings.Repeat("?,", len(columns)-1)+"?")
+}
+
+// deleteCQL returns the DELETE statement for a row by its primary key.
+func deleteCQL(keyspace string, s *internal.Schema) string {
+	keys := keyColumns(s)
+	where := make([]string, len(keys))
+	for i, key := range keys {
+		where[i] = quoteIdentifier(key) + " = ?"
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", tableName(keyspace, s.Table), strings.Join(where, " AND "))
+}
+
+// schemaCQL is the query for the columns of the tables in a keyspace.
+const schemaCQL = "SELECT table_name, column_name, type FROM system_schema.columns WHERE keyspace_name = ?"
+
+// toValue converts a JSON value to the type which is bound for the column type.
+func toValue(val any, prop internal.SchemaProperty) (any, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch cqlType(prop) {
+	case "bigint":
+		if v, ok := val.(float64); ok {
+			return int64(v), nil
+		}
+	case "double":
+		if v, ok := val.(float64); ok {
+			return v, nil
+		}
+	case "boolean":
+		if v, ok := val.(bool); ok {
+			return v, nil
+		}
+	case "timestamp":
+		if v, ok := val.(string); ok {
+			tv, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp: %s", v)
+			}
+			return tv, nil
+		}
+	case "text":
+		if v, ok := val.(string); ok {
+			return v, nil
+		}
+		return util.JSONStringify(val), nil
+	}
+	return nil, fmt.Errorf("unexpected value %v for type %s", val, prop.Type)
+}
+
+// upsertValues returns the values bound to the statement from upsertCQL.
+func upsertValues(s *internal.Schema, object map[string]any) ([]any, error) {
+	columns := s.Columns()
+	values := make([]any, len(columns))
+	for i, name := range columns {
+		val, err := toValue(object[name], s.Properties[name])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", name, err)
+		}
+		values[i] = val
+	}
+	return values, nil
+}
+
+// deleteValues returns the values bound to the statement from deleteCQL using the keys of the event when available.
+func deleteValues(s *internal.Schema, record *util.Record) ([]any, error) {
+	keys := keyColumns(s)
+	object := map[string]any{keys[len(keys)-1]: record.Id}
+	if record.Event != nil && len(record.Event.Key) == len(keys) {
+		for i, key := range keys {
+			object[key] = record.Event.Key[i]
+		}
+	}
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		val, err := toValue(object[key], s.Properties[key])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", key, err)
+		}
+		values[i] = val
+	}
+	return values, nil
+}
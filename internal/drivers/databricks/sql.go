@@ -0,0 +1,283 @@
+package databricks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	maxMergeRows = 500       // number of rows in the source of a single MERGE statement
+	operationCol = "_eds_op" // the column in the MERGE source with the operation of the row
+)
+
+func quoteIdentifier(val string) string {
+	return util.DatabricksIdentifiers.Quote(val)
+}
+
+func quoteIdentifiers(vals []string) []string {
+	return util.DatabricksIdentifiers.QuoteAll(vals)
+}
+
+// quoteString returns a string literal. Backslashes are escape characters in Databricks SQL string literals.
+func quoteString(val string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(val, `\`, `\\`), "'", `\'`) + "'"
+}
+
+func sqlType(prop internal.SchemaProperty) string {
+	switch prop.Type {
+	case "integer":
+		return "BIGINT"
+	case "number":
+		return "DOUBLE"
+	case "boolean":
+		return "BOOLEAN"
+	case "string":
+		if prop.Format == "date-time" {
+			return "TIMESTAMP"
+		}
+		if prop.IsBinary() {
+			return "BINARY"
+		}
+	}
+	return "STRING"
+}
+
+// toValue converts a JSON value to the string representation used for both SQL literals and CSV fields.
+// Binary values are hex since CSV fields can only hold text. It returns false if the value is NULL.
+func toValue(val any, prop internal.SchemaProperty) (string, bool) {
+	switch v := util.EncodeBinaryValue(val, prop).(type) {
+	case nil:
+		return "", false
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		if prop.Type == "integer" {
+			return strconv.FormatInt(int64(v), 10), true
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		return v, true
+	default:
+		return util.JSONStringify(v), true
+	}
+}
+
+// quoteValue returns the literal for the value cast to the column type so the types of the MERGE source match the table.
+func quoteValue(val any, prop internal.SchemaProperty) string {
+	typ := sqlType(prop)
+	v, ok := toValue(val, prop)
+	if !ok {
+		return "CAST(NULL AS " + typ + ")"
+	}
+	switch typ {
+	case "STRING":
+		return quoteString(v)
+	case "BOOLEAN":
+		if _, ok := val.(bool); ok {
+			return v
+		}
+	case "BIGINT", "DOUBLE":
+		if _, ok := val.(float64); ok {
+			return "CAST(" + v + " AS " + typ + ")"
+		}
+	case "BINARY":
+		if _, ok := util.ToBinaryValue(val, prop).([]byte); ok {
+			return "X'" + v + "'"
+		}
+	}
+	return "CAST(" + quoteString(v) + " AS " + typ + ")"
+}
+
+// keyColumns returns the columns which identify a row. The MERGE matches on all of them.
+func keyColumns(schema *internal.Schema) []string {
+	if len(schema.PrimaryKeys) > 0 {
+		return schema.PrimaryKeys
+	}
+	return []string{"id"}
+}
+
+// deletedKeys returns the key values of a deleted row using the keys of the event when available.
+func deletedKeys(keys []string, record *util.Record) map[string]any {
+	object := map[string]any{keys[len(keys)-1]: record.Id}
+	if record.Event != nil && len(record.Event.Key) == len(keys) {
+		for i, key := range keys {
+			object[key] = record.Event.Key[i]
+		}
+	}
+	return object
+}
+
+func createSQL(s *internal.Schema) string {
+	var sql strings.Builder
+	sql.WriteString("CREATE OR REPLACE TABLE ")
+	sql.WriteString(quoteIdentifier(s.Table))
+	sql.WriteString(" (\n")
+	columns := s.Columns()
+	for i, name := range columns {
+		prop := s.Properties[name]
+		sql.WriteString("\t")
+		sql.WriteString(quoteIdentifier(name))
+		sql.WriteString(" ")
+		sql.WriteString(sqlType(prop))
+		if util.SliceContains(s.PrimaryKeys, name) {
+			sql.WriteString(" NOT NULL")
+		}
+		if i < len(columns)-1 {
+			sql.WriteString(",")
+		}
+		sql.WriteString("\n")
+	}
+	sql.WriteString(") USING DELTA")
+	if len(s.PrimaryKeys) > 0 {
+		// clustering on the primary key keeps the files scanned by the MERGE small
+		sql.WriteString(" CLUSTER BY (")
+		sql.WriteString(strings.Join(quoteIdentifiers(s.PrimaryKeys), ", "))
+		sql.WriteString(")")
+	}
+	sql.WriteString(";")
+	return sql.String()
+}
+
+func addNewColumnsSQL(logger logger.Logger, columns []string, s *internal.Schema, db internal.DatabaseSchema) []string {
+	var res []string
+	for _, column := range columns {
+		if ok, _ := db.GetType(s.Table, column); ok {
+			logger.Warn("skipping migration for column: %s for table: %s since it already exists", column, s.Table)
+			continue
+		}
+		res = append(res, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", quoteIdentifier(s.Table), quoteIdentifier(column), sqlType(s.Properties[column])))
+	}
+	return res
+}
+
+// mergeSQL returns the MERGE statements to apply the records for a single table. The records must be for distinct keys
+// which the batcher guarantees. Deleted rows only have their keys set in the source.
+func mergeSQL(s *internal.Schema, records []*util.Record) []string {
+	columns := s.Columns()
+	keys := keyColumns(s)
+	var res []string
+	for start := 0; start < len(records); start += maxMergeRows {
+		end := min(start+maxMergeRows, len(records))
+		var sql strings.Builder
+		sql.WriteString("MERGE INTO ")
+		sql.WriteString(quoteIdentifier(s.Table))
+		sql.WriteString(" AS t USING (")
+		for i, record := range records[start:end] {
+			if i > 0 {
+				sql.WriteString(" UNION ALL")
+			}
+			object := record.Object
+			if record.Operation == "DELETE" || object == nil {
+				object = deletedKeys(keys, record)
+			}
+			values := make([]string, 0, len(columns)+1)
+			values = append(values, quoteString(record.Operation)+" AS "+quoteIdentifier(operationCol))
+			for _, name := range columns {
+				values = append(values, quoteValue(object[name], s.Properties[name])+" AS "+quoteIdentifier(name))
+			}
+			sql.WriteString("\nSELECT ")
+			sql.WriteString(strings.Join(values, ","))
+		}
+		sql.WriteString("\n) AS s ON ")
+		for i, key := range keys {
+			if i > 0 {
+				sql.WriteString(" AND ")
+			}
+			sql.WriteString("t.")
+			sql.WriteString(quoteIdentifier(key))
+			sql.WriteString(" = s.")
+			sql.WriteString(quoteIdentifier(key))
+		}
+		op := "s." + quoteIdentifier(operationCol)
+		sql.WriteString("\nWHEN MATCHED AND ")
+		sql.WriteString(op)
+		sql.WriteString(" = 'DELETE' THEN DELETE\nWHEN MATCHED THEN UPDATE SET ")
+		sets := make([]string, len(columns))
+		for i, name := range columns {
+			sets[i] = "t." + quoteIdentifier(name) + " = s." + quoteIdentifier(name)
+		}
+		sql.WriteString(strings.Join(sets, ", "))
+		sql.WriteString("\nWHEN NOT MATCHED AND ")
+		sql.WriteString(op)
+		sql.WriteString(" <> 'DELETE' THEN INSERT (")
+		sql.WriteString(strings.Join(quoteIdentifiers(columns), ","))
+		sql.WriteString(") VALUES (")
+		sources := make([]string, len(columns))
+		for i, name := range columns {
+			sources[i] = "s." + quoteIdentifier(name)
+		}
+		sql.WriteString(strings.Join(sources, ","))
+		sql.WriteString(");")
+		res = append(res, sql.String())
+	}
+	return res
+}
+
+// rowSQL returns the values of the row for an insert statement.
+func rowSQL(s *internal.Schema, row map[string]any) string {
+	columns := s.Columns()
+	values := make([]string, len(columns))
+	for i, name := range columns {
+		values[i] = quoteValue(row[name], s.Properties[name])
+	}
+	return "(" + strings.Join(values, ",") + ")"
+}
+
+// insertSQL returns the statements to insert the rows for an import when no staging volume is configured.
+func insertSQL(s *internal.Schema, rows []map[string]any) []string {
+	columns := s.Columns()
+	var res []string
+	for start := 0; start < len(rows); start += maxMergeRows {
+		end := min(start+maxMergeRows, len(rows))
+		var sql strings.Builder
+		sql.WriteString("INSERT INTO ")
+		sql.WriteString(quoteIdentifier(s.Table))
+		sql.WriteString(" (")
+		sql.WriteString(strings.Join(quoteIdentifiers(columns), ","))
+		sql.WriteString(") VALUES")
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				sql.WriteString(",")
+			}
+			sql.WriteString("\n")
+			sql.WriteString(rowSQL(s, row))
+		}
+		sql.WriteString(";")
+		res = append(res, sql.String())
+	}
+	return res
+}
+
+// copySQL returns the COPY INTO statement to load the staged CSV file. The CSV columns are cast to the column types
+// explicitly and empty fields are loaded as NULL.
+func copySQL(s *internal.Schema, path string) string {
+	columns := s.Columns()
+	selects := make([]string, len(columns))
+	for i, name := range columns {
+		if s.Properties[name].IsBinary() {
+			// casting a string to binary would load the hex text so it has to be decoded
+			selects[i] = fmt.Sprintf("unhex(_c%d) AS %s", i, quoteIdentifier(name))
+			continue
+		}
+		selects[i] = fmt.Sprintf("CAST(_c%d AS %s) AS %s", i, sqlType(s.Properties[name]), quoteIdentifier(name))
+	}
+	var sql strings.Builder
+	sql.WriteString("COPY INTO ")
+	sql.WriteString(quoteIdentifier(s.Table))
+	sql.WriteString("\nFROM (SELECT ")
+	sql.WriteString(strings.Join(selects, ", "))
+	sql.WriteString(" FROM ")
+	sql.WriteString(quoteString(path))
+	sql.WriteString(")\nFILEFORMAT = CSV\nFORMAT_OPTIONS ('header' = 'false', 'multiLine' = 'true', 'escape' = '\"');")
+	return sql.String()
+}
+
+// schemaSQL returns the query for the columns of the tables in the schema.
+func schemaSQL(catalog string, schema string) string {
+	return fmt.Sprintf("SELECT table_name, column_name, data_type FROM %s.information_schema.columns WHERE table_schema = %s", quoteIdentifier(catalog), quoteString(schema))
+}
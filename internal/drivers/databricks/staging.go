@@ -0,0 +1,53 @@
+package databricks
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// stagedFile buffers the rows for a table as CSV in the column order of the schema so they can be uploaded
+// to the staging volume and loaded with COPY INTO.
+type stagedFile struct {
+	schema *internal.Schema
+	buf    bytes.Buffer
+	writer *csv.Writer
+	count  int
+}
+
+func newStagedFile(schema *internal.Schema) *stagedFile {
+	f := &stagedFile{schema: schema}
+	f.writer = csv.NewWriter(&f.buf)
+	return f
+}
+
+// add writes the object as a row. NULL values are written as empty fields.
+func (f *stagedFile) add(object map[string]any) error {
+	columns := f.schema.Columns()
+	row := make([]string, len(columns))
+	for i, name := range columns {
+		row[i], _ = toValue(object[name], f.schema.Properties[name])
+	}
+	if err := f.writer.Write(row); err != nil {
+		return fmt.Errorf("error writing csv row: %w", err)
+	}
+	f.count++
+	return nil
+}
+
+// size returns the number of bytes of CSV data written so far.
+func (f *stagedFile) size() int {
+	f.writer.Flush()
+	return f.buf.Len()
+}
+
+// bytes returns the CSV data written so far.
+func (f *stagedFile) bytes() ([]byte, error) {
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
+		return nil, fmt.Errorf("error flushing csv: %w", err)
+	}
+	return f.buf.Bytes(), nil
+}
@@ -0,0 +1,144 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const maxBulkErrors = 10 // number of failed items included in the error returned for a bulk request
+
+type bulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type bulkItemResult struct {
+	Index  string         `json:"_index"`
+	ID     string         `json:"_id"`
+	Status int            `json:"status"`
+	Error  *bulkItemError `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool                         `json:"errors"`
+	Items  []map[string]*bulkItemResult `json:"items"`
+}
+
+// err returns an error for the items which failed. Deleting a document which doesn't exist isn't an error.
+func (r *bulkResponse) err() error {
+	if !r.Errors {
+		return nil
+	}
+	var errs []error
+	var failed int
+	for _, item := range r.Items {
+		for action, result := range item {
+			if result == nil || (result.Status >= 200 && result.Status <= 299) {
+				continue
+			}
+			if action == "delete" && result.Status == http.StatusNotFound {
+				continue
+			}
+			failed++
+			if len(errs) < maxBulkErrors {
+				reason := http.StatusText(result.Status)
+				if result.Error != nil {
+					reason = result.Error.Type + ": " + result.Error.Reason
+				}
+				errs = append(errs, fmt.Errorf("%s %s/%s failed with status %d: %s", action, result.Index, result.ID, result.Status, reason))
+			}
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d bulk item(s) failed: %w", failed, errors.Join(errs...))
+}
+
+// bulkBody returns the NDJSON body for the _bulk API. Inserts and updates index the full document and deletes remove it
+// so applying the same records again has the same result.
+func bulkBody(c *client, records []*util.Record) []byte {
+	var buf bytes.Buffer
+	for _, record := range records {
+		meta := map[string]any{"_index": c.index(record.Table), "_id": record.Id}
+		if record.Operation == "DELETE" {
+			buf.WriteString(util.JSONStringify(map[string]any{"delete": meta}))
+			buf.WriteByte('\n')
+			continue
+		}
+		buf.WriteString(util.JSONStringify(map[string]any{"index": meta}))
+		buf.WriteByte('\n')
+		buf.WriteString(util.JSONStringify(record.Object))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// fieldMapping returns the mapping for the schema property. Keys are mapped as keywords so they can be used for exact
+// matches and joins, other strings are full text with a keyword sub-field like the default dynamic mapping. Objects are
+// kept in the source but not indexed since their shape isn't part of the schema.
+func fieldMapping(name string, prop internal.SchemaProperty, keys []string) map[string]any {
+	switch prop.Type {
+	case "integer":
+		return map[string]any{"type": "long"}
+	case "number":
+		return map[string]any{"type": "double"}
+	case "boolean":
+		return map[string]any{"type": "boolean"}
+	case "string":
+		if prop.Format == "date-time" {
+			return map[string]any{"type": "date"}
+		}
+		if prop.IsBinary() {
+			return map[string]any{"type": "binary"}
+		}
+		if util.SliceContains(keys, name) || strings.HasSuffix(name, "Id") {
+			return map[string]any{"type": "keyword"}
+		}
+		return map[string]any{"type": "text", "fields": map[string]any{"keyword": map[string]any{"type": "keyword", "ignore_above": 256}}}
+	case "array":
+		if prop.Items != nil {
+			switch prop.Items.Type {
+			case "string":
+				return map[string]any{"type": "keyword"}
+			case "integer":
+				return map[string]any{"type": "long"}
+			case "number":
+				return map[string]any{"type": "double"}
+			case "boolean":
+				return map[string]any{"type": "boolean"}
+			}
+		}
+	}
+	return map[string]any{"type": "object", "enabled": false}
+}
+
+// mappingProperties returns the mapping for the columns of the schema.
+func mappingProperties(s *internal.Schema, columns []string) map[string]any {
+	properties := make(map[string]any)
+	for _, name := range columns {
+		properties[name] = fieldMapping(name, s.Properties[name], s.PrimaryKeys)
+	}
+	return properties
+}
+
+// templateBody returns the index template for the table. Dynamic mapping is disabled so a column which isn't in the
+// schema yet is kept in the source without guessing its type, it's mapped when the column is migrated.
+func templateBody(c *client, s *internal.Schema) map[string]any {
+	return map[string]any{
+		"index_patterns": []string{c.index(s.Table)},
+		"template": map[string]any{
+			"mappings": map[string]any{
+				"dynamic":    false,
+				"properties": mappingProperties(s, s.Columns()),
+			},
+		},
+		"_meta": map[string]any{"source": "eds", "table": s.Table, "modelVersion": s.ModelVersion},
+	}
+}
@@ -0,0 +1,137 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// section is the events matching a filter.
+type section struct {
+	Count int        `json:"count"`
+	Sum   float64    `json:"sum,omitempty"`
+	Rows  [][]string `json:"rows,omitempty"`
+}
+
+// digest accumulates the events until the digest is sent. It's saved in the tracker so a restart doesn't lose it.
+type digest struct {
+	Start    time.Time      `json:"start"`
+	Counts   map[string]int `json:"counts"`
+	Sections []*section     `json:"sections"`
+}
+
+func newDigest(filters []Filter, start time.Time) *digest {
+	d := &digest{Start: start, Counts: make(map[string]int)}
+	for range filters {
+		d.Sections = append(d.Sections, &section{})
+	}
+	return d
+}
+
+// loadDigest decodes a saved digest, starting a new one if the filters have changed since it was saved.
+func loadDigest(filters []Filter, buf string, start time.Time) *digest {
+	var d digest
+	if err := json.Unmarshal([]byte(buf), &d); err != nil || len(d.Sections) != len(filters) || d.Counts == nil {
+		return newDigest(filters, start)
+	}
+	return &d
+}
+
+func (d *digest) empty() bool {
+	return len(d.Counts) == 0
+}
+
+// add counts the event and adds it to the section for each matching filter.
+func (d *digest) add(filters []Filter, event *internal.DBChangeEvent) error {
+	data := event.After
+	if event.Operation == "DELETE" {
+		data = event.Before
+	}
+	object := make(map[string]any)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &object); err != nil {
+			return fmt.Errorf("error decoding event %s: %w", event.ID, err)
+		}
+	}
+	if _, ok := object["id"]; !ok {
+		object["id"] = event.GetPrimaryKey()
+	}
+	d.Counts[event.Table+" "+event.Operation]++
+	for i := range filters {
+		f := &filters[i]
+		if !f.matches(event, object) {
+			continue
+		}
+		s := d.Sections[i]
+		s.Count++
+		if f.Sum != "" {
+			if val, ok := toNumber(object[f.Sum]); ok {
+				s.Sum += val
+			}
+		}
+		if len(s.Rows) < f.Limit {
+			row := make([]string, len(f.Fields))
+			for j, name := range f.Fields {
+				row[j] = toString(object[name])
+			}
+			s.Rows = append(s.Rows, row)
+		}
+	}
+	return nil
+}
+
+func plural(count int, word string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, word)
+	}
+	return fmt.Sprintf("%d %ss", count, word)
+}
+
+// render returns the subject and plain text body of the digest email.
+func (d *digest) render(filters []Filter, title string, end time.Time) (string, string) {
+	var total int
+	for _, count := range d.Counts {
+		total += count
+	}
+	subject := fmt.Sprintf("%s: %s", title, plural(total, "change"))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s for %s to %s\n", title, d.Start.Format(time.RFC1123), end.Format(time.RFC1123))
+	for i, f := range filters {
+		s := d.Sections[i]
+		fmt.Fprintf(&sb, "\n%s: %s", f.Name, plural(s.Count, "event"))
+		if f.Sum != "" {
+			fmt.Fprintf(&sb, ", %s total %s", f.Sum, toString(s.Sum))
+		}
+		sb.WriteString("\n")
+		if len(s.Rows) == 0 {
+			continue
+		}
+		w := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "  %s\n", strings.Join(f.Fields, "\t"))
+		for _, row := range s.Rows {
+			fmt.Fprintf(w, "  %s\n", strings.Join(row, "\t"))
+		}
+		w.Flush()
+		if s.Count > len(s.Rows) {
+			fmt.Fprintf(&sb, "  ... and %d more\n", s.Count-len(s.Rows))
+		}
+	}
+	keys := make([]string, 0, len(d.Counts))
+	for key := range d.Counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sb.WriteString("\nAll changes:\n")
+	w := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		table, operation, _ := strings.Cut(key, " ")
+		fmt.Fprintf(w, "  %s\t%s\t%d\n", table, operation, d.Counts[key])
+	}
+	w.Flush()
+	return subject, sb.String()
+}
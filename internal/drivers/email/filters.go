@@ -0,0 +1,197 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+const defaultLimit = 25
+
+// Condition compares a field of the event object to a value.
+type Condition struct {
+	// Field is the name of the field in the object such as totalCostCents.
+	Field string `json:"field"`
+
+	// Op is one of =, !=, >, >=, <, <= or contains. Defaults to =.
+	Op string `json:"op,omitempty"`
+
+	// Value is the value to compare to. Numbers are compared numerically and everything else as strings.
+	Value any `json:"value"`
+}
+
+// Filter selects the events to include in a section of the digest.
+type Filter struct {
+	// Name is the title of the section in the digest. Defaults to the tables and operations.
+	Name string `json:"name,omitempty"`
+
+	// Tables the filter applies to. Defaults to all tables.
+	Tables []string `json:"tables,omitempty"`
+
+	// Operations (INSERT, UPDATE, DELETE) the filter applies to. Defaults to all operations.
+	Operations []string `json:"operations,omitempty"`
+
+	// Conditions must all match for the event to be included.
+	Conditions []Condition `json:"conditions,omitempty"`
+
+	// Fields are listed for each matching event. Defaults to the id and the fields in the conditions.
+	Fields []string `json:"fields,omitempty"`
+
+	// Sum is a numeric field to total for the matching events.
+	Sum string `json:"sum,omitempty"`
+
+	// Limit is the maximum number of events listed in the section. Defaults to 25.
+	Limit int `json:"limit,omitempty"`
+}
+
+func matchesAny(values []string, val string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || strings.EqualFold(v, val) {
+			return true
+		}
+	}
+	return false
+}
+
+func toNumber(val any) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toString(val any) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		buf, _ := json.Marshal(v)
+		return string(buf)
+	}
+}
+
+func compare(a, b any) int {
+	if x, ok := a.(float64); ok {
+		if y, ok := toNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(toString(a), toString(b))
+}
+
+func (c *Condition) matches(object map[string]any) bool {
+	val, ok := object[c.Field]
+	if !ok || val == nil {
+		return c.Op == "!=" && c.Value != nil
+	}
+	switch c.Op {
+	case "", "=":
+		return compare(val, c.Value) == 0
+	case "!=":
+		return compare(val, c.Value) != 0
+	case ">":
+		return compare(val, c.Value) > 0
+	case ">=":
+		return compare(val, c.Value) >= 0
+	case "<":
+		return compare(val, c.Value) < 0
+	case "<=":
+		return compare(val, c.Value) <= 0
+	case "contains":
+		return strings.Contains(strings.ToLower(toString(val)), strings.ToLower(toString(c.Value)))
+	}
+	return false
+}
+
+func (f *Filter) matches(event *internal.DBChangeEvent, object map[string]any) bool {
+	if !matchesAny(f.Tables, event.Table) || !matchesAny(f.Operations, event.Operation) {
+		return false
+	}
+	for i := range f.Conditions {
+		if !f.Conditions[i].matches(object) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks the filter and fills in the defaults.
+func (f *Filter) validate() error {
+	if f.Name == "" {
+		tables := "all tables"
+		if len(f.Tables) > 0 {
+			tables = strings.Join(f.Tables, ", ")
+		}
+		f.Name = tables
+		if len(f.Operations) > 0 {
+			f.Name += " (" + strings.Join(f.Operations, ", ") + ")"
+		}
+	}
+	for _, c := range f.Conditions {
+		if c.Field == "" {
+			return fmt.Errorf("condition for filter %s is missing a field", f.Name)
+		}
+		switch c.Op {
+		case "", "=", "!=", ">", ">=", "<", "<=", "contains":
+		default:
+			return fmt.Errorf("invalid op for filter %s: %s", f.Name, c.Op)
+		}
+	}
+	if len(f.Fields) == 0 {
+		f.Fields = []string{"id"}
+		for _, c := range f.Conditions {
+			if !slices.Contains(f.Fields, c.Field) {
+				f.Fields = append(f.Fields, c.Field)
+			}
+		}
+		if f.Sum != "" && !slices.Contains(f.Fields, f.Sum) {
+			f.Fields = append(f.Fields, f.Sum)
+		}
+	}
+	if f.Limit <= 0 {
+		f.Limit = defaultLimit
+	}
+	return nil
+}
+
+// loadFilters reads the filters from a JSON file containing an array of filters.
+func loadFilters(fn string) ([]Filter, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading filters file: %w", err)
+	}
+	var filters []Filter
+	if err := json.Unmarshal(buf, &filters); err != nil {
+		return nil, fmt.Errorf("error parsing filters file %s: %w", fn, err)
+	}
+	for i := range filters {
+		if err := filters[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
@@ -25,12 +25,13 @@ type eventHubDriver struct {
 	once         sync.Once
 	importConfig internal.ImporterConfig
 	dryRun       bool
+	templates    util.PayloadTemplates
 }
 
 var _ internal.Driver = (*eventHubDriver)(nil)
 var _ internal.DriverLifecycle = (*eventHubDriver)(nil)
 var _ internal.DriverHelp = (*eventHubDriver)(nil)
-var _ importer.Handler = (*eventHubDriver)(nil)
+var _ importer.BatchHandler = (*eventHubDriver)(nil)
 var _ internal.Importer = (*eventHubDriver)(nil)
 var _ internal.ImporterHelp = (*eventHubDriver)(nil)
 
@@ -55,6 +56,11 @@ func newProducerClient(urlString string) (*azeventhubs.ProducerClient, error) {
 }
 
 func (p *eventHubDriver) connect(urlString string) error {
+	urlString, templates, err := util.ParsePayloadTemplates(urlString)
+	if err != nil {
+		return err
+	}
+	p.templates = templates
 	producerClient, err := newProducerClient(urlString)
 	if err != nil {
 		return fmt.Errorf("error connecting to eventhub: %w", err)
@@ -130,11 +136,21 @@ func (p *eventHubDriver) getKeys(record *util.Record, companyId string, location
 }
 
 func (p *eventHubDriver) addEventToBatch(batch *azeventhubs.EventDataBatch, record *util.Record, key string) error {
+	body, err := p.templates.Render(record.Event)
+	if err != nil {
+		return err
+	}
+	properties := map[string]any{"objectId": key}
+	if record.Event.Lineage != nil {
+		for k, v := range record.Event.Lineage.Headers() {
+			properties[k] = v
+		}
+	}
 	if err := batch.AddEventData(&azeventhubs.EventData{
-		Body:        []byte(util.JSONStringify(record.Event)),
+		Body:        body,
 		MessageID:   &record.Event.ID,
 		ContentType: &contentType,
-		Properties:  map[string]any{"objectId": key},
+		Properties:  properties,
 	}, nil); err != nil {
 		return fmt.Errorf("error adding event to batch: %w", err)
 	}
@@ -218,6 +234,8 @@ func (p *eventHubDriver) Help() string {
 	help.WriteString(util.GenerateHelpSection("Partitioning", "The partition key is calculated automatically based on the number of partitions for the topic and the incoming message.\nThe partition key is in the format: [TABLE].[COMPANY_ID].[LOCATION_ID].[PRIMARY_KEY].\n"))
 	help.WriteString("\n")
 	help.WriteString(util.GenerateHelpSection("Message Value", "The message value is a JSON encoded value of the EDS DBChange event."))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Payload Templates", util.PayloadTemplatesHelp))
 	return help.String()
 }
 
@@ -233,13 +251,19 @@ func (p *eventHubDriver) ImportEvent(event internal.DBChangeEvent, schema *inter
 		return fmt.Errorf("error getting json object: %w", err)
 	}
 	p.batcher.Add(event.Table, event.GetPrimaryKey(), event.Operation, event.Diff, object, &event)
-
-	if p.batcher.Len() >= maxImportBatchSize {
-		return p.Flush(p.logger)
-	}
 	return nil
 }
 
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *eventHubDriver) ImportBatchLimits() (int, int) {
+	return maxImportBatchSize, 0
+}
+
+// FlushBatch sends the pending events.
+func (p *eventHubDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
 // ImportCompleted is called when all events have been processed.
 func (p *eventHubDriver) ImportCompleted() error {
 	if p.batcher != nil {
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +21,11 @@ type fileDriver struct {
 	logger       logger.Logger
 	dir          string
 	importConfig internal.ImporterConfig
+	manifest     *util.ManifestBuilder
+	exactlyOnce  bool
+	format       string
+	roller       *roller
+	delta        *util.DeltaEncoder
 }
 
 var _ internal.Driver = (*fileDriver)(nil)
@@ -27,7 +33,7 @@ var _ internal.DriverLifecycle = (*fileDriver)(nil)
 var _ internal.DriverHelp = (*fileDriver)(nil)
 var _ internal.Importer = (*fileDriver)(nil)
 var _ internal.ImporterHelp = (*fileDriver)(nil)
-var _ importer.Handler = (*fileDriver)(nil)
+var _ importer.BatchHandler = (*fileDriver)(nil)
 
 func (p *fileDriver) GetPathFromURL(urlString string) (string, error) {
 	u, err := url.Parse(urlString)
@@ -35,6 +41,43 @@ func (p *fileDriver) GetPathFromURL(urlString string) (string, error) {
 		return "", fmt.Errorf("unable to parse url: %w", err)
 	}
 
+	query := u.Query()
+	p.manifest = nil
+	if query.Get("manifest") == "true" {
+		p.manifest = &util.ManifestBuilder{}
+	}
+	p.exactlyOnce = query.Get("exactlyOnce") == "true"
+	p.format = query.Get("format")
+	switch p.format {
+	case "":
+		p.format = formatJSON
+	case formatJSON, formatNDJSON, formatCSV:
+	default:
+		return "", fmt.Errorf("invalid format: %s. must be either json, ndjson or csv", p.format)
+	}
+	maxSizeMB := defaultMaxFileSizeMB
+	if val := query.Get("maxSizeMB"); val != "" {
+		if maxSizeMB, err = strconv.Atoi(val); err != nil || maxSizeMB < 0 {
+			return "", fmt.Errorf("invalid maxSizeMB: %s", val)
+		}
+	}
+	interval := defaultRotateInterval
+	if val := query.Get("rotate"); val != "" {
+		if interval, err = time.ParseDuration(val); err != nil || interval < 0 {
+			return "", fmt.Errorf("invalid rotate: %s", val)
+		}
+	}
+	if p.format != formatJSON && (p.manifest != nil || p.exactlyOnce) {
+		return "", fmt.Errorf("manifest and exactlyOnce are only supported with the json format")
+	}
+	if query.Get("delta") == "true" && p.format == formatCSV {
+		return "", fmt.Errorf("delta is only supported with the json and ndjson formats")
+	}
+	p.closeDelta()
+	if p.delta, err = util.ParseDeltaEncoder(context.Background(), query); err != nil {
+		return "", err
+	}
+
 	if u.Path == "" {
 		return "", fmt.Errorf("path is required in url which should be the directory to store files")
 	} else {
@@ -52,6 +95,9 @@ func (p *fileDriver) GetPathFromURL(urlString string) (string, error) {
 			}
 		}
 	}
+	if p.format != formatJSON {
+		p.roller = newRoller(p.dir, p.format, int64(maxSizeMB)*1024*1024, interval)
+	}
 	return p.dir, nil
 }
 
@@ -62,11 +108,33 @@ func (p *fileDriver) Start(pc internal.DriverConfig) error {
 	if _, err := p.GetPathFromURL(pc.URL); err != nil {
 		return err
 	}
+	if p.roller != nil {
+		return p.roller.recover(p.logger)
+	}
 	return nil
 }
 
+func (p *fileDriver) closeDelta() {
+	if p.delta != nil {
+		p.delta.Close()
+		p.delta = nil
+	}
+}
+
+// payload returns the event or a delta of the event when delta mode is enabled.
+func (p *fileDriver) payload(event internal.DBChangeEvent) (any, error) {
+	if p.delta == nil {
+		return event, nil
+	}
+	return p.delta.Payload(event)
+}
+
 // Stop the driver. This is called once at the end of the driver's lifecycle.
 func (p *fileDriver) Stop() error {
+	p.closeDelta()
+	if p.roller != nil {
+		return p.roller.close(p.logger)
+	}
 	return nil
 }
 
@@ -80,20 +148,53 @@ func (p *fileDriver) getFileName(table string, ts time.Time, id string) string {
 	return fmt.Sprintf("%s/%d-%s.json", table, ts.Unix(), id)
 }
 
+// getKey returns the file name for the event and true if the name is derived from the stream sequence.
+func (p *fileDriver) getKey(event internal.DBChangeEvent) (string, bool) {
+	if p.exactlyOnce {
+		if seq := event.GetStreamSequence(); seq > 0 {
+			return util.SequenceKey("", event.Table, seq, seq, ".json"), true
+		}
+	}
+	if p.delta != nil {
+		// include the event id since a delta must not replace another change to the record in the same second
+		return fmt.Sprintf("%s/%d-%s-%s.json", event.Table, time.UnixMilli(event.Timestamp).Unix(), event.GetPrimaryKey(), event.ID), false
+	}
+	return p.getFileName(event.Table, time.UnixMilli(event.Timestamp), event.GetPrimaryKey()), false
+}
+
 func (p *fileDriver) writeEvent(logger logger.Logger, event internal.DBChangeEvent, dryRun bool) error {
-	key := p.getFileName(event.Table, time.UnixMilli(event.Timestamp), event.GetPrimaryKey())
-	buf := []byte(util.JSONStringify(event))
+	key, deterministic := p.getKey(event)
+	payload, err := p.payload(event)
+	if err != nil {
+		return err
+	}
+	buf := []byte(util.JSONStringify(payload))
 	fp := filepath.Join(p.dir, key)
 	if !dryRun {
+		if deterministic && util.Exists(fp) {
+			// the event was redelivered after it was already written
+			internal.DuplicateObjectsSkipped.WithLabelValues(event.Table).Inc()
+			internal.SkippedEvents.WithLabelValues(event.Table, internal.SkipReasonDuplicate).Inc()
+			logger.Trace("skipping %s, already stored", fp)
+			return nil
+		}
 		dir := filepath.Dir(fp)
 		if !util.Exists(dir) {
 			if err := os.MkdirAll(dir, 0755); err != nil {
 				return fmt.Errorf("unable to create directory: %w", err)
 			}
 		}
-		if err := os.WriteFile(fp, buf, 0644); err != nil {
+		// write to a temp file and rename so a partially written file is never mistaken for a completed one
+		tmp := fp + ".tmp"
+		if err := os.WriteFile(tmp, buf, 0644); err != nil {
 			return fmt.Errorf("unable to write file: %w", err)
 		}
+		if err := os.Rename(tmp, fp); err != nil {
+			return fmt.Errorf("unable to rename file: %w", err)
+		}
+		if p.manifest != nil {
+			p.manifest.Add(key, event.Table, event.Timestamp, buf)
+		}
 		logger.Trace("stored %s", fp)
 	} else {
 		logger.Trace("would have stored %s", fp)
@@ -103,15 +204,50 @@ func (p *fileDriver) writeEvent(logger logger.Logger, event internal.DBChangeEve
 
 // Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
 func (p *fileDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	if p.roller != nil {
+		var schema *internal.Schema
+		if p.format == formatCSV {
+			var err error
+			schema, err = p.config.SchemaRegistry.GetSchema(event.Table, event.ModelVersion)
+			if err != nil {
+				return false, fmt.Errorf("unable to get schema for table: %s (%s). %w", event.Table, event.ModelVersion, err)
+			}
+		}
+		payload, err := p.payload(event)
+		if err != nil {
+			return false, err
+		}
+		return false, p.roller.add(logger, event, payload, schema)
+	}
 	if err := p.writeEvent(logger, event, false); err != nil {
 		return false, err
 	}
 	return false, nil
 }
 
+// writeManifest writes the manifest for the files stored since the last manifest.
+func (p *fileDriver) writeManifest(logger logger.Logger) error {
+	if p.manifest == nil || p.manifest.Len() == 0 {
+		return nil
+	}
+	now := time.Now()
+	fp := filepath.Join(p.dir, util.ManifestKey("", now))
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return fmt.Errorf("unable to create directory: %w", err)
+	}
+	if err := os.WriteFile(fp, []byte(util.JSONStringify(p.manifest.Build(now))), 0644); err != nil {
+		return fmt.Errorf("unable to write manifest: %w", err)
+	}
+	logger.Trace("stored manifest %s", fp)
+	return nil
+}
+
 // Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
 func (p *fileDriver) Flush(logger logger.Logger) error {
-	return nil
+	if p.roller != nil {
+		return p.roller.flush(logger)
+	}
+	return p.writeManifest(logger)
 }
 
 // Name is a unique name for the driver.
@@ -133,6 +269,12 @@ func (p *fileDriver) ExampleURL() string {
 func (p *fileDriver) Help() string {
 	var help strings.Builder
 	help.WriteString("Provide a directory in the URL path to store events into this folder.\n")
+	help.WriteString("Add exactlyOnce=true to the URL to name files by the table and stream sequence so redelivered events are skipped instead of written again.\n")
+	help.WriteString("Add manifest=true to the URL to write a manifest with the files, record counts, timestamps and sha256 checksums for each batch into the _manifests folder.\n")
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Delta Events", util.DeltaHelp+"With the json format the file name includes the event id (table/timestamp-id-eventid.json) so every change is kept.\nDelta events aren't supported with the csv format.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Format", "Each event is written to its own JSON file by default. Add format=ndjson or format=csv to append events to a rolling file\nper table instead. CSV files have a header which contains the _operation and _timestamp of each event followed by the\ncolumns of the table (the before values are used for deletes). A file is rotated when it reaches maxSizeMB (default 100)\nor is older than rotate (default 1h), files which are still being written end with .partial.\n"))
 	return help.String()
 }
 
@@ -143,12 +285,34 @@ func (p *fileDriver) CreateDatasource(schema internal.SchemaMap) error {
 
 // ImportEvent allows the handler to process the event.
 func (p *fileDriver) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	if p.roller != nil {
+		if p.importConfig.DryRun {
+			return nil
+		}
+		return p.roller.add(p.logger, event, event, schema)
+	}
 	return p.writeEvent(p.logger, event, p.importConfig.DryRun)
 }
 
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *fileDriver) ImportBatchLimits() (int, int) {
+	return 0, 0
+}
+
+// FlushBatch writes the manifest for the files stored in the batch.
+func (p *fileDriver) FlushBatch() error {
+	if p.roller != nil {
+		return p.roller.flush(p.logger)
+	}
+	return p.writeManifest(p.logger)
+}
+
 // ImportCompleted is called when all events have been processed.
 func (p *fileDriver) ImportCompleted() error {
-	return nil
+	if p.roller != nil {
+		return p.roller.close(p.logger)
+	}
+	return p.writeManifest(p.logger)
 }
 
 func (p *fileDriver) Import(config internal.ImporterConfig) error {
@@ -159,6 +323,7 @@ func (p *fileDriver) Import(config internal.ImporterConfig) error {
 	if _, err := p.GetPathFromURL(config.URL); err != nil {
 		return err
 	}
+	defer p.closeDelta()
 	p.importConfig = config
 	return importer.Run(p.logger, config, p)
 }
@@ -171,6 +336,7 @@ func (p *fileDriver) SupportsDelete() bool {
 // Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
 func (p *fileDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
 	_, err := p.GetPathFromURL(url)
+	p.closeDelta()
 	return err
 }
 
@@ -178,6 +344,11 @@ func (p *fileDriver) Test(ctx context.Context, logger logger.Logger, url string)
 func (p *fileDriver) Configuration() []internal.DriverField {
 	return []internal.DriverField{
 		internal.RequiredStringField("Directory", "The directory on the server to store files", nil),
+		internal.OptionalBooleanField("Manifest", "Write a manifest with checksums for each batch of files", false),
+		internal.OptionalBooleanField("Exactly Once", "Name files by the stream sequence and skip events which were already stored", false),
+		internal.OptionalStringField("Format", "The file format which is either json (a file per event), ndjson or csv (rolling files per table)", internal.StringPointer(formatJSON)),
+		internal.OptionalNumberField("Max File Size", "The size in megabytes at which a rolling file is rotated", internal.IntPointer(defaultMaxFileSizeMB)),
+		internal.OptionalBooleanField("Delta Events", "Write only the changed fields of updates with a full event periodically (json and ndjson only)", false),
 	}
 }
 
@@ -209,6 +380,33 @@ func (p *fileDriver) Validate(values map[string]any) (string, []internal.FieldEr
 			return "", []internal.FieldError{internal.NewFieldError("Directory", fmt.Sprintf("%s directory isn't writable", absdir))}
 		}
 	}
+	format := internal.GetOptionalStringValue("Format", formatJSON, values)
+	if format != formatJSON && format != formatNDJSON && format != formatCSV {
+		return "", []internal.FieldError{internal.NewFieldError("Format", "must be either json, ndjson or csv")}
+	}
+	q := url.Values{}
+	if format != formatJSON {
+		if internal.GetOptionalBoolValue("Manifest", false, values) || internal.GetOptionalBoolValue("Exactly Once", false, values) {
+			return "", []internal.FieldError{internal.NewFieldError("Format", "manifest and exactly once are only supported with the json format")}
+		}
+		q.Set("format", format)
+		q.Set("maxSizeMB", strconv.Itoa(internal.GetOptionalIntValue("Max File Size", defaultMaxFileSizeMB, values)))
+	}
+	if internal.GetOptionalBoolValue("Manifest", false, values) {
+		q.Set("manifest", "true")
+	}
+	if internal.GetOptionalBoolValue("Exactly Once", false, values) {
+		q.Set("exactlyOnce", "true")
+	}
+	if internal.GetOptionalBoolValue("Delta Events", false, values) {
+		if format == formatCSV {
+			return "", []internal.FieldError{internal.NewFieldError("Format", "delta events are only supported with the json and ndjson formats")}
+		}
+		q.Set("delta", "true")
+	}
+	if len(q) > 0 {
+		return "file://" + filepath.ToSlash(absdir) + "?" + q.Encode(), nil
+	}
 	return "file://" + filepath.ToSlash(absdir), nil
 }
 
@@ -1,9 +1,16 @@
 package file
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,3 +27,172 @@ func TestValidate(t *testing.T) {
 	assert.Empty(t, errs)
 	assert.Equal(t, "file://"+tmpdir, url)
 }
+
+func TestManifest(t *testing.T) {
+	var driver fileDriver
+	dir := t.TempDir()
+	assert.NoError(t, driver.Start(internal.DriverConfig{URL: "file://" + dir + "?manifest=true", Logger: logger.NewTestLogger()}))
+	for _, id := range []string{"1", "2"} {
+		_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: id, Table: "order", Key: []string{id}, Timestamp: 1000, Operation: "INSERT"})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+
+	manifests, err := util.ListDir(filepath.Join(dir, "_manifests"))
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 1)
+	buf, err := os.ReadFile(manifests[0])
+	assert.NoError(t, err)
+	var manifest util.Manifest
+	assert.NoError(t, json.Unmarshal(buf, &manifest))
+	assert.Equal(t, 2, manifest.Records)
+	assert.Equal(t, "order/1-1.json", manifest.Files[0].Key)
+	assert.FileExists(t, filepath.Join(dir, manifest.Files[0].Key))
+
+	// nothing new so no manifest is written
+	assert.NoError(t, driver.Flush(driver.logger))
+	manifests, err = util.ListDir(filepath.Join(dir, "_manifests"))
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 1)
+}
+
+type testMsg struct {
+	jetstream.Msg
+	sequence uint64
+}
+
+func (m *testMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return &jetstream.MsgMetadata{Sequence: jetstream.SequencePair{Stream: m.sequence}}, nil
+}
+
+func TestExactlyOnce(t *testing.T) {
+	var driver fileDriver
+	dir := t.TempDir()
+	assert.NoError(t, driver.Start(internal.DriverConfig{URL: "file://" + dir + "?exactlyOnce=true", Logger: logger.NewTestLogger()}))
+	event := internal.DBChangeEvent{ID: "1", Table: "order", Key: []string{"1"}, Timestamp: 1000, Operation: "INSERT", NatsMsg: &testMsg{sequence: 42}}
+	_, err := driver.Process(driver.logger, event)
+	assert.NoError(t, err)
+	fp := filepath.Join(dir, "order", "00000000000000000042.json")
+	assert.FileExists(t, fp)
+
+	// a redelivery with the same sequence must not overwrite the stored file
+	assert.NoError(t, os.WriteFile(fp, []byte("original"), 0644))
+	_, err = driver.Process(driver.logger, event)
+	assert.NoError(t, err)
+	buf, err := os.ReadFile(fp)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(buf))
+
+	// events without a stream sequence fall back to the default name
+	event.NatsMsg = nil
+	_, err = driver.Process(driver.logger, event)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "order", "1-1.json"))
+}
+
+type testRegistry struct {
+	internal.SchemaRegistry
+	schema *internal.Schema
+}
+
+func (r *testRegistry) GetSchema(table string, version string) (*internal.Schema, error) {
+	return r.schema, nil
+}
+
+func TestRollingCSV(t *testing.T) {
+	var driver fileDriver
+	dir := t.TempDir()
+	schema := &internal.Schema{Table: "order", ModelVersion: "1", Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "total": {Type: "number"}}}
+	assert.NoError(t, driver.Start(internal.DriverConfig{URL: "file://" + dir + "?format=csv", Logger: logger.NewTestLogger(), SchemaRegistry: &testRegistry{schema: schema}}))
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Key: []string{"1"}, Timestamp: 1000, Operation: "INSERT", ModelVersion: "1", After: json.RawMessage(`{"id":"1","total":10.5}`)})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "2", Table: "order", Key: []string{"1"}, Timestamp: 2000, Operation: "DELETE", ModelVersion: "1", Before: json.RawMessage(`{"id":"1","total":10.5}`)})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+
+	// the file is still being written until it's rotated
+	files, err := util.ListDir(filepath.Join(dir, "order"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ".csv"+partialSuffix))
+
+	assert.NoError(t, driver.Stop())
+	files, err = util.ListDir(filepath.Join(dir, "order"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ".csv"))
+	buf, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "_operation,_timestamp,id,total\nINSERT,1000,1,10.5\nDELETE,2000,1,10.5\n", string(buf))
+}
+
+func TestRollingNDJSONRotate(t *testing.T) {
+	var driver fileDriver
+	dir := t.TempDir()
+	// a max size of 0 disables the size limit and rotate=1ns rotates on every flush
+	assert.NoError(t, driver.Start(internal.DriverConfig{URL: "file://" + dir + "?format=ndjson&maxSizeMB=0&rotate=1ns", Logger: logger.NewTestLogger()}))
+	for _, id := range []string{"1", "2"} {
+		_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: id, Table: "order", Key: []string{id}, Timestamp: 1000, Operation: "INSERT"})
+		assert.NoError(t, err)
+		assert.NoError(t, driver.Flush(driver.logger))
+	}
+	files, err := util.ListDir(filepath.Join(dir, "order"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	for _, file := range files {
+		assert.True(t, strings.HasSuffix(file, ".ndjson"))
+		buf, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(string(buf), "\n"))
+	}
+}
+
+func TestRollingRecover(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "order", "1.ndjson"+partialSuffix)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(partial), 0755))
+	assert.NoError(t, os.WriteFile(partial, []byte("{}\n"), 0644))
+	var driver fileDriver
+	assert.NoError(t, driver.Start(internal.DriverConfig{URL: "file://" + dir + "?format=ndjson", Logger: logger.NewTestLogger()}))
+	assert.NoFileExists(t, partial)
+	assert.FileExists(t, filepath.Join(dir, "order", "1.ndjson"))
+}
+
+func TestRollingInvalidOptions(t *testing.T) {
+	var driver fileDriver
+	dir := t.TempDir()
+	_, err := driver.GetPathFromURL("file://" + dir + "?format=xml")
+	assert.ErrorContains(t, err, "invalid format: xml")
+	_, err = driver.GetPathFromURL("file://" + dir + "?format=csv&manifest=true")
+	assert.ErrorContains(t, err, "only supported with the json format")
+	_, err = driver.GetPathFromURL("file://" + dir + "?format=csv&maxSizeMB=abc")
+	assert.ErrorContains(t, err, "invalid maxSizeMB")
+	_, err = driver.GetPathFromURL("file://" + dir + "?format=csv&delta=true")
+	assert.ErrorContains(t, err, "only supported with the json and ndjson formats")
+}
+
+func TestDeltaNDJSON(t *testing.T) {
+	var driver fileDriver
+	dir := t.TempDir()
+	assert.NoError(t, driver.Start(internal.DriverConfig{URL: "file://" + dir + "?format=ndjson&delta=true", Logger: logger.NewTestLogger()}))
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Key: []string{"1"}, Timestamp: 1000, Operation: "INSERT", After: json.RawMessage(`{"id":"1","status":"open","notes":"a long note"}`)})
+	assert.NoError(t, err)
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "2", Table: "order", Key: []string{"1"}, Timestamp: 2000, Operation: "UPDATE", Diff: []string{"status"}, After: json.RawMessage(`{"id":"1","status":"closed","notes":"a long note"}`)})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Stop())
+
+	files, err := util.ListDir(filepath.Join(dir, "order"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	buf, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"notes":"a long note"`)
+	var delta util.DeltaEvent
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &delta))
+	assert.True(t, delta.Delta)
+	assert.Equal(t, []string{"status"}, delta.Diff)
+	assert.JSONEq(t, `{"status":"closed"}`, util.JSONStringify(delta.Changes))
+}
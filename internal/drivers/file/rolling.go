@@ -0,0 +1,236 @@
+package file
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	formatJSON   = "json"   // one JSON file per event
+	formatNDJSON = "ndjson" // events appended to a rolling NDJSON file per table
+	formatCSV    = "csv"    // rows appended to a rolling CSV file per table
+
+	defaultMaxFileSizeMB  = 100
+	defaultRotateInterval = time.Hour
+	partialSuffix         = ".partial" // the suffix of a rolling file which is still being written
+)
+
+// csvMetaColumns are written before the table columns so the receiver knows how to apply each row.
+var csvMetaColumns = []string{"_operation", "_timestamp"}
+
+// rollingFile is the file events for a table are currently appended to.
+type rollingFile struct {
+	path         string // the path of the file once it's rotated
+	modelVersion string
+	columns      []string
+	created      time.Time
+	size         int64
+	count        int
+	pending      bytes.Buffer
+	writer       *csv.Writer
+}
+
+// roller appends events to a file per table which is rotated when it reaches the max size or is older than the rotate
+// interval. Events are buffered until flush so a batch is written with a single append.
+type roller struct {
+	dir      string
+	format   string
+	maxSize  int64
+	interval time.Duration
+	files    map[string]*rollingFile
+}
+
+func newRoller(dir string, format string, maxSize int64, interval time.Duration) *roller {
+	return &roller{
+		dir:      dir,
+		format:   format,
+		maxSize:  maxSize,
+		interval: interval,
+		files:    make(map[string]*rollingFile),
+	}
+}
+
+func csvValue(val any) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return util.JSONStringify(v)
+	}
+}
+
+func (r *roller) open(table string, schema *internal.Schema) *rollingFile {
+	now := time.Now()
+	f := &rollingFile{
+		path:    filepath.Join(r.dir, table, fmt.Sprintf("%d.%s", now.UnixNano(), r.format)),
+		created: now,
+	}
+	if r.format == formatCSV {
+		f.modelVersion = schema.ModelVersion
+		f.columns = schema.Columns()
+		f.writer = csv.NewWriter(&f.pending)
+		f.writer.Write(append(append([]string{}, csvMetaColumns...), f.columns...))
+	}
+	r.files[table] = f
+	return f
+}
+
+// add buffers the event in the file for its table. The payload is written for NDJSON which is the event or a delta of
+// the event. A CSV file is rotated when the model version changes since the header can change.
+func (r *roller) add(logger logger.Logger, event internal.DBChangeEvent, payload any, schema *internal.Schema) error {
+	f := r.files[event.Table]
+	if f != nil && r.format == formatCSV && f.modelVersion != schema.ModelVersion {
+		if err := r.rotate(logger, event.Table); err != nil {
+			return err
+		}
+		f = nil
+	}
+	if f == nil {
+		f = r.open(event.Table, schema)
+	}
+	f.count++
+	if r.format == formatNDJSON {
+		f.pending.WriteString(util.JSONStringify(payload))
+		f.pending.WriteByte('\n')
+		return nil
+	}
+	data := event.After
+	if event.Operation == "DELETE" {
+		data = event.Before
+	}
+	object := make(map[string]any)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &object); err != nil {
+			return fmt.Errorf("error decoding event %s: %w", event.ID, err)
+		}
+	}
+	if _, ok := object["id"]; !ok {
+		object["id"] = event.GetPrimaryKey()
+	}
+	row := []string{event.Operation, strconv.FormatInt(event.Timestamp, 10)}
+	for _, name := range f.columns {
+		row = append(row, csvValue(object[name]))
+	}
+	return f.writer.Write(row)
+}
+
+// write appends the buffered events to the partial file and syncs it to disk.
+func (r *roller) write(f *rollingFile) error {
+	if f.writer != nil {
+		f.writer.Flush()
+		if err := f.writer.Error(); err != nil {
+			return fmt.Errorf("error writing csv: %w", err)
+		}
+	}
+	if f.pending.Len() == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return fmt.Errorf("unable to create directory: %w", err)
+	}
+	out, err := os.OpenFile(f.path+partialSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open file: %w", err)
+	}
+	n, err := out.Write(f.pending.Bytes())
+	f.size += int64(n)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write file: %w", err)
+	}
+	f.pending.Reset()
+	return nil
+}
+
+// rotate writes the buffered events of the table and renames the partial file so it can be consumed.
+func (r *roller) rotate(logger logger.Logger, table string) error {
+	f := r.files[table]
+	if f == nil {
+		return nil
+	}
+	if err := r.write(f); err != nil {
+		return err
+	}
+	delete(r.files, table)
+	if f.size == 0 {
+		return nil
+	}
+	if err := os.Rename(f.path+partialSuffix, f.path); err != nil {
+		return fmt.Errorf("unable to rename file: %w", err)
+	}
+	logger.Debug("rotated %s with %d events (%d bytes)", f.path, f.count, f.size)
+	return nil
+}
+
+// flush writes the buffered events of every table and rotates the files which reached the max size or rotate interval.
+func (r *roller) flush(logger logger.Logger) error {
+	tables := make([]string, 0, len(r.files))
+	for table := range r.files {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		f := r.files[table]
+		if err := r.write(f); err != nil {
+			return err
+		}
+		if (r.maxSize > 0 && f.size >= r.maxSize) || (r.interval > 0 && time.Since(f.created) >= r.interval) {
+			if err := r.rotate(logger, table); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close writes the buffered events and rotates all the files.
+func (r *roller) close(logger logger.Logger) error {
+	for table := range r.files {
+		if err := r.rotate(logger, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recover renames the partial files left behind when the process exited before they were rotated. Their events were
+// written before the flush which acknowledged them so they are complete.
+func (r *roller) recover(logger logger.Logger) error {
+	return filepath.WalkDir(r.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, partialSuffix) {
+			return nil
+		}
+		if err := os.Rename(path, strings.TrimSuffix(path, partialSuffix)); err != nil {
+			return fmt.Errorf("unable to rename file: %w", err)
+		}
+		logger.Debug("rotated %s left from a previous run", strings.TrimSuffix(path, partialSuffix))
+		return nil
+	})
+}
@@ -0,0 +1,383 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/importer"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	maxImportBatchSize = 500
+	defaultTimeout     = time.Second * 30
+	defaultMaxAttempts = 5
+	deliveredExpiry    = time.Minute * 15 // how long to remember events which were sent in a flush that failed
+)
+
+type pendingEvent struct {
+	mutation *Mutation
+	event    *Event
+}
+
+type request struct {
+	Query     string          `json:"query"`
+	Variables json.RawMessage `json:"variables"`
+}
+
+type response struct {
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+type graphqlDriver struct {
+	ctx          context.Context
+	logger       logger.Logger
+	endpoint     string
+	headers      map[string]string
+	timeout      time.Duration
+	maxAttempts  int
+	mutations    []*Mutation
+	client       *http.Client
+	pending      []pendingEvent
+	delivered    map[string]time.Time
+	lock         sync.Mutex
+	waitGroup    sync.WaitGroup
+	importConfig internal.ImporterConfig
+}
+
+var _ internal.Driver = (*graphqlDriver)(nil)
+var _ internal.DriverLifecycle = (*graphqlDriver)(nil)
+var _ internal.DriverHelp = (*graphqlDriver)(nil)
+var _ internal.Importer = (*graphqlDriver)(nil)
+var _ internal.ImporterHelp = (*graphqlDriver)(nil)
+var _ importer.BatchHandler = (*graphqlDriver)(nil)
+
+// parseURL parses the url in the format graphql://host/path?mutations=/path/to/mutations.json where tls=false will use http.
+func (p *graphqlDriver) parseURL(urlString string) error {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return fmt.Errorf("unable to parse url: %w", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host is required in url")
+	}
+	query := u.Query()
+	fn := query.Get("mutations")
+	if fn == "" {
+		return fmt.Errorf("mutations is required in url which should be the path to the mutations file")
+	}
+	if p.mutations, err = loadMutations(fn); err != nil {
+		return err
+	}
+	p.headers = make(map[string]string)
+	for _, header := range query["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return fmt.Errorf("invalid header: %s (expected name:value)", header)
+		}
+		p.headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	p.timeout = defaultTimeout
+	if val := query.Get("timeout"); val != "" {
+		if p.timeout, err = time.ParseDuration(val); err != nil || p.timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %s", val)
+		}
+	}
+	p.maxAttempts = defaultMaxAttempts
+	if val := query.Get("maxAttempts"); val != "" {
+		if p.maxAttempts, err = strconv.Atoi(val); err != nil || p.maxAttempts <= 0 {
+			return fmt.Errorf("invalid maxAttempts: %s", val)
+		}
+	}
+	scheme := "https"
+	if query.Get("tls") == "false" {
+		scheme = "http"
+	}
+	for _, key := range []string{"mutations", "header", "timeout", "maxAttempts", "tls"} {
+		query.Del(key)
+	}
+	target := url.URL{Scheme: scheme, Host: u.Host, Path: u.Path, RawQuery: query.Encode()}
+	p.endpoint = target.String()
+	return nil
+}
+
+func (p *graphqlDriver) connect(urlString string) error {
+	if err := p.parseURL(urlString); err != nil {
+		return err
+	}
+	p.client = &http.Client{}
+	p.delivered = make(map[string]time.Time)
+	return nil
+}
+
+// Start the driver. This is called once at the beginning of the driver's lifecycle.
+func (p *graphqlDriver) Start(pc internal.DriverConfig) error {
+	p.ctx = pc.Context
+	p.logger = pc.Logger.WithPrefix("[graphql]")
+	if err := p.connect(pc.URL); err != nil {
+		return err
+	}
+	p.logger.Debug("using endpoint %s with %d mutations", p.endpoint, len(p.mutations))
+	return nil
+}
+
+// Stop the driver. This is called once at the end of the driver's lifecycle.
+func (p *graphqlDriver) Stop() error {
+	p.logger.Debug("stopping")
+	p.waitGroup.Wait()
+	p.logger.Debug("stopped")
+	return nil
+}
+
+// MaxBatchSize returns the maximum number of events that can be processed in a single call to Process and when Flush should be called.
+// Return -1 to indicate that there is no limit.
+func (p *graphqlDriver) MaxBatchSize() int {
+	return -1
+}
+
+func (p *graphqlDriver) route(event *internal.DBChangeEvent) *Mutation {
+	for _, m := range p.mutations {
+		if m.matches(event) {
+			return m
+		}
+	}
+	return nil
+}
+
+// Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
+func (p *graphqlDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	m := p.route(&event)
+	if m == nil {
+		logger.Trace("no mutation for table: %s, operation: %s, skipping event: %s", event.Table, event.Operation, event.ID)
+		return false, nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.delivered[event.ID]; ok {
+		delete(p.delivered, event.ID)
+		logger.Trace("event %s already sent, skipping", event.ID)
+		return false, nil
+	}
+	e, err := newEvent(&event)
+	if err != nil {
+		return false, err
+	}
+	p.pending = append(p.pending, pendingEvent{m, e})
+	return false, nil
+}
+
+// send will POST the mutation for the events, retrying up to the max attempts.
+func (p *graphqlDriver) send(logger logger.Logger, m *Mutation, events []*Event) error {
+	variables, err := m.render(events)
+	if err != nil {
+		return err
+	}
+	body := []byte(util.JSONStringify(request{Query: m.Query, Variables: variables}))
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request for %s: %w", m.Name, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	retry := util.NewHTTPRetry(req,
+		util.WithLogger(logger),
+		util.WithClient(p.client),
+		util.WithMaxAttempts(p.maxAttempts),
+		util.WithAttemptTimeout(p.timeout),
+		util.WithTimeout(p.timeout*time.Duration(p.maxAttempts)),
+		util.WithRetryStatus(util.RetryServerErrors),
+	)
+	resp, err := retry.Do()
+	if err != nil {
+		return fmt.Errorf("error sending %s: %w", m.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d for %s", resp.StatusCode, m.Name)
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response for %s: %w", m.Name, err)
+	}
+	var res response
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return fmt.Errorf("error decoding response for %s: %w", m.Name, err)
+	}
+	if len(res.Errors) > 0 {
+		var msgs []string
+		for _, e := range res.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("mutation %s failed: %s", m.Name, strings.Join(msgs, "; "))
+	}
+	logger.Trace("sent %d events with %s in %d attempt(s)", len(events), m.Name, retry.Attempts())
+	return nil
+}
+
+// Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
+func (p *graphqlDriver) Flush(logger logger.Logger) error {
+	logger.Debug("flush")
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for id, ts := range p.delivered {
+		if now.Sub(ts) > deliveredExpiry {
+			delete(p.delivered, id)
+		}
+	}
+	pending := p.pending
+	p.pending = nil
+	var sent []*Event
+	// send in order, combining consecutive events for the same mutation up to the batch size
+	for i := 0; i < len(pending); {
+		m := pending[i].mutation
+		events := []*Event{pending[i].event}
+		j := i + 1
+		for j < len(pending) && pending[j].mutation == m && len(events) < m.BatchSize {
+			events = append(events, pending[j].event)
+			j++
+		}
+		if err := p.send(logger, m, events); err != nil {
+			// the batch will be redelivered so remember what was already sent to avoid sending it twice
+			for _, e := range sent {
+				p.delivered[e.ID] = now
+			}
+			return err
+		}
+		sent = append(sent, events...)
+		i = j
+	}
+	return nil
+}
+
+// Name is a unique name for the driver.
+func (p *graphqlDriver) Name() string {
+	return "GraphQL"
+}
+
+// Description is the description of the driver.
+func (p *graphqlDriver) Description() string {
+	return "Supports streaming EDS messages to a GraphQL API using mutations templated by table and operation."
+}
+
+// ExampleURL should return an example URL for configuring the driver.
+func (p *graphqlDriver) ExampleURL() string {
+	return "graphql://api.example.com/graphql?mutations=/etc/eds/mutations.json"
+}
+
+// Help should return a detailed help documentation for the driver.
+func (p *graphqlDriver) Help() string {
+	var help strings.Builder
+	help.WriteString(util.GenerateHelpSection("Endpoint", "The host and path in the URL is the GraphQL endpoint. Requests are sent using https unless tls=false is provided.\nAdditional headers can be sent using header=Name:Value. Use timeout=30s and maxAttempts=5 to control retries.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Mutations", "Provide a JSON file with mutations=/path/to/mutations.json. The file is an array of mutations with name, tables, operations, query, variables, batch and batchSize.\nThe first matching mutation is used and events which don't match a mutation are skipped.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Variables", "The variables is a Go template which must produce a JSON object. It is rendered with .Event for each event, or .Events when batch is true.\nEach event has ID, Operation, Table, PrimaryKey, CompanyID, LocationID, UserID, Timestamp, Diff, Before and After. Use the json function to encode values such as {\"input\": {{ json .Event.After }}}.\nMutations should be idempotent (such as upserts) since a failed batch is redelivered.\n"))
+	return help.String()
+}
+
+// CreateDatasource allows the handler to create the datasource before importing data.
+func (p *graphqlDriver) CreateDatasource(schema internal.SchemaMap) error {
+	return nil
+}
+
+// ImportEvent allows the handler to process the event.
+func (p *graphqlDriver) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	if p.importConfig.DryRun {
+		p.logger.Trace("would have sent event: %s", event.ID)
+		return nil
+	}
+	_, err := p.Process(p.logger, event)
+	return err
+}
+
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *graphqlDriver) ImportBatchLimits() (int, int) {
+	return maxImportBatchSize, 0
+}
+
+// FlushBatch sends the pending events.
+func (p *graphqlDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
+// ImportCompleted is called when all events have been processed.
+func (p *graphqlDriver) ImportCompleted() error {
+	return p.Flush(p.logger)
+}
+
+func (p *graphqlDriver) Import(config internal.ImporterConfig) error {
+	if config.SchemaOnly {
+		return nil
+	}
+	p.logger = config.Logger.WithPrefix("[graphql]")
+	if err := p.connect(config.URL); err != nil {
+		return err
+	}
+	p.ctx = config.Context
+	p.importConfig = config
+	return importer.Run(p.logger, config, p)
+}
+
+// SupportsDelete returns true if the importer supports deleting data.
+func (p *graphqlDriver) SupportsDelete() bool {
+	return false
+}
+
+// Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
+func (p *graphqlDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
+	return p.parseURL(url)
+}
+
+// Configuration returns the configuration fields for the driver.
+func (p *graphqlDriver) Configuration() []internal.DriverField {
+	return []internal.DriverField{
+		internal.RequiredStringField("URL", "The GraphQL endpoint url", nil),
+		internal.RequiredStringField("Mutations File", "The path to a JSON file with the mutations", nil),
+	}
+}
+
+// Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
+func (p *graphqlDriver) Validate(values map[string]any) (string, []internal.FieldError) {
+	endpoint := internal.GetRequiredStringValue("URL", values)
+	mutations := internal.GetRequiredStringValue("Mutations File", values)
+	eu, err := url.Parse(endpoint)
+	if err != nil || eu.Host == "" {
+		return "", []internal.FieldError{internal.NewFieldError("URL", "invalid url")}
+	}
+	if _, err := loadMutations(mutations); err != nil {
+		return "", []internal.FieldError{internal.NewFieldError("Mutations File", err.Error())}
+	}
+	u := url.URL{Scheme: "graphql", Host: eu.Host, Path: eu.Path}
+	query := eu.Query()
+	if eu.Scheme == "http" {
+		query.Set("tls", "false")
+	}
+	query.Set("mutations", mutations)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func init() {
+	internal.RegisterDriver("graphql", &graphqlDriver{})
+	internal.RegisterImporter("graphql", &graphqlDriver{})
+}
@@ -0,0 +1,201 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type testServer struct {
+	server   *httptest.Server
+	requests []request
+	header   http.Header
+	fail     func(req request) string
+	attempts int
+	lock     sync.Mutex
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.attempts++
+		var req request
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if s.fail != nil {
+			if msg := s.fail(req); msg == "unavailable" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			} else if msg != "" {
+				w.Write([]byte(`{"errors":[{"message":"` + msg + `"}]}`))
+				return
+			}
+		}
+		s.requests = append(s.requests, req)
+		s.header = r.Header.Clone()
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *testServer) variables() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var res []string
+	for _, req := range s.requests {
+		res = append(res, string(req.Variables))
+	}
+	return res
+}
+
+func writeMutations(t *testing.T, mutations []Mutation) string {
+	fn := filepath.Join(t.TempDir(), "mutations.json")
+	assert.NoError(t, os.WriteFile(fn, []byte(util.JSONStringify(mutations)), 0600))
+	return fn
+}
+
+func startDriver(t *testing.T, s *testServer, mutations string, extra string) *graphqlDriver {
+	var driver graphqlDriver
+	assert.NoError(t, driver.Start(internal.DriverConfig{
+		Context: context.Background(),
+		URL:     "graphql://" + strings.TrimPrefix(s.server.URL, "http://") + "/graphql?tls=false&mutations=" + mutations + extra,
+		Logger:  logger.NewTestLogger(),
+	}))
+	return &driver
+}
+
+var testMutations = []Mutation{
+	{
+		Name:       "upsertOrders",
+		Tables:     []string{"order"},
+		Operations: []string{"INSERT", "UPDATE"},
+		Query:      "mutation ($input: [OrderInput!]!) { upsertOrders(input: $input) { count } }",
+		Variables:  `{"input": [{{ range $i, $e := .Events }}{{ if $i }},{{ end }}{{ json (pick $e.After "id" "name") }}{{ end }}]}`,
+		Batch:      true,
+		BatchSize:  2,
+	},
+	{
+		Name:       "deleteOrder",
+		Tables:     []string{"order"},
+		Operations: []string{"DELETE"},
+		Query:      "mutation ($id: ID!) { deleteOrder(id: $id) }",
+		Variables:  `{"id": {{ json .Event.PrimaryKey }}}`,
+	},
+}
+
+func TestMutations(t *testing.T) {
+	s := newTestServer(t)
+	driver := startDriver(t, s, writeMutations(t, testMutations), "&header=Authorization:Bearer%20abc")
+
+	for _, event := range []internal.DBChangeEvent{
+		{ID: "1", Table: "order", Operation: "INSERT", Key: []string{"1"}, After: json.RawMessage(`{"id":"1","name":"a","extra":true}`)},
+		{ID: "2", Table: "order", Operation: "UPDATE", Key: []string{"2"}, After: json.RawMessage(`{"id":"2","name":"b"}`)},
+		{ID: "3", Table: "order", Operation: "INSERT", Key: []string{"3"}, After: json.RawMessage(`{"id":"3","name":"c"}`)},
+		{ID: "4", Table: "order", Operation: "DELETE", Key: []string{"1"}, Before: json.RawMessage(`{"id":"1"}`)},
+		{ID: "5", Table: "customer", Operation: "INSERT", Key: []string{"1"}},
+	} {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, []string{
+		`{"input":[{"id":"1","name":"a"},{"id":"2","name":"b"}]}`,
+		`{"input":[{"id":"3","name":"c"}]}`,
+		`{"id":"1"}`,
+	}, s.variables())
+	assert.Equal(t, testMutations[1].Query, s.requests[2].Query)
+	assert.Equal(t, "Bearer abc", s.header.Get("Authorization"))
+}
+
+func TestFailedMutationIsNotResent(t *testing.T) {
+	s := newTestServer(t)
+	s.fail = func(req request) string {
+		if strings.Contains(req.Query, "deleteOrder") {
+			return "not allowed"
+		}
+		return ""
+	}
+	driver := startDriver(t, s, writeMutations(t, testMutations), "")
+
+	events := []internal.DBChangeEvent{
+		{ID: "1", Table: "order", Operation: "INSERT", Key: []string{"1"}, After: json.RawMessage(`{"id":"1","name":"a"}`)},
+		{ID: "2", Table: "order", Operation: "DELETE", Key: []string{"1"}},
+	}
+	for _, event := range events {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.ErrorContains(t, driver.Flush(driver.logger), "not allowed")
+	assert.Len(t, s.variables(), 1)
+
+	// the batch is redelivered after the nak
+	s.lock.Lock()
+	s.fail = nil
+	s.lock.Unlock()
+	for _, event := range events {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, []string{`{"input":[{"id":"1","name":"a"}]}`, `{"id":"1"}`}, s.variables())
+}
+
+func TestRetry(t *testing.T) {
+	s := newTestServer(t)
+	s.fail = func(req request) string {
+		if s.attempts < 3 {
+			return "unavailable"
+		}
+		return ""
+	}
+	driver := startDriver(t, s, writeMutations(t, testMutations), "")
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "DELETE", Key: []string{"1"}})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, 3, s.attempts)
+
+	// out of attempts
+	s.attempts = 0
+	driver = startDriver(t, s, writeMutations(t, testMutations), "&maxAttempts=2")
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "DELETE", Key: []string{"1"}})
+	assert.NoError(t, err)
+	assert.ErrorContains(t, driver.Flush(driver.logger), "503")
+}
+
+func TestLoadMutations(t *testing.T) {
+	_, err := loadMutations(writeMutations(t, []Mutation{{Tables: []string{"order"}}}))
+	assert.ErrorContains(t, err, "query is required")
+	_, err = loadMutations(writeMutations(t, []Mutation{{Query: "mutation { x }", Variables: "{{ .Event"}}))
+	assert.ErrorContains(t, err, "invalid variables template")
+	_, err = loadMutations(writeMutations(t, []Mutation{}))
+	assert.Error(t, err)
+
+	mutations, err := loadMutations(writeMutations(t, []Mutation{{Query: "mutation { x }", Variables: "not json"}}))
+	assert.NoError(t, err)
+	_, err = mutations[0].render([]*Event{{ID: "1"}})
+	assert.ErrorContains(t, err, "not a valid JSON object")
+}
+
+func TestValidate(t *testing.T) {
+	var driver graphqlDriver
+	fn := writeMutations(t, testMutations)
+	url, errs := driver.Validate(map[string]any{"URL": "http://localhost:8080/graphql", "Mutations File": fn})
+	assert.Empty(t, errs)
+	assert.Equal(t, "graphql://localhost:8080/graphql?mutations="+strings.ReplaceAll(fn, "/", "%2F")+"&tls=false", url)
+
+	_, errs = driver.Validate(map[string]any{"URL": "http://localhost:8080/graphql", "Mutations File": "/does/not/exist.json"})
+	assert.NotEmpty(t, errs)
+}
@@ -0,0 +1,165 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const defaultBatchSize = 100
+
+// Mutation maps events for a set of tables and operations to a GraphQL mutation.
+type Mutation struct {
+	// Name identifies the mutation in logs. Defaults to the index in the file.
+	Name string `json:"name,omitempty"`
+
+	// Tables the mutation applies to. Defaults to all tables.
+	Tables []string `json:"tables,omitempty"`
+
+	// Operations (INSERT, UPDATE, DELETE) the mutation applies to. Defaults to all operations.
+	Operations []string `json:"operations,omitempty"`
+
+	// Query is the GraphQL mutation document.
+	Query string `json:"query"`
+
+	// Variables is a Go template which must produce a JSON object of the variables for the mutation.
+	// The template is rendered with .Event for each event or with .Events when Batch is true.
+	Variables string `json:"variables"`
+
+	// Batch sends up to BatchSize events in a single mutation instead of one mutation per event.
+	Batch bool `json:"batch,omitempty"`
+
+	// BatchSize is the maximum number of events rendered into a single mutation when Batch is true. Defaults to 100.
+	BatchSize int `json:"batchSize,omitempty"`
+
+	tmpl *template.Template
+}
+
+// Event is the data for an event available to the variables template.
+type Event struct {
+	ID         string         `json:"id"`
+	Operation  string         `json:"operation"`
+	Table      string         `json:"table"`
+	PrimaryKey string         `json:"primaryKey"`
+	CompanyID  string         `json:"companyId,omitempty"`
+	LocationID string         `json:"locationId,omitempty"`
+	UserID     string         `json:"userId,omitempty"`
+	Timestamp  int64          `json:"timestamp"`
+	Diff       []string       `json:"diff,omitempty"`
+	Before     map[string]any `json:"before,omitempty"`
+	After      map[string]any `json:"after,omitempty"`
+}
+
+func newEvent(event *internal.DBChangeEvent) (*Event, error) {
+	e := &Event{
+		ID:         event.ID,
+		Operation:  event.Operation,
+		Table:      event.Table,
+		PrimaryKey: event.GetPrimaryKey(),
+		Timestamp:  event.Timestamp,
+		Diff:       event.Diff,
+	}
+	if event.CompanyID != nil {
+		e.CompanyID = *event.CompanyID
+	}
+	if event.LocationID != nil {
+		e.LocationID = *event.LocationID
+	}
+	if event.UserID != nil {
+		e.UserID = *event.UserID
+	}
+	if len(event.Before) > 0 {
+		if err := json.Unmarshal(event.Before, &e.Before); err != nil {
+			return nil, fmt.Errorf("error decoding before for event %s: %w", event.ID, err)
+		}
+	}
+	if len(event.After) > 0 {
+		if err := json.Unmarshal(event.After, &e.After); err != nil {
+			return nil, fmt.Errorf("error decoding after for event %s: %w", event.ID, err)
+		}
+	}
+	return e, nil
+}
+
+func (m *Mutation) matches(event *internal.DBChangeEvent) bool {
+	return matchesAny(m.Tables, event.Table) && matchesAny(m.Operations, event.Operation)
+}
+
+func matchesAny(values []string, val string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || strings.EqualFold(v, val) {
+			return true
+		}
+	}
+	return false
+}
+
+// render returns the variables for the events.
+func (m *Mutation) render(events []*Event) (json.RawMessage, error) {
+	data := map[string]any{"Events": events}
+	if len(events) > 0 {
+		data["Event"] = events[0]
+	}
+	var buf strings.Builder
+	if err := m.tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("error rendering variables for mutation %s: %w", m.Name, err)
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(buf.String()), &obj); err != nil {
+		return nil, fmt.Errorf("variables for mutation %s are not a valid JSON object: %w", m.Name, err)
+	}
+	return json.RawMessage(buf.String()), nil
+}
+
+func (m *Mutation) init(index int) error {
+	if m.Name == "" {
+		m.Name = fmt.Sprintf("mutation-%d", index)
+	}
+	if strings.TrimSpace(m.Query) == "" {
+		return fmt.Errorf("query is required for %s", m.Name)
+	}
+	if m.Variables == "" {
+		m.Variables = "{}"
+	}
+	tmpl, err := template.New(m.Name).Funcs(util.TemplateFuncs).Option("missingkey=zero").Parse(m.Variables)
+	if err != nil {
+		return fmt.Errorf("invalid variables template for %s: %w", m.Name, err)
+	}
+	m.tmpl = tmpl
+	if m.BatchSize <= 0 {
+		m.BatchSize = defaultBatchSize
+	}
+	if !m.Batch {
+		m.BatchSize = 1
+	}
+	return nil
+}
+
+// loadMutations loads the mutations from a JSON file which is an array of mutations.
+func loadMutations(fn string) ([]*Mutation, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading mutations file: %w", err)
+	}
+	var mutations []*Mutation
+	if err := json.Unmarshal(buf, &mutations); err != nil {
+		return nil, fmt.Errorf("error parsing mutations file %s: %w", fn, err)
+	}
+	if len(mutations) == 0 {
+		return nil, fmt.Errorf("no mutations found in %s", fn)
+	}
+	for i, m := range mutations {
+		if err := m.init(i); err != nil {
+			return nil, err
+		}
+	}
+	return mutations, nil
+}
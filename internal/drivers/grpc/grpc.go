@@ -0,0 +1,393 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/importer"
+	"github.com/shopmonkeyus/eds/internal/util"
+	edsv1 "github.com/shopmonkeyus/eds/proto/eds/v1"
+	"github.com/shopmonkeyus/go-common/logger"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxBatchSize       = 1_000
+	maxImportBatchSize = 500
+	defaultAckTimeout  = time.Second * 30
+)
+
+type grpcDriver struct {
+	ctx          context.Context
+	logger       logger.Logger
+	target       string
+	secure       bool
+	headers      metadata.MD
+	ackTimeout   time.Duration
+	conn         *grpclib.ClientConn
+	client       edsv1.ChangeEventServiceClient
+	stream       edsv1.ChangeEventService_StreamClient
+	cancelStream context.CancelFunc
+	pending      []*edsv1.ChangeEvent
+	batchPrefix  string
+	batchCount   uint64
+	lock         sync.Mutex
+	waitGroup    sync.WaitGroup
+	importConfig internal.ImporterConfig
+}
+
+var _ internal.Driver = (*grpcDriver)(nil)
+var _ internal.DriverLifecycle = (*grpcDriver)(nil)
+var _ internal.DriverHelp = (*grpcDriver)(nil)
+var _ internal.Importer = (*grpcDriver)(nil)
+var _ internal.ImporterHelp = (*grpcDriver)(nil)
+var _ importer.BatchHandler = (*grpcDriver)(nil)
+
+// parseURL parses the url in the format grpc://host:port?tls=false&header=Name:Value&timeout=30s
+func (p *grpcDriver) parseURL(urlString string) error {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return fmt.Errorf("unable to parse url: %w", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host is required in url")
+	}
+	query := u.Query()
+	p.target = u.Host
+	p.secure = query.Get("tls") != "false"
+	p.headers = metadata.MD{}
+	for _, header := range query["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return fmt.Errorf("invalid header: %s (expected name:value)", header)
+		}
+		p.headers.Append(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	p.ackTimeout = defaultAckTimeout
+	if val := query.Get("timeout"); val != "" {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %s", val)
+		}
+		p.ackTimeout = timeout
+	}
+	return nil
+}
+
+func (p *grpcDriver) connect(urlString string) error {
+	if err := p.parseURL(urlString); err != nil {
+		return err
+	}
+	creds := insecure.NewCredentials()
+	if p.secure {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpclib.NewClient(p.target, grpclib.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("error creating grpc client for %s: %w", p.target, err)
+	}
+	p.conn = conn
+	p.client = edsv1.NewChangeEventServiceClient(conn)
+	p.batchPrefix = fmt.Sprintf("%x", time.Now().UnixNano())
+	return nil
+}
+
+// Start the driver. This is called once at the beginning of the driver's lifecycle.
+func (p *grpcDriver) Start(pc internal.DriverConfig) error {
+	p.ctx = pc.Context
+	p.logger = pc.Logger.WithPrefix("[grpc]")
+	if err := p.connect(pc.URL); err != nil {
+		return err
+	}
+	p.logger.Debug("using endpoint %s (tls=%v)", p.target, p.secure)
+	return nil
+}
+
+// Stop the driver. This is called once at the end of the driver's lifecycle.
+func (p *grpcDriver) Stop() error {
+	p.logger.Debug("stopping")
+	p.waitGroup.Wait()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closeStream()
+	if p.conn != nil {
+		if err := p.conn.Close(); err != nil {
+			return fmt.Errorf("error closing grpc connection: %w", err)
+		}
+		p.conn = nil
+	}
+	p.logger.Debug("stopped")
+	return nil
+}
+
+// MaxBatchSize returns the maximum number of events that can be processed in a single call to Process and when Flush should be called.
+// Return -1 to indicate that there is no limit.
+func (p *grpcDriver) MaxBatchSize() int {
+	return maxBatchSize
+}
+
+func toChangeEvent(event internal.DBChangeEvent) *edsv1.ChangeEvent {
+	return &edsv1.ChangeEvent{
+		Id:            event.ID,
+		Operation:     event.Operation,
+		Table:         event.Table,
+		Key:           event.Key,
+		ModelVersion:  event.ModelVersion,
+		CompanyId:     event.CompanyID,
+		LocationId:    event.LocationID,
+		UserId:        event.UserID,
+		Before:        event.Before,
+		After:         event.After,
+		Diff:          event.Diff,
+		Timestamp:     event.Timestamp,
+		MvccTimestamp: event.MVCCTimestamp,
+		Imported:      event.Imported,
+	}
+}
+
+// Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
+func (p *grpcDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pending = append(p.pending, toChangeEvent(event))
+	return false, nil
+}
+
+// closeStream closes the current stream so that the next flush will open a new one. Must be called with the lock held.
+func (p *grpcDriver) closeStream() {
+	if p.stream != nil {
+		p.stream.CloseSend()
+		p.stream = nil
+	}
+	if p.cancelStream != nil {
+		p.cancelStream()
+		p.cancelStream = nil
+	}
+}
+
+// openStream opens the stream if not already open. Must be called with the lock held.
+func (p *grpcDriver) openStream() error {
+	if p.stream != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	if len(p.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, p.headers)
+	}
+	stream, err := p.client.Stream(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("error opening stream to %s: %w", p.target, err)
+	}
+	p.stream = stream
+	p.cancelStream = cancel
+	return nil
+}
+
+// send sends the batch and waits for the ack. Must be called with the lock held.
+func (p *grpcDriver) send(logger logger.Logger, batch *edsv1.EventBatch) error {
+	if err := p.openStream(); err != nil {
+		return err
+	}
+	if err := p.stream.Send(batch); err != nil {
+		return fmt.Errorf("error sending batch %s: %w", batch.BatchId, err)
+	}
+	type result struct {
+		ack *edsv1.BatchAck
+		err error
+	}
+	ch := make(chan result, 1)
+	stream := p.stream
+	go func() {
+		ack, err := stream.Recv()
+		ch <- result{ack, err}
+	}()
+	timer := time.NewTimer(p.ackTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return fmt.Errorf("error receiving ack for batch %s: %w", batch.BatchId, res.err)
+		}
+		if res.ack.GetBatchId() != batch.BatchId {
+			return fmt.Errorf("received ack for batch %s but expected %s", res.ack.GetBatchId(), batch.BatchId)
+		}
+		if !res.ack.GetSuccess() {
+			return fmt.Errorf("batch %s was rejected: %s", batch.BatchId, res.ack.GetError())
+		}
+		logger.Trace("batch %s with %d events acked", batch.BatchId, len(batch.Events))
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("timed out after %v waiting for ack for batch %s", p.ackTimeout, batch.BatchId)
+	case <-p.ctx.Done():
+		return internal.ErrDriverStopped
+	}
+}
+
+// Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
+func (p *grpcDriver) Flush(logger logger.Logger) error {
+	logger.Debug("flush")
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.pending) == 0 {
+		return nil
+	}
+	p.batchCount++
+	batch := &edsv1.EventBatch{
+		BatchId: fmt.Sprintf("%s-%d", p.batchPrefix, p.batchCount),
+		Events:  p.pending,
+	}
+	p.pending = nil
+	if err := p.send(logger, batch); err != nil {
+		// the stream may have a late ack for this batch so start over with a new stream
+		p.closeStream()
+		if errors.Is(err, internal.ErrDriverStopped) {
+			return err
+		}
+		return fmt.Errorf("error sending to %s: %w", p.target, err)
+	}
+	return nil
+}
+
+// Name is a unique name for the driver.
+func (p *grpcDriver) Name() string {
+	return "gRPC"
+}
+
+// Description is the description of the driver.
+func (p *grpcDriver) Description() string {
+	return "Supports streaming EDS messages to a gRPC service implementing the EDS ChangeEventService."
+}
+
+// ExampleURL should return an example URL for configuring the driver.
+func (p *grpcDriver) ExampleURL() string {
+	return "grpc://eds.example.com:443"
+}
+
+// Help should return a detailed help documentation for the driver.
+func (p *grpcDriver) Help() string {
+	var help strings.Builder
+	help.WriteString(util.GenerateHelpSection("Service", "Provide the host and port of a gRPC service which implements the eds.v1.ChangeEventService defined in proto/eds/v1/eds.proto.\nConnections use TLS unless tls=false is provided. Additional metadata can be sent using header=Name:Value.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Acknowledgements", "Events are sent in batches over a single stream and the service must reply with a BatchAck for each batch. Events are only acknowledged when the batch is acked with success, otherwise they are redelivered.\nThe driver will wait up to 30s for each ack, which can be changed with timeout=1m.\n"))
+	return help.String()
+}
+
+// CreateDatasource allows the handler to create the datasource before importing data.
+func (p *grpcDriver) CreateDatasource(schema internal.SchemaMap) error {
+	return nil
+}
+
+// ImportEvent allows the handler to process the event.
+func (p *grpcDriver) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	if p.importConfig.DryRun {
+		p.logger.Trace("would have sent event: %s", event.ID)
+		return nil
+	}
+	_, err := p.Process(p.logger, event)
+	return err
+}
+
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *grpcDriver) ImportBatchLimits() (int, int) {
+	return maxImportBatchSize, 0
+}
+
+// FlushBatch sends the pending events.
+func (p *grpcDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
+// ImportCompleted is called when all events have been processed.
+func (p *grpcDriver) ImportCompleted() error {
+	return p.Flush(p.logger)
+}
+
+func (p *grpcDriver) Import(config internal.ImporterConfig) error {
+	if config.SchemaOnly {
+		return nil
+	}
+	p.logger = config.Logger.WithPrefix("[grpc]")
+	p.ctx = config.Context
+	if err := p.connect(config.URL); err != nil {
+		return err
+	}
+	defer p.Stop()
+	p.importConfig = config
+	return importer.Run(p.logger, config, p)
+}
+
+// SupportsDelete returns true if the importer supports deleting data.
+func (p *grpcDriver) SupportsDelete() bool {
+	return false
+}
+
+// Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
+func (p *grpcDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
+	if err := p.connect(url); err != nil {
+		return err
+	}
+	defer p.conn.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.ackTimeout)
+		defer cancel()
+	}
+	if len(p.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, p.headers)
+	}
+	res, err := healthpb.NewHealthClient(p.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			// the service answered so it's reachable even though it doesn't report its health
+			logger.Debug("%s doesn't implement the health service", p.target)
+			return nil
+		}
+		return fmt.Errorf("error checking health of %s: %w", p.target, err)
+	}
+	if res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%s is not serving: %s", p.target, res.GetStatus())
+	}
+	return nil
+}
+
+// Configuration returns the configuration fields for the driver.
+func (p *grpcDriver) Configuration() []internal.DriverField {
+	return []internal.DriverField{
+		internal.RequiredStringField("Host", "The host and port of the gRPC service", nil),
+		internal.OptionalBooleanField("TLS", "Connect to the service using TLS", true),
+	}
+}
+
+// Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
+func (p *grpcDriver) Validate(values map[string]any) (string, []internal.FieldError) {
+	host := internal.GetRequiredStringValue("Host", values)
+	if !strings.Contains(host, ":") {
+		return "", []internal.FieldError{internal.NewFieldError("Host", "must include the port such as example.com:443")}
+	}
+	u := url.URL{Scheme: "grpc", Host: host}
+	if !internal.GetOptionalBoolValue("TLS", true, values) {
+		u.RawQuery = "tls=false"
+	}
+	return u.String(), nil
+}
+
+func init() {
+	internal.RegisterDriver("grpc", &grpcDriver{})
+	internal.RegisterImporter("grpc", &grpcDriver{})
+}
@@ -0,0 +1,178 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	edsv1 "github.com/shopmonkeyus/eds/proto/eds/v1"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+type testService struct {
+	edsv1.UnimplementedChangeEventServiceServer
+	batches []*edsv1.EventBatch
+	reject  bool
+	token   string
+	lock    sync.Mutex
+}
+
+func (s *testService) Stream(stream edsv1.ChangeEventService_StreamServer) error {
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if vals := md.Get("x-token"); len(vals) > 0 {
+			s.lock.Lock()
+			s.token = vals[0]
+			s.lock.Unlock()
+		}
+	}
+	for {
+		batch, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		s.lock.Lock()
+		ack := &edsv1.BatchAck{BatchId: batch.BatchId, Success: !s.reject}
+		if s.reject {
+			ack.Error = "rejected"
+		} else {
+			s.batches = append(s.batches, batch)
+		}
+		s.lock.Unlock()
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+func startServer(t *testing.T) (*testService, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpclib.NewServer()
+	svc := &testService{}
+	edsv1.RegisterChangeEventServiceServer(server, svc)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return svc, listener.Addr().String()
+}
+
+func startDriver(t *testing.T, urlString string) *grpcDriver {
+	var driver grpcDriver
+	assert.NoError(t, driver.Start(internal.DriverConfig{
+		Context: context.Background(),
+		URL:     urlString,
+		Logger:  logger.NewTestLogger(),
+	}))
+	t.Cleanup(func() { driver.Stop() })
+	return &driver
+}
+
+func TestStream(t *testing.T) {
+	svc, addr := startServer(t)
+	driver := startDriver(t, "grpc://"+addr+"?tls=false&header=x-token:abc")
+
+	companyID := "1234"
+	for _, id := range []string{"1", "2"} {
+		_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: id, Table: "order", Operation: "INSERT", Key: []string{id}, CompanyID: &companyID, After: []byte(`{"id":"` + id + `"}`)})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "3", Table: "customer", Operation: "DELETE"})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.NoError(t, driver.Flush(driver.logger)) // nothing pending
+
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	assert.Len(t, svc.batches, 2)
+	assert.Len(t, svc.batches[0].Events, 2)
+	assert.Equal(t, "order", svc.batches[0].Events[0].Table)
+	assert.Equal(t, "1234", svc.batches[0].Events[0].GetCompanyId())
+	assert.Equal(t, `{"id":"1"}`, string(svc.batches[0].Events[0].After))
+	assert.Equal(t, "3", svc.batches[1].Events[0].Id)
+	assert.NotEqual(t, svc.batches[0].BatchId, svc.batches[1].BatchId)
+	assert.Equal(t, "abc", svc.token)
+}
+
+func TestRejectedBatch(t *testing.T) {
+	svc, addr := startServer(t)
+	svc.reject = true
+	driver := startDriver(t, "grpc://"+addr+"?tls=false")
+
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	assert.ErrorContains(t, driver.Flush(driver.logger), "rejected")
+
+	// the batch is redelivered after the nak
+	svc.lock.Lock()
+	svc.reject = false
+	svc.lock.Unlock()
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	assert.Len(t, svc.batches, 1)
+}
+
+func TestConnectivity(t *testing.T) {
+	var driver grpcDriver
+	ctx := context.Background()
+
+	// a service without the health service is reachable
+	_, addr := startServer(t)
+	assert.NoError(t, driver.Test(ctx, logger.NewTestLogger(), "grpc://"+addr+"?tls=false"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpclib.NewServer()
+	checker := health.NewServer()
+	healthpb.RegisterHealthServer(server, checker)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	assert.NoError(t, driver.Test(ctx, logger.NewTestLogger(), "grpc://"+listener.Addr().String()+"?tls=false"))
+	checker.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.ErrorContains(t, driver.Test(ctx, logger.NewTestLogger(), "grpc://"+listener.Addr().String()+"?tls=false"), "not serving")
+
+	// nothing is listening
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closed.Close()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	assert.Error(t, driver.Test(ctx, logger.NewTestLogger(), "grpc://"+closed.Addr().String()+"?tls=false"))
+}
+
+func TestParseURL(t *testing.T) {
+	var driver grpcDriver
+	assert.NoError(t, driver.parseURL("grpc://example.com:443?timeout=1m&header=Authorization:Bearer%20abc"))
+	assert.Equal(t, "example.com:443", driver.target)
+	assert.True(t, driver.secure)
+	assert.Equal(t, time.Minute, driver.ackTimeout)
+	assert.Equal(t, []string{"Bearer abc"}, driver.headers.Get("authorization"))
+
+	assert.Error(t, driver.parseURL("grpc:///"))
+	assert.Error(t, driver.parseURL("grpc://example.com:443?timeout=soon"))
+	assert.Error(t, driver.parseURL("grpc://example.com:443?header=foo"))
+}
+
+func TestValidate(t *testing.T) {
+	var driver grpcDriver
+	url, errs := driver.Validate(map[string]any{"Host": "localhost:9000", "TLS": false})
+	assert.Empty(t, errs)
+	assert.Equal(t, "grpc://localhost:9000?tls=false", url)
+
+	url, errs = driver.Validate(map[string]any{"Host": "eds.example.com:443"})
+	assert.Empty(t, errs)
+	assert.Equal(t, "grpc://eds.example.com:443", url)
+
+	_, errs = driver.Validate(map[string]any{"Host": "eds.example.com"})
+	assert.NotEmpty(t, errs)
+}
@@ -0,0 +1,424 @@
+package gsheets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/importer"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultAPIURL      = "https://sheets.googleapis.com"
+	defaultMaxRows     = 5_000
+	maxAttempts        = 5
+	requestTimeout     = time.Second * 30
+	sheetsScope        = "https://www.googleapis.com/auth/spreadsheets"
+	maxImportBatchSize = 1_000
+)
+
+type sheetsDriver struct {
+	ctx           context.Context
+	logger        logger.Logger
+	registry      internal.SchemaRegistry
+	client        *http.Client
+	apiURL        string
+	spreadsheetID string
+	credentials   string
+	tables        []string
+	maxRows       int
+	sheets        map[string]*sheet
+	existing      map[string]bool
+	lock          sync.Mutex
+	importConfig  internal.ImporterConfig
+}
+
+var _ internal.Driver = (*sheetsDriver)(nil)
+var _ internal.DriverLifecycle = (*sheetsDriver)(nil)
+var _ internal.DriverHelp = (*sheetsDriver)(nil)
+var _ internal.Importer = (*sheetsDriver)(nil)
+var _ internal.ImporterHelp = (*sheetsDriver)(nil)
+var _ importer.BatchHandler = (*sheetsDriver)(nil)
+
+// parseURL parses the url in the format gsheets://spreadsheetId?tables=location,labor_rate&credentials=/path/to/service-account.json
+func (p *sheetsDriver) parseURL(urlString string) error {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return fmt.Errorf("unable to parse url: %w", err)
+	}
+	p.spreadsheetID = u.Host
+	if p.spreadsheetID == "" {
+		return fmt.Errorf("spreadsheet id is required in url")
+	}
+	query := u.Query()
+	p.tables = nil
+	for _, table := range strings.Split(query.Get("tables"), ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			p.tables = append(p.tables, table)
+		}
+	}
+	if len(p.tables) == 0 {
+		return fmt.Errorf("tables is required in url which should be a comma separated list of tables to mirror")
+	}
+	p.credentials = query.Get("credentials")
+	p.maxRows = defaultMaxRows
+	if val := query.Get("maxRows"); val != "" {
+		if p.maxRows, err = strconv.Atoi(val); err != nil || p.maxRows <= 0 {
+			return fmt.Errorf("invalid maxRows: %s", val)
+		}
+	}
+	if p.apiURL == "" {
+		p.apiURL = defaultAPIURL
+	}
+	return nil
+}
+
+// newClient returns an http client authorized with the service account credentials file or the application default credentials.
+func newClient(ctx context.Context, credentials string) (*http.Client, error) {
+	var creds *google.Credentials
+	var err error
+	if credentials != "" {
+		buf, rerr := os.ReadFile(credentials)
+		if rerr != nil {
+			return nil, fmt.Errorf("error reading credentials file: %w", rerr)
+		}
+		creds, err = google.CredentialsFromJSON(ctx, buf, sheetsScope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, sheetsScope)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading google credentials: %w", err)
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
+func (p *sheetsDriver) connect(ctx context.Context, urlString string) error {
+	if err := p.parseURL(urlString); err != nil {
+		return err
+	}
+	if p.client == nil {
+		client, err := newClient(ctx, p.credentials)
+		if err != nil {
+			return err
+		}
+		p.client = client
+	}
+	p.sheets = make(map[string]*sheet)
+	return p.loadTabs()
+}
+
+// call makes a request to the sheets api, retrying on rate limits and server errors.
+func (p *sheetsDriver) call(method string, path string, query url.Values, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader([]byte(util.JSONStringify(body)))
+	}
+	u := p.apiURL + "/v4/spreadsheets/" + url.PathEscape(p.spreadsheetID) + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(p.ctx, method, u, reader)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	retry := util.NewHTTPRetry(req,
+		util.WithLogger(p.logger),
+		util.WithClient(p.client),
+		util.WithMaxAttempts(maxAttempts),
+		util.WithAttemptTimeout(requestTimeout),
+		util.WithTimeout(requestTimeout*maxAttempts),
+		util.WithRetryStatus(util.RetryServerErrors),
+	)
+	resp, err := retry.Do()
+	if err != nil {
+		return fmt.Errorf("error calling %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	res, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response from %s: %w", path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d from %s: %s", resp.StatusCode, path, strings.TrimSpace(string(res)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(res, out); err != nil {
+			return fmt.Errorf("error decoding response from %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// loadTabs loads the titles of the existing tabs in the spreadsheet.
+func (p *sheetsDriver) loadTabs() error {
+	var res struct {
+		Sheets []struct {
+			Properties struct {
+				Title string `json:"title"`
+			} `json:"properties"`
+		} `json:"sheets"`
+	}
+	if err := p.call(http.MethodGet, "", url.Values{"fields": {"sheets.properties.title"}}, nil, &res); err != nil {
+		return fmt.Errorf("error loading spreadsheet %s: %w", p.spreadsheetID, err)
+	}
+	p.existing = make(map[string]bool)
+	for _, s := range res.Sheets {
+		p.existing[s.Properties.Title] = true
+	}
+	return nil
+}
+
+// getSheet returns the mirror for the table, loading it from the tab the first time.
+func (p *sheetsDriver) getSheet(table string, schema *internal.Schema) (*sheet, error) {
+	if s := p.sheets[table]; s != nil {
+		return s, nil
+	}
+	s := newSheet(table)
+	if p.existing[table] {
+		var res struct {
+			Values [][]any `json:"values"`
+		}
+		if err := p.call(http.MethodGet, "/values/"+url.PathEscape(quoteTitle(table)), url.Values{"valueRenderOption": {"UNFORMATTED_VALUE"}}, nil, &res); err != nil {
+			return nil, fmt.Errorf("error loading tab %s: %w", table, err)
+		}
+		s.load(res.Values, keyColumn(schema))
+		p.logger.Debug("loaded %d rows from tab %s", len(s.keys), table)
+	} else {
+		req := map[string]any{"requests": []any{map[string]any{"addSheet": map[string]any{"properties": map[string]any{"title": table}}}}}
+		if err := p.call(http.MethodPost, ":batchUpdate", nil, req, nil); err != nil {
+			return nil, fmt.Errorf("error creating tab %s: %w", table, err)
+		}
+		p.existing[table] = true
+		p.logger.Debug("created tab %s", table)
+	}
+	p.sheets[table] = s
+	return s, nil
+}
+
+func (p *sheetsDriver) process(event internal.DBChangeEvent, schema *internal.Schema) error {
+	if !util.SliceContains(p.tables, event.Table) {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, err := p.getSheet(event.Table, schema)
+	if err != nil {
+		return err
+	}
+	var object map[string]any
+	if event.Operation != "DELETE" {
+		if object, err = event.GetObject(); err != nil {
+			return fmt.Errorf("error getting object for event %s: %w", event.ID, err)
+		}
+	}
+	if schema != nil {
+		s.setColumns(schema.Columns())
+	} else if len(s.columns) == 0 && object != nil {
+		s.setColumns(objectColumns(object, keyColumn(nil)))
+	}
+	s.apply(event.GetPrimaryKey(), event.Operation, object)
+	if len(s.keys) > p.maxRows {
+		return fmt.Errorf("table %s has more than %d rows which is too large to mirror into google sheets", event.Table, p.maxRows)
+	}
+	return nil
+}
+
+// Start the driver. This is called once at the beginning of the driver's lifecycle.
+func (p *sheetsDriver) Start(pc internal.DriverConfig) error {
+	p.ctx = pc.Context
+	p.logger = pc.Logger.WithPrefix("[gsheets]")
+	p.registry = pc.SchemaRegistry
+	if err := p.connect(pc.Context, pc.URL); err != nil {
+		return err
+	}
+	p.logger.Debug("mirroring %s into spreadsheet %s", strings.Join(p.tables, ", "), p.spreadsheetID)
+	return nil
+}
+
+// Stop the driver. This is called once at the end of the driver's lifecycle.
+func (p *sheetsDriver) Stop() error {
+	return nil
+}
+
+// MaxBatchSize returns the maximum number of events that can be processed in a single call to Process and when Flush should be called.
+// Return -1 to indicate that there is no limit.
+func (p *sheetsDriver) MaxBatchSize() int {
+	return -1
+}
+
+// Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
+func (p *sheetsDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	var schema *internal.Schema
+	if p.registry != nil && util.SliceContains(p.tables, event.Table) {
+		var err error
+		if schema, err = p.registry.GetSchema(event.Table, event.ModelVersion); err != nil {
+			return false, fmt.Errorf("error getting schema for table: %s: %w", event.Table, err)
+		}
+	}
+	return false, p.process(event, schema)
+}
+
+// Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
+func (p *sheetsDriver) Flush(logger logger.Logger) error {
+	logger.Debug("flush")
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var data []any
+	var clear []string
+	var dirty []*sheet
+	for _, s := range p.sheets {
+		if !s.dirty {
+			continue
+		}
+		values := s.values()
+		clear = append(clear, s.clearRanges(len(values), len(s.columns))...)
+		data = append(data, map[string]any{"range": quoteTitle(s.title) + "!A1", "values": values})
+		dirty = append(dirty, s)
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	if len(clear) > 0 {
+		if err := p.call(http.MethodPost, "/values:batchClear", nil, map[string]any{"ranges": clear}, nil); err != nil {
+			return fmt.Errorf("error clearing old rows: %w", err)
+		}
+	}
+	if err := p.call(http.MethodPost, "/values:batchUpdate", nil, map[string]any{"valueInputOption": "RAW", "data": data}, nil); err != nil {
+		return fmt.Errorf("error updating spreadsheet: %w", err)
+	}
+	for _, s := range dirty {
+		s.written = len(s.keys) + 1
+		s.wrote = len(s.columns)
+		s.dirty = false
+		logger.Trace("wrote %d rows to tab %s", len(s.keys), s.title)
+	}
+	return nil
+}
+
+// Name is a unique name for the driver.
+func (p *sheetsDriver) Name() string {
+	return "Google Sheets"
+}
+
+// Description is the description of the driver.
+func (p *sheetsDriver) Description() string {
+	return "Supports mirroring small tables into tabs of a Google Sheets spreadsheet."
+}
+
+// ExampleURL should return an example URL for configuring the driver.
+func (p *sheetsDriver) ExampleURL() string {
+	return "gsheets://1BxiMVs0XRA5nFMdKvBdBZjgmUUqptlbs74OgvE2upms?tables=location,labor_rate&credentials=/etc/eds/service-account.json"
+}
+
+// Help should return a detailed help documentation for the driver.
+func (p *sheetsDriver) Help() string {
+	var help strings.Builder
+	help.WriteString(util.GenerateHelpSection("Spreadsheet", "Provide the spreadsheet id (from the spreadsheet url) as the host and the tables to mirror with tables=location,labor_rate.\nEach table is mirrored into a tab with the same name which is created if it doesn't exist. Events for other tables are skipped.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Authentication", "Provide a service account key file with credentials=/path/to/key.json or the application default credentials will be used.\nThe spreadsheet must be shared with the service account email as an editor.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Limits", "The driver is only intended for small, low-churn tables since each changed tab is rewritten on flush.\nA table with more than 5000 rows will fail, which can be changed with maxRows=10000.\n"))
+	return help.String()
+}
+
+// CreateDatasource allows the handler to create the datasource before importing data.
+func (p *sheetsDriver) CreateDatasource(schema internal.SchemaMap) error {
+	return nil
+}
+
+// ImportEvent allows the handler to process the event.
+func (p *sheetsDriver) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	if p.importConfig.DryRun {
+		p.logger.Trace("would have mirrored event: %s", event.ID)
+		return nil
+	}
+	return p.process(event, schema)
+}
+
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *sheetsDriver) ImportBatchLimits() (int, int) {
+	return maxImportBatchSize, 0
+}
+
+// FlushBatch writes the changed tabs.
+func (p *sheetsDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
+// ImportCompleted is called when all events have been processed.
+func (p *sheetsDriver) ImportCompleted() error {
+	return p.Flush(p.logger)
+}
+
+func (p *sheetsDriver) Import(config internal.ImporterConfig) error {
+	if config.SchemaOnly {
+		return nil
+	}
+	p.logger = config.Logger.WithPrefix("[gsheets]")
+	p.ctx = config.Context
+	if err := p.connect(config.Context, config.URL); err != nil {
+		return err
+	}
+	p.importConfig = config
+	return importer.Run(p.logger, config, p)
+}
+
+// SupportsDelete returns true if the importer supports deleting data.
+func (p *sheetsDriver) SupportsDelete() bool {
+	return false
+}
+
+// Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
+func (p *sheetsDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
+	p.ctx = ctx
+	p.logger = logger.WithPrefix("[gsheets]")
+	return p.connect(ctx, url)
+}
+
+// Configuration returns the configuration fields for the driver.
+func (p *sheetsDriver) Configuration() []internal.DriverField {
+	return []internal.DriverField{
+		internal.RequiredStringField("Spreadsheet ID", "The id of the spreadsheet from the spreadsheet url", nil),
+		internal.RequiredStringField("Tables", "A comma separated list of the tables to mirror", nil),
+		internal.OptionalStringField("Credentials File", "The path to a service account key file", nil),
+	}
+}
+
+// Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
+func (p *sheetsDriver) Validate(values map[string]any) (string, []internal.FieldError) {
+	id := internal.GetRequiredStringValue("Spreadsheet ID", values)
+	tables := internal.GetRequiredStringValue("Tables", values)
+	credentials := internal.GetOptionalStringValue("Credentials File", "", values)
+	if credentials != "" && !util.Exists(credentials) {
+		return "", []internal.FieldError{internal.NewFieldError("Credentials File", "file does not exist")}
+	}
+	query := url.Values{}
+	query.Set("tables", tables)
+	if credentials != "" {
+		query.Set("credentials", credentials)
+	}
+	u := url.URL{Scheme: "gsheets", Host: id, RawQuery: query.Encode()}
+	return u.String(), nil
+}
+
+func init() {
+	internal.RegisterDriver("gsheets", &sheetsDriver{})
+	internal.RegisterImporter("gsheets", &sheetsDriver{})
+}
@@ -0,0 +1,173 @@
+package gsheets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSheetsAPI is a fake of the parts of the sheets api used by the driver.
+type testSheetsAPI struct {
+	server  *httptest.Server
+	tabs    map[string][][]any
+	cleared []string
+	updates int
+	lock    sync.Mutex
+}
+
+func newTestSheetsAPI(t *testing.T, tabs map[string][][]any) *testSheetsAPI {
+	api := &testSheetsAPI{tabs: tabs}
+	prefix := "/v4/spreadsheets/sheet1"
+	api.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.lock.Lock()
+		defer api.lock.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		switch {
+		case r.Method == http.MethodGet && path == "":
+			var sheets []any
+			for title := range api.tabs {
+				sheets = append(sheets, map[string]any{"properties": map[string]any{"title": title}})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"sheets": sheets})
+		case r.Method == http.MethodGet && strings.HasPrefix(path, "/values/"):
+			title := strings.Trim(strings.TrimPrefix(path, "/values/"), "'")
+			json.NewEncoder(w).Encode(map[string]any{"values": api.tabs[title]})
+		case path == ":batchUpdate":
+			var req struct {
+				Requests []struct {
+					AddSheet struct {
+						Properties struct {
+							Title string `json:"title"`
+						} `json:"properties"`
+					} `json:"addSheet"`
+				} `json:"requests"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			api.tabs[req.Requests[0].AddSheet.Properties.Title] = nil
+			w.Write([]byte("{}"))
+		case path == "/values:batchClear":
+			var req struct {
+				Ranges []string `json:"ranges"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			api.cleared = append(api.cleared, req.Ranges...)
+			w.Write([]byte("{}"))
+		case path == "/values:batchUpdate":
+			var req struct {
+				ValueInputOption string `json:"valueInputOption"`
+				Data             []struct {
+					Range  string  `json:"range"`
+					Values [][]any `json:"values"`
+				} `json:"data"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, "RAW", req.ValueInputOption)
+			for _, d := range req.Data {
+				title := strings.Trim(strings.TrimSuffix(d.Range, "!A1"), "'")
+				api.tabs[title] = d.Values
+			}
+			api.updates++
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(api.server.Close)
+	return api
+}
+
+type testRegistry struct {
+	internal.SchemaRegistry
+	schema internal.SchemaMap
+}
+
+func (r *testRegistry) GetSchema(table string, version string) (*internal.Schema, error) {
+	return r.schema[table], nil
+}
+
+func startDriver(t *testing.T, api *testSheetsAPI) *sheetsDriver {
+	driver := &sheetsDriver{client: api.server.Client(), apiURL: api.server.URL}
+	registry := &testRegistry{schema: internal.SchemaMap{
+		"location": {Table: "location", PrimaryKeys: []string{"id"}, Properties: map[string]internal.SchemaProperty{"id": {}, "name": {}, "rate": {}}},
+	}}
+	assert.NoError(t, driver.Start(internal.DriverConfig{
+		Context:        context.Background(),
+		URL:            "gsheets://sheet1?tables=location,labor_rate",
+		Logger:         logger.NewTestLogger(),
+		SchemaRegistry: registry,
+	}))
+	return driver
+}
+
+func TestMirror(t *testing.T) {
+	api := newTestSheetsAPI(t, map[string][][]any{
+		"location": {{"id", "name", "rate"}, {"1", "Main", 100.0}, {"2", "North", 90.0}, {"3", "South", 80.0}},
+	})
+	driver := startDriver(t, api)
+
+	for _, event := range []internal.DBChangeEvent{
+		{ID: "a", Table: "location", Operation: "UPDATE", Key: []string{"1"}, After: json.RawMessage(`{"id":"1","name":"Main St","rate":110}`)},
+		{ID: "b", Table: "location", Operation: "DELETE", Key: []string{"2"}},
+		{ID: "f", Table: "location", Operation: "DELETE", Key: []string{"3"}},
+		{ID: "c", Table: "location", Operation: "INSERT", Key: []string{"4"}, After: json.RawMessage(`{"id":"4","name":"East","rate":null}`)},
+		{ID: "d", Table: "labor_rate", Operation: "INSERT", Key: []string{"1"}, After: json.RawMessage(`{"id":"1","rate":50,"tags":["a"]}`)},
+		{ID: "e", Table: "order", Operation: "INSERT", Key: []string{"1"}, After: json.RawMessage(`{"id":"1"}`)},
+	} {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+
+	assert.Equal(t, [][]any{{"id", "name", "rate"}, {"1", "Main St", 110.0}, {"4", "East", ""}}, api.tabs["location"])
+	assert.Equal(t, [][]any{{"id", "rate", "tags"}, {"1", 50.0, `["a"]`}}, api.tabs["labor_rate"])
+	assert.NotContains(t, api.tabs, "order")
+	assert.Equal(t, []string{"'location'!A4:C"}, api.cleared)
+	assert.Equal(t, 1, api.updates)
+
+	// nothing changed so nothing is written
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, 1, api.updates)
+}
+
+func TestMaxRows(t *testing.T) {
+	api := newTestSheetsAPI(t, map[string][][]any{})
+	driver := &sheetsDriver{client: api.server.Client(), apiURL: api.server.URL}
+	assert.NoError(t, driver.Start(internal.DriverConfig{
+		Context: context.Background(),
+		URL:     "gsheets://sheet1?tables=location&maxRows=1",
+		Logger:  logger.NewTestLogger(),
+	}))
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "a", Table: "location", Operation: "INSERT", Key: []string{"1"}, After: json.RawMessage(`{"id":"1"}`)})
+	assert.NoError(t, err)
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "b", Table: "location", Operation: "INSERT", Key: []string{"2"}, After: json.RawMessage(`{"id":"2"}`)})
+	assert.ErrorContains(t, err, "too large")
+}
+
+func TestClearRanges(t *testing.T) {
+	s := newSheet("it's")
+	s.written = 10
+	s.wrote = 30
+	assert.Equal(t, []string{"'it''s'!A6:AD", "'it''s'!D1:AD5"}, s.clearRanges(5, 3))
+	assert.Empty(t, s.clearRanges(10, 30))
+	assert.Equal(t, "A", columnName(1))
+	assert.Equal(t, "Z", columnName(26))
+	assert.Equal(t, "AA", columnName(27))
+}
+
+func TestValidate(t *testing.T) {
+	var driver sheetsDriver
+	url, errs := driver.Validate(map[string]any{"Spreadsheet ID": "abc", "Tables": "location,labor_rate"})
+	assert.Empty(t, errs)
+	assert.Equal(t, "gsheets://abc?tables=location%2Clabor_rate", url)
+
+	_, errs = driver.Validate(map[string]any{"Spreadsheet ID": "abc", "Tables": "location", "Credentials File": "/does/not/exist.json"})
+	assert.NotEmpty(t, errs)
+}
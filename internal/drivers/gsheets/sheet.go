@@ -0,0 +1,182 @@
+package gsheets
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// sheet is the in-memory mirror of a table in a tab. The whole tab is rewritten on flush when it changes
+// which is fine since the driver is only intended for small tables.
+type sheet struct {
+	title   string
+	columns []string
+	keys    []string
+	rows    map[string][]any
+	written int // number of rows (including the header) currently in the tab
+	wrote   int // number of columns currently in the tab
+	dirty   bool
+}
+
+func newSheet(title string) *sheet {
+	return &sheet{title: title, rows: make(map[string][]any)}
+}
+
+func keyColumn(schema *internal.Schema) string {
+	if schema != nil && len(schema.PrimaryKeys) > 0 {
+		return schema.PrimaryKeys[len(schema.PrimaryKeys)-1]
+	}
+	return "id"
+}
+
+// objectColumns returns the columns for an object without a schema with the key first and the rest sorted.
+func objectColumns(object map[string]any, key string) []string {
+	var columns []string
+	for name := range object {
+		if name != key {
+			columns = append(columns, name)
+		}
+	}
+	sort.Strings(columns)
+	if _, ok := object[key]; ok {
+		columns = append([]string{key}, columns...)
+	}
+	return columns
+}
+
+// load populates the mirror from the existing values in the tab.
+func (s *sheet) load(values [][]any, key string) {
+	s.written = len(values)
+	if len(values) == 0 {
+		return
+	}
+	for _, v := range values[0] {
+		s.columns = append(s.columns, fmt.Sprint(v))
+	}
+	s.wrote = len(s.columns)
+	keyIndex := -1
+	for i, c := range s.columns {
+		if c == key {
+			keyIndex = i
+		}
+	}
+	if keyIndex < 0 {
+		// we can't match rows without the key so the tab will be rewritten on the next change
+		s.columns = nil
+		return
+	}
+	for _, row := range values[1:] {
+		if keyIndex >= len(row) {
+			continue
+		}
+		pk := fmt.Sprint(row[keyIndex])
+		if _, ok := s.rows[pk]; !ok {
+			s.keys = append(s.keys, pk)
+		}
+		s.rows[pk] = row
+	}
+}
+
+// setColumns changes the columns, remapping the existing rows by column name.
+func (s *sheet) setColumns(columns []string) {
+	if strings.Join(columns, ",") == strings.Join(s.columns, ",") {
+		return
+	}
+	old := make(map[string]int)
+	for i, c := range s.columns {
+		old[c] = i
+	}
+	for pk, row := range s.rows {
+		newrow := make([]any, len(columns))
+		for i, c := range columns {
+			if j, ok := old[c]; ok && j < len(row) {
+				newrow[i] = row[j]
+			}
+		}
+		s.rows[pk] = newrow
+	}
+	s.columns = columns
+	s.dirty = true
+}
+
+func cellValue(val any) any {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string, bool, float64:
+		return v
+	default:
+		buf, _ := json.Marshal(v)
+		return string(buf)
+	}
+}
+
+// apply applies the change event to the mirror.
+func (s *sheet) apply(pk string, operation string, object map[string]any) {
+	s.dirty = true
+	if operation == "DELETE" {
+		if _, ok := s.rows[pk]; ok {
+			delete(s.rows, pk)
+			for i, k := range s.keys {
+				if k == pk {
+					s.keys = append(s.keys[:i], s.keys[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	row := make([]any, len(s.columns))
+	for i, c := range s.columns {
+		row[i] = cellValue(object[c])
+	}
+	if _, ok := s.rows[pk]; !ok {
+		s.keys = append(s.keys, pk)
+	}
+	s.rows[pk] = row
+}
+
+// values returns the header and rows to write to the tab.
+func (s *sheet) values() [][]any {
+	values := make([][]any, 0, len(s.keys)+1)
+	header := make([]any, len(s.columns))
+	for i, c := range s.columns {
+		header[i] = c
+	}
+	values = append(values, header)
+	for _, pk := range s.keys {
+		values = append(values, s.rows[pk])
+	}
+	return values
+}
+
+// quoteTitle returns the title quoted for use in A1 notation.
+func quoteTitle(title string) string {
+	return "'" + strings.ReplaceAll(title, "'", "''") + "'"
+}
+
+// columnName returns the A1 column name for the 1-based column number.
+func columnName(n int) string {
+	var name string
+	for n > 0 {
+		n--
+		name = string(rune('A'+n%26)) + name
+		n /= 26
+	}
+	return name
+}
+
+// clearRanges returns the ranges left over from the previous write which must be cleared.
+func (s *sheet) clearRanges(rows int, columns int) []string {
+	var ranges []string
+	if s.written > rows {
+		ranges = append(ranges, fmt.Sprintf("%s!A%d:%s", quoteTitle(s.title), rows+1, columnName(max(s.wrote, columns))))
+	}
+	if s.wrote > columns && rows > 0 {
+		ranges = append(ranges, fmt.Sprintf("%s!%s1:%s%d", quoteTitle(s.title), columnName(columns+1), columnName(s.wrote), rows))
+	}
+	return ranges
+}
@@ -0,0 +1,591 @@
+package iceberg
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// The manifests, manifest lists and files written by the driver use the Avro object container format. This is a
+// minimal implementation of the parts of the spec which Iceberg uses.
+
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+type avroSchema struct {
+	Type     string
+	Name     string
+	Fields   []avroField
+	Items    *avroSchema
+	Values   *avroSchema
+	Branches []*avroSchema
+	Symbols  []string
+	Size     int
+}
+
+type avroField struct {
+	Name   string
+	Schema *avroSchema
+}
+
+// parseAvroSchema parses the JSON representation of a schema. Named types may be referenced after they are defined.
+func parseAvroSchema(val any, names map[string]*avroSchema) (*avroSchema, error) {
+	switch v := val.(type) {
+	case string:
+		switch v {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroSchema{Type: v}, nil
+		}
+		if named, ok := names[v]; ok {
+			return named, nil
+		}
+		return nil, fmt.Errorf("unknown avro type: %s", v)
+	case []any:
+		schema := &avroSchema{Type: "union"}
+		for _, branch := range v {
+			s, err := parseAvroSchema(branch, names)
+			if err != nil {
+				return nil, err
+			}
+			schema.Branches = append(schema.Branches, s)
+		}
+		return schema, nil
+	case map[string]any:
+		typ, _ := v["type"].(string)
+		name, _ := v["name"].(string)
+		switch typ {
+		case "record", "error":
+			schema := &avroSchema{Type: "record", Name: name}
+			if name != "" {
+				names[name] = schema
+			}
+			fields, _ := v["fields"].([]any)
+			for _, f := range fields {
+				field, ok := f.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("invalid avro field in record %s", name)
+				}
+				fs, err := parseAvroSchema(field["type"], names)
+				if err != nil {
+					return nil, err
+				}
+				fname, _ := field["name"].(string)
+				schema.Fields = append(schema.Fields, avroField{Name: fname, Schema: fs})
+			}
+			return schema, nil
+		case "array":
+			items, err := parseAvroSchema(v["items"], names)
+			if err != nil {
+				return nil, err
+			}
+			return &avroSchema{Type: "array", Items: items}, nil
+		case "map":
+			values, err := parseAvroSchema(v["values"], names)
+			if err != nil {
+				return nil, err
+			}
+			return &avroSchema{Type: "map", Values: values}, nil
+		case "enum":
+			schema := &avroSchema{Type: "enum", Name: name}
+			symbols, _ := v["symbols"].([]any)
+			for _, s := range symbols {
+				str, _ := s.(string)
+				schema.Symbols = append(schema.Symbols, str)
+			}
+			if name != "" {
+				names[name] = schema
+			}
+			return schema, nil
+		case "fixed":
+			size, _ := v["size"].(float64)
+			schema := &avroSchema{Type: "fixed", Name: name, Size: int(size)}
+			if name != "" {
+				names[name] = schema
+			}
+			return schema, nil
+		default:
+			// a primitive with attributes such as a logical type
+			return parseAvroSchema(typ, names)
+		}
+	}
+	return nil, fmt.Errorf("invalid avro schema: %v", val)
+}
+
+func writeLong(buf *bytes.Buffer, val int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], val)
+	buf.Write(tmp[:n])
+}
+
+func writeBytes(buf *bytes.Buffer, val []byte) {
+	writeLong(buf, int64(len(val)))
+	buf.Write(val)
+}
+
+func toInt64(val any) (int64, bool) {
+	switch v := val.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), v == math.Trunc(v)
+	}
+	return 0, false
+}
+
+// matches returns true if the value can be encoded with the schema. It's used to pick the branch of a union.
+func (s *avroSchema) matches(val any) bool {
+	switch s.Type {
+	case "null":
+		return val == nil
+	case "boolean":
+		_, ok := val.(bool)
+		return ok
+	case "int", "long":
+		_, ok := toInt64(val)
+		return ok
+	case "float", "double":
+		switch val.(type) {
+		case float32, float64:
+			return true
+		}
+		_, ok := toInt64(val)
+		return ok
+	case "bytes", "fixed":
+		_, ok := val.([]byte)
+		return ok
+	case "string", "enum":
+		_, ok := val.(string)
+		return ok
+	case "record", "map":
+		_, ok := val.(map[string]any)
+		return ok
+	case "array":
+		_, ok := val.([]any)
+		return ok
+	}
+	return false
+}
+
+func (s *avroSchema) encode(buf *bytes.Buffer, val any) error {
+	switch s.Type {
+	case "null":
+		if val != nil {
+			return fmt.Errorf("expected null but was %T", val)
+		}
+	case "boolean":
+		b, ok := val.(bool)
+		if !ok {
+			return fmt.Errorf("expected boolean but was %T", val)
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "int", "long":
+		v, ok := toInt64(val)
+		if !ok {
+			return fmt.Errorf("expected %s but was %T", s.Type, val)
+		}
+		writeLong(buf, v)
+	case "float", "double":
+		var f float64
+		switch v := val.(type) {
+		case float32:
+			f = float64(v)
+		case float64:
+			f = v
+		default:
+			iv, ok := toInt64(val)
+			if !ok {
+				return fmt.Errorf("expected %s but was %T", s.Type, val)
+			}
+			f = float64(iv)
+		}
+		if s.Type == "float" {
+			binary.Write(buf, binary.LittleEndian, float32(f))
+		} else {
+			binary.Write(buf, binary.LittleEndian, f)
+		}
+	case "bytes":
+		b, ok := val.([]byte)
+		if !ok {
+			return fmt.Errorf("expected bytes but was %T", val)
+		}
+		writeBytes(buf, b)
+	case "fixed":
+		b, ok := val.([]byte)
+		if !ok || len(b) != s.Size {
+			return fmt.Errorf("expected fixed(%d) but was %T", s.Size, val)
+		}
+		buf.Write(b)
+	case "string":
+		str, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("expected string but was %T", val)
+		}
+		writeBytes(buf, []byte(str))
+	case "enum":
+		str, _ := val.(string)
+		for i, symbol := range s.Symbols {
+			if symbol == str {
+				writeLong(buf, int64(i))
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid symbol %v for enum %s", val, s.Name)
+	case "record":
+		record, ok := val.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected record %s but was %T", s.Name, val)
+		}
+		for _, field := range s.Fields {
+			if err := field.Schema.encode(buf, record[field.Name]); err != nil {
+				return fmt.Errorf("%s.%s: %w", s.Name, field.Name, err)
+			}
+		}
+	case "array":
+		items, ok := val.([]any)
+		if !ok {
+			return fmt.Errorf("expected array but was %T", val)
+		}
+		if len(items) > 0 {
+			writeLong(buf, int64(len(items)))
+			for _, item := range items {
+				if err := s.Items.encode(buf, item); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buf, 0)
+	case "map":
+		values, ok := val.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected map but was %T", val)
+		}
+		if len(values) > 0 {
+			writeLong(buf, int64(len(values)))
+			for k, v := range values {
+				writeBytes(buf, []byte(k))
+				if err := s.Values.encode(buf, v); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buf, 0)
+	case "union":
+		for i, branch := range s.Branches {
+			if branch.matches(val) {
+				writeLong(buf, int64(i))
+				return branch.encode(buf, val)
+			}
+		}
+		return fmt.Errorf("no union branch matches %T", val)
+	default:
+		return fmt.Errorf("unsupported avro type: %s", s.Type)
+	}
+	return nil
+}
+
+type avroDecoder struct {
+	r *bytes.Reader
+}
+
+func (d *avroDecoder) long() (int64, error) {
+	return binary.ReadVarint(d.r)
+}
+
+func (d *avroDecoder) bytes() ([]byte, error) {
+	n, err := d.long()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > int64(d.r.Len()) {
+		return nil, fmt.Errorf("invalid avro length: %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// blockCount reads the count of an array or map block. A negative count is followed by the size of the block in bytes.
+func (d *avroDecoder) blockCount() (int64, error) {
+	n, err := d.long()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		if _, err := d.long(); err != nil {
+			return 0, err
+		}
+		n = -n
+	}
+	return n, nil
+}
+
+func (d *avroDecoder) decode(s *avroSchema) (any, error) {
+	switch s.Type {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := d.r.ReadByte()
+		return b == 1, err
+	case "int":
+		v, err := d.long()
+		return int32(v), err
+	case "long":
+		return d.long()
+	case "float":
+		var f float32
+		err := binary.Read(d.r, binary.LittleEndian, &f)
+		return f, err
+	case "double":
+		var f float64
+		err := binary.Read(d.r, binary.LittleEndian, &f)
+		return f, err
+	case "bytes":
+		return d.bytes()
+	case "fixed":
+		buf := make([]byte, s.Size)
+		_, err := io.ReadFull(d.r, buf)
+		return buf, err
+	case "string":
+		buf, err := d.bytes()
+		return string(buf), err
+	case "enum":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(s.Symbols) {
+			return nil, fmt.Errorf("invalid enum index %d for %s", i, s.Name)
+		}
+		return s.Symbols[i], nil
+	case "record":
+		record := make(map[string]any, len(s.Fields))
+		for _, field := range s.Fields {
+			val, err := d.decode(field.Schema)
+			if err != nil {
+				return nil, err
+			}
+			record[field.Name] = val
+		}
+		return record, nil
+	case "array":
+		items := []any{}
+		for {
+			n, err := d.blockCount()
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return items, nil
+			}
+			for i := int64(0); i < n; i++ {
+				item, err := d.decode(s.Items)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+		}
+	case "map":
+		values := make(map[string]any)
+		for {
+			n, err := d.blockCount()
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return values, nil
+			}
+			for i := int64(0); i < n; i++ {
+				key, err := d.bytes()
+				if err != nil {
+					return nil, err
+				}
+				val, err := d.decode(s.Values)
+				if err != nil {
+					return nil, err
+				}
+				values[string(key)] = val
+			}
+		}
+	case "union":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(s.Branches) {
+			return nil, fmt.Errorf("invalid union index %d", i)
+		}
+		return d.decode(s.Branches[i])
+	}
+	return nil, fmt.Errorf("unsupported avro type: %s", s.Type)
+}
+
+// avroWriter writes records to an uncompressed Avro object container file in memory.
+type avroWriter struct {
+	schema *avroSchema
+	buf    bytes.Buffer
+	block  bytes.Buffer
+	count  int
+	sync   [16]byte
+}
+
+// newAvroWriter returns a writer for the schema which is the JSON representation of the record schema. The metadata
+// is added to the file header.
+func newAvroWriter(schema any, metadata map[string]string) (*avroWriter, error) {
+	buf, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	var parsed any
+	if err := json.Unmarshal(buf, &parsed); err != nil {
+		return nil, err
+	}
+	s, err := parseAvroSchema(parsed, make(map[string]*avroSchema))
+	if err != nil {
+		return nil, err
+	}
+	w := &avroWriter{schema: s}
+	if _, err := rand.Read(w.sync[:]); err != nil {
+		return nil, err
+	}
+	w.buf.Write(avroMagic)
+	writeLong(&w.buf, int64(len(metadata)+2))
+	writeBytes(&w.buf, []byte("avro.schema"))
+	writeBytes(&w.buf, buf)
+	writeBytes(&w.buf, []byte("avro.codec"))
+	writeBytes(&w.buf, []byte("null"))
+	for k, v := range metadata {
+		writeBytes(&w.buf, []byte(k))
+		writeBytes(&w.buf, []byte(v))
+	}
+	writeLong(&w.buf, 0)
+	w.buf.Write(w.sync[:])
+	return w, nil
+}
+
+// Append encodes the record to the current block.
+func (w *avroWriter) Append(record map[string]any) error {
+	if err := w.schema.encode(&w.block, record); err != nil {
+		return err
+	}
+	w.count++
+	return nil
+}
+
+// Count returns the number of records written.
+func (w *avroWriter) Count() int {
+	return w.count
+}
+
+// Bytes returns the encoded file. No more records should be appended.
+func (w *avroWriter) Bytes() []byte {
+	if w.count > 0 {
+		writeLong(&w.buf, int64(w.count))
+		writeBytes(&w.buf, w.block.Bytes())
+		w.buf.Write(w.sync[:])
+		w.block.Reset()
+	}
+	return w.buf.Bytes()
+}
+
+// readAvroFile decodes all the records in an Avro object container file and returns them with the file metadata.
+func readAvroFile(data []byte) (map[string]string, []map[string]any, error) {
+	if !bytes.HasPrefix(data, avroMagic) {
+		return nil, nil, fmt.Errorf("not an avro file")
+	}
+	header := &avroDecoder{r: bytes.NewReader(data[len(avroMagic):])}
+	meta, err := header.decode(&avroSchema{Type: "map", Values: &avroSchema{Type: "bytes"}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading avro header: %w", err)
+	}
+	metadata := make(map[string]string)
+	for k, v := range meta.(map[string]any) {
+		metadata[k] = string(v.([]byte))
+	}
+	var sync [16]byte
+	if _, err := io.ReadFull(header.r, sync[:]); err != nil {
+		return nil, nil, fmt.Errorf("error reading avro header: %w", err)
+	}
+	var parsed any
+	if err := json.Unmarshal([]byte(metadata["avro.schema"]), &parsed); err != nil {
+		return nil, nil, fmt.Errorf("error parsing avro schema: %w", err)
+	}
+	schema, err := parseAvroSchema(parsed, make(map[string]*avroSchema))
+	if err != nil {
+		return nil, nil, err
+	}
+	var records []map[string]any
+	for header.r.Len() > 0 {
+		count, err := header.long()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading avro block: %w", err)
+		}
+		block, err := header.bytes()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading avro block: %w", err)
+		}
+		if block, err = decompressBlock(metadata["avro.codec"], block); err != nil {
+			return nil, nil, err
+		}
+		var marker [16]byte
+		if _, err := io.ReadFull(header.r, marker[:]); err != nil || marker != sync {
+			return nil, nil, fmt.Errorf("invalid avro sync marker")
+		}
+		d := &avroDecoder{r: bytes.NewReader(block)}
+		for i := int64(0); i < count; i++ {
+			val, err := d.decode(schema)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error decoding avro record: %w", err)
+			}
+			record, ok := val.(map[string]any)
+			if !ok {
+				return nil, nil, fmt.Errorf("expected avro record but was %T", val)
+			}
+			records = append(records, record)
+		}
+	}
+	return metadata, records, nil
+}
+
+func decompressBlock(codec string, block []byte) ([]byte, error) {
+	switch codec {
+	case "", "null":
+		return block, nil
+	case "deflate":
+		buf, err := io.ReadAll(flate.NewReader(bytes.NewReader(block)))
+		if err != nil {
+			return nil, fmt.Errorf("error inflating avro block: %w", err)
+		}
+		return buf, nil
+	case "snappy":
+		if len(block) < 4 {
+			return nil, fmt.Errorf("invalid snappy avro block")
+		}
+		buf, err := snappy.Decode(nil, block[:len(block)-4])
+		if err != nil {
+			return nil, fmt.Errorf("error decoding snappy avro block: %w", err)
+		}
+		if crc32.ChecksumIEEE(buf) != binary.BigEndian.Uint32(block[len(block)-4:]) {
+			return nil, fmt.Errorf("invalid snappy avro block checksum")
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unsupported avro codec: %s", codec)
+}
@@ -0,0 +1,125 @@
+package iceberg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fileIO reads and writes the files of a table at the locations from the table metadata.
+type fileIO interface {
+	Read(ctx context.Context, location string) ([]byte, error)
+	Write(ctx context.Context, location string, data []byte) error
+}
+
+// newFileIO returns the file io for the table location. The table config from the catalog may contain vended
+// credentials for the object store, otherwise the default AWS credentials are used.
+func newFileIO(ctx context.Context, location string, tableConfig map[string]string, region string) (fileIO, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid table location: %s. %w", location, err)
+	}
+	switch u.Scheme {
+	case "", "file":
+		return localIO{}, nil
+	case "s3", "s3a", "s3n":
+		return newS3IO(ctx, tableConfig, region)
+	}
+	return nil, fmt.Errorf("unsupported table location: %s", location)
+}
+
+type localIO struct{}
+
+func localPath(location string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(location, "file://"), "file:")
+}
+
+func (localIO) Read(ctx context.Context, location string) ([]byte, error) {
+	return os.ReadFile(localPath(location))
+}
+
+func (localIO) Write(ctx context.Context, location string, data []byte) error {
+	fn := localPath(location)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(fn, data, 0644)
+}
+
+type s3IO struct {
+	client *awss3.Client
+}
+
+func newS3IO(ctx context.Context, tableConfig map[string]string, region string) (*s3IO, error) {
+	if val := tableConfig["s3.region"]; val != "" {
+		region = val
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	opts := []func(*config.LoadOptions) error{}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if key := tableConfig["s3.access-key-id"]; key != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(key, tableConfig["s3.secret-access-key"], tableConfig["s3.session-token"])))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+	client := awss3.NewFromConfig(cfg, func(o *awss3.Options) {
+		if endpoint := tableConfig["s3.endpoint"]; endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = tableConfig["s3.path-style-access"] == "true"
+	})
+	return &s3IO{client: client}, nil
+}
+
+func splitS3Location(location string) (string, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+func (s *s3IO) Read(ctx context.Context, location string) ([]byte, error) {
+	bucket, key, err := splitS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", location, err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3IO) Write(ctx context.Context, location string, data []byte) error {
+	bucket, key, err := splitS3Location(location)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	}); err != nil {
+		return fmt.Errorf("error writing %s: %w", location, err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package iceberg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	contentData           = 0
+	contentEqualityDelete = 2
+
+	manifestContentData    = 0
+	manifestContentDeletes = 1
+
+	entryStatusAdded = 1
+)
+
+// manifestEntrySchema is the v2 manifest_entry schema. The optional column metrics are omitted and the snapshot id and
+// sequence numbers are null so they are inherited from the manifest list when the snapshot is committed.
+var manifestEntrySchema = map[string]any{
+	"type": "record",
+	"name": "manifest_entry",
+	"fields": []any{
+		map[string]any{"name": "status", "type": "int", "field-id": 0},
+		map[string]any{"name": "snapshot_id", "type": []any{"null", "long"}, "default": nil, "field-id": 1},
+		map[string]any{"name": "sequence_number", "type": []any{"null", "long"}, "default": nil, "field-id": 3},
+		map[string]any{"name": "file_sequence_number", "type": []any{"null", "long"}, "default": nil, "field-id": 4},
+		map[string]any{"name": "data_file", "field-id": 2, "type": map[string]any{
+			"type": "record",
+			"name": "r2",
+			"fields": []any{
+				map[string]any{"name": "content", "type": "int", "field-id": 134},
+				map[string]any{"name": "file_path", "type": "string", "field-id": 100},
+				map[string]any{"name": "file_format", "type": "string", "field-id": 101},
+				map[string]any{"name": "partition", "type": map[string]any{"type": "record", "name": "r102", "fields": []any{}}, "field-id": 102},
+				map[string]any{"name": "record_count", "type": "long", "field-id": 103},
+				map[string]any{"name": "file_size_in_bytes", "type": "long", "field-id": 104},
+				map[string]any{"name": "equality_ids", "type": []any{"null", map[string]any{"type": "array", "items": "int", "element-id": 136}}, "default": nil, "field-id": 135},
+			},
+		}},
+	},
+}
+
+// manifestFileSchema is the v2 manifest_file schema used for the manifest list. Partition summaries are omitted since
+// the tables are unpartitioned.
+var manifestFileSchema = map[string]any{
+	"type": "record",
+	"name": "manifest_file",
+	"fields": []any{
+		map[string]any{"name": "manifest_path", "type": "string", "field-id": 500},
+		map[string]any{"name": "manifest_length", "type": "long", "field-id": 501},
+		map[string]any{"name": "partition_spec_id", "type": "int", "field-id": 502},
+		map[string]any{"name": "content", "type": "int", "field-id": 517},
+		map[string]any{"name": "sequence_number", "type": "long", "field-id": 515},
+		map[string]any{"name": "min_sequence_number", "type": "long", "field-id": 516},
+		map[string]any{"name": "added_snapshot_id", "type": "long", "field-id": 503},
+		map[string]any{"name": "added_files_count", "type": "int", "field-id": 504},
+		map[string]any{"name": "existing_files_count", "type": "int", "field-id": 505},
+		map[string]any{"name": "deleted_files_count", "type": "int", "field-id": 506},
+		map[string]any{"name": "added_rows_count", "type": "long", "field-id": 512},
+		map[string]any{"name": "existing_rows_count", "type": "long", "field-id": 513},
+		map[string]any{"name": "deleted_rows_count", "type": "long", "field-id": 514},
+	},
+}
+
+// dataFile is a data or delete file which has been written to the table location.
+type dataFile struct {
+	content     int
+	path        string
+	count       int
+	size        int
+	equalityIDs []int
+}
+
+// writeManifest writes a manifest with the added files and returns its manifest list entry without the sequence
+// numbers and snapshot id which are set when the snapshot is committed.
+func writeManifest(ctx context.Context, io fileIO, location string, schema *icebergSchema, content int, files []dataFile) (map[string]any, error) {
+	contentName := "data"
+	if content == manifestContentDeletes {
+		contentName = "deletes"
+	}
+	w, err := newAvroWriter(manifestEntrySchema, map[string]string{
+		"schema":            util.JSONStringify(schema),
+		"schema-id":         strconv.Itoa(schema.SchemaID),
+		"partition-spec":    "[]",
+		"partition-spec-id": "0",
+		"format-version":    "2",
+		"content":           contentName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows int64
+	for _, file := range files {
+		var equalityIDs any
+		if len(file.equalityIDs) > 0 {
+			var ids []any
+			for _, id := range file.equalityIDs {
+				ids = append(ids, id)
+			}
+			equalityIDs = ids
+		}
+		if err := w.Append(map[string]any{
+			"status": entryStatusAdded,
+			"data_file": map[string]any{
+				"content":            file.content,
+				"file_path":          file.path,
+				"file_format":        "AVRO",
+				"partition":          map[string]any{},
+				"record_count":       file.count,
+				"file_size_in_bytes": file.size,
+				"equality_ids":       equalityIDs,
+			},
+		}); err != nil {
+			return nil, fmt.Errorf("error writing manifest entry: %w", err)
+		}
+		rows += int64(file.count)
+	}
+	buf := w.Bytes()
+	if err := io.Write(ctx, location, buf); err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"manifest_path":        location,
+		"manifest_length":      len(buf),
+		"partition_spec_id":    0,
+		"content":              content,
+		"added_files_count":    len(files),
+		"existing_files_count": 0,
+		"deleted_files_count":  0,
+		"added_rows_count":     rows,
+		"existing_rows_count":  0,
+		"deleted_rows_count":   0,
+	}, nil
+}
+
+// readManifestList returns the manifest list entries of the snapshot.
+func readManifestList(ctx context.Context, io fileIO, location string) ([]map[string]any, error) {
+	buf, err := io.Read(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	_, records, err := readAvroFile(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest list %s: %w", location, err)
+	}
+	for _, record := range records {
+		// manifests from before the table was upgraded to v2 use the v1 names for the counts
+		for name, v1 := range map[string]string{"added_files_count": "added_data_files_count", "existing_files_count": "existing_data_files_count", "deleted_files_count": "deleted_data_files_count"} {
+			if _, ok := record[name]; !ok {
+				record[name] = record[v1]
+			}
+		}
+		if _, ok := record["content"]; !ok {
+			record["content"] = manifestContentData
+		}
+		for _, name := range []string{"sequence_number", "min_sequence_number", "added_files_count", "existing_files_count", "deleted_files_count", "added_rows_count", "existing_rows_count", "deleted_rows_count"} {
+			if record[name] == nil {
+				record[name] = int64(0)
+			}
+		}
+	}
+	return records, nil
+}
+
+// writeManifestList writes the manifest list for a new snapshot with the added manifests followed by the manifests of
+// the parent snapshot.
+func writeManifestList(ctx context.Context, io fileIO, location string, snapshotID int64, parentID *int64, sequenceNumber int64, added []map[string]any, existing []map[string]any) error {
+	metadata := map[string]string{
+		"snapshot-id":     strconv.FormatInt(snapshotID, 10),
+		"sequence-number": strconv.FormatInt(sequenceNumber, 10),
+		"format-version":  "2",
+	}
+	if parentID != nil {
+		metadata["parent-snapshot-id"] = strconv.FormatInt(*parentID, 10)
+	}
+	w, err := newAvroWriter(manifestFileSchema, metadata)
+	if err != nil {
+		return err
+	}
+	for _, manifest := range added {
+		manifest["sequence_number"] = sequenceNumber
+		manifest["min_sequence_number"] = sequenceNumber
+		manifest["added_snapshot_id"] = snapshotID
+		if err := w.Append(manifest); err != nil {
+			return fmt.Errorf("error writing manifest list entry: %w", err)
+		}
+	}
+	for _, manifest := range existing {
+		if err := w.Append(manifest); err != nil {
+			return fmt.Errorf("error copying manifest list entry: %w", err)
+		}
+	}
+	return io.Write(ctx, location, w.Bytes())
+}
@@ -0,0 +1,282 @@
+package iceberg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+type icebergField struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Type     any    `json:"type"`
+}
+
+type icebergSchema struct {
+	Type               string         `json:"type"`
+	SchemaID           int            `json:"schema-id"`
+	IdentifierFieldIDs []int          `json:"identifier-field-ids,omitempty"`
+	Fields             []icebergField `json:"fields"`
+}
+
+// field returns the field with the name or nil if it isn't in the schema.
+func (s *icebergSchema) field(name string) *icebergField {
+	for i := range s.Fields {
+		if s.Fields[i].Name == name {
+			return &s.Fields[i]
+		}
+	}
+	return nil
+}
+
+type partitionSpec struct {
+	SpecID int   `json:"spec-id"`
+	Fields []any `json:"fields"`
+}
+
+type snapshot struct {
+	SnapshotID       int64             `json:"snapshot-id"`
+	ParentSnapshotID *int64            `json:"parent-snapshot-id,omitempty"`
+	SequenceNumber   int64             `json:"sequence-number"`
+	TimestampMs      int64             `json:"timestamp-ms"`
+	ManifestList     string            `json:"manifest-list"`
+	Summary          map[string]string `json:"summary"`
+	SchemaID         *int              `json:"schema-id,omitempty"`
+}
+
+type snapshotRef struct {
+	SnapshotID int64  `json:"snapshot-id"`
+	Type       string `json:"type"`
+}
+
+type tableMetadata struct {
+	FormatVersion      int                    `json:"format-version"`
+	TableUUID          string                 `json:"table-uuid"`
+	Location           string                 `json:"location"`
+	LastSequenceNumber int64                  `json:"last-sequence-number"`
+	LastColumnID       int                    `json:"last-column-id"`
+	CurrentSchemaID    int                    `json:"current-schema-id"`
+	Schemas            []icebergSchema        `json:"schemas"`
+	DefaultSpecID      int                    `json:"default-spec-id"`
+	PartitionSpecs     []partitionSpec        `json:"partition-specs"`
+	CurrentSnapshotID  *int64                 `json:"current-snapshot-id"`
+	Snapshots          []snapshot             `json:"snapshots"`
+	Refs               map[string]snapshotRef `json:"refs"`
+}
+
+// currentSchema returns the current schema of the table.
+func (m *tableMetadata) currentSchema() (*icebergSchema, error) {
+	for i := range m.Schemas {
+		if m.Schemas[i].SchemaID == m.CurrentSchemaID {
+			return &m.Schemas[i], nil
+		}
+	}
+	return nil, fmt.Errorf("current schema %d not found in table metadata", m.CurrentSchemaID)
+}
+
+// currentSnapshot returns the snapshot at the head of the main branch or nil if the table is empty.
+func (m *tableMetadata) currentSnapshot() *snapshot {
+	id := int64(-1)
+	if ref, ok := m.Refs["main"]; ok {
+		id = ref.SnapshotID
+	} else if m.CurrentSnapshotID != nil {
+		id = *m.CurrentSnapshotID
+	}
+	for i := range m.Snapshots {
+		if m.Snapshots[i].SnapshotID == id {
+			return &m.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// validate checks the table supports row-level deletes and is unpartitioned which is how the driver creates tables.
+func (m *tableMetadata) validate() error {
+	if m.FormatVersion < 2 {
+		return fmt.Errorf("table format version %d is not supported, equality deletes require format version 2", m.FormatVersion)
+	}
+	for _, spec := range m.PartitionSpecs {
+		if spec.SpecID == m.DefaultSpecID && len(spec.Fields) > 0 {
+			return fmt.Errorf("partitioned tables are not supported")
+		}
+	}
+	return nil
+}
+
+// icebergType returns the iceberg type for the property. Objects and arrays are stored as JSON strings.
+func icebergType(prop internal.SchemaProperty) string {
+	switch prop.Type {
+	case "integer":
+		return "long"
+	case "number":
+		return "double"
+	case "boolean":
+		return "boolean"
+	case "string":
+		if prop.IsBinary() {
+			return "binary"
+		}
+		if prop.Format == "date-time" {
+			return "timestamptz"
+		}
+	}
+	return "string"
+}
+
+// newIcebergSchema returns the iceberg schema for the table. The primary keys are the identifier fields which are used
+// for the equality deletes.
+func newIcebergSchema(schema *internal.Schema) icebergSchema {
+	result := icebergSchema{Type: "struct"}
+	for i, name := range schema.Columns() {
+		pk := util.SliceContains(schema.PrimaryKeys, name)
+		result.Fields = append(result.Fields, icebergField{
+			ID:       i + 1,
+			Name:     name,
+			Required: pk,
+			Type:     icebergType(schema.Properties[name]),
+		})
+		if pk {
+			result.IdentifierFieldIDs = append(result.IdentifierFieldIDs, i+1)
+		}
+	}
+	return result
+}
+
+// addColumnsSchema returns a new schema from the current schema with the columns added as optional fields.
+func addColumnsSchema(current *icebergSchema, lastColumnID int, schema *internal.Schema, columns []string) (icebergSchema, int) {
+	result := icebergSchema{
+		Type:               "struct",
+		SchemaID:           current.SchemaID + 1,
+		IdentifierFieldIDs: current.IdentifierFieldIDs,
+		Fields:             append([]icebergField{}, current.Fields...),
+	}
+	for _, name := range columns {
+		if current.field(name) != nil {
+			continue
+		}
+		lastColumnID++
+		result.Fields = append(result.Fields, icebergField{
+			ID:   lastColumnID,
+			Name: name,
+			Type: icebergType(schema.Properties[name]),
+		})
+	}
+	return result, lastColumnID
+}
+
+// avroName returns a valid avro name for the field. Invalid characters are replaced in the same way as the Java
+// implementation. Readers match the fields by id so this only needs to be valid.
+func avroName(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		valid := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')
+		if valid {
+			sb.WriteRune(r)
+		} else if r >= '0' && r <= '9' {
+			sb.WriteString("_" + string(r))
+		} else {
+			sb.WriteString(fmt.Sprintf("_x%X", r))
+		}
+	}
+	return sb.String()
+}
+
+func avroType(typ any) any {
+	switch typ {
+	case "long":
+		return "long"
+	case "double":
+		return "double"
+	case "boolean":
+		return "boolean"
+	case "binary":
+		return "bytes"
+	case "timestamptz":
+		return map[string]any{"type": "long", "logicalType": "timestamp-micros", "adjust-to-utc": true}
+	case "timestamp":
+		return map[string]any{"type": "long", "logicalType": "timestamp-micros", "adjust-to-utc": false}
+	}
+	return "string"
+}
+
+// avroRecordSchema returns the avro schema for writing the fields to a data or delete file.
+func avroRecordSchema(fields []icebergField) map[string]any {
+	var avroFields []map[string]any
+	for _, field := range fields {
+		f := map[string]any{
+			"name":     avroName(field.Name),
+			"field-id": field.ID,
+			"type":     avroType(field.Type),
+		}
+		if !field.Required {
+			f["type"] = []any{"null", f["type"]}
+			f["default"] = nil
+		}
+		avroFields = append(avroFields, f)
+	}
+	return map[string]any{"type": "record", "name": "table", "fields": avroFields}
+}
+
+// toIcebergValue converts the value from the JSON of the event to the value for the iceberg type.
+func toIcebergValue(typ any, val any) (any, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch typ {
+	case "long":
+		if v, ok := val.(float64); ok {
+			return int64(v), nil
+		}
+	case "double":
+		if v, ok := val.(float64); ok {
+			return v, nil
+		}
+	case "boolean":
+		if v, ok := val.(bool); ok {
+			return v, nil
+		}
+	case "binary":
+		if v, ok := val.(string); ok {
+			return util.DecodeBytes(v)
+		}
+	case "timestamptz", "timestamp":
+		if v, ok := val.(string); ok {
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp: %w", err)
+			}
+			return ts.UnixMicro(), nil
+		}
+	case "string":
+		if v, ok := val.(string); ok {
+			return v, nil
+		}
+		buf, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf), nil
+	}
+	return nil, fmt.Errorf("unable to convert %T to %v", val, typ)
+}
+
+// toAvroRecord returns the avro record for the fields from the object.
+func toAvroRecord(fields []icebergField, object map[string]any) (map[string]any, error) {
+	record := make(map[string]any, len(fields))
+	for _, field := range fields {
+		val, err := toIcebergValue(field.Type, object[field.Name])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", field.Name, err)
+		}
+		if val == nil && field.Required {
+			return nil, fmt.Errorf("column %s is required", field.Name)
+		}
+		record[avroName(field.Name)] = val
+	}
+	return record, nil
+}
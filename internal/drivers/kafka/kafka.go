@@ -44,6 +44,7 @@ type kafkaDriver struct {
 	waitGroup    sync.WaitGroup
 	once         sync.Once
 	importConfig internal.ImporterConfig
+	templates    util.PayloadTemplates
 }
 
 var _ internal.Driver = (*kafkaDriver)(nil)
@@ -51,9 +52,14 @@ var _ internal.DriverLifecycle = (*kafkaDriver)(nil)
 var _ internal.DriverHelp = (*kafkaDriver)(nil)
 var _ internal.Importer = (*kafkaDriver)(nil)
 var _ internal.ImporterHelp = (*kafkaDriver)(nil)
-var _ importer.Handler = (*kafkaDriver)(nil)
+var _ importer.BatchHandler = (*kafkaDriver)(nil)
 
 func (p *kafkaDriver) connect(urlString string) error {
+	urlString, templates, err := util.ParsePayloadTemplates(urlString)
+	if err != nil {
+		return err
+	}
+	p.templates = templates
 	u, err := url.Parse(urlString)
 	if err != nil {
 		return fmt.Errorf("unable to parse url: %w", err)
@@ -124,16 +130,26 @@ func (p *kafkaDriver) process(event internal.DBChangeEvent, dryRun bool) error {
 	key := fmt.Sprintf("dbchange.%s.%s.%s.%s.%s", event.Table, event.Operation, strWithDef(event.CompanyID, "NONE"), strWithDef(event.LocationID, "NONE"), event.ID)
 	pk := event.GetPrimaryKey()
 	partitionkey := fmt.Sprintf("%s.%s.%s.%s", event.Table, strWithDef(event.CompanyID, "NONE"), strWithDef(event.LocationID, "NONE"), pk)
+	value, err := p.templates.Render(&event)
+	if err != nil {
+		return err
+	}
 	if dryRun {
 		p.logger.Trace("would store key: %s, partition key: %s", key, partitionkey)
 		return nil
 	} else {
+		headers := []gokafka.Header{
+			{Key: edsPartitionKeyHeader, Value: []byte(partitionkey)},
+		}
+		if event.Lineage != nil {
+			for k, v := range event.Lineage.Headers() {
+				headers = append(headers, gokafka.Header{Key: k, Value: []byte(v)})
+			}
+		}
 		p.pending = append(p.pending, gokafka.Message{
-			Key:   []byte(key),
-			Value: []byte(util.JSONStringify(event)),
-			Headers: []gokafka.Header{
-				{Key: edsPartitionKeyHeader, Value: []byte(partitionkey)},
-			},
+			Key:     []byte(key),
+			Value:   value,
+			Headers: headers,
 		})
 	}
 	if len(p.pending) >= maxImportBatchSize {
@@ -198,6 +214,8 @@ func (p *kafkaDriver) Help() string {
 	help.WriteString(util.GenerateHelpSection("Message Key", "The message key is computed in the format: dbchange.[TABLE].[OPERATION].[COMPANY_ID].[LOCATION_ID].[MESSAGE_ID].\n"))
 	help.WriteString("\n")
 	help.WriteString(util.GenerateHelpSection("Message Value", "The message value is a JSON encoded value of the EDS DBChange event."))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Payload Templates", util.PayloadTemplatesHelp))
 	return help.String()
 }
 
@@ -211,6 +229,16 @@ func (p *kafkaDriver) ImportEvent(event internal.DBChangeEvent, schema *internal
 	return p.process(event, p.importConfig.DryRun)
 }
 
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *kafkaDriver) ImportBatchLimits() (int, int) {
+	return maxImportBatchSize, 0
+}
+
+// FlushBatch writes the pending messages.
+func (p *kafkaDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
 // ImportCompleted is called when all events have been processed.
 func (p *kafkaDriver) ImportCompleted() error {
 	if err := p.Flush(p.logger); err != nil {
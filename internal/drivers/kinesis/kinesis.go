@@ -0,0 +1,391 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awskinesis "github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/importer"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	maxRecordsPerRequest = 500             // the PutRecords limit for the number of records in a request
+	maxBytesPerRequest   = 5 * 1024 * 1024 // the PutRecords limit for the size of a request
+	maxBytesPerRecord    = 1024 * 1024     // the limit for the size of a record including the partition key
+	maxPartitionKeyLen   = 256             // the limit for the number of unicode characters in a partition key
+	defaultMaxBatchSize  = maxRecordsPerRequest
+)
+
+// ErrThrottled is returned by Flush when records were rejected because the stream exceeded its provisioned throughput.
+var ErrThrottled = errors.New("kinesis stream throughput exceeded")
+
+// kinesisClient is the part of the kinesis client used by the driver.
+type kinesisClient interface {
+	PutRecords(ctx context.Context, params *awskinesis.PutRecordsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.PutRecordsOutput, error)
+	DescribeStreamSummary(ctx context.Context, params *awskinesis.DescribeStreamSummaryInput, optFns ...func(*awskinesis.Options)) (*awskinesis.DescribeStreamSummaryOutput, error)
+}
+
+type kinesisDriver struct {
+	ctx          context.Context
+	logger       logger.Logger
+	client       kinesisClient
+	stream       string
+	maxBatchSize int
+	pending      []types.PutRecordsRequestEntry
+	waitGroup    sync.WaitGroup
+	once         sync.Once
+	importConfig internal.ImporterConfig
+}
+
+var _ internal.Driver = (*kinesisDriver)(nil)
+var _ internal.DriverLifecycle = (*kinesisDriver)(nil)
+var _ internal.DriverHelp = (*kinesisDriver)(nil)
+var _ internal.Importer = (*kinesisDriver)(nil)
+var _ internal.ImporterHelp = (*kinesisDriver)(nil)
+var _ importer.BatchHandler = (*kinesisDriver)(nil)
+
+func getQueryOrEnv(q url.Values, name string, env string) string {
+	if q.Has(name) {
+		return q.Get(name)
+	}
+	return os.Getenv(env)
+}
+
+func (p *kinesisDriver) connect(ctx context.Context, urlString string) error {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return fmt.Errorf("unable to parse url: %w", err)
+	}
+	p.stream = u.Host
+	if p.stream == "" {
+		return fmt.Errorf("kinesis url requires a host which is the stream name")
+	}
+	q := u.Query()
+	p.maxBatchSize = defaultMaxBatchSize
+	if val := q.Get("maxBatchSize"); val != "" {
+		p.maxBatchSize, err = strconv.Atoi(val)
+		if err != nil || p.maxBatchSize <= 0 {
+			return fmt.Errorf("invalid maxBatchSize: %s", val)
+		}
+	}
+	region := getQueryOrEnv(q, "region", "AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+		if region == "" {
+			region = "us-west-2"
+		}
+	}
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	accessKeyID := getQueryOrEnv(q, "access-key-id", "AWS_ACCESS_KEY_ID")
+	secretAccessKey := getQueryOrEnv(q, "secret-access-key", "AWS_SECRET_ACCESS_KEY")
+	if accessKeyID != "" && secretAccessKey != "" {
+		sessionToken := getQueryOrEnv(q, "session-token", "AWS_SESSION_TOKEN")
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken)))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("unable to load AWS config: %w", err)
+	}
+	endpoint := q.Get("endpoint")
+	p.client = awskinesis.NewFromConfig(cfg, func(o *awskinesis.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return nil
+}
+
+// Start the driver. This is called once at the beginning of the driver's lifecycle.
+func (p *kinesisDriver) Start(pc internal.DriverConfig) error {
+	p.ctx = pc.Context
+	p.logger = pc.Logger.WithPrefix("[kinesis]")
+	if err := p.connect(pc.Context, pc.URL); err != nil {
+		return err
+	}
+	p.logger.Info("started")
+	return nil
+}
+
+// Stop the driver. This is called once at the end of the driver's lifecycle.
+func (p *kinesisDriver) Stop() error {
+	p.logger.Debug("stopping")
+	p.once.Do(func() {
+		p.logger.Debug("waiting on waitgroup")
+		p.waitGroup.Wait()
+		p.logger.Debug("completed waitgroup")
+	})
+	p.logger.Debug("stopped")
+	return nil
+}
+
+// MaxBatchSize returns the maximum number of events that can be processed in a single call to Process and when Flush should be called.
+// Return -1 to indicate that there is no limit.
+func (p *kinesisDriver) MaxBatchSize() int {
+	return p.maxBatchSize
+}
+
+// partitionKey returns the partition key for the event so all the changes for a record are in the same shard and in
+// order. Keys which are longer than the kinesis limit use a hash of the primary key.
+func partitionKey(event internal.DBChangeEvent) string {
+	key := event.Table + "." + event.GetPrimaryKey()
+	if utf8.RuneCountInString(key) > maxPartitionKeyLen {
+		key = event.Table + "." + util.Hash(event.GetPrimaryKey())
+		if utf8.RuneCountInString(key) > maxPartitionKeyLen {
+			key = util.Hash(event.Table, event.GetPrimaryKey())
+		}
+	}
+	return key
+}
+
+// process adds the event to the pending records. An event which is larger than the kinesis record limit can never be
+// put so it's skipped instead of failing the batch and stalling the stream.
+func (p *kinesisDriver) process(event internal.DBChangeEvent, dryRun bool) error {
+	key := partitionKey(event)
+	data := []byte(util.JSONStringify(event))
+	if len(data)+len(key) > maxBytesPerRecord {
+		p.logger.Warn("skipping event %s for %s which is %d bytes and larger than the kinesis record limit of %d bytes", event.ID, event.Table, len(data)+len(key), maxBytesPerRecord)
+		internal.SkippedEvents.WithLabelValues(event.Table, internal.SkipReasonOversized).Inc()
+		return nil
+	}
+	if dryRun {
+		p.logger.Trace("would put record with partition key: %s", key)
+		return nil
+	}
+	p.pending = append(p.pending, types.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: aws.String(key),
+	})
+	return nil
+}
+
+// Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
+func (p *kinesisDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	if err := p.process(event, false); err != nil {
+		return false, err
+	}
+	return len(p.pending) >= p.maxBatchSize, nil
+}
+
+// chunkRecords splits the records into PutRecords requests which are within the kinesis limits, keeping their order.
+func chunkRecords(records []types.PutRecordsRequestEntry) [][]types.PutRecordsRequestEntry {
+	var chunks [][]types.PutRecordsRequestEntry
+	var start, size int
+	for i, record := range records {
+		recordSize := len(record.Data) + len(aws.ToString(record.PartitionKey))
+		if i > start && (i-start >= maxRecordsPerRequest || size+recordSize > maxBytesPerRequest) {
+			chunks = append(chunks, records[start:i])
+			start = i
+			size = 0
+		}
+		size += recordSize
+	}
+	if start < len(records) {
+		chunks = append(chunks, records[start:])
+	}
+	return chunks
+}
+
+// putRecordsError returns an error for the records which failed in the request. Throttled records are wrapped with
+// ErrThrottled so the caller can tell them apart from records which failed for other reasons.
+func putRecordsError(output *awskinesis.PutRecordsOutput) error {
+	failed := aws.ToInt32(output.FailedRecordCount)
+	if failed == 0 {
+		return nil
+	}
+	var throttled bool
+	var reason string
+	for _, result := range output.Records {
+		code := aws.ToString(result.ErrorCode)
+		if code == "" {
+			continue
+		}
+		if code == "ProvisionedThroughputExceededException" {
+			throttled = true
+		} else if reason == "" {
+			reason = code + ": " + aws.ToString(result.ErrorMessage)
+		}
+	}
+	if throttled && reason == "" {
+		return fmt.Errorf("%d of %d records failed: %w", failed, len(output.Records), ErrThrottled)
+	}
+	if throttled {
+		return fmt.Errorf("%d of %d records failed (%s): %w", failed, len(output.Records), reason, ErrThrottled)
+	}
+	return fmt.Errorf("%d of %d records failed: %s", failed, len(output.Records), reason)
+}
+
+// Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
+func (p *kinesisDriver) Flush(logger logger.Logger) error {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	records := p.pending
+	p.pending = nil // the events are redelivered when the flush fails so they shouldn't be sent again with the next flush
+	if len(records) == 0 {
+		return nil
+	}
+	ts := time.Now()
+	for _, chunk := range chunkRecords(records) {
+		output, err := p.client.PutRecords(p.ctx, &awskinesis.PutRecordsInput{
+			StreamName: aws.String(p.stream),
+			Records:    chunk,
+		})
+		if err != nil {
+			var throughput *types.ProvisionedThroughputExceededException
+			if errors.As(err, &throughput) {
+				return fmt.Errorf("error putting records: %w: %w", ErrThrottled, err)
+			}
+			return fmt.Errorf("error putting records: %w", err)
+		}
+		if err := putRecordsError(output); err != nil {
+			return fmt.Errorf("error putting records: %w", err)
+		}
+	}
+	logger.Debug("flushed %d records in %v", len(records), time.Since(ts))
+	return nil
+}
+
+// Name is a unique name for the driver.
+func (p *kinesisDriver) Name() string {
+	return "AWS Kinesis"
+}
+
+// Description is the description of the driver.
+func (p *kinesisDriver) Description() string {
+	return "Supports streaming EDS messages to an AWS Kinesis Data Stream."
+}
+
+// ExampleURL should return an example URL for configuring the driver.
+func (p *kinesisDriver) ExampleURL() string {
+	return "kinesis://stream?region=us-west-2"
+}
+
+// Help should return a detailed help documentation for the driver.
+func (p *kinesisDriver) Help() string {
+	var help strings.Builder
+	help.WriteString(util.GenerateHelpSection("Partitioning", "The partition key is in the format: [TABLE].[PRIMARY_KEY] so all the changes for a record are in the same shard and in order.\nA hash of the primary key is used when the partition key would be longer than 256 characters.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Batching", "Events are sent with PutRecords when the batch reaches maxBatchSize (default 500) or the consumer flushes.\nEach request is limited to 500 records and 5MB. If any record is rejected, such as when the stream is throttled, the flush fails\nand the events are redelivered so the records which were accepted may be sent more than once.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Credentials", "The credentials are read from the access-key-id, secret-access-key and session-token query parameters, the AWS environment variables\nor the default AWS credential chain. Add endpoint=url to use a Kinesis compatible endpoint such as LocalStack.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Record Data", "The record data is a JSON encoded value of the EDS DBChange event."))
+	return help.String()
+}
+
+// CreateDatasource allows the handler to create the datasource before importing data.
+func (p *kinesisDriver) CreateDatasource(schema internal.SchemaMap) error {
+	return nil
+}
+
+// ImportEvent allows the handler to process the event.
+func (p *kinesisDriver) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	return p.process(event, p.importConfig.DryRun)
+}
+
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *kinesisDriver) ImportBatchLimits() (int, int) {
+	return p.maxBatchSize, 0
+}
+
+// FlushBatch puts the pending records.
+func (p *kinesisDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
+// ImportCompleted is called when all events have been processed.
+func (p *kinesisDriver) ImportCompleted() error {
+	return p.Flush(p.logger)
+}
+
+func (p *kinesisDriver) Import(config internal.ImporterConfig) error {
+	if config.SchemaOnly {
+		return nil
+	}
+	p.logger = config.Logger.WithPrefix("[kinesis]")
+	p.ctx = config.Context
+	p.importConfig = config
+	if err := p.connect(config.Context, config.URL); err != nil {
+		return err
+	}
+	return importer.Run(p.logger, config, p)
+}
+
+// SupportsDelete returns true if the importer supports deleting data.
+func (p *kinesisDriver) SupportsDelete() bool {
+	return false
+}
+
+// Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
+func (p *kinesisDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
+	if err := p.connect(ctx, url); err != nil {
+		return err
+	}
+	if _, err := p.client.DescribeStreamSummary(ctx, &awskinesis.DescribeStreamSummaryInput{StreamName: aws.String(p.stream)}); err != nil {
+		return fmt.Errorf("error describing stream: %s. %w", p.stream, err)
+	}
+	return nil
+}
+
+// Configuration returns the configuration fields for the driver.
+func (p *kinesisDriver) Configuration() []internal.DriverField {
+	return []internal.DriverField{
+		internal.RequiredStringField("Stream", "The name of the Kinesis Data Stream", nil),
+		internal.OptionalStringField("Region", "The AWS region to use", nil),
+		internal.OptionalPasswordField("Access Key ID", "The AWS Access Key ID", nil),
+		internal.OptionalPasswordField("Secret Access Key", "The AWS Secret Access Key", nil),
+		internal.OptionalStringField("Endpoint", "The endpoint url to override if using a Kinesis compatible provider", nil),
+		internal.OptionalNumberField("Max Batch Size", "The number of events to batch before putting the records", internal.IntPointer(defaultMaxBatchSize)),
+	}
+}
+
+// Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
+func (p *kinesisDriver) Validate(values map[string]any) (string, []internal.FieldError) {
+	stream := internal.GetRequiredStringValue("Stream", values)
+	var u url.URL
+	u.Scheme = "kinesis"
+	u.Host = stream
+	q := u.Query()
+	if region := internal.GetOptionalStringValue("Region", "", values); region != "" {
+		q.Set("region", region)
+	}
+	if accessKeyID := internal.GetOptionalStringValue("Access Key ID", "", values); accessKeyID != "" {
+		q.Set("access-key-id", accessKeyID)
+	}
+	if secretAccessKey := internal.GetOptionalStringValue("Secret Access Key", "", values); secretAccessKey != "" {
+		q.Set("secret-access-key", secretAccessKey)
+	}
+	if endpoint := internal.GetOptionalStringValue("Endpoint", "", values); endpoint != "" {
+		q.Set("endpoint", endpoint)
+	}
+	maxBatchSize := internal.GetOptionalIntValue("Max Batch Size", defaultMaxBatchSize, values)
+	if maxBatchSize <= 0 {
+		return "", []internal.FieldError{internal.NewFieldError("Max Batch Size", "must be greater than 0")}
+	}
+	if maxBatchSize != defaultMaxBatchSize {
+		q.Set("maxBatchSize", strconv.Itoa(maxBatchSize))
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func init() {
+	internal.RegisterDriver("kinesis", &kinesisDriver{})
+	internal.RegisterImporter("kinesis", &kinesisDriver{})
+}
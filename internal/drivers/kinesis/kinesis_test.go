@@ -0,0 +1,142 @@
+package kinesis
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awskinesis "github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockClient struct {
+	requests [][]types.PutRecordsRequestEntry
+	output   *awskinesis.PutRecordsOutput
+}
+
+func (m *mockClient) PutRecords(ctx context.Context, params *awskinesis.PutRecordsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.PutRecordsOutput, error) {
+	m.requests = append(m.requests, params.Records)
+	if m.output != nil {
+		return m.output, nil
+	}
+	return &awskinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(0)}, nil
+}
+
+func (m *mockClient) DescribeStreamSummary(ctx context.Context, params *awskinesis.DescribeStreamSummaryInput, optFns ...func(*awskinesis.Options)) (*awskinesis.DescribeStreamSummaryOutput, error) {
+	return &awskinesis.DescribeStreamSummaryOutput{}, nil
+}
+
+func TestPartitionKey(t *testing.T) {
+	assert.Equal(t, "order.1", partitionKey(internal.DBChangeEvent{Table: "order", Key: []string{"order", "1"}}))
+	key := partitionKey(internal.DBChangeEvent{Table: "order", Key: []string{"order", strings.Repeat("x", 300)}})
+	assert.True(t, strings.HasPrefix(key, "order."))
+	assert.LessOrEqual(t, len(key), maxPartitionKeyLen)
+}
+
+func TestChunkRecords(t *testing.T) {
+	records := make([]types.PutRecordsRequestEntry, 1001)
+	for i := range records {
+		records[i] = types.PutRecordsRequestEntry{Data: []byte("{}"), PartitionKey: aws.String("order.1")}
+	}
+	chunks := chunkRecords(records)
+	assert.Len(t, chunks, 3)
+	assert.Len(t, chunks[0], 500)
+	assert.Len(t, chunks[1], 500)
+	assert.Len(t, chunks[2], 1)
+
+	big := make([]byte, maxBytesPerRecord-100)
+	chunks = chunkRecords([]types.PutRecordsRequestEntry{{Data: big}, {Data: big}, {Data: big}, {Data: big}, {Data: big}, {Data: big}})
+	assert.Len(t, chunks, 2)
+	assert.Len(t, chunks[0], 5)
+	assert.Len(t, chunks[1], 1)
+}
+
+func TestProcessSkipsOversizedRecord(t *testing.T) {
+	internal.MetricsReset()
+	client := &mockClient{}
+	p := &kinesisDriver{ctx: context.Background(), logger: logger.NewTestLogger(), client: client, stream: "eds", maxBatchSize: 10}
+	big := json.RawMessage(`{"id":"1","notes":"` + strings.Repeat("x", maxBytesPerRecord) + `"}`)
+	_, err := p.Process(logger.NewTestLogger(), internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT", Key: []string{"order", "1"}, After: big})
+	assert.NoError(t, err)
+	_, err = p.Process(logger.NewTestLogger(), internal.DBChangeEvent{ID: "2", Table: "order", Operation: "INSERT", Key: []string{"order", "2"}, After: json.RawMessage(`{"id":"2"}`)})
+	assert.NoError(t, err)
+	assert.Len(t, p.pending, 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(internal.SkippedEvents.WithLabelValues("order", internal.SkipReasonOversized)))
+	assert.NoError(t, p.Flush(logger.NewTestLogger()))
+	assert.Len(t, client.requests, 1)
+	assert.Equal(t, "order.2", aws.ToString(client.requests[0][0].PartitionKey))
+}
+
+func TestProcessAndFlush(t *testing.T) {
+	client := &mockClient{}
+	p := &kinesisDriver{ctx: context.Background(), logger: logger.NewTestLogger(), client: client, stream: "eds", maxBatchSize: 2}
+	flush, err := p.Process(logger.NewTestLogger(), internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT", Key: []string{"order", "1"}, After: json.RawMessage(`{"id":"1"}`)})
+	assert.NoError(t, err)
+	assert.False(t, flush)
+	flush, err = p.Process(logger.NewTestLogger(), internal.DBChangeEvent{ID: "2", Table: "order", Operation: "UPDATE", Key: []string{"order", "1"}, After: json.RawMessage(`{"id":"1"}`)})
+	assert.NoError(t, err)
+	assert.True(t, flush)
+	assert.NoError(t, p.Flush(logger.NewTestLogger()))
+	assert.Len(t, client.requests, 1)
+	assert.Len(t, client.requests[0], 2)
+	assert.Equal(t, "order.1", aws.ToString(client.requests[0][1].PartitionKey))
+	assert.Empty(t, p.pending)
+}
+
+func TestFlushThrottled(t *testing.T) {
+	client := &mockClient{output: &awskinesis.PutRecordsOutput{
+		FailedRecordCount: aws.Int32(1),
+		Records: []types.PutRecordsResultEntry{
+			{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000000")},
+			{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("Rate exceeded for shard")},
+		},
+	}}
+	p := &kinesisDriver{ctx: context.Background(), logger: logger.NewTestLogger(), client: client, stream: "eds", maxBatchSize: 500}
+	for _, id := range []string{"1", "2"} {
+		_, err := p.Process(logger.NewTestLogger(), internal.DBChangeEvent{ID: id, Table: "order", Operation: "INSERT", Key: []string{"order", id}, After: json.RawMessage(`{}`)})
+		assert.NoError(t, err)
+	}
+	err := p.Flush(logger.NewTestLogger())
+	assert.ErrorIs(t, err, ErrThrottled)
+	assert.ErrorContains(t, err, "1 of 2 records failed")
+	assert.Empty(t, p.pending)
+
+	client.output = &awskinesis.PutRecordsOutput{
+		FailedRecordCount: aws.Int32(1),
+		Records:           []types.PutRecordsResultEntry{{ErrorCode: aws.String("InternalFailure"), ErrorMessage: aws.String("Internal service failure")}},
+	}
+	_, err = p.Process(logger.NewTestLogger(), internal.DBChangeEvent{ID: "3", Table: "order", Operation: "INSERT", Key: []string{"order", "3"}, After: json.RawMessage(`{}`)})
+	assert.NoError(t, err)
+	err = p.Flush(logger.NewTestLogger())
+	assert.NotErrorIs(t, err, ErrThrottled)
+	assert.ErrorContains(t, err, "InternalFailure: Internal service failure")
+}
+
+func TestValidate(t *testing.T) {
+	var driver kinesisDriver
+	url, errs := driver.Validate(map[string]any{"Stream": "eds", "Region": "us-east-1"})
+	assert.Empty(t, errs)
+	assert.Equal(t, "kinesis://eds?region=us-east-1", url)
+
+	url, errs = driver.Validate(map[string]any{"Stream": "eds", "Endpoint": "http://localhost:4566", "Max Batch Size": 100})
+	assert.Empty(t, errs)
+	assert.Equal(t, "kinesis://eds?endpoint=http%3A%2F%2Flocalhost%3A4566&maxBatchSize=100", url)
+
+	_, errs = driver.Validate(map[string]any{"Stream": "eds", "Max Batch Size": 0})
+	assert.Len(t, errs, 1)
+}
+
+func TestConnect(t *testing.T) {
+	var driver kinesisDriver
+	assert.NoError(t, driver.connect(context.Background(), "kinesis://eds?region=us-east-1&maxBatchSize=100&access-key-id=a&secret-access-key=b"))
+	assert.Equal(t, "eds", driver.stream)
+	assert.Equal(t, 100, driver.MaxBatchSize())
+	assert.ErrorContains(t, driver.connect(context.Background(), "kinesis://eds?maxBatchSize=none"), "invalid maxBatchSize")
+	assert.ErrorContains(t, driver.connect(context.Background(), "kinesis:///"), "stream name")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -18,26 +19,33 @@ import (
 const maxBytesSizeInsert = 5_000_000
 
 type mysqlDriver struct {
-	ctx          context.Context
-	logger       logger.Logger
-	registry     internal.SchemaRegistry
-	db           *sql.DB
-	waitGroup    sync.WaitGroup
-	once         sync.Once
-	pending      strings.Builder
-	count        int
-	executor     func(string) error
-	importConfig internal.ImporterConfig
-	size         int
-	dbname       string
-	dbschema     internal.DatabaseSchema
+	ctx              context.Context
+	cancel           context.CancelFunc
+	statementTimeout time.Duration
+	pingInterval     time.Duration
+	logger           logger.Logger
+	registry         internal.SchemaRegistry
+	db               *sql.DB
+	reader           *sql.DB // the read replica or db when there isn't one
+	waitGroup        sync.WaitGroup
+	once             sync.Once
+	pending          strings.Builder
+	count            int
+	executor         func(string) error
+	importConfig     internal.ImporterConfig
+	size             int
+	dbname           string
+	dbschema         internal.DatabaseSchema
+	geo              util.GeoColumns
 }
 
 var _ internal.Driver = (*mysqlDriver)(nil)
 var _ internal.DriverLifecycle = (*mysqlDriver)(nil)
+var _ internal.DriverSchemaDrift = (*mysqlDriver)(nil)
+var _ internal.DriverSnapshot = (*mysqlDriver)(nil)
 var _ internal.Importer = (*mysqlDriver)(nil)
 var _ internal.DriverHelp = (*mysqlDriver)(nil)
-var _ importer.Handler = (*mysqlDriver)(nil)
+var _ importer.BatchHandler = (*mysqlDriver)(nil)
 
 func (p *mysqlDriver) refreshSchema(ctx context.Context, db *sql.DB, failIfEmpty bool) error {
 	if p.dbname == "" {
@@ -55,7 +63,7 @@ func (p *mysqlDriver) refreshSchema(ctx context.Context, db *sql.DB, failIfEmpty
 	return nil
 }
 
-func (p *mysqlDriver) connectToDB(ctx context.Context, urlstr string) (*sql.DB, error) {
+func (p *mysqlDriver) openDB(ctx context.Context, urlstr string) (*sql.DB, error) {
 	dsn, err := ParseURLToDSN(urlstr)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing url: %w", err)
@@ -70,25 +78,52 @@ func (p *mysqlDriver) connectToDB(ctx context.Context, urlstr string) (*sql.DB,
 		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	if err := p.refreshSchema(ctx, db, false); err != nil {
-		db.Close()
-		return nil, err
+func (p *mysqlDriver) connectToDB(ctx context.Context, urlstr string) (*sql.DB, *sql.DB, error) {
+	urlstr, timeout, err := util.ParseStatementTimeout(urlstr)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	return db, nil
+	p.statementTimeout = timeout
+	urlstr, interval, err := util.ParsePingInterval(urlstr)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.pingInterval = interval
+	urlstr, geo, err := util.ParseGeoColumns(urlstr)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.geo = geo
+	db, reader, err := util.OpenWithReadReplica(ctx, urlstr, p.openDB)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.refreshSchema(ctx, reader, false); err != nil {
+		util.CloseWithReadReplica(db, reader)
+		return nil, nil, err
+	}
+	return db, reader, nil
 }
 
 // Start the driver. This is called once at the beginning of the driver's lifecycle.
 func (p *mysqlDriver) Start(config internal.DriverConfig) error {
 	p.logger = config.Logger.WithPrefix("[mysql]")
-	db, err := p.connectToDB(config.Context, config.URL)
+	db, reader, err := p.connectToDB(config.Context, config.URL)
 	if err != nil {
 		return err
 	}
 	p.registry = config.SchemaRegistry
 	p.db = db
-	p.ctx = config.Context
+	p.reader = reader
+	p.ctx, p.cancel = context.WithCancel(config.Context)
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+		util.MonitorConnection(p.ctx, p.logger, p.pingInterval, db, reader)
+	}()
 	return nil
 }
 
@@ -96,13 +131,17 @@ func (p *mysqlDriver) Start(config internal.DriverConfig) error {
 func (p *mysqlDriver) Stop() error {
 	p.logger.Debug("stopping")
 	p.once.Do(func() {
+		if p.cancel != nil {
+			p.cancel() // cancel any running statements so a hung query doesn't block shutdown
+		}
 		p.logger.Debug("waiting on waitgroup")
 		p.waitGroup.Wait()
 		p.logger.Debug("completed waitgroup")
 		if p.db != nil {
 			p.logger.Debug("closing db")
-			p.db.Close()
+			util.CloseWithReadReplica(p.db, p.reader)
 			p.db = nil
+			p.reader = nil
 			p.logger.Debug("closed db")
 		}
 	})
@@ -125,7 +164,7 @@ func (p *mysqlDriver) Process(logger logger.Logger, event internal.DBChangeEvent
 	if err != nil {
 		return false, fmt.Errorf("unable to get schema for table: %s (%s). %w", event.Table, event.ModelVersion, err)
 	}
-	sql, err := toSQL(event, schema)
+	sql, err := toSQL(event, p.geo.Apply(schema))
 	if err != nil {
 		return false, err
 	}
@@ -143,7 +182,9 @@ func (p *mysqlDriver) Flush(logger logger.Logger) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
 	if p.count > 0 {
-		tx, err := p.db.BeginTx(p.ctx, nil)
+		ctx, cancel := util.StatementContext(p.ctx, p.statementTimeout)
+		defer cancel()
+		tx, err := p.db.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("unable to start transaction: %w", err)
 		}
@@ -153,7 +194,7 @@ func (p *mysqlDriver) Flush(logger logger.Logger) error {
 				tx.Rollback()
 			}
 		}()
-		if _, err := tx.ExecContext(p.ctx, p.pending.String()); err != nil {
+		if _, err := tx.ExecContext(ctx, p.pending.String()); err != nil {
 			logger.Error("offending sql: %s", p.pending.String())
 			return fmt.Errorf("unable to execute sql: %w", err)
 		}
@@ -171,7 +212,7 @@ func (p *mysqlDriver) Flush(logger logger.Logger) error {
 func (p *mysqlDriver) CreateDatasource(schema internal.SchemaMap) error {
 	// create all the tables
 	for _, table := range p.importConfig.Tables {
-		data := schema[table]
+		data := p.geo.Apply(schema[table])
 		p.logger.Debug("creating table %s", table)
 		if err := p.executor(createSQL(data)); err != nil {
 			return fmt.Errorf("error creating table: %s. %w", table, err)
@@ -183,14 +224,28 @@ func (p *mysqlDriver) CreateDatasource(schema internal.SchemaMap) error {
 
 // ImportEvent allows the handler to process the event.
 func (p *mysqlDriver) ImportEvent(event internal.DBChangeEvent, data *internal.Schema) error {
-	sql, err := toSQLFromObject("INSERT", data, event.Table, event, nil)
+	sql, err := toSQLFromObject("INSERT", p.geo.Apply(data), event.Table, event, nil)
 	if err != nil {
 		return err
 	}
 	p.pending.WriteString(sql)
 	p.count++
 	p.size += len(sql)
-	if p.size >= maxBytesSizeInsert || p.importConfig.Single {
+	if p.size >= maxBytesSizeInsert {
+		return p.FlushBatch()
+	}
+	return nil
+}
+
+// ImportBatchLimits returns no driver specific limits since ImportEvent flushes the batch once its statements reach
+// their maximum size.
+func (p *mysqlDriver) ImportBatchLimits() (int, int) {
+	return 0, 0
+}
+
+// FlushBatch executes the pending insert statements.
+func (p *mysqlDriver) FlushBatch() error {
+	if p.size > 0 {
 		if err := p.executor(p.pending.String()); err != nil {
 			p.logger.Error("offending sql: %s", p.pending.String())
 			return fmt.Errorf("unable to execute sql: %w", err)
@@ -203,23 +258,17 @@ func (p *mysqlDriver) ImportEvent(event internal.DBChangeEvent, data *internal.S
 
 // ImportCompleted is called when all events have been processed.
 func (p *mysqlDriver) ImportCompleted() error {
-	if p.size > 0 {
-		if err := p.executor(p.pending.String()); err != nil {
-			p.logger.Error("offending sql: %s", p.pending.String())
-			return fmt.Errorf("unable to execute sql: %w", err)
-		}
-	}
-	return nil
+	return p.FlushBatch()
 }
 
 // Import is called to import data from the source.
 func (p *mysqlDriver) Import(config internal.ImporterConfig) error {
 	p.logger = config.Logger.WithPrefix("[mysql]")
-	db, err := p.connectToDB(config.Context, config.URL)
+	db, reader, err := p.connectToDB(config.Context, config.URL)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer util.CloseWithReadReplica(db, reader)
 
 	p.registry = config.SchemaRegistry
 	p.importConfig = config
@@ -250,40 +299,47 @@ func (p *mysqlDriver) ExampleURL() string {
 func (p *mysqlDriver) Help() string {
 	var help strings.Builder
 	help.WriteString(util.GenerateHelpSection("Schema", "The database will match the public schema from the Shopmonkey transactional database.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Read Replica", "Add readURL=url (url encoded) to query the schema from a read replica instead of the primary. Writes always go to the primary.\nThe read replica uses the credentials from the primary when its url doesn't have any.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Geo Columns", "Add geo=table.column (repeated or comma separated) to store a column as a GEOMETRY with SRID 4326 so spatial queries work without casts.\nThe value can be GeoJSON, an object with lat and lng properties or a \"lat,lng\" string, other values are stored as NULL.\nThe column type is only changed when the table is created or the column is added.\n"))
 	return help.String()
 }
 
 // Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
 func (p *mysqlDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
 	p.logger = logger.WithPrefix("[mysql]")
-	db, err := p.connectToDB(ctx, url)
+	db, reader, err := p.connectToDB(ctx, url)
 	if err != nil {
 		return err
 	}
-	return db.Close()
+	return util.CloseWithReadReplica(db, reader)
 }
 
 // Configuration returns the configuration fields for the driver.
 func (p *mysqlDriver) Configuration() []internal.DriverField {
-	return internal.NewDatabaseConfiguration(3306)
+	return append(internal.NewDatabaseConfiguration(3306), internal.ReadReplicaField())
 }
 
 // Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
 func (p *mysqlDriver) Validate(values map[string]any) (string, []internal.FieldError) {
-	return internal.URLFromDatabaseConfiguration("mysql", 3306, values), nil
+	url := internal.URLFromDatabaseConfiguration("mysql", 3306, values)
+	return internal.AppendReadURLFromDatabaseConfiguration(url, "mysql", 3306, values), nil
 }
 
 // MigrateNewTable is called when a new table is detected with the appropriate information for the driver to perform the migration.
 func (p *mysqlDriver) MigrateNewTable(ctx context.Context, logger logger.Logger, schema *internal.Schema) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
 	if _, ok := p.dbschema[schema.Table]; ok {
 		logger.Info("table already exists for: %s, dropping and recreating...", schema.Table)
 		if err := util.DropTable(ctx, logger, p.db, quoteIdentifier(schema.Table)); err != nil {
 			return err
 		}
 	}
-	sql := createSQL(schema)
+	sql := createSQL(p.geo.Apply(schema))
 	logger.Trace("migrate new table: %s", sql)
 	if _, err := p.db.ExecContext(ctx, sql); err != nil {
 		return err
@@ -295,7 +351,9 @@ func (p *mysqlDriver) MigrateNewTable(ctx context.Context, logger logger.Logger,
 func (p *mysqlDriver) MigrateNewColumns(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns []string) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
-	sqls := addNewColumnsSQL(logger, columns, schema, p.dbschema)
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	sqls := addNewColumnsSQL(logger, columns, p.geo.Apply(schema), p.dbschema)
 	for _, sql := range sqls {
 		logger.Trace("migrating new columns: %s", sql)
 		_, err := p.db.ExecContext(ctx, sql)
@@ -307,6 +365,39 @@ func (p *mysqlDriver) MigrateNewColumns(ctx context.Context, logger logger.Logge
 	return p.refreshSchema(ctx, p.db, true)
 }
 
+// MissingColumns reloads the destination schema and returns the columns of the schemas which are missing from their tables.
+func (p *mysqlDriver) MissingColumns(ctx context.Context, logger logger.Logger, schemas []*internal.Schema) (map[string][]string, error) {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	if err := p.refreshSchema(ctx, p.db, false); err != nil {
+		return nil, err
+	}
+	return util.MissingColumns(p.dbschema, schemas), nil
+}
+
+// Snapshot writes the rows of the table as CSV.
+func (p *mysqlDriver) Snapshot(ctx context.Context, logger logger.Logger, table string, limit int, w io.Writer) error {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	if p.reader == nil {
+		return internal.ErrDriverStopped
+	}
+	name, ok := util.FindTable(p.dbschema, table)
+	if !ok {
+		return internal.ErrTableNotFound
+	}
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	count, err := util.WriteCSVRows(ctx, p.reader, snapshotSQL(name, limit), w)
+	if err != nil {
+		return fmt.Errorf("error reading table %s: %w", name, err)
+	}
+	logger.Debug("wrote %d rows of table %s", count, name)
+	return nil
+}
+
 func init() {
 	internal.RegisterDriver("mysql", &mysqlDriver{})
 	internal.RegisterImporter("mysql", &mysqlDriver{})
@@ -3,7 +3,6 @@ package mysql
 import (
 	"fmt"
 	"net/url"
-	"regexp"
 	"sort"
 	"strings"
 
@@ -12,14 +11,20 @@ import (
 	"github.com/shopmonkeyus/go-common/logger"
 )
 
-var needsQuote = regexp.MustCompile(`[A-Z0-9_\s]`)
-var keywords = regexp.MustCompile(`(?i)\b(USER|SELECT|INSERT|UPDATE|DELETE|FROM|WHERE|JOIN|LEFT|RIGHT|INNER|GROUP BY|ORDER BY|HAVING|AND|OR|CREATE|DROP|ALTER|TABLE|INDEX|ON|INTO|VALUES|SET|AS|DISTINCT|TYPE|DEFAULT|ORDER|GROUP|LIMIT|SUM|TOTAL|START|END|BEGIN|COMMIT|ROLLBACK|PRIMARY|AUTHORIZATION)\b`)
-
 func quoteIdentifier(val string) string {
-	if needsQuote.MatchString(val) || keywords.MatchString(val) {
-		return "`" + val + "`"
+	return util.MySQLIdentifiers.QuoteIfNeeded(val)
+}
+
+// quotePropertyValue returns the SQL value for a column. Geo columns are converted from GeoJSON to a geometry and are
+// NULL when the value isn't a location.
+func quotePropertyValue(val any, prop internal.SchemaProperty) string {
+	if prop.IsGeography() {
+		if geojson, ok := util.ToGeoJSON(val); ok {
+			return "ST_GeomFromGeoJSON(" + quoteValue(geojson) + ")"
+		}
+		return "NULL"
 	}
-	return val
+	return quoteValue(util.ToBinaryValue(val, prop))
 }
 
 func toSQLFromObject(operation string, model *internal.Schema, table string, event internal.DBChangeEvent, diff []string) (string, error) {
@@ -46,7 +51,7 @@ func toSQLFromObject(operation string, model *internal.Schema, table string, eve
 			}
 			prop := model.Properties[name]
 			if val, ok := o[name]; ok {
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, true)
+				v := util.ToJSONStringVal(name, quotePropertyValue(val, prop), prop, true)
 				updateValues = append(updateValues, fmt.Sprintf("%s=%s", quoteIdentifier(name), v))
 			} else {
 				v := util.ToJSONStringVal(name, "NULL", prop, true)
@@ -56,7 +61,7 @@ func toSQLFromObject(operation string, model *internal.Schema, table string, eve
 		for _, name := range model.Columns() {
 			prop := model.Properties[name]
 			if val, ok := o[name]; ok {
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, true)
+				v := util.ToJSONStringVal(name, quotePropertyValue(val, prop), prop, true)
 				insertVals = append(insertVals, v)
 			} else {
 				v := util.ToJSONStringVal(name, "NULL", prop, true)
@@ -67,7 +72,7 @@ func toSQLFromObject(operation string, model *internal.Schema, table string, eve
 		for _, name := range model.Columns() {
 			prop := model.Properties[name]
 			if val, ok := o[name]; ok {
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, true)
+				v := util.ToJSONStringVal(name, quotePropertyValue(val, prop), prop, true)
 				if name != "id" {
 					updateValues = append(updateValues, fmt.Sprintf("%s=%s", quoteIdentifier(name), v))
 				}
@@ -106,6 +111,15 @@ func toSQL(c internal.DBChangeEvent, model *internal.Schema) (string, error) {
 func propTypeToSQLType(property internal.SchemaProperty, isPrimaryKey bool) string {
 	switch property.Type {
 	case "string":
+		if property.IsBinary() {
+			if isPrimaryKey {
+				return "VARBINARY(64)"
+			}
+			return "LONGBLOB"
+		}
+		if property.IsGeography() {
+			return "GEOMETRY SRID 4326"
+		}
 		if isPrimaryKey {
 			return "VARCHAR(64)"
 		}
@@ -217,3 +231,12 @@ func ParseURLToDSN(urlstr string) (string, error) {
 	dsn.WriteString(vals.Encode())
 	return dsn.String(), nil
 }
+
+// snapshotSQL returns the query for the rows of the table, all of them if the limit is 0.
+func snapshotSQL(table string, limit int) string {
+	sql := "SELECT * FROM " + quoteIdentifier(table)
+	if limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return sql
+}
@@ -0,0 +1,116 @@
+package neo4j
+
+import (
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+// statement is a cypher statement with its parameters.
+type statement struct {
+	cypher string
+	params map[string]any
+}
+
+// quoteName quotes a label, relationship type or property name.
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// toProperties converts the object to node properties. Neo4j doesn't support maps or mixed lists as properties so they're stored as JSON.
+func toProperties(object map[string]any) map[string]any {
+	props := make(map[string]any)
+	for key, val := range object {
+		switch v := val.(type) {
+		case nil:
+			continue // SET n = props removes properties which aren't set
+		case string, bool, float64:
+			props[key] = v
+		case []any:
+			if strs, ok := toStrings(v); ok {
+				props[key] = strs
+			} else {
+				props[key] = util.JSONStringify(v)
+			}
+		default:
+			props[key] = util.JSONStringify(v)
+		}
+	}
+	return props
+}
+
+func toStrings(vals []any) ([]string, bool) {
+	res := make([]string, 0, len(vals))
+	for _, val := range vals {
+		s, ok := val.(string)
+		if !ok {
+			return nil, false
+		}
+		res = append(res, s)
+	}
+	return res, true
+}
+
+func upsertCypher(table string) string {
+	return "UNWIND $rows AS row MERGE (n:" + quoteName(label(table)) + " {id: row.id}) SET n = row.props"
+}
+
+// relationCypher replaces the relationship for each row. The related node is created if it doesn't exist yet and its properties
+// are filled in when the related row is received.
+func relationCypher(r Relation) string {
+	relType := quoteName(r.Type)
+	property := "row.props." + quoteName(r.Property)
+	var sb strings.Builder
+	sb.WriteString("UNWIND $rows AS row MATCH (n:")
+	sb.WriteString(quoteName(label(r.From)))
+	sb.WriteString(" {id: row.id}) OPTIONAL MATCH (n)-[r:")
+	sb.WriteString(relType)
+	sb.WriteString("]->() DELETE r WITH DISTINCT n, row WHERE ")
+	sb.WriteString(property)
+	sb.WriteString(" IS NOT NULL MERGE (m:")
+	sb.WriteString(quoteName(label(r.To)))
+	sb.WriteString(" {id: ")
+	sb.WriteString(property)
+	sb.WriteString("}) MERGE (n)-[:")
+	sb.WriteString(relType)
+	sb.WriteString("]->(m)")
+	return sb.String()
+}
+
+func deleteCypher(table string) string {
+	return "UNWIND $ids AS id MATCH (n:" + quoteName(label(table)) + " {id: id}) DETACH DELETE n"
+}
+
+// buildStatements returns the statements to apply the records, grouped by table in the order the tables were first seen.
+func buildStatements(records []*util.Record, relations map[string][]Relation) []statement {
+	var tables []string
+	seen := make(map[string]bool)
+	ids := make(map[string][]any)
+	rows := make(map[string][]any)
+	for _, record := range records {
+		if !seen[record.Table] {
+			seen[record.Table] = true
+			tables = append(tables, record.Table)
+		}
+		if record.Operation == "DELETE" {
+			ids[record.Table] = append(ids[record.Table], record.Id)
+			continue
+		}
+		props := toProperties(record.Object)
+		props["id"] = record.Id
+		rows[record.Table] = append(rows[record.Table], map[string]any{"id": record.Id, "props": props})
+	}
+	var res []statement
+	for _, table := range tables {
+		if len(ids[table]) > 0 {
+			res = append(res, statement{deleteCypher(table), map[string]any{"ids": ids[table]}})
+		}
+		if len(rows[table]) > 0 {
+			res = append(res, statement{upsertCypher(table), map[string]any{"rows": rows[table]}})
+			for _, r := range relations[table] {
+				res = append(res, statement{relationCypher(r), map[string]any{"rows": rows[table]}})
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,107 @@
+package neo4j
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// Relation maps a foreign key property of a table to a relationship to the node of another table.
+type Relation struct {
+	// From is the table with the foreign key property.
+	From string `json:"from"`
+
+	// Property is the foreign key property which contains the id of the related row.
+	Property string `json:"property"`
+
+	// To is the related table.
+	To string `json:"to"`
+
+	// Type is the relationship type. Defaults to the property without the Id suffix in upper snake case (customerId is CUSTOMER).
+	Type string `json:"type,omitempty"`
+}
+
+// label returns the node label for a table in pascal case (labor_rate is LaborRate).
+func label(table string) string {
+	var sb strings.Builder
+	upper := true
+	for _, r := range table {
+		if r == '_' || r == '-' || r == ' ' {
+			upper = true
+			continue
+		}
+		if upper {
+			sb.WriteRune(unicode.ToUpper(r))
+			upper = false
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// snakeCase converts a camel case name to snake case (laborRate is labor_rate).
+func snakeCase(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(unicode.ToLower(r))
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// relationshipType returns the default relationship type for a foreign key property.
+func relationshipType(property string) string {
+	return strings.ToUpper(snakeCase(strings.TrimSuffix(property, "Id")))
+}
+
+// inferRelations returns the relations for the foreign key properties (such as customerId) of the table which reference another selected table.
+func inferRelations(schema *internal.Schema, tables []string) []Relation {
+	var res []Relation
+	for name, prop := range schema.Properties {
+		if prop.Type != "string" || !strings.HasSuffix(name, "Id") || name == "id" {
+			continue
+		}
+		to := snakeCase(strings.TrimSuffix(name, "Id"))
+		for _, table := range tables {
+			if table == to {
+				res = append(res, Relation{From: schema.Table, Property: name, To: to, Type: relationshipType(name)})
+				break
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Property < res[j].Property })
+	return res
+}
+
+// loadRelations loads the relations from a JSON file which is an array of relations.
+func loadRelations(fn string) ([]Relation, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading relations file: %w", err)
+	}
+	var relations []Relation
+	if err := json.Unmarshal(buf, &relations); err != nil {
+		return nil, fmt.Errorf("error parsing relations file %s: %w", fn, err)
+	}
+	for i, r := range relations {
+		if r.From == "" || r.Property == "" || r.To == "" {
+			return nil, fmt.Errorf("relation %d in %s must have from, property and to", i, fn)
+		}
+		if r.Type == "" {
+			relations[i].Type = relationshipType(r.Property)
+		}
+	}
+	return relations, nil
+}
@@ -0,0 +1,169 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	cockroachDefaultPort       = 26257
+	cockroachMaxAttempts       = 5
+	cockroachRetryDelay        = 100 * time.Millisecond
+	cockroachStatementsPerExec = 100
+)
+
+// isCockroachScheme returns true if the url scheme is for cockroachdb.
+func isCockroachScheme(scheme string) bool {
+	switch scheme {
+	case "cockroach", "cockroachdb", "crdb":
+		return true
+	}
+	return false
+}
+
+// parseAsOfSystemTime removes the asOf parameter from the url and returns the AS OF SYSTEM TIME expression for it.
+// The value is either follower to use the follower read timestamp or a negative interval such as -10s.
+func parseAsOfSystemTime(urlstr string) (string, string, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing cockroachdb url: %w", err)
+	}
+	q := u.Query()
+	if !q.Has("asOf") {
+		return urlstr, "", nil
+	}
+	val := q.Get("asOf")
+	q.Del("asOf")
+	u.RawQuery = q.Encode()
+	switch {
+	case val == "":
+		return u.String(), "", nil
+	case val == "follower":
+		return u.String(), "follower_read_timestamp()", nil
+	case strings.HasPrefix(val, "-"):
+		if _, err := time.ParseDuration(val); err != nil {
+			return "", "", fmt.Errorf("invalid asOf: %s. %w", val, err)
+		}
+		return u.String(), pq.QuoteLiteral(val), nil
+	}
+	return "", "", fmt.Errorf("invalid asOf: %s. must be follower or a negative interval such as -10s", val)
+}
+
+// buildCockroachSchema reads the database schema as of the system time so the query doesn't wait on the intents of
+// concurrent writes, such as the rows being imported.
+func buildCockroachSchema(ctx context.Context, logger logger.Logger, db *sql.DB, dbname string, asOf string) (internal.DatabaseSchema, error) {
+	res := make(internal.DatabaseSchema)
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, "SELECT table_name, column_name, data_type FROM information_schema.columns AS OF SYSTEM TIME "+asOf+" WHERE table_catalog = $1", dbname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tableName, columnName, dataType string
+		if err := rows.Scan(&tableName, &columnName, &dataType); err != nil {
+			return nil, err
+		}
+		if _, ok := res[tableName]; !ok {
+			res[tableName] = make(map[string]string)
+		}
+		res[tableName][columnName] = dataType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	logger.Info("refreshed %d tables ddl as of %s in %v", len(res), asOf, time.Since(start))
+	return res, nil
+}
+
+// isCockroachRetryable returns true if the transaction was aborted by a conflict and can be retried.
+func isCockroachRetryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001"
+	}
+	return strings.Contains(err.Error(), "restart transaction")
+}
+
+// execCockroachTx executes the statements in a transaction. CockroachDB handles large multi-statement batches poorly so
+// the statements are sent in smaller groups.
+func execCockroachTx(ctx context.Context, db *sql.DB, statements []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	var success bool
+	defer func() {
+		if !success {
+			tx.Rollback()
+		}
+	}()
+	for i := 0; i < len(statements); i += cockroachStatementsPerExec {
+		end := min(i+cockroachStatementsPerExec, len(statements))
+		if _, err := tx.ExecContext(ctx, strings.Join(statements[i:end], "")); err != nil {
+			return fmt.Errorf("unable to execute sql: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit transaction: %w", err)
+	}
+	success = true
+	return nil
+}
+
+// runCockroachTx executes the statements in a transaction and retries it with a backoff when it's aborted because of
+// a conflict with another transaction.
+func runCockroachTx(ctx context.Context, logger logger.Logger, db *sql.DB, statements []string) error {
+	delay := cockroachRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := execCockroachTx(ctx, db, statements)
+		if err == nil || !isCockroachRetryable(err) {
+			return err
+		}
+		if attempt >= cockroachMaxAttempts {
+			return internal.NewRetryableError(fmt.Errorf("transaction failed after %d attempts: %w", attempt, err))
+		}
+		logger.Warn("transaction was aborted (attempt %d/%d), retrying in %v: %s", attempt, cockroachMaxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// toUpsertSQLFromObject returns the UPSERT statement to write the whole row which is faster than INSERT ... ON CONFLICT
+// in CockroachDB since it doesn't need to read the existing row.
+func toUpsertSQLFromObject(model *internal.Schema, table string, o map[string]any) string {
+	var sql strings.Builder
+	sql.WriteString("UPSERT INTO ")
+	sql.WriteString(quoteIdentifier(table))
+	var columns []string
+	var values []string
+	for _, name := range model.Columns() {
+		columns = append(columns, quoteIdentifier(name))
+		prop := model.Properties[name]
+		if val, ok := o[name]; ok {
+			values = append(values, util.ToJSONStringVal(name, quotePropertyValue(val, prop), prop, true))
+		} else {
+			values = append(values, util.ToJSONStringVal(name, "NULL", prop, true))
+		}
+	}
+	sql.WriteString(" (")
+	sql.WriteString(strings.Join(columns, ","))
+	sql.WriteString(") VALUES (")
+	sql.WriteString(strings.Join(values, ","))
+	sql.WriteString(");\n")
+	return sql.String()
+}
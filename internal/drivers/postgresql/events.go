@@ -0,0 +1,146 @@
+package postgresql
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	defaultEventsTable     = "eds_events"
+	maxRowsPerEventsInsert = 1000
+)
+
+// eventsMode holds the settings for writing the append-only event history instead of the current state of each table.
+type eventsMode struct {
+	enabled bool
+	table   string
+}
+
+// parseEventsMode removes the events mode parameters from the url since they aren't connection parameters.
+func parseEventsMode(urlstr string) (string, eventsMode, error) {
+	var mode eventsMode
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", mode, fmt.Errorf("error parsing postgres db url: %w", err)
+	}
+	q := u.Query()
+	if !q.Has("mode") && !q.Has("eventsTable") {
+		return urlstr, mode, nil
+	}
+	switch q.Get("mode") {
+	case "events":
+		mode.enabled = true
+	case "", "tables":
+	default:
+		return "", mode, fmt.Errorf("invalid mode: %s. must be either tables or events", q.Get("mode"))
+	}
+	mode.table = q.Get("eventsTable")
+	if mode.table == "" {
+		mode.table = defaultEventsTable
+	}
+	q.Del("mode")
+	q.Del("eventsTable")
+	u.RawQuery = q.Encode()
+	return u.String(), mode, nil
+}
+
+// createEventsTableSQL returns the statements to create the events table if it doesn't exist.
+// The primary key must include the time column so that the table can be converted to a hypertable.
+func createEventsTableSQL(table string) string {
+	var sql strings.Builder
+	sql.WriteString("CREATE TABLE IF NOT EXISTS ")
+	sql.WriteString(quoteIdentifier(table))
+	sql.WriteString(` (
+	"timestamp" TIMESTAMP WITH TIME ZONE NOT NULL,
+	id TEXT NOT NULL,
+	"table" TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	"key" TEXT NOT NULL,
+	company_id TEXT,
+	location_id TEXT,
+	user_id TEXT,
+	model_version TEXT,
+	mvcc_timestamp TEXT,
+	diff JSONB,
+	before JSONB,
+	after JSONB,
+	imported BOOLEAN NOT NULL DEFAULT false,
+	PRIMARY KEY (id, "timestamp")
+);
+`)
+	sql.WriteString("CREATE INDEX IF NOT EXISTS ")
+	sql.WriteString(quoteIdentifier(table + "_table_key_idx"))
+	sql.WriteString(" ON ")
+	sql.WriteString(quoteIdentifier(table))
+	sql.WriteString(` ("table", "key", "timestamp" DESC);
+`)
+	return sql.String()
+}
+
+// createHypertableSQL returns the statement to convert the events table to a TimescaleDB hypertable partitioned by the event timestamp.
+func createHypertableSQL(table string) string {
+	return fmt.Sprintf(`SELECT create_hypertable(%s, 'timestamp', if_not_exists => TRUE, migrate_data => TRUE);`, quoteString(quoteIdentifier(table)))
+}
+
+// lookupEventSQL returns the query for whether the events table has the event.
+func lookupEventSQL(table string, id string) string {
+	return "SELECT EXISTS (SELECT 1 FROM " + quoteIdentifier(table) + " WHERE id=" + quoteValue(id) + ")"
+}
+
+const hasTimescaleSQL = `SELECT count(*) FROM pg_extension WHERE extname = 'timescaledb'`
+
+func quoteJSON(buf []byte) string {
+	if len(buf) == 0 || string(buf) == "null" {
+		return "null"
+	}
+	return quoteString(string(buf))
+}
+
+// toEventValuesSQL returns the values of the event for a row of the events table.
+func toEventValuesSQL(event internal.DBChangeEvent) string {
+	var diff string
+	if len(event.Diff) > 0 {
+		diff = quoteString(util.JSONStringify(event.Diff))
+	} else {
+		diff = "null"
+	}
+	values := []string{
+		quoteValue(time.UnixMilli(event.Timestamp).UTC()),
+		quoteValue(event.ID),
+		quoteValue(event.Table),
+		quoteValue(event.Operation),
+		quoteValue(event.GetPrimaryKey()),
+		quoteValue(event.CompanyID),
+		quoteValue(event.LocationID),
+		quoteValue(event.UserID),
+		quoteValue(event.ModelVersion),
+		quoteValue(event.MVCCTimestamp),
+		diff,
+		quoteJSON(event.Before),
+		quoteJSON(event.After),
+		quoteValue(event.Imported),
+	}
+	return "(" + strings.Join(values, ",") + ")"
+}
+
+// toEventsSQL returns the statements to append the rows to the events table using a multi-row insert for up to
+// maxRowsPerEventsInsert rows at a time. Redelivered events are ignored.
+func toEventsSQL(table string, rows []string) []string {
+	var statements []string
+	for i := 0; i < len(rows); i += maxRowsPerEventsInsert {
+		end := min(i+maxRowsPerEventsInsert, len(rows))
+		var sql strings.Builder
+		sql.WriteString("INSERT INTO ")
+		sql.WriteString(quoteIdentifier(table))
+		sql.WriteString(` ("timestamp",id,"table",operation,"key",company_id,location_id,user_id,model_version,mvcc_timestamp,diff,before,after,imported) VALUES `)
+		sql.WriteString(strings.Join(rows[i:end], ","))
+		sql.WriteString(" ON CONFLICT DO NOTHING;\n")
+		statements = append(statements, sql.String())
+	}
+	return statements
+}
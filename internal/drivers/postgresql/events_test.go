@@ -0,0 +1,71 @@
+package postgresql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEventsMode(t *testing.T) {
+	url, mode, err := parseEventsMode("postgres://localhost:5432/db?sslmode=disable")
+	assert.NoError(t, err)
+	assert.False(t, mode.enabled)
+	assert.Equal(t, "postgres://localhost:5432/db?sslmode=disable", url)
+
+	url, mode, err = parseEventsMode("postgres://localhost:5432/db?mode=events&sslmode=disable")
+	assert.NoError(t, err)
+	assert.True(t, mode.enabled)
+	assert.Equal(t, defaultEventsTable, mode.table)
+	assert.Equal(t, "postgres://localhost:5432/db?sslmode=disable", url)
+
+	url, mode, err = parseEventsMode("postgres://localhost:5432/db?mode=events&eventsTable=history")
+	assert.NoError(t, err)
+	assert.True(t, mode.enabled)
+	assert.Equal(t, "history", mode.table)
+	assert.Equal(t, "postgres://localhost:5432/db", url)
+
+	_, _, err = parseEventsMode("postgres://localhost:5432/db?mode=foo")
+	assert.ErrorContains(t, err, "invalid mode")
+}
+
+func TestEventsTableSQL(t *testing.T) {
+	sql := createEventsTableSQL("eds_events")
+	assert.Contains(t, sql, `CREATE TABLE IF NOT EXISTS "eds_events" (`)
+	assert.Contains(t, sql, `PRIMARY KEY (id, "timestamp")`)
+	assert.Contains(t, sql, `CREATE INDEX IF NOT EXISTS "eds_events_table_key_idx" ON "eds_events" ("table", "key", "timestamp" DESC);`)
+	assert.Equal(t, `SELECT create_hypertable('"eds_events"', 'timestamp', if_not_exists => TRUE, migrate_data => TRUE);`, createHypertableSQL("eds_events"))
+}
+
+func TestToEventSQL(t *testing.T) {
+	companyID := "1234"
+	row := toEventValuesSQL(internal.DBChangeEvent{
+		ID:            "abc",
+		Operation:     "UPDATE",
+		Table:         "order",
+		Key:           []string{"gcp-us-west1", "1"},
+		ModelVersion:  "v1",
+		CompanyID:     &companyID,
+		Timestamp:     1720732611708,
+		MVCCTimestamp: "1720732611708587506.0000000000",
+		Diff:          []string{"name"},
+		Before:        []byte(`{"id":"1","name":"a"}`),
+		After:         []byte(`{"id":"1","name":"it's"}`),
+	})
+	sql := toEventsSQL("eds_events", []string{row})
+	assert.Equal(t, []string{`INSERT INTO "eds_events" ("timestamp",id,"table",operation,"key",company_id,location_id,user_id,model_version,mvcc_timestamp,diff,before,after,imported) VALUES ('2024-07-11 21:16:51.708Z','abc','order','UPDATE','1','1234',null,null,'v1','1720732611708587506.0000000000','["name"]','{"id":"1","name":"a"}',$_H_${"id":"1","name":"it's"}$_H_$,false) ON CONFLICT DO NOTHING;
+`}, sql)
+
+	row = toEventValuesSQL(internal.DBChangeEvent{ID: "def", Operation: "DELETE", Table: "order", Key: []string{"gcp-us-west1", "1"}, Timestamp: 1720732611708})
+	assert.Contains(t, row, "'DELETE','1',null,null,null,'','',null,null,null,false)")
+
+	rows := make([]string, maxRowsPerEventsInsert+1)
+	for i := range rows {
+		rows[i] = row
+	}
+	sql = toEventsSQL("eds_events", rows)
+	assert.Len(t, sql, 2)
+	assert.Equal(t, maxRowsPerEventsInsert, strings.Count(sql[0], "'def'"))
+	assert.Equal(t, 1, strings.Count(sql[1], "'def'"))
+}
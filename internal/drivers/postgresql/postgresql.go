@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -16,20 +17,33 @@ import (
 
 const maxBytesSizeInsert = 5_000_000
 
+const hasPostGISSQL = `SELECT count(*) FROM pg_extension WHERE extname = 'postgis'`
+
 type postgresqlDriver struct {
-	ctx          context.Context
-	logger       logger.Logger
-	db           *sql.DB
-	registry     internal.SchemaRegistry
-	waitGroup    sync.WaitGroup
-	once         sync.Once
-	pending      strings.Builder
-	count        int
-	executor     func(string) error
-	importConfig internal.ImporterConfig
-	size         int
-	dbname       string
-	dbschema     internal.DatabaseSchema
+	ctx              context.Context
+	cancel           context.CancelFunc
+	statementTimeout time.Duration
+	pingInterval     time.Duration
+	logger           logger.Logger
+	db               *sql.DB
+	reader           *sql.DB // the read replica or db when there isn't one
+	registry         internal.SchemaRegistry
+	waitGroup        sync.WaitGroup
+	once             sync.Once
+	pending          strings.Builder
+	count            int
+	executor         func(string) error
+	importConfig     internal.ImporterConfig
+	size             int
+	dbname           string
+	dbschema         internal.DatabaseSchema
+	events           eventsMode
+	geo              util.GeoColumns
+	cockroach        bool     // use the cockroachdb dialect and retry transactions aborted by conflicts
+	statements       []string // the pending statements when using cockroachdb so they can be sent in groups
+	asOf             string   // the AS OF SYSTEM TIME expression for reading the schema from cockroachdb
+	hypertables      hypertables
+	eventRows        []string // the pending rows for the events table which are inserted together
 }
 
 var _ internal.Driver = (*postgresqlDriver)(nil)
@@ -37,6 +51,18 @@ var _ internal.DriverLifecycle = (*postgresqlDriver)(nil)
 var _ internal.Importer = (*postgresqlDriver)(nil)
 var _ internal.DriverHelp = (*postgresqlDriver)(nil)
 var _ internal.DriverMigration = (*postgresqlDriver)(nil)
+var _ internal.DriverSchemaDrift = (*postgresqlDriver)(nil)
+var _ internal.DriverSnapshot = (*postgresqlDriver)(nil)
+var _ internal.DriverLookup = (*postgresqlDriver)(nil)
+var _ importer.BatchHandler = (*postgresqlDriver)(nil)
+
+// logPrefix returns the prefix for the logger of the driver.
+func (p *postgresqlDriver) logPrefix() string {
+	if p.cockroach {
+		return "[cockroach]"
+	}
+	return "[postgres]"
+}
 
 func (p *postgresqlDriver) refreshSchema(ctx context.Context, db *sql.DB, failIfEmpty bool) error {
 	if p.dbname == "" {
@@ -46,6 +72,15 @@ func (p *postgresqlDriver) refreshSchema(ctx context.Context, db *sql.DB, failIf
 		}
 		p.dbname = dbname
 	}
+	if p.asOf != "" && !failIfEmpty {
+		// only the initial read can be stale, after a migration the schema must include the changes
+		schema, err := buildCockroachSchema(ctx, p.logger, db, p.dbname, p.asOf)
+		if err != nil {
+			return fmt.Errorf("error building database schema: %w", err)
+		}
+		p.dbschema = schema
+		return nil
+	}
 	schema, err := util.BuildDBSchemaFromInfoSchema(ctx, p.logger, db, "table_catalog", p.dbname, failIfEmpty)
 	if err != nil {
 		return fmt.Errorf("error building database schema: %w", err)
@@ -54,7 +89,7 @@ func (p *postgresqlDriver) refreshSchema(ctx context.Context, db *sql.DB, failIf
 	return nil
 }
 
-func (p *postgresqlDriver) connectToDB(ctx context.Context, url string) (*sql.DB, error) {
+func (p *postgresqlDriver) openDB(ctx context.Context, url string) (*sql.DB, error) {
 	urlstr, err := GetConnectionStringFromURL(url)
 	if err != nil {
 		return nil, err
@@ -69,25 +104,118 @@ func (p *postgresqlDriver) connectToDB(ctx context.Context, url string) (*sql.DB
 		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	if err := p.refreshSchema(ctx, db, false); err != nil {
-		db.Close()
-		return nil, err
+func (p *postgresqlDriver) connectToDB(ctx context.Context, url string) (*sql.DB, *sql.DB, error) {
+	url, timeout, err := util.ParseStatementTimeout(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.statementTimeout = timeout
+	url, interval, err := util.ParsePingInterval(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.pingInterval = interval
+	url, events, err := parseEventsMode(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.events = events
+	url, geo, err := util.ParseGeoColumns(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.geo = geo
+	url, p.hypertables, err = parseHypertables(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(p.hypertables) > 0 && p.cockroach {
+		return nil, nil, fmt.Errorf("hypertables require timescaledb which isn't supported by cockroachdb")
+	}
+	if p.cockroach {
+		url, p.asOf, err = parseAsOfSystemTime(url)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	db, reader, err := util.OpenWithReadReplica(ctx, url, p.openDB)
+	if err != nil {
+		return nil, nil, err
+	}
+	// cockroachdb has built-in spatial support so it doesn't have the postgis extension
+	if len(geo) > 0 && !p.cockroach {
+		var count int
+		if err := reader.QueryRowContext(ctx, hasPostGISSQL).Scan(&count); err != nil {
+			util.CloseWithReadReplica(db, reader)
+			return nil, nil, fmt.Errorf("error checking for postgis extension: %w", err)
+		}
+		if count == 0 {
+			util.CloseWithReadReplica(db, reader)
+			return nil, nil, fmt.Errorf("the postgis extension is required for geo columns")
+		}
+	}
+	if len(p.hypertables) > 0 {
+		var count int
+		if err := reader.QueryRowContext(ctx, hasTimescaleSQL).Scan(&count); err != nil {
+			util.CloseWithReadReplica(db, reader)
+			return nil, nil, fmt.Errorf("error checking for timescaledb extension: %w", err)
+		}
+		if count == 0 {
+			util.CloseWithReadReplica(db, reader)
+			return nil, nil, fmt.Errorf("the timescaledb extension is required for hypertables")
+		}
+	}
+	if err := p.refreshSchema(ctx, reader, false); err != nil {
+		util.CloseWithReadReplica(db, reader)
+		return nil, nil, err
 	}
+	return db, reader, nil
+}
 
-	return db, nil
+// createEventsTable creates the events table, converting it to a hypertable when TimescaleDB is installed.
+func (p *postgresqlDriver) createEventsTable(ctx context.Context, db *sql.DB, executor func(string) error) error {
+	if err := executor(createEventsTableSQL(p.events.table)); err != nil {
+		return fmt.Errorf("error creating events table: %s. %w", p.events.table, err)
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, hasTimescaleSQL).Scan(&count); err != nil {
+		return fmt.Errorf("error checking for timescaledb extension: %w", err)
+	}
+	if count == 0 {
+		p.logger.Warn("timescaledb extension is not installed, events table %s will be a regular table", p.events.table)
+		return nil
+	}
+	if err := executor(createHypertableSQL(p.events.table)); err != nil {
+		return fmt.Errorf("error creating hypertable for events table: %s. %w", p.events.table, err)
+	}
+	return nil
 }
 
 // Start the driver. This is called once at the beginning of the driver's lifecycle.
 func (p *postgresqlDriver) Start(config internal.DriverConfig) error {
-	p.logger = config.Logger.WithPrefix("[postgres]")
-	db, err := p.connectToDB(config.Context, config.URL)
+	p.logger = config.Logger.WithPrefix(p.logPrefix())
+	db, reader, err := p.connectToDB(config.Context, config.URL)
 	if err != nil {
 		return err
 	}
+	if p.events.enabled {
+		if err := p.createEventsTable(config.Context, db, util.SQLExecuter(config.Context, p.logger, db, false)); err != nil {
+			util.CloseWithReadReplica(db, reader)
+			return err
+		}
+	}
 	p.registry = config.SchemaRegistry
 	p.db = db
-	p.ctx = config.Context
+	p.reader = reader
+	p.ctx, p.cancel = context.WithCancel(config.Context)
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+		util.MonitorConnection(p.ctx, p.logger, p.pingInterval, db, reader)
+	}()
 	return nil
 }
 
@@ -95,13 +223,17 @@ func (p *postgresqlDriver) Start(config internal.DriverConfig) error {
 func (p *postgresqlDriver) Stop() error {
 	p.logger.Debug("stopping")
 	p.once.Do(func() {
+		if p.cancel != nil {
+			p.cancel() // cancel any running statements so a hung query doesn't block shutdown
+		}
 		p.logger.Debug("waiting on waitgroup")
 		p.waitGroup.Wait()
 		p.logger.Debug("completed waitgroup")
 		if p.db != nil {
 			p.logger.Debug("closing db")
-			p.db.Close()
+			util.CloseWithReadReplica(p.db, p.reader)
 			p.db = nil
+			p.reader = nil
 			p.logger.Debug("closed db")
 		}
 	})
@@ -120,29 +252,79 @@ func (p *postgresqlDriver) Process(logger logger.Logger, event internal.DBChange
 	logger.Trace("processing event: %s", event.String())
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
+	if p.events.enabled {
+		p.eventRows = append(p.eventRows, toEventValuesSQL(event))
+		p.count++
+		return false, nil
+	}
 	schema, err := p.registry.GetSchema(event.Table, event.ModelVersion)
 	if err != nil {
 		return false, fmt.Errorf("unable to get schema for table: %s (%s). %w", event.Table, event.ModelVersion, err)
 	}
-	sql, err := toSQL(event, schema)
-	if err != nil {
-		return false, err
+	schema = p.geo.Apply(schema)
+	var sql string
+	switch {
+	case p.hypertables[event.Table] != "" && event.Operation != "DELETE":
+		object, err := event.GetObject()
+		if err != nil {
+			return false, err
+		}
+		sql = toSQLFromObjectWithConflict(event.Operation, schema, event.Table, object, event.Diff, p.hypertables.conflict(schema))
+	case p.cockroach && event.Operation == "INSERT":
+		object, err := event.GetObject()
+		if err != nil {
+			return false, err
+		}
+		sql = toUpsertSQLFromObject(schema, event.Table, object)
+	default:
+		sql, err = toSQL(event, schema)
+		if err != nil {
+			return false, err
+		}
 	}
 	logger.Trace("sql: %s", sql)
-	if _, err := p.pending.WriteString(sql); err != nil {
-		return false, fmt.Errorf("error writing sql to pending buffer: %w", err)
-	}
+	p.addStatement(sql)
 	p.count++
 	return false, nil
 }
 
+// addStatement adds the statement to the pending batch.
+func (p *postgresqlDriver) addStatement(sql string) {
+	if p.cockroach {
+		p.statements = append(p.statements, sql)
+	} else {
+		p.pending.WriteString(sql)
+	}
+}
+
+// addEventRows adds the pending rows for the events table to the batch as multi-row inserts.
+func (p *postgresqlDriver) addEventRows() {
+	if len(p.eventRows) == 0 {
+		return
+	}
+	for _, sql := range toEventsSQL(p.events.table, p.eventRows) {
+		p.addStatement(sql)
+	}
+	p.eventRows = nil
+}
+
 // Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
 func (p *postgresqlDriver) Flush(logger logger.Logger) error {
 	logger.Debug("flush")
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
-	if p.count > 0 {
-		tx, err := p.db.BeginTx(p.ctx, nil)
+	p.addEventRows()
+	if p.count > 0 && p.cockroach {
+		ctx, cancel := util.StatementContext(p.ctx, p.statementTimeout)
+		defer cancel()
+		if err := runCockroachTx(ctx, logger, p.db, p.statements); err != nil {
+			return err
+		}
+		logger.Debug("flushed %d records", p.count)
+	} else if p.count > 0 {
+		ctx, cancel := util.StatementContext(p.ctx, p.statementTimeout)
+		defer cancel()
+		tx, err := p.db.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("unable to start transaction: %w", err)
 		}
@@ -152,7 +334,7 @@ func (p *postgresqlDriver) Flush(logger logger.Logger) error {
 				tx.Rollback()
 			}
 		}()
-		if _, err := tx.ExecContext(p.ctx, p.pending.String()); err != nil {
+		if _, err := tx.ExecContext(ctx, p.pending.String()); err != nil {
 			logger.Error("offending sql: %s", p.pending.String())
 			return fmt.Errorf("unable to execute sql: %w", err)
 		}
@@ -163,17 +345,22 @@ func (p *postgresqlDriver) Flush(logger logger.Logger) error {
 		logger.Debug("flushed %d records", p.count)
 	}
 	p.pending.Reset()
+	p.statements = nil
 	p.count = 0
 	return nil
 }
 
 // CreateDatasource allows the handler to create the datasource before importing data.
 func (p *postgresqlDriver) CreateDatasource(schema internal.SchemaMap) error {
+	if p.events.enabled {
+		// the event history is append-only so the events table is never dropped
+		return p.createEventsTable(p.importConfig.Context, p.db, p.executor)
+	}
 	// create all the tables
 	for _, table := range p.importConfig.Tables {
-		data := schema[table]
+		data := p.geo.Apply(schema[table])
 		p.logger.Debug("creating table %s", table)
-		if err := p.executor(createSQL(data)); err != nil {
+		if err := p.executor(p.hypertables.createSQL(data)); err != nil {
 			return fmt.Errorf("error creating table: %s. %w", table, err)
 		}
 		p.logger.Debug("created table %s", table)
@@ -183,15 +370,55 @@ func (p *postgresqlDriver) CreateDatasource(schema internal.SchemaMap) error {
 
 // ImportEvent allows the handler to process the event.
 func (p *postgresqlDriver) ImportEvent(event internal.DBChangeEvent, data *internal.Schema) error {
+	if p.events.enabled {
+		row := toEventValuesSQL(event)
+		p.eventRows = append(p.eventRows, row)
+		p.count++
+		p.size += len(row)
+		if p.size >= maxBytesSizeInsert {
+			return p.FlushBatch()
+		}
+		return nil
+	}
 	object, err := event.GetObject()
 	if err != nil {
 		return err
 	}
-	sql := toSQLFromObject("INSERT", data, event.Table, object, nil)
-	p.pending.WriteString(sql)
+	data = p.geo.Apply(data)
+	var sql string
+	if p.cockroach {
+		// upserts make the import safe to run again over existing rows
+		sql = toUpsertSQLFromObject(data, event.Table, object)
+	} else {
+		sql = toSQLFromObjectWithConflict("INSERT", data, event.Table, object, nil, p.hypertables.conflict(data))
+	}
+	p.addStatement(sql)
 	p.count++
 	p.size += len(sql)
-	if p.size >= maxBytesSizeInsert || p.importConfig.Single {
+	if p.size >= maxBytesSizeInsert {
+		return p.FlushBatch()
+	}
+	return nil
+}
+
+// ImportBatchLimits returns no driver specific limits since ImportEvent flushes the batch once its statements reach
+// their maximum size.
+func (p *postgresqlDriver) ImportBatchLimits() (int, int) {
+	return 0, 0
+}
+
+// FlushBatch executes the pending insert statements.
+func (p *postgresqlDriver) FlushBatch() error {
+	p.addEventRows()
+	if p.size > 0 && p.cockroach {
+		if p.importConfig.DryRun {
+			p.logger.Info("[dry-run] %d statements", len(p.statements))
+		} else if err := runCockroachTx(p.importConfig.Context, p.logger, p.db, p.statements); err != nil {
+			return err
+		}
+		p.statements = nil
+		p.size = 0
+	} else if p.size > 0 {
 		if err := p.executor(p.pending.String()); err != nil {
 			p.logger.Error("offending sql: %s", p.pending.String())
 			return fmt.Errorf("unable to execute sql: %w", err)
@@ -204,28 +431,26 @@ func (p *postgresqlDriver) ImportEvent(event internal.DBChangeEvent, data *inter
 
 // ImportCompleted is called when all events have been processed.
 func (p *postgresqlDriver) ImportCompleted() error {
-	if p.size > 0 {
-		if err := p.executor(p.pending.String()); err != nil {
-			p.logger.Error("offending sql: %s", p.pending.String())
-			return fmt.Errorf("unable to execute sql: %w", err)
-		}
-	}
-	return nil
+	return p.FlushBatch()
 }
 
 // Import is called to import data from the source.
 func (p *postgresqlDriver) Import(config internal.ImporterConfig) error {
-	p.logger = config.Logger.WithPrefix("[postgres]")
-	db, err := p.connectToDB(config.Context, config.URL)
+	p.logger = config.Logger.WithPrefix(p.logPrefix())
+	db, reader, err := p.connectToDB(config.Context, config.URL)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer util.CloseWithReadReplica(db, reader)
 
+	p.db = db
+	p.reader = reader
 	p.registry = config.SchemaRegistry
 	p.importConfig = config
 	p.executor = util.SQLExecuter(config.Context, p.logger, db, config.DryRun)
 	p.pending = strings.Builder{}
+	p.statements = nil
+	p.eventRows = nil
 	p.count = 0
 	p.size = 0
 
@@ -234,16 +459,25 @@ func (p *postgresqlDriver) Import(config internal.ImporterConfig) error {
 
 // Name is a unique name for the driver.
 func (p *postgresqlDriver) Name() string {
+	if p.cockroach {
+		return "CockroachDB"
+	}
 	return "PostgreSQL"
 }
 
 // Description is the description of the driver.
 func (p *postgresqlDriver) Description() string {
+	if p.cockroach {
+		return "Supports streaming EDS messages to a CockroachDB database."
+	}
 	return "Supports streaming EDS messages to a PostgreSQL database."
 }
 
 // ExampleURL should return an example URL for configuring the driver.
 func (p *postgresqlDriver) ExampleURL() string {
+	if p.cockroach {
+		return "cockroach://localhost:26257/database"
+	}
 	return "postgres://localhost:5432/database"
 }
 
@@ -251,44 +485,80 @@ func (p *postgresqlDriver) ExampleURL() string {
 func (p *postgresqlDriver) Help() string {
 	var help strings.Builder
 	help.WriteString(util.GenerateHelpSection("Schema", "The database will match the public schema from the Shopmonkey transactional database.\n"))
+	help.WriteString("\n")
+	if p.cockroach {
+		help.WriteString(util.GenerateHelpSection("Transactions", "Inserts are written with UPSERT and a transaction which is aborted by a conflict with another transaction (40001) is retried\nwith a backoff. The statements of a batch are sent in groups instead of a single multi-statement batch.\n"))
+		help.WriteString("\n")
+		help.WriteString(util.GenerateHelpSection("As Of System Time", "Add asOf=follower or asOf=-10s to read the schema on startup and before an import AS OF SYSTEM TIME so it doesn't wait on\nconcurrent writes. The import uses UPSERT so it can be run again over existing rows.\n"))
+		help.WriteString("\n")
+	}
+	help.WriteString(util.GenerateHelpSection("Read Replica", "Add readURL=url (url encoded) to query the schema from a read replica instead of the primary. Writes always go to the primary.\nThe read replica uses the credentials from the primary when its url doesn't have any.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Events Mode", "Add mode=events to append every change event to a single events table (eds_events or the name provided with eventsTable=name) instead of\nmaintaining the current state of each table. Each row has the event timestamp, table, operation, key, diff and the before and after JSON.\nWhen the TimescaleDB extension is installed the table is created as a hypertable partitioned by the event timestamp.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Hypertables", "Add hypertable=table.column (repeated or comma separated) to create a table as a TimescaleDB hypertable partitioned by the time column\nsuch as hypertable=order.createdDate. The time column is added to the primary key and is required. The TimescaleDB extension must be installed.\nThe events table in events mode is always a hypertable when TimescaleDB is installed and its rows are written with multi-row inserts.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Geo Columns", "Add geo=table.column (repeated or comma separated) to store a column as a PostGIS geography so spatial queries work without casts.\nThe value can be GeoJSON, an object with lat and lng properties or a \"lat,lng\" string, other values are stored as NULL.\nThe PostGIS extension must be installed. The column type is only changed when the table is created or the column is added.\n"))
 	return help.String()
 }
 
 func (p *postgresqlDriver) Aliases() []string {
+	if p.cockroach {
+		return []string{"cockroachdb", "crdb"}
+	}
 	return []string{"postgresql"}
 }
 
 // Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
 func (p *postgresqlDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
-	p.logger = logger.WithPrefix("[postgres]")
-	db, err := p.connectToDB(ctx, url)
+	p.logger = logger.WithPrefix(p.logPrefix())
+	db, reader, err := p.connectToDB(ctx, url)
 	if err != nil {
 		return err
 	}
-	return db.Close()
+	return util.CloseWithReadReplica(db, reader)
 }
 
 // Configuration returns the configuration fields for the driver.
 func (p *postgresqlDriver) Configuration() []internal.DriverField {
-	return internal.NewDatabaseConfiguration(5432)
+	if p.cockroach {
+		return append(internal.NewDatabaseConfiguration(cockroachDefaultPort), internal.ReadReplicaField())
+	}
+	return append(internal.NewDatabaseConfiguration(5432),
+		internal.ReadReplicaField(),
+		internal.OptionalBooleanField("Events Mode", "Append every change event to an events table instead of maintaining the current state of each table", false),
+	)
 }
 
 // Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
 func (p *postgresqlDriver) Validate(values map[string]any) (string, []internal.FieldError) {
-	return internal.URLFromDatabaseConfiguration("postgres", 5432, values), nil
+	if p.cockroach {
+		url := internal.URLFromDatabaseConfiguration("cockroach", cockroachDefaultPort, values)
+		return internal.AppendReadURLFromDatabaseConfiguration(url, "cockroach", cockroachDefaultPort, values), nil
+	}
+	url := internal.URLFromDatabaseConfiguration("postgres", 5432, values)
+	if internal.GetOptionalBoolValue("Events Mode", false, values) {
+		url += "?mode=events"
+	}
+	return internal.AppendReadURLFromDatabaseConfiguration(url, "postgres", 5432, values), nil
 }
 
 // MigrateNewTable is called when a new table is detected with the appropriate information for the driver to perform the migration.
 func (p *postgresqlDriver) MigrateNewTable(ctx context.Context, logger logger.Logger, schema *internal.Schema) error {
+	if p.events.enabled {
+		return nil // the events table doesn't depend on the table schema
+	}
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
 	if _, ok := p.dbschema[schema.Table]; ok {
 		logger.Info("table already exists for: %s, dropping and recreating...", schema.Table)
 		if err := util.DropTable(ctx, logger, p.db, quoteIdentifier(schema.Table)); err != nil {
 			return err
 		}
 	}
-	sql := createSQL(schema)
+	sql := p.hypertables.createSQL(p.geo.Apply(schema))
 	logger.Trace("migrate new table: %s", sql)
 	if _, err := p.db.ExecContext(ctx, sql); err != nil {
 		return err
@@ -298,9 +568,14 @@ func (p *postgresqlDriver) MigrateNewTable(ctx context.Context, logger logger.Lo
 
 // MigrateNewColumns is called when one or more new columns are detected with the appropriate information for the driver to perform the migration.
 func (p *postgresqlDriver) MigrateNewColumns(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns []string) error {
+	if p.events.enabled {
+		return nil
+	}
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
-	sqls := addNewColumnsSQL(logger, columns, schema, p.dbschema)
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	sqls := addNewColumnsSQL(logger, columns, p.geo.Apply(schema), p.dbschema)
 	for _, sql := range sqls {
 		logger.Trace("migrating new columns: %s", sql)
 		_, err := p.db.ExecContext(ctx, sql)
@@ -312,7 +587,88 @@ func (p *postgresqlDriver) MigrateNewColumns(ctx context.Context, logger logger.
 	return p.refreshSchema(ctx, p.db, true)
 }
 
+// MissingColumns reloads the destination schema and returns the columns of the schemas which are missing from their tables.
+func (p *postgresqlDriver) MissingColumns(ctx context.Context, logger logger.Logger, schemas []*internal.Schema) (map[string][]string, error) {
+	if p.events.enabled {
+		return nil, nil
+	}
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	if err := p.refreshSchema(ctx, p.db, false); err != nil {
+		return nil, err
+	}
+	return util.MissingColumns(p.dbschema, schemas), nil
+}
+
+// Snapshot writes the rows of the table as CSV.
+func (p *postgresqlDriver) Snapshot(ctx context.Context, logger logger.Logger, table string, limit int, w io.Writer) error {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	if p.reader == nil {
+		return internal.ErrDriverStopped
+	}
+	name, ok := util.FindTable(p.dbschema, table)
+	if !ok {
+		return internal.ErrTableNotFound
+	}
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	count, err := util.WriteCSVRows(ctx, p.reader, snapshotSQL(name, limit), w)
+	if err != nil {
+		return fmt.Errorf("error reading table %s: %w", name, err)
+	}
+	logger.Debug("wrote %d rows of table %s", count, name)
+	return nil
+}
+
+// Lookup returns true if the change of the event is in the destination. The primary is checked since a read replica can
+// be behind it.
+func (p *postgresqlDriver) Lookup(ctx context.Context, logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	if p.db == nil {
+		return false, internal.ErrDriverStopped
+	}
+	var query string
+	if p.events.enabled {
+		query = lookupEventSQL(p.events.table, event.ID)
+	} else {
+		name, ok := util.FindTable(p.dbschema, event.Table)
+		if !ok {
+			return false, internal.ErrTableNotFound
+		}
+		schema, err := p.registry.GetSchema(event.Table, event.ModelVersion)
+		if err != nil {
+			return false, fmt.Errorf("unable to get schema for table: %s (%s). %w", event.Table, event.ModelVersion, err)
+		}
+		var updatedDate string
+		if _, ok := schema.Properties["updatedDate"]; ok && event.Operation == "UPDATE" {
+			if object, err := event.GetObject(); err == nil {
+				updatedDate, _ = object["updatedDate"].(string)
+			}
+		}
+		if query, err = lookupSQL(name, schema.PrimaryKeys, event.Key, updatedDate); err != nil {
+			return false, err
+		}
+	}
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	var found bool
+	if err := p.db.QueryRowContext(ctx, query).Scan(&found); err != nil {
+		return false, fmt.Errorf("error looking up event %s: %w", event.ID, err)
+	}
+	logger.Trace("looked up event %s: %v", event.ID, found)
+	if event.Operation == "DELETE" && !p.events.enabled {
+		return !found, nil // the row of a delete is gone once it's applied
+	}
+	return found, nil
+}
+
 func init() {
 	internal.RegisterDriver("postgres", &postgresqlDriver{})
 	internal.RegisterImporter("postgres", &postgresqlDriver{})
+	internal.RegisterDriver("cockroach", &postgresqlDriver{cockroach: true})
+	internal.RegisterImporter("cockroach", &postgresqlDriver{cockroach: true})
 }
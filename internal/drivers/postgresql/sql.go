@@ -127,17 +127,29 @@ func quoteValue(arg any) (str string) {
 	return str
 }
 
-var needsQuote = regexp.MustCompile(`[A-Z0-9_\s]`)
-var keywords = regexp.MustCompile(`(?i)\b(USER|SELECT|INSERT|UPDATE|DELETE|FROM|WHERE|JOIN|LEFT|RIGHT|INNER|GROUP BY|ORDER BY|HAVING|AND|OR|CREATE|DROP|ALTER|TABLE|INDEX|ON|INTO|VALUES|SET|AS|DISTINCT|TYPE|DEFAULT|ORDER|GROUP|LIMIT|SUM|TOTAL|START|END|BEGIN|COMMIT|ROLLBACK|PRIMARY|AUTHORIZATION)\b`)
+// quotePropertyValue returns the SQL value for a column. Geo columns are converted from GeoJSON to a geography and are
+// NULL when the value isn't a location.
+func quotePropertyValue(val any, prop internal.SchemaProperty) string {
+	if prop.IsGeography() {
+		if geojson, ok := util.ToGeoJSON(val); ok {
+			return "ST_GeomFromGeoJSON(" + quoteString(geojson) + ")::geography"
+		}
+		return "NULL"
+	}
+	return quoteValue(util.ToBinaryValue(val, prop))
+}
 
 func quoteIdentifier(val string) string {
-	if needsQuote.MatchString(val) || keywords.MatchString(val) {
-		return pq.QuoteIdentifier(val)
-	}
-	return val
+	return util.PostgresIdentifiers.QuoteIfNeeded(val)
 }
 
 func toSQLFromObject(operation string, model *internal.Schema, table string, o map[string]any, diff []string) string {
+	return toSQLFromObjectWithConflict(operation, model, table, o, diff, "id")
+}
+
+// toSQLFromObjectWithConflict returns the upsert statement for the row where conflict is the comma separated columns
+// of the unique constraint to upsert on.
+func toSQLFromObjectWithConflict(operation string, model *internal.Schema, table string, o map[string]any, diff []string, conflict string) string {
 	var sql strings.Builder
 	sql.WriteString("INSERT INTO ")
 	sql.WriteString(quoteIdentifier(table))
@@ -157,7 +169,7 @@ func toSQLFromObject(operation string, model *internal.Schema, table string, o m
 			}
 			prop := model.Properties[name]
 			if val, ok := o[name]; ok {
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, true)
+				v := util.ToJSONStringVal(name, quotePropertyValue(val, prop), prop, true)
 				updateValues = append(updateValues, fmt.Sprintf("%s=%s", quoteIdentifier(name), v))
 			} else {
 				v := util.ToJSONStringVal(name, "NULL", prop, true)
@@ -167,7 +179,7 @@ func toSQLFromObject(operation string, model *internal.Schema, table string, o m
 		for _, name := range model.Columns() {
 			prop := model.Properties[name]
 			if val, ok := o[name]; ok {
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, true)
+				v := util.ToJSONStringVal(name, quotePropertyValue(val, prop), prop, true)
 				insertVals = append(insertVals, v)
 			} else {
 				v := util.ToJSONStringVal(name, "NULL", prop, true)
@@ -178,7 +190,7 @@ func toSQLFromObject(operation string, model *internal.Schema, table string, o m
 		for _, name := range model.Columns() {
 			prop := model.Properties[name]
 			if val, ok := o[name]; ok {
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, true)
+				v := util.ToJSONStringVal(name, quotePropertyValue(val, prop), prop, true)
 				if name != "id" {
 					updateValues = append(updateValues, fmt.Sprintf("%s=%s", quoteIdentifier(name), v))
 				}
@@ -191,7 +203,9 @@ func toSQLFromObject(operation string, model *internal.Schema, table string, o m
 		}
 	}
 	sql.WriteString(strings.Join(insertVals, ","))
-	sql.WriteString(") ON CONFLICT (id) DO ")
+	sql.WriteString(") ON CONFLICT (")
+	sql.WriteString(conflict)
+	sql.WriteString(") DO ")
 	if len(updateValues) == 0 {
 		sql.WriteString("NOTHING")
 	} else {
@@ -231,6 +245,12 @@ func propTypeToSQLType(property internal.SchemaProperty) string {
 		if property.Format == "date-time" {
 			return "TIMESTAMP WITH TIME ZONE"
 		}
+		if property.IsBinary() {
+			return "BYTEA"
+		}
+		if property.IsGeography() {
+			return "GEOGRAPHY(GEOMETRY, 4326)"
+		}
 		return "TEXT"
 	case "integer":
 		return "BIGINT"
@@ -318,9 +338,13 @@ func GetConnectionStringFromURL(urlstr string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("error parsing postgres db url: %w", err)
 	}
+	port := "5432"
+	if isCockroachScheme(u.Scheme) {
+		port = strconv.Itoa(cockroachDefaultPort)
+	}
 	u.Scheme = "postgresql"
 	if u.Port() == "" {
-		u.Host = u.Host + ":5432"
+		u.Host = u.Host + ":" + port
 	}
 	var reencode bool
 	q := u.Query()
@@ -337,3 +361,29 @@ func GetConnectionStringFromURL(urlstr string) (string, error) {
 	}
 	return u.String(), nil
 }
+
+// snapshotSQL returns the query for the rows of the table, all of them if the limit is 0.
+func snapshotSQL(table string, limit int) string {
+	sql := "SELECT * FROM " + quoteIdentifier(table)
+	if limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return sql
+}
+
+// lookupSQL returns the query for whether the table has the row with the primary key of the event, and with the
+// updatedDate of an update or a newer one if it's set.
+func lookupSQL(table string, primaryKeys []string, key []string, updatedDate string) (string, error) {
+	if len(key) < len(primaryKeys)+1 {
+		return "", fmt.Errorf("event key %v doesn't have a value for each of the primary keys %v", key, primaryKeys)
+	}
+	var predicate []string
+	for i, pk := range primaryKeys {
+		predicate = append(predicate, fmt.Sprintf("%s=%s", quoteIdentifier(pk), quoteValue(key[1+i])))
+	}
+	if updatedDate != "" {
+		// an update is only applied once the row has its version or a newer one
+		predicate = append(predicate, fmt.Sprintf("%s>=%s", quoteIdentifier("updatedDate"), quoteValue(updatedDate)))
+	}
+	return "SELECT EXISTS (SELECT 1 FROM " + quoteIdentifier(table) + " WHERE " + strings.Join(predicate, " AND ") + ")", nil
+}
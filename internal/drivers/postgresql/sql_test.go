@@ -3,8 +3,11 @@ package postgresql
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"testing"
 
+	"github.com/lib/pq"
 	"github.com/shopmonkeyus/eds/internal"
 	"github.com/shopmonkeyus/eds/internal/registry"
 	"github.com/shopmonkeyus/eds/internal/util"
@@ -117,3 +120,82 @@ func TestAddNewColumnsSQLSkip(t *testing.T) {
 	sql := addNewColumnsSQL(logger, []string{"number", "internalNumber", "externalNumber"}, detail, internal.DatabaseSchema{"order": {"number": "TEXT"}})
 	assert.Equal(t, []string{"ALTER TABLE \"order\" ADD COLUMN \"internalNumber\" TEXT;", "ALTER TABLE \"order\" ADD COLUMN \"externalNumber\" TEXT;"}, sql)
 }
+
+func TestBinarySQL(t *testing.T) {
+	schema := &internal.Schema{Table: "file", PrimaryKeys: []string{"id"}, Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "data": {Type: "string", Format: "byte"}}}
+	assert.Equal(t, "BYTEA", propTypeToSQLType(schema.Properties["data"]))
+	sql := toSQLFromObject("INSERT", schema, "file", map[string]any{"id": "1", "data": "aGk="}, nil)
+	assert.Equal(t, "INSERT INTO file (id,data) VALUES ('1','\\x6869') ON CONFLICT (id) DO UPDATE SET data='\\x6869';\n", sql)
+}
+
+func TestGeographySQL(t *testing.T) {
+	schema := util.GeoColumns{"location": {"coordinates": true}}.Apply(&internal.Schema{Table: "location", PrimaryKeys: []string{"id"}, Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "coordinates": {Type: "object"}}})
+	assert.Equal(t, "GEOGRAPHY(GEOMETRY, 4326)", propTypeToSQLType(schema.Properties["coordinates"]))
+	sql := toSQLFromObject("INSERT", schema, "location", map[string]any{"id": "1", "coordinates": map[string]any{"lat": 37.7, "lng": -122.4}}, nil)
+	assert.Equal(t, "INSERT INTO location (id,coordinates) VALUES ('1',ST_GeomFromGeoJSON('{\"coordinates\":[-122.4,37.7],\"type\":\"Point\"}')::geography) ON CONFLICT (id) DO UPDATE SET coordinates=ST_GeomFromGeoJSON('{\"coordinates\":[-122.4,37.7],\"type\":\"Point\"}')::geography;\n", sql)
+	sql = toSQLFromObject("INSERT", schema, "location", map[string]any{"id": "1", "coordinates": "unknown"}, nil)
+	assert.Equal(t, "INSERT INTO location (id,coordinates) VALUES ('1',NULL) ON CONFLICT (id) DO UPDATE SET coordinates=NULL;\n", sql)
+}
+
+func TestCockroachValidate(t *testing.T) {
+	driver := postgresqlDriver{cockroach: true}
+	url, err := driver.Validate(map[string]any{
+		"Database": "db",
+		"Hostname": "hostname",
+	})
+	assert.Empty(t, err)
+	assert.Equal(t, "cockroach://hostname:26257/db", url)
+
+	val, cerr := GetConnectionStringFromURL("cockroach://localhost/db")
+	assert.NoError(t, cerr)
+	assert.Equal(t, "postgresql://localhost:26257/db?application_name=eds&sslmode=disable", val)
+}
+
+func TestParseAsOfSystemTime(t *testing.T) {
+	url, asOf, err := parseAsOfSystemTime("cockroach://localhost/db?asOf=follower&sslmode=disable")
+	assert.NoError(t, err)
+	assert.Equal(t, "cockroach://localhost/db?sslmode=disable", url)
+	assert.Equal(t, "follower_read_timestamp()", asOf)
+
+	_, asOf, err = parseAsOfSystemTime("cockroach://localhost/db?asOf=-10s")
+	assert.NoError(t, err)
+	assert.Equal(t, "'-10s'", asOf)
+
+	url, asOf, err = parseAsOfSystemTime("cockroach://localhost/db")
+	assert.NoError(t, err)
+	assert.Equal(t, "cockroach://localhost/db", url)
+	assert.Empty(t, asOf)
+
+	_, _, err = parseAsOfSystemTime("cockroach://localhost/db?asOf=10s")
+	assert.Error(t, err)
+}
+
+func TestUpsertSQL(t *testing.T) {
+	schema := &internal.Schema{Table: "file", PrimaryKeys: []string{"id"}, Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "name": {Type: "string"}, "size": {Type: "integer"}}}
+	sql := toUpsertSQLFromObject(schema, "file", map[string]any{"id": "1", "name": "a"})
+	assert.Equal(t, "UPSERT INTO file (id,name,size) VALUES ('1','a',NULL);\n", sql)
+}
+
+func TestIsCockroachRetryable(t *testing.T) {
+	assert.True(t, isCockroachRetryable(&pq.Error{Code: "40001", Message: "restart transaction"}))
+	assert.True(t, isCockroachRetryable(fmt.Errorf("unable to commit transaction: %w", &pq.Error{Code: "40001"})))
+	assert.False(t, isCockroachRetryable(&pq.Error{Code: "23505"}))
+	assert.False(t, isCockroachRetryable(errors.New("connection refused")))
+}
+
+func TestLookupSQL(t *testing.T) {
+	sql, err := lookupSQL("order", []string{"id"}, []string{"CID", "1"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT EXISTS (SELECT 1 FROM "order" WHERE id='1')`, sql)
+	sql, err = lookupSQL("order", []string{"id"}, []string{"CID", "1"}, "2024-10-02T12:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT EXISTS (SELECT 1 FROM "order" WHERE id='1' AND "updatedDate">='2024-10-02T12:00:00Z')`, sql)
+	_, err = lookupSQL("order", []string{"id", "companyId"}, []string{"CID", "1"}, "")
+	assert.Error(t, err)
+	assert.Equal(t, `SELECT EXISTS (SELECT 1 FROM "eds_events" WHERE id='e1')`, lookupEventSQL("eds_events", "e1"))
+}
+
+func TestSnapshotSQL(t *testing.T) {
+	assert.Equal(t, `SELECT * FROM "order" LIMIT 10`, snapshotSQL("order", 10))
+	assert.Equal(t, `SELECT * FROM "order"`, snapshotSQL("order", 0))
+}
@@ -0,0 +1,94 @@
+package postgresql
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+// hypertables maps the tables which are created as TimescaleDB hypertables to the time column they're partitioned by.
+type hypertables map[string]string
+
+// parseHypertables removes the hypertable parameters from the url. Each value is a table.column such as
+// order.createdDate and can be repeated or comma separated.
+func parseHypertables(urlstr string) (string, hypertables, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing postgres db url: %w", err)
+	}
+	query := u.Query()
+	if !query.Has("hypertable") {
+		return urlstr, nil, nil
+	}
+	tables := make(hypertables)
+	for _, val := range query["hypertable"] {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			table, column, ok := strings.Cut(name, ".")
+			if !ok || table == "" || column == "" {
+				return "", nil, fmt.Errorf("invalid hypertable: %s (expected table.column)", name)
+			}
+			if existing, ok := tables[table]; ok && existing != column {
+				return "", nil, fmt.Errorf("invalid hypertable: %s (table %s is already partitioned by %s)", name, table, existing)
+			}
+			tables[table] = column
+		}
+	}
+	query.Del("hypertable")
+	u.RawQuery = query.Encode()
+	return u.String(), tables, nil
+}
+
+// primaryKeys returns the primary key of the table which must include the time column for a hypertable.
+func (h hypertables) primaryKeys(s *internal.Schema) []string {
+	column := h[s.Table]
+	if column == "" || util.SliceContains(s.PrimaryKeys, column) {
+		return s.PrimaryKeys
+	}
+	return append(append([]string{}, s.PrimaryKeys...), column)
+}
+
+// conflict returns the conflict target for upserting a row into the table.
+func (h hypertables) conflict(s *internal.Schema) string {
+	keys := h.primaryKeys(s)
+	if len(keys) == 0 || h[s.Table] == "" {
+		return "id"
+	}
+	var columns []string
+	for _, key := range keys {
+		columns = append(columns, quoteIdentifier(key))
+	}
+	return strings.Join(columns, ",")
+}
+
+// createSQL returns the statements to create the table, converting it to a hypertable when it's partitioned by time.
+// The time column is added to the primary key and is required since a hypertable's unique constraints must include it.
+func (h hypertables) createSQL(s *internal.Schema) string {
+	column := h[s.Table]
+	if column == "" {
+		return createSQL(s)
+	}
+	table := &internal.Schema{
+		Table:        s.Table,
+		ModelVersion: s.ModelVersion,
+		PrimaryKeys:  h.primaryKeys(s),
+		Required:     s.Required,
+		Properties:   make(map[string]internal.SchemaProperty, len(s.Properties)),
+	}
+	if !util.SliceContains(table.Required, column) {
+		table.Required = append(append([]string{}, s.Required...), column)
+	}
+	for name, prop := range s.Properties {
+		if name == column {
+			prop.Nullable = false
+		}
+		table.Properties[name] = prop
+	}
+	return createSQL(table) + fmt.Sprintf("SELECT create_hypertable(%s, %s, if_not_exists => TRUE, migrate_data => TRUE);\n", quoteString(quoteIdentifier(s.Table)), quoteString(column))
+}
@@ -0,0 +1,47 @@
+package postgresql
+
+import (
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHypertables(t *testing.T) {
+	url, tables, err := parseHypertables("postgres://localhost:5432/db?sslmode=disable")
+	assert.NoError(t, err)
+	assert.Nil(t, tables)
+	assert.Equal(t, "postgres://localhost:5432/db?sslmode=disable", url)
+
+	url, tables, err = parseHypertables("postgres://localhost:5432/db?hypertable=order.createdDate,appointment.startDate&hypertable=inspection.createdDate")
+	assert.NoError(t, err)
+	assert.Equal(t, hypertables{"order": "createdDate", "appointment": "startDate", "inspection": "createdDate"}, tables)
+	assert.Equal(t, "postgres://localhost:5432/db", url)
+
+	_, _, err = parseHypertables("postgres://localhost:5432/db?hypertable=order")
+	assert.EqualError(t, err, "invalid hypertable: order (expected table.column)")
+	_, _, err = parseHypertables("postgres://localhost:5432/db?hypertable=order.createdDate,order.updatedDate")
+	assert.EqualError(t, err, "invalid hypertable: order.updatedDate (table order is already partitioned by createdDate)")
+}
+
+func TestHypertableSQL(t *testing.T) {
+	schema := &internal.Schema{Table: "order", PrimaryKeys: []string{"id"}, Properties: map[string]internal.SchemaProperty{"id": {Type: "string"}, "createdDate": {Type: "string", Format: "date-time", Nullable: true}, "name": {Type: "string"}}}
+	tables := hypertables{"order": "createdDate"}
+
+	assert.Equal(t, `CREATE TABLE "order" (
+	id TEXT,
+	"createdDate" TIMESTAMP WITH TIME ZONE NOT NULL,
+	name TEXT,
+	PRIMARY KEY (id, "createdDate")
+);
+SELECT create_hypertable('"order"', 'createdDate', if_not_exists => TRUE, migrate_data => TRUE);
+`, tables.createSQL(schema)[len(`DROP TABLE IF EXISTS "order";`)+1:])
+	assert.Equal(t, []string{"id"}, schema.PrimaryKeys, "the schema isn't changed")
+	assert.Equal(t, createSQL(schema), hypertables{}.createSQL(schema))
+
+	assert.Equal(t, `id,"createdDate"`, tables.conflict(schema))
+	assert.Equal(t, "id", hypertables{}.conflict(schema))
+
+	sql := toSQLFromObjectWithConflict("INSERT", schema, "order", map[string]any{"id": "1", "createdDate": "2024-07-09T18:28:03Z", "name": "a"}, nil, tables.conflict(schema))
+	assert.Equal(t, `INSERT INTO "order" (id,"createdDate",name) VALUES ('1','2024-07-09T18:28:03Z','a') ON CONFLICT (id,"createdDate") DO UPDATE SET "createdDate"='2024-07-09T18:28:03Z',name='a';`+"\n", sql)
+}
@@ -17,9 +17,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/shopmonkeyus/eds/internal"
 	"github.com/shopmonkeyus/eds/internal/importer"
 	"github.com/shopmonkeyus/eds/internal/util"
@@ -56,9 +58,11 @@ func (lt *RecalculateV4Signature) RoundTrip(req *http.Request) (*http.Response,
 }
 
 type job struct {
-	logger logger.Logger
-	event  internal.DBChangeEvent
-	key    string
+	logger  logger.Logger
+	event   internal.DBChangeEvent
+	payload any // the event or a delta of the event
+	key     string
+	unique  bool // the key is derived from the stream sequence so an existing object means it was already written
 }
 
 type s3Driver struct {
@@ -74,14 +78,20 @@ type s3Driver struct {
 	errors       chan error
 	ctx          context.Context
 	cancel       context.CancelFunc
+	manifest     *util.ManifestBuilder
+	exactlyOnce  bool
+	window       time.Duration
+	aggregator   *util.Aggregator
+	delta        *util.DeltaEncoder
 }
 
 var _ internal.Driver = (*s3Driver)(nil)
 var _ internal.DriverLifecycle = (*s3Driver)(nil)
 var _ internal.DriverHelp = (*s3Driver)(nil)
+var _ internal.DriverAggregation = (*s3Driver)(nil)
 var _ internal.Importer = (*s3Driver)(nil)
 var _ internal.ImporterHelp = (*s3Driver)(nil)
-var _ importer.Handler = (*s3Driver)(nil)
+var _ importer.BatchHandler = (*s3Driver)(nil)
 
 func addFinalSlash(s string) string {
 	if s == "" {
@@ -277,6 +287,26 @@ func (p *s3Driver) connect(ctx context.Context, logger logger.Logger, urlString
 	p.prefix = prefix
 	p.s3 = client
 
+	if u, err := url.Parse(urlString); err == nil {
+		if u.Query().Get("manifest") == "true" {
+			p.manifest = &util.ManifestBuilder{}
+		}
+		p.exactlyOnce = u.Query().Get("exactlyOnce") == "true"
+		if val := u.Query().Get("window"); val != "" {
+			window, err := time.ParseDuration(val)
+			if err != nil || window < 0 {
+				return fmt.Errorf("invalid window: %s", val)
+			}
+			p.window = window
+		}
+		if p.delta, err = util.ParseDeltaEncoder(p.ctx, u.Query()); err != nil {
+			return err
+		}
+	}
+	if p.window > 0 {
+		p.aggregator = util.NewAggregator()
+	}
+
 	if testonly {
 		return nil
 	}
@@ -293,6 +323,23 @@ func (p *s3Driver) connect(ctx context.Context, logger logger.Logger, urlString
 	return nil
 }
 
+// exists returns true if the object has already been uploaded.
+func (p *s3Driver) exists(key string) (bool, error) {
+	_, err := p.s3.HeadObject(p.ctx, &awss3.HeadObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	var notFound *types.NotFound
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &notFound) || (errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound) {
+		return false, nil
+	}
+	return false, fmt.Errorf("error checking s3 object %s:%s: %w", p.bucket, key, err)
+}
+
 func (p *s3Driver) run() {
 	defer p.waitGroup.Done()
 	for {
@@ -300,7 +347,22 @@ func (p *s3Driver) run() {
 		case <-p.ctx.Done():
 			return
 		case job := <-p.ch:
-			buf := []byte(util.JSONStringify(job.event))
+			if job.unique {
+				exists, err := p.exists(job.key)
+				if err != nil {
+					p.errors <- err
+					p.jobWaitGroup.Done()
+					continue
+				}
+				if exists {
+					internal.DuplicateObjectsSkipped.WithLabelValues(job.event.Table).Inc()
+					internal.SkippedEvents.WithLabelValues(job.event.Table, internal.SkipReasonDuplicate).Inc()
+					job.logger.Trace("skipping %s:%s, already uploaded", p.bucket, job.key)
+					p.jobWaitGroup.Done()
+					continue
+				}
+			}
+			buf := []byte(util.JSONStringify(job.payload))
 			_, err := p.s3.PutObject(context.Background(), &awss3.PutObjectInput{
 				Bucket:        aws.String(p.bucket),
 				Key:           aws.String(job.key),
@@ -311,6 +373,9 @@ func (p *s3Driver) run() {
 			if err != nil {
 				p.errors <- fmt.Errorf("error storing s3 object to %s:%s: %w", p.bucket, job.key, err)
 			} else {
+				if p.manifest != nil {
+					p.manifest.Add(job.key, job.event.Table, job.event.Timestamp, buf)
+				}
 				job.logger.Trace("uploaded to %s:%s", p.bucket, job.key)
 			}
 			p.jobWaitGroup.Done()
@@ -344,33 +409,75 @@ func (p *s3Driver) Stop() error {
 // MaxBatchSize returns the maximum number of events that can be processed in a single call to Process and when Flush should be called.
 // Return -1 to indicate that there is no limit.
 func (p *s3Driver) MaxBatchSize() int {
+	if p.aggregator != nil {
+		return -1 // the batch is bounded by the window instead
+	}
 	return 1_000
 }
 
-func (p *s3Driver) process(_ context.Context, logger logger.Logger, event internal.DBChangeEvent, dryRun bool) (bool, error) {
-	var key string
+// AggregationWindow returns how long events should be accumulated before Flush is called or 0 if aggregation is disabled.
+func (p *s3Driver) AggregationWindow() time.Duration {
+	return p.window
+}
+
+// getKey returns the object key for the event and true if the key is derived from the stream sequence.
+func (p *s3Driver) getKey(event internal.DBChangeEvent) (string, bool) {
+	if p.exactlyOnce {
+		if seq := event.GetStreamSequence(); seq > 0 {
+			return util.SequenceKey(p.prefix, event.Table, seq, seq, ".json"), true
+		}
+	}
 	if event.SchemaValidatedPath != nil {
-		key = path.Join(p.prefix, *event.SchemaValidatedPath)
-	} else {
-		key = path.Join(p.prefix, event.Table, event.GetPrimaryKey()+".json")
+		return path.Join(p.prefix, *event.SchemaValidatedPath), false
+	}
+	if p.delta != nil {
+		// each change is kept since a delta can't replace the previous object for the record
+		return path.Join(p.prefix, event.Table, event.GetPrimaryKey(), fmt.Sprintf("%d-%s.json", event.Timestamp, event.ID)), false
+	}
+	return path.Join(p.prefix, event.Table, event.GetPrimaryKey()+".json"), false
+}
+
+func (p *s3Driver) process(_ context.Context, logger logger.Logger, event internal.DBChangeEvent, dryRun bool) (bool, error) {
+	key, unique := p.getKey(event)
+	var payload any = event
+	if p.delta != nil {
+		var err error
+		if payload, err = p.delta.Payload(event); err != nil {
+			return false, err
+		}
 	}
 	if dryRun {
 		logger.Trace("would store %s:%s", p.bucket, key)
 	} else {
 		p.jobWaitGroup.Add(1)
-		p.ch <- job{logger, event, key}
+		p.ch <- job{logger, event, payload, key, unique}
 	}
 	return false, nil
 }
 
 // Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
 func (p *s3Driver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	if p.aggregator != nil {
+		p.aggregator.Add(event)
+		return false, nil
+	}
 	return p.process(p.config.Context, logger, event, false)
 }
 
 // Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
 func (p *s3Driver) Flush(logger logger.Logger) error {
 	logger.Debug("flush called")
+	if p.aggregator != nil {
+		events := p.aggregator.Events()
+		logger.Debug("uploading %d of %d events in window", len(events), p.aggregator.Received())
+		// on error the window is redelivered so it can always be discarded here
+		p.aggregator.Reset()
+		for _, event := range events {
+			if _, err := p.process(p.config.Context, logger, event, false); err != nil {
+				return err
+			}
+		}
+	}
 	p.jobWaitGroup.Wait()
 	var errs []error
 done:
@@ -382,11 +489,39 @@ done:
 			break done
 		}
 	}
+	if len(errs) > 0 {
+		if p.manifest != nil {
+			// the batch will be redelivered so these objects will be included in a later manifest
+			p.manifest.Reset()
+		}
+		return errors.Join(errs...)
+	}
+	if err := p.writeManifest(logger); err != nil {
+		return err
+	}
 	logger.Debug("flush finished")
-	if len(errs) == 0 {
+	return nil
+}
+
+// writeManifest uploads the manifest for the objects uploaded since the last manifest.
+func (p *s3Driver) writeManifest(logger logger.Logger) error {
+	if p.manifest == nil || p.manifest.Len() == 0 {
 		return nil
 	}
-	return errors.Join(errs...)
+	now := time.Now()
+	key := util.ManifestKey(p.prefix, now)
+	buf := []byte(util.JSONStringify(p.manifest.Build(now)))
+	if _, err := p.s3.PutObject(p.ctx, &awss3.PutObjectInput{
+		Bucket:        aws.String(p.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String("application/json"),
+		Body:          bytes.NewReader(buf),
+		ContentLength: aws.Int64(int64(len(buf))),
+	}); err != nil {
+		return fmt.Errorf("error storing s3 manifest to %s:%s: %w", p.bucket, key, err)
+	}
+	logger.Trace("uploaded manifest to %s:%s", p.bucket, key)
+	return nil
 }
 
 // Name is a unique name for the driver.
@@ -412,6 +547,14 @@ func (p *s3Driver) Help() string {
 	help.WriteString(util.GenerateHelpSection("Google Cloud Storage", "To use GCS for storage, use the following url pattern: s3://storage.googleapis.com/bucket. See https://cloud.google.com/storage/docs/interoperability\n"))
 	help.WriteString("\n")
 	help.WriteString(util.GenerateHelpSection("LocalStack", "To use localstack for testing, use the following url pattern: s3://localhost:4566/bucket.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Aggregation Window", "Add window=5m to the URL to collapse the events for each record in a window into a single object. This trades latency for fewer writes. The window must be shorter than the time it takes to receive the max ack pending number of events to be effective.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Exactly Once", "Add exactlyOnce=true to the URL to name objects by the table and stream sequence (prefix/table/sequence.json). Redelivered events are skipped if the object already exists.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Delta Events", util.DeltaHelp+"Unless exactlyOnce is set, each change is stored as prefix/table/id/timestamp-eventid.json instead of replacing prefix/table/id.json.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Manifests", "Add manifest=true to the URL to upload a manifest with the objects, record counts, timestamps and sha256 checksums for each batch into the _manifests folder under the prefix.\n"))
 	return help.String()
 }
 
@@ -426,9 +569,19 @@ func (p *s3Driver) ImportEvent(event internal.DBChangeEvent, schema *internal.Sc
 	return err
 }
 
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *s3Driver) ImportBatchLimits() (int, int) {
+	return p.MaxBatchSize(), 0
+}
+
+// FlushBatch waits for the pending uploads to complete.
+func (p *s3Driver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
 // ImportCompleted is called when all events have been processed.
 func (p *s3Driver) ImportCompleted() error {
-	return nil
+	return p.Flush(p.logger)
 }
 
 func (p *s3Driver) Import(config internal.ImporterConfig) error {
@@ -465,6 +618,10 @@ func (p *s3Driver) Configuration() []internal.DriverField {
 		internal.OptionalPasswordField("Access Key ID", "The AWS AWS Key ID", nil),
 		internal.OptionalPasswordField("Secret Access Key", "The AWS Secret Access Key", nil),
 		internal.OptionalStringField("Endpoint", "The Endpoint hostname to override if using an AWS compatible provider", nil),
+		internal.OptionalBooleanField("Manifest", "Upload a manifest with checksums for each batch of objects", false),
+		internal.OptionalBooleanField("Exactly Once", "Name objects by the stream sequence and skip events which were already uploaded", false),
+		internal.OptionalStringField("Aggregation Window", "The duration (such as 5m) to collapse events for the same record before uploading", nil),
+		internal.OptionalBooleanField("Delta Events", "Upload only the changed fields of updates with a full event periodically", false),
 	}
 }
 
@@ -501,6 +658,21 @@ func (p *s3Driver) Validate(values map[string]any) (string, []internal.FieldErro
 	if secret != "" {
 		q.Set("secret-access-key", secret)
 	}
+	if internal.GetOptionalBoolValue("Manifest", false, values) {
+		q.Set("manifest", "true")
+	}
+	if internal.GetOptionalBoolValue("Exactly Once", false, values) {
+		q.Set("exactlyOnce", "true")
+	}
+	if window := internal.GetOptionalStringValue("Aggregation Window", "", values); window != "" {
+		if _, err := time.ParseDuration(window); err != nil {
+			return "", []internal.FieldError{internal.NewFieldError("Aggregation Window", "must be a valid duration such as 5m")}
+		}
+		q.Set("window", window)
+	}
+	if internal.GetOptionalBoolValue("Delta Events", false, values) {
+		q.Set("delta", "true")
+	}
 	url.RawQuery = q.Encode()
 	return url.String(), nil
 }
@@ -0,0 +1,102 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// csvMetaColumns are written before the table columns so the receiver knows how to apply each row.
+var csvMetaColumns = []string{"_operation", "_timestamp"}
+
+// batchFile buffers the events for a table until the batch is uploaded.
+type batchFile struct {
+	table   string
+	format  string
+	columns []string
+	buf     bytes.Buffer
+	writer  *csv.Writer
+	count   int
+}
+
+func newBatchFile(table string, format string, schema *internal.Schema) *batchFile {
+	f := &batchFile{table: table, format: format}
+	if format == formatCSV {
+		f.columns = schema.Columns()
+		f.writer = csv.NewWriter(&f.buf)
+		f.writer.Write(append(append([]string{}, csvMetaColumns...), f.columns...))
+	}
+	return f
+}
+
+// batchKey returns the key for the batch file for the event. CSV files are split by model version since the header can change.
+func batchKey(format string, event internal.DBChangeEvent) string {
+	if format == formatCSV {
+		return event.Table + "/" + event.ModelVersion
+	}
+	return event.Table
+}
+
+func csvValue(val any) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return util.JSONStringify(v)
+	}
+}
+
+// add writes the event to the file.
+func (f *batchFile) add(event internal.DBChangeEvent) error {
+	f.count++
+	if f.format == formatNDJSON {
+		f.buf.WriteString(util.JSONStringify(event))
+		f.buf.WriteByte('\n')
+		return nil
+	}
+	data := event.After
+	if event.Operation == "DELETE" {
+		data = event.Before
+	}
+	object := make(map[string]any)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &object); err != nil {
+			return fmt.Errorf("error decoding event %s: %w", event.ID, err)
+		}
+	}
+	if _, ok := object["id"]; !ok {
+		object["id"] = event.GetPrimaryKey()
+	}
+	row := []string{event.Operation, strconv.FormatInt(event.Timestamp, 10)}
+	for _, name := range f.columns {
+		row = append(row, csvValue(object[name]))
+	}
+	return f.writer.Write(row)
+}
+
+// bytes returns the contents of the file.
+func (f *batchFile) bytes() ([]byte, error) {
+	if f.writer != nil {
+		f.writer.Flush()
+		if err := f.writer.Error(); err != nil {
+			return nil, fmt.Errorf("error writing csv: %w", err)
+		}
+	}
+	return f.buf.Bytes(), nil
+}
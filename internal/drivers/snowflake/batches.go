@@ -0,0 +1,162 @@
+package snowflake
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const defaultBatchesTable = "_eds_batches"
+
+// batchLog holds the settings for recording the metadata of each load in the batches table.
+type batchLog struct {
+	enabled bool
+	table   string
+}
+
+// parseBatchLog removes the batch log parameters from the url since they aren't connection parameters.
+// The batch log is enabled unless batches=false is provided.
+func parseBatchLog(urlstr string) (string, batchLog, error) {
+	log := batchLog{enabled: true, table: defaultBatchesTable}
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", log, fmt.Errorf("error parsing snowflake db url: %w", err)
+	}
+	q := u.Query()
+	if !q.Has("batches") && !q.Has("batchesTable") {
+		return urlstr, log, nil
+	}
+	if val := q.Get("batches"); val != "" {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return "", log, fmt.Errorf("invalid batches: %s. must be either true or false", val)
+		}
+		log.enabled = enabled
+	}
+	if val := q.Get("batchesTable"); val != "" {
+		log.table = val
+	}
+	q.Del("batches")
+	q.Del("batchesTable")
+	u.RawQuery = q.Encode()
+	return u.String(), log, nil
+}
+
+// createBatchesTableSQL returns the statement to create the batches table if it doesn't exist.
+func createBatchesTableSQL(table string) string {
+	var sql strings.Builder
+	sql.WriteString("CREATE TABLE IF NOT EXISTS ")
+	sql.WriteString(util.QuoteIdentifier(table))
+	sql.WriteString(" (\n")
+	sql.WriteString("\t\"batch_id\" STRING NOT NULL,\n")
+	sql.WriteString("\t\"query_tag\" STRING,\n")
+	sql.WriteString("\t\"session_id\" STRING,\n")
+	sql.WriteString("\t\"source\" STRING NOT NULL,\n")
+	sql.WriteString("\t\"min_sequence\" INTEGER,\n")
+	sql.WriteString("\t\"max_sequence\" INTEGER,\n")
+	sql.WriteString("\t\"event_count\" INTEGER NOT NULL,\n")
+	sql.WriteString("\t\"insert_count\" INTEGER NOT NULL,\n")
+	sql.WriteString("\t\"update_count\" INTEGER NOT NULL,\n")
+	sql.WriteString("\t\"delete_count\" INTEGER NOT NULL,\n")
+	sql.WriteString("\t\"tables\" VARIANT,\n")
+	sql.WriteString("\t\"started_at\" TIMESTAMP_NTZ NOT NULL,\n")
+	sql.WriteString("\t\"completed_at\" TIMESTAMP_NTZ NOT NULL,\n")
+	sql.WriteString("\tPRIMARY KEY (\"batch_id\")\n")
+	sql.WriteString(");\n")
+	return sql.String()
+}
+
+// batchInfo is the metadata of a single load which is recorded in the batches table.
+type batchInfo struct {
+	ID          string
+	QueryTag    string
+	SessionID   string
+	Source      string // stream or import
+	MinSequence uint64 // the first nats stream sequence in the batch or 0 when not available
+	MaxSequence uint64 // the last nats stream sequence in the batch or 0 when not available
+	Events      int
+	Inserts     int
+	Updates     int
+	Deletes     int
+	Tables      map[string]int // number of events by table
+	Started     time.Time
+}
+
+func newBatchInfo(source string, sessionID string) *batchInfo {
+	return &batchInfo{
+		ID:        uuid.NewString(),
+		SessionID: sessionID,
+		Source:    source,
+		Tables:    make(map[string]int),
+		Started:   time.Now(),
+	}
+}
+
+// add counts the event in the batch. Events are counted before they are merged by the batcher so the counts match the
+// events which were received.
+func (b *batchInfo) add(event *internal.DBChangeEvent) {
+	b.Events++
+	b.Tables[event.Table]++
+	switch event.Operation {
+	case "INSERT":
+		b.Inserts++
+	case "UPDATE":
+		b.Updates++
+	case "DELETE":
+		b.Deletes++
+	}
+	if seq := event.GetStreamSequence(); seq > 0 {
+		if b.MinSequence == 0 || seq < b.MinSequence {
+			b.MinSequence = seq
+		}
+		if seq > b.MaxSequence {
+			b.MaxSequence = seq
+		}
+	}
+}
+
+func sequenceValue(seq uint64) string {
+	if seq == 0 {
+		return "NULL"
+	}
+	return strconv.FormatUint(seq, 10)
+}
+
+func nullableString(val string) string {
+	if val == "" {
+		return "NULL"
+	}
+	return quoteValue(val, "")
+}
+
+// toBatchSQL returns the statement to record the batch. The completed time is set by snowflake when the statement runs
+// so it can be used with time travel to query the tables as they were after the load.
+func toBatchSQL(table string, b *batchInfo) string {
+	var sql strings.Builder
+	sql.WriteString("INSERT INTO ")
+	sql.WriteString(util.QuoteIdentifier(table))
+	sql.WriteString(" (\"batch_id\",\"query_tag\",\"session_id\",\"source\",\"min_sequence\",\"max_sequence\",\"event_count\",\"insert_count\",\"update_count\",\"delete_count\",\"tables\",\"started_at\",\"completed_at\") SELECT ")
+	sql.WriteString(strings.Join([]string{
+		quoteValue(b.ID, ""),
+		nullableString(b.QueryTag),
+		nullableString(b.SessionID),
+		quoteValue(b.Source, ""),
+		sequenceValue(b.MinSequence),
+		sequenceValue(b.MaxSequence),
+		strconv.Itoa(b.Events),
+		strconv.Itoa(b.Inserts),
+		strconv.Itoa(b.Updates),
+		strconv.Itoa(b.Deletes),
+		quoteValue(util.JSONStringify(b.Tables), "PARSE_JSON"),
+		quoteValue(b.Started.UTC(), ""),
+		"SYSDATE()",
+	}, ","))
+	sql.WriteString(";\n")
+	return sql.String()
+}
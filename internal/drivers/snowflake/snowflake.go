@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -17,25 +19,36 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
-const maxBatchSize = 200
+const (
+	maxBatchSize  = 200
+	maxExistsKeys = 1_000 // number of ids in a single SELECT ... IN existence check
+)
 
 type snowflakeDriver struct {
-	config    internal.DriverConfig
-	logger    logger.Logger
-	db        *sql.DB
-	registry  internal.SchemaRegistry
-	waitGroup sync.WaitGroup
-	once      sync.Once
-	ctx       context.Context
-	batcher   *util.Batcher
-	locker    sync.Mutex
-	sessionID string
-	dbname    string
-	dbschema  internal.DatabaseSchema
+	config           internal.DriverConfig
+	logger           logger.Logger
+	db               *sql.DB
+	registry         internal.SchemaRegistry
+	waitGroup        sync.WaitGroup
+	once             sync.Once
+	ctx              context.Context
+	cancel           context.CancelFunc
+	statementTimeout time.Duration
+	pingInterval     time.Duration
+	batcher          *util.Batcher
+	locker           sync.Mutex
+	sessionID        string
+	dbname           string
+	dbschema         internal.DatabaseSchema
+	geo              util.GeoColumns
+	batches          batchLog
+	batch            *batchInfo // the metadata of the pending events when the batch log is enabled
 }
 
 var _ internal.Driver = (*snowflakeDriver)(nil)
 var _ internal.DriverLifecycle = (*snowflakeDriver)(nil)
+var _ internal.DriverSchemaDrift = (*snowflakeDriver)(nil)
+var _ internal.DriverSnapshot = (*snowflakeDriver)(nil)
 var _ internal.Importer = (*snowflakeDriver)(nil)
 var _ internal.DriverSessionHandler = (*snowflakeDriver)(nil)
 var _ internal.DriverHelp = (*snowflakeDriver)(nil)
@@ -45,7 +58,7 @@ var uuidRegexp = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f
 func (p *snowflakeDriver) SetSessionID(sessionID string) {
 	if sessionID != "" && uuidRegexp.MatchString(sessionID) {
 		p.sessionID = sessionID
-		p.ctx = sf.WithRequestID(p.config.Context, sf.ParseUUID(sessionID))
+		p.ctx = sf.WithRequestID(p.ctx, sf.ParseUUID(sessionID))
 	}
 }
 
@@ -66,7 +79,27 @@ func (p *snowflakeDriver) refreshSchema(ctx context.Context, db *sql.DB, failIfE
 }
 
 func (p *snowflakeDriver) connectToDB(ctx context.Context, url string) (*sql.DB, error) {
-	url, err := GetConnectionStringFromURL(url)
+	url, timeout, err := util.ParseStatementTimeout(url)
+	if err != nil {
+		return nil, err
+	}
+	p.statementTimeout = timeout
+	url, interval, err := util.ParsePingInterval(url)
+	if err != nil {
+		return nil, err
+	}
+	p.pingInterval = interval
+	url, geo, err := util.ParseGeoColumns(url)
+	if err != nil {
+		return nil, err
+	}
+	p.geo = geo
+	url, batches, err := parseBatchLog(url)
+	if err != nil {
+		return nil, err
+	}
+	p.batches = batches
+	url, err = GetConnectionStringFromURL(url)
 	if err != nil {
 		return nil, err
 	}
@@ -91,15 +124,26 @@ func (p *snowflakeDriver) connectToDB(ctx context.Context, url string) (*sql.DB,
 // Start the driver. This is called once at the beginning of the driver's lifecycle.
 func (p *snowflakeDriver) Start(config internal.DriverConfig) error {
 	p.config = config
-	p.ctx = config.Context
+	p.ctx, p.cancel = context.WithCancel(config.Context)
 	p.logger = config.Logger.WithPrefix("[snowflake]")
 	p.registry = config.SchemaRegistry
 	db, err := p.connectToDB(config.Context, config.URL)
 	if err != nil {
 		return fmt.Errorf("unable to create connection: %w", err)
 	}
+	if p.batches.enabled {
+		if _, err := db.ExecContext(config.Context, createBatchesTableSQL(p.batches.table)); err != nil {
+			db.Close()
+			return fmt.Errorf("error creating batches table: %s. %w", p.batches.table, err)
+		}
+	}
 	p.db = db
 	p.batcher = util.NewBatcher()
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+		util.MonitorConnection(p.ctx, p.logger, p.pingInterval, db)
+	}()
 	p.logger.Debug("started")
 	return nil
 }
@@ -111,6 +155,9 @@ func (p *snowflakeDriver) Stop() error {
 		p.logger.Debug("waiting on flush")
 		p.Flush(p.logger) // make sure we flush
 		p.logger.Debug("completed flush")
+		if p.cancel != nil {
+			p.cancel() // cancel any running statements so a hung query doesn't block shutdown
+		}
 		p.logger.Debug("waiting on waitgroup")
 		p.waitGroup.Wait()
 		p.logger.Debug("completed waitgroup")
@@ -142,9 +189,57 @@ func (p *snowflakeDriver) Process(logger logger.Logger, event internal.DBChangeE
 		return false, fmt.Errorf("error getting json object: %w", err)
 	}
 	p.batcher.Add(event.Table, event.GetPrimaryKey(), event.Operation, event.Diff, object, &event)
+	if p.batches.enabled {
+		if p.batch == nil {
+			p.batch = newBatchInfo("stream", p.sessionID)
+			if event.Lineage != nil {
+				// use the lineage batch id so the rows delivered downstream can be found in the batches table
+				p.batch.ID = event.Lineage.BatchID
+			}
+		}
+		p.batch.add(&event)
+	}
 	return false, nil
 }
 
+// existingRecords returns the ids by table of the records being inserted which already exist, using a single query per
+// table instead of checking each record. Snowflake doesn't enforce primary keys so these need to be deleted before the insert.
+func (p *snowflakeDriver) existingRecords(ctx context.Context, records []*util.Record) (map[string]map[string]bool, error) {
+	ids := make(map[string][]string)
+	for _, record := range records {
+		if record.Operation == "INSERT" {
+			ids[record.Table] = append(ids[record.Table], record.Id)
+		}
+	}
+	existing := make(map[string]map[string]bool)
+	for table, tableIDs := range ids {
+		found := make(map[string]bool)
+		for len(tableIDs) > 0 {
+			chunk := tableIDs[:min(len(tableIDs), maxExistsKeys)]
+			tableIDs = tableIDs[len(chunk):]
+			rows, err := p.db.QueryContext(ctx, toExistsSQL(table, chunk))
+			if err != nil {
+				return nil, fmt.Errorf("error checking for existing records in %s: %w", table, err)
+			}
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err != nil {
+					rows.Close()
+					return nil, fmt.Errorf("error reading existing records in %s: %w", table, err)
+				}
+				found[id] = true
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, fmt.Errorf("error reading existing records in %s: %w", table, err)
+			}
+		}
+		existing[table] = found
+	}
+	return existing, nil
+}
+
 var sequence int64
 
 // Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
@@ -159,28 +254,33 @@ func (p *snowflakeDriver) Flush(logger logger.Logger) error {
 	records := p.batcher.Records()
 	count := len(records)
 	p.batcher.Clear()
+	batch := p.batch
+	p.batch = nil
 	if count > 0 {
 		logger.Debug("flush: %d / %d", count, sequence+1)
 		sequence++
 		tag := fmt.Sprintf("eds-%s/%d/%d", p.sessionID, sequence, count)
-		ctx := sf.WithQueryTag(context.Background(), tag)
+		if batch != nil {
+			tag += "/" + batch.ID
+			batch.QueryTag = tag
+			batch.SessionID = p.sessionID
+		}
+		ctx, cancel := util.StatementContext(p.ctx, p.statementTimeout)
+		defer cancel()
+		ctx = sf.WithQueryTag(ctx, tag)
+		existing, err := p.existingRecords(ctx, records)
+		if err != nil {
+			return err
+		}
 		var query strings.Builder
 		var statementCount int
-		var cachekeys []string
-		var deletekeys []string
 		for i, record := range records {
 			var force bool
-			var key string
 			switch record.Operation {
 			case "INSERT":
-				key = fmt.Sprintf("snowflake:%s:%s", record.Table, record.Id)
-				ok, _, err := p.config.Tracker.GetKey(key)
-				if err != nil {
-					return fmt.Errorf("error getting cache key %s from tracker: %w", key, err)
-				}
-				force = ok
+				force = existing[record.Table][record.Id]
 				if force {
-					logger.Trace("forcing delete before insert because we've seen an insert for %s/%s", record.Table, record.Id)
+					logger.Trace("forcing delete before insert because the record already exists for %s/%s", record.Table, record.Id)
 				}
 			case "UPDATE":
 				// slight optimization to skip records that just have an updatedDate and nothing else
@@ -190,21 +290,20 @@ func (p *snowflakeDriver) Flush(logger logger.Logger) error {
 					logger.Trace("skipping update because only updatedDate changed for %s/%s", record.Table, record.Id)
 					continue
 				}
-			case "DELETE":
-				key = fmt.Sprintf("snowflake:%s:%s", record.Table, record.Id)
-				deletekeys = append(deletekeys, key)
 			}
 			schema, err := p.registry.GetSchema(record.Table, record.Event.ModelVersion)
 			if err != nil {
 				return fmt.Errorf("unable to get schema for table: %s (%s). %w", record.Table, record.Event.ModelVersion, err)
 			}
-			sql, c := toSQL(record, schema, force)
+			sql, c := toSQL(record, p.geo.Apply(schema), force)
 			statementCount += c
 			logger.Trace("adding %d to %s sql (%d/%d): %s", c, tag, i+1, count, strings.TrimRight(sql, "\n"))
 			query.WriteString(sql)
-			if key != "" {
-				cachekeys = append(cachekeys, key)
-			}
+		}
+		if batch != nil {
+			// recorded last so the batch is only in the table when all the statements before it succeeded
+			query.WriteString(toBatchSQL(p.batches.table, batch))
+			statementCount++
 		}
 		if statementCount > 0 {
 			execCTX, err := sf.WithMultiStatement(ctx, statementCount)
@@ -224,17 +323,6 @@ func (p *snowflakeDriver) Flush(logger logger.Logger) error {
 				logger.Trace("executed query (%s/%d/%d) in %v", tag, statementCount, rows, time.Since(ts))
 			}
 		}
-		if len(cachekeys) > 0 {
-			// cache keys seen for the past 24 hours ... might want to make it configurable at some point but this is good enough for now
-			if err := p.config.Tracker.SetKeys(cachekeys, tag, time.Hour*24); err != nil {
-				return fmt.Errorf("error setting cache keys: %s in tracker: %w", cachekeys, err)
-			}
-		}
-		if len(deletekeys) > 0 {
-			if err := p.config.Tracker.DeleteKey(deletekeys...); err != nil {
-				return fmt.Errorf("error deleting cache keys from tracker: %w", err)
-			}
-		}
 	}
 	return nil
 }
@@ -259,13 +347,18 @@ func (p *snowflakeDriver) Import(config internal.ImporterConfig) error {
 
 	// create all the tables
 	for _, table := range config.Tables {
-		data := schema[table]
+		data := p.geo.Apply(schema[table])
 		p.logger.Debug("creating table %s", table)
 		if err := executeSQL(createSQL(data)); err != nil {
 			return fmt.Errorf("error creating table: %s. %w", table, err)
 		}
 		p.logger.Debug("created table %s", table)
 	}
+	if p.batches.enabled {
+		if err := executeSQL(createBatchesTableSQL(p.batches.table)); err != nil {
+			return fmt.Errorf("error creating batches table: %s. %w", p.batches.table, err)
+		}
+	}
 
 	if config.SchemaOnly {
 		return nil
@@ -294,9 +387,15 @@ func (p *snowflakeDriver) Import(config internal.ImporterConfig) error {
 	}
 
 	// upload files
-	fileURI := util.ToFileURI(config.DataDir, "*.ndjson.gz")
-	if err := executeSQL(fmt.Sprintf(`PUT '%s' @%s PARALLEL=%d SOURCE_COMPRESSION=gzip`, fileURI, stageName, parallel)); err != nil {
-		return fmt.Errorf("error uploading files: %s", err)
+	if config.EncryptionKey != nil {
+		if err := p.putDecryptedFiles(config, db, stageName); err != nil {
+			return err
+		}
+	} else {
+		fileURI := util.ToFileURI(config.DataDir, "*.ndjson.gz")
+		if err := executeSQL(fmt.Sprintf(`PUT '%s' @%s PARALLEL=%d SOURCE_COMPRESSION=gzip`, fileURI, stageName, parallel)); err != nil {
+			return fmt.Errorf("error uploading files: %s", err)
+		}
 	}
 	p.logger.Debug("files uploaded in %v", time.Since(started))
 
@@ -315,9 +414,18 @@ func (p *snowflakeDriver) Import(config internal.ImporterConfig) error {
 				wg.Done()
 			}()
 			sem.Acquire(config.Context, 1)
-			if err := executeSQL(fmt.Sprintf(`COPY INTO %s FROM @%s MATCH_BY_COLUMN_NAME=CASE_INSENSITIVE FILE_FORMAT = (TYPE = 'JSON' STRIP_OUTER_ARRAY = true COMPRESSION = 'GZIP') PATTERN='.*-%s-.*'`, util.QuoteIdentifier(table), stageName, table)); err != nil {
+			batch := newBatchInfo("import", p.sessionID)
+			batch.QueryTag = fmt.Sprintf("eds-import-%s/%s/%s", jobId, table, batch.ID)
+			copySQL := util.SQLExecuter(sf.WithQueryTag(config.Context, batch.QueryTag), p.logger, db, config.DryRun)
+			if err := copySQL(fmt.Sprintf(`COPY INTO %s FROM @%s MATCH_BY_COLUMN_NAME=CASE_INSENSITIVE FILE_FORMAT = (TYPE = 'JSON' STRIP_OUTER_ARRAY = true COMPRESSION = 'GZIP' BINARY_FORMAT = 'BASE64') PATTERN='.*-%s-.*'`, util.QuoteIdentifier(table), stageName, table)); err != nil {
 				p.logger.Trace("error importing data: %s", err)
 				errorChannel <- fmt.Errorf("error importing %s data: %s", table, err)
+				return
+			}
+			if p.batches.enabled {
+				if err := p.recordImportBatch(config, db, executeSQL, table, batch); err != nil {
+					errorChannel <- err
+				}
 			}
 		}(table)
 	}
@@ -348,6 +456,55 @@ done:
 	return nil
 }
 
+// putDecryptedFiles uploads the files which were encrypted when they were downloaded one at a time. Each file is decrypted
+// into a stream, which the snowflake driver reads into memory, so the data is never written to disk unencrypted. The
+// file is named on the stage without the util.EncryptedFileExtension so the COPY pattern matches it.
+func (p *snowflakeDriver) putDecryptedFiles(config internal.ImporterConfig, db *sql.DB, stageName string) error {
+	files, err := util.ListDir(config.DataDir)
+	if err != nil {
+		return fmt.Errorf("error listing files: %w", err)
+	}
+	for _, fn := range files {
+		name := strings.TrimSuffix(fn, util.EncryptedFileExtension)
+		if !strings.HasSuffix(name, ".ndjson.gz") {
+			continue
+		}
+		if err := func() error {
+			r, err := util.OpenFile(fn, config.EncryptionKey)
+			if err != nil {
+				return fmt.Errorf("error opening %s: %w", fn, err)
+			}
+			defer r.Close()
+			executeSQL := util.SQLExecuter(sf.WithFileStream(config.Context, r), p.logger, db, config.DryRun)
+			if err := executeSQL(fmt.Sprintf(`PUT '%s' @%s SOURCE_COMPRESSION=gzip`, util.ToFileURI(filepath.Dir(name), filepath.Base(name)), stageName)); err != nil {
+				return fmt.Errorf("error uploading %s: %s", fn, err)
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordImportBatch records the COPY of a table in the batches table. The table is recreated by the import so the number
+// of rows in it is the number of events which were loaded.
+func (p *snowflakeDriver) recordImportBatch(config internal.ImporterConfig, db *sql.DB, executeSQL func(string) error, table string, batch *batchInfo) error {
+	if !config.DryRun {
+		var count int
+		if err := db.QueryRowContext(config.Context, "SELECT COUNT(*) FROM "+util.QuoteIdentifier(table)).Scan(&count); err != nil {
+			return fmt.Errorf("error counting %s rows: %w", table, err)
+		}
+		batch.Events = count
+		batch.Inserts = count
+	}
+	batch.Tables[table] = batch.Events
+	if err := executeSQL(toBatchSQL(p.batches.table, batch)); err != nil {
+		return fmt.Errorf("error recording %s import batch: %w", table, err)
+	}
+	return nil
+}
+
 // Name is a unique name for the driver.
 func (p *snowflakeDriver) Name() string {
 	return "Snowflake"
@@ -367,6 +524,10 @@ func (p *snowflakeDriver) ExampleURL() string {
 func (p *snowflakeDriver) Help() string {
 	var help strings.Builder
 	help.WriteString(util.GenerateHelpSection("Schema", "The database will match the public schema from the Shopmonkey transactional database.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Geo Columns", "Add geo=table.column (repeated or comma separated) to store a column as a GEOGRAPHY so geospatial functions work without casts.\nThe value can be GeoJSON, an object with lat and lng properties or a \"lat,lng\" string, other values are stored as NULL.\nThe import loads the values as is so they must be GeoJSON. The column type is only changed when the table is created or the column is added.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Batches", "Each load is recorded in the _eds_batches table (or the name provided with batchesTable=name) with its batch id, query tag, NATS sequence range,\nevent counts by operation and table, and start and completion time. The batch id is also in the query tag of the load so it can be found in the query history\nand the completion time can be used with time travel (AT(TIMESTAMP => completed_at)). Add batches=false to disable it.\n"))
 	return help.String()
 }
 
@@ -394,6 +555,8 @@ func (p *snowflakeDriver) Validate(values map[string]any) (string, []internal.Fi
 func (p *snowflakeDriver) MigrateNewTable(ctx context.Context, logger logger.Logger, schema *internal.Schema) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
 	if _, ok := p.dbschema[schema.Table]; ok {
 		logger.Info("table already exists for: %s, dropping and recreating...", schema.Table)
 		if err := util.DropTable(ctx, logger, p.db, util.QuoteIdentifier(schema.Table)); err != nil {
@@ -405,7 +568,7 @@ func (p *snowflakeDriver) MigrateNewTable(ctx context.Context, logger logger.Log
 		}
 		logger.Debug("deleted %d cache keys for table %s", delCount, schema.Table)
 	}
-	sql := createSQL(schema)
+	sql := createSQL(p.geo.Apply(schema))
 	logger.Trace("migrate new table: %s", sql)
 	if _, err := p.db.ExecContext(ctx, sql); err != nil {
 		return err
@@ -417,7 +580,9 @@ func (p *snowflakeDriver) MigrateNewTable(ctx context.Context, logger logger.Log
 func (p *snowflakeDriver) MigrateNewColumns(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns []string) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
-	sqls := addNewColumnsSQL(logger, columns, schema, p.dbschema)
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	sqls := addNewColumnsSQL(logger, columns, p.geo.Apply(schema), p.dbschema)
 	for _, sql := range sqls {
 		logger.Trace("migrating new columns: %s", sql)
 		_, err := p.db.ExecContext(ctx, sql)
@@ -429,6 +594,39 @@ func (p *snowflakeDriver) MigrateNewColumns(ctx context.Context, logger logger.L
 	return p.refreshSchema(ctx, p.db, true)
 }
 
+// MissingColumns reloads the destination schema and returns the columns of the schemas which are missing from their tables.
+func (p *snowflakeDriver) MissingColumns(ctx context.Context, logger logger.Logger, schemas []*internal.Schema) (map[string][]string, error) {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	if err := p.refreshSchema(ctx, p.db, false); err != nil {
+		return nil, err
+	}
+	return util.MissingColumns(p.dbschema, schemas), nil
+}
+
+// Snapshot writes the rows of the table as CSV.
+func (p *snowflakeDriver) Snapshot(ctx context.Context, logger logger.Logger, table string, limit int, w io.Writer) error {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	if p.db == nil {
+		return internal.ErrDriverStopped
+	}
+	name, ok := util.FindTable(p.dbschema, table)
+	if !ok {
+		return internal.ErrTableNotFound
+	}
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	count, err := util.WriteCSVRows(ctx, p.db, snapshotSQL(name, limit), w)
+	if err != nil {
+		return fmt.Errorf("error reading table %s: %w", name, err)
+	}
+	logger.Debug("wrote %d rows of table %s", count, name)
+	return nil
+}
+
 func init() {
 	internal.RegisterDriver("snowflake", &snowflakeDriver{})
 	internal.RegisterImporter("snowflake", &snowflakeDriver{})
@@ -1,6 +1,7 @@
 package snowflake
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net/url"
 	"reflect"
@@ -80,6 +81,8 @@ func quoteValue(value any, fn string) string {
 		}
 	case string:
 		str = quoteString(arg, fn)
+	case []byte:
+		str = "TO_BINARY('" + hex.EncodeToString(arg) + "', 'HEX')"
 	case *time.Time:
 		if arg == nil {
 			str = "NULL"
@@ -109,6 +112,18 @@ func quoteValue(value any, fn string) string {
 	return str
 }
 
+// quotePropertyValue returns the SQL value for a column. Geo columns are converted from GeoJSON to a geography and are
+// NULL when the value isn't a location.
+func quotePropertyValue(val any, prop internal.SchemaProperty, fn string) string {
+	if prop.IsGeography() {
+		if geojson, ok := util.ToGeoJSON(val); ok {
+			return quoteString(geojson, "TO_GEOGRAPHY")
+		}
+		return "NULL"
+	}
+	return quoteValue(util.ToBinaryValue(val, prop), fn)
+}
+
 func toDeleteSQL(record *util.Record) string {
 	var sql strings.Builder
 	sql.WriteString("DELETE FROM ")
@@ -146,6 +161,26 @@ func nullableValue(c internal.SchemaProperty, wrap bool) string {
 	}
 }
 
+// toExistsSQL returns a query for the ids which exist in the table.
+func toExistsSQL(table string, ids []string) string {
+	var sql strings.Builder
+	sql.WriteString("SELECT ")
+	sql.WriteString(util.QuoteIdentifier("id"))
+	sql.WriteString(" FROM ")
+	sql.WriteString(util.QuoteIdentifier(table))
+	sql.WriteString(" WHERE ")
+	sql.WriteString(util.QuoteIdentifier("id"))
+	sql.WriteString(" IN (")
+	for i, id := range ids {
+		if i > 0 {
+			sql.WriteString(",")
+		}
+		sql.WriteString(quoteValue(id, ""))
+	}
+	sql.WriteString(")")
+	return sql.String()
+}
+
 func toSQL(record *util.Record, model *internal.Schema, exists bool) (string, int) {
 	var sql strings.Builder
 	var count int
@@ -174,7 +209,7 @@ func toSQL(record *util.Record, model *internal.Schema, exists bool) (string, in
 							fn = "TO_VARIANT"
 						}
 					}
-					v := quoteValue(val, fn)
+					v := quotePropertyValue(val, c, fn)
 					insertVals = append(insertVals, v)
 				} else {
 					insertVals = append(insertVals, nullableValue(c, true))
@@ -195,7 +230,7 @@ func toSQL(record *util.Record, model *internal.Schema, exists bool) (string, in
 					continue
 				}
 				if val, ok := record.Object[name]; ok {
-					v := quoteValue(val, "")
+					v := quotePropertyValue(val, model.Properties[name], "")
 					updateValues = append(updateValues, fmt.Sprintf("%s=%s", util.QuoteIdentifier(name), v))
 				}
 				// else shouldn't be possible
@@ -247,6 +282,12 @@ func propTypeToSQLType(property internal.SchemaProperty) string {
 		if property.Format == "date-time" {
 			return "TIMESTAMP_NTZ"
 		}
+		if property.IsBinary() {
+			return "BINARY"
+		}
+		if property.IsGeography() {
+			return "GEOGRAPHY"
+		}
 		return "STRING"
 	case "integer":
 		return "INTEGER"
@@ -325,3 +366,12 @@ func addNewColumnsSQL(logger logger.Logger, columns []string, s *internal.Schema
 	}
 	return res
 }
+
+// snapshotSQL returns the query for the rows of the table, all of them if the limit is 0.
+func snapshotSQL(table string, limit int) string {
+	sql := "SELECT * FROM " + util.QuoteIdentifier(table)
+	if limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return sql
+}
@@ -18,6 +18,7 @@
 package sqlserver
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -158,9 +159,9 @@ func quoteValue(arg any) string {
 		if v == nil {
 			buf = append(buf, "NULL"...)
 		} else {
-			buf = append(buf, "_binary'"...)
-			buf = escapeBytesBackslash(buf, v)
-			buf = append(buf, '\'')
+			// binary literals are hex with a 0x prefix in T-SQL
+			buf = append(buf, "0x"...)
+			buf = hex.AppendEncode(buf, v)
 		}
 	case string:
 		if looksLikeJSONTimestamp.MatchString(v) {
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
-	"regexp"
 	"sort"
 	"strings"
 
@@ -13,17 +12,12 @@ import (
 	"github.com/shopmonkeyus/go-common/logger"
 )
 
-var needsQuote = regexp.MustCompile(`[A-Z0-9_\s]`)
-var keywords = regexp.MustCompile(`(?i)\b(USER|SELECT|INSERT|UPDATE|DELETE|FROM|WHERE|JOIN|LEFT|RIGHT|INNER|GROUP BY|ORDER BY|HAVING|AND|OR|CREATE|DROP|ALTER|TABLE|INDEX|ON|INTO|VALUES|SET|AS|DISTINCT|TYPE|DEFAULT|ORDER|GROUP|LIMIT|SUM|TOTAL|START|END|BEGIN|COMMIT|ROLLBACK|PRIMARY|PERCENT|AUTHORIZATION)\b`)
-
+// quoteIdentifier always quotes table names and only quotes column names when needed.
 func quoteIdentifier(val string, istable bool) string {
 	if istable {
-		return "[" + val + "]"
-	}
-	if needsQuote.MatchString(val) || keywords.MatchString(val) {
-		return `"` + val + `"`
+		return util.SQLServerIdentifiers.Quote(val)
 	}
-	return val
+	return util.SQLServerIdentifiers.QuoteIfNeeded(val)
 }
 
 func toSQLFromObject(model *internal.Schema, table string, object map[string]any, diff []string) string {
@@ -46,7 +40,7 @@ func toSQLFromObject(model *internal.Schema, table string, object map[string]any
 			}
 			if val, ok := object[name]; ok {
 				prop := model.Properties[name]
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, false)
+				v := util.ToJSONStringVal(name, quoteValue(util.ToBinaryValue(val, prop)), prop, false)
 				updateValues = append(updateValues, fmt.Sprintf("%s=%s", quoteIdentifier(name, false), v))
 			} else {
 				updateValues = append(updateValues, fmt.Sprintf("%s=NULL", quoteIdentifier(name, false)))
@@ -59,7 +53,7 @@ func toSQLFromObject(model *internal.Schema, table string, object map[string]any
 			}
 			if val, ok := object[name]; ok {
 				prop := model.Properties[name]
-				v := util.ToJSONStringVal(name, quoteValue(val), prop, false)
+				v := util.ToJSONStringVal(name, quoteValue(util.ToBinaryValue(val, prop)), prop, false)
 				updateValues = append(updateValues, fmt.Sprintf("%s=%s", quoteIdentifier(name, false), v))
 			} else {
 				updateValues = append(updateValues, fmt.Sprintf("%s=NULL", quoteIdentifier(name, false)))
@@ -80,7 +74,7 @@ func toSQLFromObject(model *internal.Schema, table string, object map[string]any
 	for _, name := range model.Columns() {
 		if val, ok := object[name]; ok {
 			prop := model.Properties[name]
-			v := util.ToJSONStringVal(name, quoteValue(val), prop, false)
+			v := util.ToJSONStringVal(name, quoteValue(util.ToBinaryValue(val, prop)), prop, false)
 			if name != "id" {
 				v = handleSchemaProperty(model.Properties[name], v)
 			}
@@ -123,6 +117,12 @@ func toSQL(c internal.DBChangeEvent, model *internal.Schema) (string, error) {
 func propTypeToSQLType(property internal.SchemaProperty, isPrimaryKey bool) string {
 	switch property.Type {
 	case "string":
+		if property.IsBinary() {
+			if isPrimaryKey {
+				return "VARBINARY(64)"
+			}
+			return "VARBINARY(MAX)"
+		}
 		if isPrimaryKey {
 			return "VARCHAR(64)"
 		}
@@ -282,3 +282,11 @@ func ParseURLToDSN(urlstr string) (string, error) {
 
 	return dsn.String(), nil
 }
+
+// snapshotSQL returns the query for the rows of the table, all of them if the limit is 0.
+func snapshotSQL(table string, limit int) string {
+	if limit > 0 {
+		return fmt.Sprintf("SELECT TOP (%d) * FROM %s", limit, quoteIdentifier(table, true))
+	}
+	return "SELECT * FROM " + quoteIdentifier(table, true)
+}
@@ -28,12 +28,23 @@ func TestQuoteValue(t *testing.T) {
 	assert.Equal(t, `'2021-01-01 00:00:00'`, quoteValue(&tv))
 	assert.Equal(t, `'2024-07-09 18:28:03.69708'`, quoteValue("2024-07-09T18:28:03.69708Z"))
 	assert.Equal(t, `'2024-07-09 18:28:03'`, quoteValue("2024-07-09T18:28:03Z"))
+	assert.Equal(t, "0x6869", quoteValue([]byte("hi")))
+	assert.Equal(t, "0x", quoteValue([]byte{}))
+}
+
+func TestBinarySQL(t *testing.T) {
+	prop := internal.SchemaProperty{Type: "string", Format: "byte"}
+	assert.Equal(t, "VARBINARY(MAX)", propTypeToSQLType(prop, false))
+	assert.Equal(t, "VARBINARY(64)", propTypeToSQLType(prop, true))
+	assert.Equal(t, "0x6869", quoteValue(util.ToBinaryValue("aGk=", prop)))
 }
 
 func TestQuoteIdentifier(t *testing.T) {
 	assert.Equal(t, "[test]", quoteIdentifier("test", true))
 	assert.Equal(t, "test", quoteIdentifier("test", false))
-	assert.Equal(t, `"order"`, quoteIdentifier("order", false))
+	assert.Equal(t, "[order]", quoteIdentifier("order", false))
+	assert.Equal(t, "[percent]", quoteIdentifier("percent", false))
+	assert.Equal(t, "[a]]b]", quoteIdentifier("a]b", false))
 }
 
 func TestDBChanges(t *testing.T) {
@@ -101,7 +112,7 @@ func TestAddNewColumnsSQL(t *testing.T) {
 	assert.NotNil(t, schema)
 	detail := schema["order"]
 	sql := addNewColumnsSQL(logger, []string{"number", "internalNumber", "externalNumber"}, detail, make(internal.DatabaseSchema))
-	assert.Equal(t, []string{"ALTER TABLE [order] ADD number NVARCHAR(MAX);", "ALTER TABLE [order] ADD \"internalNumber\" NVARCHAR(MAX);", "ALTER TABLE [order] ADD \"externalNumber\" NVARCHAR(MAX);"}, sql)
+	assert.Equal(t, []string{"ALTER TABLE [order] ADD number NVARCHAR(MAX);", "ALTER TABLE [order] ADD [internalNumber] NVARCHAR(MAX);", "ALTER TABLE [order] ADD [externalNumber] NVARCHAR(MAX);"}, sql)
 }
 
 func TestAddNewColumnsSQLSkip(t *testing.T) {
@@ -113,7 +124,7 @@ func TestAddNewColumnsSQLSkip(t *testing.T) {
 	assert.NotNil(t, schema)
 	detail := schema["order"]
 	sql := addNewColumnsSQL(logger, []string{"number", "internalNumber", "externalNumber"}, detail, internal.DatabaseSchema{"order": {"number": "NVARCHAR(MAX)"}})
-	assert.Equal(t, []string{"ALTER TABLE [order] ADD \"internalNumber\" NVARCHAR(MAX);", "ALTER TABLE [order] ADD \"externalNumber\" NVARCHAR(MAX);"}, sql)
+	assert.Equal(t, []string{"ALTER TABLE [order] ADD [internalNumber] NVARCHAR(MAX);", "ALTER TABLE [order] ADD [externalNumber] NVARCHAR(MAX);"}, sql)
 }
 
 func TestUpdateWithNullSQL(t *testing.T) {
@@ -123,5 +134,10 @@ func TestUpdateWithNullSQL(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, schema)
 	sql := toSQLFromObject(schema["order"], "order", map[string]any{"id": "1"}, []string{"number"})
-	assert.Equal(t, `MERGE [order] AS target USING (VALUES('1')) AS source (id) ON target.id=source.id WHEN MATCHED THEN UPDATE SET number=NULL WHEN NOT MATCHED THEN INSERT (id,"allowCollectPayment","allowCustomerAuthorization","allowCustomerViewActivity","allowCustomerViewAuthorizations","allowCustomerViewInspections","allowCustomerViewMessages","appointmentDates",archived,"assignedTechnicianIds",authorized,"authorizedDate","coalescedName","companyId",complaint,"completedAuthorizedLaborHours","completedDate","completedLaborHours","conversationId","createdDate","customFields","customerId","deferredServiceCount",deleted,"deletedDate","deletedReason","deletedUserId","discountCents","discountPercent","dueDate","emailId","epaCents","externalNumber","feesCents","fullyPaidDate","generatedCustomerName","generatedName","generatedVehicleName","gstCents","hstCents",imported,"inspectionCount","inspectionStatus",invoiced,"invoicedDate",labels,"laborCents","locationId","messageCount","messagedDate",metadata,"mileageIn","mileageOut",name,number,"orderCreatedDate",paid,"paidCostCents","partsCents","paymentDueDate","paymentTermId","phoneNumberId",profitability,"pstCents","publicId","purchaseOrderNumber","readOnly","readOnlyReason",recommendation,"remainingCostCents","repairOrderDate","requestedDepositCents","requireESignatureOnAuthorization","requireESignatureOnInvoice","sentToCarfax","serviceWriterId","shopSuppliesCents","shopUnreadMessageCount","statementId",status,"subcontractsCents","taxCents","taxConfigId","tiresCents","totalAuthorizedLaborHours","totalCostCents","totalLaborHours","transactionFeeConfigId","transactionalFeeSubtotalCents","transactionalFeeTotalCents","updatedDate","updatedSinceSignedInvoice","vehicleId","workflowStatusDate","workflowStatusId","workflowStatusPosition") VALUES ('1',0,0,0,0,0,0,'',0,'',0,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,0,0,NULL,NULL,NULL,0,NULL,NULL,NULL,0,NULL,0,NULL,NULL,NULL,NULL,0,0,0,0,'',0,NULL,NULL,0,NULL,0,NULL,NULL,NULL,NULL,NULL,NULL,NULL,0,0,0,NULL,NULL,NULL,NULL,0,NULL,NULL,0,NULL,NULL,0,NULL,0,0,0,0,NULL,0,0,NULL,'',0,0,NULL,0,NULL,0,NULL,NULL,0,0,NULL,0,NULL,NULL,NULL,NULL);`, sql)
+	assert.Equal(t, `MERGE [order] AS target USING (VALUES('1')) AS source (id) ON target.id=source.id WHEN MATCHED THEN UPDATE SET number=NULL WHEN NOT MATCHED THEN INSERT (id,[allowCollectPayment],[allowCustomerAuthorization],[allowCustomerViewActivity],[allowCustomerViewAuthorizations],[allowCustomerViewInspections],[allowCustomerViewMessages],[appointmentDates],archived,[assignedTechnicianIds],authorized,[authorizedDate],[coalescedName],[companyId],complaint,[completedAuthorizedLaborHours],[completedDate],[completedLaborHours],[conversationId],[createdDate],[customFields],[customerId],[deferredServiceCount],deleted,[deletedDate],[deletedReason],[deletedUserId],[discountCents],[discountPercent],[dueDate],[emailId],[epaCents],[externalNumber],[feesCents],[fullyPaidDate],[generatedCustomerName],[generatedName],[generatedVehicleName],[gstCents],[hstCents],imported,[inspectionCount],[inspectionStatus],invoiced,[invoicedDate],labels,[laborCents],[locationId],[messageCount],[messagedDate],metadata,[mileageIn],[mileageOut],name,number,[orderCreatedDate],paid,[paidCostCents],[partsCents],[paymentDueDate],[paymentTermId],[phoneNumberId],profitability,[pstCents],[publicId],[purchaseOrderNumber],[readOnly],[readOnlyReason],recommendation,[remainingCostCents],[repairOrderDate],[requestedDepositCents],[requireESignatureOnAuthorization],[requireESignatureOnInvoice],[sentToCarfax],[serviceWriterId],[shopSuppliesCents],[shopUnreadMessageCount],[statementId],status,[subcontractsCents],[taxCents],[taxConfigId],[tiresCents],[totalAuthorizedLaborHours],[totalCostCents],[totalLaborHours],[transactionFeeConfigId],[transactionalFeeSubtotalCents],[transactionalFeeTotalCents],[updatedDate],[updatedSinceSignedInvoice],[vehicleId],[workflowStatusDate],[workflowStatusId],[workflowStatusPosition]) VALUES ('1',0,0,0,0,0,0,'',0,'',0,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,NULL,0,0,NULL,NULL,NULL,0,NULL,NULL,NULL,0,NULL,0,NULL,NULL,NULL,NULL,0,0,0,0,'',0,NULL,NULL,0,NULL,0,NULL,NULL,NULL,NULL,NULL,NULL,NULL,0,0,0,NULL,NULL,NULL,NULL,0,NULL,NULL,0,NULL,NULL,0,NULL,0,0,0,0,NULL,0,0,NULL,'',0,0,NULL,0,NULL,0,NULL,NULL,0,0,NULL,0,NULL,NULL,NULL,NULL);`, sql)
+}
+
+func TestSnapshotSQL(t *testing.T) {
+	assert.Equal(t, "SELECT TOP (10) * FROM [order]", snapshotSQL("order", 10))
+	assert.Equal(t, "SELECT * FROM [order]", snapshotSQL("order", 0))
 }
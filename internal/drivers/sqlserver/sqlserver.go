@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -18,26 +19,32 @@ import (
 const maxBytesSizeInsert = 5_000_000
 
 type sqlserverDriver struct {
-	ctx          context.Context
-	logger       logger.Logger
-	db           *sql.DB
-	registry     internal.SchemaRegistry
-	waitGroup    sync.WaitGroup
-	once         sync.Once
-	pending      strings.Builder
-	count        int
-	importConfig internal.ImporterConfig
-	executor     func(string) error
-	size         int
-	dbname       string
-	dbschema     internal.DatabaseSchema
+	ctx              context.Context
+	cancel           context.CancelFunc
+	statementTimeout time.Duration
+	pingInterval     time.Duration
+	logger           logger.Logger
+	db               *sql.DB
+	reader           *sql.DB // the read replica or db when there isn't one
+	registry         internal.SchemaRegistry
+	waitGroup        sync.WaitGroup
+	once             sync.Once
+	pending          strings.Builder
+	count            int
+	importConfig     internal.ImporterConfig
+	executor         func(string) error
+	size             int
+	dbname           string
+	dbschema         internal.DatabaseSchema
 }
 
 var _ internal.Driver = (*sqlserverDriver)(nil)
 var _ internal.DriverLifecycle = (*sqlserverDriver)(nil)
+var _ internal.DriverSchemaDrift = (*sqlserverDriver)(nil)
+var _ internal.DriverSnapshot = (*sqlserverDriver)(nil)
 var _ internal.Importer = (*sqlserverDriver)(nil)
 var _ internal.DriverHelp = (*sqlserverDriver)(nil)
-var _ importer.Handler = (*sqlserverDriver)(nil)
+var _ importer.BatchHandler = (*sqlserverDriver)(nil)
 
 func (p *sqlserverDriver) refreshSchema(ctx context.Context, db *sql.DB, failIfEmpty bool) error {
 	if p.dbname == "" {
@@ -55,7 +62,7 @@ func (p *sqlserverDriver) refreshSchema(ctx context.Context, db *sql.DB, failIfE
 	return nil
 }
 
-func (p *sqlserverDriver) connectToDB(ctx context.Context, urlstr string) (*sql.DB, error) {
+func (p *sqlserverDriver) openDB(ctx context.Context, urlstr string) (*sql.DB, error) {
 	dsn, err := ParseURLToDSN(urlstr)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing url: %w", err)
@@ -70,25 +77,47 @@ func (p *sqlserverDriver) connectToDB(ctx context.Context, urlstr string) (*sql.
 		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	if err := p.refreshSchema(ctx, db, false); err != nil {
-		db.Close()
-		return nil, err
+func (p *sqlserverDriver) connectToDB(ctx context.Context, urlstr string) (*sql.DB, *sql.DB, error) {
+	urlstr, timeout, err := util.ParseStatementTimeout(urlstr)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	return db, nil
+	p.statementTimeout = timeout
+	urlstr, interval, err := util.ParsePingInterval(urlstr)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.pingInterval = interval
+	db, reader, err := util.OpenWithReadReplica(ctx, urlstr, p.openDB)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.refreshSchema(ctx, reader, false); err != nil {
+		util.CloseWithReadReplica(db, reader)
+		return nil, nil, err
+	}
+	return db, reader, nil
 }
 
 // Start the driver. This is called once at the beginning of the driver's lifecycle.
 func (p *sqlserverDriver) Start(config internal.DriverConfig) error {
 	p.logger = config.Logger.WithPrefix("[sqlserver]")
-	db, err := p.connectToDB(config.Context, config.URL)
+	db, reader, err := p.connectToDB(config.Context, config.URL)
 	if err != nil {
 		return err
 	}
 	p.registry = config.SchemaRegistry
 	p.db = db
-	p.ctx = config.Context
+	p.reader = reader
+	p.ctx, p.cancel = context.WithCancel(config.Context)
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+		util.MonitorConnection(p.ctx, p.logger, p.pingInterval, db, reader)
+	}()
 	return nil
 }
 
@@ -96,13 +125,17 @@ func (p *sqlserverDriver) Start(config internal.DriverConfig) error {
 func (p *sqlserverDriver) Stop() error {
 	p.logger.Debug("stopping")
 	p.once.Do(func() {
+		if p.cancel != nil {
+			p.cancel() // cancel any running statements so a hung query doesn't block shutdown
+		}
 		p.logger.Debug("waiting on waitgroup")
 		p.waitGroup.Wait()
 		p.logger.Debug("completed waitgroup")
 		if p.db != nil {
 			p.logger.Debug("closing db")
-			p.db.Close()
+			util.CloseWithReadReplica(p.db, p.reader)
 			p.db = nil
+			p.reader = nil
 			p.logger.Debug("closed db")
 		}
 	})
@@ -143,7 +176,9 @@ func (p *sqlserverDriver) Flush(logger logger.Logger) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
 	if p.count > 0 {
-		tx, err := p.db.BeginTx(p.ctx, nil)
+		ctx, cancel := util.StatementContext(p.ctx, p.statementTimeout)
+		defer cancel()
+		tx, err := p.db.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("unable to start transaction: %w", err)
 		}
@@ -153,7 +188,7 @@ func (p *sqlserverDriver) Flush(logger logger.Logger) error {
 				tx.Rollback()
 			}
 		}()
-		if _, err := tx.ExecContext(p.ctx, p.pending.String()); err != nil {
+		if _, err := tx.ExecContext(ctx, p.pending.String()); err != nil {
 			logger.Error("offending sql: %s", p.pending.String())
 			return fmt.Errorf("unable to execute sql: %w", err)
 		}
@@ -191,7 +226,21 @@ func (p *sqlserverDriver) ImportEvent(event internal.DBChangeEvent, schema *inte
 	p.pending.WriteString(sql)
 	p.count++
 	p.size += len(sql)
-	if p.size >= maxBytesSizeInsert || p.importConfig.Single {
+	if p.size >= maxBytesSizeInsert {
+		return p.FlushBatch()
+	}
+	return nil
+}
+
+// ImportBatchLimits returns no driver specific limits since ImportEvent flushes the batch once its statements reach
+// their maximum size.
+func (p *sqlserverDriver) ImportBatchLimits() (int, int) {
+	return 0, 0
+}
+
+// FlushBatch executes the pending insert statements.
+func (p *sqlserverDriver) FlushBatch() error {
+	if p.size > 0 {
 		if err := p.executor(p.pending.String()); err != nil {
 			p.logger.Error("offending sql: %s", p.pending.String())
 			return fmt.Errorf("unable to execute sql: %w", err)
@@ -204,23 +253,17 @@ func (p *sqlserverDriver) ImportEvent(event internal.DBChangeEvent, schema *inte
 
 // ImportCompleted is called when all events have been processed.
 func (p *sqlserverDriver) ImportCompleted() error {
-	if p.size > 0 {
-		if err := p.executor(p.pending.String()); err != nil {
-			p.logger.Error("offending sql: %s", p.pending.String())
-			return fmt.Errorf("unable to execute sql: %w", err)
-		}
-	}
-	return nil
+	return p.FlushBatch()
 }
 
 // Import is called to import data from the source.
 func (p *sqlserverDriver) Import(config internal.ImporterConfig) error {
 	p.logger = config.Logger.WithPrefix("[sqlserver]")
-	db, err := p.connectToDB(config.Context, config.URL)
+	db, reader, err := p.connectToDB(config.Context, config.URL)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer util.CloseWithReadReplica(db, reader)
 
 	p.importConfig = config
 	p.registry = config.SchemaRegistry
@@ -250,6 +293,8 @@ func (p *sqlserverDriver) ExampleURL() string {
 func (p *sqlserverDriver) Help() string {
 	var help strings.Builder
 	help.WriteString(util.GenerateHelpSection("Schema", "The database will match the public schema from the Shopmonkey transactional database.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Read Replica", "Add readURL=url (url encoded) to query the schema from a read replica instead of the primary. Writes always go to the primary.\nThe read replica uses the credentials from the primary when its url doesn't have any.\n"))
 	return help.String()
 }
 
@@ -260,27 +305,30 @@ func (p *sqlserverDriver) Aliases() []string {
 // Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
 func (p *sqlserverDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
 	p.logger = logger.WithPrefix("[sqlserver]")
-	db, err := p.connectToDB(ctx, url)
+	db, reader, err := p.connectToDB(ctx, url)
 	if err != nil {
 		return err
 	}
-	return db.Close()
+	return util.CloseWithReadReplica(db, reader)
 }
 
 // Configuration returns the configuration fields for the driver.
 func (p *sqlserverDriver) Configuration() []internal.DriverField {
-	return internal.NewDatabaseConfiguration(1433)
+	return append(internal.NewDatabaseConfiguration(1433), internal.ReadReplicaField())
 }
 
 // Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
 func (p *sqlserverDriver) Validate(values map[string]any) (string, []internal.FieldError) {
-	return internal.URLFromDatabaseConfiguration("sqlserver", 1433, values), nil
+	url := internal.URLFromDatabaseConfiguration("sqlserver", 1433, values)
+	return internal.AppendReadURLFromDatabaseConfiguration(url, "sqlserver", 1433, values), nil
 }
 
 // MigrateNewTable is called when a new table is detected with the appropriate information for the driver to perform the migration.
 func (p *sqlserverDriver) MigrateNewTable(ctx context.Context, logger logger.Logger, schema *internal.Schema) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
 	if _, ok := p.dbschema[schema.Table]; ok {
 		logger.Info("table already exists for: %s, dropping and recreating...", schema.Table)
 		if err := util.DropTable(ctx, logger, p.db, quoteIdentifier(schema.Table, true)); err != nil {
@@ -299,6 +347,8 @@ func (p *sqlserverDriver) MigrateNewTable(ctx context.Context, logger logger.Log
 func (p *sqlserverDriver) MigrateNewColumns(ctx context.Context, logger logger.Logger, schema *internal.Schema, columns []string) error {
 	p.waitGroup.Add(1)
 	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
 	sqls := addNewColumnsSQL(logger, columns, schema, p.dbschema)
 	for _, sql := range sqls {
 		logger.Trace("migrating new columns: %s", sql)
@@ -311,6 +361,39 @@ func (p *sqlserverDriver) MigrateNewColumns(ctx context.Context, logger logger.L
 	return p.refreshSchema(ctx, p.db, true)
 }
 
+// MissingColumns reloads the destination schema and returns the columns of the schemas which are missing from their tables.
+func (p *sqlserverDriver) MissingColumns(ctx context.Context, logger logger.Logger, schemas []*internal.Schema) (map[string][]string, error) {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	if err := p.refreshSchema(ctx, p.db, false); err != nil {
+		return nil, err
+	}
+	return util.MissingColumns(p.dbschema, schemas), nil
+}
+
+// Snapshot writes the rows of the table as CSV.
+func (p *sqlserverDriver) Snapshot(ctx context.Context, logger logger.Logger, table string, limit int, w io.Writer) error {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	if p.reader == nil {
+		return internal.ErrDriverStopped
+	}
+	name, ok := util.FindTable(p.dbschema, table)
+	if !ok {
+		return internal.ErrTableNotFound
+	}
+	ctx, cancel := util.StatementContext(ctx, p.statementTimeout)
+	defer cancel()
+	count, err := util.WriteCSVRows(ctx, p.reader, snapshotSQL(name, limit), w)
+	if err != nil {
+		return fmt.Errorf("error reading table %s: %w", name, err)
+	}
+	logger.Debug("wrote %d rows of table %s", count, name)
+	return nil
+}
+
 func init() {
 	internal.RegisterDriver("sqlserver", &sqlserverDriver{})
 	internal.RegisterImporter("sqlserver", &sqlserverDriver{})
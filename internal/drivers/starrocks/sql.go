@@ -0,0 +1,190 @@
+package starrocks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	operationCol    = "__op" // the column which tells stream load to upsert (0) or delete (1) the row
+	upsertOperation = 0
+	deleteOperation = 1
+	datetimeFormat  = "2006-01-02 15:04:05.000000"
+)
+
+func quoteIdentifier(val string) string {
+	return util.StarRocksIdentifiers.Quote(val)
+}
+
+func quoteIdentifiers(vals []string) []string {
+	return util.StarRocksIdentifiers.QuoteAll(vals)
+}
+
+func sqlType(prop internal.SchemaProperty, isPrimaryKey bool, doris bool) string {
+	switch prop.Type {
+	case "integer":
+		return "BIGINT"
+	case "number":
+		return "DOUBLE"
+	case "boolean":
+		return "BOOLEAN"
+	case "object", "array":
+		return "JSON"
+	case "string":
+		if isPrimaryKey {
+			// key columns can't be STRING
+			return "VARCHAR(255)"
+		}
+		if prop.Format == "date-time" {
+			if doris {
+				return "DATETIME(6)"
+			}
+			return "DATETIME"
+		}
+	}
+	return "STRING"
+}
+
+// keyColumns returns the columns which identify a row.
+func keyColumns(schema *internal.Schema) []string {
+	if len(schema.PrimaryKeys) > 0 {
+		return schema.PrimaryKeys
+	}
+	return []string{"id"}
+}
+
+// dropSQL returns the statement to drop the table if it exists.
+func dropSQL(s *internal.Schema) string {
+	return "DROP TABLE IF EXISTS " + quoteIdentifier(s.Table) + ";"
+}
+
+// createSQL returns the statement to create the table. StarRocks tables use the primary key model and Doris tables use
+// the unique key model with merge on write so that loading a row replaces the row with the same keys. The key columns
+// must be the first columns of the table which Columns guarantees.
+func createSQL(s *internal.Schema, doris bool, replication int) string {
+	keys := keyColumns(s)
+	var sql strings.Builder
+	sql.WriteString("CREATE TABLE IF NOT EXISTS ")
+	sql.WriteString(quoteIdentifier(s.Table))
+	sql.WriteString(" (\n")
+	columns := s.Columns()
+	for i, name := range columns {
+		isPrimaryKey := util.SliceContains(keys, name)
+		sql.WriteString("\t")
+		sql.WriteString(quoteIdentifier(name))
+		sql.WriteString(" ")
+		sql.WriteString(sqlType(s.Properties[name], isPrimaryKey, doris))
+		if isPrimaryKey {
+			sql.WriteString(" NOT NULL")
+		} else {
+			sql.WriteString(" NULL")
+		}
+		if i < len(columns)-1 {
+			sql.WriteString(",")
+		}
+		sql.WriteString("\n")
+	}
+	sql.WriteString(")")
+	if doris {
+		sql.WriteString(" UNIQUE KEY (")
+	} else {
+		sql.WriteString(" PRIMARY KEY (")
+	}
+	sql.WriteString(strings.Join(quoteIdentifiers(keys), ", "))
+	sql.WriteString(")\nDISTRIBUTED BY HASH (")
+	sql.WriteString(strings.Join(quoteIdentifiers(keys), ", "))
+	sql.WriteString(")")
+	var properties []string
+	if doris {
+		properties = append(properties, `"enable_unique_key_merge_on_write" = "true"`)
+	}
+	if replication > 0 {
+		properties = append(properties, fmt.Sprintf(`"replication_num" = "%d"`, replication))
+	}
+	if len(properties) > 0 {
+		sql.WriteString("\nPROPERTIES (")
+		sql.WriteString(strings.Join(properties, ", "))
+		sql.WriteString(")")
+	}
+	sql.WriteString(";")
+	return sql.String()
+}
+
+// addNewColumnsSQL returns the statement to add the columns which don't exist yet. The columns are added with a single
+// statement since a table only allows one schema change at a time.
+func addNewColumnsSQL(logger logger.Logger, columns []string, s *internal.Schema, db internal.DatabaseSchema, doris bool) string {
+	var adds []string
+	for _, column := range columns {
+		if ok, _ := db.GetType(s.Table, column); ok {
+			logger.Warn("skipping migration for column: %s for table: %s since it already exists", column, s.Table)
+			continue
+		}
+		adds = append(adds, quoteIdentifier(column)+" "+sqlType(s.Properties[column], false, doris)+" NULL")
+	}
+	if len(adds) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN (%s);", quoteIdentifier(s.Table), strings.Join(adds, ", "))
+}
+
+// toValue converts a JSON value to the value stream load expects for the column. Timestamps are converted to UTC
+// without the offset since DATETIME columns don't parse ISO 8601.
+func toValue(val any, prop internal.SchemaProperty) any {
+	if str, ok := val.(string); ok && prop.Type == "string" && prop.Format == "date-time" {
+		if tv, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			return tv.UTC().Format(datetimeFormat)
+		}
+	}
+	return val
+}
+
+// toRow returns the row to load for the object with the operation.
+func toRow(s *internal.Schema, object map[string]any, operation int) map[string]any {
+	row := make(map[string]any, len(object)+1)
+	for _, name := range s.Columns() {
+		if val, ok := object[name]; ok {
+			row[name] = toValue(val, s.Properties[name])
+		}
+	}
+	row[operationCol] = operation
+	return row
+}
+
+// deletedKeys returns the key values of a deleted row using the keys of the event when available.
+func deletedKeys(keys []string, record *util.Record) map[string]any {
+	object := map[string]any{keys[len(keys)-1]: record.Id}
+	if record.Event != nil && len(record.Event.Key) == len(keys) {
+		for i, key := range keys {
+			object[key] = record.Event.Key[i]
+		}
+	}
+	return object
+}
+
+// toRows returns the rows to load for the records of a single table. Deleted rows only have their keys set.
+func toRows(s *internal.Schema, records []*util.Record) []map[string]any {
+	keys := keyColumns(s)
+	rows := make([]map[string]any, 0, len(records))
+	for _, record := range records {
+		if record.Operation == "DELETE" || record.Object == nil {
+			rows = append(rows, toRow(s, deletedKeys(keys, record), deleteOperation))
+			continue
+		}
+		rows = append(rows, toRow(s, record.Object, upsertOperation))
+	}
+	return rows
+}
+
+// snapshotSQL returns the query for the rows of the table, all of them if the limit is 0.
+func snapshotSQL(table string, limit int) string {
+	sql := "SELECT * FROM " + quoteIdentifier(table)
+	if limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return sql
+}
@@ -0,0 +1,141 @@
+package starrocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	defaultHTTPPort        = 8030
+	streamLoadAttempts     = 3
+	streamLoadTimeout      = 10 * time.Minute
+	streamLoadRetryTimeout = 5 * time.Minute
+)
+
+// streamLoadResult is the response of a stream load.
+type streamLoadResult struct {
+	Status            string `json:"Status"`
+	Message           string `json:"Message"`
+	NumberLoadedRows  int    `json:"NumberLoadedRows"`
+	ErrorURL          string `json:"ErrorURL"`
+	ExistingJobStatus string `json:"ExistingJobStatus"`
+}
+
+// streamLoader loads rows into a table with the Stream Load HTTP API of the frontend.
+type streamLoader struct {
+	logger   logger.Logger
+	baseURL  string
+	database string
+	username string
+	password string
+	doris    bool
+	client   *http.Client
+	count    atomic.Int64
+}
+
+func newStreamLoader(logger logger.Logger, baseURL string, database string, username string, password string, doris bool) *streamLoader {
+	l := &streamLoader{
+		logger:   logger,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		database: database,
+		username: username,
+		password: password,
+		doris:    doris,
+	}
+	l.client = &http.Client{
+		Timeout: streamLoadTimeout,
+		// the frontend redirects the load to a backend which is a different host so the credentials have to be added back
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			req.SetBasicAuth(l.username, l.password)
+			return nil
+		},
+	}
+	return l
+}
+
+// label returns a unique label for a load. The label is kept across retries of the same load so a load which
+// succeeded but whose response was lost isn't applied twice.
+func (l *streamLoader) label(table string) string {
+	return fmt.Sprintf("eds_%s_%d_%d", strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, table), time.Now().UnixNano(), l.count.Add(1))
+}
+
+// load loads the rows into the table. Each row has the columns and the operation column which decides whether the row
+// is upserted or deleted.
+func (l *streamLoader) load(ctx context.Context, table string, columns []string, rows []map[string]any) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(rows)
+	if err != nil {
+		return fmt.Errorf("error encoding rows for table: %s. %w", table, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/api/%s/%s/_stream_load", l.baseURL, url.PathEscape(l.database), url.PathEscape(table)), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating stream load request: %w", err)
+	}
+	req.SetBasicAuth(l.username, l.password)
+	req.Header.Set("Expect", "100-continue")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("label", l.label(table))
+	req.Header.Set("format", "json")
+	req.Header.Set("strip_outer_array", "true")
+	req.Header.Set("columns", strings.Join(columns, ",")+","+operationCol)
+	if l.doris {
+		// doris uses a delete condition on the operation column instead of the __op column of a primary key table
+		req.Header.Set("merge_type", "MERGE")
+		req.Header.Set("delete", fmt.Sprintf("%s=%d", operationCol, deleteOperation))
+	}
+	started := time.Now()
+	retry := util.NewHTTPRetry(req, util.WithLogger(l.logger), util.WithClient(l.client), util.WithMaxAttempts(streamLoadAttempts), util.WithTimeout(streamLoadRetryTimeout))
+	resp, err := retry.Do()
+	if err != nil {
+		return internal.NewRetryableError(fmt.Errorf("error sending stream load for table: %s. %w", table, err))
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return internal.NewRetryableError(fmt.Errorf("error reading stream load response for table: %s. %w", table, err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return internal.NewRetryableError(fmt.Errorf("stream load for table: %s failed with status code: %d. %s", table, resp.StatusCode, string(buf)))
+	}
+	var result streamLoadResult
+	if err := json.Unmarshal(buf, &result); err != nil {
+		return fmt.Errorf("error decoding stream load response for table: %s. %w", table, err)
+	}
+	switch result.Status {
+	case "Success", "Publish Timeout":
+		// a publish timeout means the load was committed and the data will be visible shortly
+	case "Label Already Exists":
+		if result.ExistingJobStatus != "FINISHED" && result.ExistingJobStatus != "VISIBLE" {
+			return internal.NewRetryableError(fmt.Errorf("stream load for table: %s has a pending load with the same label (%s)", table, result.ExistingJobStatus))
+		}
+	default:
+		if result.ErrorURL != "" {
+			return fmt.Errorf("stream load for table: %s failed: %s. %s (see %s)", table, result.Status, result.Message, result.ErrorURL)
+		}
+		return fmt.Errorf("stream load for table: %s failed: %s. %s", table, result.Status, result.Message)
+	}
+	l.logger.Debug("loaded %d rows into %s in %v", result.NumberLoadedRows, table, time.Since(started))
+	return nil
+}
@@ -0,0 +1,81 @@
+package starrocks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLoad(t *testing.T) {
+	var headers http.Header
+	var rows []map[string]any
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		buf, _ := io.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(buf, &rows))
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "root", user)
+		assert.Equal(t, "secret", pass)
+		w.Write([]byte(`{"Status":"Success","Message":"OK","NumberLoadedRows":2}`))
+	}))
+	defer backend.Close()
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/api/eds/order/_stream_load", r.URL.Path)
+		http.Redirect(w, r, backend.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer frontend.Close()
+
+	l := newStreamLoader(logger.NewTestLogger(), frontend.URL, "eds", "root", "secret", false)
+	err := l.load(context.Background(), "order", []string{"id", "total"}, []map[string]any{
+		{"id": "1", "total": 1.5, "__op": upsertOperation},
+		{"id": "2", "__op": deleteOperation},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "json", headers.Get("format"))
+	assert.Equal(t, "true", headers.Get("strip_outer_array"))
+	assert.Equal(t, "id,total,__op", headers.Get("columns"))
+	assert.Contains(t, headers.Get("label"), "eds_order_")
+	assert.Empty(t, headers.Get("merge_type"))
+	assert.Len(t, rows, 2)
+	assert.Equal(t, float64(deleteOperation), rows[1]["__op"])
+}
+
+func TestStreamLoadDoris(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.Write([]byte(`{"Status":"Success","Message":"OK"}`))
+	}))
+	defer srv.Close()
+	l := newStreamLoader(logger.NewTestLogger(), srv.URL, "eds", "root", "", true)
+	assert.NoError(t, l.load(context.Background(), "order", []string{"id"}, []map[string]any{{"id": "1", "__op": deleteOperation}}))
+	assert.Equal(t, "MERGE", headers.Get("merge_type"))
+	assert.Equal(t, "__op=1", headers.Get("delete"))
+}
+
+func TestStreamLoadFailed(t *testing.T) {
+	status := `{"Status":"Fail","Message":"too many filtered rows","ErrorURL":"http://be/error_log"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(status))
+	}))
+	defer srv.Close()
+	l := newStreamLoader(logger.NewTestLogger(), srv.URL, "eds", "root", "", false)
+	rows := []map[string]any{{"id": "1", "__op": upsertOperation}}
+	err := l.load(context.Background(), "order", []string{"id"}, rows)
+	assert.ErrorContains(t, err, "too many filtered rows")
+	assert.ErrorContains(t, err, "http://be/error_log")
+
+	status = `{"Status":"Label Already Exists","ExistingJobStatus":"FINISHED"}`
+	assert.NoError(t, l.load(context.Background(), "order", []string{"id"}, rows))
+
+	status = `{"Status":"Label Already Exists","ExistingJobStatus":"RUNNING"}`
+	assert.Error(t, l.load(context.Background(), "order", []string{"id"}, rows))
+}
@@ -0,0 +1,265 @@
+package synapse
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/drivers/sqlserver"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	maxDeleteKeys  = 1_000 // number of keys in a single DELETE ... IN statement
+	maxInsertRows  = 500   // number of rows in a single INSERT ... SELECT ... UNION ALL statement
+	primaryKeyType = "VARCHAR(64)"
+)
+
+// dialect handles the differences between a Synapse dedicated SQL pool and a Fabric Warehouse.
+// Neither supports MERGE reliably, DROP TABLE IF EXISTS, multi-row VALUES or enforced primary keys which the sqlserver driver uses.
+type dialect struct {
+	fabric bool
+}
+
+func quoteIdentifier(val string) string {
+	return util.SQLServerIdentifiers.Quote(val)
+}
+
+func quoteIdentifiers(vals []string) []string {
+	return util.SQLServerIdentifiers.QuoteAll(vals)
+}
+
+// stringType returns the type for unbounded strings. Fabric only supports VARCHAR with a UTF-8 collation.
+func (d dialect) stringType() string {
+	if d.fabric {
+		return "VARCHAR(MAX)"
+	}
+	return "NVARCHAR(MAX)"
+}
+
+func (d dialect) quoteString(val string) string {
+	quoted := "'" + strings.ReplaceAll(val, "'", "''") + "'"
+	if d.fabric {
+		return quoted
+	}
+	return "N" + quoted
+}
+
+func (d dialect) sqlType(prop internal.SchemaProperty, isPrimaryKey bool) string {
+	if isPrimaryKey {
+		return primaryKeyType
+	}
+	switch prop.Type {
+	case "integer":
+		return "BIGINT"
+	case "number":
+		return "FLOAT"
+	case "boolean":
+		return "BIT"
+	case "string":
+		if prop.IsBinary() {
+			return "VARBINARY(MAX)"
+		}
+	case "array":
+		if prop.Items != nil && prop.Items.Enum != nil {
+			return "VARCHAR(64)"
+		}
+	}
+	return d.stringType()
+}
+
+// toValue converts a JSON value to the string representation used for both SQL literals and CSV fields.
+// Binary values are hex which is what COPY INTO expects for a VARBINARY column. It returns false if the value is NULL.
+func toValue(val any, prop internal.SchemaProperty) (string, bool) {
+	switch v := util.EncodeBinaryValue(val, prop).(type) {
+	case nil:
+		return "", false
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	case float64:
+		if prop.Type == "integer" {
+			return strconv.FormatInt(int64(v), 10), true
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		return v, true
+	default:
+		return util.JSONStringify(v), true
+	}
+}
+
+func (d dialect) quoteValue(val any, prop internal.SchemaProperty) string {
+	v, ok := toValue(val, prop)
+	if !ok {
+		if !prop.Nullable {
+			switch prop.Type {
+			case "integer", "number", "boolean":
+				return "0"
+			}
+		}
+		return "NULL"
+	}
+	switch val.(type) {
+	case bool, float64:
+		if prop.Type == "integer" || prop.Type == "number" || prop.Type == "boolean" {
+			return v
+		}
+	}
+	if _, ok := util.ToBinaryValue(val, prop).([]byte); ok {
+		return "0x" + v
+	}
+	return d.quoteString(v)
+}
+
+func keyColumn(schema *internal.Schema) string {
+	if len(schema.PrimaryKeys) > 0 {
+		return schema.PrimaryKeys[len(schema.PrimaryKeys)-1]
+	}
+	return "id"
+}
+
+func (d dialect) dropSQL(table string) string {
+	return fmt.Sprintf("IF OBJECT_ID(%s) IS NOT NULL DROP TABLE %s;\n", d.quoteString(quoteIdentifier(table)), quoteIdentifier(table))
+}
+
+func (d dialect) createSQL(s *internal.Schema) string {
+	var sql strings.Builder
+	sql.WriteString(d.dropSQL(s.Table))
+	sql.WriteString("CREATE TABLE ")
+	sql.WriteString(quoteIdentifier(s.Table))
+	sql.WriteString(" (\n")
+	columns := s.Columns()
+	for i, name := range columns {
+		prop := s.Properties[name]
+		isPrimaryKey := util.SliceContains(s.PrimaryKeys, name)
+		sql.WriteString("\t")
+		sql.WriteString(quoteIdentifier(name))
+		sql.WriteString(" ")
+		sql.WriteString(d.sqlType(prop, isPrimaryKey))
+		if isPrimaryKey || (util.SliceContains(s.Required, name) && !prop.Nullable) {
+			sql.WriteString(" NOT NULL")
+		}
+		if i < len(columns)-1 || len(s.PrimaryKeys) > 0 {
+			sql.WriteString(",")
+		}
+		sql.WriteString("\n")
+	}
+	if len(s.PrimaryKeys) > 0 {
+		// primary keys are informational only and must not be enforced
+		sql.WriteString("\tCONSTRAINT ")
+		sql.WriteString(quoteIdentifier("pk_" + s.Table))
+		sql.WriteString(" PRIMARY KEY NONCLUSTERED (")
+		sql.WriteString(strings.Join(quoteIdentifiers(s.PrimaryKeys), ", "))
+		sql.WriteString(") NOT ENFORCED\n")
+	}
+	sql.WriteString(")")
+	if !d.fabric {
+		// fabric manages distribution automatically and rejects the WITH clause
+		sql.WriteString(" WITH (DISTRIBUTION = HASH(")
+		sql.WriteString(quoteIdentifier(keyColumn(s)))
+		sql.WriteString("), HEAP)")
+	}
+	sql.WriteString(";\n")
+	return sql.String()
+}
+
+func (d dialect) addNewColumnsSQL(logger logger.Logger, columns []string, s *internal.Schema, db internal.DatabaseSchema) []string {
+	var res []string
+	for _, column := range columns {
+		if ok, _ := db.GetType(s.Table, column); ok {
+			logger.Warn("skipping migration for column: %s for table: %s since it already exists", column, s.Table)
+			continue
+		}
+		res = append(res, fmt.Sprintf("ALTER TABLE %s ADD %s %s;", quoteIdentifier(s.Table), quoteIdentifier(column), d.sqlType(s.Properties[column], false)))
+	}
+	return res
+}
+
+// deleteSQL returns the statements to delete the rows with the keys.
+func (d dialect) deleteSQL(s *internal.Schema, keys []string) string {
+	var sql strings.Builder
+	for start := 0; start < len(keys); start += maxDeleteKeys {
+		end := min(start+maxDeleteKeys, len(keys))
+		values := make([]string, 0, end-start)
+		for _, key := range keys[start:end] {
+			values = append(values, d.quoteString(key))
+		}
+		sql.WriteString("DELETE FROM ")
+		sql.WriteString(quoteIdentifier(s.Table))
+		sql.WriteString(" WHERE ")
+		sql.WriteString(quoteIdentifier(keyColumn(s)))
+		sql.WriteString(" IN (")
+		sql.WriteString(strings.Join(values, ","))
+		sql.WriteString(");\n")
+	}
+	return sql.String()
+}
+
+// rowSQL returns the SELECT of the row which the insert statements combine with UNION ALL.
+func (d dialect) rowSQL(s *internal.Schema, row map[string]any) string {
+	columns := s.Columns()
+	values := make([]string, len(columns))
+	for i, name := range columns {
+		values[i] = d.quoteValue(row[name], s.Properties[name])
+	}
+	return "SELECT " + strings.Join(values, ",")
+}
+
+// insertSQL returns the statements to insert the rows. Multi-row VALUES isn't supported so rows are combined with UNION ALL.
+func (d dialect) insertSQL(s *internal.Schema, rows []map[string]any) string {
+	var sql strings.Builder
+	columns := s.Columns()
+	for start := 0; start < len(rows); start += maxInsertRows {
+		end := min(start+maxInsertRows, len(rows))
+		sql.WriteString("INSERT INTO ")
+		sql.WriteString(quoteIdentifier(s.Table))
+		sql.WriteString(" (")
+		sql.WriteString(strings.Join(quoteIdentifiers(columns), ","))
+		sql.WriteString(")")
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				sql.WriteString(" UNION ALL")
+			}
+			sql.WriteString("\n")
+			sql.WriteString(d.rowSQL(s, row))
+		}
+		sql.WriteString(";\n")
+	}
+	return sql.String()
+}
+
+// parseURL returns the sqlserver dsn, whether the target is fabric and the staging container url.
+func parseURL(urlString string) (string, bool, string, error) {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return "", false, "", fmt.Errorf("error parsing url: %w", err)
+	}
+	query := u.Query()
+	fabric := u.Scheme == "fabric" || query.Get("fabric") == "true"
+	staging := query.Get("staging")
+	query.Del("fabric")
+	query.Del("staging")
+	if query.Get("encrypt") == "" && !util.IsLocalhost(u.Host) {
+		query.Set("encrypt", "true")
+	}
+	u.RawQuery = query.Encode()
+	dsn, err := sqlserver.ParseURLToDSN(u.String())
+	if err != nil {
+		return "", false, "", err
+	}
+	return dsn, fabric, staging, nil
+}
+
+// snapshotSQL returns the query for the rows of the table, all of them if the limit is 0.
+func snapshotSQL(table string, limit int) string {
+	if limit > 0 {
+		return fmt.Sprintf("SELECT TOP (%d) * FROM %s", limit, quoteIdentifier(table))
+	}
+	return "SELECT * FROM " + quoteIdentifier(table)
+}
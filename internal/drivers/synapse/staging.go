@@ -0,0 +1,152 @@
+package synapse
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+const blobAPIVersion = "2023-11-03"
+
+// stager uploads CSV files to an Azure Blob Storage or ADLS Gen2 container so they can be loaded with COPY INTO
+// which is much faster than inserting rows for large imports and batches.
+type stager struct {
+	container string // the container url used to upload without the SAS token
+	location  string // the container url used by COPY INTO
+	sas       string // the SAS token without the leading ?
+	client    *http.Client
+}
+
+func newStager(urlString string) (*stager, error) {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing staging url: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("staging url must be an https url to an Azure Blob Storage container")
+	}
+	if u.RawQuery == "" {
+		return nil, fmt.Errorf("staging url must include a SAS token")
+	}
+	sas := u.RawQuery
+	u.RawQuery = ""
+	location := strings.TrimRight(u.String(), "/")
+	// ADLS Gen2 accounts also accept the blob api so upload with it and load from the dfs endpoint
+	if account, ok := strings.CutSuffix(u.Host, ".dfs.core.windows.net"); ok {
+		u.Host = account + ".blob.core.windows.net"
+	}
+	return &stager{
+		container: strings.TrimRight(u.String(), "/"),
+		location:  location,
+		sas:       sas,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// blobURL returns the url of the blob without the SAS token.
+func (s *stager) blobURL(name string) string {
+	return s.container + "/" + name
+}
+
+// locationURL returns the url of the blob for COPY INTO.
+func (s *stager) locationURL(name string) string {
+	return s.location + "/" + name
+}
+
+func (s *stager) do(ctx context.Context, method string, name string, body []byte, expect int) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.blobURL(name)+"?"+s.sas, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("x-ms-version", blobAPIVersion)
+	if method == http.MethodPut {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		req.Header.Set("Content-Type", "text/csv")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending %s request for blob %s: %w", method, name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expect {
+		buf, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d for %s of blob %s: %s", resp.StatusCode, method, name, strings.TrimSpace(string(buf)))
+	}
+	return nil
+}
+
+// upload the data to the blob.
+func (s *stager) upload(ctx context.Context, name string, data []byte) error {
+	return s.do(ctx, http.MethodPut, name, data, http.StatusCreated)
+}
+
+// remove the blob.
+func (s *stager) remove(ctx context.Context, name string) error {
+	return s.do(ctx, http.MethodDelete, name, nil, http.StatusAccepted)
+}
+
+// copySQL returns the COPY INTO statement to load the staged blob into the table.
+func (s *stager) copySQL(d dialect, schema *internal.Schema, name string) string {
+	var sql strings.Builder
+	sql.WriteString("COPY INTO ")
+	sql.WriteString(quoteIdentifier(schema.Table))
+	sql.WriteString(" (")
+	sql.WriteString(strings.Join(quoteIdentifiers(schema.Columns()), ","))
+	sql.WriteString(")\nFROM ")
+	sql.WriteString(d.quoteString(s.locationURL(name)))
+	sql.WriteString("\nWITH (\n\tFILE_TYPE = 'CSV',\n\tCREDENTIAL = (IDENTITY = 'Shared Access Signature', SECRET = ")
+	sql.WriteString(d.quoteString(s.sas))
+	sql.WriteString("),\n\tFIELDQUOTE = '\"',\n\tFIELDTERMINATOR = ',',\n\tROWTERMINATOR = '0x0A',\n\tENCODING = 'UTF8'\n);\n")
+	return sql.String()
+}
+
+// stagedFile buffers the rows for a table as CSV in the column order of the schema.
+type stagedFile struct {
+	schema *internal.Schema
+	buf    bytes.Buffer
+	writer *csv.Writer
+	count  int
+}
+
+func newStagedFile(schema *internal.Schema) *stagedFile {
+	f := &stagedFile{schema: schema}
+	f.writer = csv.NewWriter(&f.buf)
+	return f
+}
+
+// add writes the object as a row. NULL values are written as empty fields.
+func (f *stagedFile) add(object map[string]any) error {
+	columns := f.schema.Columns()
+	row := make([]string, len(columns))
+	for i, name := range columns {
+		row[i], _ = toValue(object[name], f.schema.Properties[name])
+	}
+	if err := f.writer.Write(row); err != nil {
+		return fmt.Errorf("error writing csv row: %w", err)
+	}
+	f.count++
+	return nil
+}
+
+// size returns the number of bytes of CSV data written so far.
+func (f *stagedFile) size() int {
+	f.writer.Flush()
+	return f.buf.Len()
+}
+
+// bytes returns the CSV data written so far.
+func (f *stagedFile) bytes() ([]byte, error) {
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
+		return nil, fmt.Errorf("error flushing csv: %w", err)
+	}
+	return f.buf.Bytes(), nil
+}
@@ -0,0 +1,136 @@
+package temporal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+const (
+	actionStart           = "start"
+	actionSignal          = "signal"
+	actionSignalWithStart = "signalWithStart"
+
+	defaultWorkflowID = "eds-{eventId}"
+)
+
+// Rule maps events for a set of tables and operations to a workflow.
+type Rule struct {
+	// Name identifies the rule in logs. Defaults to the action and workflow.
+	Name string `json:"name,omitempty"`
+
+	// Tables the rule applies to. Defaults to all tables.
+	Tables []string `json:"tables,omitempty"`
+
+	// Operations (INSERT, UPDATE, DELETE) the rule applies to. Defaults to all operations.
+	Operations []string `json:"operations,omitempty"`
+
+	// Action is start, signal or signalWithStart. Defaults to start.
+	Action string `json:"action,omitempty"`
+
+	// Workflow is the workflow type to start. Required unless the action is signal.
+	Workflow string `json:"workflow,omitempty"`
+
+	// TaskQueue is the task queue to start the workflow on. Defaults to the taskQueue in the url.
+	TaskQueue string `json:"taskQueue,omitempty"`
+
+	// WorkflowID is the workflow id which can use {table}, {operation}, {id}, {eventId}, {companyId} and {locationId}.
+	// Defaults to eds-{eventId} when starting workflows and is required for signals.
+	WorkflowID string `json:"workflowId,omitempty"`
+
+	// Signal is the name of the signal to send. Required for signal and signalWithStart.
+	Signal string `json:"signal,omitempty"`
+}
+
+func (r *Rule) matches(event *internal.DBChangeEvent) bool {
+	return matchesAny(r.Tables, event.Table) && matchesAny(r.Operations, event.Operation)
+}
+
+func matchesAny(values []string, val string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || strings.EqualFold(v, val) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the rule and fills in the defaults.
+func (r *Rule) validate(taskQueue string) error {
+	if r.Action == "" {
+		r.Action = actionStart
+	}
+	if r.Name == "" {
+		r.Name = r.Action + " " + r.Workflow + r.Signal
+	}
+	switch r.Action {
+	case actionStart, actionSignalWithStart:
+		if r.Workflow == "" {
+			return fmt.Errorf("workflow is required for rule %s", r.Name)
+		}
+		if r.TaskQueue == "" {
+			r.TaskQueue = taskQueue
+		}
+		if r.TaskQueue == "" {
+			return fmt.Errorf("taskQueue is required for rule %s", r.Name)
+		}
+	case actionSignal:
+	default:
+		return fmt.Errorf("invalid action for rule %s: %s. must be start, signal or signalWithStart", r.Name, r.Action)
+	}
+	if r.Action != actionStart {
+		if r.Signal == "" {
+			return fmt.Errorf("signal is required for rule %s", r.Name)
+		}
+		if r.WorkflowID == "" {
+			return fmt.Errorf("workflowId is required for rule %s", r.Name)
+		}
+	}
+	if r.WorkflowID == "" {
+		r.WorkflowID = defaultWorkflowID
+	}
+	return nil
+}
+
+// workflowID returns the workflow id for the event by replacing the placeholders in the template.
+func workflowID(template string, event *internal.DBChangeEvent) string {
+	var companyID, locationID string
+	if event.CompanyID != nil {
+		companyID = *event.CompanyID
+	}
+	if event.LocationID != nil {
+		locationID = *event.LocationID
+	}
+	return strings.NewReplacer(
+		"{table}", event.Table,
+		"{operation}", event.Operation,
+		"{id}", event.GetPrimaryKey(),
+		"{eventId}", event.ID,
+		"{companyId}", companyID,
+		"{locationId}", locationID,
+	).Replace(template)
+}
+
+// loadRules reads the rules from a JSON file containing an array of rules.
+func loadRules(fn string, taskQueue string) ([]Rule, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return nil, fmt.Errorf("error parsing rules file %s: %w", fn, err)
+	}
+	for i := range rules {
+		if err := rules[i].validate(taskQueue); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
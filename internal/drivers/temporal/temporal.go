@@ -0,0 +1,433 @@
+package temporal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/importer"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+)
+
+const (
+	defaultPort      = "7233"
+	defaultNamespace = "default"
+	defaultTimeout   = time.Second * 10
+	defaultRuleName  = "default"
+	deliveredExpiry  = time.Minute * 15 // how long to remember the actions which succeeded when a batch failed
+	maxImportPending = 100
+)
+
+// workflowClient is the part of the temporal client used by the driver.
+type workflowClient interface {
+	ExecuteWorkflow(ctx context.Context, options client.StartWorkflowOptions, workflow interface{}, args ...interface{}) (client.WorkflowRun, error)
+	SignalWorkflow(ctx context.Context, workflowID string, runID string, signalName string, arg interface{}) error
+	SignalWithStartWorkflow(ctx context.Context, workflowID string, signalName string, signalArg interface{}, options client.StartWorkflowOptions, workflow interface{}, workflowArgs ...interface{}) (client.WorkflowRun, error)
+	Close()
+}
+
+// temporalLogger adapts our logger to the temporal client logger. The client is chatty so debug is logged as trace.
+type temporalLogger struct {
+	logger logger.Logger
+}
+
+func formatKeyvals(msg string, keyvals []interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	return sb.String()
+}
+
+func (l *temporalLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Trace("%s", formatKeyvals(msg, keyvals))
+}
+
+func (l *temporalLogger) Info(msg string, keyvals ...interface{}) {
+	l.logger.Debug("%s", formatKeyvals(msg, keyvals))
+}
+
+func (l *temporalLogger) Warn(msg string, keyvals ...interface{}) {
+	l.logger.Warn("%s", formatKeyvals(msg, keyvals))
+}
+
+func (l *temporalLogger) Error(msg string, keyvals ...interface{}) {
+	l.logger.Error("%s", formatKeyvals(msg, keyvals))
+}
+
+// pendingAction is an event to send to the workflow for a rule.
+type pendingAction struct {
+	rule  *Rule
+	event *internal.DBChangeEvent
+}
+
+func (a *pendingAction) key() string {
+	return a.rule.Name + "/" + a.event.ID
+}
+
+type temporalDriver struct {
+	ctx          context.Context
+	logger       logger.Logger
+	client       workflowClient
+	rules        []Rule
+	timeout      time.Duration
+	pending      []pendingAction
+	delivered    map[string]time.Time
+	lock         sync.Mutex
+	once         sync.Once
+	importConfig internal.ImporterConfig
+}
+
+var _ internal.Driver = (*temporalDriver)(nil)
+var _ internal.DriverLifecycle = (*temporalDriver)(nil)
+var _ internal.DriverHelp = (*temporalDriver)(nil)
+var _ internal.Importer = (*temporalDriver)(nil)
+var _ internal.ImporterHelp = (*temporalDriver)(nil)
+var _ importer.BatchHandler = (*temporalDriver)(nil)
+
+// parseURL returns the client options and the rules from the url in the format temporal://host:7233?namespace=default&taskQueue=eds&workflow=HandleChange.
+// The workflow, action, workflowId and signal parameters configure the default rule which is used when no rule in the rules file matches.
+func parseURL(urlString string) (client.Options, []Rule, time.Duration, error) {
+	var opts client.Options
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return opts, nil, 0, fmt.Errorf("unable to parse url: %w", err)
+	}
+	if u.Hostname() == "" {
+		return opts, nil, 0, fmt.Errorf("host is required in url")
+	}
+	query := u.Query()
+	opts.HostPort = u.Host
+	if u.Port() == "" {
+		opts.HostPort = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	opts.Namespace = query.Get("namespace")
+	if opts.Namespace == "" {
+		opts.Namespace = defaultNamespace
+	}
+	apiKey := query.Get("apiKey")
+	if apiKey != "" {
+		opts.Credentials = client.NewAPIKeyStaticCredentials(apiKey)
+	}
+	if query.Get("tls") == "true" || apiKey != "" {
+		opts.ConnectionOptions.TLS = &tls.Config{ServerName: u.Hostname()}
+	}
+	timeout := defaultTimeout
+	if val := query.Get("timeout"); val != "" {
+		if timeout, err = time.ParseDuration(val); err != nil || timeout <= 0 {
+			return opts, nil, 0, fmt.Errorf("invalid timeout: %s", val)
+		}
+	}
+	taskQueue := query.Get("taskQueue")
+	var rules []Rule
+	if fn := query.Get("rules"); fn != "" {
+		if rules, err = loadRules(fn, taskQueue); err != nil {
+			return opts, nil, 0, err
+		}
+	}
+	if query.Get("workflow") != "" || query.Get("signal") != "" {
+		rule := Rule{
+			Name:       defaultRuleName,
+			Action:     query.Get("action"),
+			Workflow:   query.Get("workflow"),
+			WorkflowID: query.Get("workflowId"),
+			Signal:     query.Get("signal"),
+		}
+		if err := rule.validate(taskQueue); err != nil {
+			return opts, nil, 0, err
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return opts, nil, 0, fmt.Errorf("a workflow or rules file is required in url")
+	}
+	return opts, rules, timeout, nil
+}
+
+func (p *temporalDriver) connect(urlString string) error {
+	opts, rules, timeout, err := parseURL(urlString)
+	if err != nil {
+		return err
+	}
+	opts.Logger = &temporalLogger{p.logger}
+	c, err := client.DialContext(p.ctx, opts)
+	if err != nil {
+		return fmt.Errorf("unable to connect to temporal at %s: %w", opts.HostPort, err)
+	}
+	p.client = c
+	p.rules = rules
+	p.timeout = timeout
+	p.delivered = make(map[string]time.Time)
+	return nil
+}
+
+// Start the driver. This is called once at the beginning of the driver's lifecycle.
+func (p *temporalDriver) Start(config internal.DriverConfig) error {
+	p.ctx = config.Context
+	p.logger = config.Logger.WithPrefix("[temporal]")
+	return p.connect(config.URL)
+}
+
+// Stop the driver. This is called once at the end of the driver's lifecycle.
+func (p *temporalDriver) Stop() error {
+	p.logger.Debug("stopping")
+	p.once.Do(func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if p.client != nil {
+			p.client.Close()
+			p.client = nil
+		}
+	})
+	p.logger.Debug("stopped")
+	return nil
+}
+
+// MaxBatchSize returns the maximum number of events that can be processed in a single call to Process and when Flush should be called.
+// Return -1 to indicate that there is no limit.
+func (p *temporalDriver) MaxBatchSize() int {
+	return -1
+}
+
+// Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
+func (p *temporalDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if rule.matches(&event) {
+			p.pending = append(p.pending, pendingAction{rule, &event})
+			return false, nil
+		}
+	}
+	logger.Trace("no rule for table: %s, operation: %s, skipping event: %s", event.Table, event.Operation, event.ID)
+	return false, nil
+}
+
+// execute runs the action for the rule.
+func (p *temporalDriver) execute(action pendingAction) error {
+	ctx, cancel := context.WithTimeout(p.ctx, p.timeout)
+	defer cancel()
+	rule := action.rule
+	id := workflowID(rule.WorkflowID, action.event)
+	opts := client.StartWorkflowOptions{ID: id, TaskQueue: rule.TaskQueue}
+	switch rule.Action {
+	case actionSignal:
+		if err := p.client.SignalWorkflow(ctx, id, "", rule.Signal, action.event); err != nil {
+			return fmt.Errorf("error signaling workflow %s for rule %s: %w", id, rule.Name, err)
+		}
+	case actionSignalWithStart:
+		if _, err := p.client.SignalWithStartWorkflow(ctx, id, rule.Signal, action.event, opts, rule.Workflow, action.event); err != nil {
+			return fmt.Errorf("error signaling workflow %s for rule %s: %w", id, rule.Name, err)
+		}
+	default:
+		if strings.Contains(rule.WorkflowID, "{eventId}") {
+			// the id is unique to the event so a redelivered event shouldn't start the workflow again
+			opts.WorkflowIDReusePolicy = enumspb.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE
+		}
+		if _, err := p.client.ExecuteWorkflow(ctx, opts, rule.Workflow, action.event); err != nil {
+			var started *serviceerror.WorkflowExecutionAlreadyStarted
+			if errors.As(err, &started) {
+				p.logger.Trace("workflow %s already started for rule %s", id, rule.Name)
+				return nil
+			}
+			return fmt.Errorf("error starting workflow %s for rule %s: %w", id, rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
+func (p *temporalDriver) Flush(logger logger.Logger) error {
+	logger.Debug("flush")
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	defer func() {
+		for key, ts := range p.delivered {
+			if now.Sub(ts) > deliveredExpiry {
+				delete(p.delivered, key)
+			}
+		}
+		p.pending = nil
+	}()
+	// actions are run in order so signals to the same workflow arrive in the order of the changes
+	for i, action := range p.pending {
+		key := action.key()
+		if _, ok := p.delivered[key]; ok {
+			logger.Trace("skipping %s which was already delivered", key)
+			delete(p.delivered, key)
+			continue
+		}
+		if err := p.execute(action); err != nil {
+			// the batch will be redelivered so remember what already succeeded to avoid sending it twice
+			for _, done := range p.pending[:i] {
+				p.delivered[done.key()] = now
+			}
+			return err
+		}
+	}
+	logger.Debug("sent %d events to temporal", len(p.pending))
+	return nil
+}
+
+// Name is a unique name for the driver.
+func (p *temporalDriver) Name() string {
+	return "Temporal"
+}
+
+// Description is the description of the driver.
+func (p *temporalDriver) Description() string {
+	return "Supports starting or signaling Temporal workflows for EDS messages with rules by table and operation."
+}
+
+// ExampleURL should return an example URL for configuring the driver.
+func (p *temporalDriver) ExampleURL() string {
+	return "temporal://localhost:7233?namespace=default&taskQueue=eds&workflow=HandleChange"
+}
+
+// Help should return a detailed help documentation for the driver.
+func (p *temporalDriver) Help() string {
+	var help strings.Builder
+	help.WriteString(util.GenerateHelpSection("Default Rule", "Provide workflow=HandleChange and taskQueue=eds to start a workflow for every event. The workflow receives the EDS DBChange event as its only argument.\nUse action=signal (or signalWithStart) with signal=changed and workflowId=order-{id} to signal a workflow instead.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Rules", "Provide a JSON file with rules=/path/to/rules.json to configure the workflows per table and operation. The file is an array of rules with tables, operations,\naction, workflow, taskQueue, workflowId and signal. The first matching rule is used followed by the default rule. Events which don't match a rule are skipped.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Workflow IDs", "The workflowId can use {table}, {operation}, {id}, {eventId}, {companyId} and {locationId}. The default is eds-{eventId} which only starts one workflow per event\neven if the event is redelivered. Signals may be delivered more than once so workflows should handle duplicate events.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Connection", "Use namespace=my-namespace to change the namespace from default. Add tls=true to connect using TLS or apiKey=key for Temporal Cloud.\n"))
+	return help.String()
+}
+
+// CreateDatasource allows the handler to create the datasource before importing data.
+func (p *temporalDriver) CreateDatasource(schema internal.SchemaMap) error {
+	return nil
+}
+
+// ImportEvent allows the handler to process the event.
+func (p *temporalDriver) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	if p.importConfig.DryRun {
+		p.logger.Trace("would have sent event: %s", event.ID)
+		return nil
+	}
+	_, err := p.Process(p.logger, event)
+	return err
+}
+
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *temporalDriver) ImportBatchLimits() (int, int) {
+	return maxImportPending, 0
+}
+
+// FlushBatch sends the pending events.
+func (p *temporalDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
+// ImportCompleted is called when all events have been processed.
+func (p *temporalDriver) ImportCompleted() error {
+	return p.Flush(p.logger)
+}
+
+// Import is called to import data from the source.
+func (p *temporalDriver) Import(config internal.ImporterConfig) error {
+	if config.SchemaOnly {
+		return nil
+	}
+	p.ctx = config.Context
+	p.logger = config.Logger.WithPrefix("[temporal]")
+	p.importConfig = config
+	if err := p.connect(config.URL); err != nil {
+		return err
+	}
+	defer p.client.Close()
+	return importer.Run(p.logger, config, p)
+}
+
+// SupportsDelete returns true if the importer supports deleting data.
+func (p *temporalDriver) SupportsDelete() bool {
+	return false
+}
+
+// Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
+func (p *temporalDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
+	p.ctx = ctx
+	p.logger = logger.WithPrefix("[temporal]")
+	if err := p.connect(url); err != nil {
+		return err
+	}
+	p.client.Close()
+	return nil
+}
+
+// Configuration returns the configuration fields for the driver.
+func (p *temporalDriver) Configuration() []internal.DriverField {
+	return []internal.DriverField{
+		internal.RequiredStringField("Hostname", "The hostname of the Temporal frontend", nil),
+		internal.OptionalNumberField("Port", "The port of the Temporal frontend", internal.IntPointer(7233)),
+		internal.OptionalStringField("Namespace", "The Temporal namespace", internal.StringPointer(defaultNamespace)),
+		internal.OptionalPasswordField("API Key", "The API key for Temporal Cloud", nil),
+		internal.OptionalBooleanField("TLS", "Connect using TLS", false),
+		internal.OptionalStringField("Task Queue", "The task queue to start workflows on", nil),
+		internal.OptionalStringField("Workflow", "The workflow type to start for each event", nil),
+		internal.OptionalStringField("Rules File", "The path to a JSON file with the workflow rules", nil),
+	}
+}
+
+// Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
+func (p *temporalDriver) Validate(values map[string]any) (string, []internal.FieldError) {
+	taskQueue := internal.GetOptionalStringValue("Task Queue", "", values)
+	workflow := internal.GetOptionalStringValue("Workflow", "", values)
+	rules := internal.GetOptionalStringValue("Rules File", "", values)
+	if workflow == "" && rules == "" {
+		return "", []internal.FieldError{internal.NewFieldError("Workflow", "a workflow or rules file is required")}
+	}
+	if workflow != "" && taskQueue == "" {
+		return "", []internal.FieldError{internal.NewFieldError("Task Queue", "required to start the workflow")}
+	}
+	if rules != "" {
+		if _, err := loadRules(rules, taskQueue); err != nil {
+			return "", []internal.FieldError{internal.NewFieldError("Rules File", err.Error())}
+		}
+	}
+	u := url.URL{
+		Scheme: "temporal",
+		Host:   fmt.Sprintf("%s:%d", internal.GetRequiredStringValue("Hostname", values), internal.GetOptionalIntValue("Port", 7233, values)),
+	}
+	query := url.Values{}
+	query.Set("namespace", internal.GetOptionalStringValue("Namespace", defaultNamespace, values))
+	if apiKey := internal.GetOptionalStringValue("API Key", "", values); apiKey != "" {
+		query.Set("apiKey", apiKey)
+	}
+	if internal.GetOptionalBoolValue("TLS", false, values) {
+		query.Set("tls", "true")
+	}
+	if taskQueue != "" {
+		query.Set("taskQueue", taskQueue)
+	}
+	if workflow != "" {
+		query.Set("workflow", workflow)
+	}
+	if rules != "" {
+		query.Set("rules", rules)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func init() {
+	internal.RegisterDriver("temporal", &temporalDriver{})
+	internal.RegisterImporter("temporal", &temporalDriver{})
+}
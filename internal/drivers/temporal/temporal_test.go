@@ -0,0 +1,166 @@
+package temporal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+)
+
+type call struct {
+	action     string
+	workflowID string
+	workflow   string
+	signal     string
+	reuse      enumspb.WorkflowIdReusePolicy
+}
+
+type fakeClient struct {
+	calls []call
+	errs  map[string]error
+}
+
+func (c *fakeClient) ExecuteWorkflow(ctx context.Context, options client.StartWorkflowOptions, workflow interface{}, args ...interface{}) (client.WorkflowRun, error) {
+	c.calls = append(c.calls, call{action: actionStart, workflowID: options.ID, workflow: workflow.(string), reuse: options.WorkflowIDReusePolicy})
+	return nil, c.errs[options.ID]
+}
+
+func (c *fakeClient) SignalWorkflow(ctx context.Context, workflowID string, runID string, signalName string, arg interface{}) error {
+	c.calls = append(c.calls, call{action: actionSignal, workflowID: workflowID, signal: signalName})
+	return c.errs[workflowID]
+}
+
+func (c *fakeClient) SignalWithStartWorkflow(ctx context.Context, workflowID string, signalName string, signalArg interface{}, options client.StartWorkflowOptions, workflow interface{}, workflowArgs ...interface{}) (client.WorkflowRun, error) {
+	c.calls = append(c.calls, call{action: actionSignalWithStart, workflowID: workflowID, workflow: workflow.(string), signal: signalName})
+	return nil, c.errs[workflowID]
+}
+
+func (c *fakeClient) Close() {}
+
+func companyID() *string {
+	id := "c1"
+	return &id
+}
+
+func TestWorkflowID(t *testing.T) {
+	event := &internal.DBChangeEvent{ID: "e1", Table: "order", Operation: "UPDATE", Key: []string{"r", "o1"}, CompanyID: companyID()}
+	assert.Equal(t, "eds-e1", workflowID(defaultWorkflowID, event))
+	assert.Equal(t, "c1/order-o1-UPDATE/", workflowID("{companyId}/{table}-{id}-{operation}/{locationId}", event))
+}
+
+func TestLoadRules(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "rules.json")
+	assert.NoError(t, os.WriteFile(fn, []byte(`[{"tables":["order"],"workflow":"OrderCreated"},{"action":"signal","signal":"changed","workflowId":"customer-{id}"}]`), 0644))
+	rules, err := loadRules(fn, "eds")
+	assert.NoError(t, err)
+	assert.Len(t, rules, 2)
+	assert.Equal(t, "start OrderCreated", rules[0].Name)
+	assert.Equal(t, "eds", rules[0].TaskQueue)
+	assert.Equal(t, defaultWorkflowID, rules[0].WorkflowID)
+	assert.Equal(t, actionSignal, rules[1].Action)
+
+	_, err = loadRules(fn, "")
+	assert.ErrorContains(t, err, "taskQueue is required")
+
+	assert.NoError(t, os.WriteFile(fn, []byte(`[{"action":"signal","signal":"changed"}]`), 0644))
+	_, err = loadRules(fn, "eds")
+	assert.ErrorContains(t, err, "workflowId is required")
+
+	assert.NoError(t, os.WriteFile(fn, []byte(`[{"action":"cancel"}]`), 0644))
+	_, err = loadRules(fn, "eds")
+	assert.ErrorContains(t, err, "invalid action")
+}
+
+func TestParseURL(t *testing.T) {
+	opts, rules, timeout, err := parseURL("temporal://temporal.example.com?namespace=shop&taskQueue=eds&workflow=HandleChange&apiKey=secret&timeout=5s")
+	assert.NoError(t, err)
+	assert.Equal(t, "temporal.example.com:7233", opts.HostPort)
+	assert.Equal(t, "shop", opts.Namespace)
+	assert.NotNil(t, opts.Credentials)
+	assert.NotNil(t, opts.ConnectionOptions.TLS)
+	assert.Equal(t, 5*time.Second, timeout)
+	assert.Len(t, rules, 1)
+	assert.Equal(t, defaultRuleName, rules[0].Name)
+
+	_, _, _, err = parseURL("temporal://localhost:7233")
+	assert.ErrorContains(t, err, "a workflow or rules file is required")
+	_, _, _, err = parseURL("temporal://localhost:7233?workflow=HandleChange")
+	assert.ErrorContains(t, err, "taskQueue is required")
+}
+
+func TestFlush(t *testing.T) {
+	fc := &fakeClient{errs: make(map[string]error)}
+	p := &temporalDriver{
+		ctx:       context.Background(),
+		logger:    logger.NewTestLogger(),
+		client:    fc,
+		timeout:   defaultTimeout,
+		delivered: make(map[string]time.Time),
+		rules: []Rule{
+			{Name: "orders", Tables: []string{"order"}, Operations: []string{"INSERT"}, Action: actionStart, Workflow: "OrderCreated", TaskQueue: "eds", WorkflowID: defaultWorkflowID},
+			{Name: "customers", Tables: []string{"customer"}, Action: actionSignalWithStart, Workflow: "Customer", TaskQueue: "eds", WorkflowID: "customer-{id}", Signal: "changed"},
+			{Name: "vehicles", Tables: []string{"vehicle"}, Action: actionSignal, WorkflowID: "vehicle-{id}", Signal: "changed"},
+		},
+	}
+	events := []internal.DBChangeEvent{
+		{ID: "e1", Table: "order", Operation: "INSERT", Key: []string{"r", "o1"}},
+		{ID: "e2", Table: "order", Operation: "UPDATE", Key: []string{"r", "o1"}},
+		{ID: "e3", Table: "customer", Operation: "UPDATE", Key: []string{"r", "c1"}},
+		{ID: "e4", Table: "vehicle", Operation: "UPDATE", Key: []string{"r", "v1"}},
+	}
+	for _, event := range events {
+		_, err := p.Process(p.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, p.pending, 3)
+
+	fc.errs["vehicle-v1"] = errors.New("workflow not found")
+	assert.ErrorContains(t, p.Flush(p.logger), "error signaling workflow vehicle-v1 for rule vehicles")
+	assert.Equal(t, []call{
+		{action: actionStart, workflowID: "eds-e1", workflow: "OrderCreated", reuse: enumspb.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE},
+		{action: actionSignalWithStart, workflowID: "customer-c1", workflow: "Customer", signal: "changed"},
+		{action: actionSignal, workflowID: "vehicle-v1", signal: "changed"},
+	}, fc.calls)
+	assert.Len(t, p.delivered, 2)
+	assert.Empty(t, p.pending)
+
+	// the redelivered batch only sends what failed
+	fc.calls = nil
+	delete(fc.errs, "vehicle-v1")
+	fc.errs["eds-e1"] = serviceerror.NewWorkflowExecutionAlreadyStarted("started", "", "")
+	for _, event := range events {
+		_, err := p.Process(p.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Flush(p.logger))
+	assert.Equal(t, []call{{action: actionSignal, workflowID: "vehicle-v1", signal: "changed"}}, fc.calls)
+	assert.Empty(t, p.delivered)
+
+	// an already started workflow isn't an error
+	fc.calls = nil
+	_, err := p.Process(p.logger, events[0])
+	assert.NoError(t, err)
+	assert.NoError(t, p.Flush(p.logger))
+	assert.Len(t, fc.calls, 1)
+}
+
+func TestValidate(t *testing.T) {
+	p := &temporalDriver{}
+	url, errs := p.Validate(map[string]any{"Hostname": "localhost", "Task Queue": "eds", "Workflow": "HandleChange"})
+	assert.Empty(t, errs)
+	assert.Equal(t, "temporal://localhost:7233?namespace=default&taskQueue=eds&workflow=HandleChange", url)
+
+	_, errs = p.Validate(map[string]any{"Hostname": "localhost"})
+	assert.Len(t, errs, 1)
+	_, errs = p.Validate(map[string]any{"Hostname": "localhost", "Workflow": "HandleChange"})
+	assert.Len(t, errs, 1)
+}
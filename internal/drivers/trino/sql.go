@@ -0,0 +1,260 @@
+package trino
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	maxStatementBytes = 500_000   // the coordinator rejects queries longer than query.max-length which defaults to 1MB
+	operationCol      = "_eds_op" // the column in the MERGE source with the operation of the row
+	timestampFormat   = "2006-01-02 15:04:05.000000"
+)
+
+func quoteIdentifier(val string) string {
+	return util.ANSIIdentifiers.Quote(val)
+}
+
+func quoteIdentifiers(vals []string) []string {
+	return util.ANSIIdentifiers.QuoteAll(vals)
+}
+
+// quoteString returns a string literal.
+func quoteString(val string) string {
+	return "'" + strings.ReplaceAll(val, "'", "''") + "'"
+}
+
+// sqlType returns the column type. Only the types which are supported by most connectors are used, so objects and
+// arrays are stored as JSON in a VARCHAR.
+func sqlType(prop internal.SchemaProperty) string {
+	switch prop.Type {
+	case "integer":
+		return "BIGINT"
+	case "number":
+		return "DOUBLE"
+	case "boolean":
+		return "BOOLEAN"
+	case "string":
+		if prop.Format == "date-time" {
+			return "TIMESTAMP(6)"
+		}
+	}
+	return "VARCHAR"
+}
+
+// quoteValue returns the literal for the value with the column type so the types of the rows in a VALUES list match.
+func quoteValue(val any, prop internal.SchemaProperty) string {
+	typ := sqlType(prop)
+	if val == nil {
+		return "CAST(NULL AS " + typ + ")"
+	}
+	switch typ {
+	case "BIGINT":
+		if v, ok := val.(float64); ok {
+			return "BIGINT '" + strconv.FormatInt(int64(v), 10) + "'"
+		}
+	case "DOUBLE":
+		if v, ok := val.(float64); ok {
+			return "DOUBLE '" + strconv.FormatFloat(v, 'g', -1, 64) + "'"
+		}
+	case "BOOLEAN":
+		if v, ok := val.(bool); ok {
+			return strconv.FormatBool(v)
+		}
+	case "TIMESTAMP(6)":
+		if v, ok := val.(string); ok {
+			if tv, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return "TIMESTAMP '" + tv.UTC().Format(timestampFormat) + "'"
+			}
+		}
+	case "VARCHAR":
+		if v, ok := val.(string); ok {
+			return quoteString(v)
+		}
+		return quoteString(util.JSONStringify(val))
+	}
+	var str string
+	if v, ok := val.(string); ok {
+		str = v
+	} else {
+		str = util.JSONStringify(val)
+	}
+	return "CAST(" + quoteString(str) + " AS " + typ + ")"
+}
+
+// keyColumns returns the columns which identify a row. The MERGE matches on all of them.
+func keyColumns(schema *internal.Schema) []string {
+	if len(schema.PrimaryKeys) > 0 {
+		return schema.PrimaryKeys
+	}
+	return []string{"id"}
+}
+
+// deletedKeys returns the key values of a deleted row using the keys of the event when available.
+func deletedKeys(keys []string, record *util.Record) map[string]any {
+	object := map[string]any{keys[len(keys)-1]: record.Id}
+	if record.Event != nil && len(record.Event.Key) == len(keys) {
+		for i, key := range keys {
+			object[key] = record.Event.Key[i]
+		}
+	}
+	return object
+}
+
+// dropSQL returns the statement to drop the table if it exists.
+func dropSQL(s *internal.Schema) string {
+	return "DROP TABLE IF EXISTS " + quoteIdentifier(s.Table)
+}
+
+// createSQL returns the statement to create the table. Trino connectors don't support primary keys so the keys are only
+// used by the MERGE. The properties are passed as is to the WITH clause, such as format = 'PARQUET'.
+func createSQL(s *internal.Schema, properties string) string {
+	var sql strings.Builder
+	sql.WriteString("CREATE TABLE IF NOT EXISTS ")
+	sql.WriteString(quoteIdentifier(s.Table))
+	sql.WriteString(" (\n")
+	columns := s.Columns()
+	for i, name := range columns {
+		sql.WriteString("\t")
+		sql.WriteString(quoteIdentifier(name))
+		sql.WriteString(" ")
+		sql.WriteString(sqlType(s.Properties[name]))
+		if i < len(columns)-1 {
+			sql.WriteString(",")
+		}
+		sql.WriteString("\n")
+	}
+	sql.WriteString(")")
+	if properties != "" {
+		sql.WriteString(" WITH (")
+		sql.WriteString(properties)
+		sql.WriteString(")")
+	}
+	return sql.String()
+}
+
+// addNewColumnsSQL returns the statements to add the columns which don't exist yet. Trino stores the names of the
+// tables and columns in lower case.
+func addNewColumnsSQL(logger logger.Logger, columns []string, s *internal.Schema, db internal.DatabaseSchema) []string {
+	var res []string
+	for _, column := range columns {
+		if ok, _ := db.GetType(strings.ToLower(s.Table), strings.ToLower(column)); ok {
+			logger.Warn("skipping migration for column: %s for table: %s since it already exists", column, s.Table)
+			continue
+		}
+		res = append(res, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quoteIdentifier(s.Table), quoteIdentifier(column), sqlType(s.Properties[column])))
+	}
+	return res
+}
+
+// batchStatements groups the rows into statements which are smaller than maxStatementBytes.
+func batchStatements(rows []string, prefix string, suffix string) []string {
+	var res []string
+	var sql strings.Builder
+	for _, row := range rows {
+		if sql.Len() > 0 && sql.Len()+len(row)+len(suffix) > maxStatementBytes {
+			sql.WriteString(suffix)
+			res = append(res, sql.String())
+			sql.Reset()
+		}
+		if sql.Len() == 0 {
+			sql.WriteString(prefix)
+		} else {
+			sql.WriteString(",")
+		}
+		sql.WriteString("\n")
+		sql.WriteString(row)
+	}
+	if sql.Len() > 0 {
+		sql.WriteString(suffix)
+		res = append(res, sql.String())
+	}
+	return res
+}
+
+// rowSQL returns the values of the columns of the row.
+func rowSQL(s *internal.Schema, object map[string]any) string {
+	columns := s.Columns()
+	values := make([]string, len(columns))
+	for i, name := range columns {
+		values[i] = quoteValue(object[name], s.Properties[name])
+	}
+	return "(" + strings.Join(values, ",") + ")"
+}
+
+// mergeSQL returns the MERGE statements to apply the records for a single table. The records must be for distinct keys
+// which the batcher guarantees. Deleted rows only have their keys set in the source.
+func mergeSQL(s *internal.Schema, records []*util.Record) []string {
+	columns := s.Columns()
+	keys := keyColumns(s)
+	rows := make([]string, 0, len(records))
+	for _, record := range records {
+		object := record.Object
+		if record.Operation == "DELETE" || object == nil {
+			object = deletedKeys(keys, record)
+		}
+		row := rowSQL(s, object)
+		rows = append(rows, "("+quoteString(record.Operation)+","+row[1:])
+	}
+	var prefix strings.Builder
+	prefix.WriteString("MERGE INTO ")
+	prefix.WriteString(quoteIdentifier(s.Table))
+	prefix.WriteString(" AS t USING (VALUES")
+	var suffix strings.Builder
+	suffix.WriteString("\n) AS s (")
+	suffix.WriteString(quoteIdentifier(operationCol))
+	suffix.WriteString(",")
+	suffix.WriteString(strings.Join(quoteIdentifiers(columns), ","))
+	suffix.WriteString(") ON ")
+	for i, key := range keys {
+		if i > 0 {
+			suffix.WriteString(" AND ")
+		}
+		suffix.WriteString("t.")
+		suffix.WriteString(quoteIdentifier(key))
+		suffix.WriteString(" = s.")
+		suffix.WriteString(quoteIdentifier(key))
+	}
+	op := "s." + quoteIdentifier(operationCol)
+	suffix.WriteString("\nWHEN MATCHED AND ")
+	suffix.WriteString(op)
+	suffix.WriteString(" = 'DELETE' THEN DELETE\nWHEN MATCHED THEN UPDATE SET ")
+	sets := make([]string, len(columns))
+	for i, name := range columns {
+		sets[i] = quoteIdentifier(name) + " = s." + quoteIdentifier(name)
+	}
+	suffix.WriteString(strings.Join(sets, ", "))
+	suffix.WriteString("\nWHEN NOT MATCHED AND ")
+	suffix.WriteString(op)
+	suffix.WriteString(" <> 'DELETE' THEN INSERT (")
+	suffix.WriteString(strings.Join(quoteIdentifiers(columns), ","))
+	suffix.WriteString(") VALUES (")
+	sources := make([]string, len(columns))
+	for i, name := range columns {
+		sources[i] = "s." + quoteIdentifier(name)
+	}
+	suffix.WriteString(strings.Join(sources, ","))
+	suffix.WriteString(")")
+	return batchStatements(rows, prefix.String(), suffix.String())
+}
+
+// insertSQL returns the statements to insert the rows.
+func insertSQL(s *internal.Schema, objects []map[string]any) []string {
+	rows := make([]string, 0, len(objects))
+	for _, object := range objects {
+		rows = append(rows, rowSQL(s, object))
+	}
+	prefix := "INSERT INTO " + quoteIdentifier(s.Table) + " (" + strings.Join(quoteIdentifiers(s.Columns()), ",") + ") VALUES"
+	return batchStatements(rows, prefix, "")
+}
+
+// schemaSQL returns the query for the columns of the tables in the schema.
+func schemaSQL(catalog string, schema string) string {
+	return fmt.Sprintf("SELECT table_name, column_name, data_type FROM %s.information_schema.columns WHERE table_schema = %s", quoteIdentifier(catalog), quoteString(schema))
+}
@@ -0,0 +1,326 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	defaultOutboxMaxBatches = 1000
+	defaultOutboxMaxAge     = time.Hour * 24
+	outboxDirName           = "webhook-outbox"
+	outboxBaseDelay         = time.Second
+	outboxMaxDelay          = time.Minute
+	outboxExt               = ".json"
+	outboxFailedExt         = ".failed"
+
+	outboxReasonStatus          = "status"           // the endpoint responded with a status code which isn't retried
+	outboxReasonEndpointRemoved = "endpoint_removed" // the routes changed since the batch was saved
+	outboxReasonMaxAge          = "max_age"          // the batch was still failing after the max age
+)
+
+// outboxConfig is the configuration of the outbox from the url.
+type outboxConfig struct {
+	maxBatches int           // the max number of pending batches before new events are retried instead of acked
+	maxAge     time.Duration // how long a batch is retried before its failing delivery is given up on
+}
+
+// parseOutbox returns the outbox configuration when it's enabled with outbox=true, or nil, with the max number of
+// pending batches from outboxMax and the max age of a batch from outboxMaxAge.
+func parseOutbox(urlString string) (*outboxConfig, error) {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse url: %w", err)
+	}
+	query := u.Query()
+	if query.Get("outbox") != "true" {
+		return nil, nil
+	}
+	config := &outboxConfig{maxBatches: defaultOutboxMaxBatches, maxAge: defaultOutboxMaxAge}
+	if val := query.Get("outboxMax"); val != "" {
+		config.maxBatches, err = strconv.Atoi(val)
+		if err != nil || config.maxBatches <= 0 {
+			return nil, fmt.Errorf("invalid outboxMax: %s", val)
+		}
+	}
+	if val := query.Get("outboxMaxAge"); val != "" {
+		config.maxAge, err = time.ParseDuration(val)
+		if err != nil || config.maxAge <= 0 {
+			return nil, fmt.Errorf("invalid outboxMaxAge: %s", val)
+		}
+	}
+	return config, nil
+}
+
+// permanentError is returned by an outbox sender when the delivery fails the same way however many times it's retried.
+type permanentError struct {
+	reason string
+	err    error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// outboxDelivery is the body for one endpoint in a batch.
+type outboxDelivery struct {
+	Endpoint string          `json:"endpoint"`
+	Count    int             `json:"count"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// outboxBatch is a flushed batch which is delivered to each endpoint in order.
+type outboxBatch struct {
+	Deliveries []outboxDelivery `json:"deliveries"`
+	Delivered  int              `json:"delivered"` // the number of deliveries sent so a restart resumes mid-batch
+	Added      time.Time        `json:"added"`
+
+	path string
+}
+
+// outboxFailure is a delivery which was given up on, saved for inspection.
+type outboxFailure struct {
+	outboxDelivery
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+type outboxSender func(ctx context.Context, logger logger.Logger, delivery *outboxDelivery) error
+
+// outbox persists the flushed batches before they are acked and delivers them in order in the background, retrying
+// until each endpoint accepts them. A batch is only removed once it was fully delivered so events are delivered at
+// least once, even across restarts. A delivery which can never succeed, or which is still failing after the max age
+// of its batch, is given up on and kept in the outbox directory with a .failed extension so it doesn't hold back the
+// batches after it.
+type outbox struct {
+	logger     logger.Logger
+	dir        string
+	maxBatches int
+	maxAge     time.Duration
+	send       outboxSender
+	notify     chan struct{}
+	lock       sync.Mutex
+	pending    int
+	last       int64
+}
+
+func newOutbox(logger logger.Logger, dir string, config outboxConfig, send outboxSender) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating outbox directory: %w", err)
+	}
+	o := &outbox{
+		logger:     logger,
+		dir:        dir,
+		maxBatches: config.maxBatches,
+		maxAge:     config.maxAge,
+		send:       send,
+		notify:     make(chan struct{}, 1),
+	}
+	batches, err := o.list()
+	if err != nil {
+		return nil, err
+	}
+	o.pending = len(batches)
+	if o.pending > 0 {
+		logger.Info("resuming delivery of %d batches from the outbox", o.pending)
+	}
+	return o, nil
+}
+
+// save writes the batch, replacing the file if it was saved before.
+func (o *outbox) save(batch *outboxBatch) error {
+	if batch.path == "" {
+		// the name is increasing so the batches are listed in the order they were added
+		o.last = max(o.last+1, time.Now().UnixNano())
+		batch.path = filepath.Join(o.dir, fmt.Sprintf("%020d%s", o.last, outboxExt))
+	}
+	// write to a temp file and rename so a partially written batch is never read
+	tmp := batch.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(util.JSONStringify(batch)), 0600); err != nil {
+		return fmt.Errorf("error writing outbox batch: %w", err)
+	}
+	if err := os.Rename(tmp, batch.path); err != nil {
+		return fmt.Errorf("error renaming outbox batch: %w", err)
+	}
+	return nil
+}
+
+// add persists the deliveries as a new batch. It returns a retryable error if there are too many pending batches so
+// the events aren't acked while the endpoints are unavailable.
+func (o *outbox) add(deliveries []outboxDelivery) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.pending >= o.maxBatches {
+		return internal.NewRetryableError(fmt.Errorf("outbox has %d batches waiting to be delivered", o.pending))
+	}
+	if err := o.save(&outboxBatch{Deliveries: deliveries, Added: time.Now()}); err != nil {
+		return err
+	}
+	o.pending++
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// size returns the number of batches waiting to be delivered.
+func (o *outbox) size() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.pending
+}
+
+// list returns the batches in the order they were added.
+func (o *outbox) list() ([]*outboxBatch, error) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox directory: %w", err)
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), outboxExt) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	batches := make([]*outboxBatch, 0, len(names))
+	for _, name := range names {
+		fn := filepath.Join(o.dir, name)
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading outbox batch: %w", err)
+		}
+		var batch outboxBatch
+		if err := json.Unmarshal(buf, &batch); err != nil {
+			return nil, fmt.Errorf("error decoding outbox batch %s: %w", name, err)
+		}
+		batch.path = fn
+		if batch.Added.IsZero() {
+			batch.Added = time.Now() // saved before the age was recorded so its age starts now
+		}
+		batches = append(batches, &batch)
+	}
+	return batches, nil
+}
+
+// wait returns false if the context was cancelled before the delay.
+func wait(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// fail saves a delivery which was given up on next to its batch with a .failed extension.
+func (o *outbox) fail(batch *outboxBatch, delivery *outboxDelivery, reason string, err error) error {
+	fn := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(batch.path, outboxExt), batch.Delivered, outboxFailedExt)
+	failure := outboxFailure{outboxDelivery: *delivery, Reason: reason, Error: err.Error()}
+	if err := os.WriteFile(fn, []byte(util.JSONStringify(failure)), 0600); err != nil {
+		return fmt.Errorf("error writing failed outbox delivery: %w", err)
+	}
+	internal.DeadLetterEvents.WithLabelValues("webhook", reason).Add(float64(delivery.Count))
+	o.logger.Error("giving up delivering %d events to %s from the outbox (%s), saved to %s: %s", delivery.Count, delivery.Endpoint, reason, fn, err)
+	return nil
+}
+
+// deliver sends the remaining deliveries of the batch in order, retrying each with a backoff until it succeeds or is
+// given up on, and removes the batch once it's fully delivered.
+func (o *outbox) deliver(ctx context.Context, batch *outboxBatch) error {
+	for batch.Delivered < len(batch.Deliveries) {
+		delivery := &batch.Deliveries[batch.Delivered]
+		delay := outboxBaseDelay
+		for attempt := 1; ; attempt++ {
+			err := o.send(ctx, o.logger, delivery)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var permanent *permanentError
+			if errors.As(err, &permanent) {
+				if err := o.fail(batch, delivery, permanent.reason, err); err != nil {
+					return err
+				}
+				break
+			}
+			if time.Since(batch.Added) >= o.maxAge {
+				if err := o.fail(batch, delivery, outboxReasonMaxAge, err); err != nil {
+					return err
+				}
+				break
+			}
+			o.logger.Error("error delivering %d events to %s from the outbox (attempt %d), retrying in %v: %s", delivery.Count, delivery.Endpoint, attempt, delay, err)
+			if !wait(ctx, delay) {
+				return ctx.Err()
+			}
+			delay = min(delay*2, outboxMaxDelay)
+		}
+		batch.Delivered++
+		if batch.Delivered < len(batch.Deliveries) {
+			o.lock.Lock()
+			err := o.save(batch)
+			o.lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(batch.path); err != nil {
+		return fmt.Errorf("error removing outbox batch: %w", err)
+	}
+	o.lock.Lock()
+	o.pending--
+	o.lock.Unlock()
+	return nil
+}
+
+// run delivers the batches until the context is cancelled.
+func (o *outbox) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		batches, err := o.list()
+		if err == nil {
+			for _, batch := range batches {
+				if err = o.deliver(ctx, batch); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			o.logger.Error("error delivering from the outbox, retrying in %v: %s", outboxMaxDelay, err)
+			wait(ctx, outboxMaxDelay)
+			continue
+		}
+		if len(batches) > 0 {
+			continue // check for batches added while delivering
+		}
+		select {
+		case <-ctx.Done():
+		case <-o.notify:
+		}
+	}
+}
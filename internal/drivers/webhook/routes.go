@@ -0,0 +1,223 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	defaultRouteName   = "default"
+	defaultTimeout     = time.Second * 30
+	defaultMaxAttempts = 5
+	deliveredExpiry    = time.Minute * 15 // how long to remember events an endpoint received when another endpoint failed
+)
+
+// Route maps events for a set of tables and operations to an endpoint.
+type Route struct {
+	// Name identifies the route in logs. Defaults to the url host and path.
+	Name string `json:"name,omitempty"`
+
+	// Tables the route applies to. Defaults to all tables.
+	Tables []string `json:"tables,omitempty"`
+
+	// Operations (INSERT, UPDATE, DELETE) the route applies to. Defaults to all operations.
+	Operations []string `json:"operations,omitempty"`
+
+	// URL is the endpoint to POST the events to.
+	URL string `json:"url"`
+
+	// Headers are additional headers sent with each request such as Authorization.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Timeout is the maximum time for a single request such as 10s. Defaults to 30s.
+	Timeout string `json:"timeout,omitempty"`
+
+	// MaxAttempts is the number of times to try a request before failing the batch. Defaults to 5.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+}
+
+func (r *Route) matches(event *internal.DBChangeEvent) bool {
+	return matchesAny(r.Tables, event.Table) && matchesAny(r.Operations, event.Operation)
+}
+
+func matchesAny(values []string, val string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || strings.EqualFold(v, val) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint is the destination for a route. Each endpoint has its own queue and retry settings so that
+// a slow or failing endpoint doesn't cause the events for the other endpoints to be resent.
+type endpoint struct {
+	name        string
+	url         string
+	headers     map[string]string
+	timeout     time.Duration
+	maxAttempts int
+	queue       []*internal.DBChangeEvent
+	delivered   map[string]time.Time
+}
+
+func (e *endpoint) wasDelivered(id string) bool {
+	if _, ok := e.delivered[id]; ok {
+		delete(e.delivered, id)
+		return true
+	}
+	return false
+}
+
+func (e *endpoint) markDelivered(now time.Time) {
+	for _, event := range e.queue {
+		e.delivered[event.ID] = now
+	}
+}
+
+func (e *endpoint) expireDelivered(now time.Time) {
+	for id, ts := range e.delivered {
+		if now.Sub(ts) > deliveredExpiry {
+			delete(e.delivered, id)
+		}
+	}
+}
+
+func newEndpoint(route Route) (*endpoint, error) {
+	u, err := url.Parse(route.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url for route %s: %s", route.Name, route.URL)
+	}
+	timeout := defaultTimeout
+	if route.Timeout != "" {
+		timeout, err = time.ParseDuration(route.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout for route %s: %s", route.Name, route.Timeout)
+		}
+	}
+	maxAttempts := route.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	name := route.Name
+	if name == "" {
+		name = u.Host + u.Path
+	}
+	return &endpoint{
+		name:        name,
+		url:         route.URL,
+		headers:     route.Headers,
+		timeout:     timeout,
+		maxAttempts: maxAttempts,
+		delivered:   make(map[string]time.Time),
+	}, nil
+}
+
+// router picks the endpoint for each event using the first matching route, falling back to the default endpoint.
+type router struct {
+	routes    []Route
+	endpoints []*endpoint
+	fallback  *endpoint
+	all       []*endpoint
+}
+
+// Route returns the endpoint for the event or nil if no route matches and there is no default endpoint.
+func (r *router) Route(event *internal.DBChangeEvent) *endpoint {
+	for i, route := range r.routes {
+		if route.matches(event) {
+			return r.endpoints[i]
+		}
+	}
+	return r.fallback
+}
+
+// All returns every endpoint including the default, once each even when routes share it.
+func (r *router) All() []*endpoint {
+	return r.all
+}
+
+// Endpoint returns the endpoint with the name or nil if there isn't one.
+func (r *router) Endpoint(name string) *endpoint {
+	for _, ep := range r.All() {
+		if ep.name == name {
+			return ep
+		}
+	}
+	return nil
+}
+
+// key returns what identifies the endpoint so routes share an endpoint only when they send the same requests.
+func (e *endpoint) key() string {
+	headers := e.headers
+	if len(headers) == 0 {
+		headers = nil
+	}
+	return util.JSONStringify(map[string]any{"url": e.url, "headers": headers, "timeout": e.timeout, "maxAttempts": e.maxAttempts})
+}
+
+func newRouter(routes []Route, fallback *Route) (*router, error) {
+	var r router
+	byKey := make(map[string]*endpoint)
+	byName := make(map[string]*endpoint)
+	add := func(route Route) (*endpoint, error) {
+		ep, err := newEndpoint(route)
+		if err != nil {
+			return nil, err
+		}
+		// routes to the same url with the same headers and retry settings share an endpoint so they share a queue
+		key := ep.key()
+		if existing := byKey[key]; existing != nil {
+			return existing, nil
+		}
+		// the outbox finds the endpoint of a batch by its name
+		if byName[ep.name] != nil {
+			return nil, fmt.Errorf("duplicate endpoint name %s: routes to the same url with different headers or retry settings need a unique name", ep.name)
+		}
+		byKey[key] = ep
+		byName[ep.name] = ep
+		r.all = append(r.all, ep)
+		return ep, nil
+	}
+	for _, route := range routes {
+		ep, err := add(route)
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, route)
+		r.endpoints = append(r.endpoints, ep)
+	}
+	if fallback != nil {
+		ep, err := add(*fallback)
+		if err != nil {
+			return nil, err
+		}
+		r.fallback = ep
+	}
+	if len(r.routes) == 0 && r.fallback == nil {
+		return nil, fmt.Errorf("at least one route or a default url is required")
+	}
+	return &r, nil
+}
+
+// loadRoutes reads the routing rules from a JSON file containing an array of routes.
+func loadRoutes(fn string) ([]Route, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading routes file: %w", err)
+	}
+	var routes []Route
+	if err := json.Unmarshal(buf, &routes); err != nil {
+		return nil, fmt.Errorf("error parsing routes file %s: %w", fn, err)
+	}
+	return routes, nil
+}
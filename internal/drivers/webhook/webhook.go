@@ -0,0 +1,462 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/importer"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const maxImportBatchSize = 100
+
+type webhookDriver struct {
+	ctx          context.Context
+	logger       logger.Logger
+	router       *router
+	client       *http.Client
+	lock         sync.Mutex
+	waitGroup    sync.WaitGroup
+	importConfig internal.ImporterConfig
+	pending      int
+	templates    util.PayloadTemplates
+	outbox       *outbox
+	cancel       context.CancelFunc
+	delivering   sync.WaitGroup
+}
+
+var _ internal.Driver = (*webhookDriver)(nil)
+var _ internal.DriverLifecycle = (*webhookDriver)(nil)
+var _ internal.DriverHelp = (*webhookDriver)(nil)
+var _ internal.Importer = (*webhookDriver)(nil)
+var _ internal.ImporterHelp = (*webhookDriver)(nil)
+var _ importer.BatchHandler = (*webhookDriver)(nil)
+
+// parseURL returns the default route (if a host is provided) and the routing rules from the url.
+// The url is in the format webhook://host/path?routes=/path/to/routes.json where tls=false will use http for the default url.
+func parseURL(urlString string) (*Route, []Route, error) {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse url: %w", err)
+	}
+	query := u.Query()
+	var routes []Route
+	if fn := query.Get("routes"); fn != "" {
+		if routes, err = loadRoutes(fn); err != nil {
+			return nil, nil, err
+		}
+	}
+	var fallback *Route
+	if u.Host != "" {
+		scheme := "https"
+		if query.Get("tls") == "false" {
+			scheme = "http"
+		}
+		headers := make(map[string]string)
+		for _, header := range query["header"] {
+			name, value, ok := strings.Cut(header, ":")
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid header: %s (expected name:value)", header)
+			}
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+		query.Del("routes")
+		query.Del("tls")
+		query.Del("header")
+		query.Del("outbox")
+		query.Del("outboxMax")
+		query.Del("outboxMaxAge")
+		target := url.URL{Scheme: scheme, Host: u.Host, Path: u.Path, RawQuery: query.Encode()}
+		fallback = &Route{Name: defaultRouteName, URL: target.String(), Headers: headers}
+	}
+	return fallback, routes, nil
+}
+
+func (p *webhookDriver) connect(urlString string) error {
+	urlString, templates, err := util.ParsePayloadTemplates(urlString)
+	if err != nil {
+		return err
+	}
+	p.templates = templates
+	fallback, routes, err := parseURL(urlString)
+	if err != nil {
+		return err
+	}
+	r, err := newRouter(routes, fallback)
+	if err != nil {
+		return err
+	}
+	p.router = r
+	p.client = &http.Client{}
+	return nil
+}
+
+// Start the driver. This is called once at the beginning of the driver's lifecycle.
+func (p *webhookDriver) Start(pc internal.DriverConfig) error {
+	p.ctx = pc.Context
+	p.logger = pc.Logger.WithPrefix("[webhook]")
+	if err := p.connect(pc.URL); err != nil {
+		return err
+	}
+	for _, ep := range p.router.All() {
+		p.logger.Debug("using endpoint %s: %s", ep.name, ep.url)
+	}
+	config, err := parseOutbox(pc.URL)
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		if pc.DataDir == "" {
+			return fmt.Errorf("the outbox requires a data directory")
+		}
+		p.outbox, err = newOutbox(p.logger, filepath.Join(pc.DataDir, outboxDirName), *config, p.deliver)
+		if err != nil {
+			return err
+		}
+		var ctx context.Context
+		ctx, p.cancel = context.WithCancel(p.ctx)
+		p.delivering.Add(1)
+		go func() {
+			defer p.delivering.Done()
+			defer util.RecoverPanic(p.logger)
+			p.outbox.run(ctx)
+		}()
+	}
+	return nil
+}
+
+// Stop the driver. This is called once at the end of the driver's lifecycle.
+func (p *webhookDriver) Stop() error {
+	p.logger.Debug("stopping")
+	p.waitGroup.Wait()
+	if p.cancel != nil {
+		// undelivered batches stay in the outbox and are delivered after a restart
+		p.cancel()
+		p.delivering.Wait()
+	}
+	p.logger.Debug("stopped")
+	return nil
+}
+
+// MaxBatchSize returns the maximum number of events that can be processed in a single call to Process and when Flush should be called.
+// Return -1 to indicate that there is no limit.
+func (p *webhookDriver) MaxBatchSize() int {
+	return -1
+}
+
+// Process a single event. It returns a bool indicating whether Flush should be called. If an error is returned, the driver will NAK the event.
+func (p *webhookDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	ep := p.router.Route(&event)
+	if ep == nil {
+		logger.Trace("no route for table: %s, operation: %s, skipping event: %s", event.Table, event.Operation, event.ID)
+		return false, nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if ep.wasDelivered(event.ID) {
+		logger.Trace("event %s already delivered to %s, skipping", event.ID, ep.name)
+		internal.SkippedEvents.WithLabelValues(event.Table, internal.SkipReasonDuplicate).Inc()
+		return false, nil
+	}
+	ep.queue = append(ep.queue, &event)
+	p.pending++
+	return false, nil
+}
+
+// send will POST the events as a JSON array to the endpoint, retrying up to the max attempts for the endpoint.
+func (p *webhookDriver) send(logger logger.Logger, ep *endpoint) error {
+	body, err := p.body(ep.queue)
+	if err != nil {
+		return err
+	}
+	return p.post(p.ctx, logger, ep, body, len(ep.queue))
+}
+
+// body returns the JSON array of the payloads for the events.
+func (p *webhookDriver) body(events []*internal.DBChangeEvent) ([]byte, error) {
+	if p.templates == nil {
+		return []byte(util.JSONStringify(events)), nil
+	}
+	payloads := make([]json.RawMessage, 0, len(events))
+	for _, event := range events {
+		payload, err := p.templates.Render(event)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return json.Marshal(payloads)
+}
+
+// deliver sends a delivery from the outbox to its endpoint. A delivery to an endpoint which no longer exists or which
+// is rejected with a status code which isn't retried can't succeed so it fails with a permanent error.
+func (p *webhookDriver) deliver(ctx context.Context, logger logger.Logger, delivery *outboxDelivery) error {
+	ep := p.router.Endpoint(delivery.Endpoint)
+	if ep == nil {
+		// the routes changed since the batch was saved so there is nowhere to send it
+		return &permanentError{outboxReasonEndpointRemoved, fmt.Errorf("endpoint %s no longer exists", delivery.Endpoint)}
+	}
+	err := p.post(ctx, logger, ep, delivery.Body, delivery.Count)
+	var status *statusError
+	if errors.As(err, &status) && !util.RetryServerErrors(status.code) {
+		return &permanentError{outboxReasonStatus, err}
+	}
+	return err
+}
+
+// statusError is returned when an endpoint responds with a status code which isn't a success.
+type statusError struct {
+	endpoint string
+	code     int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from %s", e.code, e.endpoint)
+}
+
+func (p *webhookDriver) post(ctx context.Context, logger logger.Logger, ep *endpoint, body []byte, count int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request for %s: %w", ep.name, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range ep.headers {
+		req.Header.Set(k, v)
+	}
+	retry := util.NewHTTPRetry(req,
+		util.WithLogger(logger),
+		util.WithClient(p.client),
+		util.WithMaxAttempts(ep.maxAttempts),
+		util.WithAttemptTimeout(ep.timeout),
+		util.WithTimeout(ep.timeout*time.Duration(ep.maxAttempts)),
+		util.WithRetryStatus(util.RetryServerErrors),
+	)
+	resp, err := retry.Do()
+	if err != nil {
+		return fmt.Errorf("error sending to %s: %w", ep.name, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{ep.name, resp.StatusCode}
+	}
+	logger.Trace("sent %d events to %s in %d attempt(s)", count, ep.name, retry.Attempts())
+	return nil
+}
+
+// Flush is called to commit any pending events. It should return an error if the flush fails. If the flush fails, the driver will NAK all pending events.
+func (p *webhookDriver) Flush(logger logger.Logger) error {
+	logger.Debug("flush")
+	p.waitGroup.Add(1)
+	defer p.waitGroup.Done()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending == 0 {
+		return nil
+	}
+	endpoints := p.router.All()
+	if p.outbox != nil {
+		return p.flushToOutbox(endpoints)
+	}
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, ep := range endpoints {
+		if len(ep.queue) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, ep *endpoint) {
+			defer wg.Done()
+			errs[i] = p.send(logger, ep)
+		}(i, ep)
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	now := time.Now()
+	for i, ep := range endpoints {
+		if err != nil && errs[i] == nil {
+			// the batch will be redelivered so remember what this endpoint already received to avoid sending it twice
+			ep.markDelivered(now)
+		}
+		ep.expireDelivered(now)
+		ep.queue = nil
+	}
+	p.pending = 0
+	return err
+}
+
+// flushToOutbox saves the pending events to the outbox so they can be acked before they are delivered.
+func (p *webhookDriver) flushToOutbox(endpoints []*endpoint) error {
+	var deliveries []outboxDelivery
+	for _, ep := range endpoints {
+		if len(ep.queue) > 0 {
+			body, err := p.body(ep.queue)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, outboxDelivery{
+				Endpoint: ep.name,
+				Count:    len(ep.queue),
+				Body:     body,
+			})
+		}
+	}
+	if err := p.outbox.add(deliveries); err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		ep.queue = nil
+	}
+	p.pending = 0
+	return nil
+}
+
+// Name is a unique name for the driver.
+func (p *webhookDriver) Name() string {
+	return "Webhook"
+}
+
+// Description is the description of the driver.
+func (p *webhookDriver) Description() string {
+	return "Supports streaming EDS messages to one or more HTTP endpoints with routing by table and operation."
+}
+
+// ExampleURL should return an example URL for configuring the driver.
+func (p *webhookDriver) ExampleURL() string {
+	return "webhook://hooks.example.com/eds?routes=/etc/eds/routes.json"
+}
+
+// Help should return a detailed help documentation for the driver.
+func (p *webhookDriver) Help() string {
+	var help strings.Builder
+	help.WriteString(util.GenerateHelpSection("Default Endpoint", "The host and path in the URL is the default endpoint which receives any event not matched by a route. Events are sent using https unless tls=false is provided.\nAdditional headers can be sent using header=Name:Value.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Routes", "Provide a JSON file with routes=/path/to/routes.json to send events to different endpoints. The file is an array of routes with url, tables, operations, headers, timeout and maxAttempts.\nThe first matching route is used. If there is no default endpoint, events which don't match a route are skipped.\nRoutes to the same url with the same headers and retry settings share an endpoint, otherwise each needs a unique name.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Message Body", "Events are sent with a POST as a JSON array of EDS DBChange events. Each endpoint is retried independently and an endpoint which succeeded won't receive the batch again if another endpoint fails.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Payload Templates", util.PayloadTemplatesHelp+"The body is a JSON array of the rendered payloads.\n"))
+	help.WriteString("\n")
+	help.WriteString(util.GenerateHelpSection("Outbox", "Provide outbox=true to save each batch to an outbox in the data directory before it's acknowledged. The batches are delivered in order in the background and each endpoint is retried until it succeeds, resuming from the last delivered endpoint after a restart.\nEvents are delivered at least once so endpoints should ignore duplicate event ids. Use outboxMax to set the number of undelivered batches (default 1000) after which new events are retried instead of acknowledged.\nA delivery which is rejected with a status that isn't retried, whose endpoint was removed or which is still failing after outboxMaxAge (default 24h) is saved to a .failed file in the outbox directory and counted in eds_dead_letter_events_total.\n"))
+	return help.String()
+}
+
+// CreateDatasource allows the handler to create the datasource before importing data.
+func (p *webhookDriver) CreateDatasource(schema internal.SchemaMap) error {
+	return nil
+}
+
+// ImportEvent allows the handler to process the event.
+func (p *webhookDriver) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	if p.importConfig.DryRun {
+		p.logger.Trace("would have sent event: %s", event.ID)
+		return nil
+	}
+	_, err := p.Process(p.logger, event)
+	return err
+}
+
+// ImportBatchLimits returns the maximum number of events and bytes to accumulate before FlushBatch is called.
+func (p *webhookDriver) ImportBatchLimits() (int, int) {
+	return maxImportBatchSize, 0
+}
+
+// FlushBatch sends the pending events.
+func (p *webhookDriver) FlushBatch() error {
+	return p.Flush(p.logger)
+}
+
+// ImportCompleted is called when all events have been processed.
+func (p *webhookDriver) ImportCompleted() error {
+	return p.Flush(p.logger)
+}
+
+func (p *webhookDriver) Import(config internal.ImporterConfig) error {
+	if config.SchemaOnly {
+		return nil
+	}
+	p.logger = config.Logger.WithPrefix("[webhook]")
+	if err := p.connect(config.URL); err != nil {
+		return err
+	}
+	p.ctx = config.Context
+	p.importConfig = config
+	return importer.Run(p.logger, config, p)
+}
+
+// SupportsDelete returns true if the importer supports deleting data.
+func (p *webhookDriver) SupportsDelete() bool {
+	return false
+}
+
+// Test is called to test the drivers connectivity with the configured url. It should return an error if the test fails or nil if the test passes.
+func (p *webhookDriver) Test(ctx context.Context, logger logger.Logger, url string) error {
+	url, _, err := util.ParsePayloadTemplates(url)
+	if err != nil {
+		return err
+	}
+	fallback, routes, err := parseURL(url)
+	if err != nil {
+		return err
+	}
+	_, err = newRouter(routes, fallback)
+	return err
+}
+
+// Configuration returns the configuration fields for the driver.
+func (p *webhookDriver) Configuration() []internal.DriverField {
+	return []internal.DriverField{
+		internal.OptionalStringField("URL", "The default endpoint to send events which don't match a route", nil),
+		internal.OptionalStringField("Routes File", "The path to a JSON file with routing rules", nil),
+	}
+}
+
+// Validate validates the configuration and returns an error if the configuration is invalid or a valid url if the configuration is valid.
+func (p *webhookDriver) Validate(values map[string]any) (string, []internal.FieldError) {
+	endpoint := internal.GetOptionalStringValue("URL", "", values)
+	routes := internal.GetOptionalStringValue("Routes File", "", values)
+	if endpoint == "" && routes == "" {
+		return "", []internal.FieldError{internal.NewFieldError("URL", "a url or routes file is required")}
+	}
+	u := url.URL{Scheme: "webhook"}
+	query := url.Values{}
+	if endpoint != "" {
+		eu, err := url.Parse(endpoint)
+		if err != nil || eu.Host == "" {
+			return "", []internal.FieldError{internal.NewFieldError("URL", "invalid url")}
+		}
+		u.Host = eu.Host
+		u.Path = eu.Path
+		query = eu.Query()
+		if eu.Scheme == "http" {
+			query.Set("tls", "false")
+		}
+	}
+	if routes != "" {
+		if _, err := loadRoutes(routes); err != nil {
+			return "", []internal.FieldError{internal.NewFieldError("Routes File", err.Error())}
+		}
+		query.Set("routes", routes)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func init() {
+	internal.RegisterDriver("webhook", &webhookDriver{})
+	internal.RegisterImporter("webhook", &webhookDriver{})
+}
@@ -0,0 +1,378 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEndpoint struct {
+	server *httptest.Server
+	status int
+	events []internal.DBChangeEvent
+	header http.Header
+	lock   sync.Mutex
+}
+
+func (e *testEndpoint) received() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var ids []string
+	for _, event := range e.events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func newTestEndpoint(t *testing.T) *testEndpoint {
+	e := &testEndpoint{status: http.StatusOK}
+	e.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if e.status != http.StatusOK {
+			w.WriteHeader(e.status)
+			return
+		}
+		var events []internal.DBChangeEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&events))
+		e.events = append(e.events, events...)
+		e.header = r.Header.Clone()
+	}))
+	t.Cleanup(e.server.Close)
+	return e
+}
+
+func writeRoutes(t *testing.T, routes []Route) string {
+	fn := filepath.Join(t.TempDir(), "routes.json")
+	assert.NoError(t, os.WriteFile(fn, []byte(util.JSONStringify(routes)), 0600))
+	return fn
+}
+
+func startDriver(t *testing.T, urlString string) *webhookDriver {
+	var driver webhookDriver
+	assert.NoError(t, driver.Start(internal.DriverConfig{
+		Context: context.Background(),
+		URL:     urlString,
+		Logger:  logger.NewTestLogger(),
+	}))
+	return &driver
+}
+
+func TestRouting(t *testing.T) {
+	orders := newTestEndpoint(t)
+	customers := newTestEndpoint(t)
+	fallback := newTestEndpoint(t)
+	routes := writeRoutes(t, []Route{
+		{Tables: []string{"order"}, Operations: []string{"INSERT", "UPDATE"}, URL: orders.server.URL + "/orders", Headers: map[string]string{"Authorization": "Bearer abc"}},
+		{Tables: []string{"customer"}, URL: customers.server.URL + "/customers"},
+	})
+	driver := startDriver(t, "webhook://"+strings.TrimPrefix(fallback.server.URL, "http://")+"/default?tls=false&routes="+routes)
+
+	for _, event := range []internal.DBChangeEvent{
+		{ID: "1", Table: "order", Operation: "INSERT"},
+		{ID: "2", Table: "customer", Operation: "DELETE"},
+		{ID: "3", Table: "order", Operation: "DELETE"},
+		{ID: "4", Table: "vehicle", Operation: "UPDATE"},
+	} {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, []string{"1"}, orders.received())
+	assert.Equal(t, "Bearer abc", orders.header.Get("Authorization"))
+	assert.Equal(t, []string{"2"}, customers.received())
+	assert.Equal(t, []string{"3", "4"}, fallback.received())
+}
+
+func TestRoutesShareEndpointWithSameSettings(t *testing.T) {
+	hooks := newTestEndpoint(t)
+	routes := writeRoutes(t, []Route{
+		{Name: "orders", Tables: []string{"order"}, URL: hooks.server.URL, Headers: map[string]string{"Authorization": "Bearer abc"}},
+		{Name: "customers", Tables: []string{"customer"}, URL: hooks.server.URL, Headers: map[string]string{"Authorization": "Bearer xyz"}},
+		{Tables: []string{"vehicle"}, URL: hooks.server.URL, Headers: map[string]string{"Authorization": "Bearer abc"}},
+	})
+	driver := startDriver(t, "webhook:///?routes="+routes)
+	assert.Len(t, driver.router.All(), 2)
+	assert.Equal(t, "orders", driver.router.Route(&internal.DBChangeEvent{Table: "vehicle"}).name)
+	assert.Equal(t, "Bearer xyz", driver.router.Route(&internal.DBChangeEvent{Table: "customer"}).headers["Authorization"])
+
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "2", Table: "vehicle", Operation: "INSERT"})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, []string{"1", "2"}, hooks.received(), "a shared endpoint gets the batch once")
+
+	// the outbox finds an endpoint by its name so routes with different settings can't share one
+	_, err = newRouter([]Route{
+		{URL: hooks.server.URL, Timeout: "10s"},
+		{URL: hooks.server.URL, Timeout: "20s"},
+	}, nil)
+	assert.ErrorContains(t, err, "duplicate endpoint name")
+}
+
+func TestRoutingWithoutDefaultSkipsUnmatched(t *testing.T) {
+	orders := newTestEndpoint(t)
+	routes := writeRoutes(t, []Route{{Tables: []string{"order"}, URL: orders.server.URL}})
+	driver := startDriver(t, "webhook:///?routes="+routes)
+
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "customer", Operation: "INSERT"})
+	assert.NoError(t, err)
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "2", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, []string{"2"}, orders.received())
+}
+
+func TestFailedEndpointDoesNotResendToOthers(t *testing.T) {
+	orders := newTestEndpoint(t)
+	customers := newTestEndpoint(t)
+	customers.status = http.StatusBadRequest
+	routes := writeRoutes(t, []Route{
+		{Tables: []string{"order"}, URL: orders.server.URL},
+		{Tables: []string{"customer"}, URL: customers.server.URL, MaxAttempts: 1},
+	})
+	driver := startDriver(t, "webhook:///?routes="+routes)
+
+	events := []internal.DBChangeEvent{
+		{ID: "1", Table: "order", Operation: "INSERT"},
+		{ID: "2", Table: "customer", Operation: "INSERT"},
+	}
+	for _, event := range events {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.Error(t, driver.Flush(driver.logger))
+	assert.Equal(t, []string{"1"}, orders.received())
+	assert.Empty(t, customers.received())
+
+	// the batch is redelivered after the nak
+	customers.status = http.StatusOK
+	for _, event := range events {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, []string{"1"}, orders.received())
+	assert.Equal(t, []string{"2"}, customers.received())
+}
+
+func TestRetry(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	driver := startDriver(t, "webhook://"+strings.TrimPrefix(server.URL, "http://")+"?tls=false")
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Equal(t, 3, attempts)
+}
+
+func startOutboxDriver(t *testing.T, urlString string, dir string) *webhookDriver {
+	var driver webhookDriver
+	assert.NoError(t, driver.Start(internal.DriverConfig{
+		Context: context.Background(),
+		URL:     urlString,
+		Logger:  logger.NewTestLogger(),
+		DataDir: dir,
+	}))
+	return &driver
+}
+
+func TestOutboxResumesAfterRestart(t *testing.T) {
+	orders := newTestEndpoint(t)
+	customers := newTestEndpoint(t)
+	customers.status = http.StatusServiceUnavailable
+	routes := writeRoutes(t, []Route{
+		{Tables: []string{"order"}, URL: orders.server.URL},
+		{Tables: []string{"customer"}, URL: customers.server.URL, MaxAttempts: 1},
+	})
+	dir := t.TempDir()
+	driver := startOutboxDriver(t, "webhook:///?outbox=true&routes="+routes, dir)
+	for _, event := range []internal.DBChangeEvent{
+		{ID: "1", Table: "order", Operation: "INSERT"},
+		{ID: "2", Table: "customer", Operation: "INSERT"},
+	} {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	// the batch is saved and acked even though the customers endpoint is failing
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Eventually(t, func() bool { return len(orders.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, driver.outbox.size())
+	assert.NoError(t, driver.Stop())
+
+	// after a restart the batch resumes with the customers endpoint
+	customers.lock.Lock()
+	customers.status = http.StatusOK
+	customers.lock.Unlock()
+	driver = startOutboxDriver(t, "webhook:///?outbox=true&routes="+routes, dir)
+	assert.Eventually(t, func() bool { return len(customers.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return driver.outbox.size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1"}, orders.received())
+	assert.Equal(t, []string{"2"}, customers.received())
+	assert.NoError(t, driver.Stop())
+}
+
+func TestOutboxDeliversInOrder(t *testing.T) {
+	endpoint := newTestEndpoint(t)
+	driver := startOutboxDriver(t, "webhook://"+strings.TrimPrefix(endpoint.server.URL, "http://")+"?tls=false&outbox=true", t.TempDir())
+	defer driver.Stop()
+	var expected []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%d", i)
+		expected = append(expected, id)
+		_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: id, Table: "order", Operation: "INSERT"})
+		assert.NoError(t, err)
+		assert.NoError(t, driver.Flush(driver.logger))
+	}
+	assert.Eventually(t, func() bool { return len(endpoint.received()) == len(expected) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, expected, endpoint.received())
+}
+
+func TestOutboxFull(t *testing.T) {
+	endpoint := newTestEndpoint(t)
+	endpoint.status = http.StatusServiceUnavailable
+	routes := writeRoutes(t, []Route{{URL: endpoint.server.URL, MaxAttempts: 1}})
+	driver := startOutboxDriver(t, "webhook:///?outbox=true&outboxMax=1&routes="+routes, t.TempDir())
+	defer driver.Stop()
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	_, err = driver.Process(driver.logger, internal.DBChangeEvent{ID: "2", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	err = driver.Flush(driver.logger)
+	assert.Error(t, err)
+	assert.True(t, internal.IsRetryableError(err))
+}
+
+func TestOutboxGivesUpOnFailedDeliveries(t *testing.T) {
+	internal.MetricsReset()
+	orders := newTestEndpoint(t)
+	customers := newTestEndpoint(t)
+	customers.status = http.StatusBadRequest
+	vehicles := newTestEndpoint(t)
+	vehicles.status = http.StatusServiceUnavailable
+	routes := writeRoutes(t, []Route{
+		{Tables: []string{"order"}, URL: orders.server.URL},
+		{Tables: []string{"customer"}, URL: customers.server.URL},
+		{Tables: []string{"vehicle"}, URL: vehicles.server.URL, MaxAttempts: 1},
+	})
+	dir := t.TempDir()
+	driver := startOutboxDriver(t, "webhook:///?outbox=true&outboxMaxAge=1ms&routes="+routes, dir)
+	defer driver.Stop()
+	for _, event := range []internal.DBChangeEvent{
+		{ID: "1", Table: "customer", Operation: "INSERT"},
+		{ID: "2", Table: "vehicle", Operation: "INSERT"},
+		{ID: "3", Table: "order", Operation: "INSERT"},
+	} {
+		_, err := driver.Process(driver.logger, event)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, driver.Flush(driver.logger))
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "4", Table: "order", Operation: "INSERT"})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+
+	// a rejected delivery and one which is failing past the max age don't hold back the later batches
+	assert.Eventually(t, func() bool { return driver.outbox.size() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"3", "4"}, orders.received())
+	assert.Equal(t, float64(1), testutil.ToFloat64(internal.DeadLetterEvents.WithLabelValues("webhook", outboxReasonStatus)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(internal.DeadLetterEvents.WithLabelValues("webhook", outboxReasonMaxAge)))
+	failed, err := filepath.Glob(filepath.Join(dir, outboxDirName, "*"+outboxFailedExt))
+	assert.NoError(t, err)
+	assert.Len(t, failed, 2)
+	var failure outboxFailure
+	buf, err := os.ReadFile(failed[0])
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(buf, &failure))
+	assert.Equal(t, 1, failure.Count)
+	assert.Contains(t, []string{outboxReasonStatus, outboxReasonMaxAge}, failure.Reason)
+}
+
+func TestParseOutbox(t *testing.T) {
+	config, err := parseOutbox("webhook://example.com/hook?outbox=true&outboxMax=5&outboxMaxAge=1h")
+	assert.NoError(t, err)
+	assert.Equal(t, &outboxConfig{maxBatches: 5, maxAge: time.Hour}, config)
+
+	config, err = parseOutbox("webhook://example.com/hook?outbox=true")
+	assert.NoError(t, err)
+	assert.Equal(t, &outboxConfig{maxBatches: defaultOutboxMaxBatches, maxAge: defaultOutboxMaxAge}, config)
+
+	config, err = parseOutbox("webhook://example.com/hook")
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	_, err = parseOutbox("webhook://example.com/hook?outbox=true&outboxMax=0")
+	assert.Error(t, err)
+	_, err = parseOutbox("webhook://example.com/hook?outbox=true&outboxMaxAge=soon")
+	assert.Error(t, err)
+
+	fallback, _, err := parseURL("webhook://example.com/hook?outbox=true&outboxMax=5&outboxMaxAge=1h")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/hook", fallback.URL)
+}
+
+func TestPayloadTemplates(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(buf))
+	}))
+	defer server.Close()
+	fn := filepath.Join(t.TempDir(), "templates.json")
+	assert.NoError(t, os.WriteFile(fn, []byte(`{"order": "{{json (pick .Object \"id\" \"status\")}}"}`), 0600))
+	driver := startDriver(t, "webhook://"+strings.TrimPrefix(server.URL, "http://")+"?tls=false&templates="+fn)
+	_, err := driver.Process(driver.logger, internal.DBChangeEvent{ID: "1", Table: "order", Operation: "INSERT", After: json.RawMessage(`{"id":"1","status":"open","total":5}`)})
+	assert.NoError(t, err)
+	assert.NoError(t, driver.Flush(driver.logger))
+	assert.Len(t, bodies, 1)
+	assert.JSONEq(t, `[{"id":"1","status":"open"}]`, bodies[0])
+}
+
+func TestParseURL(t *testing.T) {
+	fallback, routes, err := parseURL("webhook://example.com/hook?header=X-Token:abc&foo=bar")
+	assert.NoError(t, err)
+	assert.Empty(t, routes)
+	assert.Equal(t, "https://example.com/hook?foo=bar", fallback.URL)
+	assert.Equal(t, map[string]string{"X-Token": "abc"}, fallback.Headers)
+
+	fallback, _, err = parseURL("webhook:///")
+	assert.NoError(t, err)
+	assert.Nil(t, fallback)
+	_, err = newRouter(nil, fallback)
+	assert.Error(t, err)
+
+	_, err = newRouter([]Route{{URL: "ftp://example.com"}}, nil)
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	var driver webhookDriver
+	url, errs := driver.Validate(map[string]any{"URL": "http://localhost:8080/hook"})
+	assert.Empty(t, errs)
+	assert.Equal(t, "webhook://localhost:8080/hook?tls=false", url)
+
+	_, errs = driver.Validate(map[string]any{})
+	assert.NotEmpty(t, errs)
+}
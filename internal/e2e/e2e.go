@@ -218,6 +218,19 @@ func RunTests(logger logger.Logger, only []string) (bool, error) {
 	var pass, fail, skipped uint32
 	runNatsTestServer(func(nc *nats.Conn, js jetstream.JetStream, srv *server.Server, userCreds string) {
 		logger.Trace("creds: %s", userCreds)
+		if len(only) == 0 || util.SliceContains(only, orderingTestName) {
+			testStarted := time.Now()
+			if err := runOrderingTest(logger, js, srv.ClientURL(), userCreds, tmpdir); err != nil {
+				atomic.AddUint32(&fail, 1)
+				logger.Error("🔴 ordering test failed: %s", err)
+			} else {
+				atomic.AddUint32(&pass, 1)
+				logger.Info("✅ ordering test succeeded in %s", time.Since(testStarted))
+			}
+		} else {
+			skipped++
+			logger.Warn("skipping test: %s", orderingTestName)
+		}
 		httpport, shutdown := setupServer(logger, userCreds)
 		apiurl := fmt.Sprintf("http://127.0.0.1:%d", httpport)
 		run("enroll", []string{"--api-url", apiurl, "-v", "-d", tmpdir, "1234"}, nil, nil)
@@ -0,0 +1,180 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/consumer"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	orderingTestName      = "ordering"
+	orderingTestPipelines = 4
+	orderingTestKeys      = 20
+	orderingTestEvents    = 50 // for each key
+	orderingTestTimeout   = time.Minute
+)
+
+// orderingState is shared by the drivers of the pipelines to check that the events with the same ordering key are never
+// processed at the same time or after a newer event.
+type orderingState struct {
+	lock      sync.Mutex
+	inflight  map[string]int // the driver processing each ordering key
+	last      map[string]int // the last version processed for each ordering key
+	processed int
+	err       error
+}
+
+func (s *orderingState) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// orderingDriver is the driver of a pipeline which takes a random time to process each event so the pipelines overlap.
+type orderingDriver struct {
+	id    int
+	state *orderingState
+}
+
+var _ consumer.Driver = (*orderingDriver)(nil)
+
+func (d *orderingDriver) MaxBatchSize() int {
+	return 10
+}
+
+func (d *orderingDriver) Process(logger logger.Logger, event internal.DBChangeEvent) (bool, error) {
+	key := event.OrderingKey()
+	var version int
+	if _, err := fmt.Sscanf(event.MVCCTimestamp, "%d", &version); err != nil {
+		return false, fmt.Errorf("invalid version %s: %w", event.MVCCTimestamp, err)
+	}
+	d.state.lock.Lock()
+	if other, ok := d.state.inflight[key]; ok {
+		d.state.fail(fmt.Errorf("%s processed by pipeline %d while pipeline %d was processing it", key, d.id, other))
+	}
+	d.state.inflight[key] = d.id
+	d.state.lock.Unlock()
+
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+
+	d.state.lock.Lock()
+	defer d.state.lock.Unlock()
+	delete(d.state.inflight, key)
+	if last, ok := d.state.last[key]; ok && version <= last {
+		d.state.fail(fmt.Errorf("%s version %d processed after version %d", key, version, last))
+	}
+	d.state.last[key] = version
+	d.state.processed++
+	return false, nil
+}
+
+func (d *orderingDriver) Flush(logger logger.Logger) error {
+	return nil
+}
+
+// publishOrderingEvents publishes the events of each key from its own goroutine with increasing versions. The subject
+// has a random key so the consumer has to route the events by their ordering key.
+func publishOrderingEvents(js jetstream.JetStream, table string) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, orderingTestKeys)
+	for k := 0; k < orderingTestKeys; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			for v := 1; v <= orderingTestEvents; v++ {
+				event := internal.DBChangeEvent{
+					ID:            util.Hash(table, k, v),
+					Operation:     "UPDATE",
+					Table:         table,
+					Key:           []string{"gcp-us-central1", fmt.Sprintf("%s-%d", table, k)},
+					ModelVersion:  modelVersion,
+					After:         json.RawMessage(defaultPayload),
+					Timestamp:     time.Now().UnixMilli(),
+					MVCCTimestamp: fmt.Sprintf("%d", v),
+				}
+				subject := fmt.Sprintf("dbchange.%s.UPDATE.%s.1.PUBLIC.%d", table, companyId, rand.Int())
+				if _, err := js.Publish(context.Background(), subject, []byte(util.JSONStringify(event))); err != nil {
+					errs <- fmt.Errorf("error publishing event: %w", err)
+					return
+				}
+			}
+		}(k)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// runOrderingTest runs a consumer with several pipelines for each way of sharding and checks that the events with the
+// same ordering key are processed one at a time in the order they were published.
+func runOrderingTest(logger logger.Logger, js jetstream.JetStream, natsurl string, userCreds string, dir string) error {
+	credsFile := filepath.Join(dir, "ordering.creds")
+	if err := os.WriteFile(credsFile, []byte(userCreds), 0600); err != nil {
+		return err
+	}
+	for _, shard := range []string{consumer.PipelineShardKey, consumer.PipelineShardTable} {
+		state := &orderingState{inflight: make(map[string]int), last: make(map[string]int)}
+		var count int
+		c, err := consumer.NewConsumer(consumer.ConsumerConfig{
+			Context:       context.Background(),
+			Logger:        logger.WithPrefix("[" + orderingTestName + "-" + shard + "]"),
+			URL:           natsurl,
+			Credentials:   credsFile,
+			Driver:        &orderingDriver{state: state},
+			Pipelines:     orderingTestPipelines,
+			PipelineShard: shard,
+			NewPipelineDriver: func() (consumer.Driver, error) {
+				count++
+				return &orderingDriver{id: count, state: state}, nil
+			},
+			MinPendingLatency: time.Millisecond,
+			MaxPendingLatency: 10 * time.Millisecond,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating consumer sharded by %s: %w", shard, err)
+		}
+		err = func() error {
+			defer c.Stop()
+			if err := publishOrderingEvents(js, "order_"+shard); err != nil {
+				return err
+			}
+			expected := orderingTestKeys * orderingTestEvents
+			started := time.Now()
+			for time.Since(started) < orderingTestTimeout {
+				select {
+				case err := <-c.Error():
+					return fmt.Errorf("consumer sharded by %s failed: %w", shard, err)
+				case <-time.After(100 * time.Millisecond):
+				}
+				state.lock.Lock()
+				processed, err := state.processed, state.err
+				state.lock.Unlock()
+				if err != nil {
+					return fmt.Errorf("events sharded by %s were reordered: %w", shard, err)
+				}
+				if processed >= expected {
+					return nil
+				}
+			}
+			return fmt.Errorf("timed out waiting for %d events sharded by %s, processed %d", expected, shard, state.processed)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Code identifies a class of failure so the control plane and the docs can map it to its remediation steps without
+// parsing the error message.
+type Code string
+
+const (
+	Unknown                Code = "EDS-1000" // an error which hasn't been classified
+	InvalidConfig          Code = "EDS-1001" // the flags or the configuration are invalid
+	NatsDisconnected       Code = "EDS-2001" // the connection to the nats server was lost
+	SequenceGap            Code = "EDS-2002" // messages were delivered out of sequence
+	InvalidEvent           Code = "EDS-2003" // an event couldn't be decoded
+	DestinationUnavailable Code = "EDS-3001" // the destination failed with a transient error
+	DestinationWrite       Code = "EDS-3002" // the destination rejected the events
+	MigrationFailed        Code = "EDS-3003" // a table or its columns couldn't be migrated in the destination
+	SchemaRegistry         Code = "EDS-4001" // the schema couldn't be fetched from the registry
+)
+
+// Definition describes an error code.
+type Definition struct {
+	Code        Code   `json:"code"`
+	Summary     string `json:"summary"`
+	Remediation string `json:"remediation"`
+	ExitCode    int    `json:"exitCode"` // the exit code of the process when the error stops it
+}
+
+// definitions are the known error codes. Unknown, InvalidConfig and NatsDisconnected use the exit codes the server
+// already handles while the others use their own so the server can tell them apart.
+var definitions = map[Code]Definition{
+	Unknown:                {Unknown, "an unexpected error occurred", "check the server logs and contact support if it keeps happening", 1},
+	InvalidConfig:          {InvalidConfig, "the flags or the configuration are invalid", "fix the problems which are logged, the server command with --check-config validates the configuration without starting", 3},
+	NatsDisconnected:       {NatsDisconnected, "the connection to the Shopmonkey nats server was lost", "the server reconnects automatically, check the network and firewall if it keeps happening", 5},
+	SequenceGap:            {SequenceGap, "messages were delivered out of sequence", "the server restarts the consumer automatically so the messages are delivered again in order", 10},
+	InvalidEvent:           {InvalidEvent, "an event couldn't be decoded", "contact support with the logs since the event is redelivered until it can be decoded", 11},
+	DestinationUnavailable: {DestinationUnavailable, "the destination failed with a transient error such as a timeout", "check the destination is reachable and has capacity, the events are retried automatically", 12},
+	DestinationWrite:       {DestinationWrite, "the destination rejected the events", "check the destination logs, the permissions of the user and that the tables weren't changed outside of eds", 13},
+	MigrationFailed:        {MigrationFailed, "a table or its columns couldn't be migrated in the destination", "check the user has permission to create and alter tables in the destination", 14},
+	SchemaRegistry:         {SchemaRegistry, "the schema couldn't be fetched from the Shopmonkey API", "check the server can reach the Shopmonkey API, the schema is fetched again automatically", 15},
+}
+
+// Error is an error with a code.
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New returns the error with the code. An error which already has a code keeps it and nil is returned for a nil error.
+func New(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Errorf formats an error with the code.
+func Errorf(code Code, format string, args ...any) error {
+	return New(code, fmt.Errorf(format, args...))
+}
+
+// Of returns the code of the error or Unknown if it doesn't have one.
+func Of(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Unknown
+}
+
+// Fields returns the fields to add to a log entry for the error.
+func Fields(err error) map[string]any {
+	return map[string]any{"code": Of(err)}
+}
+
+// ExitCode returns the exit code of the process for the error.
+func ExitCode(err error) int {
+	return Lookup(Of(err)).ExitCode
+}
+
+// Lookup returns the definition of the code or the definition of Unknown if the code isn't known.
+func Lookup(code Code) Definition {
+	if def, ok := definitions[code]; ok {
+		return def
+	}
+	return definitions[Unknown]
+}
+
+// ForExitCode returns the definition for the exit code of a process and false if the exit code doesn't belong to one.
+func ForExitCode(exitCode int) (Definition, bool) {
+	for _, def := range definitions {
+		if def.ExitCode == exitCode {
+			return def, true
+		}
+	}
+	return Definition{}, false
+}
+
+// All returns the definitions of the known error codes sorted by code.
+func All() []Definition {
+	defs := make([]Definition, 0, len(definitions))
+	for _, def := range definitions {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Code < defs[j].Code
+	})
+	return defs
+}
@@ -0,0 +1,46 @@
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := New(DestinationUnavailable, cause)
+	assert.EqualError(t, err, "connection refused")
+	assert.ErrorIs(t, err, cause)
+	assert.Equal(t, DestinationUnavailable, Of(err))
+	assert.Equal(t, 12, ExitCode(err))
+
+	// the code of the original error is kept when wrapped again
+	wrapped := New(DestinationWrite, fmt.Errorf("error flushing: %w", err))
+	assert.Equal(t, DestinationUnavailable, Of(wrapped))
+
+	assert.NoError(t, New(DestinationWrite, nil))
+	assert.Equal(t, Unknown, Of(cause))
+	assert.Equal(t, 1, ExitCode(cause))
+	assert.Equal(t, map[string]any{"code": MigrationFailed}, Fields(Errorf(MigrationFailed, "error migrating table: %s", "order")))
+}
+
+func TestDefinitions(t *testing.T) {
+	exitCodes := make(map[int]Code)
+	for _, def := range All() {
+		assert.Regexp(t, `^EDS-\d{4}$`, string(def.Code))
+		assert.NotEmpty(t, def.Summary, def.Code)
+		assert.NotEmpty(t, def.Remediation, def.Code)
+		if existing, ok := exitCodes[def.ExitCode]; ok {
+			t.Errorf("exit code %d is used by %s and %s", def.ExitCode, existing, def.Code)
+		}
+		exitCodes[def.ExitCode] = def.Code
+		found, ok := ForExitCode(def.ExitCode)
+		assert.True(t, ok)
+		assert.Equal(t, def.Code, found.Code)
+	}
+	_, ok := ForExitCode(0)
+	assert.False(t, ok)
+	assert.Equal(t, Unknown, Lookup("EDS-9999").Code)
+}
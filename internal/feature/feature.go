@@ -0,0 +1,107 @@
+package feature
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dedupe skips an event when an event with the same id is already pending in the batch.
+const Dedupe = "dedupe"
+
+// Lineage adds the stream sequence, consumer, version and batch id of the message to each delivered event.
+const Lineage = "lineage"
+
+// known are the feature flags this version understands and their descriptions. Flags which aren't known are kept so
+// the control plane can roll out a flag before every install has the version which uses it.
+var known = map[string]string{
+	Dedupe:  "skip events with the same id as an event already pending in the batch",
+	Lineage: "add the stream sequence, consumer, version and batch id of the message to each delivered event",
+}
+
+var (
+	lock    sync.RWMutex
+	enabled = make(map[string]bool)
+)
+
+// Known returns the names of the feature flags this version understands.
+func Known() []string {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Description returns the description of a known feature flag or an empty string if it isn't known.
+func Description(name string) string {
+	return known[name]
+}
+
+// IsKnown returns true if this version understands the feature flag.
+func IsKnown(name string) bool {
+	_, ok := known[name]
+	return ok
+}
+
+// Parse parses the feature flags in the format name or name=bool such as dedupe or dedupe=false. A later value for the
+// same name overrides an earlier one so the flags from the control plane can be appended to the ones from the config.
+func Parse(values []string) (map[string]bool, error) {
+	flags := make(map[string]bool)
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		name, val, found := strings.Cut(value, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("invalid feature flag: %s (must be name or name=bool)", value)
+		}
+		on := true
+		if found {
+			var err error
+			on, err = strconv.ParseBool(strings.TrimSpace(val))
+			if err != nil {
+				return nil, fmt.Errorf("invalid feature flag: %s (must be name or name=bool)", value)
+			}
+		}
+		flags[name] = on
+	}
+	return flags, nil
+}
+
+// Set replaces the feature flags of the process.
+func Set(flags map[string]bool) {
+	values := make(map[string]bool, len(flags))
+	for name, on := range flags {
+		if on {
+			values[name] = true
+		}
+	}
+	lock.Lock()
+	enabled = values
+	lock.Unlock()
+}
+
+// Enabled returns true if the feature flag is enabled. All feature flags are disabled by default.
+func Enabled(name string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return enabled[name]
+}
+
+// EnabledFlags returns the sorted names of the enabled feature flags.
+func EnabledFlags() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	names := make([]string, 0, len(enabled))
+	for name := range enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,41 @@
+package feature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	flags, err := Parse([]string{"dedupe", "copy=false", " parallel-flush = true ", ""})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dedupe": true, "copy": false, "parallel-flush": true}, flags)
+
+	flags, err = Parse([]string{"dedupe", "dedupe=0"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dedupe": false}, flags)
+
+	_, err = Parse([]string{"dedupe=maybe"})
+	assert.ErrorContains(t, err, "invalid feature flag: dedupe=maybe")
+	_, err = Parse([]string{"=true"})
+	assert.ErrorContains(t, err, "invalid feature flag")
+}
+
+func TestSetEnabled(t *testing.T) {
+	defer Set(nil)
+	assert.False(t, Enabled(Dedupe))
+	Set(map[string]bool{Dedupe: true, "copy": false, "parallel-flush": true})
+	assert.True(t, Enabled(Dedupe))
+	assert.False(t, Enabled("copy"))
+	assert.Equal(t, []string{"dedupe", "parallel-flush"}, EnabledFlags())
+	Set(map[string]bool{})
+	assert.False(t, Enabled(Dedupe))
+	assert.Empty(t, EnabledFlags())
+}
+
+func TestKnown(t *testing.T) {
+	assert.Contains(t, Known(), Dedupe)
+	assert.True(t, IsKnown(Dedupe))
+	assert.False(t, IsKnown("copy"))
+	assert.NotEmpty(t, Description(Dedupe))
+}
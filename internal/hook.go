@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// ProcessorHook lets an embedding program run its own logic, such as enriching or auditing the events, as the consumer
+// processes them. The hooks of a consumer with several pipelines are called by each pipeline at the same time.
+type ProcessorHook struct {
+	// Name identifies the hook in the logs.
+	Name string
+
+	// PreProcess is called with each event before it's sent to the driver and can change it. Returning true skips the
+	// event and returning an error fails the pending events so they're redelivered. Can be nil.
+	PreProcess func(logger logger.Logger, event *DBChangeEvent) (bool, error)
+
+	// PostFlush is called with the events which were sent to the driver after it flushed them and before they're acked.
+	// Returning an error fails the pending events so they're redelivered. Can be nil.
+	PostFlush func(logger logger.Logger, events []DBChangeEvent) error
+}
+
+var processorHooksLock sync.Mutex
+var processorHooks []ProcessorHook
+
+// RegisterProcessorHook registers a hook which is used by the consumers created after it.
+func RegisterProcessorHook(hook ProcessorHook) {
+	processorHooksLock.Lock()
+	defer processorHooksLock.Unlock()
+	processorHooks = append(processorHooks, hook)
+}
+
+// ProcessorHooks returns the hooks in the order they were registered.
+func ProcessorHooks() []ProcessorHook {
+	processorHooksLock.Lock()
+	defer processorHooksLock.Unlock()
+	return append([]ProcessorHook(nil), processorHooks...)
+}
+
+// ResetProcessorHooks removes the registered hooks.
+func ResetProcessorHooks() {
+	processorHooksLock.Lock()
+	defer processorHooksLock.Unlock()
+	processorHooks = nil
+}
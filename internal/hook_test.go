@@ -0,0 +1,20 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterProcessorHook(t *testing.T) {
+	t.Cleanup(ResetProcessorHooks)
+	assert.Empty(t, ProcessorHooks())
+	RegisterProcessorHook(ProcessorHook{Name: "a"})
+	RegisterProcessorHook(ProcessorHook{Name: "b"})
+	hooks := ProcessorHooks()
+	assert.Len(t, hooks, 2)
+	assert.Equal(t, "a", hooks[0].Name)
+	assert.Equal(t, "b", hooks[1].Name)
+	ResetProcessorHooks()
+	assert.Empty(t, ProcessorHooks())
+}
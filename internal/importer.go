@@ -45,11 +45,29 @@ type ImporterConfig struct {
 	// Single is true if only a single row should be imported at a time vs batching.
 	Single bool
 
+	// MaxBatchCount is the maximum number of events to accumulate in memory before they are written. 0 uses the default.
+	MaxBatchCount int
+
+	// MaxBatchBytes is the maximum number of event bytes to accumulate in memory before they are written. 0 uses the default.
+	MaxBatchBytes int
+
 	// Only create the schema but do not import any data.
 	SchemaOnly bool
 
 	// NoDelete is true if the importer should not delete the tables before importing.
 	NoDelete bool
+
+	// FileMappings map the data files which aren't CockroachDB exports to their table.
+	FileMappings []ImportFileMapping
+
+	// EncryptionKey decrypts the data files which were encrypted when they were downloaded or nil if they aren't.
+	EncryptionKey []byte
+}
+
+// ImportFileMapping maps the data files with a name matching the glob pattern to a table.
+type ImportFileMapping struct {
+	Pattern string
+	Table   string
 }
 
 // Importer is the interface that must be implemented by all importer implementations
@@ -0,0 +1,332 @@
+package importer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	FormatNDJSON = "ndjson" // new line delimited JSON objects
+	FormatJSON   = "json"   // a JSON array of objects or JSON objects one after the other
+	FormatCSV    = "csv"    // comma separated values with a header row of column names
+
+	fileMappingFormat = "pattern=table" // the format of a file mapping flag value
+)
+
+// formatExtensions are the file extensions which can be imported and their format, longest first so .ndjson.gz is
+// matched before .gz.
+var formatExtensions = []struct {
+	ext        string
+	format     string
+	compressed bool
+}{
+	{".ndjson.gz", FormatNDJSON, true},
+	{".json.gz", FormatJSON, true},
+	{".csv.gz", FormatCSV, true},
+	{".ndjson", FormatNDJSON, false},
+	{".json", FormatJSON, false},
+	{".csv", FormatCSV, false},
+}
+
+// File is a data file which can be imported.
+type File struct {
+	Path       string
+	Table      string
+	Timestamp  time.Time
+	Format     string
+	Compressed bool
+	Encrypted  bool
+}
+
+// ParseFileMappings parses a list of file mappings in the format pattern=table where pattern is a glob matched against
+// the name of the file such as orders_*.csv.gz=order.
+func ParseFileMappings(values []string) ([]internal.ImportFileMapping, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	mappings := make([]internal.ImportFileMapping, 0, len(values))
+	for _, value := range values {
+		pattern, table, ok := strings.Cut(value, "=")
+		pattern = strings.TrimSpace(pattern)
+		table = strings.TrimSpace(table)
+		if !ok || pattern == "" || table == "" {
+			return nil, fmt.Errorf("invalid file mapping: %s (expected %s)", value, fileMappingFormat)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid file mapping pattern: %s: %w", pattern, err)
+		}
+		mappings = append(mappings, internal.ImportFileMapping{Pattern: pattern, Table: table})
+	}
+	return mappings, nil
+}
+
+// ParseFile returns the file to import for the path or false if it's not a format which can be imported. The table is
+// the first matching file mapping, the table of a CockroachDB export filename or the filename without its extension.
+// The timestamp of files which aren't CockroachDB exports is the modification time of the file. Files encrypted by the
+// download have the util.EncryptedFileExtension added to their name which is ignored for the format and table.
+func ParseFile(path string, mappings []internal.ImportFileMapping) (File, bool) {
+	file := File{Path: path, Encrypted: util.IsEncryptedFile(path)}
+	name := strings.TrimSuffix(path, util.EncryptedFileExtension)
+	filename := filepath.Base(name)
+	for _, fe := range formatExtensions {
+		if strings.HasSuffix(filename, fe.ext) {
+			file.Format = fe.format
+			file.Compressed = fe.compressed
+			file.Table = strings.TrimSuffix(filename, fe.ext)
+			break
+		}
+	}
+	if file.Format == "" {
+		return File{}, false
+	}
+	var mapped bool
+	for _, mapping := range mappings {
+		if ok, _ := filepath.Match(mapping.Pattern, filename); ok {
+			file.Table = mapping.Table
+			mapped = true
+			break
+		}
+	}
+	if table, tv, ok := util.ParseCRDBExportFile(name); ok {
+		if !mapped {
+			file.Table = table
+		}
+		file.Timestamp = tv
+		return file, true
+	}
+	if file.Table == "" {
+		return File{}, false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return File{}, false
+	}
+	file.Timestamp = info.ModTime()
+	return file, true
+}
+
+// NewDecoder returns a decoder for the rows of the file. Each row is decoded as a JSON object. The values of a CSV file
+// are converted to the type of their column in the schema. Encrypted files are decrypted with key as they are read.
+func NewDecoder(file File, schema *internal.Schema, key []byte) (util.JSONDecoder, error) {
+	if file.Format == FormatNDJSON {
+		return util.NewEncryptedNDJSONDecoder(file.Path, key)
+	}
+	in, err := util.OpenFile(file.Path, key)
+	if err != nil {
+		return nil, fmt.Errorf("error opening: %s. %w", file.Path, err)
+	}
+	var r io.Reader = in
+	var gr *gzip.Reader
+	if file.Compressed {
+		gr, err = gzip.NewReader(in)
+		if err != nil {
+			in.Close()
+			return nil, fmt.Errorf("gzip: error opening: %s. %w", file.Path, err)
+		}
+		r = gr
+	}
+	closer := func() {
+		if gr != nil {
+			gr.Close()
+		}
+		in.Close()
+	}
+	switch file.Format {
+	case FormatJSON:
+		dec, err := newJSONDecoder(r, closer)
+		if err != nil {
+			closer()
+			return nil, fmt.Errorf("error reading: %s. %w", file.Path, err)
+		}
+		return dec, nil
+	case FormatCSV:
+		dec, err := newCSVDecoder(r, closer, schema)
+		if err != nil {
+			closer()
+			return nil, fmt.Errorf("error reading: %s. %w", file.Path, err)
+		}
+		return dec, nil
+	}
+	closer()
+	return nil, fmt.Errorf("unsupported import format: %s", file.Format)
+}
+
+// jsonDecoder reads a JSON array of objects or JSON objects one after the other.
+type jsonDecoder struct {
+	dec    *json.Decoder
+	close  func()
+	count  int
+	closed bool
+}
+
+var _ util.JSONDecoder = (*jsonDecoder)(nil)
+
+func newJSONDecoder(r io.Reader, close func()) (*jsonDecoder, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	// skip the opening bracket of an array so the objects in it are decoded one at a time
+	for {
+		b, err := br.Peek(1)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			br.ReadByte()
+			continue
+		}
+		if b[0] == '[' {
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+	return &jsonDecoder{dec: dec, close: close}, nil
+}
+
+func (d *jsonDecoder) Count() int {
+	return d.count
+}
+
+func (d *jsonDecoder) Close() error {
+	if !d.closed {
+		d.closed = true
+		d.close()
+	}
+	return nil
+}
+
+func (d *jsonDecoder) More() bool {
+	return d.dec.More()
+}
+
+func (d *jsonDecoder) Decode(v any) error {
+	if err := d.dec.Decode(v); err != nil {
+		return err
+	}
+	d.count++
+	return nil
+}
+
+// csvDecoder reads the rows of a CSV file with a header row as JSON objects. An empty value is null.
+type csvDecoder struct {
+	reader  *csv.Reader
+	close   func()
+	header  []string
+	types   []string
+	next    []string
+	err     error
+	count   int
+	closed  bool
+	lineNum int
+}
+
+var _ util.JSONDecoder = (*csvDecoder)(nil)
+
+func newCSVDecoder(r io.Reader, close func(), schema *internal.Schema) (*csvDecoder, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return &csvDecoder{reader: reader, close: close}, nil
+		}
+		return nil, fmt.Errorf("error reading header: %w", err)
+	}
+	types := make([]string, len(header))
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if schema != nil {
+			types[i] = schema.Properties[header[i]].Type
+		}
+	}
+	d := &csvDecoder{reader: reader, close: close, header: header, types: types, lineNum: 1}
+	d.read()
+	return d, nil
+}
+
+func (d *csvDecoder) read() {
+	d.next, d.err = d.reader.Read()
+	d.lineNum++
+}
+
+func (d *csvDecoder) Count() int {
+	return d.count
+}
+
+func (d *csvDecoder) Close() error {
+	if !d.closed {
+		d.closed = true
+		d.close()
+	}
+	return nil
+}
+
+func (d *csvDecoder) More() bool {
+	return d.header != nil && !errors.Is(d.err, io.EOF)
+}
+
+func (d *csvDecoder) Decode(v any) error {
+	if d.err != nil {
+		return d.err
+	}
+	row := make(map[string]any, len(d.header))
+	for i, name := range d.header {
+		val, err := csvValue(d.next[i], d.types[i])
+		if err != nil {
+			return fmt.Errorf("line %d, column %s: %w", d.lineNum, name, err)
+		}
+		row[name] = val
+	}
+	buf, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return err
+	}
+	d.count++
+	d.read()
+	return nil
+}
+
+// csvValue converts the value of a CSV column to the type of the column in the schema.
+func csvValue(val string, typ string) (any, error) {
+	if val == "" {
+		return nil, nil
+	}
+	switch typ {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return nil, fmt.Errorf("invalid number: %s", val)
+		}
+		return json.Number(val), nil
+	case "boolean":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean: %s", val)
+		}
+		return b, nil
+	case "object", "array":
+		if !json.Valid([]byte(val)) {
+			return nil, fmt.Errorf("invalid JSON: %s", val)
+		}
+		return json.RawMessage(val), nil
+	}
+	return val, nil
+}
@@ -0,0 +1,180 @@
+package importer
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, fn string, data string) {
+	f, err := os.Create(fn)
+	assert.NoError(t, err)
+	if filepath.Ext(fn) == ".gz" {
+		gw := gzip.NewWriter(f)
+		_, err = gw.Write([]byte(data))
+		assert.NoError(t, err)
+		assert.NoError(t, gw.Close())
+	} else {
+		_, err = f.WriteString(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+}
+
+func TestParseFileMappings(t *testing.T) {
+	mappings, err := ParseFileMappings([]string{"orders_*.csv.gz=order", " items.json = orderLineItem "})
+	assert.NoError(t, err)
+	assert.Equal(t, []internal.ImportFileMapping{{Pattern: "orders_*.csv.gz", Table: "order"}, {Pattern: "items.json", Table: "orderLineItem"}}, mappings)
+
+	_, err = ParseFileMappings([]string{"order"})
+	assert.ErrorContains(t, err, "invalid file mapping: order")
+	_, err = ParseFileMappings([]string{"[=order"})
+	assert.ErrorContains(t, err, "invalid file mapping pattern")
+}
+
+func TestParseFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"customer.ndjson", "orders_1.csv.gz", "vehicle.json.gz", "notes.txt"} {
+		writeFile(t, filepath.Join(dir, name), "")
+	}
+	mappings := []internal.ImportFileMapping{{Pattern: "orders_*", Table: "order"}}
+
+	f, ok := ParseFile(filepath.Join(dir, "customer.ndjson"), mappings)
+	assert.True(t, ok)
+	assert.Equal(t, "customer", f.Table)
+	assert.Equal(t, FormatNDJSON, f.Format)
+	assert.False(t, f.Compressed)
+	assert.False(t, f.Timestamp.IsZero())
+
+	f, ok = ParseFile(filepath.Join(dir, "orders_1.csv.gz"), mappings)
+	assert.True(t, ok)
+	assert.Equal(t, "order", f.Table)
+	assert.Equal(t, FormatCSV, f.Format)
+	assert.True(t, f.Compressed)
+
+	f, ok = ParseFile(filepath.Join(dir, "vehicle.json.gz"), nil)
+	assert.True(t, ok)
+	assert.Equal(t, "vehicle", f.Table)
+	assert.Equal(t, FormatJSON, f.Format)
+
+	_, ok = ParseFile(filepath.Join(dir, "notes.txt"), mappings)
+	assert.False(t, ok)
+
+	f, ok = ParseFile("202407131650522808024600000000000-c7274317e9a4a9cb-1-651-00000000-order-2.ndjson.gz", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "order", f.Table)
+	assert.Equal(t, 2024, f.Timestamp.Year())
+}
+
+func decodeAll(t *testing.T, f File, schema *internal.Schema) []map[string]any {
+	dec, err := NewDecoder(f, schema, nil)
+	assert.NoError(t, err)
+	defer dec.Close()
+	var rows []map[string]any
+	for dec.More() {
+		var raw json.RawMessage
+		assert.NoError(t, dec.Decode(&raw))
+		var row map[string]any
+		assert.NoError(t, json.Unmarshal(raw, &row))
+		rows = append(rows, row)
+	}
+	assert.Equal(t, len(rows), dec.Count())
+	return rows
+}
+
+func TestDecodeJSON(t *testing.T) {
+	dir := t.TempDir()
+	array := filepath.Join(dir, "array.json.gz")
+	writeFile(t, array, "\n [{\"id\":\"1\"},\n{\"id\":\"2\"}]\n")
+	assert.Equal(t, []map[string]any{{"id": "1"}, {"id": "2"}}, decodeAll(t, File{Path: array, Format: FormatJSON, Compressed: true}, nil))
+
+	objects := filepath.Join(dir, "objects.json")
+	writeFile(t, objects, "{\"id\":\"1\"}\n{\"id\":\"2\"}\n")
+	assert.Equal(t, []map[string]any{{"id": "1"}, {"id": "2"}}, decodeAll(t, File{Path: objects, Format: FormatJSON}, nil))
+}
+
+func TestDecodeEncrypted(t *testing.T) {
+	key, err := util.NewEncryptionKey()
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	w, err := util.CreateEncryptedFile(filepath.Join(dir, "202407131650522808024600000000000-c7274317e9a4a9cb-1-651-00000000-order-2.ndjson.gz"), key)
+	assert.NoError(t, err)
+	gw := gzip.NewWriter(w)
+	_, err = gw.Write([]byte("{\"id\":\"1\"}\n{\"id\":\"2\"}\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, gw.Close())
+	assert.NoError(t, w.Close())
+
+	files, err := util.ListDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	f, ok := ParseFile(files[0], nil)
+	assert.True(t, ok)
+	assert.True(t, f.Encrypted)
+	assert.Equal(t, "order", f.Table)
+	assert.Equal(t, FormatNDJSON, f.Format)
+
+	dec, err := NewDecoder(f, nil, key)
+	assert.NoError(t, err)
+	defer dec.Close()
+	var count int
+	for dec.More() {
+		var row map[string]any
+		assert.NoError(t, dec.Decode(&row))
+		count++
+	}
+	assert.Equal(t, 2, count)
+
+	_, err = NewDecoder(f, nil, nil)
+	assert.ErrorIs(t, err, util.ErrEncryptionKeyRequired)
+}
+
+func TestDecodeCSV(t *testing.T) {
+	schema := &internal.Schema{Properties: map[string]internal.SchemaProperty{
+		"id":       {Type: "string"},
+		"total":    {Type: "number"},
+		"paid":     {Type: "boolean"},
+		"metadata": {Type: "object"},
+	}}
+	fn := filepath.Join(t.TempDir(), "order.csv.gz")
+	writeFile(t, fn, "id,total,paid,metadata,notes\n1,10.5,true,\"{\"\"a\"\":1}\",hello\n2,,false,,\n")
+	rows := decodeAll(t, File{Path: fn, Format: FormatCSV, Compressed: true}, schema)
+	assert.Equal(t, []map[string]any{
+		{"id": "1", "total": 10.5, "paid": true, "metadata": map[string]any{"a": float64(1)}, "notes": "hello"},
+		{"id": "2", "total": nil, "paid": false, "metadata": nil, "notes": nil},
+	}, rows)
+
+	bad := filepath.Join(t.TempDir(), "order.csv")
+	writeFile(t, bad, "id,total\n1,abc\n")
+	dec, err := NewDecoder(File{Path: bad, Format: FormatCSV}, schema, nil)
+	assert.NoError(t, err)
+	defer dec.Close()
+	assert.True(t, dec.More())
+	var raw json.RawMessage
+	assert.ErrorContains(t, dec.Decode(&raw), "line 2, column total: invalid number: abc")
+}
+
+func TestRunCSV(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "orders_2024.csv"), "id,name\n1,a\n2,b\n3,c\n")
+	var handler testBatchHandler
+	config := internal.ImporterConfig{
+		Context:        context.Background(),
+		Logger:         logger.NewTestLogger(),
+		DataDir:        dir,
+		Tables:         []string{"order"},
+		NoDelete:       true,
+		SchemaRegistry: &testRegistry{schema: internal.SchemaMap{"order": {Table: "order", PrimaryKeys: []string{"id"}}}},
+		FileMappings:   []internal.ImportFileMapping{{Pattern: "orders_*.csv", Table: "order"}},
+	}
+	assert.NoError(t, Run(config.Logger, config, &handler))
+	assert.Equal(t, []int{3}, handler.batches)
+}
@@ -24,6 +24,51 @@ type Handler interface {
 	ImportCompleted() error
 }
 
+const (
+	DefaultMaxBatchCount = 10_000     // default maximum number of events a handler accumulates before the batch is flushed
+	DefaultMaxBatchBytes = 32_000_000 // default maximum number of event bytes a handler accumulates before the batch is flushed
+)
+
+// BatchHandler is implemented by handlers which accumulate events in memory before writing them. Run will call FlushBatch
+// whenever the accumulated events reach the batch limits so that memory is bounded regardless of the size of the import.
+type BatchHandler interface {
+	Handler
+
+	// ImportBatchLimits returns the maximum number of events and bytes the handler should accumulate, 0 for no handler specific limit.
+	// The lower of these and the limits in the importer configuration are used.
+	ImportBatchLimits() (int, int)
+
+	// FlushBatch writes any accumulated events.
+	FlushBatch() error
+}
+
+func minLimit(a, b int) int {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 || a < b {
+		return a
+	}
+	return b
+}
+
+// batchLimits returns the count and byte limits for the handler.
+func batchLimits(config internal.ImporterConfig, handler BatchHandler) (int, int) {
+	maxCount := config.MaxBatchCount
+	if maxCount <= 0 {
+		maxCount = DefaultMaxBatchCount
+	}
+	maxBytes := config.MaxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBatchBytes
+	}
+	if config.Single {
+		maxCount = 1
+	}
+	count, bytes := handler.ImportBatchLimits()
+	return minLimit(count, maxCount), minLimit(bytes, maxBytes)
+}
+
 // Run will import data from the importer configuration and call the handler to handle the event.
 func Run(logger logger.Logger, config internal.ImporterConfig, handler Handler) error {
 	started := time.Now()
@@ -39,17 +84,24 @@ func Run(logger logger.Logger, config internal.ImporterConfig, handler Handler)
 	if config.SchemaOnly {
 		return nil
 	}
+	batcher, _ := handler.(BatchHandler)
+	var maxCount, maxBytes, pendingCount, pendingBytes int
+	if batcher != nil {
+		maxCount, maxBytes = batchLimits(config, batcher)
+		logger.Debug("using import batch limits of %d events and %d bytes", maxCount, maxBytes)
+	}
 	var total int
 	files, err := util.ListDir(config.DataDir)
 	if err != nil {
 		return fmt.Errorf("unable to list files in directory: %w", err)
 	}
 	for _, file := range files {
-		table, tv, ok := util.ParseCRDBExportFile(file)
+		f, ok := ParseFile(file, config.FileMappings)
 		if !ok {
 			logger.Debug("skipping file: %s", file)
 			continue
 		}
+		table, tv := f.Table, f.Timestamp
 		if !util.SliceContains(config.Tables, table) {
 			continue
 		}
@@ -57,10 +109,10 @@ func Run(logger logger.Logger, config internal.ImporterConfig, handler Handler)
 		if data == nil {
 			return fmt.Errorf("unexpected table (%s) not found in schema but in import directory: %s", table, file)
 		}
-		logger.Debug("processing file: %s, table: %s", file, table)
-		dec, err := util.NewNDJSONDecoder(file)
+		logger.Debug("processing file: %s, table: %s, format: %s", file, table, f.Format)
+		dec, err := NewDecoder(f, data, config.EncryptionKey)
 		if err != nil {
-			return fmt.Errorf("unable to create JSON decoder for %s: %w", file, err)
+			return fmt.Errorf("unable to create decoder for %s: %w", file, err)
 		}
 		defer dec.Close()
 		var count int
@@ -74,7 +126,7 @@ func Run(logger logger.Logger, config internal.ImporterConfig, handler Handler)
 			event.ID = util.Hash(filepath.Base(file))
 			event.ModelVersion = schema[table].ModelVersion
 			if err := dec.Decode(&event.After); err != nil {
-				return fmt.Errorf("unable to decode JSON: %w", err)
+				return fmt.Errorf("unable to decode %s: %w", file, err)
 			}
 			event.Key = []string{event.GetPrimaryKey()}
 			o, err := event.GetObject()
@@ -94,6 +146,11 @@ func Run(logger logger.Logger, config internal.ImporterConfig, handler Handler)
 
 			if config.SchemaValidator != nil {
 				found, valid, path, err := config.SchemaValidator.Validate(event)
+				var rerr *internal.ValidationRuleError
+				if errors.As(err, &rerr) && rerr.Action == internal.ValidationActionAlert {
+					logger.Warn("%s for event: %s", rerr, event.String())
+					err = nil
+				}
 				if errors.Is(err, util.ErrSchemaValidation) {
 					// note we join these errors since they are separated by definition in errors.Join and we want to log them together
 					logger.Debug("skipping %s, schema did not validate (%s) for event: %s", event.Table, strings.TrimSpace(strings.Join(strings.Split(err.Error(), "\n"), " ")), util.JSONStringify(event))
@@ -119,6 +176,17 @@ func Run(logger logger.Logger, config internal.ImporterConfig, handler Handler)
 			if err := handler.ImportEvent(event, data); err != nil {
 				return err
 			}
+			if batcher != nil {
+				pendingCount++
+				pendingBytes += len(event.After)
+				if pendingCount >= maxCount || pendingBytes >= maxBytes {
+					if err := batcher.FlushBatch(); err != nil {
+						return err
+					}
+					pendingCount = 0
+					pendingBytes = 0
+				}
+			}
 		}
 		if err := dec.Close(); err != nil {
 			return err
@@ -127,6 +195,12 @@ func Run(logger logger.Logger, config internal.ImporterConfig, handler Handler)
 		logger.Debug("imported %d %s records in %s", count, table, time.Since(tstarted))
 	}
 
+	if batcher != nil && pendingCount > 0 {
+		if err := batcher.FlushBatch(); err != nil {
+			return err
+		}
+	}
+
 	if err := handler.ImportCompleted(); err != nil {
 		return err
 	}
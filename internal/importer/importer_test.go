@@ -0,0 +1,100 @@
+package importer
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRegistry struct {
+	schema internal.SchemaMap
+}
+
+func (r *testRegistry) GetLatestSchema() (internal.SchemaMap, error) { return r.schema, nil }
+func (r *testRegistry) GetSchema(table string, version string) (*internal.Schema, error) {
+	return r.schema[table], nil
+}
+func (r *testRegistry) GetTableVersion(table string) (bool, string, error) { return false, "", nil }
+func (r *testRegistry) SetTableVersion(table string, version string) error { return nil }
+func (r *testRegistry) Close() error                                       { return nil }
+
+type testBatchHandler struct {
+	maxCount  int
+	maxBytes  int
+	pending   int
+	batches   []int
+	completed bool
+}
+
+func (h *testBatchHandler) CreateDatasource(schema internal.SchemaMap) error { return nil }
+func (h *testBatchHandler) ImportEvent(event internal.DBChangeEvent, schema *internal.Schema) error {
+	h.pending++
+	return nil
+}
+func (h *testBatchHandler) ImportCompleted() error {
+	h.completed = true
+	return nil
+}
+func (h *testBatchHandler) ImportBatchLimits() (int, int) { return h.maxCount, h.maxBytes }
+func (h *testBatchHandler) FlushBatch() error {
+	h.batches = append(h.batches, h.pending)
+	h.pending = 0
+	return nil
+}
+
+func writeExportFile(t *testing.T, dir string, table string, count int) {
+	fn := filepath.Join(dir, "202407131650522808024600000000000-c7274317e9a4a9cb-1-651-00000000-"+table+"-2.ndjson.gz")
+	f, err := os.Create(fn)
+	assert.NoError(t, err)
+	gw := gzip.NewWriter(f)
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(gw, "{\"id\":\"%d\",\"name\":\"0123456789\"}\n", i)
+	}
+	assert.NoError(t, gw.Close())
+	assert.NoError(t, f.Close())
+}
+
+func runImport(t *testing.T, handler *testBatchHandler, config internal.ImporterConfig) {
+	dir := t.TempDir()
+	writeExportFile(t, dir, "order", 25)
+	config.Context = context.Background()
+	config.Logger = logger.NewTestLogger()
+	config.DataDir = dir
+	config.Tables = []string{"order"}
+	config.NoDelete = true
+	config.SchemaRegistry = &testRegistry{schema: internal.SchemaMap{"order": {Table: "order", PrimaryKeys: []string{"id"}}}}
+	assert.NoError(t, Run(config.Logger, config, handler))
+	assert.True(t, handler.completed)
+}
+
+func TestRunBatchCountLimit(t *testing.T) {
+	var handler testBatchHandler
+	runImport(t, &handler, internal.ImporterConfig{MaxBatchCount: 10})
+	assert.Equal(t, []int{10, 10, 5}, handler.batches)
+}
+
+func TestRunBatchHandlerLimit(t *testing.T) {
+	handler := testBatchHandler{maxCount: 20}
+	runImport(t, &handler, internal.ImporterConfig{MaxBatchCount: 100})
+	assert.Equal(t, []int{20, 5}, handler.batches)
+}
+
+func TestRunBatchBytesLimit(t *testing.T) {
+	var handler testBatchHandler
+	// each record is about 30 bytes so a batch is flushed after every 3 records
+	runImport(t, &handler, internal.ImporterConfig{MaxBatchBytes: 64})
+	assert.Equal(t, []int{3, 3, 3, 3, 3, 3, 3, 3, 1}, handler.batches)
+}
+
+func TestRunSingle(t *testing.T) {
+	var handler testBatchHandler
+	runImport(t, &handler, internal.ImporterConfig{Single: true})
+	assert.Len(t, handler.batches, 25)
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime/debug"
+
+	"github.com/shirou/gopsutil/v4/mem"
+)
+
+const (
+	DefaultMemoryLimitPercent = 70 // the percent of the system memory used for the memory limit by default
+	MemoryLimitDisabled       = -1 // turns off the memory limit
+	GCDisabled                = -1 // turns off the garbage collection until the memory limit is reached
+)
+
+// MemoryConfig controls the soft memory limit and the garbage collection of the process.
+type MemoryConfig struct {
+	LimitMB      int64 // the soft memory limit in megabytes, 0 derives it from the system memory or GOMEMLIMIT and MemoryLimitDisabled turns it off
+	LimitPercent int   // the percent of the system memory to use for the memory limit when LimitMB is 0
+	GCPercent    int   // the garbage collection target percentage like GOGC, 0 keeps the default and GCDisabled only collects at the memory limit
+	BallastMB    int64 // the size in megabytes of a ballast allocation which raises the heap size the garbage collection is paced from
+}
+
+// Validate returns an error if the memory configuration isn't valid.
+func (c MemoryConfig) Validate() error {
+	if c.LimitMB < MemoryLimitDisabled {
+		return fmt.Errorf("memory limit must be at least %d", MemoryLimitDisabled)
+	}
+	if c.LimitPercent < 0 || c.LimitPercent > 100 {
+		return fmt.Errorf("memory limit percent must be between 0 and 100")
+	}
+	if c.GCPercent < GCDisabled {
+		return fmt.Errorf("gc percent must be at least %d", GCDisabled)
+	}
+	if c.GCPercent == GCDisabled && (c.LimitMB == MemoryLimitDisabled || (c.LimitMB == 0 && c.LimitPercent == 0)) {
+		return fmt.Errorf("gc can only be disabled with a memory limit")
+	}
+	if c.BallastMB < 0 {
+		return fmt.Errorf("gc ballast must not be negative")
+	}
+	return nil
+}
+
+// MemorySettings are the memory settings which were applied.
+type MemorySettings struct {
+	Limit     int64  // the soft memory limit in bytes or 0 if there is none
+	Source    string // where the memory limit came from
+	GCPercent int    // the garbage collection target percentage or 0 for the default
+	Ballast   int64  // the size in bytes of the ballast
+}
+
+func (s MemorySettings) String() string {
+	limit := "none"
+	if s.Limit > 0 {
+		limit = fmt.Sprintf("%dMB (%s)", s.Limit/1024/1024, s.Source)
+	}
+	gc := "default"
+	switch {
+	case s.GCPercent == GCDisabled:
+		gc = "off"
+	case s.GCPercent > 0:
+		gc = fmt.Sprintf("%d%%", s.GCPercent)
+	}
+	return fmt.Sprintf("limit %s, gc %s, ballast %dMB", limit, gc, s.Ballast/1024/1024)
+}
+
+// totalMemory returns the total system memory in bytes, the same as reported in the SystemStats.
+var totalMemory = func() (uint64, error) {
+	stat, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Total, nil
+}
+
+// ballast is never read, it only needs to stay reachable so the garbage collection counts it in the heap size.
+var ballast []byte
+
+// ApplyMemoryConfig sets the soft memory limit and the garbage collection of the process. Without a memory limit the
+// heap can grow to twice the live data before collecting which on hosts with little memory causes swapping and stalls
+// while catching up, so by default the limit is derived from the system memory unless GOMEMLIMIT is set.
+func ApplyMemoryConfig(config MemoryConfig) (*MemorySettings, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var settings MemorySettings
+	switch {
+	case config.LimitMB == MemoryLimitDisabled:
+		debug.SetMemoryLimit(math.MaxInt64)
+	case config.LimitMB > 0:
+		settings.Limit = config.LimitMB * 1024 * 1024
+		settings.Source = "flag"
+	case os.Getenv("GOMEMLIMIT") != "":
+		settings.Limit = debug.SetMemoryLimit(-1) // the runtime already applied it so only read it
+		settings.Source = "GOMEMLIMIT"
+	case config.LimitPercent > 0:
+		total, err := totalMemory()
+		if err != nil {
+			return nil, fmt.Errorf("error detecting system memory: %w", err)
+		}
+		settings.Limit = int64(total / 100 * uint64(config.LimitPercent))
+		settings.Source = fmt.Sprintf("%d%% of %dMB system memory", config.LimitPercent, total/1024/1024)
+	}
+	if settings.Limit > 0 {
+		debug.SetMemoryLimit(settings.Limit)
+	}
+	if config.GCPercent != 0 {
+		debug.SetGCPercent(config.GCPercent)
+		settings.GCPercent = config.GCPercent
+	}
+	if config.BallastMB > 0 {
+		settings.Ballast = config.BallastMB * 1024 * 1024
+		ballast = make([]byte, settings.Ballast)
+	}
+	return &settings, nil
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyMemoryConfig(t *testing.T) {
+	defer debug.SetMemoryLimit(math.MaxInt64)
+	defer debug.SetGCPercent(100)
+	t.Setenv("GOMEMLIMIT", "")
+
+	oldTotal := totalMemory
+	defer func() { totalMemory = oldTotal }()
+	totalMemory = func() (uint64, error) { return 2048 * 1024 * 1024, nil }
+
+	settings, err := ApplyMemoryConfig(MemoryConfig{LimitPercent: DefaultMemoryLimitPercent})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2048*1024*1024/100*70), settings.Limit)
+	assert.Equal(t, settings.Limit, debug.SetMemoryLimit(-1))
+	assert.Equal(t, "limit 1433MB (70% of 2048MB system memory), gc default, ballast 0MB", settings.String())
+
+	settings, err = ApplyMemoryConfig(MemoryConfig{LimitMB: 512, GCPercent: GCDisabled, BallastMB: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(512*1024*1024), debug.SetMemoryLimit(-1))
+	assert.Equal(t, GCDisabled, debug.SetGCPercent(100))
+	assert.Equal(t, "limit 512MB (flag), gc off, ballast 1MB", settings.String())
+
+	settings, err = ApplyMemoryConfig(MemoryConfig{LimitMB: MemoryLimitDisabled})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), debug.SetMemoryLimit(-1))
+	assert.Equal(t, "limit none, gc default, ballast 0MB", settings.String())
+}
+
+func TestMemoryConfigValidate(t *testing.T) {
+	assert.NoError(t, MemoryConfig{LimitPercent: DefaultMemoryLimitPercent}.Validate())
+	assert.ErrorContains(t, MemoryConfig{LimitPercent: 101}.Validate(), "between 0 and 100")
+	assert.ErrorContains(t, MemoryConfig{LimitMB: -2}.Validate(), "memory limit must be at least -1")
+	assert.ErrorContains(t, MemoryConfig{LimitMB: MemoryLimitDisabled, GCPercent: GCDisabled}.Validate(), "only be disabled with a memory limit")
+	assert.ErrorContains(t, MemoryConfig{BallastMB: -1}.Validate(), "must not be negative")
+}
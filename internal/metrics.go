@@ -1,6 +1,11 @@
 package internal
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	dto "github.com/prometheus/client_model/go"
@@ -13,6 +18,42 @@ var TotalEvents prometheus.Counter
 var FlushDuration prometheus.Histogram
 var FlushCount prometheus.Histogram
 var ProcessingDuration prometheus.Histogram
+var OrderingViolations *prometheus.CounterVec
+var ValidationFailures *prometheus.CounterVec
+var CompanyEvents *prometheus.CounterVec
+var CompanyLag *prometheus.GaugeVec
+var CompanyThrottled *prometheus.CounterVec
+var CompanyErrors *prometheus.CounterVec
+var PausedTableEvents *prometheus.CounterVec
+var ParkedEvents prometheus.Gauge
+var ScratchBytes prometheus.Gauge
+var ScratchDirs prometheus.Gauge
+var ScratchCleanedBytes prometheus.Counter
+var ScratchQuotaExceeded prometheus.Counter
+var DuplicateObjectsSkipped *prometheus.CounterVec
+var AggregatedEvents *prometheus.CounterVec
+var TranslatedEvents *prometheus.CounterVec
+var SkippedEvents *prometheus.CounterVec
+var HTTPRequests *prometheus.CounterVec
+var HTTPRetries *prometheus.CounterVec
+var HTTPRequestDuration *prometheus.HistogramVec
+var Info *prometheus.GaugeVec
+var Backpressure prometheus.Gauge
+var BackpressurePauses *prometheus.CounterVec
+var RateLimitWait prometheus.Counter
+var BufferedBytes prometheus.Gauge
+var SpilledEvents prometheus.Counter
+var JournalEvents *prometheus.CounterVec
+var RetryEvents *prometheus.CounterVec
+var DeadLetterEvents *prometheus.CounterVec
+var SchemaDriftColumns *prometheus.GaugeVec
+var NatsDisconnects prometheus.Counter
+var NatsReconnects *prometheus.CounterVec
+var ConsumerPending *prometheus.GaugeVec
+var ConsumerDeliveredSequence *prometheus.GaugeVec
+var ConsumerAckFloorSequence *prometheus.GaugeVec
+var ConsumerRedelivered *prometheus.GaugeVec
+var ConsumerLag *prometheus.GaugeVec
 
 func createCounters() {
 	PendingEvents = promauto.NewGauge(prometheus.GaugeOpts{
@@ -42,8 +83,178 @@ func createCounters() {
 		Help:    "The latency in duration of processing events from receving them to flushing them",
 		Buckets: []float64{1, 2, 3, 5, 10, 60, 300, 600, 1800, 3600},
 	})
+
+	OrderingViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_ordering_violations_total",
+		Help: "The number of events received with an older version than a previously received event for the same key",
+	}, []string{"table"})
+
+	ValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_validation_failures_total",
+		Help: "The number of events which failed a validation rule",
+	}, []string{"table", "rule", "action"})
+
+	CompanyEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_company_events_total",
+		Help: "The total number of events processed by company",
+	}, []string{"company"})
+
+	CompanyLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_company_lag_seconds",
+		Help: "The latency between the event timestamp and when it was processed by company",
+	}, []string{"company"})
+
+	CompanyThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_company_throttled_total",
+		Help: "The number of events parked or delayed for redelivery because the company was over quota or paused",
+	}, []string{"company", "reason"})
+
+	CompanyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_company_errors_total",
+		Help: "The number of times the consumer of a company failed and was restarted when the companies are isolated",
+	}, []string{"company"})
+
+	PausedTableEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_paused_table_events_total",
+		Help: "The number of events delayed for redelivery because the table was paused",
+	}, []string{"table"})
+
+	ParkedEvents = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eds_parked_events",
+		Help: "The number of events of companies which were over quota or paused parked on disk",
+	})
+	ScratchBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eds_scratch_bytes",
+		Help: "The number of bytes currently used in scratch space",
+	})
+	ScratchDirs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eds_scratch_dirs",
+		Help: "The number of scratch directories currently allocated",
+	})
+	ScratchCleanedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eds_scratch_cleaned_bytes_total",
+		Help: "The number of bytes of leftover scratch files removed at startup",
+	})
+	ScratchQuotaExceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eds_scratch_quota_exceeded_total",
+		Help: "The number of writes to scratch space rejected because the quota was exceeded",
+	})
+	DuplicateObjectsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_duplicate_objects_skipped_total",
+		Help: "The number of redelivered events skipped because the object was already written",
+	}, []string{"table"})
+	AggregatedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_aggregated_events_total",
+		Help: "The number of events collapsed into another event for the same key in an aggregation window",
+	}, []string{"table"})
+	TranslatedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_translated_events_total",
+		Help: "The number of events with an older model version translated to the version of the table",
+	}, []string{"table"})
+	SkippedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_skipped_events_total",
+		Help: "The number of events which were not sent to the driver by reason",
+	}, []string{"table", "reason"})
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_http_requests_total",
+		Help: "The number of outbound HTTP request attempts by status",
+	}, []string{"method", "host", "status"})
+	HTTPRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_http_retries_total",
+		Help: "The number of outbound HTTP requests which were retried",
+	}, []string{"method", "host"})
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "eds_http_request_duration_seconds",
+		Help:    "The duration of outbound HTTP request attempts",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "host"})
+	Info = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_info",
+		Help: "The session, server and company of the install, always 1",
+	}, []string{"session_id", "server_id", "company_id"})
+	Backpressure = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eds_backpressure",
+		Help: "1 when pulling messages is paused because of backpressure, otherwise 0",
+	})
+	BackpressurePauses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_backpressure_pauses_total",
+		Help: "The number of times pulling messages was paused because of backpressure by reason",
+	}, []string{"reason"})
+	RateLimitWait = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eds_rate_limit_wait_seconds_total",
+		Help: "The time spent waiting to send events to the driver because of the max events per second",
+	})
+	BufferedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eds_buffered_bytes",
+		Help: "The size in bytes of the messages held in memory from when they're pulled until they're acked when there is a max buffered size",
+	})
+	SpilledEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eds_spilled_events_total",
+		Help: "The number of events spilled to disk because the max buffered size was reached",
+	})
+	JournalEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_journal_events_total",
+		Help: "The number of events found in the journal after a crash by result (applied, redelivered, duplicate, gap or unknown)",
+	}, []string{"result"})
+	DeadLetterEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_dead_letter_events_total",
+		Help: "The number of events a driver gave up on delivering and saved to a dead letter file by driver and reason",
+	}, []string{"driver", "reason"})
+	RetryEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_retry_events_total",
+		Help: "The number of events in the retry queue by result (queued, replayed or failed)",
+	}, []string{"result"})
+	SchemaDriftColumns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_schema_drift_columns",
+		Help: "The number of columns missing from a destination table when it was last checked by table",
+	}, []string{"table"})
+	NatsDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eds_nats_disconnects_total",
+		Help: "The number of times the connection to the nats server was lost",
+	})
+	NatsReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eds_nats_reconnects_total",
+		Help: "The number of times the consumer was re-established after the connection was lost by result (reconnected or failed)",
+	}, []string{"result"})
+	ConsumerPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_consumer_pending_messages",
+		Help: "The number of messages in the stream which haven't been delivered to the consumer yet by consumer",
+	}, []string{"consumer"})
+	ConsumerDeliveredSequence = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_consumer_delivered_sequence",
+		Help: "The stream sequence of the last message delivered to the consumer by consumer",
+	}, []string{"consumer"})
+	ConsumerAckFloorSequence = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_consumer_ack_floor_sequence",
+		Help: "The stream sequence below which every message was acked by consumer",
+	}, []string{"consumer"})
+	ConsumerRedelivered = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_consumer_redelivered_messages",
+		Help: "The number of messages which were redelivered and not acked yet by consumer",
+	}, []string{"consumer"})
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eds_consumer_lag_seconds",
+		Help: "How far the consumer is behind the head of the stream by the timestamp of the last event received, 0 when caught up, by consumer",
+	}, []string{"consumer"})
 }
 
+// The reasons an event is counted by SkippedEvents.
+const (
+	SkipReasonTableNotAllowed    = "table_not_allowed"
+	SkipReasonLocationNotAllowed = "location_not_allowed"
+	SkipReasonExportTimestamp    = "export_timestamp"
+	SkipReasonSchemaValidation   = "schema_validation"
+	SkipReasonSchemaNotFound     = "schema_not_found"
+	SkipReasonValidationRule     = "validation_rule"
+	SkipReasonValidationError    = "validation_error"
+	SkipReasonQuarantined        = "quarantined"
+	SkipReasonOutOfOrder         = "out_of_order"
+	SkipReasonDuplicate          = "duplicate"
+	SkipReasonOversized          = "oversized"
+	SkipReasonUnchangedFields    = "unchanged_fields"
+	SkipReasonHook               = "hook"
+)
+
 func init() {
 	createCounters()
 }
@@ -68,9 +279,142 @@ func MetricsReset() {
 	prometheus.DefaultRegisterer.Unregister(FlushDuration)
 	prometheus.DefaultRegisterer.Unregister(FlushCount)
 	prometheus.DefaultRegisterer.Unregister(ProcessingDuration)
+	prometheus.DefaultRegisterer.Unregister(OrderingViolations)
+	prometheus.DefaultRegisterer.Unregister(ValidationFailures)
+	prometheus.DefaultRegisterer.Unregister(CompanyEvents)
+	prometheus.DefaultRegisterer.Unregister(CompanyLag)
+	prometheus.DefaultRegisterer.Unregister(CompanyThrottled)
+	prometheus.DefaultRegisterer.Unregister(CompanyErrors)
+	prometheus.DefaultRegisterer.Unregister(PausedTableEvents)
+	prometheus.DefaultRegisterer.Unregister(ParkedEvents)
+	prometheus.DefaultRegisterer.Unregister(ScratchBytes)
+	prometheus.DefaultRegisterer.Unregister(ScratchDirs)
+	prometheus.DefaultRegisterer.Unregister(ScratchCleanedBytes)
+	prometheus.DefaultRegisterer.Unregister(ScratchQuotaExceeded)
+	prometheus.DefaultRegisterer.Unregister(DuplicateObjectsSkipped)
+	prometheus.DefaultRegisterer.Unregister(AggregatedEvents)
+	prometheus.DefaultRegisterer.Unregister(TranslatedEvents)
+	prometheus.DefaultRegisterer.Unregister(SkippedEvents)
+	prometheus.DefaultRegisterer.Unregister(HTTPRequests)
+	prometheus.DefaultRegisterer.Unregister(HTTPRetries)
+	prometheus.DefaultRegisterer.Unregister(HTTPRequestDuration)
+	prometheus.DefaultRegisterer.Unregister(Info)
+	prometheus.DefaultRegisterer.Unregister(Backpressure)
+	prometheus.DefaultRegisterer.Unregister(BackpressurePauses)
+	prometheus.DefaultRegisterer.Unregister(RateLimitWait)
+	prometheus.DefaultRegisterer.Unregister(BufferedBytes)
+	prometheus.DefaultRegisterer.Unregister(SpilledEvents)
+	prometheus.DefaultRegisterer.Unregister(JournalEvents)
+	prometheus.DefaultRegisterer.Unregister(RetryEvents)
+	prometheus.DefaultRegisterer.Unregister(DeadLetterEvents)
+	prometheus.DefaultRegisterer.Unregister(SchemaDriftColumns)
+	prometheus.DefaultRegisterer.Unregister(NatsDisconnects)
+	prometheus.DefaultRegisterer.Unregister(NatsReconnects)
+	prometheus.DefaultRegisterer.Unregister(ConsumerPending)
+	prometheus.DefaultRegisterer.Unregister(ConsumerDeliveredSequence)
+	prometheus.DefaultRegisterer.Unregister(ConsumerAckFloorSequence)
+	prometheus.DefaultRegisterer.Unregister(ConsumerRedelivered)
+	prometheus.DefaultRegisterer.Unregister(ConsumerLag)
 	createCounters()
 }
 
+// The info which can be added as a label to every metric with SetMetricLabels.
+const (
+	MetricLabelSession = "session"
+	MetricLabelServer  = "server"
+	MetricLabelCompany = "company"
+)
+
+// metricLabels maps the names accepted by SetMetricLabels to the label added to each metric.
+var metricLabels = map[string]string{
+	MetricLabelSession: "session_id",
+	MetricLabelServer:  "server_id",
+	MetricLabelCompany: "company_id",
+}
+
+var metricsInfo struct {
+	lock   sync.RWMutex
+	labels []string          // the labels added to every metric
+	values map[string]string // the value by label
+}
+
+// MetricLabelNames returns the names which can be passed to SetMetricLabels.
+func MetricLabelNames() []string {
+	names := make([]string, 0, len(metricLabels))
+	for name := range metricLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetMetricLabels sets which info is added as a label to every metric so series from multiple installs can be
+// distinguished. These should be used sparingly since the session label creates new series every time the session is renewed.
+func SetMetricLabels(names []string) error {
+	var labels []string
+	for _, name := range names {
+		label, ok := metricLabels[name]
+		if !ok {
+			return fmt.Errorf("invalid metric label: %s, must be one of: %s", name, strings.Join(MetricLabelNames(), ", "))
+		}
+		labels = append(labels, label)
+	}
+	metricsInfo.lock.Lock()
+	defer metricsInfo.lock.Unlock()
+	metricsInfo.labels = labels
+	return nil
+}
+
+// SetMetricsInfo sets the info for the install which is exported by the eds_info metric and can be added to every metric.
+func SetMetricsInfo(sessionID string, serverID string, companyIDs []string) {
+	Info.Reset()
+	for _, companyID := range companyIDs {
+		Info.WithLabelValues(sessionID, serverID, companyID).Set(1)
+	}
+	metricsInfo.lock.Lock()
+	defer metricsInfo.lock.Unlock()
+	metricsInfo.values = map[string]string{
+		"session_id": sessionID,
+		"server_id":  serverID,
+		"company_id": strings.Join(companyIDs, ","),
+	}
+}
+
+// MetricsGatherer returns the gatherer for the metrics which adds the labels set with SetMetricLabels to every metric.
+func MetricsGatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		metricsInfo.lock.RLock()
+		defer metricsInfo.lock.RUnlock()
+		if len(metricsInfo.labels) == 0 || metricsInfo.values == nil {
+			return families, err
+		}
+		for _, family := range families {
+			if family.GetName() == "eds_info" {
+				continue
+			}
+			for _, metric := range family.Metric {
+				for _, label := range metricsInfo.labels {
+					if !hasLabel(metric, label) {
+						metric.Label = append(metric.Label, &dto.LabelPair{Name: StringPointer(label), Value: StringPointer(metricsInfo.values[label])})
+					}
+				}
+				sort.Slice(metric.Label, func(i, j int) bool { return metric.Label[i].GetName() < metric.Label[j].GetName() })
+			}
+		}
+		return families, err
+	})
+}
+
+func hasLabel(metric *dto.Metric, name string) bool {
+	for _, label := range metric.Label {
+		if label.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
 // collect calls the function for each metric associated with the Collector
 func collect(col prometheus.Collector, do func(*dto.Metric)) {
 	c := make(chan prometheus.Metric)
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func findMetric(families []*dto.MetricFamily, name string) *dto.Metric {
+	for _, family := range families {
+		if family.GetName() == name && len(family.Metric) > 0 {
+			return family.Metric[0]
+		}
+	}
+	return nil
+}
+
+func metricLabelValues(metric *dto.Metric) map[string]string {
+	values := make(map[string]string)
+	for _, label := range metric.Label {
+		values[label.GetName()] = label.GetValue()
+	}
+	return values
+}
+
+func TestMetricsGatherer(t *testing.T) {
+	MetricsReset()
+	defer SetMetricLabels(nil)
+	SetMetricsInfo("session1", "server1", []string{"c1", "c2"})
+	CompanyEvents.WithLabelValues("c1").Inc()
+
+	families, err := MetricsGatherer().Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"company": "c1"}, metricLabelValues(findMetric(families, "eds_company_events_total")))
+	assert.Equal(t, map[string]string{"session_id": "session1", "server_id": "server1", "company_id": "c1"}, metricLabelValues(findMetric(families, "eds_info")))
+
+	assert.NoError(t, SetMetricLabels([]string{MetricLabelServer, MetricLabelCompany}))
+	families, err = MetricsGatherer().Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"company": "c1", "server_id": "server1", "company_id": "c1,c2"}, metricLabelValues(findMetric(families, "eds_company_events_total")))
+	assert.Equal(t, map[string]string{"server_id": "server1", "company_id": "c1,c2"}, metricLabelValues(findMetric(families, "eds_total_events")))
+
+	assert.ErrorContains(t, SetMetricLabels([]string{"location"}), "invalid metric label: location, must be one of: company, server, session")
+}
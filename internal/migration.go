@@ -15,3 +15,12 @@ type DriverMigration interface {
 	// MigrateNewColumns is called when one or more new columns are detected with the appropriate information for the driver to perform the migration.
 	MigrateNewColumns(ctx context.Context, logger logger.Logger, schema *Schema, columns []string) error
 }
+
+// DriverSchemaDrift is an interface that Drivers implement when they can detect the columns which were removed from
+// the destination outside of EDS, such as a column which was dropped or renamed by hand.
+type DriverSchemaDrift interface {
+
+	// MissingColumns reloads the destination schema and returns the columns of each schema which are missing from its
+	// table keyed by table. Tables which don't exist in the destination aren't included.
+	MissingColumns(ctx context.Context, logger logger.Logger, schemas []*Schema) (map[string][]string, error)
+}
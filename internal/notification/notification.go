@@ -45,6 +45,15 @@ type NotificationHandler struct {
 
 	// Validate action is called to validate the driver configurations.
 	Validate func(driver string, values map[string]any) *ValidateResponse
+
+	// Tables action is called to change the tables the server receives, an empty list receives all tables.
+	Tables func(tables []string) error
+
+	// RefreshSchema action is called to fetch the latest schema and migrate the tables, an empty list migrates all tables.
+	RefreshSchema func(tables []string) error
+
+	// Features action is called to change the feature flags of the server using name or name=bool values.
+	Features func(features []string) error
 }
 
 type SendLogsResponse struct {
@@ -289,6 +298,26 @@ func getBool(val any) bool {
 	return false
 }
 
+func getStrings(val any) ([]string, bool) {
+	switch v := val.(type) {
+	case []string:
+		return v, true
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, s)
+		}
+		return values, true
+	case nil:
+		return nil, true
+	}
+	return nil, false
+}
+
 func (c *NotificationConsumer) callback(m *nats.Msg) {
 	c.wg.Add(1)
 	defer c.wg.Done()
@@ -367,6 +396,27 @@ func (c *NotificationConsumer) callback(m *nats.Msg) {
 		req.Backfill = getBool(notification.Data["backfill"])
 		c.publishSimpleStatus("import", "")
 		c.importaction(&req)
+	case "tables":
+		tables, ok := getStrings(notification.Data["tables"])
+		if !ok {
+			respondGenerically(fmt.Errorf("invalid tables notification. tables must be a list of strings for: %s", notification.String()))
+			return
+		}
+		respondGenerically(c.handler.Tables(tables))
+	case "refreshschema":
+		tables, ok := getStrings(notification.Data["tables"])
+		if !ok {
+			respondGenerically(fmt.Errorf("invalid refreshschema notification. tables must be a list of strings for: %s", notification.String()))
+			return
+		}
+		respondGenerically(c.handler.RefreshSchema(tables))
+	case "features":
+		features, ok := getStrings(notification.Data["features"])
+		if !ok {
+			respondGenerically(fmt.Errorf("invalid features notification. features must be a list of strings for: %s", notification.String()))
+			return
+		}
+		respondGenerically(c.handler.Features(features))
 	case "driverconfig":
 		c.driverconfig(m)
 	case "validate":
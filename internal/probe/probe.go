@@ -0,0 +1,165 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long each handshake waits for the destination.
+const DefaultTimeout = 5 * time.Second
+
+var errNotDetected = errors.New("not detected")
+
+// Credentials are added to the suggested URLs. Placeholders are used for the ones which are needed but not provided.
+type Credentials struct {
+	Username string
+	Password string
+	Database string
+}
+
+// Result is a driver which matches a protocol the destination speaks.
+type Result struct {
+	Driver   string `json:"driver"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	URL      string `json:"url"`
+}
+
+// target is the destination being probed.
+type target struct {
+	host    string
+	port    int
+	creds   Credentials
+	timeout time.Duration
+}
+
+func (t target) addr() string {
+	return net.JoinHostPort(t.host, strconv.Itoa(t.port))
+}
+
+// prober detects a protocol with a handshake and suggests the driver url for it.
+type prober struct {
+	protocol string
+	ports    []int // the default ports of the protocol
+	detect   func(ctx context.Context, t target) (string, error)
+	suggest  func(t target, detail string) (string, *url.URL)
+}
+
+var probers = []prober{
+	{"postgres", []int{5432, 26257}, detectPostgres, suggestPostgres},
+	{"mysql", []int{3306, 9030}, detectMySQL, suggestMySQL},
+	{"tds", []int{1433}, detectTDS, suggestTDS},
+	{"cql", []int{9042}, detectCQL, suggestCQL},
+	{"kafka", []int{9092}, detectKafka, suggestKafka},
+	{"amqp", []int{5672}, detectAMQP, suggestAMQP},
+	{"bolt", []int{7687}, detectBolt, suggestBolt},
+	{"ssh", []int{22}, detectSSH, suggestSSH},
+	{"elasticsearch", []int{9200, 443}, detectElasticsearch, suggestElasticsearch},
+	{"trino", []int{8080, 443}, detectTrino, suggestTrino},
+}
+
+// hostSuffixes are the managed services which are recognized by their host name since they don't have a handshake
+// which can be probed without credentials.
+var hostSuffixes = []struct {
+	suffix string
+	driver string
+	path   string
+}{
+	{".snowflakecomputing.com", "snowflake", "/database"},
+	{".cloud.databricks.com", "databricks", "/catalog/schema"},
+	{".azuredatabricks.net", "databricks", "/catalog/schema"},
+	{".hanacloud.ondemand.com", "hana", "/SCHEMA"},
+	{".servicebus.windows.net", "eventhub", "/"},
+}
+
+// Probe connects to the host on the port, or the default ports of each protocol when the port is 0, and returns the
+// drivers which match the protocols which answered a handshake. The results are sorted by port and driver.
+func Probe(ctx context.Context, host string, port int, creds Credentials, timeout time.Duration) []Result {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	var results []Result
+	for _, hs := range hostSuffixes {
+		if strings.HasSuffix(strings.ToLower(host), hs.suffix) {
+			u := &url.URL{Scheme: hs.driver, User: userInfo(creds), Host: host, Path: hs.path}
+			if port > 0 {
+				u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+			}
+			results = append(results, Result{Driver: hs.driver, Protocol: "hostname", Port: port, URL: u.String()})
+		}
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range probers {
+		ports := p.ports
+		if port > 0 {
+			ports = []int{port}
+		}
+		for _, pt := range ports {
+			wg.Add(1)
+			go func(p prober, t target) {
+				defer wg.Done()
+				detail, err := p.detect(ctx, t)
+				if err != nil {
+					return
+				}
+				driver, u := p.suggest(t, detail)
+				lock.Lock()
+				results = append(results, Result{Driver: driver, Protocol: p.protocol, Port: t.port, Detail: detail, URL: u.String()})
+				lock.Unlock()
+			}(p, target{host, pt, creds, timeout})
+		}
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Port != results[j].Port {
+			return results[i].Port < results[j].Port
+		}
+		return results[i].Driver < results[j].Driver
+	})
+	return results
+}
+
+// ParseHost splits an optional port from the host.
+func ParseHost(val string) (string, int, error) {
+	if !strings.Contains(val, ":") || strings.HasSuffix(val, "]") {
+		return strings.Trim(val, "[]"), 0, nil
+	}
+	host, portStr, err := net.SplitHostPort(val)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port: %s", portStr)
+	}
+	return host, port, nil
+}
+
+func userInfo(creds Credentials) *url.Userinfo {
+	username := creds.Username
+	if username == "" {
+		username = "user"
+	}
+	password := creds.Password
+	if password == "" {
+		password = "password"
+	}
+	return url.UserPassword(username, password)
+}
+
+func database(creds Credentials, placeholder string) string {
+	if creds.Database != "" {
+		return "/" + creds.Database
+	}
+	return "/" + placeholder
+}
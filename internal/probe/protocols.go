@@ -0,0 +1,403 @@
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dial connects to the target with a deadline for the whole handshake.
+func dial(ctx context.Context, t target) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	return conn, nil
+}
+
+// exchange sends the request, if any, and reads exactly n bytes of the response.
+func exchange(ctx context.Context, t target, request []byte, n int) (net.Conn, []byte, error) {
+	conn, err := dial(ctx, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(request) > 0 {
+		if _, err := conn.Write(request); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, buf, nil
+}
+
+// quiet returns true if the server doesn't send anything else within a short time. It's used for the protocols which
+// answer with a single byte so that a server which speaks first isn't mistaken for them.
+func quiet(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var nerr net.Error
+	return errors.Is(err, io.EOF) || (errors.As(err, &nerr) && nerr.Timeout())
+}
+
+// detectPostgres sends an SSLRequest which a PostgreSQL server answers with S or N before authentication.
+func detectPostgres(ctx context.Context, t target) (string, error) {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:], 8)
+	binary.BigEndian.PutUint32(request[4:], 80877103)
+	conn, buf, err := exchange(ctx, t, request, 1)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if (buf[0] != 'S' && buf[0] != 'N') || !quiet(conn) {
+		return "", errNotDetected
+	}
+	if buf[0] == 'S' {
+		return "ssl", nil
+	}
+	return "no ssl", nil
+}
+
+func suggestPostgres(t target, detail string) (string, *url.URL) {
+	driver := "postgres"
+	if t.port == 26257 {
+		driver = "cockroach"
+	}
+	u := &url.URL{Scheme: driver, User: userInfo(t.creds), Host: t.addr(), Path: database(t.creds, "database")}
+	if detail == "ssl" {
+		u.RawQuery = "sslmode=require"
+	} else {
+		u.RawQuery = "sslmode=disable"
+	}
+	return driver, u
+}
+
+// detectMySQL reads the initial handshake packet which a MySQL server sends as soon as it accepts a connection.
+func detectMySQL(ctx context.Context, t target) (string, error) {
+	conn, header, err := exchange(ctx, t, nil, 4)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if header[3] != 0 || length < 2 || length > 1024 {
+		return "", errNotDetected
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return "", errNotDetected
+	}
+	switch payload[0] {
+	case 0x0a: // protocol version 10 followed by the server version
+		version, _, ok := bytes.Cut(payload[1:], []byte{0})
+		if !ok {
+			return "", errNotDetected
+		}
+		return string(version), nil
+	case 0xff: // an error such as the host not being allowed to connect
+		return "connection refused by the server", nil
+	}
+	return "", errNotDetected
+}
+
+func suggestMySQL(t target, detail string) (string, *url.URL) {
+	driver := "mysql"
+	if t.port == 9030 {
+		driver = "starrocks" // the query port of the StarRocks frontend
+	}
+	return driver, &url.URL{Scheme: driver, User: userInfo(t.creds), Host: t.addr(), Path: database(t.creds, "database")}
+}
+
+// detectTDS sends a SQL Server PRELOGIN packet with the version option and reads the version from the response.
+func detectTDS(ctx context.Context, t target) (string, error) {
+	request := []byte{
+		0x12, 0x01, 0x00, 0x14, 0x00, 0x00, 0x01, 0x00, // header: prelogin, end of message, length 20
+		0x00, 0x00, 0x06, 0x00, 0x06, // the version option at offset 6 with length 6
+		0xff,                               // end of the options
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // the client version
+	}
+	conn, header, err := exchange(ctx, t, request, 8)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if header[0] != 0x04 || length < 8 || length > 4096 {
+		return "", errNotDetected
+	}
+	payload := make([]byte, length-8)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return "", errNotDetected
+	}
+	if len(payload) >= 5 && payload[0] == 0x00 {
+		offset := int(binary.BigEndian.Uint16(payload[1:]))
+		if offset+4 <= len(payload) {
+			return fmt.Sprintf("SQL Server %d.%d.%d", payload[offset], payload[offset+1], binary.BigEndian.Uint16(payload[offset+2:])), nil
+		}
+	}
+	return "SQL Server", nil
+}
+
+func suggestTDS(t target, detail string) (string, *url.URL) {
+	driver := "sqlserver"
+	if strings.HasSuffix(strings.ToLower(t.host), ".sql.azuresynapse.net") {
+		driver = "synapse"
+	}
+	return driver, &url.URL{Scheme: driver, User: userInfo(t.creds), Host: t.addr(), Path: database(t.creds, "database")}
+}
+
+// detectCQL sends a CQL v4 OPTIONS frame which Cassandra and ScyllaDB answer with a SUPPORTED frame.
+func detectCQL(ctx context.Context, t target) (string, error) {
+	conn, header, err := exchange(ctx, t, []byte{0x04, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00}, 9)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if header[0]&0x80 == 0 || (header[4] != 0x06 && header[4] != 0x00) {
+		return "", errNotDetected
+	}
+	length := binary.BigEndian.Uint32(header[5:])
+	if length > 64*1024 {
+		return "", errNotDetected
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return "", errNotDetected
+	}
+	if bytes.Contains(body, []byte("SCYLLA")) {
+		return "ScyllaDB", nil
+	}
+	return "Cassandra", nil
+}
+
+func suggestCQL(t target, detail string) (string, *url.URL) {
+	return "cassandra", &url.URL{Scheme: "cassandra", User: userInfo(t.creds), Host: t.addr(), Path: database(t.creds, "keyspace")}
+}
+
+// detectKafka sends an ApiVersions request which a Kafka broker answers before authentication.
+func detectKafka(ctx context.Context, t target) (string, error) {
+	const correlationID = 0x45445321
+	request := make([]byte, 17)
+	binary.BigEndian.PutUint32(request[0:], 13)
+	binary.BigEndian.PutUint16(request[4:], 18) // ApiVersions
+	binary.BigEndian.PutUint16(request[6:], 0)
+	binary.BigEndian.PutUint32(request[8:], correlationID)
+	binary.BigEndian.PutUint16(request[12:], 3)
+	copy(request[14:], "eds")
+	conn, buf, err := exchange(ctx, t, request, 8)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if binary.BigEndian.Uint32(buf[4:]) != correlationID {
+		return "", errNotDetected
+	}
+	return "Kafka", nil
+}
+
+func suggestKafka(t target, detail string) (string, *url.URL) {
+	topic := "topic"
+	if t.creds.Database != "" {
+		topic = t.creds.Database
+	}
+	return "kafka", &url.URL{Scheme: "kafka", Host: t.addr(), Path: "/" + topic}
+}
+
+// detectAMQP sends the AMQP 0-9-1 protocol header which the broker answers with a Connection.Start method or the
+// protocol header of the version it supports.
+func detectAMQP(ctx context.Context, t target) (string, error) {
+	conn, buf, err := exchange(ctx, t, []byte("AMQP\x00\x00\x09\x01"), 8)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if bytes.HasPrefix(buf, []byte("AMQP")) {
+		return fmt.Sprintf("AMQP %d-%d-%d not supported", buf[5], buf[6], buf[7]), nil
+	}
+	if buf[0] != 0x01 || buf[1] != 0 || buf[2] != 0 {
+		return "", errNotDetected
+	}
+	method := make([]byte, 4)
+	if _, err := io.ReadFull(conn, method); err != nil || !bytes.Equal(method, []byte{0x00, 0x0a, 0x00, 0x0a}) {
+		return "", errNotDetected
+	}
+	return "AMQP 0-9-1", nil
+}
+
+func suggestAMQP(t target, detail string) (string, *url.URL) {
+	return "amqp", &url.URL{Scheme: "amqp", User: userInfo(t.creds), Host: t.addr(), Path: "/", RawQuery: "exchange=eds"}
+}
+
+// detectBolt sends the Bolt handshake which a Neo4j server answers with the protocol version it agreed to.
+func detectBolt(ctx context.Context, t target) (string, error) {
+	request := []byte{
+		0x60, 0x60, 0xb0, 0x17,
+		0x00, 0x00, 0x00, 0x05, // 5.0
+		0x00, 0x00, 0x04, 0x04, // 4.4
+		0x00, 0x00, 0x00, 0x04, // 4.0
+		0x00, 0x00, 0x00, 0x03, // 3.0
+	}
+	conn, buf, err := exchange(ctx, t, request, 4)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if buf[0] != 0 || buf[1] != 0 || !quiet(conn) {
+		return "", errNotDetected
+	}
+	if buf[3] == 0 {
+		return "no supported bolt version", nil
+	}
+	return fmt.Sprintf("Bolt %d.%d", buf[3], buf[2]), nil
+}
+
+func suggestBolt(t target, detail string) (string, *url.URL) {
+	return "neo4j", &url.URL{Scheme: "neo4j", User: userInfo(t.creds), Host: t.addr()}
+}
+
+// detectSSH reads the identification line an SSH server sends as soon as it accepts a connection.
+func detectSSH(ctx context.Context, t target) (string, error) {
+	conn, err := dial(ctx, t)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	line, err := bufio.NewReaderSize(conn, 256).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "SSH-") {
+		return "", errNotDetected
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func suggestSSH(t target, detail string) (string, *url.URL) {
+	return "sftp", &url.URL{Scheme: "sftp", User: userInfo(t.creds), Host: t.addr(), Path: "/upload"}
+}
+
+// get requests the path with https and then http and decodes the JSON response. It returns the scheme which worked.
+func get(ctx context.Context, t target, path string, result any) (string, *http.Response, error) {
+	client := &http.Client{
+		Timeout: t.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // only probing, the driver verifies the certificate
+		},
+	}
+	var lastErr error
+	for _, scheme := range []string{"https", "http"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+t.addr()+path, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		if t.creds.Username != "" {
+			req.SetBasicAuth(t.creds.Username, t.creds.Password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(result)
+		}
+		return scheme, resp, err
+	}
+	return "", nil, lastErr
+}
+
+// detectElasticsearch requests the root of the cluster which returns its version and tagline.
+func detectElasticsearch(ctx context.Context, t target) (string, error) {
+	var info struct {
+		Tagline string `json:"tagline"`
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	scheme, resp, err := get(ctx, t, "/", &info)
+	if err != nil {
+		return "", errNotDetected
+	}
+	if resp.StatusCode == http.StatusUnauthorized && strings.Contains(resp.Header.Get("WWW-Authenticate"), `realm="security"`) {
+		return scheme + " authentication required", nil
+	}
+	if resp.StatusCode != http.StatusOK || info.Version.Number == "" {
+		return "", errNotDetected
+	}
+	if info.Version.Distribution == "opensearch" {
+		return scheme + " OpenSearch " + info.Version.Number, nil
+	}
+	if !strings.Contains(info.Tagline, "for Search") {
+		return "", errNotDetected
+	}
+	return scheme + " Elasticsearch " + info.Version.Number, nil
+}
+
+func suggestElasticsearch(t target, detail string) (string, *url.URL) {
+	driver := "elasticsearch"
+	if strings.Contains(detail, "OpenSearch") {
+		driver = "opensearch"
+	}
+	u := &url.URL{Scheme: driver, Host: t.addr(), RawQuery: "prefix=eds-"}
+	if t.creds.Username != "" {
+		u.User = url.UserPassword(t.creds.Username, t.creds.Password)
+	}
+	if strings.HasPrefix(detail, "http ") {
+		u.RawQuery += "&tls=false"
+	}
+	return driver, u
+}
+
+// detectTrino requests the info of the coordinator which Trino and Presto return without authentication.
+func detectTrino(ctx context.Context, t target) (string, error) {
+	var info struct {
+		NodeVersion struct {
+			Version string `json:"version"`
+		} `json:"nodeVersion"`
+		Coordinator *bool `json:"coordinator"`
+	}
+	scheme, resp, err := get(ctx, t, "/v1/info", &info)
+	if err != nil || resp.StatusCode != http.StatusOK || info.Coordinator == nil || info.NodeVersion.Version == "" {
+		return "", errNotDetected
+	}
+	if !*info.Coordinator {
+		return scheme + " worker " + info.NodeVersion.Version, nil
+	}
+	return scheme + " coordinator " + info.NodeVersion.Version, nil
+}
+
+func suggestTrino(t target, detail string) (string, *url.URL) {
+	username := t.creds.Username
+	if username == "" {
+		username = "user"
+	}
+	u := &url.URL{Scheme: "trino", User: url.User(username), Host: t.addr(), Path: "/catalog/schema"}
+	if t.creds.Password != "" {
+		u.User = url.UserPassword(username, t.creds.Password)
+	}
+	if t.creds.Database != "" {
+		u.Path = "/" + t.creds.Database
+	}
+	if strings.HasPrefix(detail, "http ") && t.host != "localhost" && t.host != "127.0.0.1" {
+		u.RawQuery = "ssl=false"
+	}
+	return "trino", u
+}
@@ -13,11 +13,17 @@ import (
 	"github.com/shopmonkeyus/eds/internal/tracker"
 	"github.com/shopmonkeyus/eds/internal/util"
 	"github.com/shopmonkeyus/go-common/logger"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	prefix               = "registry:"
 	defaultCacheDuration = time.Hour * 24
+
+	maxSchemaFetchAttempts = 5 // the number of times a schema is fetched from the API before failing
+
+	maxCachedSchemas            = 1000      // the number of schemas held in memory, the least recently used are evicted
+	previousSchemaCacheDuration = time.Hour // how long a schema which isn't the latest version is held in memory
 )
 
 type APIRegistry struct {
@@ -27,11 +33,15 @@ type APIRegistry struct {
 	schema    internal.SchemaMap
 	objects   tableToObjectNameMap
 	tracker   *tracker.Tracker
-	cache     util.Cache
+	cache     util.Cache // table versions
+	schemas   util.Cache // schemas by table and version
+	fetches   singleflight.Group
+	lock      sync.RWMutex // protects schema and objects which are replaced by a refresh
 	once      sync.Once
 }
 
 var _ internal.SchemaRegistry = (*APIRegistry)(nil)
+var _ internal.SchemaRegistryRefresher = (*APIRegistry)(nil)
 
 func (r *APIRegistry) Close() error {
 	r.logger.Trace("closing")
@@ -39,6 +49,9 @@ func (r *APIRegistry) Close() error {
 		if err := r.cache.Close(); err != nil {
 			r.logger.Error("error closing cache: %s", err)
 		}
+		if err := r.schemas.Close(); err != nil {
+			r.logger.Error("error closing schema cache: %s", err)
+		}
 	})
 	r.logger.Trace("closed")
 	return nil
@@ -48,12 +61,25 @@ func (r *APIRegistry) getSchemaCacheKey(table string, version string) string {
 	return prefix + table + "-" + version
 }
 
+// getSchemaCacheDuration returns how long the schema is held in memory. The latest version of a table is kept until it's
+// evicted since every new event uses it, older versions are only used by events still in flight.
+func (r *APIRegistry) getSchemaCacheDuration(table string, version string) time.Duration {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if latest := r.schema[table]; latest != nil && latest.ModelVersion == version {
+		return 0
+	}
+	return previousSchemaCacheDuration
+}
+
 func (r *APIRegistry) getVersionCacheKey(table string) string {
 	return prefix + table + ":version"
 }
 
 // GetLatestSchema returns the latest schema for all tables.
 func (r *APIRegistry) GetLatestSchema() (internal.SchemaMap, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
 	return r.schema, nil
 }
 
@@ -102,7 +128,7 @@ func (r *APIRegistry) GetSchema(table string, version string) (*internal.Schema,
 	key := r.getSchemaCacheKey(table, version)
 
 	// fast path is to check the in memory cache first
-	found, val, err := r.cache.Get(key)
+	found, val, err := r.schemas.Get(key)
 
 	if err != nil {
 		return nil, fmt.Errorf("error fetching schema from cache: %s", err)
@@ -112,6 +138,30 @@ func (r *APIRegistry) GetSchema(table string, version string) (*internal.Schema,
 		return val.(*internal.Schema), nil
 	}
 
+	// only fetch the schema once when the first events for a table arrive at the same time, the other callers wait
+	// for the result of the fetch in flight
+	val, err, _ = r.fetches.Do(key, func() (any, error) {
+		return r.fetchSchema(key, table, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*internal.Schema), nil
+}
+
+// fetchSchema loads the schema from the tracker or the API and saves it in the cache.
+func (r *APIRegistry) fetchSchema(key string, table string, version string) (*internal.Schema, error) {
+	// check the cache again in case a fetch completed between the cache miss and the start of this fetch
+	found, val, err := r.schemas.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching schema from cache: %s", err)
+	}
+	if found {
+		return val.(*internal.Schema), nil
+	}
+
+	expires := r.getSchemaCacheDuration(table, version)
+
 	if r.tracker != nil {
 		// now check the tracker for the data
 		found, valstr, err := r.tracker.GetKey(key)
@@ -125,7 +175,7 @@ func (r *APIRegistry) GetSchema(table string, version string) (*internal.Schema,
 			if err := json.Unmarshal([]byte(valstr), &schema); err != nil {
 				return nil, fmt.Errorf("error decoding schema for table: %s, modelVersion: %s: %s", table, version, err)
 			}
-			if err := r.cache.Set(key, &schema, defaultCacheDuration); err != nil {
+			if err := r.schemas.Set(key, &schema, expires); err != nil {
 				return nil, fmt.Errorf("error setting key %s in cache: %s", key, err)
 			}
 			return &schema, nil
@@ -133,7 +183,9 @@ func (r *APIRegistry) GetSchema(table string, version string) (*internal.Schema,
 	}
 
 	// we have to now fallback to the API to get the data
+	r.lock.RLock()
 	object := r.objects[table]
+	r.lock.RUnlock()
 	if object == "" {
 		object = table
 	}
@@ -142,7 +194,8 @@ func (r *APIRegistry) GetSchema(table string, version string) (*internal.Schema,
 		return nil, fmt.Errorf("error creating request: %s", err)
 	}
 	req.Header.Set("User-Agent", r.userAgent)
-	resp, err := http.DefaultClient.Do(req)
+	retry := util.NewHTTPRetry(req, util.WithLogger(r.logger), util.WithMaxAttempts(maxSchemaFetchAttempts))
+	resp, err := retry.Do()
 	if err != nil {
 		return nil, fmt.Errorf("error fetching schema: %s", err)
 	}
@@ -158,7 +211,7 @@ func (r *APIRegistry) GetSchema(table string, version string) (*internal.Schema,
 	}
 
 	// save it in the cache and tracker
-	if err := r.cache.Set(key, &schema, defaultCacheDuration); err != nil {
+	if err := r.schemas.Set(key, &schema, expires); err != nil {
 		return nil, fmt.Errorf("error setting key %s in cache: %s", key, err)
 	}
 	if r.tracker != nil {
@@ -175,19 +228,17 @@ type errorResponse struct {
 	Message string `json:"message"`
 }
 
-// NewAPIRegistry creates a new schema registry from the API. This implementation doesn't support versioning.
-func NewAPIRegistry(ctx context.Context, logger logger.Logger, apiURL string, edsVersion string, tracker *tracker.Tracker) (internal.SchemaRegistry, error) {
-	var registry APIRegistry
-	registry.userAgent = "Shopmonkey EDS Server/" + edsVersion
+// fetchLatestSchema fetches the latest schema for all tables from the API.
+func fetchLatestSchema(logger logger.Logger, apiURL string, userAgent string) (internal.SchemaMap, tableToObjectNameMap, error) {
 	req, err := http.NewRequest("GET", apiURL+"/v3/schema", nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %s", err)
+		return nil, nil, fmt.Errorf("error creating request: %s", err)
 	}
-	req.Header.Set("User-Agent", registry.userAgent)
+	req.Header.Set("User-Agent", userAgent)
 	retry := util.NewHTTPRetry(req, util.WithLogger(logger))
 	resp, err := retry.Do()
 	if err != nil {
-		return nil, fmt.Errorf("error fetching schema: %s", err)
+		return nil, nil, fmt.Errorf("error fetching schema: %s", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -195,31 +246,67 @@ func NewAPIRegistry(ctx context.Context, logger logger.Logger, apiURL string, ed
 		buf, _ := io.ReadAll(resp.Body)
 		json.Unmarshal(buf, &errResponse)
 		if errResponse.Message != "" {
-			return nil, fmt.Errorf("error fetching schema: %s", errResponse.Message)
+			return nil, nil, fmt.Errorf("error fetching schema: %s", errResponse.Message)
 		}
-		return nil, fmt.Errorf("error fetching schema: %d: %s", resp.StatusCode, string(buf))
+		return nil, nil, fmt.Errorf("error fetching schema: %d: %s", resp.StatusCode, string(buf))
 	}
-	registry.logger = logger.WithPrefix("[tracker]")
-	registry.cache = util.NewCache(ctx, time.Hour)
-	registry.tracker = tracker
-	registry.apiURL = apiURL
-	registry.schema = make(internal.SchemaMap)
+	schema := make(internal.SchemaMap)
 	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&registry.schema); err != nil {
-		return nil, fmt.Errorf("error decoding schema: %s", err)
-	}
-	registry.schema, registry.objects = sortTable(registry.schema)
-	// save all the data into the tracker and cache the latest
-	for _, schema := range registry.schema {
-		key := registry.getSchemaCacheKey(schema.Table, schema.ModelVersion)
-		if tracker != nil {
-			if err := tracker.SetKey(key, util.JSONStringify(schema), 0); err != nil {
-				return nil, fmt.Errorf("error setting key %s in tracker: %s", key, err)
+	if err := dec.Decode(&schema); err != nil {
+		return nil, nil, fmt.Errorf("error decoding schema: %s", err)
+	}
+	schema, objects := sortTable(schema)
+	return schema, objects, nil
+}
+
+// setLatestSchema saves all the data into the tracker and caches the latest.
+func (r *APIRegistry) setLatestSchema(schema internal.SchemaMap, objects tableToObjectNameMap) error {
+	for _, s := range schema {
+		key := r.getSchemaCacheKey(s.Table, s.ModelVersion)
+		if r.tracker != nil {
+			if err := r.tracker.SetKey(key, util.JSONStringify(s), 0); err != nil {
+				return fmt.Errorf("error setting key %s in tracker: %s", key, err)
 			}
 		}
-		if err := registry.cache.Set(key, schema, 0); err != nil {
-			return nil, fmt.Errorf("error setting key %s in cache: %s", key, err)
+		if err := r.schemas.Set(key, s, 0); err != nil {
+			return fmt.Errorf("error setting key %s in cache: %s", key, err)
 		}
 	}
+	r.lock.Lock()
+	r.schema = schema
+	r.objects = objects
+	r.lock.Unlock()
+	return nil
+}
+
+// RefreshLatestSchema fetches the latest schema for all tables from the API again, such as after a model release.
+func (r *APIRegistry) RefreshLatestSchema() (internal.SchemaMap, error) {
+	schema, objects, err := fetchLatestSchema(r.logger, r.apiURL, r.userAgent)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.setLatestSchema(schema, objects); err != nil {
+		return nil, err
+	}
+	r.logger.Debug("refreshed latest schema for %d tables", len(schema))
+	return schema, nil
+}
+
+// NewAPIRegistry creates a new schema registry from the API. This implementation doesn't support versioning.
+func NewAPIRegistry(ctx context.Context, logger logger.Logger, apiURL string, edsVersion string, tracker *tracker.Tracker) (internal.SchemaRegistry, error) {
+	var registry APIRegistry
+	registry.userAgent = "Shopmonkey EDS Server/" + edsVersion
+	schema, objects, err := fetchLatestSchema(logger, apiURL, registry.userAgent)
+	if err != nil {
+		return nil, err
+	}
+	registry.logger = logger.WithPrefix("[tracker]")
+	registry.cache = util.NewCache(ctx, time.Hour)
+	registry.schemas = util.NewLRUCache(ctx, time.Minute, maxCachedSchemas)
+	registry.tracker = tracker
+	registry.apiURL = apiURL
+	if err := registry.setLatestSchema(schema, objects); err != nil {
+		return nil, err
+	}
 	return &registry, nil
 }
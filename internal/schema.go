@@ -2,6 +2,7 @@ package internal
 
 import (
 	"sort"
+	"time"
 )
 
 type ItemsType struct {
@@ -10,6 +11,10 @@ type ItemsType struct {
 	Format string   `json:"format,omitempty"`
 }
 
+// FormatGeography is the format of a property which is mapped to a native geospatial type. It isn't in the schema from
+// the registry but is set by drivers for the columns configured as geo columns.
+const FormatGeography = "geography"
+
 // SchemaProperty is the property metaedata of a schema.
 type SchemaProperty struct {
 	Type                 string     `json:"type"`
@@ -29,6 +34,16 @@ func (p SchemaProperty) IsArrayOrJSON() bool {
 	return p.Type == "object" || p.Type == "array"
 }
 
+// IsGeography returns true if the property is mapped to a native geospatial type.
+func (p SchemaProperty) IsGeography() bool {
+	return p.Format == FormatGeography
+}
+
+// IsBinary returns true if the property is a bytes value which is encoded as a base64 string in the JSON.
+func (p SchemaProperty) IsBinary() bool {
+	return p.Type == "string" && (p.Format == "byte" || p.Format == "binary")
+}
+
 // Schema is the schema metadata for a table.
 type Schema struct {
 	Properties   map[string]SchemaProperty `json:"properties"`
@@ -89,12 +104,55 @@ type SchemaRegistry interface {
 	Close() error
 }
 
+// SchemaRegistryRefresher is the interface optionally implemented by a SchemaRegistry which can fetch the latest schema
+// again without being recreated.
+type SchemaRegistryRefresher interface {
+	// RefreshLatestSchema fetches the latest schema for all tables and returns it.
+	RefreshLatestSchema() (SchemaMap, error)
+}
+
 // SchemaValidator is the interface for a schema validator.
 type SchemaValidator interface {
 	// Validate the event against the schema. Returns true if a schema is found for the table, true if the event is valid, the path transformed and an error if one occurs.
 	Validate(event DBChangeEvent) (bool, bool, string, error)
 }
 
+// SchemaValidatorStatus is the status of a schema validator.
+type SchemaValidatorStatus struct {
+	LoadedAt *time.Time `json:"loadedAt,omitempty"` // when the rules in effect were loaded
+	Error    string     `json:"error,omitempty"`    // the error of the last reload if it failed and the previous rules are still in effect
+}
+
+// SchemaValidatorWithStatus is the interface optionally implemented by a SchemaValidator which can report its status.
+type SchemaValidatorWithStatus interface {
+	// Status returns the status of the validator.
+	Status() SchemaValidatorStatus
+}
+
+// ValidationAction is the action to take when an event fails a validation rule.
+type ValidationAction string
+
+const (
+	// ValidationActionSkip will skip the event.
+	ValidationActionSkip ValidationAction = "skip"
+	// ValidationActionQuarantine will save the event to the quarantine directory and skip it.
+	ValidationActionQuarantine ValidationAction = "quarantine"
+	// ValidationActionAlert will log the failure but still process the event.
+	ValidationActionAlert ValidationAction = "alert"
+)
+
+// ValidationRuleError is returned by a SchemaValidator when an event fails a validation rule.
+type ValidationRuleError struct {
+	Table   string
+	Rule    string
+	Action  ValidationAction
+	Message string
+}
+
+func (e *ValidationRuleError) Error() string {
+	return "validation rule " + e.Rule + " failed for table " + e.Table + ": " + e.Message
+}
+
 // DatabaseSchema is a map of table names to a map of column names to column types.
 type DatabaseSchema map[string]map[string]string
 
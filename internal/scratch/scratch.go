@@ -0,0 +1,265 @@
+package scratch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// Manager is the shared scratch space for drivers which stage files on disk. All files are kept under a single
+// directory so that anything left behind by a crash or failed batch can be removed at startup.
+type Manager struct {
+	logger   logger.Logger
+	dir      string
+	maxBytes int64
+	key      []byte
+	used     atomic.Int64
+}
+
+var _ internal.ScratchSpace = (*Manager)(nil)
+
+// Allocate returns a new empty directory for staging files.
+func (m *Manager) Allocate(prefix string) (internal.ScratchDir, error) {
+	dir, err := os.MkdirTemp(m.dir, prefix+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating scratch directory: %w", err)
+	}
+	internal.ScratchDirs.Inc()
+	m.logger.Trace("allocated scratch directory: %s", dir)
+	return &Dir{manager: m, path: dir}, nil
+}
+
+// Used returns the number of bytes currently written to scratch space.
+func (m *Manager) Used() int64 {
+	return m.used.Load()
+}
+
+// reserve adds n bytes to the used total or returns false if it would exceed the quota.
+func (m *Manager) reserve(n int64) bool {
+	for {
+		used := m.used.Load()
+		if m.maxBytes > 0 && used+n > m.maxBytes {
+			internal.ScratchQuotaExceeded.Inc()
+			return false
+		}
+		if m.used.CompareAndSwap(used, used+n) {
+			internal.ScratchBytes.Add(float64(n))
+			return true
+		}
+	}
+}
+
+func (m *Manager) release(n int64) {
+	m.used.Add(-n)
+	internal.ScratchBytes.Sub(float64(n))
+}
+
+// cleanup removes anything left in the scratch directory from a previous run.
+func (m *Manager) cleanup() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return fmt.Errorf("error reading scratch directory: %w", err)
+	}
+	var removed int64
+	for _, entry := range entries {
+		fn := filepath.Join(m.dir, entry.Name())
+		size, err := dirSize(fn)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(fn); err != nil {
+			return fmt.Errorf("error removing %s: %w", fn, err)
+		}
+		removed += size
+	}
+	if len(entries) > 0 {
+		internal.ScratchCleanedBytes.Add(float64(removed))
+		m.logger.Info("removed %d leftover scratch entries (%d bytes) from %s", len(entries), removed, m.dir)
+	}
+	return nil
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error calculating size of %s: %w", path, err)
+	}
+	return size, nil
+}
+
+// Dir is a directory allocated from the scratch space.
+type Dir struct {
+	manager *Manager
+	path    string
+	written atomic.Int64
+	once    sync.Once
+}
+
+var _ internal.ScratchDir = (*Dir)(nil)
+
+// Path returns the absolute path to the directory.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Create a new file in the directory which counts against the scratch space quota. An existing file is truncated and
+// its space returned to the quota.
+func (d *Dir) Create(name string) (io.WriteCloser, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid scratch filename: %s", name)
+	}
+	fn := filepath.Join(d.path, name)
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return nil, fmt.Errorf("error creating directory for %s: %w", fn, err)
+	}
+	var existing int64
+	if fi, err := os.Stat(fn); err == nil {
+		existing = fi.Size()
+	}
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating scratch file: %w", err)
+	}
+	if existing > 0 {
+		d.written.Add(-existing)
+		d.manager.release(existing)
+	}
+	w := &file{dir: d, f: f}
+	if d.manager.key == nil {
+		return w, nil
+	}
+	enc, err := util.NewEncryptingWriter(w, d.manager.key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error encrypting scratch file: %w", err)
+	}
+	return &encryptedFile{WriteCloser: enc, f: w}, nil
+}
+
+// Open a file in the directory for reading, decrypting it if the scratch space is encrypted.
+func (d *Dir) Open(name string) (io.ReadCloser, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid scratch filename: %s", name)
+	}
+	f, err := os.Open(filepath.Join(d.path, name))
+	if err != nil {
+		return nil, fmt.Errorf("error opening scratch file: %w", err)
+	}
+	if d.manager.key == nil {
+		return f, nil
+	}
+	r, err := util.NewDecryptingReader(bufio.NewReader(f), d.manager.key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error decrypting scratch file: %w", err)
+	}
+	return &decryptedFile{Reader: r, f: f}, nil
+}
+
+// Release removes the directory and returns its space to the quota.
+func (d *Dir) Release() error {
+	var err error
+	d.once.Do(func() {
+		if rerr := os.RemoveAll(d.path); rerr != nil {
+			err = fmt.Errorf("error removing scratch directory: %w", rerr)
+		}
+		d.manager.release(d.written.Load())
+		internal.ScratchDirs.Dec()
+		d.manager.logger.Trace("released scratch directory: %s", d.path)
+	})
+	return err
+}
+
+type file struct {
+	dir *Dir
+	f   *os.File
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if !f.dir.manager.reserve(int64(len(p))) {
+		return 0, internal.ErrScratchQuotaExceeded
+	}
+	n, err := f.f.Write(p)
+	if unused := len(p) - n; unused > 0 {
+		f.dir.manager.release(int64(unused))
+	}
+	f.dir.written.Add(int64(n))
+	return n, err
+}
+
+func (f *file) Close() error {
+	return f.f.Close()
+}
+
+// encryptedFile writes the last encrypted chunk before closing the file.
+type encryptedFile struct {
+	io.WriteCloser
+	f *file
+}
+
+func (e *encryptedFile) Close() error {
+	err := e.WriteCloser.Close()
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type decryptedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (d *decryptedFile) Close() error {
+	return d.f.Close()
+}
+
+// NewManager creates the scratch space in dir, removing anything left from a previous run. A maxBytes of 0 means no quota.
+// If encrypt is true the files are encrypted with a key which is only kept in memory, which is enough since the files
+// never outlive the process.
+func NewManager(log logger.Logger, dir string, maxBytes int64, encrypt bool) (*Manager, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path for %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(abs, 0700); err != nil {
+		return nil, fmt.Errorf("error creating scratch directory %s: %w", abs, err)
+	}
+	m := &Manager{
+		logger:   log.WithPrefix("[scratch]"),
+		dir:      abs,
+		maxBytes: maxBytes,
+	}
+	if encrypt {
+		key, err := util.NewEncryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		m.key = key
+	}
+	if err := m.cleanup(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,115 @@
+package scratch
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupOnStartup(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "batch-1"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "batch-1", "data.ndjson"), []byte("hello"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "leftover"), []byte("world"), 0600))
+
+	m, err := NewManager(logger.NewTestLogger(), dir, 0, false)
+	assert.NoError(t, err)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, int64(0), m.Used())
+}
+
+func TestAllocateAndRelease(t *testing.T) {
+	m, err := NewManager(logger.NewTestLogger(), t.TempDir(), 0, false)
+	assert.NoError(t, err)
+	d, err := m.Allocate("batch")
+	assert.NoError(t, err)
+	assert.DirExists(t, d.Path())
+
+	w, err := d.Create("order/data.ndjson")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.FileExists(t, filepath.Join(d.Path(), "order", "data.ndjson"))
+	assert.Equal(t, int64(10), m.Used())
+
+	// recreating a file returns the space of the old one
+	w, err = d.Create("order/data.ndjson")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("01234"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, int64(5), m.Used())
+
+	_, err = d.Create("../escape")
+	assert.Error(t, err)
+
+	assert.NoError(t, d.Release())
+	assert.NoError(t, d.Release())
+	assert.NoDirExists(t, d.Path())
+	assert.Equal(t, int64(0), m.Used())
+}
+
+func TestQuota(t *testing.T) {
+	m, err := NewManager(logger.NewTestLogger(), t.TempDir(), 15, false)
+	assert.NoError(t, err)
+	d1, err := m.Allocate("batch")
+	assert.NoError(t, err)
+	d2, err := m.Allocate("batch")
+	assert.NoError(t, err)
+
+	w1, err := d1.Create("a")
+	assert.NoError(t, err)
+	_, err = w1.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+	assert.NoError(t, w1.Close())
+
+	w2, err := d2.Create("b")
+	assert.NoError(t, err)
+	_, err = w2.Write([]byte("0123456789"))
+	assert.ErrorIs(t, err, internal.ErrScratchQuotaExceeded)
+	assert.NoError(t, w2.Close())
+
+	// releasing the first batch frees the space for the second
+	assert.NoError(t, d1.Release())
+	w2, err = d2.Create("b")
+	assert.NoError(t, err)
+	_, err = w2.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+	assert.NoError(t, w2.Close())
+	assert.NoError(t, d2.Release())
+	assert.Equal(t, int64(0), m.Used())
+}
+
+func TestEncrypted(t *testing.T) {
+	m, err := NewManager(logger.NewTestLogger(), t.TempDir(), 0, true)
+	assert.NoError(t, err)
+	d, err := m.Allocate("batch")
+	assert.NoError(t, err)
+	defer d.Release()
+
+	w, err := d.Create("data.ndjson")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	buf, err := os.ReadFile(filepath.Join(d.Path(), "data.ndjson"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(buf), "0123456789")
+	assert.Equal(t, int64(len(buf)), m.Used())
+
+	r, err := d.Open("data.ndjson")
+	assert.NoError(t, err)
+	defer r.Close()
+	buf, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(buf))
+}
@@ -0,0 +1,172 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const cockroachResolvedInterval = "10s"
+
+// cockroachSource reads the changes using a sinkless changefeed. The changes are buffered until a resolved timestamp
+// is received since only then are all the changes before it known to have been emitted. The resolved timestamp is the
+// position which is used as the cursor when the changefeed is restarted.
+type cockroachSource struct {
+	logger logger.Logger
+	db     *sql.DB
+	tables []string
+}
+
+var _ Source = (*cockroachSource)(nil)
+
+func newCockroachSource(ctx context.Context, config Config, u *url.URL) (*cockroachSource, error) {
+	u.Scheme = "postgres"
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to connect to cockroachdb: %w", err)
+	}
+	return &cockroachSource{
+		logger: config.Logger.WithPrefix("[cockroachdb]"),
+		db:     db,
+		tables: config.Tables,
+	}, nil
+}
+
+// changefeedSQL returns the statement to start the changefeed from the cursor or from now if the cursor is empty.
+func (s *cockroachSource) changefeedSQL(cursor string) string {
+	var tables []string
+	for _, table := range s.tables {
+		tables = append(tables, pq.QuoteIdentifier(table))
+	}
+	var sql strings.Builder
+	sql.WriteString("EXPERIMENTAL CHANGEFEED FOR ")
+	sql.WriteString(strings.Join(tables, ", "))
+	sql.WriteString(" WITH updated, diff, resolved = ")
+	sql.WriteString(pq.QuoteLiteral(cockroachResolvedInterval))
+	if cursor != "" {
+		sql.WriteString(", cursor = ")
+		sql.WriteString(pq.QuoteLiteral(cursor))
+	} else {
+		sql.WriteString(", initial_scan = 'no'")
+	}
+	return sql.String()
+}
+
+func (s *cockroachSource) Run(ctx context.Context, position string, handler Handler) error {
+	if position != "" {
+		s.logger.Info("resuming changefeed from %s", position)
+	}
+	rows, err := s.db.QueryContext(ctx, s.changefeedSQL(position))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("error starting changefeed: %w", err)
+	}
+	defer rows.Close()
+	var decoder changefeedDecoder
+	for rows.Next() {
+		var table sql.NullString
+		var key, value []byte
+		if err := rows.Scan(&table, &key, &value); err != nil {
+			return fmt.Errorf("error reading changefeed row: %w", err)
+		}
+		resolved, err := decoder.add(table.String, key, value)
+		if err != nil {
+			return err
+		}
+		if resolved == "" {
+			continue
+		}
+		events := decoder.flush()
+		if len(events) > 0 {
+			if err := handler(ctx, events, resolved); err != nil {
+				return err
+			}
+			s.logger.Debug("published %d changes up to %s", len(events), resolved)
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("error reading changefeed: %w", err)
+	}
+	return nil
+}
+
+func (s *cockroachSource) Close() error {
+	return s.db.Close()
+}
+
+type changefeedValue struct {
+	After    map[string]any `json:"after"`
+	Before   map[string]any `json:"before"`
+	Updated  string         `json:"updated"`
+	Resolved string         `json:"resolved"`
+}
+
+// changefeedDecoder converts the changefeed rows to events and buffers them until the next resolved timestamp.
+type changefeedDecoder struct {
+	pending []internal.DBChangeEvent
+}
+
+// add decodes a changefeed row and returns the timestamp if the row is a resolved timestamp.
+func (d *changefeedDecoder) add(table string, key []byte, value []byte) (string, error) {
+	var val changefeedValue
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&val); err != nil {
+		return "", fmt.Errorf("error decoding changefeed value: %w", err)
+	}
+	if table == "" {
+		return val.Resolved, nil
+	}
+	var keyValues []any
+	dec = json.NewDecoder(bytes.NewReader(key))
+	dec.UseNumber()
+	if err := dec.Decode(&keyValues); err != nil {
+		return "", fmt.Errorf("error decoding changefeed key: %w", err)
+	}
+	var keys []string
+	for _, v := range keyValues {
+		keys = append(keys, keyValue(v))
+	}
+	operation := "UPDATE"
+	switch {
+	case val.After == nil:
+		operation = "DELETE"
+	case val.Before == nil:
+		operation = "INSERT"
+	}
+	// the id is the same if the change is emitted again after a restart so it's deduplicated when published
+	id := table + ":" + strings.Join(keys, ",") + ":" + val.Updated
+	event, err := newEvent(operation, id, table, keys, val.Before, val.After)
+	if err != nil {
+		return "", err
+	}
+	event.MVCCTimestamp = val.Updated
+	event.Timestamp = event.GetVersion().Wall / 1_000_000
+	d.pending = append(d.pending, *event)
+	return "", nil
+}
+
+// flush returns the buffered events ordered by their commit timestamp.
+func (d *changefeedDecoder) flush() []internal.DBChangeEvent {
+	events := d.pending
+	d.pending = nil
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].GetVersion().Compare(events[j].GetVersion()) < 0
+	})
+	return events
+}
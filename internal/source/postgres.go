@@ -0,0 +1,299 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const (
+	defaultSlotName      = "eds_source"
+	postgresPollInterval = time.Second
+	postgresMaxChanges   = 1000
+)
+
+// postgresSource reads the changes from a logical replication slot using the wal2json output plugin. The changes are
+// peeked from the slot and the slot is only advanced once the handler has published them so nothing is lost on restart.
+type postgresSource struct {
+	logger logger.Logger
+	db     *sql.DB
+	slot   string
+	tables []string
+}
+
+var _ Source = (*postgresSource)(nil)
+
+func newPostgresSource(ctx context.Context, config Config, u *url.URL) (*postgresSource, error) {
+	u.Scheme = "postgres"
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to connect to postgres: %w", err)
+	}
+	slot := config.Slot
+	if slot == "" {
+		slot = defaultSlotName
+	}
+	s := &postgresSource{
+		logger: config.Logger.WithPrefix("[postgres]"),
+		db:     db,
+		slot:   slot,
+		tables: config.Tables,
+	}
+	if err := s.createSlot(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// createSlot creates the replication slot if it doesn't already exist.
+func (s *postgresSource) createSlot(ctx context.Context) error {
+	var plugin string
+	err := s.db.QueryRowContext(ctx, "SELECT plugin FROM pg_replication_slots WHERE slot_name = $1", s.slot).Scan(&plugin)
+	if err == nil {
+		if plugin != "wal2json" {
+			return fmt.Errorf("replication slot %s uses the %s plugin, wal2json is required", s.slot, plugin)
+		}
+		s.logger.Debug("using existing replication slot: %s", s.slot)
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error checking replication slot: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "SELECT pg_create_logical_replication_slot($1, 'wal2json')", s.slot); err != nil {
+		return fmt.Errorf("error creating replication slot %s: %w", s.slot, err)
+	}
+	s.logger.Info("created replication slot: %s", s.slot)
+	return nil
+}
+
+// addTables returns the wal2json add-tables option which requires the tables to be schema qualified.
+func (s *postgresSource) addTables() string {
+	var tables []string
+	for _, table := range s.tables {
+		if !strings.Contains(table, ".") {
+			table = "public." + table
+		}
+		tables = append(tables, table)
+	}
+	return strings.Join(tables, ",")
+}
+
+// Run reads the changes from the slot. The position is ignored since the slot records how far the changes were read.
+func (s *postgresSource) Run(ctx context.Context, position string, handler Handler) error {
+	for {
+		read, err := s.poll(ctx, handler)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if read > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(postgresPollInterval):
+		}
+	}
+}
+
+// poll reads the next transactions from the slot, calls the handler and advances the slot. It returns the number of
+// changes read.
+func (s *postgresSource) poll(ctx context.Context, handler Handler) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2,
+		'format-version', '2', 'include-transaction', 'true', 'include-timestamp', 'true', 'include-pk', 'true', 'add-tables', $3)`,
+		s.slot, postgresMaxChanges, s.addTables())
+	if err != nil {
+		return 0, fmt.Errorf("error reading changes from slot %s: %w", s.slot, err)
+	}
+	defer rows.Close()
+	var decoder wal2jsonDecoder
+	var count int
+	for rows.Next() {
+		var lsn string
+		var data []byte
+		if err := rows.Scan(&lsn, &data); err != nil {
+			return 0, fmt.Errorf("error reading change: %w", err)
+		}
+		if err := decoder.add(lsn, data); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error reading changes from slot %s: %w", s.slot, err)
+	}
+	rows.Close()
+	if decoder.position == "" {
+		return count, nil
+	}
+	if len(decoder.events) > 0 {
+		if err := handler(ctx, decoder.events, decoder.position); err != nil {
+			return 0, err
+		}
+		s.logger.Debug("published %d changes up to %s", len(decoder.events), decoder.position)
+	}
+	if _, err := s.db.ExecContext(ctx, "SELECT pg_replication_slot_advance($1, $2::pg_lsn)", s.slot, decoder.position); err != nil {
+		return 0, fmt.Errorf("error advancing slot %s: %w", s.slot, err)
+	}
+	return count, nil
+}
+
+func (s *postgresSource) Close() error {
+	return s.db.Close()
+}
+
+type wal2jsonColumn struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+type wal2jsonChange struct {
+	Action    string           `json:"action"`
+	Timestamp string           `json:"timestamp"`
+	Schema    string           `json:"schema"`
+	Table     string           `json:"table"`
+	Columns   []wal2jsonColumn `json:"columns"`
+	Identity  []wal2jsonColumn `json:"identity"`
+	PK        []wal2jsonColumn `json:"pk"`
+}
+
+// wal2jsonDecoder converts the wal2json format version 2 changes to events. Only the events of committed transactions
+// are kept and the position is the lsn of the last commit.
+type wal2jsonDecoder struct {
+	events    []internal.DBChangeEvent
+	position  string
+	pending   []internal.DBChangeEvent
+	timestamp int64
+}
+
+var postgresTimestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func parsePostgresTimestamp(val string) (time.Time, error) {
+	var err error
+	for _, layout := range postgresTimestampFormats {
+		var ts time.Time
+		if ts, err = time.Parse(layout, val); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func (d *wal2jsonDecoder) add(lsn string, data []byte) error {
+	var change wal2jsonChange
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&change); err != nil {
+		return fmt.Errorf("error decoding change at %s: %w", lsn, err)
+	}
+	switch change.Action {
+	case "B":
+		d.pending = nil
+		d.timestamp = 0
+		if ts, err := parsePostgresTimestamp(change.Timestamp); err == nil {
+			d.timestamp = ts.UnixMilli()
+		}
+	case "C":
+		// the id is the commit lsn with the index of the change so the id is the same if the transaction is read again
+		for i := range d.pending {
+			d.pending[i].ID = fmt.Sprintf("%s-%d", lsn, i)
+		}
+		d.events = append(d.events, d.pending...)
+		d.pending = nil
+		d.position = lsn
+	case "I", "U", "D":
+		event, err := toPostgresEvent(change)
+		if err != nil {
+			return fmt.Errorf("error converting change at %s: %w", lsn, err)
+		}
+		event.Timestamp = d.timestamp
+		d.pending = append(d.pending, *event)
+	}
+	return nil
+}
+
+// postgresValue converts the value to the same JSON the Shopmonkey events use.
+func postgresValue(column wal2jsonColumn) any {
+	val, ok := column.Value.(string)
+	if !ok {
+		return column.Value
+	}
+	switch column.Type {
+	case "json", "jsonb":
+		var v any
+		if err := json.Unmarshal([]byte(val), &v); err == nil {
+			return v
+		}
+	case "timestamp with time zone", "timestamp without time zone", "timestamptz", "timestamp":
+		if ts, err := parsePostgresTimestamp(val); err == nil {
+			return ts.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return val
+}
+
+func toRow(columns []wal2jsonColumn) map[string]any {
+	if len(columns) == 0 {
+		return nil
+	}
+	row := make(map[string]any, len(columns))
+	for _, column := range columns {
+		row[column.Name] = postgresValue(column)
+	}
+	return row
+}
+
+func toPostgresEvent(change wal2jsonChange) (*internal.DBChangeEvent, error) {
+	after := toRow(change.Columns)
+	identity := toRow(change.Identity)
+	var before map[string]any
+	var operation string
+	switch change.Action {
+	case "I":
+		operation = "INSERT"
+	case "U":
+		operation = "UPDATE"
+		// the identity only has every column when the table uses replica identity full
+		if len(change.Identity) == len(change.Columns) {
+			before = identity
+		}
+	case "D":
+		operation = "DELETE"
+		before = identity
+		after = nil
+	}
+	row := after
+	if row == nil {
+		row = identity
+	}
+	var key []string
+	for _, pk := range change.PK {
+		key = append(key, keyValue(row[pk.Name]))
+	}
+	if len(key) == 0 {
+		key = []string{keyValue(row["id"])}
+	}
+	return newEvent(operation, "", change.Table, key, before, after)
+}
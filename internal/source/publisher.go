@@ -0,0 +1,73 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// Publisher publishes the events to the dbchange stream in the same format as Shopmonkey.
+type Publisher struct {
+	js jetstream.JetStream
+
+	// ModelVersion is set on the events which don't have a model version.
+	ModelVersion string
+}
+
+// NewPublisher returns a publisher which publishes with the connection.
+func NewPublisher(nc *nats.Conn, modelVersion string) (*Publisher, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating jetstream: %w", err)
+	}
+	return &Publisher{js: js, ModelVersion: modelVersion}, nil
+}
+
+func subjectToken(val *string) string {
+	if val == nil || *val == "" {
+		return "NONE"
+	}
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(*val)
+}
+
+// Subject returns the subject the event is published to.
+func Subject(event *internal.DBChangeEvent) string {
+	table := event.Table
+	return fmt.Sprintf("dbchange.%s.%s.%s.%s.PUBLIC.2", subjectToken(&table), event.Operation, subjectToken(event.CompanyID), subjectToken(event.LocationID))
+}
+
+// Publish publishes the events and waits for the stream to acknowledge them. The event id is used as the message id so
+// events which are published again after a restart are deduplicated by the stream.
+func (p *Publisher) Publish(ctx context.Context, events []internal.DBChangeEvent) error {
+	futures := make([]jetstream.PubAckFuture, 0, len(events))
+	for i := range events {
+		event := &events[i]
+		if event.ModelVersion == "" {
+			event.ModelVersion = p.ModelVersion
+		}
+		buf, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("error encoding event %s: %w", event.ID, err)
+		}
+		future, err := p.js.PublishAsync(Subject(event), buf, jetstream.WithMsgID(event.ID))
+		if err != nil {
+			return fmt.Errorf("error publishing event %s: %w", event.ID, err)
+		}
+		futures = append(futures, future)
+	}
+	for _, future := range futures {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-future.Ok():
+		case err := <-future.Err():
+			return fmt.Errorf("error publishing event %s: %w", future.Msg().Header.Get(jetstream.MsgIDHeader), err)
+		}
+	}
+	return nil
+}
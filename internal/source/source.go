@@ -0,0 +1,137 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+// Handler is called with the changes of one or more committed transactions in commit order. The position can be passed
+// to Run to resume after the changes once the handler has returned successfully.
+type Handler func(ctx context.Context, events []internal.DBChangeEvent, position string) error
+
+// Source reads the changefeed of a database and converts the changes to dbchange events.
+type Source interface {
+	// Run reads the changes and calls the handler until the context is cancelled or an error occurs. The source only
+	// moves past the changes once the handler has returned without an error.
+	Run(ctx context.Context, position string, handler Handler) error
+
+	// Close releases the resources of the source.
+	Close() error
+}
+
+// Config is the configuration for a source.
+type Config struct {
+	Logger logger.Logger
+
+	// URL is the connection string of the database to read changes from.
+	URL string
+
+	// Tables is the list of tables to read changes from.
+	Tables []string
+
+	// Slot is the name of the logical replication slot for postgres.
+	Slot string
+}
+
+// New returns a source for the database in the url.
+func New(ctx context.Context, config Config) (Source, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source url: %w", err)
+	}
+	if len(config.Tables) == 0 {
+		return nil, fmt.Errorf("at least one table is required")
+	}
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		return newPostgresSource(ctx, config, u)
+	case "cockroach", "cockroachdb", "crdb":
+		return newCockroachSource(ctx, config, u)
+	}
+	return nil, fmt.Errorf("unsupported source: %s. supported sources are postgres and cockroachdb", u.Scheme)
+}
+
+// newEvent returns the dbchange event for a row change. The company and location are taken from the row when present
+// in the same way as the Shopmonkey tables. The diff is only set for updates when the full before row is known.
+func newEvent(operation string, id string, table string, key []string, before map[string]any, after map[string]any) (*internal.DBChangeEvent, error) {
+	event := &internal.DBChangeEvent{
+		Operation: operation,
+		ID:        id,
+		Table:     table,
+		Key:       key,
+	}
+	if operation == "UPDATE" && before != nil && after != nil {
+		event.Diff = diffColumns(before, after)
+	}
+	if before != nil {
+		buf, err := json.Marshal(before)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding before: %w", err)
+		}
+		event.Before = buf
+	}
+	if after != nil {
+		buf, err := json.Marshal(after)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding after: %w", err)
+		}
+		event.After = buf
+	}
+	for _, row := range []map[string]any{after, before} {
+		if row == nil {
+			continue
+		}
+		if val, ok := row["companyId"].(string); ok && event.CompanyID == nil {
+			event.CompanyID = &val
+		}
+		if val, ok := row["locationId"].(string); ok && event.LocationID == nil {
+			event.LocationID = &val
+		}
+	}
+	return event, nil
+}
+
+// diffColumns returns the sorted names of the columns which are different between before and after.
+func diffColumns(before map[string]any, after map[string]any) []string {
+	var diff []string
+	for name, val := range after {
+		prev, ok := before[name]
+		if !ok {
+			diff = append(diff, name)
+			continue
+		}
+		a, _ := json.Marshal(val)
+		b, _ := json.Marshal(prev)
+		if string(a) != string(b) {
+			diff = append(diff, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			diff = append(diff, name)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// keyValue returns the string value of a primary key column.
+func keyValue(val any) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case json.Number:
+		return v.String()
+	}
+	buf, _ := json.Marshal(val)
+	return strings.Trim(string(buf), `"`)
+}
@@ -0,0 +1,142 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWal2jsonDecoder(t *testing.T) {
+	var d wal2jsonDecoder
+	assert.NoError(t, d.add("0/16B3748", []byte(`{"action":"B","timestamp":"2024-05-01 10:20:30.123456+00"}`)))
+	assert.NoError(t, d.add("0/16B3748", []byte(`{"action":"I","schema":"public","table":"order","columns":[{"name":"id","type":"text","value":"1"},{"name":"companyId","type":"text","value":"c1"},{"name":"total","type":"numeric","value":10.5},{"name":"meta","type":"jsonb","value":"{\"a\":1}"}],"pk":[{"name":"id","type":"text"}]}`)))
+	assert.NoError(t, d.add("0/16B3800", []byte(`{"action":"U","schema":"public","table":"order","columns":[{"name":"id","type":"text","value":"1"},{"name":"total","type":"numeric","value":11}],"identity":[{"name":"id","type":"text","value":"1"},{"name":"total","type":"numeric","value":10.5}],"pk":[{"name":"id","type":"text"}]}`)))
+	assert.Empty(t, d.events, "events aren't returned until the commit")
+	assert.NoError(t, d.add("0/16B3900", []byte(`{"action":"C"}`)))
+	assert.NoError(t, d.add("0/16B3950", []byte(`{"action":"B"}`)))
+	assert.NoError(t, d.add("0/16B3950", []byte(`{"action":"D","schema":"public","table":"order","identity":[{"name":"id","type":"text","value":"1"}],"pk":[{"name":"id","type":"text"}]}`)))
+
+	assert.Equal(t, "0/16B3900", d.position)
+	assert.Len(t, d.events, 2)
+
+	insert := d.events[0]
+	assert.Equal(t, "INSERT", insert.Operation)
+	assert.Equal(t, "0/16B3900-0", insert.ID)
+	assert.Equal(t, "order", insert.Table)
+	assert.Equal(t, []string{"1"}, insert.Key)
+	assert.Equal(t, "c1", *insert.CompanyID)
+	assert.Nil(t, insert.LocationID)
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 20, 30, 123456000, time.UTC).UnixMilli(), insert.Timestamp)
+	assert.JSONEq(t, `{"id":"1","companyId":"c1","total":10.5,"meta":{"a":1}}`, string(insert.After))
+	assert.Nil(t, insert.Before)
+
+	update := d.events[1]
+	assert.Equal(t, "UPDATE", update.Operation)
+	assert.Equal(t, "0/16B3900-1", update.ID)
+	assert.Equal(t, []string{"total"}, update.Diff)
+	assert.JSONEq(t, `{"id":"1","total":10.5}`, string(update.Before))
+
+	assert.Len(t, d.pending, 1)
+	assert.Equal(t, "DELETE", d.pending[0].Operation)
+	assert.Nil(t, d.pending[0].After)
+	assert.JSONEq(t, `{"id":"1"}`, string(d.pending[0].Before))
+}
+
+func TestChangefeedDecoder(t *testing.T) {
+	var d changefeedDecoder
+	resolved, err := d.add("order", []byte(`["1"]`), []byte(`{"after":{"id":"1","locationId":"l1","total":2},"before":{"id":"1","locationId":"l1","total":1},"updated":"1700000000000000002.0000000000"}`))
+	assert.NoError(t, err)
+	assert.Empty(t, resolved)
+	_, err = d.add("customer", []byte(`["2"]`), []byte(`{"after":{"id":"2"},"before":null,"updated":"1700000000000000001.0000000000"}`))
+	assert.NoError(t, err)
+	_, err = d.add("customer", []byte(`["3"]`), []byte(`{"after":null,"before":{"id":"3"},"updated":"1700000000000000003.0000000001"}`))
+	assert.NoError(t, err)
+	resolved, err = d.add("", nil, []byte(`{"resolved":"1700000000000000005.0000000000"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "1700000000000000005.0000000000", resolved)
+
+	events := d.flush()
+	assert.Len(t, events, 3)
+	assert.Empty(t, d.pending)
+
+	assert.Equal(t, "INSERT", events[0].Operation)
+	assert.Equal(t, "customer:2:1700000000000000001.0000000000", events[0].ID)
+	assert.Equal(t, int64(1700000000000), events[0].Timestamp)
+
+	assert.Equal(t, "UPDATE", events[1].Operation)
+	assert.Equal(t, []string{"total"}, events[1].Diff)
+	assert.Equal(t, "l1", *events[1].LocationID)
+	assert.Equal(t, "1700000000000000002.0000000000", events[1].MVCCTimestamp)
+
+	assert.Equal(t, "DELETE", events[2].Operation)
+	assert.Equal(t, []string{"3"}, events[2].Key)
+	assert.Nil(t, events[2].After)
+}
+
+func TestChangefeedSQL(t *testing.T) {
+	s := &cockroachSource{tables: []string{"order", "customer"}}
+	assert.Equal(t, `EXPERIMENTAL CHANGEFEED FOR "order", "customer" WITH updated, diff, resolved = '10s', initial_scan = 'no'`, s.changefeedSQL(""))
+	assert.Equal(t, `EXPERIMENTAL CHANGEFEED FOR "order", "customer" WITH updated, diff, resolved = '10s', cursor = '123.0'`, s.changefeedSQL("123.0"))
+}
+
+func TestSubject(t *testing.T) {
+	companyID := "c1"
+	locationID := "l.1"
+	assert.Equal(t, "dbchange.order.INSERT.c1.l_1.PUBLIC.2", Subject(&internal.DBChangeEvent{Table: "order", Operation: "INSERT", CompanyID: &companyID, LocationID: &locationID}))
+	assert.Equal(t, "dbchange.order.DELETE.NONE.NONE.PUBLIC.2", Subject(&internal.DBChangeEvent{Table: "order", Operation: "DELETE"}))
+}
+
+func TestPublish(t *testing.T) {
+	port, err := util.GetFreePort()
+	assert.NoError(t, err)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&opts)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", port))
+	assert.NoError(t, err)
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     "dbchange",
+		Subjects: []string{"dbchange.>"},
+		Storage:  jetstream.MemoryStorage,
+	})
+	assert.NoError(t, err)
+
+	publisher, err := NewPublisher(nc, "v1")
+	assert.NoError(t, err)
+	companyID := "c1"
+	events := []internal.DBChangeEvent{
+		{ID: "1", Operation: "INSERT", Table: "order", Key: []string{"1"}, CompanyID: &companyID, After: json.RawMessage(`{"id":"1"}`)},
+		{ID: "2", Operation: "DELETE", Table: "order", Key: []string{"1"}, CompanyID: &companyID, Before: json.RawMessage(`{"id":"1"}`)},
+	}
+	assert.NoError(t, publisher.Publish(ctx, events))
+	// publishing the same events again is deduplicated by the stream
+	assert.NoError(t, publisher.Publish(ctx, events))
+
+	info, err := stream.Info(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), info.State.Msgs)
+
+	msg, err := stream.GetMsg(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "dbchange.order.INSERT.c1.NONE.PUBLIC.2", msg.Subject)
+	var event internal.DBChangeEvent
+	assert.NoError(t, json.Unmarshal(msg.Data, &event))
+	assert.Equal(t, "v1", event.ModelVersion)
+	assert.Equal(t, "1", event.ID)
+}
@@ -95,11 +95,39 @@ func (t *Tracker) SetKeys(keys []string, value string, expires time.Duration) er
 	return nil
 }
 
-// DeleteKey will delete the key from the database.
+// TouchKey will set the key to the value in the database if it doesn't exist or expires in less than half of expires, so
+// a key which is touched often is only written once in a while. It returns true if the key was written.
+func (t *Tracker) TouchKey(key, value string, expires time.Duration) (bool, error) {
+	var written bool
+	err := t.db.Update(func(tx *buntdb.Tx) error {
+		ttl, err := tx.TTL(key)
+		if err == nil && (expires <= 0 || ttl >= expires/2) {
+			return nil // a key without an expiry has a negative ttl so it's given one
+		}
+		if err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		var opts *buntdb.SetOptions
+		if expires > 0 {
+			opts = &buntdb.SetOptions{Expires: true, TTL: expires}
+		}
+		if _, _, err := tx.Set(key, value, opts); err != nil {
+			return err
+		}
+		written = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to touch key: %w", err)
+	}
+	return written, nil
+}
+
+// DeleteKey will delete the keys from the database, keys which don't exist are ignored.
 func (t *Tracker) DeleteKey(keys ...string) error {
 	return t.db.Update(func(tx *buntdb.Tx) error {
 		for _, key := range keys {
-			if _, err := tx.Delete(key); err != nil {
+			if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
 				return err
 			}
 		}
@@ -107,6 +135,21 @@ func (t *Tracker) DeleteKey(keys ...string) error {
 	})
 }
 
+// GetKeysWithPrefix will return all keys and values with the given prefix from the database.
+func (t *Tracker) GetKeysWithPrefix(prefix string) (map[string]string, error) {
+	res := make(map[string]string)
+	err := t.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(prefix+"*", func(k, v string) bool {
+			res[k] = v
+			return true // continue
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keys: %w", err)
+	}
+	return res, nil
+}
+
 // DeleteKeysWithPrefix will delete all keys with the given prefix from the database.
 func (t *Tracker) DeleteKeysWithPrefix(prefix string) (int, error) {
 	var count int
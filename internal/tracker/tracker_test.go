@@ -38,3 +38,59 @@ func TestTracker(t *testing.T) {
 	assert.Equal(t, "bar", val)
 	assert.NoError(t, tracker.Close())
 }
+
+func TestTrackerKeysWithPrefix(t *testing.T) {
+	tracker, err := NewTracker(TrackerConfig{
+		Logger:  logger.NewTestLogger(),
+		Context: context.Background(),
+		Dir:     t.TempDir(),
+	})
+	assert.NoError(t, err)
+	defer tracker.Close()
+	assert.NoError(t, tracker.SetKeys([]string{"a:1", "a:2", "b:1"}, "x", 0))
+	vals, err := tracker.GetKeysWithPrefix("a:")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a:1": "x", "a:2": "x"}, vals)
+	count, err := tracker.DeleteKeysWithPrefix("a:")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	vals, err = tracker.GetKeysWithPrefix("a:")
+	assert.NoError(t, err)
+	assert.Empty(t, vals)
+}
+
+func TestTrackerTouchKey(t *testing.T) {
+	tracker, err := NewTracker(TrackerConfig{
+		Logger:  logger.NewTestLogger(),
+		Context: context.Background(),
+		Dir:     t.TempDir(),
+	})
+	assert.NoError(t, err)
+	defer tracker.Close()
+	written, err := tracker.TouchKey("a", "1", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, written)
+	written, err = tracker.TouchKey("a", "1", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, written, "not written again until half of the expiry is left")
+	written, err = tracker.TouchKey("a", "1", 3*time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, written, "refreshed when less than half of the expiry is left")
+
+	// a key written without an expiry is given one
+	assert.NoError(t, tracker.SetKey("b", "1", 0))
+	written, err = tracker.TouchKey("b", "1", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, written)
+	written, err = tracker.TouchKey("c", "1", 0)
+	assert.NoError(t, err)
+	assert.True(t, written)
+	written, err = tracker.TouchKey("c", "1", 0)
+	assert.NoError(t, err)
+	assert.False(t, written)
+
+	assert.NoError(t, tracker.DeleteKey("a", "missing"), "missing keys are ignored")
+	ok, _, err := tracker.GetKey("a")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
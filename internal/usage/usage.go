@@ -0,0 +1,170 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/eds/internal/util"
+)
+
+const (
+	prefix           = "usage:"
+	dateFormat       = "2006-01-02"
+	DefaultRetention = time.Hour * 24 * 90 // how long daily rollups are kept in the tracker
+)
+
+// Rollup is the usage for a single company and table for a single day (UTC).
+type Rollup struct {
+	Date      string `json:"date"`
+	CompanyID string `json:"companyId"`
+	Table     string `json:"table"`
+	Events    int64  `json:"events"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type counts struct {
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+type rollupKey struct {
+	date      string
+	companyID string
+	table     string
+}
+
+func (k rollupKey) String() string {
+	return prefix + k.date + ":" + k.companyID + ":" + k.table
+}
+
+func parseRollupKey(key string) (rollupKey, bool) {
+	tok := strings.SplitN(strings.TrimPrefix(key, prefix), ":", 3)
+	if len(tok) != 3 {
+		return rollupKey{}, false
+	}
+	return rollupKey{tok[0], tok[1], tok[2]}, true
+}
+
+// Recorder accumulates usage for delivered events and persists daily rollups in the tracker.
+// Usage is staged until Commit is called so that only events which were successfully delivered are counted.
+type Recorder struct {
+	tracker   *tracker.Tracker
+	retention time.Duration
+	staged    map[rollupKey]*counts
+	lock      sync.Mutex
+	commits   *sync.Mutex // shared by the clones so their commits don't overwrite each other's rollups
+	now       func() time.Time
+}
+
+// Clone returns a recorder which stages its usage separately and commits it to the same rollups, such as for a pipeline
+// which flushes on its own.
+func (r *Recorder) Clone() *Recorder {
+	if r == nil {
+		return nil
+	}
+	return &Recorder{
+		tracker:   r.tracker,
+		retention: r.retention,
+		staged:    make(map[rollupKey]*counts),
+		commits:   r.commits,
+		now:       r.now,
+	}
+}
+
+// Add stages the usage for a single event.
+func (r *Recorder) Add(companyID string, table string, bytes int) {
+	key := rollupKey{r.now().UTC().Format(dateFormat), companyID, table}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c := r.staged[key]
+	if c == nil {
+		c = &counts{}
+		r.staged[key] = c
+	}
+	c.Events++
+	c.Bytes += int64(bytes)
+}
+
+// Discard drops any staged usage, such as when a batch fails to flush.
+func (r *Recorder) Discard() {
+	r.lock.Lock()
+	r.staged = make(map[rollupKey]*counts)
+	r.lock.Unlock()
+}
+
+// Commit adds the staged usage to the daily rollups in the tracker.
+func (r *Recorder) Commit() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.commits.Lock()
+	defer r.commits.Unlock()
+	for key, c := range r.staged {
+		var existing counts
+		found, val, err := r.tracker.GetKey(key.String())
+		if err != nil {
+			return fmt.Errorf("error reading usage: %w", err)
+		}
+		if found {
+			if err := json.Unmarshal([]byte(val), &existing); err != nil {
+				return fmt.Errorf("error decoding usage for %s: %w", key, err)
+			}
+		}
+		existing.Events += c.Events
+		existing.Bytes += c.Bytes
+		if err := r.tracker.SetKey(key.String(), util.JSONStringify(existing), r.retention); err != nil {
+			return fmt.Errorf("error saving usage: %w", err)
+		}
+		delete(r.staged, key)
+	}
+	return nil
+}
+
+// Rollups returns the persisted daily rollups for the number of days including today sorted by date, company and table.
+func (r *Recorder) Rollups(days int) ([]Rollup, error) {
+	if days <= 0 {
+		days = 1
+	}
+	since := r.now().UTC().AddDate(0, 0, -(days - 1)).Format(dateFormat)
+	kv, err := r.tracker.GetKeysWithPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Rollup, 0)
+	for k, v := range kv {
+		key, ok := parseRollupKey(k)
+		if !ok || key.date < since {
+			continue
+		}
+		var c counts
+		if err := json.Unmarshal([]byte(v), &c); err != nil {
+			return nil, fmt.Errorf("error decoding usage for %s: %w", k, err)
+		}
+		res = append(res, Rollup{Date: key.date, CompanyID: key.companyID, Table: key.table, Events: c.Events, Bytes: c.Bytes})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Date != res[j].Date {
+			return res[i].Date < res[j].Date
+		}
+		if res[i].CompanyID != res[j].CompanyID {
+			return res[i].CompanyID < res[j].CompanyID
+		}
+		return res[i].Table < res[j].Table
+	})
+	return res, nil
+}
+
+// NewRecorder returns a new usage recorder which persists to the tracker.
+func NewRecorder(tracker *tracker.Tracker) *Recorder {
+	return &Recorder{
+		tracker:   tracker,
+		retention: DefaultRetention,
+		staged:    make(map[rollupKey]*counts),
+		commits:   &sync.Mutex{},
+		now:       time.Now,
+	}
+}
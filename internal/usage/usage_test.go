@@ -0,0 +1,88 @@
+package usage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	tr, err := tracker.NewTracker(tracker.TrackerConfig{
+		Logger:  logger.NewTestLogger(),
+		Context: context.Background(),
+		Dir:     t.TempDir(),
+	})
+	assert.NoError(t, err)
+	defer tr.Close()
+
+	now := time.Date(2024, 10, 2, 12, 0, 0, 0, time.UTC)
+	recorder := NewRecorder(tr)
+	recorder.now = func() time.Time { return now }
+
+	recorder.Add("1", "order", 100)
+	recorder.Add("1", "order", 50)
+	recorder.Add("2", "customer", 10)
+	assert.NoError(t, recorder.Commit())
+
+	// discarded usage should not be counted
+	recorder.Add("1", "order", 1000)
+	recorder.Discard()
+	assert.NoError(t, recorder.Commit())
+
+	rollups, err := recorder.Rollups(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Rollup{
+		{Date: "2024-10-02", CompanyID: "1", Table: "order", Events: 2, Bytes: 150},
+		{Date: "2024-10-02", CompanyID: "2", Table: "customer", Events: 1, Bytes: 10},
+	}, rollups)
+
+	// the next day gets a new rollup
+	now = now.Add(time.Hour * 24)
+	recorder.Add("1", "order", 5)
+	assert.NoError(t, recorder.Commit())
+
+	rollups, err = recorder.Rollups(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Rollup{{Date: "2024-10-03", CompanyID: "1", Table: "order", Events: 1, Bytes: 5}}, rollups)
+
+	rollups, err = recorder.Rollups(2)
+	assert.NoError(t, err)
+	assert.Len(t, rollups, 3)
+	assert.Equal(t, "2024-10-02", rollups[0].Date)
+	assert.Equal(t, "2024-10-03", rollups[2].Date)
+}
+
+func TestRecorderClone(t *testing.T) {
+	tr, err := tracker.NewTracker(tracker.TrackerConfig{
+		Logger:  logger.NewTestLogger(),
+		Context: context.Background(),
+		Dir:     t.TempDir(),
+	})
+	assert.NoError(t, err)
+	defer tr.Close()
+
+	now := time.Date(2024, 10, 2, 12, 0, 0, 0, time.UTC)
+	recorder := NewRecorder(tr)
+	recorder.now = func() time.Time { return now }
+	a := recorder.Clone()
+	b := recorder.Clone()
+
+	// each clone commits or discards only what it staged
+	a.Add("1", "order", 100)
+	b.Add("1", "order", 1000)
+	assert.NoError(t, a.Commit())
+	b.Discard()
+	b.Add("1", "order", 10)
+	assert.NoError(t, b.Commit())
+
+	rollups, err := recorder.Rollups(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Rollup{{Date: "2024-10-02", CompanyID: "1", Table: "order", Events: 2, Bytes: 110}}, rollups)
+
+	var nilRecorder *Recorder
+	assert.Nil(t, nilRecorder.Clone())
+}
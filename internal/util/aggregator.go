@@ -0,0 +1,82 @@
+package util
+
+import (
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// Aggregator collapses the events received in a window so that only the final state of each key is written.
+// It is intended for append-only destinations where every event would otherwise become a row.
+type Aggregator struct {
+	events   []*internal.DBChangeEvent
+	keys     map[string]int
+	received int
+}
+
+// NewAggregator returns a new Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{keys: make(map[string]int)}
+}
+
+// Add adds the event to the window, collapsing it with any previous event for the same key.
+func (a *Aggregator) Add(event internal.DBChangeEvent) {
+	a.received++
+	key := event.Table + "/" + event.GetPrimaryKey()
+	index, found := a.keys[key]
+	if !found {
+		a.keys[key] = len(a.events)
+		a.events = append(a.events, &event)
+		return
+	}
+	internal.AggregatedEvents.WithLabelValues(event.Table).Inc()
+	prev := a.events[index]
+	if prev == nil {
+		// the key was inserted and deleted earlier in the window
+		a.events[index] = &event
+		return
+	}
+	switch {
+	case prev.Operation == "INSERT" && event.Operation == "DELETE":
+		// the record never existed outside the window so there is nothing to write
+		a.events[index] = nil
+		return
+	case prev.Operation == "INSERT":
+		event.Operation = "INSERT"
+		event.Before = nil
+		event.Diff = nil
+	case event.Operation == "UPDATE":
+		for _, key := range prev.Diff {
+			if !SliceContains(event.Diff, key) {
+				event.Diff = append(event.Diff, key)
+			}
+		}
+		fallthrough
+	default:
+		if prev.Before != nil {
+			event.Before = prev.Before
+		}
+	}
+	a.events[index] = &event
+}
+
+// Events returns the collapsed events in the order their keys were first received.
+func (a *Aggregator) Events() []internal.DBChangeEvent {
+	res := make([]internal.DBChangeEvent, 0, len(a.events))
+	for _, event := range a.events {
+		if event != nil {
+			res = append(res, *event)
+		}
+	}
+	return res
+}
+
+// Received returns the number of events added since the last reset.
+func (a *Aggregator) Received() int {
+	return a.received
+}
+
+// Reset clears the window.
+func (a *Aggregator) Reset() {
+	a.events = nil
+	a.keys = make(map[string]int)
+	a.received = 0
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator()
+	a.Add(internal.DBChangeEvent{ID: "1", Table: "order", Key: []string{"1"}, Operation: "UPDATE", Before: json.RawMessage(`{"v":0}`), After: json.RawMessage(`{"v":1}`), Diff: []string{"a"}})
+	a.Add(internal.DBChangeEvent{ID: "2", Table: "order", Key: []string{"2"}, Operation: "INSERT", After: json.RawMessage(`{"v":1}`)})
+	a.Add(internal.DBChangeEvent{ID: "3", Table: "order", Key: []string{"1"}, Operation: "UPDATE", Before: json.RawMessage(`{"v":1}`), After: json.RawMessage(`{"v":2}`), Diff: []string{"b"}})
+	a.Add(internal.DBChangeEvent{ID: "4", Table: "order", Key: []string{"2"}, Operation: "UPDATE", Before: json.RawMessage(`{"v":1}`), After: json.RawMessage(`{"v":2}`), Diff: []string{"v"}})
+	a.Add(internal.DBChangeEvent{ID: "5", Table: "order", Key: []string{"3"}, Operation: "INSERT", After: json.RawMessage(`{"v":1}`)})
+	a.Add(internal.DBChangeEvent{ID: "6", Table: "order", Key: []string{"3"}, Operation: "DELETE", Before: json.RawMessage(`{"v":1}`)})
+	a.Add(internal.DBChangeEvent{ID: "7", Table: "customer", Key: []string{"1"}, Operation: "DELETE", Before: json.RawMessage(`{"v":1}`)})
+	assert.Equal(t, 7, a.Received())
+
+	events := a.Events()
+	assert.Len(t, events, 3)
+
+	assert.Equal(t, "3", events[0].ID)
+	assert.Equal(t, "UPDATE", events[0].Operation)
+	assert.Equal(t, `{"v":0}`, string(events[0].Before))
+	assert.Equal(t, `{"v":2}`, string(events[0].After))
+	assert.Equal(t, []string{"b", "a"}, events[0].Diff)
+
+	assert.Equal(t, "4", events[1].ID)
+	assert.Equal(t, "INSERT", events[1].Operation)
+	assert.Nil(t, events[1].Before)
+	assert.Nil(t, events[1].Diff)
+	assert.Equal(t, `{"v":2}`, string(events[1].After))
+
+	assert.Equal(t, "7", events[2].ID)
+	assert.Equal(t, "customer", events[2].Table)
+
+	a.Reset()
+	assert.Empty(t, a.Events())
+	assert.Equal(t, 0, a.Received())
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// DecodeBytes decodes a bytes value from the JSON of an event. Bytes are base64 encoded but the \x hex format used by
+// postgres and cockroach is also accepted.
+func DecodeBytes(val string) ([]byte, error) {
+	if hexval, ok := strings.CutPrefix(val, `\x`); ok {
+		buf, err := hex.DecodeString(hexval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex bytes value: %w", err)
+		}
+		return buf, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if buf, err := encoding.DecodeString(val); err == nil {
+			return buf, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid base64 bytes value")
+}
+
+// ToBinaryValue returns the decoded bytes for a binary property so drivers can write it with their binary literal.
+// Other values, and values which can't be decoded, are returned unchanged.
+func ToBinaryValue(val any, prop internal.SchemaProperty) any {
+	str, ok := val.(string)
+	if !ok || !prop.IsBinary() {
+		return val
+	}
+	buf, err := DecodeBytes(str)
+	if err != nil {
+		return val
+	}
+	return buf
+}
+
+// EncodeBinaryValue returns the value of a binary property as the upper case hex string which is the format bulk
+// loaders such as COPY INTO expect for binary columns in CSV files. Other values are returned unchanged.
+func EncodeBinaryValue(val any, prop internal.SchemaProperty) any {
+	if buf, ok := ToBinaryValue(val, prop).([]byte); ok {
+		return strings.ToUpper(hex.EncodeToString(buf))
+	}
+	return val
+}
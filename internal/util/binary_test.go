@@ -0,0 +1,39 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeBytes(t *testing.T) {
+	for _, val := range []string{"aGk=", "aGk", `\x6869`} {
+		buf, err := DecodeBytes(val)
+		assert.NoError(t, err, val)
+		assert.Equal(t, []byte("hi"), buf, val)
+	}
+	buf, err := DecodeBytes("_-8")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0xef}, buf)
+	buf, err = DecodeBytes("")
+	assert.NoError(t, err)
+	assert.Empty(t, buf)
+	_, err = DecodeBytes("not base64!")
+	assert.ErrorContains(t, err, "invalid base64")
+	_, err = DecodeBytes(`\xzz`)
+	assert.ErrorContains(t, err, "invalid hex")
+}
+
+func TestBinaryValue(t *testing.T) {
+	binary := internal.SchemaProperty{Type: "string", Format: "byte"}
+	assert.True(t, binary.IsBinary())
+	assert.True(t, internal.SchemaProperty{Type: "string", Format: "binary"}.IsBinary())
+	assert.False(t, internal.SchemaProperty{Type: "string"}.IsBinary())
+	assert.Equal(t, []byte("hi"), ToBinaryValue("aGk=", binary))
+	assert.Equal(t, "aGk=", ToBinaryValue("aGk=", internal.SchemaProperty{Type: "string"}))
+	assert.Equal(t, "not base64!", ToBinaryValue("not base64!", binary))
+	assert.Nil(t, ToBinaryValue(nil, binary))
+	assert.Equal(t, "6869", EncodeBinaryValue("aGk=", binary))
+	assert.Equal(t, 1.0, EncodeBinaryValue(1.0, binary))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/shopmonkeyus/eds/internal"
@@ -45,3 +46,30 @@ func BuildDBSchemaFromInfoSchema(ctx context.Context, logger logger.Logger, db *
 	logger.Info("refreshed %d tables ddl in %v", len(res), time.Since(start))
 	return res, nil
 }
+
+// MissingColumns returns the columns of each schema which are missing from its table in the database schema keyed by
+// table. Names are compared ignoring case since some databases change the case of unquoted identifiers. Tables which
+// don't exist in the database schema are skipped.
+func MissingColumns(db internal.DatabaseSchema, schemas []*internal.Schema) map[string][]string {
+	tables := make(map[string]map[string]string, len(db))
+	for table, columns := range db {
+		tables[strings.ToLower(table)] = columns
+	}
+	res := make(map[string][]string)
+	for _, schema := range schemas {
+		columns, ok := tables[strings.ToLower(schema.Table)]
+		if !ok {
+			continue
+		}
+		existing := make(map[string]bool, len(columns))
+		for name := range columns {
+			existing[strings.ToLower(name)] = true
+		}
+		for _, name := range schema.Columns() {
+			if !existing[strings.ToLower(name)] {
+				res[schema.Table] = append(res[schema.Table], name)
+			}
+		}
+	}
+	return res
+}
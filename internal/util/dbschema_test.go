@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopmonkeyus/eds/internal"
 	"github.com/shopmonkeyus/go-common/logger"
 	"github.com/stretchr/testify/assert"
 )
@@ -46,3 +47,14 @@ func TestGetCurrentDatabase(t *testing.T) {
 	assert.NotNil(t, res)
 	assert.Equal(t, "test", res)
 }
+
+func TestMissingColumns(t *testing.T) {
+	db := internal.DatabaseSchema{
+		"order":    {"id": "text", "number": "int"},
+		"CUSTOMER": {"ID": "VARCHAR", "NAME": "VARCHAR"},
+	}
+	order := &internal.Schema{Table: "order", Properties: map[string]internal.SchemaProperty{"id": {}, "number": {}, "status": {}, "total": {}}}
+	customer := &internal.Schema{Table: "customer", Properties: map[string]internal.SchemaProperty{"id": {}, "name": {}}}
+	vehicle := &internal.Schema{Table: "vehicle", Properties: map[string]internal.SchemaProperty{"id": {}}}
+	assert.Equal(t, map[string][]string{"order": {"status", "total"}}, MissingColumns(db, []*internal.Schema{order, customer, vehicle}))
+}
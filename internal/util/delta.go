@@ -0,0 +1,120 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+const (
+	// DefaultDeltaSnapshotInterval is the number of changes to a record between full events in delta mode.
+	DefaultDeltaSnapshotInterval = 100
+
+	// deltaMaxRecords is the number of records whose changes since their last full event are tracked. A record which
+	// is evicted gets a full event for its next change.
+	deltaMaxRecords = 100_000
+)
+
+// DeltaHelp is the help for the drivers which support delta events.
+const DeltaHelp = "Add delta=true to the URL to write only the changed fields of an update instead of the full record. A delta has the\nkey, diff, model version and mvcc timestamp of the event with the new values of the changed fields in changes and\ndelta set to true. Inserts, deletes and every snapshot=n (default 100) changes of a record are written as the full event,\nas is the first change of each record after a restart, so the state of a record can be rebuilt from its last full event\nand the deltas after it.\n"
+
+// DeltaEvent is written instead of the full event for an update in delta mode.
+type DeltaEvent struct {
+	Operation     string                     `json:"operation"`
+	ID            string                     `json:"id"`
+	Table         string                     `json:"table"`
+	Key           []string                   `json:"key"`
+	ModelVersion  string                     `json:"modelVersion"`
+	CompanyID     *string                    `json:"companyId,omitempty"`
+	LocationID    *string                    `json:"locationId,omitempty"`
+	UserID        *string                    `json:"userId,omitempty"`
+	Diff          []string                   `json:"diff"`
+	Changes       map[string]json.RawMessage `json:"changes"`
+	Timestamp     int64                      `json:"timestamp"`
+	MVCCTimestamp string                     `json:"mvccTimestamp"`
+	Delta         bool                       `json:"delta"`
+}
+
+// DeltaEncoder replaces updates with a DeltaEvent which only has the changed fields. It counts the changes to each
+// record since its last full event so a full event is written periodically.
+type DeltaEncoder struct {
+	interval int
+	counts   Cache
+}
+
+// NewDeltaEncoder returns an encoder which writes a full event every interval changes of a record.
+func NewDeltaEncoder(ctx context.Context, interval int) *DeltaEncoder {
+	return &DeltaEncoder{
+		interval: interval,
+		counts:   NewLRUCache(ctx, time.Hour, deltaMaxRecords),
+	}
+}
+
+// ParseDeltaEncoder returns an encoder when delta=true is in the query or nil if delta mode isn't enabled. The
+// interval between full events is set with snapshot=n.
+func ParseDeltaEncoder(ctx context.Context, query url.Values) (*DeltaEncoder, error) {
+	if query.Get("delta") != "true" {
+		return nil, nil
+	}
+	interval := DefaultDeltaSnapshotInterval
+	if val := query.Get("snapshot"); val != "" {
+		var err error
+		interval, err = strconv.Atoi(val)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid snapshot: %s", val)
+		}
+	}
+	return NewDeltaEncoder(ctx, interval), nil
+}
+
+// Payload returns the value to write for the event which is either the event or a DeltaEvent.
+func (d *DeltaEncoder) Payload(event internal.DBChangeEvent) (any, error) {
+	key := event.Table + "/" + event.GetPrimaryKey()
+	found, val, _ := d.counts.Get(key)
+	if event.Operation != "UPDATE" || len(event.Diff) == 0 || len(event.After) == 0 || !found || val.(int)+1 >= d.interval {
+		if event.Operation == "DELETE" {
+			d.counts.Set(key, d.interval, 0) // a change after a delete is a new record so it must be written in full
+		} else {
+			d.counts.Set(key, 0, 0)
+		}
+		return event, nil
+	}
+	var after map[string]json.RawMessage
+	if err := json.Unmarshal(event.After, &after); err != nil {
+		return nil, fmt.Errorf("error decoding event %s: %w", event.ID, err)
+	}
+	changes := make(map[string]json.RawMessage, len(event.Diff))
+	for _, name := range event.Diff {
+		if val, ok := after[name]; ok {
+			changes[name] = val
+		} else {
+			changes[name] = json.RawMessage("null")
+		}
+	}
+	d.counts.Set(key, val.(int)+1, 0)
+	return &DeltaEvent{
+		Operation:     event.Operation,
+		ID:            event.ID,
+		Table:         event.Table,
+		Key:           event.Key,
+		ModelVersion:  event.ModelVersion,
+		CompanyID:     event.CompanyID,
+		LocationID:    event.LocationID,
+		UserID:        event.UserID,
+		Diff:          event.Diff,
+		Changes:       changes,
+		Timestamp:     event.Timestamp,
+		MVCCTimestamp: event.MVCCTimestamp,
+		Delta:         true,
+	}, nil
+}
+
+// Close stops tracking the records.
+func (d *DeltaEncoder) Close() error {
+	return d.counts.Close()
+}
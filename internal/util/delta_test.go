@@ -0,0 +1,60 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaEncoder(t *testing.T) {
+	d := NewDeltaEncoder(context.Background(), 3)
+	defer d.Close()
+	update := func(id string) internal.DBChangeEvent {
+		return internal.DBChangeEvent{ID: id, Table: "order", Key: []string{"1"}, Operation: "UPDATE", ModelVersion: "v1", MVCCTimestamp: "1.2", Diff: []string{"status", "notes"}, Before: json.RawMessage(`{"id":"1","status":"open","notes":"x","total":1}`), After: json.RawMessage(`{"id":"1","status":"closed","total":1}`)}
+	}
+
+	// the first change of a record since the start is always full
+	payload, err := d.Payload(update("e1"))
+	assert.NoError(t, err)
+	assert.IsType(t, internal.DBChangeEvent{}, payload)
+
+	payload, err = d.Payload(update("e2"))
+	assert.NoError(t, err)
+	delta, ok := payload.(*DeltaEvent)
+	assert.True(t, ok)
+	assert.True(t, delta.Delta)
+	assert.Equal(t, []string{"1"}, delta.Key)
+	assert.Equal(t, "v1", delta.ModelVersion)
+	assert.Equal(t, "1.2", delta.MVCCTimestamp)
+	assert.JSONEq(t, `{"status":"closed","notes":null}`, JSONStringify(delta.Changes))
+
+	payload, _ = d.Payload(update("e3"))
+	assert.IsType(t, &DeltaEvent{}, payload)
+	// every third change is a full snapshot
+	payload, _ = d.Payload(update("e4"))
+	assert.IsType(t, internal.DBChangeEvent{}, payload)
+	payload, _ = d.Payload(update("e5"))
+	assert.IsType(t, &DeltaEvent{}, payload)
+
+	// a change after a delete is full
+	payload, _ = d.Payload(internal.DBChangeEvent{ID: "e6", Table: "order", Key: []string{"1"}, Operation: "DELETE"})
+	assert.IsType(t, internal.DBChangeEvent{}, payload)
+	payload, _ = d.Payload(update("e7"))
+	assert.IsType(t, internal.DBChangeEvent{}, payload)
+}
+
+func TestParseDeltaEncoder(t *testing.T) {
+	d, err := ParseDeltaEncoder(context.Background(), url.Values{})
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+	d, err = ParseDeltaEncoder(context.Background(), url.Values{"delta": {"true"}, "snapshot": {"10"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, d.interval)
+	d.Close()
+	_, err = ParseDeltaEncoder(context.Background(), url.Values{"delta": {"true"}, "snapshot": {"0"}})
+	assert.ErrorContains(t, err, "invalid snapshot")
+}
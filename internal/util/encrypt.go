@@ -0,0 +1,305 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// EncryptionKeySize is the size of the AES-256 keys used to encrypt files on disk.
+	EncryptionKeySize = 32
+
+	// EncryptedFileExtension is added to the name of files which are encrypted on disk.
+	EncryptedFileExtension = ".enc"
+
+	encryptionChunkSize = 64 * 1024
+	encryptionFinalFlag = 1 << 31
+	encryptionMagic     = "EDSENC01"
+	encryptionPrefixLen = 8
+)
+
+// ErrEncryptionKeyRequired is returned when opening an encrypted file without a key.
+var ErrEncryptionKeyRequired = errors.New("file is encrypted but no encryption key was provided")
+
+// NewEncryptionKey returns a new random key which can be used to encrypt files.
+func NewEncryptionKey() ([]byte, error) {
+	key := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// ParseEncryptionKey parses a hex or base64 encoded 32 byte key.
+func ParseEncryptionKey(val string) ([]byte, error) {
+	val = strings.TrimSpace(val)
+	if key, err := hex.DecodeString(val); err == nil && len(key) == EncryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(val); err == nil && len(key) == EncryptionKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be %d bytes encoded as hex or base64", EncryptionKeySize)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return gcm, nil
+}
+
+// chunkNonce returns the nonce of a chunk which is the random prefix of the file followed by the chunk number.
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, encryptionPrefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixLen:], counter)
+	return nonce
+}
+
+// chunkData returns the additional data of a chunk which marks the last one so a truncated file can't be read.
+func chunkData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type encryptingWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+func (e *encryptingWriter) seal(final bool) error {
+	sealed := e.gcm.Seal(nil, chunkNonce(e.prefix, e.counter), e.buf, chunkData(final))
+	e.counter++
+	e.buf = e.buf[:0]
+	length := uint32(len(sealed))
+	if final {
+		length |= encryptionFinalFlag
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], length)
+	if _, err := e.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, os.ErrClosed
+	}
+	var n int
+	for len(p) > 0 {
+		c := min(len(p), encryptionChunkSize-len(e.buf))
+		e.buf = append(e.buf, p[:c]...)
+		p = p[c:]
+		n += c
+		// only seal a full chunk once there's more data so that the last chunk is always sealed by Close
+		if len(e.buf) == encryptionChunkSize && len(p) > 0 {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk. It doesn't close the underlying writer.
+func (e *encryptingWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+// NewEncryptingWriter returns a writer which encrypts everything written to w with AES-256-GCM in chunks so large
+// files can be encrypted and decrypted as a stream. The writer must be closed to write the last chunk.
+func NewEncryptingWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encryptionPrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	if _, err := w.Write(append([]byte(encryptionMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		gcm:    gcm,
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+type decryptingReader struct {
+	r       io.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte // the decrypted chunk
+	buf     []byte // the unread part of plain
+	sealed  []byte
+	done    bool
+}
+
+func (d *decryptingReader) next() error {
+	var header [4]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF // the last chunk is missing
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	final := length&encryptionFinalFlag != 0
+	length &^= encryptionFinalFlag
+	if length > encryptionChunkSize+uint32(d.gcm.Overhead()) {
+		return fmt.Errorf("invalid encrypted chunk length: %d", length)
+	}
+	if cap(d.sealed) < int(length) {
+		d.sealed = make([]byte, length)
+	}
+	d.sealed = d.sealed[:length]
+	if _, err := io.ReadFull(d.r, d.sealed); err != nil {
+		return err
+	}
+	plain, err := d.gcm.Open(d.plain[:0], chunkNonce(d.prefix, d.counter), d.sealed, chunkData(final))
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %d: %w", d.counter, err)
+	}
+	d.counter++
+	d.plain = plain
+	d.buf = plain
+	d.done = final
+	return nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// NewDecryptingReader returns a reader which decrypts the data written by NewEncryptingWriter.
+func NewDecryptingReader(r io.Reader, key []byte) (io.Reader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptionMagic)+encryptionPrefixLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], []byte(encryptionMagic)) {
+		return nil, fmt.Errorf("invalid encryption header")
+	}
+	return &decryptingReader{
+		r:      r,
+		gcm:    gcm,
+		prefix: header[len(encryptionMagic):],
+	}, nil
+}
+
+// IsEncryptedFile returns true if the file was created with CreateEncryptedFile.
+func IsEncryptedFile(fn string) bool {
+	return strings.HasSuffix(fn, EncryptedFileExtension)
+}
+
+type encryptedFile struct {
+	io.Writer
+	enc io.WriteCloser
+	buf *bufio.Writer
+	f   *os.File
+}
+
+func (e *encryptedFile) Close() error {
+	err := e.enc.Close()
+	if ferr := e.buf.Flush(); err == nil {
+		err = ferr
+	}
+	if ferr := e.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// CreateEncryptedFile creates the file fn with the EncryptedFileExtension added to its name and returns a writer which
+// encrypts everything written to it with key. Closing the writer closes the file.
+func CreateEncryptedFile(fn string, key []byte) (io.WriteCloser, error) {
+	f, err := os.OpenFile(fn+EncryptedFileExtension, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	enc, err := NewEncryptingWriter(buf, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encryptedFile{Writer: enc, enc: enc, buf: buf, f: f}, nil
+}
+
+type decryptedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (d *decryptedFile) Close() error {
+	return d.f.Close()
+}
+
+// OpenFile opens the file for reading, decrypting it with key if its name has the EncryptedFileExtension.
+func OpenFile(fn string, key []byte) (io.ReadCloser, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncryptedFile(fn) {
+		return f, nil
+	}
+	if len(key) == 0 {
+		f.Close()
+		return nil, ErrEncryptionKeyRequired
+	}
+	r, err := NewDecryptingReader(bufio.NewReader(f), key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return &decryptedFile{Reader: r, f: f}, nil
+}
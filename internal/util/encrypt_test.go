@@ -0,0 +1,99 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := NewEncryptionKey()
+	assert.NoError(t, err)
+	for _, size := range []int{0, 10, encryptionChunkSize, encryptionChunkSize*3 + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		var buf bytes.Buffer
+		w, err := NewEncryptingWriter(&buf, key)
+		assert.NoError(t, err)
+		// write in odd sized pieces to cross the chunk boundaries
+		for p := data; len(p) > 0; {
+			n := min(len(p), 1000)
+			_, err := w.Write(p[:n])
+			assert.NoError(t, err)
+			p = p[n:]
+		}
+		assert.NoError(t, w.Close())
+		assert.False(t, size > 0 && bytes.Contains(buf.Bytes(), data))
+
+		r, err := NewDecryptingReader(bytes.NewReader(buf.Bytes()), key)
+		assert.NoError(t, err)
+		out, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, size, len(out))
+		assert.True(t, bytes.Equal(data, out))
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	var buf bytes.Buffer
+	w, err := NewEncryptingWriter(&buf, key)
+	assert.NoError(t, err)
+	_, err = w.Write(bytes.Repeat([]byte("x"), encryptionChunkSize+10))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	other, _ := NewEncryptionKey()
+	r, err := NewDecryptingReader(bytes.NewReader(buf.Bytes()), other)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorContains(t, err, "error decrypting chunk 0")
+
+	// dropping the last chunk must not look like the end of the file
+	truncated := buf.Bytes()[:len(encryptionMagic)+encryptionPrefixLen+4+encryptionChunkSize+16]
+	r, err = NewDecryptingReader(bytes.NewReader(truncated), key)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = NewDecryptingReader(bytes.NewReader([]byte("not encrypted at all")), key)
+	assert.ErrorContains(t, err, "invalid encryption header")
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	parsed, err := ParseEncryptionKey(hex.EncodeToString(key))
+	assert.NoError(t, err)
+	assert.Equal(t, key, parsed)
+	_, err = ParseEncryptionKey("abcd")
+	assert.Error(t, err)
+}
+
+func TestEncryptedFile(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	fn := filepath.Join(t.TempDir(), "order.ndjson.gz")
+	w, err := CreateEncryptedFile(fn, key)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("{\"id\":\"1\"}\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.NoFileExists(t, fn)
+	fi, err := os.Stat(fn + EncryptedFileExtension)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	_, err = OpenFile(fn+EncryptedFileExtension, nil)
+	assert.ErrorIs(t, err, ErrEncryptionKeyRequired)
+	r, err := OpenFile(fn+EncryptedFileExtension, key)
+	assert.NoError(t, err)
+	defer r.Close()
+	buf, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"id\":\"1\"}\n", string(buf))
+}
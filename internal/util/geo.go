@@ -0,0 +1,158 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// GeoColumns are the columns which are mapped to a native geospatial type keyed by table and then column.
+type GeoColumns map[string]map[string]bool
+
+// ParseGeoColumns removes the geo query parameters from the connection url and returns the columns to map to a native
+// geospatial type. Each value is a comma separated list of table.column such as geo=location.coordinates.
+func ParseGeoColumns(urlstr string) (string, GeoColumns, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing url: %w", err)
+	}
+	query := u.Query()
+	if !query.Has("geo") {
+		return urlstr, nil, nil
+	}
+	columns := make(GeoColumns)
+	for _, val := range query["geo"] {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			table, column, ok := strings.Cut(name, ".")
+			if !ok || table == "" || column == "" {
+				return "", nil, fmt.Errorf("invalid geo column: %s (expected table.column)", name)
+			}
+			if columns[table] == nil {
+				columns[table] = make(map[string]bool)
+			}
+			columns[table][column] = true
+		}
+	}
+	query.Del("geo")
+	u.RawQuery = query.Encode()
+	return u.String(), columns, nil
+}
+
+// Apply returns the schema with the geo columns changed to nullable geography properties. The schema is returned as is
+// when the table has no geo columns, otherwise it's a copy so the schema in the registry isn't changed.
+func (g GeoColumns) Apply(schema *internal.Schema) *internal.Schema {
+	if schema == nil || len(g[schema.Table]) == 0 {
+		return schema
+	}
+	res := &internal.Schema{
+		Table:        schema.Table,
+		ModelVersion: schema.ModelVersion,
+		PrimaryKeys:  schema.PrimaryKeys,
+		Required:     schema.Required,
+		Properties:   make(map[string]internal.SchemaProperty, len(schema.Properties)),
+	}
+	for name, prop := range schema.Properties {
+		if g[schema.Table][name] {
+			prop = internal.SchemaProperty{Type: "string", Format: internal.FormatGeography, Nullable: true, Comment: prop.Comment}
+		}
+		res.Properties[name] = prop
+	}
+	return res
+}
+
+// latitudeKeys and longitudeKeys are the names of the properties for an object with a latitude and longitude.
+var (
+	latitudeKeys  = []string{"lat", "latitude"}
+	longitudeKeys = []string{"lng", "lon", "long", "longitude"}
+)
+
+func toCoordinate(val any) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func findCoordinate(object map[string]any, keys []string) (float64, bool) {
+	for _, key := range keys {
+		if val, ok := object[key]; ok {
+			return toCoordinate(val)
+		}
+	}
+	return 0, false
+}
+
+func geoJSONPoint(lat float64, lng float64) (string, bool) {
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return "", false
+	}
+	return JSONStringify(map[string]any{"type": "Point", "coordinates": []float64{lng, lat}}), true
+}
+
+// ToGeoJSON returns the GeoJSON geometry for the value of a geo column. The value can be a GeoJSON geometry or feature,
+// an object with lat and lng (or latitude and longitude) properties, a "lat,lng" string or any of these encoded as a
+// JSON string. It returns false for NULL and for values which aren't recognized.
+func ToGeoJSON(val any) (string, bool) {
+	switch v := val.(type) {
+	case map[string]any:
+		if typ, ok := v["type"].(string); ok {
+			if typ == "Feature" {
+				return ToGeoJSON(v["geometry"])
+			}
+			if _, ok := v["coordinates"]; ok {
+				return JSONStringify(v), true
+			}
+			if _, ok := v["geometries"]; ok && typ == "GeometryCollection" {
+				return JSONStringify(v), true
+			}
+			return "", false
+		}
+		lat, ok := findCoordinate(v, latitudeKeys)
+		if !ok {
+			return "", false
+		}
+		lng, ok := findCoordinate(v, longitudeKeys)
+		if !ok {
+			return "", false
+		}
+		return geoJSONPoint(lat, lng)
+	case string:
+		str := strings.TrimSpace(v)
+		if strings.HasPrefix(str, "{") {
+			var object map[string]any
+			if err := json.Unmarshal([]byte(str), &object); err != nil {
+				return "", false
+			}
+			return ToGeoJSON(object)
+		}
+		latstr, lngstr, ok := strings.Cut(str, ",")
+		if !ok {
+			return "", false
+		}
+		lat, ok := toCoordinate(latstr)
+		if !ok {
+			return "", false
+		}
+		lng, ok := toCoordinate(lngstr)
+		if !ok {
+			return "", false
+		}
+		return geoJSONPoint(lat, lng)
+	}
+	return "", false
+}
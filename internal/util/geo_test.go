@@ -0,0 +1,66 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGeoColumns(t *testing.T) {
+	u, geo, err := ParseGeoColumns("postgres://primary/db?sslmode=disable")
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres://primary/db?sslmode=disable", u)
+	assert.Nil(t, geo)
+
+	u, geo, err = ParseGeoColumns("postgres://primary/db?sslmode=disable&geo=location.coordinates,customer.address&geo=vehicle.lastSeen")
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres://primary/db?sslmode=disable", u)
+	assert.Equal(t, GeoColumns{"location": {"coordinates": true}, "customer": {"address": true}, "vehicle": {"lastSeen": true}}, geo)
+
+	_, _, err = ParseGeoColumns("postgres://primary/db?geo=coordinates")
+	assert.ErrorContains(t, err, "invalid geo column: coordinates")
+}
+
+func TestGeoColumnsApply(t *testing.T) {
+	schema := &internal.Schema{
+		Table:       "location",
+		PrimaryKeys: []string{"id"},
+		Required:    []string{"id", "coordinates"},
+		Properties: map[string]internal.SchemaProperty{
+			"id":          {Type: "string"},
+			"coordinates": {Type: "object"},
+		},
+	}
+	var none GeoColumns
+	assert.Same(t, schema, none.Apply(schema))
+	geo := GeoColumns{"location": {"coordinates": true}}
+	customer := &internal.Schema{Table: "customer"}
+	assert.Same(t, customer, geo.Apply(customer))
+	res := geo.Apply(schema)
+	assert.NotSame(t, schema, res)
+	assert.True(t, res.Properties["coordinates"].IsGeography())
+	assert.True(t, res.Properties["coordinates"].Nullable)
+	assert.Equal(t, internal.SchemaProperty{Type: "string"}, res.Properties["id"])
+	assert.Equal(t, "object", schema.Properties["coordinates"].Type)
+}
+
+func TestToGeoJSON(t *testing.T) {
+	point := `{"coordinates":[-122.4,37.7],"type":"Point"}`
+	for _, val := range []any{
+		map[string]any{"type": "Point", "coordinates": []any{-122.4, 37.7}},
+		map[string]any{"type": "Feature", "geometry": map[string]any{"type": "Point", "coordinates": []any{-122.4, 37.7}}},
+		map[string]any{"lat": 37.7, "lng": -122.4},
+		map[string]any{"latitude": "37.7", "longitude": "-122.4"},
+		`{"lat":37.7,"lon":-122.4}`,
+		"37.7, -122.4",
+	} {
+		geojson, ok := ToGeoJSON(val)
+		assert.True(t, ok, "%v", val)
+		assert.Equal(t, point, geojson)
+	}
+	for _, val := range []any{nil, "", "somewhere", map[string]any{"lat": 37.7}, map[string]any{"lat": 95.0, "lng": 0.0}, map[string]any{"type": "Feature"}, 1.0} {
+		_, ok := ToGeoJSON(val)
+		assert.False(t, ok, "%v", val)
+	}
+}
@@ -1,65 +1,185 @@
 package util
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/shopmonkeyus/eds/internal"
 	"github.com/shopmonkeyus/go-common/logger"
 )
 
 const (
-	defaultTimeout = time.Second * 30
+	defaultTimeout    = time.Second * 30
+	maxRetryAfterWait = time.Minute * 5
 )
 
 type HTTPRetry struct {
-	attempts int
-	started  *time.Time
-	timeout  time.Duration
-	req      *http.Request
-	logger   logger.Logger
+	attempts       int
+	maxAttempts    int
+	started        *time.Time
+	timeout        time.Duration
+	attemptTimeout time.Duration
+	req            *http.Request
+	client         *http.Client
+	logger         logger.Logger
+	retryStatus    func(code int) bool
 }
 
-func (r *HTTPRetry) shouldRetry(resp *http.Response, err error) bool {
-	if err != nil {
-		msg := err.Error()
-		if strings.Contains(msg, "connection reset") || strings.Contains(msg, "connection refused") {
-			return r.started.Add(r.timeout).After(time.Now())
-		}
+// defaultRetryStatus returns true for the status codes which are usually temporary.
+func defaultRetryStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return true
 	}
-	if resp != nil {
-		switch resp.StatusCode {
-		case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
-			io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
-			return true
-		}
+	return false
+}
+
+// RetryServerErrors returns true for all 5xx status codes as well as request timeouts and too many requests.
+func RetryServerErrors(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+func (r *HTTPRetry) shouldRetryError(err error) bool {
+	if r.req.Context().Err() != nil {
+		return false // the caller cancelled the request
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return r.started.Add(r.timeout).After(time.Now())
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "connection reset") || strings.Contains(msg, "connection refused") {
+		return r.started.Add(r.timeout).After(time.Now())
 	}
 	return false
 }
 
+// canReplay returns true if the request body can be sent again.
+func (r *HTTPRetry) canReplay() bool {
+	return r.req.Body == nil || r.req.Body == http.NoBody || r.req.GetBody != nil
+}
+
+// retryAfter returns the delay requested by the server with the Retry-After header as either seconds or a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	val := resp.Header.Get("Retry-After")
+	if val == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if secs, err := strconv.Atoi(val); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if tv, err := http.ParseTime(val); err == nil {
+		wait = time.Until(tv)
+	} else {
+		return 0, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryAfterWait {
+		wait = maxRetryAfterWait
+	}
+	return wait, true
+}
+
+// cancelBody cancels the attempt context once the body has been read.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (r *HTTPRetry) send() (*http.Response, error) {
+	req := r.req
+	if r.attempts > 1 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("error replaying request body: %w", err)
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	cancel := context.CancelFunc(func() {})
+	if r.attemptTimeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), r.attemptTimeout)
+		req = req.WithContext(ctx)
+	}
+	host := req.URL.Host
+	started := time.Now()
+	resp, err := r.client.Do(req)
+	internal.HTTPRequestDuration.WithLabelValues(req.Method, host).Observe(time.Since(started).Seconds())
+	if err != nil {
+		cancel()
+		internal.HTTPRequests.WithLabelValues(req.Method, host, "error").Inc()
+		return nil, err
+	}
+	internal.HTTPRequests.WithLabelValues(req.Method, host, strconv.Itoa(resp.StatusCode)).Inc()
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// Do sends the request, retrying temporary failures until the request succeeds, the max attempts is reached, the timeout
+// for connection failures has passed or the request context is cancelled. The last response is returned when the max
+// attempts is reached with a status which would otherwise be retried.
 func (r *HTTPRetry) Do() (*http.Response, error) {
 	if r.started == nil {
 		tv := time.Now()
 		r.started = &tv
 	}
-	r.attempts++
-	resp, err := http.DefaultClient.Do(r.req)
-	if r.shouldRetry(resp, err) {
-		jitter := time.Duration(time.Millisecond*100 + time.Millisecond*time.Duration(rand.Int63n(int64(500*r.attempts))))
-		if r.logger != nil {
-			var code int
-			if resp != nil {
-				code = resp.StatusCode
+	for {
+		r.attempts++
+		resp, err := r.send()
+		var retry bool
+		var wait time.Duration
+		if err != nil {
+			retry = r.shouldRetryError(err)
+		} else if r.retryStatus(resp.StatusCode) {
+			retry = true
+			if val, ok := retryAfter(resp); ok {
+				wait = val
 			}
-			r.logger.Trace("%s request failed (path: %s) (status: %d), retrying request in %v", r.req.Method, r.req.URL.String(), code, jitter)
 		}
-		time.Sleep(jitter)
-		return r.Do()
+		if !retry || !r.canReplay() || (r.maxAttempts > 0 && r.attempts >= r.maxAttempts) {
+			return resp, err
+		}
+		if wait == 0 {
+			wait = time.Duration(time.Millisecond*100 + time.Millisecond*time.Duration(rand.Int63n(int64(500*r.attempts))))
+		}
+		var code int
+		if resp != nil {
+			code = resp.StatusCode
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if r.logger != nil {
+			r.logger.Trace("%s request failed (path: %s) (status: %d) (attempt: %d), retrying request in %v", r.req.Method, r.req.URL.String(), code, r.attempts, wait)
+		}
+		internal.HTTPRetries.WithLabelValues(r.req.Method, r.req.URL.Host).Inc()
+		select {
+		case <-r.req.Context().Done():
+			return nil, r.req.Context().Err()
+		case <-time.After(wait):
+		}
 	}
-	return resp, err
+}
+
+// Attempts returns the number of attempts made by the last call to Do.
+func (r *HTTPRetry) Attempts() int {
+	return r.attempts
 }
 
 type HTTPRetryOption func(*HTTPRetry)
@@ -71,18 +191,48 @@ func WithLogger(logger logger.Logger) HTTPRetryOption {
 	}
 }
 
-// WithTimeout sets the timeout for the HTTP request.
+// WithTimeout sets how long connection failures are retried.
 func WithTimeout(dur time.Duration) HTTPRetryOption {
 	return func(r *HTTPRetry) {
 		r.timeout = dur
 	}
 }
 
+// WithMaxAttempts sets the maximum number of attempts including the first one. Defaults to 0 which is unlimited.
+func WithMaxAttempts(attempts int) HTTPRetryOption {
+	return func(r *HTTPRetry) {
+		r.maxAttempts = attempts
+	}
+}
+
+// WithAttemptTimeout sets the timeout for each attempt. Defaults to 0 which only uses the request context.
+func WithAttemptTimeout(dur time.Duration) HTTPRetryOption {
+	return func(r *HTTPRetry) {
+		r.attemptTimeout = dur
+	}
+}
+
+// WithClient sets the HTTP client to send the request with. Defaults to http.DefaultClient.
+func WithClient(client *http.Client) HTTPRetryOption {
+	return func(r *HTTPRetry) {
+		r.client = client
+	}
+}
+
+// WithRetryStatus sets the function which decides which status codes are retried.
+func WithRetryStatus(fn func(code int) bool) HTTPRetryOption {
+	return func(r *HTTPRetry) {
+		r.retryStatus = fn
+	}
+}
+
 // NewHTTPRetry creates a new utility for retrying HTTP requests.
 func NewHTTPRetry(req *http.Request, opts ...HTTPRetryOption) *HTTPRetry {
 	retry := HTTPRetry{
-		req:     req,
-		timeout: defaultTimeout,
+		req:         req,
+		timeout:     defaultTimeout,
+		client:      http.DefaultClient,
+		retryStatus: defaultRetryStatus,
 	}
 	for _, opt := range opts {
 		opt(&retry)
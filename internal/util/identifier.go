@@ -0,0 +1,123 @@
+package util
+
+import (
+	"regexp"
+	"strings"
+)
+
+// IdentifierDialect quotes table and column names for a SQL dialect. Quoting escapes the closing quote character so
+// any name, including reserved words and non-ASCII names, is safe to use.
+type IdentifierDialect struct {
+	open     string
+	close    string
+	reserved map[string]bool
+}
+
+// plainIdentifier matches the names which are left unquoted by QuoteIfNeeded. Names with upper case letters, digits,
+// underscores, spaces, punctuation or non-ASCII characters are quoted since they either aren't valid unquoted or their
+// case would be folded by some databases.
+var plainIdentifier = regexp.MustCompile(`^[a-z]+$`)
+
+// Quote always quotes the name.
+func (d IdentifierDialect) Quote(name string) string {
+	return d.open + strings.ReplaceAll(name, d.close, d.close+d.close) + d.close
+}
+
+// QuoteAll quotes each of the names.
+func (d IdentifierDialect) QuoteAll(names []string) []string {
+	res := make([]string, len(names))
+	for i, name := range names {
+		res[i] = d.Quote(name)
+	}
+	return res
+}
+
+// IsReserved returns true if the name is a reserved word in the dialect.
+func (d IdentifierDialect) IsReserved(name string) bool {
+	return d.reserved[strings.ToUpper(name)]
+}
+
+// QuoteIfNeeded quotes the name unless it's plain lower case ASCII letters and isn't a reserved word.
+func (d IdentifierDialect) QuoteIfNeeded(name string) string {
+	if plainIdentifier.MatchString(name) && !d.IsReserved(name) {
+		return name
+	}
+	return d.Quote(name)
+}
+
+func newIdentifierDialect(open string, close string, reserved ...string) IdentifierDialect {
+	d := IdentifierDialect{open: open, close: close, reserved: make(map[string]bool)}
+	for _, words := range append(reserved, commonKeywords) {
+		for _, word := range strings.Fields(words) {
+			d.reserved[word] = true
+		}
+	}
+	return d
+}
+
+// commonKeywords are quoted in every dialect even when they aren't reserved since they're commonly reserved in others
+// or are used as function names.
+const commonKeywords = `USER SELECT INSERT UPDATE DELETE FROM WHERE JOIN LEFT RIGHT INNER HAVING AND OR CREATE DROP ALTER
+TABLE INDEX ON INTO VALUES SET AS DISTINCT TYPE DEFAULT ORDER GROUP LIMIT SUM TOTAL START END BEGIN COMMIT ROLLBACK
+PRIMARY AUTHORIZATION KEY`
+
+// https://www.postgresql.org/docs/current/sql-keywords-appendix.html
+const postgresReserved = `ALL ANALYSE ANALYZE AND ANY ARRAY AS ASC ASYMMETRIC AUTHORIZATION BINARY BOTH CASE CAST CHECK
+COLLATE COLLATION COLUMN CONCURRENTLY CONSTRAINT CREATE CROSS CURRENT_CATALOG CURRENT_DATE CURRENT_ROLE CURRENT_SCHEMA
+CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER DEFAULT DEFERRABLE DESC DISTINCT DO ELSE END EXCEPT FALSE FETCH FOR FOREIGN
+FREEZE FROM FULL GRANT GROUP HAVING ILIKE IN INITIALLY INNER INTERSECT INTO IS ISNULL JOIN LATERAL LEADING LEFT LIKE
+LIMIT LOCALTIME LOCALTIMESTAMP NATURAL NOT NOTNULL NULL OFFSET ON ONLY OR ORDER OUTER OVERLAPS PLACING PRIMARY
+REFERENCES RETURNING RIGHT SELECT SESSION_USER SIMILAR SOME SYMMETRIC SYSTEM_USER TABLE TABLESAMPLE THEN TO TRAILING
+TRUE UNION UNIQUE USER USING VARIADIC VERBOSE WHEN WHERE WINDOW WITH`
+
+// https://dev.mysql.com/doc/refman/8.0/en/keywords.html
+const mysqlReserved = `ACCESSIBLE ADD ALL ALTER ANALYZE AND AS ASC ASENSITIVE BEFORE BETWEEN BIGINT BINARY BLOB BOTH BY
+CALL CASCADE CASE CHANGE CHAR CHARACTER CHECK COLLATE COLUMN CONDITION CONSTRAINT CONTINUE CONVERT CREATE CROSS CUBE
+CUME_DIST CURRENT_DATE CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER CURSOR DATABASE DATABASES DAY_HOUR DAY_MICROSECOND
+DAY_MINUTE DAY_SECOND DEC DECIMAL DECLARE DEFAULT DELAYED DELETE DENSE_RANK DESC DESCRIBE DETERMINISTIC DISTINCT
+DISTINCTROW DIV DOUBLE DROP DUAL EACH ELSE ELSEIF EMPTY ENCLOSED ESCAPED EXCEPT EXISTS EXIT EXPLAIN FALSE FETCH
+FIRST_VALUE FLOAT FLOAT4 FLOAT8 FOR FORCE FOREIGN FROM FULLTEXT FUNCTION GENERATED GET GRANT GROUP GROUPING GROUPS
+HAVING HIGH_PRIORITY HOUR_MICROSECOND HOUR_MINUTE HOUR_SECOND IF IGNORE IN INDEX INFILE INNER INOUT INSENSITIVE INSERT
+INT INT1 INT2 INT3 INT4 INT8 INTEGER INTERSECT INTERVAL INTO IO_AFTER_GTIDS IO_BEFORE_GTIDS IS ITERATE JOIN JSON_TABLE
+KEY KEYS KILL LAG LAST_VALUE LATERAL LEAD LEADING LEAVE LEFT LIKE LIMIT LINEAR LINES LOAD LOCALTIME LOCALTIMESTAMP
+LOCK LONG LONGBLOB LONGTEXT LOOP LOW_PRIORITY MASTER_BIND MASTER_SSL_VERIFY_SERVER_CERT MATCH MAXVALUE MEDIUMBLOB
+MEDIUMINT MEDIUMTEXT MIDDLEINT MINUTE_MICROSECOND MINUTE_SECOND MOD MODIFIES NATURAL NOT NO_WRITE_TO_BINLOG NTH_VALUE
+NTILE NULL NUMERIC OF ON OPTIMIZE OPTIMIZER_COSTS OPTION OPTIONALLY OR ORDER OUT OUTER OUTFILE OVER PARTITION
+PERCENT_RANK PRECISION PRIMARY PROCEDURE PURGE RANGE RANK READ READS READ_WRITE REAL RECURSIVE REFERENCES REGEXP
+RELEASE RENAME REPEAT REPLACE REQUIRE RESIGNAL RESTRICT RETURN REVOKE RIGHT RLIKE ROW ROWS ROW_NUMBER SCHEMA SCHEMAS
+SECOND_MICROSECOND SELECT SENSITIVE SEPARATOR SET SHOW SIGNAL SMALLINT SPATIAL SPECIFIC SQL SQLEXCEPTION SQLSTATE
+SQLWARNING SQL_BIG_RESULT SQL_CALC_FOUND_ROWS SQL_SMALL_RESULT SSL STARTING STORED STRAIGHT_JOIN SYSTEM TABLE
+TERMINATED THEN TINYBLOB TINYINT TINYTEXT TO TRAILING TRIGGER TRUE UNDO UNION UNIQUE UNLOCK UNSIGNED UPDATE USAGE USE
+USING UTC_DATE UTC_TIME UTC_TIMESTAMP VALUES VARBINARY VARCHAR VARCHARACTER VARYING VIRTUAL WHEN WHERE WHILE WINDOW
+WITH WRITE XOR YEAR_MONTH ZEROFILL`
+
+// https://learn.microsoft.com/en-us/sql/t-sql/language-elements/reserved-keywords-transact-sql
+const sqlserverReserved = `ADD ALL ALTER AND ANY AS ASC AUTHORIZATION BACKUP BEGIN BETWEEN BREAK BROWSE BULK BY CASCADE
+CASE CHECK CHECKPOINT CLOSE CLUSTERED COALESCE COLLATE COLUMN COMMIT COMPUTE CONSTRAINT CONTAINS CONTAINSTABLE CONTINUE
+CONVERT CREATE CROSS CURRENT CURRENT_DATE CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER CURSOR DATABASE DBCC DEALLOCATE
+DECLARE DEFAULT DELETE DENY DESC DISK DISTINCT DISTRIBUTED DOUBLE DROP DUMP ELSE END ERRLVL ESCAPE EXCEPT EXEC EXECUTE
+EXISTS EXIT EXTERNAL FETCH FILE FILLFACTOR FOR FOREIGN FREETEXT FREETEXTTABLE FROM FULL FUNCTION GOTO GRANT GROUP
+HAVING HOLDLOCK IDENTITY IDENTITY_INSERT IDENTITYCOL IF IN INDEX INNER INSERT INTERSECT INTO IS JOIN KEY KILL LEFT
+LIKE LINENO LOAD MERGE NATIONAL NOCHECK NONCLUSTERED NOT NULL NULLIF OF OFF OFFSETS ON OPEN OPENDATASOURCE OPENQUERY
+OPENROWSET OPENXML OPTION OR ORDER OUTER OVER PERCENT PIVOT PLAN PRECISION PRIMARY PRINT PROC PROCEDURE PUBLIC
+RAISERROR READ READTEXT RECONFIGURE REFERENCES REPLICATION RESTORE RESTRICT RETURN REVERT REVOKE RIGHT ROLLBACK
+ROWCOUNT ROWGUIDCOL RULE SAVE SCHEMA SECURITYAUDIT SELECT SEMANTICKEYPHRASETABLE SEMANTICSIMILARITYDETAILSTABLE
+SEMANTICSIMILARITYTABLE SESSION_USER SET SETUSER SHUTDOWN SOME STATISTICS SYSTEM_USER TABLE TABLESAMPLE TEXTSIZE THEN
+TO TOP TRAN TRANSACTION TRIGGER TRUNCATE TRY_CONVERT TSEQUAL UNION UNIQUE UNPIVOT UPDATE UPDATETEXT USE USER VALUES
+VARYING VIEW WAITFOR WHEN WHERE WHILE WITH WITHIN WRITETEXT`
+
+var (
+	// PostgresIdentifiers quotes with double quotes.
+	PostgresIdentifiers = newIdentifierDialect(`"`, `"`, postgresReserved)
+	// MySQLIdentifiers quotes with backticks.
+	MySQLIdentifiers = newIdentifierDialect("`", "`", mysqlReserved)
+	// SQLServerIdentifiers quotes with brackets which, unlike double quotes, don't depend on the QUOTED_IDENTIFIER setting.
+	SQLServerIdentifiers = newIdentifierDialect("[", "]", sqlserverReserved)
+	// ANSIIdentifiers quotes with double quotes. It's used for databases such as Snowflake and HANA which upper case
+	// unquoted names so names must always be quoted.
+	ANSIIdentifiers = newIdentifierDialect(`"`, `"`)
+	// DatabricksIdentifiers quotes with backticks. Names should always be quoted.
+	DatabricksIdentifiers = newIdentifierDialect("`", "`")
+	// StarRocksIdentifiers quotes with backticks. It's also used for Apache Doris. Names should always be quoted.
+	StarRocksIdentifiers = newIdentifierDialect("`", "`")
+)
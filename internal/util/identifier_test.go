@@ -0,0 +1,45 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentifierReservedWords(t *testing.T) {
+	for _, tc := range []struct {
+		dialect  IdentifierDialect
+		reserved []string
+		quote    func(string) string
+	}{
+		{PostgresIdentifiers, []string{"user", "order", "offset", "analyze", "returning", "window", "key"}, func(s string) string { return `"` + s + `"` }},
+		{MySQLIdentifiers, []string{"key", "interval", "rank", "range", "usage", "order", "total"}, func(s string) string { return "`" + s + "`" }},
+		{SQLServerIdentifiers, []string{"percent", "top", "merge", "file", "public", "order", "user"}, func(s string) string { return "[" + s + "]" }},
+	} {
+		for _, word := range tc.reserved {
+			assert.True(t, tc.dialect.IsReserved(word), word)
+			assert.Equal(t, tc.quote(word), tc.dialect.QuoteIfNeeded(word))
+		}
+		assert.False(t, tc.dialect.IsReserved("customer"))
+		assert.Equal(t, "customer", tc.dialect.QuoteIfNeeded("customer"))
+	}
+}
+
+func TestIdentifierQuoteIfNeeded(t *testing.T) {
+	assert.Equal(t, `"customerId"`, PostgresIdentifiers.QuoteIfNeeded("customerId"))
+	assert.Equal(t, `"line_item"`, PostgresIdentifiers.QuoteIfNeeded("line_item"))
+	assert.Equal(t, `"café"`, PostgresIdentifiers.QuoteIfNeeded("café"))
+	assert.Equal(t, "`注文`", MySQLIdentifiers.QuoteIfNeeded("注文"))
+	assert.Equal(t, "[número]", SQLServerIdentifiers.QuoteIfNeeded("número"))
+	assert.Equal(t, `"a b"`, PostgresIdentifiers.QuoteIfNeeded("a b"))
+}
+
+func TestIdentifierQuoteEscapes(t *testing.T) {
+	assert.Equal(t, `"a""b"`, PostgresIdentifiers.Quote(`a"b`))
+	assert.Equal(t, "`a``b`", MySQLIdentifiers.Quote("a`b"))
+	assert.Equal(t, "[a]]b]", SQLServerIdentifiers.Quote("a]b"))
+	assert.Equal(t, "[a[b]", SQLServerIdentifiers.Quote("a[b"))
+	assert.Equal(t, `"customer"`, ANSIIdentifiers.Quote("customer"))
+	assert.Equal(t, `"order"`, ANSIIdentifiers.QuoteIfNeeded("order"))
+	assert.Equal(t, []string{"`id`", "`order`"}, DatabricksIdentifiers.QuoteAll([]string{"id", "order"}))
+}
@@ -5,8 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"path/filepath"
+	"strings"
 )
 
 type JSONDecoder interface {
@@ -20,7 +20,7 @@ type JSONDecoder interface {
 }
 
 type ndjsonReader struct {
-	in    *os.File
+	in    io.ReadCloser
 	gr    *gzip.Reader
 	dec   *json.Decoder
 	count int
@@ -58,16 +58,23 @@ func (n *ndjsonReader) Decode(v any) error {
 
 // NewNDJSONDecoder returns a decoder which can be used to read JSON new line delimited files
 func NewNDJSONDecoder(fn string) (JSONDecoder, error) {
-	in, err := os.Open(fn)
+	return NewEncryptedNDJSONDecoder(fn, nil)
+}
+
+// NewEncryptedNDJSONDecoder returns a decoder for a JSON new line delimited file which is decrypted with key if it was
+// created with CreateEncryptedFile.
+func NewEncryptedNDJSONDecoder(fn string, key []byte) (JSONDecoder, error) {
+	in, err := OpenFile(fn, key)
 	if err != nil {
 		return nil, fmt.Errorf("error opening: %s. %w", fn, err)
 	}
 	var i io.Reader = in
 	var gr *gzip.Reader
-	if filepath.Ext(fn) == ".gz" {
+	if filepath.Ext(strings.TrimSuffix(fn, EncryptedFileExtension)) == ".gz" {
 		var err error
 		gr, err = gzip.NewReader(in)
 		if err != nil {
+			in.Close()
 			return nil, fmt.Errorf("gzip: error opening: %s. %w", fn, err)
 		}
 		i = gr
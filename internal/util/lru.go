@@ -0,0 +1,118 @@
+package util
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key     string
+	object  any
+	expires time.Time // zero if the entry doesn't expire
+}
+
+type lruCache struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	entries     map[string]*list.Element
+	order       *list.List // most recently used at the front
+	maxEntries  int
+	mutex       sync.Mutex
+	waitGroup   sync.WaitGroup
+	once        sync.Once
+	expiryCheck time.Duration
+}
+
+var _ Cache = (*lruCache)(nil)
+
+func (c *lruCache) Get(key string) (bool, any, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return false, nil, nil
+	}
+	entry := el.Value.(*lruEntry)
+	if !entry.expires.IsZero() && entry.expires.Before(time.Now()) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return false, nil, nil
+	}
+	c.order.MoveToFront(el)
+	return true, entry.object, nil
+}
+
+// Set a value into the cache. An expiration of 0 or less keeps the value until it's evicted. When the cache is full the
+// least recently used value is evicted.
+func (c *lruCache) Set(key string, val any, expires time.Duration) error {
+	entry := &lruEntry{key: key, object: val}
+	if expires > 0 {
+		entry.expires = time.Now().Add(expires)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+func (c *lruCache) Close() error {
+	c.once.Do(func() {
+		c.cancel()
+		c.waitGroup.Wait()
+	})
+	return nil
+}
+
+func (c *lruCache) run() {
+	defer c.waitGroup.Done()
+	timer := time.NewTicker(c.expiryCheck)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-timer.C:
+			now := time.Now()
+			c.mutex.Lock()
+			for el := c.order.Front(); el != nil; {
+				next := el.Next()
+				entry := el.Value.(*lruEntry)
+				if !entry.expires.IsZero() && entry.expires.Before(now) {
+					c.order.Remove(el)
+					delete(c.entries, entry.key)
+				}
+				el = next
+			}
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// NewLRUCache returns a new Cache implementation which holds at most maxEntries values, evicting the least recently used
+// value when it's full. A maxEntries of 0 or less doesn't limit the size of the cache.
+func NewLRUCache(parent context.Context, expiryCheck time.Duration, maxEntries int) Cache {
+	ctx, cancel := context.WithCancel(parent)
+	c := &lruCache{
+		ctx:         ctx,
+		cancel:      cancel,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+		maxEntries:  maxEntries,
+		expiryCheck: expiryCheck,
+	}
+	c.waitGroup.Add(1)
+	go c.run()
+	return c
+}
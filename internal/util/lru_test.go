@@ -0,0 +1,52 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCacheEvict(t *testing.T) {
+	cache := NewLRUCache(context.Background(), time.Minute, 2)
+	defer cache.Close()
+	assert.NoError(t, cache.Set("a", 1, 0))
+	assert.NoError(t, cache.Set("b", 2, 0))
+	found, val, err := cache.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, val)
+	assert.NoError(t, cache.Set("c", 3, 0))
+	found, _, err = cache.Get("b")
+	assert.NoError(t, err)
+	assert.False(t, found, "b was the least recently used")
+	found, _, _ = cache.Get("a")
+	assert.True(t, found)
+	found, _, _ = cache.Get("c")
+	assert.True(t, found)
+}
+
+func TestLRUCacheExpire(t *testing.T) {
+	cache := NewLRUCache(context.Background(), time.Millisecond*50, 10)
+	defer cache.Close()
+	assert.NoError(t, cache.Set("short", "value", time.Millisecond*10))
+	assert.NoError(t, cache.Set("forever", "value", 0))
+	found, _, _ := cache.Get("short")
+	assert.True(t, found)
+	time.Sleep(time.Millisecond * 11)
+	found, val, err := cache.Get("short")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Nil(t, val)
+
+	assert.NoError(t, cache.Set("background", "value", time.Millisecond*10))
+	time.Sleep(time.Millisecond * 120)
+	c := cache.(*lruCache)
+	c.mutex.Lock()
+	assert.Len(t, c.entries, 1)
+	assert.Equal(t, 1, c.order.Len())
+	c.mutex.Unlock()
+	found, _, _ = cache.Get("forever")
+	assert.True(t, found)
+}
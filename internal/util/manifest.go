@@ -0,0 +1,115 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	manifestVersion = 1
+	manifestDir     = "_manifests"
+)
+
+// ManifestFile is a single object written in a batch.
+type ManifestFile struct {
+	Key       string `json:"key"`
+	Table     string `json:"table"`
+	Records   int    `json:"records"`
+	Size      int    `json:"size"`
+	SHA256    string `json:"sha256"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Manifest describes the objects written in a batch so downstream loaders can verify the batch is complete.
+type Manifest struct {
+	Version      int            `json:"version"`
+	Created      time.Time      `json:"created"`
+	Records      int            `json:"records"`
+	Tables       map[string]int `json:"tables"`
+	MinTimestamp int64          `json:"minTimestamp"`
+	MaxTimestamp int64          `json:"maxTimestamp"`
+	Files        []ManifestFile `json:"files"`
+}
+
+// ManifestBuilder accumulates the objects written in a batch. It is safe to use from multiple goroutines.
+type ManifestBuilder struct {
+	files []ManifestFile
+	lock  sync.Mutex
+}
+
+// Add records an object which was written with the event timestamp (in milliseconds) and contents.
+func (b *ManifestBuilder) Add(key string, table string, timestamp int64, buf []byte) {
+	sum := sha256.Sum256(buf)
+	b.lock.Lock()
+	b.files = append(b.files, ManifestFile{
+		Key:       key,
+		Table:     table,
+		Records:   1,
+		Size:      len(buf),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Timestamp: timestamp,
+	})
+	b.lock.Unlock()
+}
+
+// Len returns the number of objects in the current batch.
+func (b *ManifestBuilder) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.files)
+}
+
+// Reset discards the current batch.
+func (b *ManifestBuilder) Reset() {
+	b.lock.Lock()
+	b.files = nil
+	b.lock.Unlock()
+}
+
+// Build returns the manifest for the current batch and resets the builder.
+func (b *ManifestBuilder) Build(now time.Time) *Manifest {
+	b.lock.Lock()
+	files := b.files
+	b.files = nil
+	b.lock.Unlock()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Key < files[j].Key
+	})
+	m := &Manifest{
+		Version: manifestVersion,
+		Created: now.UTC(),
+		Tables:  make(map[string]int),
+		Files:   files,
+	}
+	for i, f := range files {
+		m.Records += f.Records
+		m.Tables[f.Table] += f.Records
+		if i == 0 || f.Timestamp < m.MinTimestamp {
+			m.MinTimestamp = f.Timestamp
+		}
+		if f.Timestamp > m.MaxTimestamp {
+			m.MaxTimestamp = f.Timestamp
+		}
+	}
+	return m
+}
+
+// SequenceKey returns a deterministic object key for the table and the stream sequence range of the events in the object.
+// The sequences are zero padded so that keys sort in stream order.
+func SequenceKey(prefix string, table string, first uint64, last uint64, ext string) string {
+	if first == last {
+		return path.Join(prefix, table, fmt.Sprintf("%020d%s", first, ext))
+	}
+	return path.Join(prefix, table, fmt.Sprintf("%020d-%020d%s", first, last, ext))
+}
+
+// ManifestKey returns the key for a manifest created at the time, grouped by day under prefix.
+func ManifestKey(prefix string, created time.Time) string {
+	created = created.UTC()
+	return path.Join(prefix, manifestDir, created.Format("2006-01-02"), fmt.Sprintf("%d.json", created.UnixNano()))
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestBuilder(t *testing.T) {
+	var b ManifestBuilder
+	b.Add("order/2.json", "order", 2000, []byte("b"))
+	b.Add("order/1.json", "order", 1000, []byte("a"))
+	b.Add("customer/1.json", "customer", 3000, []byte("c"))
+	assert.Equal(t, 3, b.Len())
+
+	now := time.Date(2024, 7, 13, 16, 50, 0, 0, time.UTC)
+	m := b.Build(now)
+	assert.Equal(t, 0, b.Len())
+	assert.Equal(t, 3, m.Records)
+	assert.Equal(t, map[string]int{"order": 2, "customer": 1}, m.Tables)
+	assert.Equal(t, int64(1000), m.MinTimestamp)
+	assert.Equal(t, int64(3000), m.MaxTimestamp)
+	assert.Equal(t, "customer/1.json", m.Files[0].Key)
+	sum := sha256.Sum256([]byte("a"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), m.Files[1].SHA256)
+	assert.Equal(t, 1, m.Files[1].Size)
+
+	assert.Equal(t, "prefix/_manifests/2024-07-13/1720889400000000000.json", ManifestKey("prefix", now))
+	assert.Equal(t, "_manifests/2024-07-13/1720889400000000000.json", ManifestKey("", now))
+}
+
+func TestSequenceKey(t *testing.T) {
+	assert.Equal(t, "prefix/order/00000000000000000042.json", SequenceKey("prefix", "order", 42, 42, ".json"))
+	assert.Equal(t, "order/00000000000000000001-00000000000000000010.csv", SequenceKey("", "order", 1, 10, ".csv"))
+}
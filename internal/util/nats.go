@@ -8,22 +8,24 @@ import (
 	"github.com/vmihailenco/msgpack/v5"
 )
 
-// DecodeNatsMsg will decode the nats message into the provided interface.
-func DecodeNatsMsg(msg *nats.Msg, v interface{}) error {
-	encoding := msg.Header.Get("content-encoding")
-	gzipped := encoding == "gzip/json"
-	msgpacked := encoding == "msgpack"
-	var err error
-	data := msg.Data
-	if gzipped {
-		data, err = compress.Gunzip(data)
-	} else if msgpacked {
+// DecodeNatsData returns the JSON of the data of a nats message using its content-encoding header.
+func DecodeNatsData(header nats.Header, data []byte) ([]byte, error) {
+	switch header.Get("content-encoding") {
+	case "gzip/json":
+		return compress.Gunzip(data)
+	case "msgpack":
 		var o any
-		err = msgpack.Unmarshal(data, &o)
-		if err == nil {
-			data, err = json.Marshal(o)
+		if err := msgpack.Unmarshal(data, &o); err != nil {
+			return nil, err
 		}
+		return json.Marshal(o)
 	}
+	return data, nil
+}
+
+// DecodeNatsMsg will decode the nats message into the provided interface.
+func DecodeNatsMsg(msg *nats.Msg, v interface{}) error {
+	data, err := DecodeNatsData(msg.Header, msg.Data)
 	if err != nil {
 		return err
 	}
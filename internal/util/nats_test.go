@@ -43,3 +43,19 @@ func TestDecodeNatsMessage(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "test", o["name"])
 }
+
+func TestDecodeNatsData(t *testing.T) {
+	data := []byte(`{"name":"test"}`)
+	buf, err := DecodeNatsData(nil, data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf)
+
+	header := nats.Header{}
+	header.Set("content-encoding", "gzip/json")
+	_, err = DecodeNatsData(header, data)
+	assert.Error(t, err)
+
+	header.Set("content-encoding", "msgpack")
+	_, err = DecodeNatsData(header, []byte{0xc1})
+	assert.Error(t, err)
+}
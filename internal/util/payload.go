@@ -0,0 +1,125 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"text/template"
+
+	"github.com/shopmonkeyus/eds/internal"
+)
+
+// TemplateFuncs are the functions available to the templates which produce JSON.
+var TemplateFuncs = template.FuncMap{
+	"json": func(val any) string {
+		return JSONStringify(val)
+	},
+	"pick": func(obj map[string]any, keys ...string) map[string]any {
+		res := make(map[string]any)
+		for _, key := range keys {
+			if val, ok := obj[key]; ok {
+				res[key] = val
+			}
+		}
+		return res
+	},
+}
+
+// PayloadTemplatesHelp is the help for the drivers which support payload templates.
+const PayloadTemplatesHelp = "Provide a JSON file with templates=/path/to/templates.json to shape the message for each table with a Go template.\nThe file is an object of table name (or * for every other table) to a template which must produce JSON, such as:\n{\"order\": \"{{json (pick .Object \\\"id\\\" \\\"status\\\" \\\"totalCostCents\\\")}}\"}\nThe template is rendered with .Event, .Before, .After and .Object (the after or before for a delete) and the json and pick functions.\n"
+
+// PayloadTemplates shape the message sent for an event with a Go template per table so only the fields a consumer
+// needs are sent. The template for * is used for the tables without a template.
+type PayloadTemplates map[string]*template.Template
+
+// ParsePayloadTemplates removes the templates query parameter from the url and loads the payload templates from the
+// JSON file it refers to. It returns nil templates when the parameter isn't provided.
+func ParsePayloadTemplates(urlstr string) (string, PayloadTemplates, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing url: %w", err)
+	}
+	query := u.Query()
+	if !query.Has("templates") {
+		return urlstr, nil, nil
+	}
+	templates, err := LoadPayloadTemplates(query.Get("templates"))
+	if err != nil {
+		return "", nil, err
+	}
+	query.Del("templates")
+	u.RawQuery = query.Encode()
+	return u.String(), templates, nil
+}
+
+// LoadPayloadTemplates loads the templates from a JSON file which is an object of table name to template.
+func LoadPayloadTemplates(fn string) (PayloadTemplates, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading templates file: %w", err)
+	}
+	var sources map[string]string
+	if err := json.Unmarshal(buf, &sources); err != nil {
+		return nil, fmt.Errorf("error parsing templates file %s: %w", fn, err)
+	}
+	return NewPayloadTemplates(sources)
+}
+
+// NewPayloadTemplates parses the templates keyed by table name.
+func NewPayloadTemplates(sources map[string]string) (PayloadTemplates, error) {
+	templates := make(PayloadTemplates)
+	for table, source := range sources {
+		tmpl, err := template.New(table).Funcs(TemplateFuncs).Option("missingkey=zero").Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload template for %s: %w", table, err)
+		}
+		templates[table] = tmpl
+	}
+	return templates, nil
+}
+
+func decodeObject(buf json.RawMessage) (map[string]any, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	var res map[string]any
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Render returns the payload for the event. The template is rendered with .Event, .Before, .After and .Object which is
+// After or Before for a delete. The event is JSON encoded as is when there is no template for the table.
+func (t PayloadTemplates) Render(event *internal.DBChangeEvent) ([]byte, error) {
+	tmpl := t[event.Table]
+	if tmpl == nil {
+		tmpl = t["*"]
+	}
+	if tmpl == nil {
+		return []byte(JSONStringify(event)), nil
+	}
+	before, err := decodeObject(event.Before)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding before for event %s: %w", event.ID, err)
+	}
+	after, err := decodeObject(event.After)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding after for event %s: %w", event.ID, err)
+	}
+	object := after
+	if object == nil {
+		object = before
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, map[string]any{"Event": event, "Before": before, "After": after, "Object": object}); err != nil {
+		return nil, fmt.Errorf("error rendering payload template for %s: %w", event.Table, err)
+	}
+	res := bytes.TrimSpace(buf.Bytes())
+	if !json.Valid(res) {
+		return nil, fmt.Errorf("payload template for %s didn't produce valid JSON for event %s", event.Table, event.ID)
+	}
+	return res, nil
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadTemplatesRender(t *testing.T) {
+	templates, err := NewPayloadTemplates(map[string]string{
+		"order": `{"id": {{json .Object.id}}, "op": {{json .Event.Operation}}, "totals": {{json (pick .Object "total" "tax")}}}`,
+		"*":     `{{json .Event.ID}}`,
+	})
+	assert.NoError(t, err)
+
+	order := &internal.DBChangeEvent{ID: "e1", Table: "order", Operation: "UPDATE", After: json.RawMessage(`{"id":"1","total":10,"tax":1,"note":"secret"}`)}
+	buf, err := templates.Render(order)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"1","op":"UPDATE","totals":{"total":10,"tax":1}}`, string(buf))
+
+	deleted := &internal.DBChangeEvent{ID: "e2", Table: "order", Operation: "DELETE", Before: json.RawMessage(`{"id":"2"}`)}
+	buf, err = templates.Render(deleted)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"2","op":"DELETE","totals":{}}`, string(buf))
+
+	buf, err = templates.Render(&internal.DBChangeEvent{ID: "e3", Table: "customer"})
+	assert.NoError(t, err)
+	assert.Equal(t, `"e3"`, string(buf))
+
+	var none PayloadTemplates
+	buf, err = none.Render(order)
+	assert.NoError(t, err)
+	assert.Equal(t, JSONStringify(order), string(buf))
+
+	invalid, err := NewPayloadTemplates(map[string]string{"order": `{"note": {{.Object.note}}}`})
+	assert.NoError(t, err)
+	_, err = invalid.Render(order)
+	assert.ErrorContains(t, err, "valid JSON")
+
+	_, err = NewPayloadTemplates(map[string]string{"order": `{{json .Object.id`})
+	assert.Error(t, err)
+}
+
+func TestParsePayloadTemplates(t *testing.T) {
+	u, templates, err := ParsePayloadTemplates("kafka://localhost:9092/topic")
+	assert.NoError(t, err)
+	assert.Equal(t, "kafka://localhost:9092/topic", u)
+	assert.Nil(t, templates)
+
+	fn := filepath.Join(t.TempDir(), "templates.json")
+	assert.NoError(t, os.WriteFile(fn, []byte(`{"order": "{{json .Object.id}}"}`), 0600))
+	u, templates, err = ParsePayloadTemplates("kafka://localhost:9092/topic?templates=" + fn)
+	assert.NoError(t, err)
+	assert.Equal(t, "kafka://localhost:9092/topic", u)
+	assert.Contains(t, templates, "order")
+
+	_, _, err = ParsePayloadTemplates("kafka://localhost:9092/topic?templates=/does/not/exist.json")
+	assert.Error(t, err)
+}
@@ -12,6 +12,7 @@ import (
 
 	js "github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/tracker"
 )
 
 var (
@@ -19,15 +20,18 @@ var (
 )
 
 type SchemaValidator struct {
-	compiler *js.Compiler
-	rules    map[string]*SchemaValidationRule
+	compiler   *js.Compiler
+	rules      map[string]*SchemaValidationRule
+	tracker    *tracker.Tracker
+	references map[string]bool
 }
 
 var _ internal.SchemaValidator = (*SchemaValidator)(nil)
 
 type SchemaValidationRule struct {
-	Schema string `json:"schema"`
-	Path   string `json:"path"`
+	Schema string            `json:"schema"`
+	Path   string            `json:"path"`
+	Rules  []*ValidationRule `json:"rules,omitempty"`
 
 	// internal
 	schema   *js.Schema
@@ -83,6 +87,9 @@ func toSchemaDBChangeEvent(event internal.DBChangeEvent) (*SchemaDBChangeEvent,
 
 // Validate validates the given event against the schema for the table. Returns true if a schema is found for the table, true if the event is valid, the path transformed and an error if one occurs.
 func (v *SchemaValidator) Validate(event internal.DBChangeEvent) (bool, bool, string, error) {
+	if err := v.trackReference(event); err != nil {
+		return false, false, "", fmt.Errorf("error tracking reference: %w", err)
+	}
 	if rule, ok := v.rules[event.Table]; ok {
 		object, err := toSchemaDBChangeEvent(event)
 		if err != nil {
@@ -92,31 +99,54 @@ func (v *SchemaValidator) Validate(event internal.DBChangeEvent) (bool, bool, st
 		if err := json.Unmarshal([]byte(JSONStringify(object)), &o); err != nil {
 			return true, false, "", fmt.Errorf("error converting to SchemaDBChangeEvent: %w", err)
 		}
-		if err := rule.schema.Validate(o); err != nil {
-			if verr, ok := err.(*js.ValidationError); ok {
-				return true, false, "", errors.Join(ErrSchemaValidation, verr)
+		if rule.schema != nil {
+			if err := rule.schema.Validate(o); err != nil {
+				if verr, ok := err.(*js.ValidationError); ok {
+					return true, false, "", errors.Join(ErrSchemaValidation, verr)
+				}
+				return true, false, "", err
 			}
+		}
+		rerr, err := v.checkRules(event.Table, event.Operation, rule, o)
+		if err != nil {
 			return true, false, "", err
 		}
+		if rerr != nil && rerr.Action != internal.ValidationActionAlert {
+			return true, false, "", errors.Join(ErrSchemaValidation, rerr)
+		}
 		var path strings.Builder
 		if rule.template != nil {
 			if err := rule.template.Execute(&path, o); err != nil {
 				return true, false, "", fmt.Errorf("error executing template: %w for %s", err, JSONStringify(o))
 			}
 		}
+		if rerr != nil {
+			return true, true, path.String(), rerr // alert only so the event is still valid
+		}
 		return true, true, path.String(), nil
 	}
 	return false, false, "", nil
 }
 
-// NewSchemaValidator creates a new SchemaValidator from the schema files in the given directory.
-func NewSchemaValidator(schemaDir string) (internal.SchemaValidator, error) {
+type SchemaValidatorOption func(*SchemaValidator)
 
+// WithSchemaValidatorTracker sets the tracker used for reference rules.
+func WithSchemaValidatorTracker(tracker *tracker.Tracker) SchemaValidatorOption {
+	return func(v *SchemaValidator) {
+		v.tracker = tracker
+	}
+}
+
+// NewSchemaValidator creates a new SchemaValidator from the schema files in the given directory.
+func NewSchemaValidator(schemaDir string, opts ...SchemaValidatorOption) (internal.SchemaValidator, error) {
 	abs, err := filepath.Abs(schemaDir)
 	if err != nil {
 		return nil, fmt.Errorf("error getting absolute path for %s: %w", schemaDir, err)
 	}
+	return loadSchemaValidator(abs, opts...)
+}
 
+func loadSchemaValidator(abs string, opts ...SchemaValidatorOption) (*SchemaValidator, error) {
 	config := filepath.Join(abs, "config.json")
 	if !Exists(config) {
 		return nil, fmt.Errorf("config.json not found in schema directory: %s", abs)
@@ -165,16 +195,31 @@ func NewSchemaValidator(schemaDir string) (internal.SchemaValidator, error) {
 		}
 	}
 
+	references := make(map[string]bool)
+
 	for table, rule := range rules {
 		fn := filepath.Join(abs, rule.Schema)
-		if !Exists(fn) {
-			return nil, fmt.Errorf("schema file not found: %s for table: %s", fn, table)
+		if rule.Schema != "" {
+			if !Exists(fn) {
+				return nil, fmt.Errorf("schema file not found: %s for table: %s", fn, table)
+			}
+			schema, err := compiler.Compile("file://" + fn)
+			if err != nil {
+				return nil, fmt.Errorf("error compiling schema: %s for table: %s. %w", fn, table, err)
+			}
+			rule.schema = schema
+		} else if len(rule.Rules) == 0 {
+			return nil, fmt.Errorf("no schema or rules provided for table: %s", table)
 		}
-		schema, err := compiler.Compile("file://" + fn)
-		if err != nil {
-			return nil, fmt.Errorf("error compiling schema: %s for table: %s. %w", fn, table, err)
+
+		for _, r := range rule.Rules {
+			if err := r.init(table); err != nil {
+				return nil, err
+			}
+			if r.Type == ValidationRuleReference {
+				references[r.Table] = true
+			}
 		}
-		rule.schema = schema
 
 		if rule.Path != "" {
 			tmpl, err := template.New(fn).Parse(rule.Path)
@@ -185,8 +230,13 @@ func NewSchemaValidator(schemaDir string) (internal.SchemaValidator, error) {
 		}
 	}
 
-	return &SchemaValidator{
-		compiler: compiler,
-		rules:    rules,
-	}, nil
+	validator := &SchemaValidator{
+		compiler:   compiler,
+		rules:      rules,
+		references: references,
+	}
+	for _, opt := range opts {
+		opt(validator)
+	}
+	return validator, nil
 }
@@ -0,0 +1,236 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+)
+
+const defaultSchemaReloadDebounce = time.Millisecond * 500
+
+// ReloadableSchemaValidator is a SchemaValidator which watches the schema directory and reloads the rules when a file changes.
+// If a reload fails, the previously loaded rules remain in effect.
+type ReloadableSchemaValidator struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    logger.Logger
+	dir       string
+	current   atomic.Pointer[SchemaValidator]
+	watcher   *fsnotify.Watcher
+	debounce  time.Duration
+	opts      []SchemaValidatorOption
+	waitGroup sync.WaitGroup
+	once      sync.Once
+	lock      sync.Mutex
+	status    internal.SchemaValidatorStatus
+}
+
+var _ internal.SchemaValidator = (*ReloadableSchemaValidator)(nil)
+var _ internal.SchemaValidatorWithStatus = (*ReloadableSchemaValidator)(nil)
+
+// Validate validates the given event against the currently loaded schema rules.
+func (v *ReloadableSchemaValidator) Validate(event internal.DBChangeEvent) (bool, bool, string, error) {
+	return v.current.Load().Validate(event)
+}
+
+// Reload will reload the schema rules from the directory.
+func (v *ReloadableSchemaValidator) Reload() error {
+	validator, err := loadSchemaValidator(v.dir, v.opts...)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if err != nil {
+		v.status.Error = err.Error()
+		return err
+	}
+	v.current.Store(validator)
+	now := time.Now()
+	v.status = internal.SchemaValidatorStatus{LoadedAt: &now}
+	return nil
+}
+
+// Status returns when the rules in effect were loaded and the error of the last reload if it failed.
+func (v *ReloadableSchemaValidator) Status() internal.SchemaValidatorStatus {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.status
+}
+
+// Close will stop watching for changes.
+func (v *ReloadableSchemaValidator) Close() error {
+	v.once.Do(func() {
+		v.cancel()
+		v.watcher.Close()
+		v.waitGroup.Wait()
+	})
+	return nil
+}
+
+func (v *ReloadableSchemaValidator) watchDirs() error {
+	return filepath.WalkDir(v.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return v.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (v *ReloadableSchemaValidator) run() {
+	defer v.waitGroup.Done()
+	timer := time.NewTimer(v.debounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-v.ctx.Done():
+			return
+		case event, ok := <-v.watcher.Events:
+			if !ok {
+				return
+			}
+			v.logger.Trace("schema validator file changed: %s (%s)", event.Name, event.Op)
+			if event.Has(fsnotify.Create) {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					if err := v.watcher.Add(event.Name); err != nil {
+						v.logger.Error("error watching schema validator directory: %s. %s", event.Name, err)
+					}
+				}
+			}
+			// editors and remote updates will typically write several files at once so wait for them to settle
+			timer.Reset(v.debounce)
+		case err, ok := <-v.watcher.Errors:
+			if !ok {
+				return
+			}
+			v.logger.Error("error watching schema validator: %s", err)
+		case <-timer.C:
+			if err := v.Reload(); err != nil {
+				v.logger.Error("error reloading schema validator, keeping previous rules: %s", err)
+				continue
+			}
+			v.logger.Info("schema validator reloaded from %s", v.dir)
+		}
+	}
+}
+
+// NewReloadableSchemaValidator creates a new SchemaValidator from the schema files in the given directory which
+// will automatically reload when the files change.
+func NewReloadableSchemaValidator(ctx context.Context, log logger.Logger, schemaDir string, opts ...SchemaValidatorOption) (*ReloadableSchemaValidator, error) {
+	abs, err := filepath.Abs(schemaDir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path for %s: %w", schemaDir, err)
+	}
+	validator, err := loadSchemaValidator(abs, opts...)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema validator watcher: %w", err)
+	}
+	var v ReloadableSchemaValidator
+	v.ctx, v.cancel = context.WithCancel(ctx)
+	v.logger = log.WithPrefix("[schema-validator]")
+	v.dir = abs
+	v.watcher = watcher
+	v.debounce = defaultSchemaReloadDebounce
+	v.opts = opts
+	v.current.Store(validator)
+	now := time.Now()
+	v.status.LoadedAt = &now
+	if err := v.watchDirs(); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("error watching schema directory %s: %w", abs, err)
+	}
+	v.waitGroup.Add(1)
+	go v.run()
+	return &v, nil
+}
+
+// SyncSchemaValidatorFiles writes the schema validator files (relative filename to contents) into dir, removing any
+// files which are no longer present. The files are validated before any changes are made. Returns true if any files changed.
+func SyncSchemaValidatorFiles(dir string, files map[string]string) (bool, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false, fmt.Errorf("error getting absolute path for %s: %w", dir, err)
+	}
+	tmpdir, err := os.MkdirTemp("", "schema-validator-*")
+	if err != nil {
+		return false, fmt.Errorf("error creating temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	for name := range files {
+		if !filepath.IsLocal(name) {
+			return false, fmt.Errorf("invalid schema validator filename: %s", name)
+		}
+	}
+	if err := writeSchemaValidatorFiles(tmpdir, files); err != nil {
+		return false, err
+	}
+	if _, err := loadSchemaValidator(tmpdir); err != nil {
+		return false, fmt.Errorf("invalid schema validator: %w", err)
+	}
+	if err := os.MkdirAll(abs, 0700); err != nil {
+		return false, fmt.Errorf("error creating directory %s: %w", abs, err)
+	}
+	var changed bool
+	existing, err := ListDir(abs)
+	if err != nil {
+		return false, fmt.Errorf("error listing files in %s: %w", abs, err)
+	}
+	for _, fn := range existing {
+		rel, _ := filepath.Rel(abs, fn)
+		if _, ok := files[filepath.ToSlash(rel)]; !ok {
+			if err := os.Remove(fn); err != nil {
+				return false, fmt.Errorf("error removing %s: %w", fn, err)
+			}
+			changed = true
+		}
+	}
+	for name, content := range files {
+		fn := filepath.Join(abs, name)
+		if buf, err := os.ReadFile(fn); err == nil && string(buf) == content {
+			continue
+		}
+		changed = true
+	}
+	if changed {
+		// write the config last so that a reload sees a consistent set of schemas
+		schemas := make(map[string]string)
+		for name, content := range files {
+			if name != "config.json" {
+				schemas[name] = content
+			}
+		}
+		if err := writeSchemaValidatorFiles(abs, schemas); err != nil {
+			return false, err
+		}
+		if err := writeSchemaValidatorFiles(abs, map[string]string{"config.json": files["config.json"]}); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+func writeSchemaValidatorFiles(dir string, files map[string]string) error {
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			return fmt.Errorf("error creating directory for %s: %w", fn, err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0600); err != nil {
+			return fmt.Errorf("error writing %s: %w", fn, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func readTestdataFiles(t *testing.T) map[string]string {
+	abs, err := filepath.Abs("./testdata")
+	assert.NoError(t, err)
+	files, err := ListDir(abs)
+	assert.NoError(t, err)
+	res := make(map[string]string)
+	for _, fn := range files {
+		buf, err := os.ReadFile(fn)
+		assert.NoError(t, err)
+		rel, _ := filepath.Rel(abs, fn)
+		res[filepath.ToSlash(rel)] = string(buf)
+	}
+	return res
+}
+
+func TestSyncSchemaValidatorFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := readTestdataFiles(t)
+
+	changed, err := SyncSchemaValidatorFiles(dir, files)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, Exists(filepath.Join(dir, "config.json")))
+	assert.Contains(t, files, "config.json", "should not modify the input")
+
+	changed, err = SyncSchemaValidatorFiles(dir, files)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// extra files should be removed
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "extra.json"), []byte("{}"), 0600))
+	changed, err = SyncSchemaValidatorFiles(dir, files)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, Exists(filepath.Join(dir, "extra.json")))
+
+	// invalid bundles should not be applied
+	_, err = SyncSchemaValidatorFiles(dir, map[string]string{"config.json": "{\"labor\":{\"schema\":\"missing.json\"}}"})
+	assert.ErrorContains(t, err, "invalid schema validator")
+	assert.True(t, Exists(filepath.Join(dir, "labor_message.json")))
+
+	_, err = SyncSchemaValidatorFiles(dir, map[string]string{"../config.json": "{}"})
+	assert.ErrorContains(t, err, "invalid schema validator filename")
+}
+
+func TestReloadableSchemaValidator(t *testing.T) {
+	dir := t.TempDir()
+	files := readTestdataFiles(t)
+	_, err := SyncSchemaValidatorFiles(dir, files)
+	assert.NoError(t, err)
+
+	validator, err := NewReloadableSchemaValidator(context.Background(), logger.NewTestLogger(), dir)
+	assert.NoError(t, err)
+	defer validator.Close()
+
+	event := internal.DBChangeEvent{Table: "labor", Operation: "DELETE"}
+	found, _, _, _ := validator.Validate(event)
+	assert.True(t, found)
+	assert.NotNil(t, validator.Status().LoadedAt)
+
+	// remove the labor rule and make sure it's picked up
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte("{}"), 0600))
+	assert.Eventually(t, func() bool {
+		found, _, _, _ := validator.Validate(event)
+		return !found
+	}, time.Second*5, time.Millisecond*10)
+
+	// an invalid config should keep the previous rules and report the error
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte("{"), 0600))
+	assert.Eventually(t, func() bool {
+		return validator.Status().Error != ""
+	}, time.Second*5, time.Millisecond*10)
+	found, _, _, err = validator.Validate(event)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(files["config.json"]), 0600))
+	assert.Eventually(t, func() bool {
+		found, _, _, _ := validator.Validate(event)
+		return found
+	}, time.Second*5, time.Millisecond*10)
+	assert.Empty(t, validator.Status().Error)
+}
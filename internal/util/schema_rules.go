@@ -0,0 +1,222 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/tracker"
+)
+
+const (
+	ValidationRuleRequired  = "required"  // the fields must be present and not empty
+	ValidationRuleRange     = "range"     // the numeric field must be within the min and max (inclusive)
+	ValidationRuleReference = "reference" // the field must reference a record in another table which has been seen
+
+	validationReferencePrefix = "validator:ref:"
+	validationReferenceTTL    = 90 * 24 * time.Hour // how long a record is remembered after it was last seen
+)
+
+// ValidationRule is a declarative data quality rule which is checked after the JSON schema for a table.
+type ValidationRule struct {
+	// Name is the name of the rule used when reporting failures. Defaults to the type and field.
+	Name string `json:"name,omitempty"`
+
+	// Type is the type of rule: required, range or reference.
+	Type string `json:"type"`
+
+	// Field is the path to the field to check using dot notation such as after.orderId.
+	Field string `json:"field,omitempty"`
+
+	// Fields is a list of field paths to check for the required rule.
+	Fields []string `json:"fields,omitempty"`
+
+	// Min is the minimum value for the range rule.
+	Min *float64 `json:"min,omitempty"`
+
+	// Max is the maximum value for the range rule.
+	Max *float64 `json:"max,omitempty"`
+
+	// Table is the table which the field references for the reference rule.
+	Table string `json:"table,omitempty"`
+
+	// Operations restricts the rule to specific operations such as INSERT or UPDATE. Defaults to all operations.
+	Operations []string `json:"operations,omitempty"`
+
+	// Action is the action to take when the rule fails: skip, quarantine or alert. Defaults to skip.
+	Action internal.ValidationAction `json:"action,omitempty"`
+}
+
+func (r *ValidationRule) init(table string) error {
+	switch r.Type {
+	case ValidationRuleRequired:
+		if r.Field != "" {
+			r.Fields = append(r.Fields, r.Field)
+		}
+		if len(r.Fields) == 0 {
+			return fmt.Errorf("required rule for table: %s must have at least one field", table)
+		}
+	case ValidationRuleRange:
+		if r.Field == "" {
+			return fmt.Errorf("range rule for table: %s must have a field", table)
+		}
+		if r.Min == nil && r.Max == nil {
+			return fmt.Errorf("range rule for table: %s must have a min or max", table)
+		}
+	case ValidationRuleReference:
+		if r.Field == "" || r.Table == "" {
+			return fmt.Errorf("reference rule for table: %s must have a field and table", table)
+		}
+	default:
+		return fmt.Errorf("unknown validation rule type: %s for table: %s", r.Type, table)
+	}
+	switch r.Action {
+	case "":
+		r.Action = internal.ValidationActionSkip
+	case internal.ValidationActionSkip, internal.ValidationActionQuarantine, internal.ValidationActionAlert:
+	default:
+		return fmt.Errorf("unknown validation action: %s for table: %s", r.Action, table)
+	}
+	if r.Name == "" {
+		r.Name = r.Type
+		if r.Field != "" {
+			r.Name += ":" + r.Field
+		}
+	}
+	return nil
+}
+
+func (r *ValidationRule) appliesTo(operation string) bool {
+	if len(r.Operations) == 0 {
+		return true
+	}
+	for _, op := range r.Operations {
+		if strings.EqualFold(op, operation) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ValidationRule) check(tracker *tracker.Tracker, o map[string]any) (string, error) {
+	switch r.Type {
+	case ValidationRuleRequired:
+		for _, field := range r.Fields {
+			if val, ok := getPathValue(o, field); !ok || isEmptyValue(val) {
+				return fmt.Sprintf("%s is required", field), nil
+			}
+		}
+	case ValidationRuleRange:
+		val, ok := getPathValue(o, r.Field)
+		if !ok || val == nil {
+			return "", nil
+		}
+		num, ok := val.(float64)
+		if !ok {
+			return fmt.Sprintf("%s is not a number", r.Field), nil
+		}
+		if r.Min != nil && num < *r.Min {
+			return fmt.Sprintf("%s value %v is less than %v", r.Field, num, *r.Min), nil
+		}
+		if r.Max != nil && num > *r.Max {
+			return fmt.Sprintf("%s value %v is greater than %v", r.Field, num, *r.Max), nil
+		}
+	case ValidationRuleReference:
+		if tracker == nil {
+			return "", nil
+		}
+		val, ok := getPathValue(o, r.Field)
+		if !ok || val == nil {
+			return "", nil
+		}
+		found, _, err := tracker.GetKey(validationReferenceKey(r.Table, fmt.Sprintf("%v", val)))
+		if err != nil {
+			return "", fmt.Errorf("error checking reference: %w", err)
+		}
+		if !found {
+			return fmt.Sprintf("%s references unknown %s: %v", r.Field, r.Table, val), nil
+		}
+	}
+	return "", nil
+}
+
+func validationReferenceKey(table string, id string) string {
+	return validationReferencePrefix + table + ":" + id
+}
+
+// getPathValue returns the value in the object using dot notation.
+func getPathValue(o map[string]any, path string) (any, bool) {
+	var current any = o
+	for _, part := range strings.Split(path, ".") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func isEmptyValue(val any) bool {
+	switch v := val.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// trackReference records the primary key of events for tables which are referenced by a reference rule so they can be checked.
+// Records which haven't been seen for validationReferenceTTL are forgotten so the tracker doesn't grow without limit.
+func (v *SchemaValidator) trackReference(event internal.DBChangeEvent) error {
+	if v.tracker == nil || !v.references[event.Table] {
+		return nil
+	}
+	pk := event.GetPrimaryKey()
+	if pk == "" {
+		return nil
+	}
+	key := validationReferenceKey(event.Table, pk)
+	if event.Operation == "DELETE" {
+		// a record which was never seen, such as one created before the rule, is deleted like any other
+		return v.tracker.DeleteKey(key)
+	}
+	// the key is only written when it's new or about to expire so the tracker isn't written for every event
+	_, err := v.tracker.TouchKey(key, "1", validationReferenceTTL)
+	return err
+}
+
+// checkRules runs the declarative rules for the table. It returns an error for the first failed rule which isn't an alert
+// or the first failed alert rule if all other rules pass.
+func (v *SchemaValidator) checkRules(table string, operation string, rule *SchemaValidationRule, o map[string]any) (*internal.ValidationRuleError, error) {
+	var alert *internal.ValidationRuleError
+	for _, r := range rule.Rules {
+		if !r.appliesTo(operation) {
+			continue
+		}
+		msg, err := r.check(v.tracker, o)
+		if err != nil {
+			return nil, err
+		}
+		if msg == "" {
+			continue
+		}
+		rerr := &internal.ValidationRuleError{Table: table, Rule: r.Name, Action: r.Action, Message: msg}
+		if r.Action != internal.ValidationActionAlert {
+			return rerr, nil
+		}
+		if alert == nil {
+			alert = rerr
+		}
+	}
+	return alert, nil
+}
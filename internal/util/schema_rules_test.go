@@ -0,0 +1,120 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopmonkeyus/eds/internal"
+	"github.com/shopmonkeyus/eds/internal/tracker"
+	"github.com/shopmonkeyus/go-common/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+const testValidationRulesConfig = `{
+	"order": {
+		"rules": [
+			{"type": "required", "fields": ["after.number", "after.customerId"], "operations": ["INSERT", "UPDATE"]},
+			{"type": "range", "field": "after.total", "min": 0, "max": 1000, "action": "quarantine"},
+			{"name": "customer-exists", "type": "reference", "field": "after.customerId", "table": "customer", "action": "alert"}
+		]
+	},
+	"customer": {
+		"rules": [
+			{"type": "required", "field": "after.id", "operations": ["INSERT"]}
+		]
+	}
+}`
+
+func newRulesValidator(t *testing.T, config string, tr *tracker.Tracker) (internal.SchemaValidator, error) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+	return NewSchemaValidator(dir, WithSchemaValidatorTracker(tr))
+}
+
+func TestValidationRules(t *testing.T) {
+	tr, err := tracker.NewTracker(tracker.TrackerConfig{
+		Logger:  logger.NewTestLogger(),
+		Context: context.Background(),
+		Dir:     t.TempDir(),
+	})
+	assert.NoError(t, err)
+	defer tr.Close()
+
+	validator, err := newRulesValidator(t, testValidationRulesConfig, tr)
+	assert.NoError(t, err)
+
+	order := func(after map[string]any) internal.DBChangeEvent {
+		return internal.DBChangeEvent{Table: "order", Operation: "INSERT", After: json.RawMessage(JSONStringify(after))}
+	}
+
+	// missing required field
+	found, valid, _, err := validator.Validate(order(map[string]any{"number": "", "customerId": "1"}))
+	assert.True(t, found)
+	assert.False(t, valid)
+	assert.True(t, errors.Is(err, ErrSchemaValidation))
+	var rerr *internal.ValidationRuleError
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, internal.ValidationActionSkip, rerr.Action)
+	assert.Equal(t, "required", rerr.Rule)
+
+	// out of range
+	found, valid, _, err = validator.Validate(order(map[string]any{"number": "1", "customerId": "1", "total": 1001}))
+	assert.True(t, found)
+	assert.False(t, valid)
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, internal.ValidationActionQuarantine, rerr.Action)
+	assert.Equal(t, "range:after.total", rerr.Rule)
+
+	// unknown reference only alerts
+	found, valid, _, err = validator.Validate(order(map[string]any{"number": "1", "customerId": "1", "total": 10}))
+	assert.True(t, found)
+	assert.True(t, valid)
+	assert.False(t, errors.Is(err, ErrSchemaValidation))
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, internal.ValidationActionAlert, rerr.Action)
+	assert.Equal(t, "customer-exists", rerr.Rule)
+
+	// once the customer is seen the reference is valid
+	found, valid, _, err = validator.Validate(internal.DBChangeEvent{Table: "customer", Operation: "INSERT", Key: []string{"1"}, After: json.RawMessage(`{"id":"1"}`)})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, valid)
+	found, valid, _, err = validator.Validate(order(map[string]any{"number": "1", "customerId": "1", "total": 10}))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, valid)
+
+	// delete removes the reference
+	_, _, _, err = validator.Validate(internal.DBChangeEvent{Table: "customer", Operation: "DELETE", Key: []string{"1"}, Before: json.RawMessage(`{"id":"1"}`)})
+	assert.NoError(t, err)
+	_, _, _, err = validator.Validate(order(map[string]any{"number": "1", "customerId": "1", "total": 10}))
+	assert.True(t, errors.As(err, &rerr))
+
+	// a delete of a record which was never seen isn't an error
+	found, valid, _, err = validator.Validate(internal.DBChangeEvent{Table: "customer", Operation: "DELETE", Key: []string{"2"}, Before: json.RawMessage(`{"id":"2"}`)})
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// rules restricted by operation
+	found, valid, _, err = validator.Validate(internal.DBChangeEvent{Table: "order", Operation: "DELETE", Before: json.RawMessage(`{"id":"1"}`)})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, valid)
+}
+
+func TestValidationRulesInvalidConfig(t *testing.T) {
+	_, err := newRulesValidator(t, `{"order": {"rules": [{"type": "foo"}]}}`, nil)
+	assert.ErrorContains(t, err, "unknown validation rule type: foo")
+	_, err = newRulesValidator(t, `{"order": {"rules": [{"type": "required", "field": "after.id", "action": "foo"}]}}`, nil)
+	assert.ErrorContains(t, err, "unknown validation action: foo")
+	_, err = newRulesValidator(t, `{"order": {"rules": [{"type": "range", "field": "after.id"}]}}`, nil)
+	assert.ErrorContains(t, err, "must have a min or max")
+	_, err = newRulesValidator(t, `{"order": {"rules": [{"type": "reference", "field": "after.id"}]}}`, nil)
+	assert.ErrorContains(t, err, "must have a field and table")
+	_, err = newRulesValidator(t, `{"order": {}}`, nil)
+	assert.ErrorContains(t, err, "no schema or rules provided")
+}
@@ -3,9 +3,15 @@ package util
 import (
 	"context"
 	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
 	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/shopmonkeyus/eds/internal"
 	"github.com/shopmonkeyus/go-common/logger"
@@ -13,16 +19,12 @@ import (
 
 // QuoteIdentifier quotes an identifier with double quotes
 func QuoteIdentifier(name string) string {
-	return `"` + name + `"`
+	return ANSIIdentifiers.Quote(name)
 }
 
 // QuoteStringIdentifiers quotes a slice of identifiers with double quotes
 func QuoteStringIdentifiers(vals []string) []string {
-	res := make([]string, len(vals))
-	for i, val := range vals {
-		res[i] = QuoteIdentifier(val)
-	}
-	return res
+	return ANSIIdentifiers.QuoteAll(vals)
 }
 
 // SQLExecuter returns a wrapper around a SQL database connection that can execute SQL statements or log them in dry-run mode
@@ -92,3 +94,240 @@ func DropTable(ctx context.Context, logger logger.Logger, db *sql.DB, table stri
 	}
 	return nil
 }
+
+// SplitReadURL removes the readURL query parameter from the connection url and returns the url for writes and the url for
+// reads from a read replica. The read url is empty when not provided and inherits the credentials of the url when it has none.
+func SplitReadURL(urlstr string) (string, string, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing url: %w", err)
+	}
+	query := u.Query()
+	readstr := query.Get("readURL")
+	if readstr == "" {
+		return urlstr, "", nil
+	}
+	query.Del("readURL")
+	u.RawQuery = query.Encode()
+	ru, err := url.Parse(readstr)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing readURL: %w", err)
+	}
+	if ru.Scheme != u.Scheme || ru.Host == "" {
+		return "", "", fmt.Errorf("readURL must be a %s url", u.Scheme)
+	}
+	if ru.User == nil {
+		ru.User = u.User
+	}
+	return u.String(), ru.String(), nil
+}
+
+// OpenWithReadReplica opens the database for the url and, when the url has a readURL, a separate database for the read
+// replica. The reader is the same as the database when there isn't a read replica.
+func OpenWithReadReplica(ctx context.Context, urlstr string, open func(ctx context.Context, urlstr string) (*sql.DB, error)) (*sql.DB, *sql.DB, error) {
+	urlstr, readurl, err := SplitReadURL(urlstr)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := open(ctx, urlstr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if readurl == "" {
+		return db, db, nil
+	}
+	reader, err := open(ctx, readurl)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("error connecting to read replica: %w", err)
+	}
+	return db, reader, nil
+}
+
+// CloseWithReadReplica closes the database and the read replica if it's separate.
+func CloseWithReadReplica(db *sql.DB, reader *sql.DB) error {
+	if reader != nil && reader != db {
+		reader.Close()
+	}
+	return db.Close()
+}
+
+// parseDurationParam removes the query parameter from the connection url and returns its duration or the default when not provided.
+func parseDurationParam(urlstr string, name string, def time.Duration) (string, time.Duration, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return "", 0, fmt.Errorf("error parsing url: %w", err)
+	}
+	query := u.Query()
+	if !query.Has(name) {
+		return urlstr, def, nil
+	}
+	val, err := time.ParseDuration(query.Get(name))
+	if err != nil || val < 0 {
+		return "", 0, fmt.Errorf("invalid %s: %s", name, query.Get(name))
+	}
+	query.Del(name)
+	u.RawQuery = query.Encode()
+	return u.String(), val, nil
+}
+
+// ParseStatementTimeout removes the statementTimeout query parameter from the connection url and returns it or 0 when
+// not provided. The value is a duration such as 30s or 5m.
+func ParseStatementTimeout(urlstr string) (string, time.Duration, error) {
+	return parseDurationParam(urlstr, "statementTimeout", 0)
+}
+
+// ParsePingInterval removes the pingInterval query parameter from the connection url and returns it or the default when
+// not provided. A value of 0 disables the liveness check.
+func ParsePingInterval(urlstr string) (string, time.Duration, error) {
+	return parseDurationParam(urlstr, "pingInterval", DefaultPingInterval)
+}
+
+// StatementContext returns the context for running a statement which is cancelled with ctx or after the timeout when it's greater than 0.
+func StatementContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+const (
+	// DefaultPingInterval is how often the database connection is checked for liveness.
+	DefaultPingInterval = time.Second * 30
+
+	pingTimeout        = time.Second * 10
+	maxReconnectWait   = time.Minute
+	defaultMaxIdleConn = 2 // the database/sql default
+)
+
+// pingDBs pings each database, discarding its idle connections when the ping fails so they aren't reused once it's reachable again.
+func pingDBs(ctx context.Context, dbs []*sql.DB) error {
+	for _, db := range dbs {
+		pctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err := db.PingContext(pctx)
+		cancel()
+		if err != nil {
+			db.SetMaxIdleConns(-1) // closes the idle connections
+			db.SetMaxIdleConns(defaultMaxIdleConn)
+			return err
+		}
+	}
+	return nil
+}
+
+// MonitorConnection pings the databases on the interval until the context is cancelled. When a ping fails the stale
+// connections are discarded and the ping is retried with a backoff until the database is reachable again, so the
+// connection pool recovers on its own when the database is restarted.
+func MonitorConnection(ctx context.Context, logger logger.Logger, interval time.Duration, dbs ...*sql.DB) {
+	if interval <= 0 {
+		return
+	}
+	var unique []*sql.DB // the reader is the same as the db when there isn't a read replica
+	for _, db := range dbs {
+		if db != nil && !slices.Contains(unique, db) {
+			unique = append(unique, db)
+		}
+	}
+	wait := interval
+	var failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		err := pingDBs(ctx, unique)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			if failures > 0 {
+				logger.Info("database connection re-established after %d failed attempt(s)", failures)
+			}
+			failures = 0
+			wait = interval
+			continue
+		}
+		failures++
+		wait = time.Second * time.Duration(1<<min(failures-1, 6))
+		if wait > maxReconnectWait {
+			wait = maxReconnectWait
+		}
+		logger.Warn("database connection is not available (attempt: %d), retrying in %v: %s", failures, wait, err)
+	}
+}
+
+// FindTable returns the name of the table in the database schema ignoring case since some databases change the case of
+// unquoted identifiers.
+func FindTable(db internal.DatabaseSchema, table string) (string, bool) {
+	if _, ok := db[table]; ok {
+		return table, true
+	}
+	for name := range db {
+		if strings.EqualFold(name, table) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// csvValue formats a value scanned from a row for a CSV field. NULL is an empty field.
+func csvValue(val any) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	}
+	return fmt.Sprint(val)
+}
+
+// WriteCSVRows runs the query and writes the rows to w as CSV with a header row of the column names. It returns the
+// number of rows written.
+func WriteCSVRows(ctx context.Context, db *sql.DB, query string, w io.Writer) (int, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	out := csv.NewWriter(w)
+	if err := out.Write(columns); err != nil {
+		return 0, err
+	}
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	var count int
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		for i, val := range values {
+			record[i] = csvValue(val)
+		}
+		if err := out.Write(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	out.Flush()
+	return count, out.Error()
+}
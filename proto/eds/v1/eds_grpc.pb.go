@@ -0,0 +1,123 @@
+// The change event service implemented by customers receiving events from the eds grpc driver.
+//
+// The driver opens a single bidirectional stream and sends one EventBatch at a time. The service
+// must reply with a BatchAck for each batch once the events are durably stored. Events in a batch
+// are only acknowledged to Shopmonkey when success is true, otherwise the batch is redelivered.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: proto/eds/v1/eds.proto
+
+package edsv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ChangeEventService_Stream_FullMethodName = "/eds.v1.ChangeEventService/Stream"
+)
+
+// ChangeEventServiceClient is the client API for ChangeEventService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChangeEventServiceClient interface {
+	// Stream receives batches of change events and replies with an ack for each batch.
+	Stream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[EventBatch, BatchAck], error)
+}
+
+type changeEventServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChangeEventServiceClient(cc grpc.ClientConnInterface) ChangeEventServiceClient {
+	return &changeEventServiceClient{cc}
+}
+
+func (c *changeEventServiceClient) Stream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[EventBatch, BatchAck], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ChangeEventService_ServiceDesc.Streams[0], ChangeEventService_Stream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[EventBatch, BatchAck]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChangeEventService_StreamClient = grpc.BidiStreamingClient[EventBatch, BatchAck]
+
+// ChangeEventServiceServer is the server API for ChangeEventService service.
+// All implementations must embed UnimplementedChangeEventServiceServer
+// for forward compatibility.
+type ChangeEventServiceServer interface {
+	// Stream receives batches of change events and replies with an ack for each batch.
+	Stream(grpc.BidiStreamingServer[EventBatch, BatchAck]) error
+	mustEmbedUnimplementedChangeEventServiceServer()
+}
+
+// UnimplementedChangeEventServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedChangeEventServiceServer struct{}
+
+func (UnimplementedChangeEventServiceServer) Stream(grpc.BidiStreamingServer[EventBatch, BatchAck]) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedChangeEventServiceServer) mustEmbedUnimplementedChangeEventServiceServer() {}
+func (UnimplementedChangeEventServiceServer) testEmbeddedByValue()                            {}
+
+// UnsafeChangeEventServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChangeEventServiceServer will
+// result in compilation errors.
+type UnsafeChangeEventServiceServer interface {
+	mustEmbedUnimplementedChangeEventServiceServer()
+}
+
+func RegisterChangeEventServiceServer(s grpc.ServiceRegistrar, srv ChangeEventServiceServer) {
+	// If the following call pancis, it indicates UnimplementedChangeEventServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ChangeEventService_ServiceDesc, srv)
+}
+
+func _ChangeEventService_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ChangeEventServiceServer).Stream(&grpc.GenericServerStream[EventBatch, BatchAck]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChangeEventService_StreamServer = grpc.BidiStreamingServer[EventBatch, BatchAck]
+
+// ChangeEventService_ServiceDesc is the grpc.ServiceDesc for ChangeEventService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChangeEventService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "eds.v1.ChangeEventService",
+	HandlerType: (*ChangeEventServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _ChangeEventService_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/eds/v1/eds.proto",
+}